@@ -0,0 +1,228 @@
+// Command logcheck reports log calls that could write secrets in plaintext: zap fields whose
+// name hints at a secret the redaction of utils/logger does not recognize, and secret
+// configuration values passed to unredacted fields or printed with fmt and log.
+//
+//	go run ./cmd/logcheck [dir]
+//
+// It exits with status 1 when it finds any.
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+)
+
+// skippedDirs are not Go sources of the server
+var skippedDirs = map[string]bool{
+	".git":         true,
+	"frontend":     true,
+	"node_modules": true,
+	"static":       true,
+	"vendor":       true,
+}
+
+// hintWords in a field name suggest it may hold a secret
+var hintWords = map[string]bool{
+	"key":     true,
+	"keys":    true,
+	"pass":    true,
+	"pwd":     true,
+	"sig":     true,
+	"jwt":     true,
+	"bearer":  true,
+	"session": true,
+}
+
+// plainFields are field names with a hint word that hold no secret: storage and API key IDs
+// and key counts
+var plainFields = map[string]bool{
+	"key":                true,
+	"total_keys":         true,
+	"sample_keys":        true,
+	"cache_keys_cleared": true,
+}
+
+// secretSuffixes end the names of configuration fields and variables holding secrets
+// (S3SecretKey, RedisPassword, IngestWebhookToken)
+var secretSuffixes = []string{"Password", "Secret", "SecretKey", "AccessKey", "AccountKey", "APIKey", "Token"}
+
+// printFuncs print their arguments unredacted, by package
+var printFuncs = map[string]map[string]bool{
+	"fmt": {"Print": true, "Printf": true, "Println": true, "Fprint": true, "Fprintf": true, "Fprintln": true},
+	"log": {"Print": true, "Printf": true, "Println": true, "Fatal": true, "Fatalf": true, "Fatalln": true, "Panic": true, "Panicf": true, "Panicln": true},
+}
+
+type finding struct {
+	pos token.Position
+	msg string
+}
+
+func main() {
+	root := "."
+	if len(os.Args) > 1 {
+		root = os.Args[1]
+	}
+
+	findings, err := checkDir(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logcheck: %v\n", err)
+		os.Exit(2)
+	}
+
+	for _, f := range findings {
+		fmt.Printf("%s: %s\n", f.pos, f.msg)
+	}
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkDir reports the findings of every Go source file below root, tests excluded
+func checkDir(root string) ([]finding, error) {
+	var findings []finding
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && skippedDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, checkFile(fset, file)...)
+		return nil
+	})
+	return findings, err
+}
+
+// checkFile reports the zap fields and print calls of a file that could write secrets
+func checkFile(fset *token.FileSet, file *ast.File) []finding {
+	var findings []finding
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		pkg, name := calledFunc(call)
+		switch {
+		case pkg == "zap" && len(call.Args) > 0:
+			key, ok := stringLiteral(call.Args[0])
+			if !ok {
+				return true
+			}
+			if logger.SensitiveField(key) {
+				// Redacted as a whole, whatever its value
+				return true
+			}
+			if hintsSecret(key) && !plainFields[key] {
+				findings = append(findings, finding{fset.Position(call.Pos()),
+					fmt.Sprintf("field %q may hold a secret: rename it so utils/logger redacts it, or add it to plainFields", key)})
+			}
+			for _, arg := range call.Args[1:] {
+				if secret := secretValue(arg); secret != "" {
+					findings = append(findings, finding{fset.Position(arg.Pos()),
+						fmt.Sprintf("%s logged in plaintext as field %q", secret, key)})
+				}
+			}
+		case printFuncs[pkg][name]:
+			for _, arg := range call.Args {
+				if secret := secretValue(arg); secret != "" {
+					findings = append(findings, finding{fset.Position(arg.Pos()),
+						fmt.Sprintf("%s printed in plaintext by %s.%s", secret, pkg, name)})
+				}
+			}
+		}
+		return true
+	})
+	return findings
+}
+
+// calledFunc returns the package and name of a call of a package function
+func calledFunc(call *ast.CallExpr) (string, string) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", ""
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", ""
+	}
+	return pkg.Name, sel.Sel.Name
+}
+
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	value, err := strconv.Unquote(lit.Value)
+	return value, err == nil
+}
+
+// hintsSecret reports whether a field name contains a word suggesting a secret
+func hintsSecret(key string) bool {
+	for _, word := range strings.FieldsFunc(strings.ToLower(key), func(r rune) bool {
+		return r == '_' || r == '-' || r == '.'
+	}) {
+		if hintWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// secretValue returns the name of a secret an expression reads, such as cfg.S3SecretKey, or
+// an empty string. Values passed through a call (len, logger.Redact) are not the secret itself.
+func secretValue(expr ast.Expr) string {
+	var secret string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if secret != "" {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			return false
+		case *ast.SelectorExpr:
+			if isSecretName(n.Sel.Name) {
+				secret = n.Sel.Name
+				if x, ok := n.X.(*ast.Ident); ok {
+					secret = x.Name + "." + n.Sel.Name
+				}
+				return false
+			}
+		case *ast.Ident:
+			if isSecretName(n.Name) {
+				secret = n.Name
+			}
+		}
+		return true
+	})
+	return secret
+}
+
+func isSecretName(name string) bool {
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
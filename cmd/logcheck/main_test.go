@@ -0,0 +1,47 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// TestModule fails on every log call of the module that could write a secret in plaintext, so
+// go test ./... holds the same guarantee as the release workflows
+func TestModule(t *testing.T) {
+	findings, err := checkDir("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range findings {
+		t.Errorf("%s: %s", f.pos, f.msg)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		findings int
+	}{
+		{"redacted field", `logger.Info("login", zap.String("password", p))`, 0},
+		{"storage key field", `logger.Info("stored", zap.String("key", k))`, 0},
+		{"unrecognized secret field", `logger.Info("signed", zap.String("sig_value", s))`, 1},
+		{"secret config value", `logger.Info("connect", zap.String("endpoint", cfg.RedisPassword))`, 1},
+		{"secret length", `logger.Info("connect", zap.Int("length", len(cfg.RedisPassword)))`, 0},
+		{"printed secret", `fmt.Printf("token %s\n", cfg.IngestWebhookToken)`, 1},
+		{"logged secret", `log.Println(apiKey, cfg.S3SecretKey)`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "sample.go", "package sample\nfunc f() {\n"+tt.src+"\n}\n", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if findings := checkFile(fset, file); len(findings) != tt.findings {
+				t.Errorf("got %d findings, want %d: %v", len(findings), tt.findings, findings)
+			}
+		})
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
@@ -16,6 +19,12 @@ func main() {
 	// Parse command-line flags
 	forceFlag := flag.Bool("force", false, "Force migration even if it was already completed")
 	envFile := flag.String("env", ".env", "Path to .env file")
+	keysFlag := flag.Bool("keys", false, "Move stored objects to the configured STORAGE_KEY_LAYOUT instead of migrating metadata")
+	reencodeFlag := flag.Bool("reencode-metadata", false, "Rewrite all metadata in the configured METADATA_ENCODING instead of migrating metadata")
+	statsFlag := flag.Bool("redis-stats", false, "Report Redis memory usage per key type instead of migrating metadata")
+	orientationFlag := flag.Bool("reclassify-orientation", false, "Recompute image orientations from pixel data and move misclassified images instead of migrating metadata")
+	thumbnailsFlag := flag.Bool("thumbnails", false, "Generate missing thumbnails of the configured THUMBNAIL_SIZES instead of migrating metadata")
+	prefixFrom := flag.String("redis-prefix-from", "", "Rename Redis keys from this prefix to the configured REDIS_PREFIX instead of migrating metadata")
 	flag.Parse()
 
 	// Load environment variables
@@ -45,6 +54,57 @@ func main() {
 		log.Fatalf("Redis metadata store is not properly initialized")
 	}
 
+	// Prefix migration only touches Redis
+	if *prefixFrom != "" {
+		ctx := context.Background()
+		log.Printf("Renaming Redis keys from %s to %s...", *prefixFrom, utils.RedisPrefix)
+		renamed, err := utils.MigrateRedisPrefix(ctx, *prefixFrom)
+		if err != nil {
+			log.Fatalf("Redis prefix migration failed after %d keys: %v", renamed, err)
+		}
+		log.Printf("Redis prefix migration completed, %d keys renamed", renamed)
+
+		// Record the new prefix so instances using the old one refuse to start
+		cfg.ClusterReconfigure = true
+		if _, err := utils.RegisterClusterState(ctx, cfg); err != nil {
+			log.Printf("Warning: Failed to update cluster state: %v", err)
+		}
+		return
+	}
+
+	// Memory report, read only
+	if *statsFlag {
+		stats, err := utils.RedisMemoryStats(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to collect Redis memory stats: %v", err)
+		}
+		var totalKeys, totalBytes int64
+		fmt.Printf("%-20s %10s %14s  %s\n", "TYPE", "KEYS", "BYTES", "ENCODINGS")
+		for _, s := range stats {
+			encodings := make([]string, 0, len(s.Encodings))
+			for encoding, count := range s.Encodings {
+				encodings = append(encodings, fmt.Sprintf("%s=%d", encoding, count))
+			}
+			sort.Strings(encodings)
+			fmt.Printf("%-20s %10d %14d  %s\n", s.Type, s.Keys, s.Bytes, strings.Join(encodings, " "))
+			totalKeys += s.Keys
+			totalBytes += s.Bytes
+		}
+		fmt.Printf("%-20s %10d %14d\n", "TOTAL", totalKeys, totalBytes)
+		return
+	}
+
+	// Metadata re-encoding only touches Redis
+	if *reencodeFlag {
+		log.Printf("Rewriting metadata with %s encoding...", cfg.MetadataEncoding)
+		rewritten, err := utils.ReencodeMetadata(context.Background())
+		if err != nil {
+			log.Fatalf("Metadata re-encoding failed after %d images: %v", rewritten, err)
+		}
+		log.Printf("Metadata re-encoding completed, %d images rewritten", rewritten)
+		return
+	}
+
 	// Initialize storage provider based on storage type
 	log.Printf("Storage type: %s", cfg.StorageType)
 
@@ -60,8 +120,54 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
-	// Check if migration was already completed
 	ctx := context.Background()
+
+	// Key layout migration moves existing objects and rewrites their metadata paths
+	if *keysFlag {
+		utils.MetadataManager = utils.NewRedisMetadataStore()
+		log.Printf("Migrating object keys to %s layout...", cfg.KeyLayout)
+		moved, err := utils.MigrateKeyLayout(ctx, cfg.KeyLayout)
+		total := 0
+		for tenant, n := range moved {
+			if tenant == "" {
+				tenant = "default"
+			}
+			log.Printf("Tenant %s: %d images moved", tenant, n)
+			total += n
+		}
+		if err != nil {
+			log.Fatalf("Key layout migration failed after %d images: %v", total, err)
+		}
+		log.Printf("Key layout migration completed, %d images moved", total)
+		return
+	}
+
+	// Orientation reclassification reads every original and moves misclassified images
+	if *orientationFlag {
+		utils.MetadataManager = utils.NewRedisMetadataStore()
+		log.Printf("Reclassifying image orientations...")
+		reclassified, err := utils.ReclassifyOrientations(ctx)
+		if err != nil {
+			log.Fatalf("Orientation reclassification failed after %d images: %v", reclassified, err)
+		}
+		log.Printf("Orientation reclassification completed, %d images reclassified", reclassified)
+		return
+	}
+
+	// Thumbnail backfill reads every original lacking a configured thumbnail
+	if *thumbnailsFlag {
+		utils.MetadataManager = utils.NewRedisMetadataStore()
+		utils.InitVips(cfg)
+		log.Printf("Generating missing thumbnails (%v)...", cfg.ThumbnailSizes)
+		updated, err := utils.BackfillThumbnails(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Thumbnail backfill failed after %d images: %v", updated, err)
+		}
+		log.Printf("Thumbnail backfill completed, %d images updated", updated)
+		return
+	}
+
+	// Check if migration was already completed
 	migrationKey := utils.RedisPrefix + "migration_completed"
 
 	if !*forceFlag {
@@ -3,8 +3,10 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -19,48 +21,316 @@ const (
 	StorageTypeLocal StorageType = "local"
 	// StorageTypeS3 represents S3 compatible storage
 	StorageTypeS3 StorageType = "s3"
+	// StorageTypeAzure represents Azure Blob Storage
+	StorageTypeAzure StorageType = "azure"
 	// StorageTypeDefault is the default storage type
 	StorageTypeDefault = StorageTypeLocal
 )
 
+// KeyLayout defines how object keys are laid out in the storage backend
+type KeyLayout string
+
+const (
+	// KeyLayoutFlat stores every object of a kind in a single directory (e.g. landscape/webp/<id>.webp)
+	KeyLayoutFlat KeyLayout = "flat"
+	// KeyLayoutSharded adds a two-level ID hash prefix (e.g. landscape/webp/ab/cd/<id>.webp)
+	KeyLayoutSharded KeyLayout = "sharded"
+	// KeyLayoutDefault is the default key layout
+	KeyLayoutDefault = KeyLayoutFlat
+)
+
+// OutputFormat is a derived format generated for uploads, with the quality it is encoded at
+type OutputFormat struct {
+	Format  string `json:"format"`  // webp or avif
+	Quality int    `json:"quality"` // Encoding quality (1-100), 0 for IMAGE_QUALITY
+}
+
+// SupportedOutputFormats lists the derived formats the encoder can generate
+var SupportedOutputFormats = []string{"webp", "avif"}
+
+// Log sinks entries can be written to
+const (
+	LogSinkFile   = "file"   // Rotated JSON file at LOG_FILE
+	LogSinkStdout = "stdout" // JSON lines on stdout, for container platforms collecting them
+	LogSinkSyslog = "syslog" // Local or remote syslog
+	LogSinkLoki   = "loki"   // Grafana Loki push API
+)
+
+// SupportedLogSinks lists the log sinks LOG_SINKS accepts
+var SupportedLogSinks = []string{LogSinkFile, LogSinkStdout, LogSinkSyslog, LogSinkLoki}
+
+// OCREngine defines how text is extracted from uploaded images
+type OCREngine string
+
+const (
+	// OCREngineNone disables text extraction
+	OCREngineNone OCREngine = ""
+	// OCREngineTesseract runs the local tesseract binary
+	OCREngineTesseract OCREngine = "tesseract"
+	// OCREngineAPI calls an external OCR service
+	OCREngineAPI OCREngine = "api"
+)
+
+// SearchEngine defines the external search engine the library is indexed in
+type SearchEngine string
+
+const (
+	// SearchEngineNone disables the external search index
+	SearchEngineNone SearchEngine = ""
+	// SearchEngineMeilisearch indexes the library in Meilisearch
+	SearchEngineMeilisearch SearchEngine = "meilisearch"
+	// SearchEngineElasticsearch indexes the library in Elasticsearch
+	SearchEngineElasticsearch SearchEngine = "elasticsearch"
+)
+
 // MetadataStoreType defines the type of metadata storage backend
 type MetadataStoreType string
 
 const (
 	// MetadataStoreTypeRedis represents Redis metadata storage
 	MetadataStoreTypeRedis MetadataStoreType = "redis"
+	// MetadataStoreTypeSQLite represents an embedded SQLite database, for single-node deployments
+	MetadataStoreTypeSQLite MetadataStoreType = "sqlite"
 	// MetadataStoreTypeDefault is the default metadata storage type
 	MetadataStoreTypeDefault = MetadataStoreTypeRedis
 )
 
+// MetadataEncoding defines how image metadata is laid out in its Redis hash
+type MetadataEncoding string
+
+const (
+	// MetadataEncodingHash stores every metadata field as a readable hash field
+	MetadataEncodingHash MetadataEncoding = "hash"
+	// MetadataEncodingCompact packs the fields that rarely change into a single binary value
+	MetadataEncodingCompact MetadataEncoding = "compact"
+	// MetadataEncodingDefault is the default metadata encoding
+	MetadataEncodingDefault = MetadataEncodingHash
+)
+
 // Config stores the application configuration
 type Config struct {
 	// Server settings
 	ServerAddr      string `json:"server_addr"`     // Server listen address
+	PublicURL       string `json:"public_url"`      // Public base URL of this server, used for absolute links
 	ImageBasePath   string `json:"image_base_path"` // Base path for image storage
 	AvifSupport     bool   `json:"avif_support"`    // Whether AVIF format is supported
 	APIKey          string // API key for authentication
 	MaxUploadCount  int    `json:"max_upload_count"` // Maximum number of images allowed in single upload
+	MaxFileSize     int    `json:"max_file_size"`    // Largest file accepted by multipart uploads in MB, 0 for no limit
+	MaxMegapixels   int    `json:"max_megapixels"`   // Most megapixels of an uploaded image, 0 for no limit
 	ImageQuality    int    `json:"image_quality"`    // Image conversion quality (1-100)
 	WorkerThreads   int    `json:"worker_threads"`   // Number of parallel worker threads
 	Speed           int    `json:"speed"`            // Encoding speed (0-8, 0=slowest/highest quality)
 	WorkerPoolSize  int    `json:"worker_pool_size"` // Size of worker pool for concurrent image processing
 	DebugMode       bool   `json:"debug_mode"`       // Whether debug mode is enabled
 	CleanupInterval int    `json:"cleanup_interval"` // Interval in minutes for cleaning expired images
+	ReadReplica     bool   `json:"read_replica"`     // Serve reads from the shared storage and Redis only, rejecting mutations
+
+	// Log settings, switchable at runtime through /api/logging, SIGUSR1 and SIGUSR2
+	LogLevel   string            `json:"log_level"`   // Global log level (debug, info, warn or error); DEBUG_MODE forces debug
+	LogModules map[string]string `json:"log_modules"` // Levels of modules (packages or file name prefixes) overriding the global level
+
+	// Log volume settings
+	LogSamplingFirst      int            `json:"log_sampling_first"`      // Entries per second logged for each message below warn before sampling (0 disables sampling)
+	LogSamplingThereafter int            `json:"log_sampling_thereafter"` // Every Nth further entry of a message logged within the second (0 drops them)
+	LogRateLimits         map[string]int `json:"log_rate_limits"`         // Entries per message and minute of hot path categories (conversion, serve)
+
+	// Log sink settings
+	LogSinks     []string          `json:"log_sinks"`     // Where entries are written: file, stdout, syslog and loki
+	LogFile      string            `json:"log_file"`      // File of the file sink, rotated at 100MB
+	SyslogAddr   string            `json:"syslog_addr"`   // Syslog server as network://host:port, empty for the local syslog
+	SyslogTag    string            `json:"syslog_tag"`    // Tag of syslog messages
+	LokiURL      string            `json:"loki_url"`      // Base URL of the Loki server entries are pushed to
+	LokiLabels   map[string]string `json:"loki_labels"`   // Stream labels of pushed entries, besides level
+	LokiTenant   string            `json:"loki_tenant"`   // X-Scope-OrgID of a multi-tenant Loki
+	LokiUsername string            `json:"loki_username"` // Basic auth user, e.g. of Grafana Cloud
+	LokiPassword string            `json:"-"`             // Basic auth password or API token
+
+	// TLS settings (serve HTTPS directly instead of behind a proxy)
+	TLSCertFile string `json:"tls_cert_file"` // Default certificate file
+	TLSKeyFile  string `json:"tls_key_file"`  // Default private key file
+	TLSCertDir  string `json:"tls_cert_dir"`  // Directory of per-domain certificates (<host>.crt and <host>.key), selected by SNI
+
+	// Visibility and public gallery settings
+	DefaultVisibility    string `json:"default_visibility"`     // Visibility of new uploads (public, unlisted or private)
+	PublicGalleryEnabled bool   `json:"public_gallery_enabled"` // Whether the anonymous gallery API is enabled
+	PublicRateLimit      int    `json:"public_rate_limit"`      // Requests per minute per client on public gallery endpoints
+	PublicStatsEnabled   bool   `json:"public_stats_enabled"`   // Whether the anonymous /stats.json is served
+	CommentsEnabled      bool   `json:"comments_enabled"`       // Whether anonymous comments on images are accepted
+	SigningSecret        string `json:"-"`                      // Secret signing URLs of private images (the API key when empty)
+	SignedURLTTL         int    `json:"signed_url_ttl"`         // Default lifetime in seconds of URLs issued by /api/sign
+	SignedURLMaxTTL      int    `json:"signed_url_max_ttl"`     // Longest lifetime in seconds of URLs issued by /api/sign
+
+	// Feature flags
+	FeatureFlags map[string]bool `json:"feature_flags"` // Deployment defaults of optional subsystems, overridable at runtime by the admin
+
+	// API rate limit settings
+	RandomRateLimit int    `json:"random_rate_limit"` // Requests per minute per client on /api/random (0 disables limiting)
+	UploadRateLimit int    `json:"upload_rate_limit"` // Upload requests per hour per client on /api/upload and /api/upload-url (0 disables limiting)
+	RateLimitBy     string `json:"rate_limit_by"`     // What tells clients apart: key (API key, else IP), ip or both
+
+	// Random image settings
+	RandomSessionTTL int `json:"random_session_ttl"` // Minutes an idle no-repeat session of /api/random is remembered
+
+	// Image list settings
+	ListDefaultLimit int `json:"list_default_limit"` // Images per page of the list APIs when the request sets no limit
+	ListMaxLimit     int `json:"list_max_limit"`     // Largest limit accepted by the list APIs
+	ListIDsMaxLimit  int `json:"list_ids_max_limit"` // Largest limit accepted for ids-only pages (fields=ids)
+
+	// Change feed settings
+	ChangeFeedMaxLength int `json:"change_feed_max_length"` // Changes kept per tenant in the change feed of /api/changes
+
+	// Access analytics settings
+	ServeStatsFlushInterval int `json:"serve_stats_flush_interval"` // Seconds between flushes of serve counts into the metadata
+
+	// Conversion queue settings
+	ConversionWorkers int `json:"conversion_workers"` // Jobs of async uploads converted at once by this instance
+
+	// Self-test settings
+	SelfTestInterval   int    `json:"selftest_interval"` // Minutes between self-test runs (0 disables the self-test)
+	SelfTestURL        string `json:"selftest_url"`      // Base URL of the API the self-test requests (empty = listen address on loopback)
+	SelfTestWebhookURL string `json:"-"`                 // Webhook alerted when the self-test starts failing and when it recovers
+
+	// Tracing settings (OpenTelemetry)
+	TracingEndpoint    string            `json:"tracing_endpoint"`     // OTLP/HTTP traces endpoint receiving spans (empty disables tracing)
+	TracingHeaders     map[string]string `json:"-"`                    // Headers sent with every export, e.g. collector credentials
+	TracingServiceName string            `json:"tracing_service_name"` // service.name resource attribute of exported spans
+	TracingSampleRatio float64           `json:"tracing_sample_ratio"` // Share of requests traced when the caller sent no traceparent
+
+	// Extension hook settings
+	HooksFile   string   `json:"hooks_file"`   // JSON file with webhook and script hooks run at extension points
+	HookPlugins []string `json:"hook_plugins"` // Go plugins (.so) registering hooks when loaded
+
+	// Routing script settings
+	RoutingScript string `json:"routing_script"` // Lua script rewriting random image requests, e.g. by time of day
+
+	// GeoIP settings
+	GeoIPDatabase string `json:"geoip_database"` // MaxMind Country or City database (.mmdb) locating random image clients
+	GeoRulesFile  string `json:"geo_rules_file"` // JSON file mapping countries, regions and continents to random image tags
+
+	// Language settings
+	LanguageRulesFile string `json:"language_rules_file"` // JSON file mapping Accept-Language languages to random image tags
+
+	// Device detection settings
+	DeviceRulesFile string `json:"device_rules_file"` // JSON file with User-Agent patterns classifying devices ahead of the built-in detection
+
+	// WASM plugin settings
+	WasmPluginsFile string `json:"wasm_plugins_file"` // JSON file with sandboxed WASM modules transforming or tagging uploads
+
+	// Upload by URL settings
+	RemoteUploadMaxSize      int  `json:"remote_upload_max_size"`      // Largest remote image in MB fetched by /api/upload-url
+	RemoteUploadTimeout      int  `json:"remote_upload_timeout"`       // Timeout in seconds for fetching a remote image
+	RemoteUploadAllowPrivate bool `json:"remote_upload_allow_private"` // Whether URLs may resolve to loopback or private network addresses
+
+	// Resumable upload settings
+	UploadSessionPath      string `json:"upload_session_path"`       // Directory holding the data of resumable uploads in progress
+	UploadSessionTTL       int    `json:"upload_session_ttl"`        // Hours without activity before a resumable upload is removed
+	ResumableUploadMaxSize int    `json:"resumable_upload_max_size"` // Largest resumable upload in MB
+
+	// Processing profile settings
+	ProfilesFile       string `json:"profiles_file"`        // JSON file with custom processing profiles
+	MaxResizeDimension int    `json:"max_resize_dimension"` // Largest width or height accepted for on-the-fly resizing
+	ResizeSizes        []int  `json:"resize_sizes"`         // Widths and heights anonymous clients may resize to
+	DeviceSizing       bool   `json:"device_sizing"`        // Whether random images without w or h are resized to the client's screen
+	ThumbnailSizes     []int  `json:"thumbnail_sizes"`      // Boxes in pixels of the WebP thumbnails generated at upload
+
+	// Output format settings
+	OutputFormats []OutputFormat `json:"output_formats"` // Derived formats generated for uploads, with their quality
+
+	// Ingest size settings
+	MaxImageDimension int  `json:"max_image_dimension"` // Largest width or height converted as uploaded; larger images are downscaled first, 0 for no limit
+	DownscaleOriginal bool `json:"downscale_original"`  // Whether downscaled images also replace the stored original
+
+	// Upload concurrency settings
+	MaxConcurrentUploads int `json:"max_concurrent_uploads"` // Uploaded files processed at once by this instance, 0 for no limit
+	UploadQueueSize      int `json:"upload_queue_size"`      // Uploaded files waiting for a slot before uploads are rejected with 503
+
+	// Privacy settings
+	StripEXIF bool `json:"strip_exif"` // Whether EXIF, XMP and other embedded metadata are removed from uploaded originals
+
+	// Video settings
+	VideoSupport     bool `json:"video_support"`      // Whether short MP4/WebM clips are accepted, which needs ffmpeg and ffprobe
+	MaxVideoDuration int  `json:"max_video_duration"` // Longest clip accepted, in seconds
+
+	// SVG settings
+	SVGSupport bool `json:"svg_support"` // Whether SVG images are accepted; they are sanitized and rendered to raster previews
+
+	// Deduplication settings
+	DedupeUploads bool `json:"dedupe_uploads"` // Whether uploads identical to a stored image return it by default instead of storing a copy
+
+	// Watermark settings, for the WebP and AVIF variants of uploads
+	WatermarkText     string  `json:"watermark_text"`     // Text drawn as the watermark (empty with no image disables watermarks)
+	WatermarkImage    string  `json:"watermark_image"`    // PNG file drawn as the watermark instead of the text
+	WatermarkPosition string  `json:"watermark_position"` // top-left, top-right, bottom-left, bottom-right or center
+	WatermarkOpacity  float64 `json:"watermark_opacity"`  // Opacity of the watermark (0-1)
+	WatermarkSize     float64 `json:"watermark_size"`     // Width of the watermark as a fraction of the image width
+
+	// Screenshot settings
+	ScreenshotDetection     bool `json:"screenshot_detection"`      // Whether PNGs with screen-sized dimensions use the screenshot profile
+	ScreenshotExpiryMinutes int  `json:"screenshot_expiry_minutes"` // Default expiry of screenshots in minutes (0 = never)
+
+	// Semantic search settings
+	EmbeddingServiceURL string `json:"embedding_service_url"` // Endpoint of the external embedding model (empty disables semantic search)
+	EmbeddingAPIKey     string `json:"-"`                     // Optional bearer token for the embedding service
+	EmbeddingTimeout    int    `json:"embedding_timeout"`     // Timeout in seconds for embedding requests
+
+	// OCR settings
+	OCREngine    OCREngine `json:"ocr_engine"`    // Text extraction engine (empty, tesseract or api)
+	OCRLanguages string    `json:"ocr_languages"` // Tesseract language codes, e.g. eng+chi_sim
+	OCRAPIURL    string    `json:"ocr_api_url"`   // Endpoint of the external OCR service
+	OCRAPIKey    string    `json:"-"`             // Optional bearer token for the OCR service
+	OCRTimeout   int       `json:"ocr_timeout"`   // Timeout in seconds for a single OCR run
+
+	// External search engine settings
+	SearchEngine       SearchEngine `json:"search_engine"`        // Engine the library is indexed in (empty, meilisearch or elasticsearch)
+	SearchEngineURL    string       `json:"search_engine_url"`    // Base URL of the search engine
+	SearchEngineAPIKey string       `json:"-"`                    // Optional API key of the search engine
+	SearchIndex        string       `json:"search_index"`         // Name of the index holding the images
+	SearchSyncInterval int          `json:"search_sync_interval"` // Seconds between polls of the change feed
+
+	// Sync settings
+	SyncSourcesFile string `json:"sync_sources_file"` // JSON file with remote sources mirrored into the library
+	SyncInterval    int    `json:"sync_interval"`     // Interval in minutes between source syncs
+
+	// Replication settings
+	ReplicationPeerURL     string `json:"replication_peer_url"`     // Base URL of a standby ImageFlow instance receiving every change
+	ReplicationPeerAPIKey  string `json:"-"`                        // API key of the standby instance
+	ReplicationS3Endpoint  string `json:"replication_s3_endpoint"`  // Endpoint of the replication bucket (empty = AWS)
+	ReplicationS3Region    string `json:"replication_s3_region"`    // Region of the replication bucket
+	ReplicationS3Bucket    string `json:"replication_s3_bucket"`    // Bucket receiving every change when no peer is configured
+	ReplicationS3AccessKey string `json:"-"`                        // Access key of the replication bucket
+	ReplicationS3SecretKey string `json:"-"`                        // Secret key of the replication bucket
+	ReplicationMaxAttempts int    `json:"replication_max_attempts"` // Attempts before a replication job is parked as failed
+
+	// S3 event ingestion settings
+	IngestPrefix       string `json:"ingest_prefix"`        // Bucket prefix whose new objects are imported (empty disables ingestion)
+	IngestWebhookToken string `json:"-"`                    // Token required by the S3 event webhook
+	IngestSQSQueueURL  string `json:"ingest_sqs_queue_url"` // SQS queue receiving the bucket's event notifications
+	IngestKeepSource   bool   `json:"ingest_keep_source"`   // Keep imported objects under the ingest prefix instead of deleting them
 
 	// Storage settings
 	StorageType  StorageType `json:"storage_type"`  // Type of storage backend to use
 	CustomDomain string      `json:"custom_domain"` // Custom domain for S3 storage
+	KeyLayout    KeyLayout   `json:"key_layout"`    // Object key layout (flat or sharded)
 
 	// Metadata storage settings
 	MetadataStoreType MetadataStoreType `json:"metadata_store_type"` // Type of metadata storage to use
+	MetadataEncoding  MetadataEncoding  `json:"metadata_encoding"`   // Layout of metadata in Redis (hash or compact)
+	SQLitePath        string            `json:"sqlite_path"`         // SQLite database file (default: metadata.db in the image directory)
 
 	// Redis settings
-	RedisHost     string `json:"redis_host"` // Redis server host
-	RedisPort     string `json:"redis_port"` // Redis server port
-	RedisPassword string `json:"-"`          // Redis password
-	RedisDB       int    `json:"redis_db"`   // Redis database number
-	RedisTLS      bool   `json:"redis_tls"`  // Whether to use TLS for Redis connection
+	RedisHost     string `json:"redis_host"`   // Redis server host
+	RedisPort     string `json:"redis_port"`   // Redis server port
+	RedisPassword string `json:"-"`            // Redis password
+	RedisDB       int    `json:"redis_db"`     // Redis database number
+	RedisTLS      bool   `json:"redis_tls"`    // Whether to use TLS for Redis connection
+	RedisPrefix   string `json:"redis_prefix"` // Prefix of every Redis key
+
+	// Cluster settings
+	ClusterReconfigure bool `json:"cluster_reconfigure"` // Replace the storage configuration recorded in Redis when it differs
+
+	// Expiry settings
+	ExpiryNotifications bool `json:"expiry_notifications"` // Delete images when Redis expires their shadow key instead of waiting for the cleaner
 
 	// S3 settings
 	S3Endpoint       string `json:"s3_endpoint"`         // S3 endpoint
@@ -70,6 +340,20 @@ type Config struct {
 	S3SecretKey      string `json:"-"`                   // S3 secret key
 	S3Enabled        bool   `json:"s3_enabled"`          // Whether S3 storage is enabled
 	S3ForcePathStyle bool   `json:"s3_force_path_style"` // Use path style S3 URLs
+
+	// Azure Blob Storage settings
+	AzureAccount    string `json:"azure_account"`   // Storage account name
+	AzureAccountKey string `json:"-"`               // Storage account access key (base64)
+	AzureContainer  string `json:"azure_container"` // Blob container name
+	AzureEndpoint   string `json:"azure_endpoint"`  // Blob service endpoint (defaults to https://<account>.blob.core.windows.net)
+}
+
+// AzureBlobEndpoint returns the Blob service endpoint of the configured storage account
+func (c *Config) AzureBlobEndpoint() string {
+	if c.AzureEndpoint != "" {
+		return strings.TrimSuffix(c.AzureEndpoint, "/")
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net", c.AzureAccount)
 }
 
 // GetBaseURL returns the base URL for image access based on storage configuration
@@ -80,45 +364,153 @@ func (c *Config) GetBaseURL() string {
 		}
 		return fmt.Sprintf("%s/%s", strings.TrimSuffix(c.S3Endpoint, "/"), c.S3Bucket)
 	}
+	if c.StorageType == StorageTypeAzure {
+		if c.CustomDomain != "" {
+			return strings.TrimSuffix(c.CustomDomain, "/")
+		}
+		return fmt.Sprintf("%s/%s", c.AzureBlobEndpoint(), c.AzureContainer)
+	}
 	return "/images"
 }
 
+// TLSEnabled reports whether the server terminates TLS itself
+func (c *Config) TLSEnabled() bool {
+	return (c.TLSCertFile != "" && c.TLSKeyFile != "") || c.TLSCertDir != ""
+}
+
+// OutputFormatNames returns the derived formats generated for uploads, in configured order
+func (c *Config) OutputFormatNames() []string {
+	names := make([]string, 0, len(c.OutputFormats))
+	for _, format := range c.OutputFormats {
+		names = append(names, format.Format)
+	}
+	return names
+}
+
+// OutputQuality returns the quality a derived format is encoded at: its quality in
+// OUTPUT_FORMATS, else IMAGE_QUALITY
+func (c *Config) OutputQuality(format string) int {
+	for _, output := range c.OutputFormats {
+		if output.Format == format && output.Quality > 0 {
+			return output.Quality
+		}
+	}
+	return c.ImageQuality
+}
+
+// IngestEnabled reports whether objects uploaded directly to the bucket are imported
+func (c *Config) IngestEnabled() bool {
+	return c.StorageType == StorageTypeS3 && c.IngestPrefix != ""
+}
+
 // ClientConfig represents the configuration exposed to clients
 type ClientConfig struct {
 	MaxUploadCount int  `json:"maxUploadCount"` // Maximum number of images allowed per upload
+	MaxFileSize    int  `json:"maxFileSize"`    // Largest file accepted per upload in MB, 0 for no limit
+	MaxMegapixels  int  `json:"maxMegapixels"`  // Most megapixels of an uploaded image, 0 for no limit
 	ImageQuality   int  `json:"imageQuality"`   // Image conversion quality (1-100)
 	Speed          int  `json:"speed"`          // Encoding speed (0-8, 0=slowest/highest quality)
 	AvifSupport    bool `json:"avifSupport"`    // Whether AVIF format is supported
+	ReadOnly       bool `json:"readOnly"`       // Whether this instance rejects uploads and other changes
 }
 
 // GetClientConfig returns configuration that can be exposed to clients
 func (c *Config) GetClientConfig() ClientConfig {
 	return ClientConfig{
 		MaxUploadCount: c.MaxUploadCount,
+		MaxFileSize:    c.MaxFileSize,
+		MaxMegapixels:  c.MaxMegapixels,
 		ImageQuality:   c.ImageQuality,
 		Speed:          c.Speed,
 		AvifSupport:    c.AvifSupport,
+		ReadOnly:       c.ReadReplica,
 	}
 }
 
+// defaultResizeSizes are the RESIZE_SIZES of common layouts, video heights and the width steps of
+// device sizing
+var defaultResizeSizes = []int{128, 256, 320, 480, 512, 600, 640, 720, 800, 960, 1024, 1080, 1280, 1600, 1920, 2560, 3840}
+
 // Load loads configuration from environment variables and config file
 func Load() (*Config, error) {
 	// Default configuration
 	cfg := &Config{
-		ServerAddr:      "0.0.0.0:8686",
-		ImageBasePath:   os.Getenv("LOCAL_STORAGE_PATH"),
-		AvifSupport:     true,
-		MaxUploadCount:  20,                 // Default max upload: 20 images
-		ImageQuality:    75,                 // Default quality: 75
-		WorkerThreads:   4,                  // Default workers: 4 threads
-		Speed:           5,                  // Default speed: 5 (medium)
-		WorkerPoolSize:  10,                 // Default worker pool size: 10 concurrent tasks
-		StorageType:     StorageTypeDefault, // Default to local storage
-		DebugMode:       false,              // Default debug mode off
-		CleanupInterval: 1,                  // Default cleanup interval: 1 minute
+		ServerAddr:              "0.0.0.0:8686",
+		ImageBasePath:           os.Getenv("LOCAL_STORAGE_PATH"),
+		AvifSupport:             true,
+		MaxUploadCount:          20,                     // Default max upload: 20 images
+		MaxFileSize:             32,                     // Files of up to 32MB
+		ImageQuality:            75,                     // Default quality: 75
+		WorkerThreads:           4,                      // Default workers: 4 threads
+		Speed:                   5,                      // Default speed: 5 (medium)
+		WorkerPoolSize:          10,                     // Default worker pool size: 10 concurrent tasks
+		MaxConcurrentUploads:    20,                     // Process 20 uploaded files at once
+		UploadQueueSize:         100,                    // Queue 100 more before rejecting uploads
+		StorageType:             StorageTypeDefault,     // Default to local storage
+		KeyLayout:               KeyLayoutDefault,       // Default to flat key layout
+		DebugMode:               false,                  // Default debug mode off
+		CleanupInterval:         1,                      // Default cleanup interval: 1 minute
+		PublicRateLimit:         60,                     // Default public gallery rate limit: 60 requests/minute
+		RateLimitBy:             "key",                  // Limit per API key, anonymous clients per IP
+		RandomSessionTTL:        60,                     // Forget no-repeat sessions after an idle hour
+		ListDefaultLimit:        12,                     // 12 images per list page by default
+		ListMaxLimit:            50,                     // At most 50 images per list page
+		ListIDsMaxLimit:         1000,                   // At most 1000 images per ids-only page
+		ChangeFeedMaxLength:     100000,                 // Keep the latest 100000 changes
+		ServeStatsFlushInterval: 60,                     // Flush serve counts every minute
+		ConversionWorkers:       2,                      // Convert two async uploads at once
+		LogSamplingFirst:        100,                    // Log the first 100 entries per second of a message,
+		LogSamplingThereafter:   100,                    // then every 100th, like zap's production preset
+		DefaultVisibility:       "public",               // New uploads are public unless requested otherwise
+		SignedURLTTL:            3600,                   // Signed URLs are valid for an hour unless requested otherwise
+		SignedURLMaxTTL:         604800,                 // At most 7 days, the limit of S3 presigned URLs
+		EmbeddingTimeout:        30,                     // Default embedding request timeout: 30 seconds
+		OCRLanguages:            "eng",                  // Default OCR language: English
+		OCRTimeout:              60,                     // Default OCR timeout: 60 seconds
+		SearchIndex:             "imageflow",            // Default search index name
+		SearchSyncInterval:      5,                      // Push changes to the search engine every 5 seconds
+		ScreenshotDetection:     true,                   // Detect screenshots by format and dimensions
+		ScreenshotExpiryMinutes: 10080,                  // Screenshots expire after 7 days unless requested otherwise
+		ProfilesFile:            "config/profiles.json", // Custom processing profiles, used when the file exists
+		SyncSourcesFile:         "config/sources.json",  // Sync sources, used when the file exists
+		HooksFile:               "config/hooks.json",    // Webhook and script hooks, used when the file exists
+		WasmPluginsFile:         "config/wasm.json",     // WASM plugins, used when the file exists
+		RoutingScript:           "config/routing.lua",   // Random image routing rules, used when the file exists
+		GeoRulesFile:            "config/geo.json",      // Geo rules, used when the file and a GeoIP database exist
+		DeviceRulesFile:         "config/devices.json",  // Device rules, used when the file exists
+		LanguageRulesFile:       "config/language.json", // Language rules, used when the file exists
+		TracingServiceName:      "imageflow",            // Service name of exported spans
+		TracingSampleRatio:      1,                      // Trace every request once an endpoint is configured
+		SyncInterval:            60,                     // Default sync interval: 60 minutes
+		ReplicationMaxAttempts:  10,                     // Retry replication jobs up to 10 times
+		MaxResizeDimension:      4096,                   // Resize to at most 4096 pixels per side
+		ResizeSizes:             defaultResizeSizes,     // Common layout and device widths
+		WatermarkPosition:       "bottom-right",         // Watermarks go in the bottom right corner
+		WatermarkOpacity:        0.5,                    // Half transparent watermarks
+		WatermarkSize:           0.2,                    // Watermarks a fifth of the image width
+		ThumbnailSizes:          []int{256, 512},        // Thumbnails for the management grid
+		MaxVideoDuration:        30,                     // Clips of up to 30 seconds
+		RemoteUploadMaxSize:     32,                     // Fetch remote images of up to 32MB, like multipart uploads
+		RemoteUploadTimeout:     30,                     // Default remote fetch timeout: 30 seconds
+		UploadSessionPath:       "uploads",              // Resumable uploads are kept outside the served image directory
+		UploadSessionTTL:        24,                     // Remove abandoned resumable uploads after 24 hours
+		ResumableUploadMaxSize:  200,                    // Accept resumable uploads of up to 200MB
+		LogFile:                 "logs/imageflow.log",   // Log file path
+		SyslogTag:               "imageflow",            // Syslog messages tagged imageflow
+
+		// Conversion and serving logs at most 60 times per message and minute
+		LogRateLimits: map[string]int{"conversion": 60, "serve": 60},
+
+		// Entries written to LOG_FILE, pushed to Loki as job imageflow once enabled
+		LogSinks:   []string{LogSinkFile},
+		LokiLabels: map[string]string{"job": "imageflow"},
+
+		// WebP and AVIF variants at IMAGE_QUALITY
+		OutputFormats: []OutputFormat{{Format: "webp"}, {Format: "avif"}},
 
 		// Metadata store defaults
 		MetadataStoreType: MetadataStoreTypeDefault,
+		MetadataEncoding:  MetadataEncodingDefault,
 
 		// Redis defaults
 		RedisHost: "localhost",
@@ -162,6 +554,13 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// Without an explicit prefix, keep the per-storage prefix used by earlier versions
+	if cfg.RedisPrefix == "" {
+		cfg.RedisPrefix = "imageflow:" + string(cfg.StorageType) + ":"
+	} else if !strings.HasSuffix(cfg.RedisPrefix, ":") {
+		cfg.RedisPrefix += ":"
+	}
+
 	return cfg, nil
 }
 
@@ -172,11 +571,399 @@ func (c *Config) loadEnvVars() {
 		c.ServerAddr = addr
 	}
 	c.APIKey = os.Getenv("API_KEY")
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		c.PublicURL = strings.TrimSuffix(publicURL, "/")
+	}
+	if readReplica := os.Getenv("READ_REPLICA"); readReplica != "" {
+		c.ReadReplica = readReplica == "true"
+	}
+
+	// TLS
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		c.TLSCertFile = certFile
+	}
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		c.TLSKeyFile = keyFile
+	}
+	if certDir := os.Getenv("TLS_CERT_DIR"); certDir != "" {
+		c.TLSCertDir = certDir
+	}
 
 	// Debug mode
 	if debug := os.Getenv("DEBUG_MODE"); debug != "" {
 		c.DebugMode = debug == "true"
 	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		c.LogLevel = level
+	}
+	// Rate limits of hot path log entries per message and minute, e.g. conversion=60,serve=120
+	// (0 removes a category's limit)
+	if limits := os.Getenv("LOG_RATE_LIMITS"); limits != "" {
+		c.LogRateLimits = make(map[string]int)
+		for _, limit := range strings.Split(limits, ",") {
+			category, value, _ := strings.Cut(strings.TrimSpace(limit), "=")
+			n, err := strconv.Atoi(value)
+			if category == "" || err != nil || n < 0 {
+				fmt.Printf("Warning: Invalid log rate limit specified (%s), expected category=entries per minute\n", limit)
+				continue
+			}
+			c.LogRateLimits[category] = n
+		}
+	}
+	// Log sinks, e.g. stdout alone on container platforms or file,loki
+	if sinks := os.Getenv("LOG_SINKS"); sinks != "" {
+		c.LogSinks = []string{}
+		for _, sink := range strings.Split(sinks, ",") {
+			sink = strings.ToLower(strings.TrimSpace(sink))
+			if !slices.Contains(SupportedLogSinks, sink) {
+				fmt.Printf("Warning: Unsupported log sink specified (%s), expected one of %s\n", sink, strings.Join(SupportedLogSinks, ", "))
+				continue
+			}
+			if !slices.Contains(c.LogSinks, sink) {
+				c.LogSinks = append(c.LogSinks, sink)
+			}
+		}
+	}
+	if file := os.Getenv("LOG_FILE"); file != "" {
+		c.LogFile = file
+	}
+	if addr := os.Getenv("SYSLOG_ADDR"); addr != "" {
+		c.SyslogAddr = addr
+	}
+	if tag := os.Getenv("SYSLOG_TAG"); tag != "" {
+		c.SyslogTag = tag
+	}
+	if lokiURL := os.Getenv("LOKI_URL"); lokiURL != "" {
+		c.LokiURL = strings.TrimSuffix(lokiURL, "/")
+	}
+	// Stream labels of Loki entries, e.g. job=imageflow,env=prod
+	if labels := os.Getenv("LOKI_LABELS"); labels != "" {
+		c.LokiLabels = make(map[string]string)
+		for _, label := range strings.Split(labels, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(label), "=")
+			if !ok || name == "" || value == "" {
+				fmt.Printf("Warning: Invalid Loki label specified (%s), expected name=value\n", label)
+				continue
+			}
+			c.LokiLabels[name] = value
+		}
+	}
+	c.LokiTenant = os.Getenv("LOKI_TENANT")
+	c.LokiUsername = os.Getenv("LOKI_USERNAME")
+	c.LokiPassword = os.Getenv("LOKI_PASSWORD")
+	if slices.Contains(c.LogSinks, LogSinkLoki) && c.LokiURL == "" {
+		fmt.Printf("Warning: Loki log sink enabled without LOKI_URL, skipping it\n")
+		c.LogSinks = slices.DeleteFunc(c.LogSinks, func(sink string) bool { return sink == LogSinkLoki })
+	}
+	if len(c.LogSinks) == 0 {
+		fmt.Printf("Warning: No valid log sink specified, writing to the log file\n")
+		c.LogSinks = []string{LogSinkFile}
+	}
+
+	// Per-module log levels, e.g. handlers=warn,storage=debug
+	if modules := os.Getenv("LOG_MODULES"); modules != "" {
+		c.LogModules = make(map[string]string)
+		for _, module := range strings.Split(modules, ",") {
+			name, level, ok := strings.Cut(strings.TrimSpace(module), "=")
+			if !ok || name == "" || level == "" {
+				fmt.Printf("Warning: Invalid log module specified (%s), expected module=level\n", module)
+				continue
+			}
+			c.LogModules[name] = level
+		}
+	}
+
+	// Thumbnail sizes, e.g. 256,512 (none disables thumbnails)
+	if sizes := os.Getenv("THUMBNAIL_SIZES"); sizes != "" {
+		c.ThumbnailSizes = nil
+		for _, size := range strings.Split(sizes, ",") {
+			size = strings.TrimSpace(size)
+			if size == "none" {
+				continue
+			}
+			if n, err := strconv.Atoi(size); err == nil && n > 0 {
+				c.ThumbnailSizes = append(c.ThumbnailSizes, n)
+			} else {
+				fmt.Printf("Warning: Invalid thumbnail size specified (%s), skipping\n", size)
+			}
+		}
+	}
+
+	// Resize sizes open to anonymous clients, e.g. 320,640,1280
+	if sizes := os.Getenv("RESIZE_SIZES"); sizes != "" {
+		c.ResizeSizes = nil
+		for _, size := range strings.Split(sizes, ",") {
+			size = strings.TrimSpace(size)
+			if n, err := strconv.Atoi(size); err == nil && n > 0 {
+				c.ResizeSizes = append(c.ResizeSizes, n)
+			} else {
+				fmt.Printf("Warning: Invalid resize size specified (%s), skipping\n", size)
+			}
+		}
+	}
+
+	// Derived formats with an optional quality each, e.g. webp:80,avif:60 (none for originals only)
+	if formats := os.Getenv("OUTPUT_FORMATS"); formats != "" {
+		c.OutputFormats = []OutputFormat{}
+		for _, entry := range strings.Split(formats, ",") {
+			name, quality, hasQuality := strings.Cut(strings.ToLower(strings.TrimSpace(entry)), ":")
+			if name == "none" {
+				continue
+			}
+			if !slices.Contains(SupportedOutputFormats, name) {
+				fmt.Printf("Warning: Unsupported output format specified (%s), expected one of %s\n", entry, strings.Join(SupportedOutputFormats, ", "))
+				continue
+			}
+			if slices.ContainsFunc(c.OutputFormats, func(f OutputFormat) bool { return f.Format == name }) {
+				fmt.Printf("Warning: Duplicate output format specified (%s), skipping\n", entry)
+				continue
+			}
+			output := OutputFormat{Format: name}
+			if hasQuality {
+				q, err := strconv.Atoi(quality)
+				if err != nil || q < 1 || q > 100 {
+					fmt.Printf("Warning: Invalid output format quality specified (%s), using IMAGE_QUALITY\n", entry)
+				} else {
+					output.Quality = q
+				}
+			}
+			c.OutputFormats = append(c.OutputFormats, output)
+		}
+	}
+
+	// Feature flags, e.g. semantic_search=false,ocr=true
+	if flags := os.Getenv("FEATURE_FLAGS"); flags != "" {
+		c.FeatureFlags = make(map[string]bool)
+		for _, flag := range strings.Split(flags, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(flag), "=")
+			enabled, err := strconv.ParseBool(value)
+			if name == "" || err != nil {
+				fmt.Printf("Warning: Invalid feature flag specified (%s), expected name=true or name=false\n", flag)
+				continue
+			}
+			c.FeatureFlags[name] = enabled
+		}
+	}
+
+	// Tracing, configured with the standard OpenTelemetry variables
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		c.TracingEndpoint = endpoint
+	} else if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		c.TracingEndpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if headers := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); headers != "" {
+		c.TracingHeaders = make(map[string]string)
+		for _, header := range strings.Split(headers, ",") {
+			name, value, ok := strings.Cut(header, "=")
+			if !ok {
+				fmt.Printf("Warning: Invalid OTLP header specified (%s), expected name=value\n", header)
+				continue
+			}
+			if unescaped, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+				value = unescaped
+			}
+			c.TracingHeaders[strings.TrimSpace(name)] = value
+		}
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		c.TracingServiceName = name
+	}
+	if ratio := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); ratio != "" {
+		if r, err := strconv.ParseFloat(ratio, 64); err == nil && r >= 0 && r <= 1 {
+			c.TracingSampleRatio = r
+		} else {
+			fmt.Printf("Warning: Invalid trace sample ratio specified (%s), expected a number between 0 and 1\n", ratio)
+		}
+	}
+
+	// Extension hooks
+	if file := os.Getenv("HOOKS_FILE"); file != "" {
+		c.HooksFile = file
+	}
+	if plugins := os.Getenv("HOOK_PLUGINS"); plugins != "" {
+		c.HookPlugins = nil
+		for _, path := range strings.Split(plugins, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				c.HookPlugins = append(c.HookPlugins, path)
+			}
+		}
+	}
+
+	// Routing script
+	if script := os.Getenv("ROUTING_SCRIPT"); script != "" {
+		c.RoutingScript = script
+	}
+
+	// GeoIP
+	if database := os.Getenv("GEOIP_DATABASE"); database != "" {
+		c.GeoIPDatabase = database
+	}
+	if file := os.Getenv("GEO_RULES_FILE"); file != "" {
+		c.GeoRulesFile = file
+	}
+
+	// Languages
+	if file := os.Getenv("LANGUAGE_RULES_FILE"); file != "" {
+		c.LanguageRulesFile = file
+	}
+
+	// Device detection
+	if file := os.Getenv("DEVICE_RULES_FILE"); file != "" {
+		c.DeviceRulesFile = file
+	}
+
+	// WASM plugins
+	if file := os.Getenv("WASM_PLUGINS_FILE"); file != "" {
+		c.WasmPluginsFile = file
+	}
+
+	// Visibility and public gallery
+	if visibility := os.Getenv("DEFAULT_VISIBILITY"); visibility != "" {
+		switch visibility {
+		case "public", "unlisted", "private":
+			c.DefaultVisibility = visibility
+		default:
+			fmt.Printf("Warning: Invalid default visibility specified (%s), using public\n", visibility)
+			c.DefaultVisibility = "public"
+		}
+	}
+	c.SigningSecret = os.Getenv("SIGNING_SECRET")
+	if enabled := os.Getenv("PUBLIC_GALLERY_ENABLED"); enabled != "" {
+		c.PublicGalleryEnabled = enabled == "true"
+	}
+	if enabled := os.Getenv("PUBLIC_STATS_ENABLED"); enabled != "" {
+		c.PublicStatsEnabled = enabled == "true"
+	}
+	if enabled := os.Getenv("COMMENTS_ENABLED"); enabled != "" {
+		c.CommentsEnabled = enabled == "true"
+	}
+
+	// API rate limits
+	if by := os.Getenv("RATE_LIMIT_BY"); by != "" {
+		switch by {
+		case "key", "ip", "both":
+			c.RateLimitBy = by
+		default:
+			fmt.Printf("Warning: Invalid rate limit client specified (%s), using key\n", by)
+			c.RateLimitBy = "key"
+		}
+	}
+
+	// Processing profiles
+	if file := os.Getenv("PROCESSING_PROFILES_FILE"); file != "" {
+		c.ProfilesFile = file
+	}
+
+	if sizing := os.Getenv("DEVICE_SIZING"); sizing != "" {
+		c.DeviceSizing = sizing == "true"
+	}
+
+	// Screenshots
+	if detection := os.Getenv("SCREENSHOT_DETECTION"); detection != "" {
+		c.ScreenshotDetection = detection == "true"
+	}
+
+	// Semantic search
+	if url := os.Getenv("EMBEDDING_SERVICE_URL"); url != "" {
+		c.EmbeddingServiceURL = url
+	}
+	c.EmbeddingAPIKey = os.Getenv("EMBEDDING_API_KEY")
+
+	// OCR
+	if engine := os.Getenv("OCR_ENGINE"); engine != "" {
+		switch engine {
+		case "tesseract":
+			c.OCREngine = OCREngineTesseract
+		case "api":
+			c.OCREngine = OCREngineAPI
+		case "none":
+			c.OCREngine = OCREngineNone
+		default:
+			fmt.Printf("Warning: Invalid OCR engine specified (%s), disabling OCR\n", engine)
+			c.OCREngine = OCREngineNone
+		}
+	}
+	if languages := os.Getenv("OCR_LANGUAGES"); languages != "" {
+		c.OCRLanguages = languages
+	}
+	if url := os.Getenv("OCR_API_URL"); url != "" {
+		c.OCRAPIURL = url
+	}
+	c.OCRAPIKey = os.Getenv("OCR_API_KEY")
+
+	// External search engine. MEILI_HOST/MEILI_KEY, as Meilisearch's own tools name them, select
+	// Meilisearch unless the SEARCH_ENGINE variables say otherwise.
+	if host := os.Getenv("MEILI_HOST"); host != "" {
+		c.SearchEngine = SearchEngineMeilisearch
+		c.SearchEngineURL = host
+		c.SearchEngineAPIKey = os.Getenv("MEILI_KEY")
+	}
+	if engine := os.Getenv("SEARCH_ENGINE"); engine != "" {
+		switch engine {
+		case "meilisearch":
+			c.SearchEngine = SearchEngineMeilisearch
+		case "elasticsearch":
+			c.SearchEngine = SearchEngineElasticsearch
+		case "none":
+			c.SearchEngine = SearchEngineNone
+		default:
+			fmt.Printf("Warning: Invalid search engine specified (%s), disabling search indexing\n", engine)
+			c.SearchEngine = SearchEngineNone
+		}
+	}
+	if url := os.Getenv("SEARCH_ENGINE_URL"); url != "" {
+		c.SearchEngineURL = url
+	}
+	if key := os.Getenv("SEARCH_ENGINE_API_KEY"); key != "" {
+		c.SearchEngineAPIKey = key
+	}
+	if index := os.Getenv("SEARCH_INDEX"); index != "" {
+		c.SearchIndex = index
+	}
+
+	// Self-test
+	c.SelfTestURL = os.Getenv("SELFTEST_URL")
+	c.SelfTestWebhookURL = os.Getenv("SELFTEST_WEBHOOK_URL")
+
+	// Sync
+	if file := os.Getenv("SYNC_SOURCES_FILE"); file != "" {
+		c.SyncSourcesFile = file
+	}
+
+	// Replication
+	if peerURL := os.Getenv("REPLICATION_PEER_URL"); peerURL != "" {
+		c.ReplicationPeerURL = peerURL
+	}
+	c.ReplicationPeerAPIKey = os.Getenv("REPLICATION_PEER_API_KEY")
+	if endpoint := os.Getenv("REPLICATION_S3_ENDPOINT"); endpoint != "" {
+		c.ReplicationS3Endpoint = endpoint
+	}
+	if region := os.Getenv("REPLICATION_S3_REGION"); region != "" {
+		c.ReplicationS3Region = region
+	}
+	if bucket := os.Getenv("REPLICATION_S3_BUCKET"); bucket != "" {
+		c.ReplicationS3Bucket = bucket
+	}
+	c.ReplicationS3AccessKey = os.Getenv("REPLICATION_S3_ACCESS_KEY")
+	c.ReplicationS3SecretKey = os.Getenv("REPLICATION_S3_SECRET_KEY")
+
+	// S3 event ingestion
+	if prefix := os.Getenv("INGEST_PREFIX"); prefix != "" {
+		c.IngestPrefix = strings.TrimPrefix(prefix, "/")
+	}
+	c.IngestWebhookToken = os.Getenv("INGEST_WEBHOOK_TOKEN")
+	if queueURL := os.Getenv("INGEST_SQS_QUEUE_URL"); queueURL != "" {
+		c.IngestSQSQueueURL = queueURL
+	}
+	if keep := os.Getenv("INGEST_KEEP_SOURCE"); keep != "" {
+		c.IngestKeepSource = keep == "true"
+	}
+	if allow := os.Getenv("REMOTE_UPLOAD_ALLOW_PRIVATE"); allow != "" {
+		c.RemoteUploadAllowPrivate = allow == "true"
+	}
+	if path := os.Getenv("UPLOAD_SESSION_PATH"); path != "" {
+		c.UploadSessionPath = path
+	}
 
 	// Storage settings
 	if storageType := os.Getenv("STORAGE_TYPE"); storageType != "" {
@@ -188,6 +975,8 @@ func (c *Config) loadEnvVars() {
 			// When storage type is S3, automatically enable S3
 			c.S3Enabled = true
 			fmt.Printf("Storage type set to S3, automatically enabling S3\n")
+		case "azure":
+			c.StorageType = StorageTypeAzure
 		default:
 			fmt.Printf("Warning: Invalid storage type specified (%s), using local storage\n", storageType)
 			c.StorageType = StorageTypeLocal
@@ -196,16 +985,59 @@ func (c *Config) loadEnvVars() {
 	if customDomain := os.Getenv("CUSTOM_DOMAIN"); customDomain != "" {
 		c.CustomDomain = customDomain
 	}
+	if layout := os.Getenv("STORAGE_KEY_LAYOUT"); layout != "" {
+		switch layout {
+		case "flat":
+			c.KeyLayout = KeyLayoutFlat
+		case "sharded":
+			c.KeyLayout = KeyLayoutSharded
+		default:
+			fmt.Printf("Warning: Invalid storage key layout specified (%s), using flat layout\n", layout)
+			c.KeyLayout = KeyLayoutFlat
+		}
+	}
 
 	// Parse integer environment variables
 	envVarInt := map[string]*int{
-		"MAX_UPLOAD_COUNT": &c.MaxUploadCount,
-		"IMAGE_QUALITY":    &c.ImageQuality,
-		"WORKER_THREADS":   &c.WorkerThreads,
-		"SPEED":            &c.Speed,
-		"WORKER_POOL_SIZE": &c.WorkerPoolSize,
-		"REDIS_DB":         &c.RedisDB,
-		"CLEANUP_INTERVAL": &c.CleanupInterval,
+		"MAX_UPLOAD_COUNT":          &c.MaxUploadCount,
+		"MAX_FILE_SIZE":             &c.MaxFileSize,
+		"MAX_MEGAPIXELS":            &c.MaxMegapixels,
+		"IMAGE_QUALITY":             &c.ImageQuality,
+		"WORKER_THREADS":            &c.WorkerThreads,
+		"SPEED":                     &c.Speed,
+		"WORKER_POOL_SIZE":          &c.WorkerPoolSize,
+		"MAX_CONCURRENT_UPLOADS":    &c.MaxConcurrentUploads,
+		"UPLOAD_QUEUE_SIZE":         &c.UploadQueueSize,
+		"REDIS_DB":                  &c.RedisDB,
+		"CLEANUP_INTERVAL":          &c.CleanupInterval,
+		"PUBLIC_RATE_LIMIT":         &c.PublicRateLimit,
+		"RANDOM_RATE_LIMIT":         &c.RandomRateLimit,
+		"UPLOAD_RATE_LIMIT":         &c.UploadRateLimit,
+		"RANDOM_SESSION_TTL":        &c.RandomSessionTTL,
+		"EMBEDDING_TIMEOUT":         &c.EmbeddingTimeout,
+		"OCR_TIMEOUT":               &c.OCRTimeout,
+		"SEARCH_SYNC_INTERVAL":      &c.SearchSyncInterval,
+		"SCREENSHOT_EXPIRY_MINUTES": &c.ScreenshotExpiryMinutes,
+		"SYNC_INTERVAL":             &c.SyncInterval,
+		"REPLICATION_MAX_ATTEMPTS":  &c.ReplicationMaxAttempts,
+		"MAX_RESIZE_DIMENSION":      &c.MaxResizeDimension,
+		"MAX_IMAGE_DIMENSION":       &c.MaxImageDimension,
+		"REMOTE_UPLOAD_MAX_SIZE":    &c.RemoteUploadMaxSize,
+		"REMOTE_UPLOAD_TIMEOUT":     &c.RemoteUploadTimeout,
+		"UPLOAD_SESSION_TTL":        &c.UploadSessionTTL,
+		"RESUMABLE_UPLOAD_MAX_SIZE": &c.ResumableUploadMaxSize,
+		"SIGNED_URL_TTL":            &c.SignedURLTTL,
+		"SIGNED_URL_MAX_TTL":        &c.SignedURLMaxTTL,
+		"MAX_VIDEO_DURATION":        &c.MaxVideoDuration,
+		"LIST_DEFAULT_LIMIT":        &c.ListDefaultLimit,
+		"LIST_MAX_LIMIT":            &c.ListMaxLimit,
+		"LIST_IDS_MAX_LIMIT":        &c.ListIDsMaxLimit,
+		"CHANGE_FEED_MAX_LENGTH":    &c.ChangeFeedMaxLength,
+		"SERVE_STATS_INTERVAL":      &c.ServeStatsFlushInterval,
+		"CONVERSION_WORKERS":        &c.ConversionWorkers,
+		"SELFTEST_INTERVAL":         &c.SelfTestInterval,
+		"LOG_SAMPLING_FIRST":        &c.LogSamplingFirst,
+		"LOG_SAMPLING_THEREAFTER":   &c.LogSamplingThereafter,
 	}
 
 	for envName, ptr := range envVarInt {
@@ -223,6 +1055,95 @@ func (c *Config) loadEnvVars() {
 		c.Speed = 8
 	}
 
+	// Keep list page sizes positive, and the default within the ceiling
+	if c.ListMaxLimit < 1 {
+		fmt.Printf("Warning: Invalid list max limit (%d), using 50\n", c.ListMaxLimit)
+		c.ListMaxLimit = 50
+	}
+	if c.ListIDsMaxLimit < c.ListMaxLimit {
+		c.ListIDsMaxLimit = c.ListMaxLimit
+	}
+	if c.ListDefaultLimit < 1 || c.ListDefaultLimit > c.ListMaxLimit {
+		fmt.Printf("Warning: Invalid list default limit (%d), expected 1 to %d\n", c.ListDefaultLimit, c.ListMaxLimit)
+		c.ListDefaultLimit = min(12, c.ListMaxLimit)
+	}
+	if c.ChangeFeedMaxLength < 1 {
+		fmt.Printf("Warning: Invalid change feed max length (%d), using 100000\n", c.ChangeFeedMaxLength)
+		c.ChangeFeedMaxLength = 100000
+	}
+	if c.SearchSyncInterval < 1 {
+		c.SearchSyncInterval = 5
+	}
+	if c.ServeStatsFlushInterval < 1 {
+		c.ServeStatsFlushInterval = 60
+	}
+	if c.ConversionWorkers < 1 {
+		c.ConversionWorkers = 2
+	}
+	if c.MaxConcurrentUploads < 0 || c.UploadQueueSize < 0 {
+		fmt.Printf("Warning: Invalid upload concurrency (%d, %d), using 20 and 100\n", c.MaxConcurrentUploads, c.UploadQueueSize)
+		c.MaxConcurrentUploads, c.UploadQueueSize = 20, 100
+	}
+
+	if c.LogSamplingFirst < 0 || c.LogSamplingThereafter < 0 {
+		fmt.Printf("Warning: Invalid log sampling (%d, %d), using 100 and 100\n", c.LogSamplingFirst, c.LogSamplingThereafter)
+		c.LogSamplingFirst, c.LogSamplingThereafter = 100, 100
+	}
+
+	if avif := os.Getenv("AVIF_SUPPORT"); avif != "" {
+		c.AvifSupport = avif == "true"
+	}
+
+	// Watermark
+	if text := os.Getenv("WATERMARK_TEXT"); text != "" {
+		c.WatermarkText = text
+	}
+	if image := os.Getenv("WATERMARK_IMAGE"); image != "" {
+		c.WatermarkImage = image
+	}
+	if position := os.Getenv("WATERMARK_POSITION"); position != "" {
+		c.WatermarkPosition = position
+	}
+	if opacity := os.Getenv("WATERMARK_OPACITY"); opacity != "" {
+		if o, err := strconv.ParseFloat(opacity, 64); err == nil && o > 0 && o <= 1 {
+			c.WatermarkOpacity = o
+		} else {
+			fmt.Printf("Warning: Invalid watermark opacity specified (%s), expected a number between 0 and 1\n", opacity)
+		}
+	}
+	if size := os.Getenv("WATERMARK_SIZE"); size != "" {
+		if s, err := strconv.ParseFloat(size, 64); err == nil && s > 0 && s <= 1 {
+			c.WatermarkSize = s
+		} else {
+			fmt.Printf("Warning: Invalid watermark size specified (%s), expected a number between 0 and 1\n", size)
+		}
+	}
+
+	// Downscaling oversized originals
+	if downscale := os.Getenv("DOWNSCALE_ORIGINAL"); downscale != "" {
+		c.DownscaleOriginal = downscale == "true"
+	}
+
+	// Metadata stripping
+	if strip := os.Getenv("STRIP_EXIF"); strip != "" {
+		c.StripEXIF = strip == "true"
+	}
+
+	// Video clips
+	if video := os.Getenv("VIDEO_SUPPORT"); video != "" {
+		c.VideoSupport = video == "true"
+	}
+
+	// SVG images
+	if svg := os.Getenv("SVG_SUPPORT"); svg != "" {
+		c.SVGSupport = svg == "true"
+	}
+
+	// Upload deduplication
+	if dedupe := os.Getenv("DEDUPE_UPLOADS"); dedupe != "" {
+		c.DedupeUploads = dedupe == "true"
+	}
+
 	// Redis settings
 	if host := os.Getenv("REDIS_HOST"); host != "" {
 		c.RedisHost = host
@@ -231,22 +1152,45 @@ func (c *Config) loadEnvVars() {
 		c.RedisPort = port
 	}
 	c.RedisPassword = os.Getenv("REDIS_PASSWORD")
+	if prefix := os.Getenv("REDIS_PREFIX"); prefix != "" {
+		c.RedisPrefix = prefix
+	}
 
 	// Metadata store settings
 	if storeType := os.Getenv("METADATA_STORE_TYPE"); storeType != "" {
 		switch storeType {
 		case "redis":
 			c.MetadataStoreType = MetadataStoreTypeRedis
+		case "sqlite":
+			c.MetadataStoreType = MetadataStoreTypeSQLite
 		default:
 			fmt.Printf("Warning: Invalid metadata store type specified (%s), using default\n", storeType)
 			c.MetadataStoreType = MetadataStoreTypeDefault
 		}
 	}
+	if encoding := os.Getenv("METADATA_ENCODING"); encoding != "" {
+		switch encoding {
+		case "hash":
+			c.MetadataEncoding = MetadataEncodingHash
+		case "compact":
+			c.MetadataEncoding = MetadataEncodingCompact
+		default:
+			fmt.Printf("Warning: Invalid metadata encoding specified (%s), using hash encoding\n", encoding)
+			c.MetadataEncoding = MetadataEncodingDefault
+		}
+	}
+	c.SQLitePath = os.Getenv("SQLITE_PATH")
 
 	if tls := os.Getenv("REDIS_TLS_ENABLED"); tls != "" {
 		c.RedisTLS = tls == "true"
 	}
 
+	// Cluster settings
+	c.ClusterReconfigure = os.Getenv("CLUSTER_RECONFIGURE") == "true"
+
+	// Expiry settings
+	c.ExpiryNotifications = os.Getenv("EXPIRY_NOTIFICATIONS") == "true"
+
 	// S3 settings
 	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
 		c.S3Endpoint = endpoint
@@ -273,9 +1217,21 @@ func (c *Config) loadEnvVars() {
 	if pathStyle := os.Getenv("S3_FORCE_PATH_STYLE"); pathStyle != "" {
 		c.S3ForcePathStyle = pathStyle == "true"
 	}
+
+	// Azure Blob Storage settings
+	if account := os.Getenv("AZURE_STORAGE_ACCOUNT"); account != "" {
+		c.AzureAccount = account
+	}
+	c.AzureAccountKey = os.Getenv("AZURE_STORAGE_KEY")
+	if container := os.Getenv("AZURE_STORAGE_CONTAINER"); container != "" {
+		c.AzureContainer = container
+	}
+	if endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT"); endpoint != "" {
+		c.AzureEndpoint = endpoint
+	}
 }
 
 // IsValidStorageType checks if the storage type is valid
 func (s StorageType) IsValidStorageType() bool {
-	return s == StorageTypeLocal || s == StorageTypeS3
+	return s == StorageTypeLocal || s == StorageTypeS3 || s == StorageTypeAzure
 }
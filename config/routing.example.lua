@@ -0,0 +1,26 @@
+-- Routing rules for /api/random, copied to config/routing.lua (or ROUTING_SCRIPT) to take effect.
+-- route(req) runs for every random image request and may change req in place or return a new table.
+--
+-- Rewritable fields: tags, exclude, prefer (string arrays), orientation, format, min_likes,
+-- collection
+-- Read-only fields: device, path, tenant, country, region (with GEOIP_DATABASE), language, query,
+-- headers, year, month, day, weekday (0 = Sunday), hour, minute (server local time)
+
+function route(req)
+  -- Dark-themed images in the evening, unless the caller picked tags
+  if (req.hour >= 20 or req.hour < 6) and #req.tags == 0 then
+    table.insert(req.prefer, "dark")
+  end
+
+  -- Winter images in December, when there are any
+  if req.month == 12 then
+    table.insert(req.prefer, "winter")
+  end
+
+  -- Never serve drafts to mobile devices
+  if req.device == "mobile" then
+    table.insert(req.exclude, "draft")
+  end
+
+  return req
+end
@@ -252,7 +252,9 @@ export default function ImageCard({
           ) : (
             // Use Next.js Image for non-GIF images with optimizations
             <Image
-              src={getFullUrl(image.urls?.webp || image.url)}
+              src={getFullUrl(
+                image.thumbnails?.["512"] || image.urls?.webp || image.url
+              )}
               alt={image.filename}
               fill
               loading="lazy"
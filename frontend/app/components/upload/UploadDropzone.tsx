@@ -50,7 +50,7 @@ export default function UploadDropzone({ onFilesSelected, maxUploadCount }: Uplo
         type="file"
         ref={fileInputRef}
         className="hidden"
-        accept="image/*"
+        accept="image/*,.heic,.heif,.svg,video/mp4,video/webm"
         multiple
         onChange={handleFileSelect}
       />
@@ -32,6 +32,7 @@ export interface ImageFile {
     webp: string;
     avif: string;
   };
+  thumbnails?: Record<string, string>;
 }
 
 export interface ImageListResponse {
@@ -101,6 +102,8 @@ export interface StatusMessage {
 // 配置类型
 export interface ConfigSettings {
   maxUploadCount: number;
+  maxFileSize?: number; // 单个文件最大 MB，0 表示不限制
+  maxMegapixels?: number; // 单张图片最大百万像素，0 表示不限制
   imageQuality: number;
   compressionEffort?: number;
   forceLossless?: boolean;
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// APIKeyRequest represents the request body for creating an API key
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"` // read, upload and/or admin
+	Tenant string   `json:"tenant"` // Optional tenant the key is bound to
+}
+
+// APIKeyResponse describes a managed API key
+type APIKeyResponse struct {
+	*utils.APIKey
+	Key string `json:"key,omitempty"` // Only returned when the key is created
+}
+
+// APIKeysHandler manages API keys (admin keys only).
+//
+// GET    /api/keys        lists keys without the keys themselves
+// POST   /api/keys        creates a key and returns it
+// DELETE /api/keys?id=    revokes a key
+func APIKeysHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listAPIKeys(w, r)
+		case http.MethodPost:
+			createAPIKey(w, r)
+		case http.MethodDelete:
+			revokeAPIKey(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := utils.ListAPIKeys(r.Context())
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list API keys", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"keys":    keys,
+	})
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+
+	key, apiKey, err := utils.CreateAPIKey(r.Context(), req.Name, req.Scopes, req.Tenant)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to create API key", err.Error())
+		return
+	}
+
+	logger.Info("API key created",
+		zap.String("key", key.ID),
+		zap.Strings("scopes", key.Scopes),
+		zap.String("tenant", key.Tenant))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyResponse{APIKey: key, Key: apiKey})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "API key ID is required", nil)
+		return
+	}
+
+	if err := utils.RevokeAPIKey(r.Context(), id); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "API key not found", nil)
+		return
+	}
+
+	logger.Info("API key revoked",
+		zap.String("key", id))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "API key revoked"})
+}
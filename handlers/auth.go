@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"strings"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
 	"go.uber.org/zap"
@@ -12,10 +15,14 @@ import (
 
 // AuthResponse represents the response for API key validation
 type AuthResponse struct {
-	Valid bool   `json:"valid"`           // Whether the API key is valid
-	Error string `json:"error,omitempty"` // Error message if validation fails
+	Valid  bool     `json:"valid"`            // Whether the API key is valid
+	Scopes []string `json:"scopes,omitempty"` // Scopes of a valid API key
+	Error  string   `json:"error,omitempty"`  // Error message if validation fails
 }
 
+// configAPIKey stands for the configured API_KEY, which is an admin key of the instance
+var configAPIKey = &utils.APIKey{ID: "config", Name: "API_KEY", Scopes: []string{utils.ScopeAdmin}}
+
 // ValidateAPIKey provides an endpoint to validate API keys
 func ValidateAPIKey(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -37,10 +44,10 @@ func ValidateAPIKey(cfg *config.Config) http.HandlerFunc {
 
 		providedKey := parts[1]
 
-		// Validate API key
-		if providedKey == cfg.APIKey {
+		// Validate API key (the admin key, a managed key or a tenant key)
+		if key := requestAPIKey(cfg, r); key != nil {
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`{"valid":true}`))
+			json.NewEncoder(w).Encode(AuthResponse{Valid: true, Scopes: key.Scopes})
 			logger.Debug("API key validated successfully")
 		} else {
 			errors.WriteError(w, errors.ErrInvalidAPIKey)
@@ -50,8 +57,15 @@ func ValidateAPIKey(cfg *config.Config) http.HandlerFunc {
 	}
 }
 
-// RequireAPIKey middleware to validate API key before processing requests
+// RequireAPIKey middleware to validate API key before processing requests. GET and HEAD
+// requests need a key with the read scope, other methods the admin scope.
 func RequireAPIKey(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
+	return RequireAPIKeyScope(cfg, "", next)
+}
+
+// RequireAPIKeyScope middleware validates the API key and requires a scope of it, for routes
+// whose scope does not follow from the method. An empty scope is derived as in RequireAPIKey.
+func RequireAPIKeyScope(cfg *config.Config, scope string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get API key from request header
 		authHeader := r.Header.Get("Authorization")
@@ -72,13 +86,29 @@ func RequireAPIKey(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Validate API key
-		providedKey := parts[1]
-		if providedKey != cfg.APIKey {
+		// Validate API key (the admin key, a managed key or a tenant key)
+		key := requestAPIKey(cfg, r)
+		if key == nil {
 			errors.WriteError(w, errors.ErrInvalidAPIKey)
 			logger.Warn("API密钥验证失败",
 				zap.String("path", r.URL.Path),
-				zap.String("provided_key", providedKey))
+				zap.String("provided_key", parts[1]))
+			return
+		}
+
+		required := scope
+		if required == "" {
+			required = utils.ScopeAdmin
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				required = utils.ScopeRead
+			}
+		}
+		if !key.HasScope(required) {
+			errors.WriteError(w, errors.ErrNoPermission)
+			logger.Warn("API key lacks the required scope",
+				zap.String("path", r.URL.Path),
+				zap.String("key", key.ID),
+				zap.String("scope", required))
 			return
 		}
 
@@ -86,3 +116,126 @@ func RequireAPIKey(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// RequireAdminKey middleware only admits instance-wide keys with the admin scope: the
+// configured API key or managed admin keys, not tenant keys
+func RequireAdminKey(cfg *config.Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(cfg, r)
+		if key == nil || key.Tenant != "" || !key.HasScope(utils.ScopeAdmin) {
+			if key != nil {
+				errors.WriteError(w, errors.ErrNoPermission)
+			} else {
+				errors.WriteError(w, errors.ErrInvalidAPIKey)
+			}
+			logger.Warn("Admin API key required",
+				zap.String("path", r.URL.Path))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAPIKeyScope reports whether the request carries an API key granting a scope as a Bearer
+// token. Keys bound to a tenant only count for requests scoped to that tenant.
+func hasAPIKeyScope(cfg *config.Config, r *http.Request, scope string) bool {
+	key := requestAPIKey(cfg, r)
+	if key == nil || !key.HasScope(scope) {
+		return false
+	}
+	if key.Tenant == "" {
+		return true
+	}
+	tenant := utils.TenantFromContext(r.Context())
+	return tenant != nil && tenant.ID == key.Tenant
+}
+
+// requestAPIKey returns the API key authenticating a request, or nil. The configured API key
+// and tenant keys act as admin keys, of the instance and of their tenant respectively.
+func requestAPIKey(cfg *config.Config, r *http.Request) *utils.APIKey {
+	token := bearerToken(r)
+	if token == "" {
+		return nil
+	}
+	if cfg.APIKey != "" && token == cfg.APIKey {
+		return configAPIKey
+	}
+	if key, ok := r.Context().Value(apiKeyAuthKey{}).(*utils.APIKey); ok {
+		return key
+	}
+	if id := authenticatedTenant(r); id != "" {
+		return &utils.APIKey{ID: "tenant:" + id, Name: id, Scopes: []string{utils.ScopeAdmin}, Tenant: id}
+	}
+	return nil
+}
+
+// bearerToken returns the Bearer token of a request, or ""
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return parts[1]
+}
+
+type tenantAuthKey struct{}
+
+// apiKeyAuthKey holds the managed API key authenticating a request
+type apiKeyAuthKey struct{}
+
+// authenticatedTenant returns the ID of the tenant whose API key authenticated the request, or ""
+func authenticatedTenant(r *http.Request) string {
+	id, _ := r.Context().Value(tenantAuthKey{}).(string)
+	return id
+}
+
+// TenantMiddleware scopes every request to a tenant and resolves managed API keys. A tenant
+// API key, or a managed key bound to a tenant, selects its own tenant; otherwise the "tenant"
+// query parameter selects one, which lets anonymous clients reach a tenant's public endpoints
+// and instance keys act on behalf of a tenant. Failing both, the Host header selects the
+// tenant owning the domain. Other requests use the default namespace.
+func TenantMiddleware(cfg *config.Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utils.IsRedisMetadataStore() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if token := bearerToken(r); token != "" && token != cfg.APIKey {
+			if tenant, err := utils.TenantByAPIKey(ctx, token); err == nil {
+				ctx = utils.WithTenant(ctx, tenant)
+				ctx = context.WithValue(ctx, tenantAuthKey{}, tenant.ID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			if key, err := utils.APIKeyByToken(ctx, token); err == nil {
+				ctx = context.WithValue(ctx, apiKeyAuthKey{}, key)
+				if key.Tenant != "" {
+					tenant, err := utils.GetTenant(ctx, key.Tenant)
+					if err != nil {
+						errors.HandleError(w, errors.ErrNotFound, "Tenant not found", key.Tenant)
+						return
+					}
+					ctx = utils.WithTenant(ctx, tenant)
+					ctx = context.WithValue(ctx, tenantAuthKey{}, tenant.ID)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+		}
+
+		if id := r.URL.Query().Get("tenant"); id != "" {
+			tenant, err := utils.GetTenant(ctx, id)
+			if err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "Tenant not found", id)
+				return
+			}
+			ctx = utils.WithTenant(ctx, tenant)
+		} else if tenant, err := utils.TenantByHost(ctx, r.Host); err == nil {
+			ctx = utils.WithTenant(ctx, tenant)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
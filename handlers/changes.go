@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Page sizes of the change feed
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// ChangesResponse is a page of the change feed
+type ChangesResponse struct {
+	Success   bool           `json:"success"`
+	Changes   []utils.Change `json:"changes"`
+	Next      int64          `json:"next"`      // Sequence number to pass as since for the next page
+	Latest    int64          `json:"latest"`    // Sequence number of the latest change
+	Truncated bool           `json:"truncated"` // Changes after since were trimmed; list the library again
+}
+
+// ChangesHandler serves the change feed of the library at /api/changes?since=<seq>, so indexers
+// and backup tools can follow uploads, updates and deletions instead of listing every image
+func ChangesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInternal, "The change feed requires Redis metadata storage", nil)
+			return
+		}
+
+		query := r.URL.Query()
+		var v paramValidator
+		since := v.Int64("since", query.Get("since"), 0, 0)
+		limit := v.Int("limit", query.Get("limit"), defaultChangesLimit, 1, maxChangesLimit)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		since = min(since, math.MaxInt64-1) // Keeps since+1 from overflowing
+
+		page, err := utils.Changes(r.Context(), since, int64(limit))
+		if err != nil {
+			logger.Error("Failed to read change feed", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read change feed", err.Error())
+			return
+		}
+
+		next := since
+		if len(page.Changes) > 0 {
+			next = page.Changes[len(page.Changes)-1].Seq
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ChangesResponse{
+			Success:   true,
+			Changes:   page.Changes,
+			Next:      next,
+			Latest:    page.Latest,
+			Truncated: page.Truncated,
+		})
+	}
+}
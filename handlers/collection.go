@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// CollectionRequest represents the request body for creating or updating a collection
+type CollectionRequest struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// CollectionImagesRequest represents the request body for adding or removing images
+type CollectionImagesRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// CollectionImagesResponse reports how many images were added to or removed from a collection
+type CollectionImagesResponse struct {
+	Success    bool              `json:"success"`
+	Changed    int64             `json:"changed"` // Images that were not in the collection yet, or that were removed
+	Collection *utils.Collection `json:"collection"`
+}
+
+// CollectionsHandler manages the collections of the request's namespace.
+//
+// GET    /api/collections        lists collections
+// POST   /api/collections        creates a collection
+// PUT    /api/collections        updates the name and description of a collection
+// DELETE /api/collections?id=    deletes a collection, keeping its images
+func CollectionsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listCollections(w, r)
+		case http.MethodPost, http.MethodPut:
+			saveCollection(w, r)
+		case http.MethodDelete:
+			deleteCollection(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+func listCollections(w http.ResponseWriter, r *http.Request) {
+	collections, err := utils.ListCollections(r.Context())
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list collections", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"collections": collections,
+	})
+}
+
+func saveCollection(w http.ResponseWriter, r *http.Request) {
+	var req CollectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+	req.ID = strings.TrimSpace(req.ID)
+
+	create := r.Method == http.MethodPost
+	var collection *utils.Collection
+	var err error
+	if create {
+		collection, err = utils.CreateCollection(r.Context(), req.ID, req.Name, req.Description)
+	} else {
+		collection, err = utils.UpdateCollection(r.Context(), req.ID, req.Name, req.Description)
+	}
+	if err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to save collection", err.Error())
+		return
+	}
+
+	logger.Info("Collection saved",
+		zap.String("collection", collection.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	if create {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(collection)
+}
+
+func deleteCollection(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Collection ID is required", nil)
+		return
+	}
+
+	if err := utils.DeleteCollection(r.Context(), id); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Collection not found", nil)
+		return
+	}
+
+	logger.Info("Collection deleted",
+		zap.String("collection", id))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "Collection deleted"})
+}
+
+// CollectionImagesHandler manages the images of a collection. Images are listed most recently
+// added first, with the filters and pagination of /api/images.
+//
+// GET    /api/collections/{id}/images   lists the images
+// POST   /api/collections/{id}/images   adds the images {"ids": [...]}
+// DELETE /api/collections/{id}/images   removes the images {"ids": [...]}, keeping them stored
+func CollectionImagesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listCollectionImages(w, r, cfg)
+		case http.MethodPost, http.MethodDelete:
+			changeCollectionImages(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+func listCollectionImages(w http.ResponseWriter, r *http.Request, cfg *config.Config) {
+	id := r.PathValue("id")
+	if _, err := utils.GetCollection(r.Context(), id); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Collection not found", nil)
+		return
+	}
+	imageIDs, err := utils.CollectionImageIDs(r.Context(), id)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list collection images", err.Error())
+		return
+	}
+
+	params, errResp := parseQueryParams(r, cfg)
+	if errResp != nil {
+		errors.WriteError(w, errResp)
+		return
+	}
+	images := make([]ImageInfo, 0, len(imageIDs))
+	for _, imageID := range imageIDs {
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), imageID)
+		if err != nil {
+			continue
+		}
+		if imageInfo, ok := imageInfoFromFields(r.Context(), imageID, utils.MetadataFieldValues(metadata), params, cfg); ok {
+			images = append(images, imageInfo)
+		}
+	}
+
+	// Keep the collection's order unless another one is requested
+	if params.sort != "" {
+		sortImages(images, params)
+	}
+	writeImagePage(w, cfg, params, images)
+}
+
+func changeCollectionImages(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req CollectionImagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		errors.HandleError(w, errors.ErrInvalidParam, "Image IDs are required", nil)
+		return
+	}
+
+	var changed int64
+	var err error
+	if r.Method == http.MethodPost {
+		changed, err = utils.AddToCollection(r.Context(), id, req.IDs)
+	} else {
+		changed, err = utils.RemoveFromCollection(r.Context(), id, req.IDs)
+	}
+	if err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to update collection", err.Error())
+		return
+	}
+
+	collection, err := utils.GetCollection(r.Context(), id)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to get collection", err.Error())
+		return
+	}
+
+	logger.Info("Collection images updated",
+		zap.String("collection", id),
+		zap.String("method", r.Method),
+		zap.Int64("changed", changed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CollectionImagesResponse{
+		Success:    true,
+		Changed:    changed,
+		Collection: collection,
+	})
+}
@@ -21,20 +21,20 @@ type DebugTagsResponse struct {
 	Images []string `json:"images"`
 }
 
-// DebugTagsHandler returns a handler for debugging tag issues
+// DebugTagsHandler returns a handler for debugging tag issues. With a tag parameter it lists
+// the images with the tag; without one it checks the tag indexes for inconsistencies, repairing
+// them on POST with repair=true.
 func DebugTagsHandler(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get tag parameter
 		tag := r.URL.Query().Get("tag")
 		if tag == "" {
-			errors.HandleError(w, errors.ErrInvalidParam, "Tag parameter is required", nil)
-			logger.Warn("Missing tag parameter",
-				zap.String("path", r.URL.Path))
+			checkTagIndexes(w, r, cfg)
 			return
 		}
 
 		// Find all images with the specified tag
-		images, err := findImagesWithTagDebug(tag, string(cfg.StorageType), cfg.ImageBasePath)
+		images, err := findImagesWithTagDebug(r.Context(), tag, string(cfg.StorageType), cfg.ImageBasePath)
 		if err != nil {
 			logger.Error("Failed to find images with tag",
 				zap.String("tag", tag),
@@ -63,12 +63,39 @@ func DebugTagsHandler(cfg *config.Config) http.HandlerFunc {
 	}
 }
 
-// findImagesWithTagDebug finds all images with the specified tag
-func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error) {
-	// Get metadata from Redis if enabled
-	if utils.IsRedisMetadataStore() {
+// checkTagIndexes reports, and on request repairs, inconsistencies of the tag indexes
+func checkTagIndexes(w http.ResponseWriter, r *http.Request, cfg *config.Config) {
+	repair := r.URL.Query().Get("repair") == "true"
+	if repair && r.Method != http.MethodPost {
+		errors.HandleError(w, errors.ErrInvalidParam, "Repair requires a POST request", nil)
+		return
+	}
+	if !utils.IsRedisMetadataStore() {
+		errors.HandleError(w, errors.ErrInvalidParam, "Tag index diagnostics require Redis", nil)
+		return
+	}
+
+	report, err := utils.CheckTagIndexes(r.Context(), cfg, repair)
+	if err != nil {
+		logger.Error("Failed to check tag indexes",
+			zap.Bool("repair", repair),
+			zap.Error(err))
+		errors.HandleError(w, errors.ErrInternal, "Failed to check tag indexes", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("Failed to encode response", zap.Error(err))
+	}
+}
+
+// findImagesWithTagDebug finds all images of the context's tenant with the specified tag
+func findImagesWithTagDebug(ctx context.Context, tag, storageType, basePath string) ([]string, error) {
+	// Get metadata from the tag index if the metadata store has one
+	if utils.HasTagIndex() {
 		// Use Redis to get all images with the specified tag
-		imageIDs, err := utils.GetImagesByTag(context.Background(), tag)
+		imageIDs, err := utils.GetImagesByTag(ctx, tag)
 		if err != nil {
 			logger.Warn("Failed to get images by tag from Redis, falling back to file storage",
 				zap.String("tag", tag),
@@ -80,7 +107,7 @@ func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error)
 
 			// Log detailed metadata for debugging
 			for _, id := range imageIDs {
-				metadata, err := utils.MetadataManager.GetMetadata(context.Background(), id)
+				metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
 				if err == nil && metadata != nil {
 					logger.Debug("Image metadata from Redis",
 						zap.String("id", metadata.ID),
@@ -98,14 +125,14 @@ func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error)
 
 	if storageType == "s3" {
 		// For S3 storage, we need to implement S3-specific logic
-		s3Storage, ok := utils.Storage.(*utils.S3Storage)
+		s3Storage, ok := utils.StorageBackend().(*utils.S3Storage)
 		if !ok {
 			return nil, fmt.Errorf("failed to get S3 storage instance")
 		}
 
 		// List all metadata objects
 		metadataPrefix := "metadata/"
-		objects, err := s3Storage.ListObjects(context.Background(), metadataPrefix)
+		objects, err := s3Storage.ListObjects(ctx, metadataPrefix)
 		if err != nil {
 			return nil, fmt.Errorf("failed to list S3 objects: %v", err)
 		}
@@ -122,7 +149,7 @@ func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error)
 			id = id[:len(id)-5] // Remove .json extension
 
 			// Get metadata
-			metadata, err := utils.MetadataManager.GetMetadata(context.Background(), id)
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
 			if err != nil {
 				logger.Warn("Failed to read metadata from S3",
 					zap.String("id", id),
@@ -170,7 +197,7 @@ func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error)
 			id = id[:len(id)-5] // Remove .json extension
 
 			// Get metadata
-			metadata, err := utils.MetadataManager.GetMetadata(context.Background(), id)
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
 			if err != nil {
 				logger.Warn("Failed to read metadata from local storage",
 					zap.String("id", id),
@@ -201,3 +228,32 @@ func findImagesWithTagDebug(tag, storageType, basePath string) ([]string, error)
 
 	return images, nil
 }
+
+// DebugStartupResponse represents the response for the startup report API
+type DebugStartupResponse struct {
+	Success bool                 `json:"success"`
+	Report  *utils.StartupReport `json:"report"`
+}
+
+// DebugStartupHandler returns the summary this instance logged at startup: the storage backend
+// and Redis with their latency then, the metadata store, libvips, the worker pools and the
+// enabled features. Support requests should include it.
+func DebugStartupHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if utils.Startup == nil {
+			errors.HandleError(w, errors.ErrInternal, "Startup report not available yet", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(DebugStartupResponse{
+			Success: true,
+			Report:  utils.Startup,
+		})
+	}
+}
@@ -62,14 +62,20 @@ func DeleteImageHandler(cfg *config.Config) http.HandlerFunc {
 			zap.String("image_id", req.ID),
 			zap.String("storage_type", string(cfg.StorageType)))
 
+		// Metadata is read before it is deleted for the post-delete hooks
+		metadata, _ := utils.MetadataManager.GetMetadata(r.Context(), req.ID)
+
 		var success bool
 		var message string
 
 		// Delete based on storage type
-		if cfg.StorageType == config.StorageTypeS3 {
-			success, message = deleteS3Images(req.ID, cfg)
-		} else {
-			success, message = deleteLocalImages(req.ID, cfg.ImageBasePath)
+		switch cfg.StorageType {
+		case config.StorageTypeS3:
+			success, message = deleteS3Images(r.Context(), req.ID, cfg)
+		case config.StorageTypeLocal:
+			success, message = deleteLocalImages(r.Context(), req.ID, cfg.ImageBasePath)
+		default:
+			success, message = deleteStoredImages(r.Context(), req.ID)
 		}
 
 		// If deletion was successful, clean up Redis data
@@ -85,20 +91,37 @@ func DeleteImageHandler(cfg *config.Config) http.HandlerFunc {
 			}
 
 			// Remove from images sorted set
-			if err := utils.RedisClient.ZRem(r.Context(), utils.RedisPrefix+"images", req.ID).Err(); err != nil {
+			if err := utils.RedisClient.ZRem(r.Context(), utils.KeyPrefix(r.Context())+"images", req.ID).Err(); err != nil {
 				logger.Warn("Failed to remove from images set",
 					zap.String("image_id", req.ID),
 					zap.Error(err))
 			}
 
-			// Clear page cache
-			if err := utils.ClearPageCache(r.Context()); err != nil {
+			// Invalidate the cached pages listing the image
+			if err := utils.InvalidateImagePages(r.Context(), metadata); err != nil {
 				logger.Warn("Failed to clear page cache",
 					zap.String("image_id", req.ID),
 					zap.Error(err))
 			}
 		}
 
+		// The paired theme variant no longer links back to the deleted image
+		if success && metadata != nil {
+			if err := utils.DeleteThemeVariantLinks(r.Context(), metadata); err != nil {
+				logger.Warn("Failed to unlink theme variant",
+					zap.String("image_id", req.ID),
+					zap.Error(err))
+			}
+		}
+
+		if success && utils.HasHooks(utils.HookPostDelete) {
+			go utils.RunHooks(context.WithoutCancel(r.Context()), &utils.HookEvent{
+				Point:    utils.HookPostDelete,
+				ImageID:  req.ID,
+				Metadata: metadata,
+			})
+		}
+
 		// Prepare and send response
 		resp := DeleteResponse{
 			Success: success,
@@ -122,77 +145,39 @@ func DeleteImageHandler(cfg *config.Config) http.HandlerFunc {
 }
 
 // deleteLocalImages deletes all formats of an image from local storage
-func deleteLocalImages(id string, basePath string) (bool, string) {
-	// Formats and orientations to check for image files
-	formats := []string{"original", "webp", "avif"}
-	orientations := []string{"landscape", "portrait"}
-
+func deleteLocalImages(ctx context.Context, id string, basePath string) (bool, string) {
 	deletedCount := 0
 	errorCount := 0
 	var lastError error
 
-	// Find all matching image files and delete them
-	for _, format := range formats {
-		for _, orientation := range orientations {
-			var path string
-			if format == "original" {
-				path = filepath.Join(basePath, format, orientation)
-			} else {
-				path = filepath.Join(basePath, orientation, format)
-			}
-
-			// Find matching files with glob pattern
-			files, err := filepath.Glob(filepath.Join(path, id+".*"))
-			if err != nil {
-				logger.Error("Failed to find files",
-					zap.String("image_id", id),
-					zap.String("path", path),
-					zap.Error(err))
-				errorCount++
-				lastError = err
-				continue
-			}
+	// Find all matching image files in every directory the image may live in
+	// (flat and sharded key layouts, including the GIF, animation and video directories)
+	for _, dir := range utils.ImageDirCandidates(id) {
+		path := filepath.Join(basePath, utils.TenantStorageKey(ctx, dir))
 
-			// Delete each found file
-			for _, file := range files {
-				err := os.Remove(file)
-				if err != nil {
-					logger.Error("Failed to delete file",
-						zap.String("file", file),
-						zap.Error(err))
-					errorCount++
-					lastError = err
-				} else {
-					logger.Debug("Successfully deleted file",
-						zap.String("file", file))
-					deletedCount++
-				}
-			}
+		// Find matching files with glob pattern
+		files, err := filepath.Glob(filepath.Join(path, id+".*"))
+		if err != nil {
+			logger.Error("Failed to find files",
+				zap.String("image_id", id),
+				zap.String("path", path),
+				zap.Error(err))
+			errorCount++
+			lastError = err
+			continue
 		}
-	}
 
-	// Check for GIF files
-	gifPath := filepath.Join(basePath, "gif")
-	gifFiles, err := filepath.Glob(filepath.Join(gifPath, id+".*"))
-	if err != nil {
-		logger.Error("Failed to find GIF files",
-			zap.String("image_id", id),
-			zap.String("path", gifPath),
-			zap.Error(err))
-		errorCount++
-		lastError = err
-	} else {
-		// Delete each GIF file found
-		for _, file := range gifFiles {
+		// Delete each found file
+		for _, file := range files {
 			err := os.Remove(file)
 			if err != nil {
-				logger.Error("Failed to delete GIF file",
+				logger.Error("Failed to delete file",
 					zap.String("file", file),
 					zap.Error(err))
 				errorCount++
 				lastError = err
 			} else {
-				logger.Debug("Successfully deleted GIF file",
+				logger.Debug("Successfully deleted file",
 					zap.String("file", file))
 				deletedCount++
 			}
@@ -212,8 +197,29 @@ func deleteLocalImages(id string, basePath string) (bool, string) {
 	return true, fmt.Sprintf("Successfully deleted %d images", deletedCount)
 }
 
+// deleteStoredImages deletes all formats of an image recorded in its metadata through the
+// storage provider, for backends that cannot be searched by prefix
+func deleteStoredImages(ctx context.Context, id string) (bool, string) {
+	metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return false, fmt.Sprintf("Image not found: %v", err)
+	}
+
+	deletedCount := 0
+	for _, key := range metadata.ObjectKeys() {
+		if err := utils.Storage.Delete(ctx, key); err != nil {
+			logger.Error("Failed to delete file",
+				zap.String("key", key),
+				zap.Error(err))
+			return false, fmt.Sprintf("Partial deletion failure: %d files deleted successfully: %v", deletedCount, err)
+		}
+		deletedCount++
+	}
+	return true, fmt.Sprintf("Successfully deleted %d images", deletedCount)
+}
+
 // deleteS3Images deletes all formats of an image from S3 storage
-func deleteS3Images(id string, cfg *config.Config) (bool, string) {
+func deleteS3Images(ctx context.Context, id string, cfg *config.Config) (bool, string) {
 	// Check if S3 is properly configured
 	if !cfg.S3Enabled {
 		return false, "S3 storage is not enabled"
@@ -228,84 +234,40 @@ func deleteS3Images(id string, cfg *config.Config) (bool, string) {
 		return false, "S3 client not initialized"
 	}
 
-	// Formats and orientations to check
-	formats := []string{"original", "webp", "avif"}
-	orientations := []string{"landscape", "portrait"}
-
 	// Build list of objects to delete
 	var objectsToDelete []types.ObjectIdentifier
 	var deletedPathsForLogging []string
 
-	// Create context
-	ctx := context.Background()
+	// Find matching objects in every directory the image may live in
+	// (flat and sharded key layouts, including the GIF, animation and video directories)
+	for _, dir := range utils.ImageDirCandidates(id) {
+		prefix := filepath.ToSlash(utils.TenantStorageKey(ctx, filepath.Join(dir, id)))
 
-	// Find matching objects
-	for _, format := range formats {
-		for _, orientation := range orientations {
-			var prefix string
-			if format == "original" {
-				prefix = fmt.Sprintf("%s/%s/%s", format, orientation, id)
-			} else {
-				prefix = fmt.Sprintf("%s/%s/%s", orientation, format, id)
-			}
-
-			// List objects matching prefix
-			paginator := s3.NewListObjectsV2Paginator(utils.S3Client, &s3.ListObjectsV2Input{
-				Bucket: aws.String(cfg.S3Bucket),
-				Prefix: aws.String(prefix),
-			})
+		// List objects matching prefix
+		paginator := s3.NewListObjectsV2Paginator(utils.S3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(cfg.S3Bucket),
+			Prefix: aws.String(prefix),
+		})
 
-			for paginator.HasMorePages() {
-				output, err := paginator.NextPage(ctx)
-				if err != nil {
-					logger.Error("Failed to list S3 objects",
-						zap.String("prefix", prefix),
-						zap.Error(err))
-					continue
-				}
-
-				for _, obj := range output.Contents {
-					key := *obj.Key
-					// Check if filename starts with ID
-					baseName := filepath.Base(key)
-					if strings.HasPrefix(baseName, id+".") {
-						objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{
-							Key: aws.String(key),
-						})
-						deletedPathsForLogging = append(deletedPathsForLogging, key)
-					}
-				}
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				logger.Error("Failed to list S3 objects",
+					zap.String("prefix", prefix),
+					zap.Error(err))
+				break
 			}
-		}
-	}
-
-	// Check for GIF files
-	gifPrefix := fmt.Sprintf("gif/%s", id)
-
-	// List GIF objects matching prefix
-	gifPaginator := s3.NewListObjectsV2Paginator(utils.S3Client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(cfg.S3Bucket),
-		Prefix: aws.String(gifPrefix),
-	})
 
-	for gifPaginator.HasMorePages() {
-		output, err := gifPaginator.NextPage(ctx)
-		if err != nil {
-			logger.Error("Failed to list S3 GIF objects",
-				zap.String("prefix", gifPrefix),
-				zap.Error(err))
-			continue
-		}
-
-		for _, obj := range output.Contents {
-			key := *obj.Key
-			// Check if filename starts with ID
-			baseName := filepath.Base(key)
-			if strings.HasPrefix(baseName, id+".") {
-				objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{
-					Key: aws.String(key),
-				})
-				deletedPathsForLogging = append(deletedPathsForLogging, key)
+			for _, obj := range output.Contents {
+				key := *obj.Key
+				// Check if filename starts with ID
+				baseName := filepath.Base(key)
+				if strings.HasPrefix(baseName, id+".") {
+					objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{
+						Key: aws.String(key),
+					})
+					deletedPathsForLogging = append(deletedPathsForLogging, key)
+				}
 			}
 		}
 	}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+)
+
+// libraryNotModified sets the ETag of a response derived from the whole library, like a list
+// page, and answers 304 Not Modified when the client's If-None-Match holds it. The ETag is the
+// library version, which changes with every upload, change and deletion, and a hash of the
+// tenant so that tenants at the same version get different ETags. Without Redis no ETag is set.
+func libraryNotModified(w http.ResponseWriter, r *http.Request) bool {
+	version, ok, err := utils.LibraryVersion(r.Context())
+	if err != nil || !ok {
+		return false
+	}
+	tenant := fnv.New32a()
+	tenant.Write([]byte(utils.KeyPrefix(r.Context())))
+	etag := fmt.Sprintf(`W/"%d-%08x"`, version, tenant.Sum32())
+
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists an ETag, comparing weakly
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
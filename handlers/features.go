@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// FeatureFlagRequest toggles a feature flag at runtime
+type FeatureFlagRequest struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"` // null removes the runtime toggle
+}
+
+// RequireFeature rejects requests to an endpoint whose feature flag is disabled
+func RequireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !utils.FeatureEnabled(name) {
+			errors.HandleError(w, errors.ErrForbidden, "Feature disabled", name)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// FeatureFlagsHandler lists and toggles feature flags (admin key only).
+//
+// GET  /api/features    lists every flag with its effective state
+// POST /api/features    sets or clears the runtime toggle of a flag
+func FeatureFlagsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req FeatureFlagRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+				return
+			}
+			if err := utils.SetFeatureFlag(r.Context(), req.Name, req.Enabled); err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Failed to set feature flag", err.Error())
+				return
+			}
+			logger.Info("Feature flag toggled",
+				zap.String("feature", req.Name),
+				zap.Any("enabled", req.Enabled))
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"features": utils.FeatureFlagStates(r.Context()),
+		})
+	}
+}
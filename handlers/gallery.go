@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// PublicImage is the anonymous view of an image; it deliberately omits management
+// fields such as storage paths, original filenames, sizes and expiry
+type PublicImage struct {
+	ID          string            `json:"id"`
+	URLs        map[string]string `json:"urls"`
+	Orientation string            `json:"orientation"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Tags        []string          `json:"tags"`
+}
+
+// PublicGalleryResponse represents a page of the public gallery
+type PublicGalleryResponse struct {
+	Images     []PublicImage `json:"images"`
+	Page       int           `json:"page"`
+	Limit      int           `json:"limit"`
+	TotalPages int           `json:"totalPages"`
+	Total      int           `json:"total"`
+}
+
+// VisibilityRequest represents the request body for changing an image's visibility
+type VisibilityRequest struct {
+	ID         string `json:"id"`
+	Visibility string `json:"visibility"` // public, unlisted or private
+}
+
+// newPublicImage builds the anonymous view of an image
+func newPublicImage(ctx context.Context, metadata *utils.ImageMetadata, cfg *config.Config) PublicImage {
+	originalURL := getPublicURL(ctx, metadata.Paths.Original, cfg)
+	urls := map[string]string{
+		FormatOriginal: originalURL,
+		FormatWebP:     originalURL,
+		FormatAVIF:     originalURL,
+	}
+	if metadata.Paths.WebP != "" {
+		urls[FormatWebP] = getPublicURL(ctx, metadata.Paths.WebP, cfg)
+	}
+	if metadata.Paths.AVIF != "" {
+		urls[FormatAVIF] = getPublicURL(ctx, metadata.Paths.AVIF, cfg)
+	}
+	// The original of a watermarked image is not published
+	if servesWatermark(metadata) {
+		urls[FormatOriginal] = urls[FormatWebP]
+	}
+
+	tags := metadata.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return PublicImage{
+		ID:          metadata.ID,
+		URLs:        urls,
+		Orientation: metadata.Orientation,
+		Width:       metadata.Width,
+		Height:      metadata.Height,
+		Tags:        tags,
+	}
+}
+
+// publicImages returns all public images matching the orientation and tag filters, newest first
+func publicImages(ctx context.Context, orientation, tag string) ([]*utils.ImageMetadata, error) {
+	ids, err := utils.GetImageIDsByVisibility(ctx, utils.VisibilityPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*utils.ImageMetadata, 0, len(ids))
+	for _, id := range ids {
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
+		if err != nil || !metadata.IsListable() {
+			continue
+		}
+		if orientation != "" && orientation != "all" && metadata.Orientation != orientation {
+			continue
+		}
+		if tag != "" && !containsTag(metadata.Tags, tag) {
+			continue
+		}
+		images = append(images, metadata)
+	}
+	return images, nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicGalleryHandler lists public images without requiring an API key
+func PublicGalleryHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		params, errResp := parseQueryParams(r, cfg)
+		if errResp == nil && params.idsOnly {
+			errResp = errors.NewValidationError([]errors.FieldError{{Field: "fields", Message: "is not supported by the gallery", Value: "ids"}})
+		}
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		images, err := publicImages(r.Context(), params.orientation, "")
+		if err != nil {
+			logger.Error("Failed to list public images", zap.Error(err))
+			errors.HandleError(w, errors.ErrImageList, "Failed to retrieve image list", nil)
+			return
+		}
+		// Apply the tag and date filters of the list API
+		images = slices.DeleteFunc(images, func(metadata *utils.ImageMetadata) bool {
+			return !params.matchesTags(metadata.Tags) || !params.uploadedInRange(metadata.UploadTime)
+		})
+
+		total := len(images)
+		totalPages := int(math.Ceil(float64(total) / float64(params.limit)))
+		start := (params.page - 1) * params.limit
+		end := start + params.limit
+		if end > total {
+			end = total
+		}
+
+		page := make([]PublicImage, 0, params.limit)
+		if start < total {
+			for _, metadata := range images[start:end] {
+				page = append(page, newPublicImage(r.Context(), metadata, cfg))
+			}
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		errors.WritePage(w, PublicGalleryResponse{
+			Images:     page,
+			Page:       params.page,
+			Limit:      params.limit,
+			TotalPages: totalPages,
+			Total:      total,
+		}, page, errors.Pagination{Page: params.page, Limit: params.limit, Total: total, TotalPages: totalPages})
+	}
+}
+
+// PublicRandomHandler redirects to a random public image. It accepts the orientation,
+// tag and format query parameters; format defaults to the best one the client accepts.
+func PublicRandomHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		query := r.URL.Query()
+		images, err := publicImages(r.Context(), query.Get("orientation"), query.Get("tag"))
+		if err != nil {
+			logger.Error("Failed to list public images", zap.Error(err))
+			errors.HandleError(w, errors.ErrImageList, "Failed to retrieve image list", nil)
+			return
+		}
+		if len(images) == 0 {
+			errors.HandleError(w, errors.ErrNotFound, "No public images found", nil)
+			return
+		}
+
+		selected := images[rand.Intn(len(images))]
+		format := query.Get("format")
+		if format == "" {
+			format = detectBestFormat(r, cfg, selected)
+		}
+		image := newPublicImage(r.Context(), selected, cfg)
+		target, ok := image.URLs[format]
+		if !ok {
+			target = image.URLs[FormatOriginal]
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Vary", "Accept")
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
+
+// VisibilityHandler changes the visibility level of an image
+func VisibilityHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		var req VisibilityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+			return
+		}
+
+		visibility, err := utils.ParseVisibility(req.Visibility)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid visibility", req.Visibility)
+			return
+		}
+
+		if _, err := utils.SetImageVisibility(r.Context(), req.ID, visibility); err != nil {
+			errors.HandleError(w, errors.ErrMetadata, "Failed to update image visibility", err.Error())
+			return
+		}
+
+		logger.Info("Image visibility updated",
+			zap.String("id", req.ID),
+			zap.String("visibility", string(visibility)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"id":         req.ID,
+			"visibility": visibility,
+		})
+	}
+}
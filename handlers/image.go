@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
@@ -25,7 +26,7 @@ import (
 // - Ensures consistent headers and caching behavior
 func RandomImage(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
 			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
 			logger.Warn("Invalid request method",
 				zap.String("method", r.Method),
@@ -33,18 +34,173 @@ func RandomImage(cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		logger.Info("Processing random image request",
+		serveLog.Info("Processing random image request",
 			zap.String("storage_type", string(cfg.StorageType)))
 
 		// Use the appropriate handler based on storage type
 		if cfg.StorageType == config.StorageTypeS3 {
-			logger.Debug("Using S3 random image handler")
+			serveLog.Debug("Using S3 random image handler")
 			// Use the existing S3 handler
 			RandomImageHandler(utils.S3Client, cfg)(w, r)
 		} else {
-			logger.Debug("Using local random image handler")
+			serveLog.Debug("Using local random image handler")
 			// Use the existing local handler
 			LocalRandomImageHandler(cfg)(w, r)
 		}
 	}
 }
+
+// RepairImageHandler rebuilds a single image from its stored original at
+// POST /api/images/{id}/repair, a targeted alternative to the library-wide migrations
+func RepairImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		id := r.PathValue("id")
+		if _, err := utils.MetadataManager.GetMetadata(r.Context(), id); err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
+		}
+
+		report, err := utils.RepairImage(r.Context(), cfg, id)
+		if err != nil {
+			logger.Error("Failed to repair image",
+				zap.String("id", id),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to repair image", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// ReprocessImageHandler converts the WebP/AVIF derivatives of an image again from its stored
+// original at POST /api/images/{id}/reprocess, returning the repair report. With ?async=true
+// the conversion is queued and its job returned instead.
+func ReprocessImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		id := r.PathValue("id")
+		if _, err := utils.MetadataManager.GetMetadata(r.Context(), id); err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
+		}
+
+		if r.URL.Query().Get("async") == "true" {
+			if utils.Conversions == nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Queued reprocessing requires Redis metadata storage", nil)
+				return
+			}
+			job, err := utils.Conversions.Enqueue(r.Context(), id, true)
+			if err != nil {
+				logger.Error("Failed to queue reprocessing",
+					zap.String("id", id),
+					zap.Error(err))
+				errors.HandleError(w, errors.ErrInternal, "Failed to queue reprocessing", err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(JobResponse{
+				Success: true,
+				Job:     job,
+			})
+			return
+		}
+
+		report, err := utils.ReprocessImage(r.Context(), cfg, id)
+		if err != nil {
+			logger.Error("Failed to reprocess image",
+				zap.String("id", id),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to reprocess image", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// ReprocessLibraryResponse reports the images queued for reprocessing
+type ReprocessLibraryResponse struct {
+	Success bool `json:"success"`
+	Queued  int  `json:"queued"` // Images whose reprocessing was queued
+}
+
+// ReprocessLibraryHandler queues the reprocessing of every image of the library at
+// POST /api/images/reprocess. Each image gets a conversion job, run by the conversion workers.
+func ReprocessLibraryHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if utils.Conversions == nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Queued reprocessing requires Redis metadata storage", nil)
+			return
+		}
+
+		images, err := utils.MetadataManager.GetAllMetadata(r.Context())
+		if err != nil {
+			logger.Error("Failed to read metadata", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read metadata", err.Error())
+			return
+		}
+
+		queued := 0
+		for _, metadata := range images {
+			if _, err := utils.Conversions.Enqueue(r.Context(), metadata.ID, true); err != nil {
+				logger.Error("Failed to queue reprocessing",
+					zap.String("id", metadata.ID),
+					zap.Error(err))
+				errors.HandleError(w, errors.ErrInternal, "Failed to queue reprocessing",
+					map[string]interface{}{"queued": queued, "error": err.Error()})
+				return
+			}
+			queued++
+		}
+		logger.Info("Queued library reprocessing", zap.Int("images", queued))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(ReprocessLibraryResponse{
+			Success: true,
+			Queued:  queued,
+		})
+	}
+}
+
+// ImagePipelineHandler returns the processing log recorded when an image was uploaded at
+// GET /api/images/{id}/pipeline
+func ImagePipelineHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInvalidParam, "Processing logs require Redis", nil)
+			return
+		}
+
+		id := r.PathValue("id")
+		pipeline, err := utils.GetPipelineLog(r.Context(), id)
+		if err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Processing log not found", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pipeline)
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// maxEventSize bounds the body of an S3 event notification
+const maxEventSize = 1 << 20
+
+// sqsIngestion tracks the SQS consumer, so shutdown waits for the message it is importing
+var sqsIngestion sync.WaitGroup
+
+// ingestObject imports an object uploaded directly to the bucket: it is converted and stored
+// like a regular upload, then removed from the ingest prefix unless configured otherwise.
+// Objects outside the ingest prefix, from other buckets or already imported are skipped.
+func ingestObject(ctx context.Context, cfg *config.Config, object utils.IngestedObject) error {
+	if object.Bucket != "" && object.Bucket != cfg.S3Bucket {
+		return nil
+	}
+	if !strings.HasPrefix(object.Key, cfg.IngestPrefix) || strings.HasSuffix(object.Key, "/") {
+		return nil
+	}
+
+	claimed, err := utils.ClaimIngestedObject(ctx, object)
+	if err != nil {
+		return fmt.Errorf("failed to claim %s: %v", object.Key, err)
+	}
+	if !claimed {
+		logger.Debug("Skipping already ingested object", zap.String("key", object.Key))
+		return nil
+	}
+
+	data, err := utils.Storage.Get(ctx, object.Key)
+	if err != nil {
+		utils.ReleaseIngestedObject(ctx, object)
+		return fmt.Errorf("failed to read %s: %v", object.Key, err)
+	}
+
+	visibility, err := utils.ParseVisibility(cfg.DefaultVisibility)
+	if err != nil {
+		visibility = utils.VisibilityPublic
+	}
+	uploadCtx := &uploadContext{
+		reqCtx:     ctx,
+		visibility: visibility,
+		cfg:        cfg,
+	}
+	name := path.Base(object.Key)
+	result := processReserved(uploadCtx, name, func() UploadResult {
+		return processImageData(uploadCtx, name, data)
+	})
+	if result.Status != "success" {
+		utils.ReleaseIngestedObject(ctx, object)
+		return fmt.Errorf("failed to process %s: %s", object.Key, result.Message)
+	}
+
+	if err := utils.CompleteIngestedObject(ctx, object, result.ID); err != nil {
+		logger.Warn("Failed to record ingested object",
+			zap.String("key", object.Key),
+			zap.Error(err))
+	}
+	if !cfg.IngestKeepSource {
+		if err := utils.Storage.Delete(ctx, object.Key); err != nil {
+			logger.Warn("Failed to delete ingested object",
+				zap.String("key", object.Key),
+				zap.Error(err))
+		}
+	}
+
+	logger.Info("Ingested object from bucket",
+		zap.String("key", object.Key),
+		zap.String("image_id", result.ID))
+	return nil
+}
+
+// ingestObjects imports the objects of an event notification, returning the last failure
+func ingestObjects(ctx context.Context, cfg *config.Config, objects []utils.IngestedObject) error {
+	var failed error
+	for _, object := range objects {
+		if err := ingestObject(ctx, cfg, object); err != nil {
+			logger.Error("Failed to ingest object",
+				zap.String("key", object.Key),
+				zap.Error(err))
+			failed = err
+		}
+	}
+	return failed
+}
+
+// S3EventHandler receives S3 event notifications (S3 via SNS, MinIO webhook targets...) at
+// /api/ingest/s3. Requests carry the ingest webhook token as a Bearer token or "token" query
+// parameter, or the API key. Failures return 500 so the sender retries the event.
+func S3EventHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !validIngestToken(r, cfg) {
+			errors.WriteError(w, errors.ErrInvalidAPIKey)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxEventSize))
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Failed to read event", nil)
+			return
+		}
+
+		objects, err := utils.ParseS3Event(body)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid S3 event", err.Error())
+			return
+		}
+		// Finish imports even if the sender gives up waiting
+		if err := ingestObjects(context.WithoutCancel(r.Context()), cfg, objects); err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to ingest objects", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"objects": len(objects),
+		})
+	}
+}
+
+func validIngestToken(r *http.Request, cfg *config.Config) bool {
+	if hasAPIKeyScope(cfg, r, utils.ScopeUpload) {
+		return true
+	}
+	if cfg.IngestWebhookToken == "" {
+		return false
+	}
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.IngestWebhookToken)) == 1
+}
+
+// WaitSQSIngestion waits for the SQS consumer to stop once its context is cancelled
+func WaitSQSIngestion() {
+	sqsIngestion.Wait()
+}
+
+// StartSQSIngestion consumes the configured SQS queue until the context is cancelled. Messages
+// are deleted once all their objects are imported; failed ones are redelivered by SQS after
+// their visibility timeout.
+func StartSQSIngestion(ctx context.Context, cfg *config.Config) error {
+	client, err := utils.NewSQSClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	sqsIngestion.Add(1)
+	go func() {
+		defer sqsIngestion.Done()
+		logger.Info("Consuming bucket events from SQS",
+			zap.String("queue", cfg.IngestSQSQueueURL),
+			zap.String("prefix", cfg.IngestPrefix))
+
+		for ctx.Err() == nil {
+			messages, err := client.ReceiveMessages(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warn("Failed to receive SQS messages", zap.Error(err))
+				select {
+				case <-ctx.Done():
+				case <-time.After(10 * time.Second):
+				}
+				continue
+			}
+
+			for _, message := range messages {
+				objects, err := utils.ParseS3Event([]byte(message.Body))
+				if err != nil {
+					// Unparseable messages would be redelivered forever; drop them
+					logger.Warn("Dropping invalid SQS message",
+						zap.String("message_id", message.MessageID),
+						zap.Error(err))
+				} else if err := ingestObjects(context.WithoutCancel(ctx), cfg, objects); err != nil {
+					continue
+				}
+				if err := client.DeleteMessage(ctx, message.ReceiptHandle); err != nil {
+					logger.Warn("Failed to delete SQS message",
+						zap.String("message_id", message.MessageID),
+						zap.Error(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// JobResponse carries the state of a conversion job
+type JobResponse struct {
+	Success bool                 `json:"success"`
+	Job     *utils.ConversionJob `json:"job"`
+}
+
+// JobHandler reports the state of the conversion job of an async upload at /api/jobs/{id}.
+// Jobs are kept for a week after their last change.
+func JobHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		id := r.PathValue("id")
+		job, err := utils.GetConversionJob(r.Context(), id)
+		if err == utils.ErrConversionJobNotFound {
+			errors.HandleError(w, errors.ErrNotFound, "Job not found", id)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to read conversion job",
+				zap.String("id", id),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read job", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(JobResponse{
+			Success: true,
+			Job:     job,
+		})
+	}
+}
@@ -1,13 +1,14 @@
 package handlers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -47,6 +48,22 @@ type PaginatedResponse struct {
 	Total      int         `json:"total"`      // Total number of images
 }
 
+// ImageRef is the entry of an image in ids-only pages, for clients enumerating large libraries
+type ImageRef struct {
+	ID  string `json:"id"`
+	URL string `json:"url"` // URL in the requested format
+}
+
+// ImageRefsResponse is a page of a list requested with fields=ids
+type ImageRefsResponse struct {
+	Success    bool       `json:"success"`
+	Images     []ImageRef `json:"images"`
+	Page       int        `json:"page"`
+	Limit      int        `json:"limit"`
+	TotalPages int        `json:"totalPages"`
+	Total      int        `json:"total"`
+}
+
 // ListImagesHandler returns a handler for listing images
 func ListImagesHandler(cfg *config.Config) http.HandlerFunc {
 	// Set global config for debug logging
@@ -64,26 +81,50 @@ func ListImagesHandler(cfg *config.Config) http.HandlerFunc {
 			}
 		}()
 
-		// Validate API key
-		if !validateAPIKey(w, r, cfg.APIKey) {
+		// Parse query parameters
+		params, errResp := parseQueryParams(r, cfg)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		if libraryNotModified(w, r) {
+			cacheHit = true
 			return
 		}
-
-		// Parse query parameters
-		params := parseQueryParams(r)
 
 		var allImages []ImageInfo
 
+		// SQLite has no page cache; every request reads the database
+		if utils.IsSQLiteMetadataStore() {
+			var err error
+			allImages, err = listImagesFromMetadata(r.Context(), params, cfg)
+			if err != nil {
+				logger.Error("Failed to list images from SQLite", zap.Error(err))
+				errors.HandleError(w, errors.ErrImageList, "Failed to retrieve image list", err)
+				return
+			}
+			writeImagePage(w, cfg, params, allImages)
+			return
+		}
+
 		// Try to get from Redis if enabled
 		if !utils.IsRedisMetadataStore() {
-			errors.HandleError(w, errors.ErrInternal, "Redis is required for metadata storage", nil)
+			errors.HandleError(w, errors.ErrInternal, "Redis or SQLite is required for metadata storage", nil)
 			return
 		}
 
 		cacheKey := utils.CachedPageKey{
 			Orientation: params.orientation,
 			Format:      params.format,
-			Tag:         params.tag,
+			Tags:        params.tags,
+			AnyTag:      params.anyTag,
+			ExcludeTags: params.excludeTags,
+			After:       params.uploadedAfter,
+			Before:      params.uploadedBefore,
+			Visibility:  params.visibility,
+			Sort:        params.sort,
+			Ascending:   params.ascending,
+			MinLikes:    params.minLikes,
 			Page:        params.page,
 			Limit:       params.limit,
 		}
@@ -109,127 +150,170 @@ func ListImagesHandler(cfg *config.Config) http.HandlerFunc {
 			}
 		}
 
-		// Calculate pagination values
-		total := len(allImages)
-		totalPages := int(math.Ceil(float64(total) / float64(params.limit)))
+		writeImagePage(w, cfg, params, allImages)
+	}
+}
 
-		// Ensure page is within valid range
-		if params.page > totalPages && totalPages > 0 {
-			params.page = totalPages
-		}
+// ImageDetailResponse describes a single image
+type ImageDetailResponse struct {
+	Success     bool                 `json:"success"`
+	Image       *utils.ImageMetadata `json:"image"`                 // Full metadata of the image
+	URLs        map[string]string    `json:"urls"`                  // URLs of the original, webp and avif formats
+	Collections []string             `json:"collections,omitempty"` // IDs of the collections the image belongs to
+}
 
-		// Calculate start and end indices for the current page
-		startIdx := (params.page - 1) * params.limit
-		endIdx := startIdx + params.limit
-		if endIdx > total {
-			endIdx = total
+// ImageDetailHandler returns the metadata of a single image at /api/images/{id}
+func ImageDetailHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
 		}
 
-		// Extract the subset of images for the current page
-		var pagedImages []ImageInfo
-		if startIdx < total {
-			pagedImages = allImages[startIdx:endIdx]
-		} else {
-			pagedImages = []ImageInfo{}
+		id := r.PathValue("id")
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), id)
+		if err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
 		}
 
-		// Send response
+		// Build the URLs the way the list API does, without its filters
+		params := queryParams{orientation: "all", format: "original"}
+		imageInfo, _ := imageInfoFromFields(r.Context(), metadata.ID, utils.MetadataFieldValues(metadata), params, cfg)
+		collections, _ := utils.ImageCollections(r.Context(), metadata.ID)
+
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ImageDetailResponse{
+			Success:     true,
+			Image:       metadata,
+			URLs:        imageInfo.URLs,
+			Collections: collections,
+		})
+	}
+}
+
+// writeImagePage responds with the requested page of the listed images
+func writeImagePage(w http.ResponseWriter, cfg *config.Config, params queryParams, allImages []ImageInfo) {
+	// Calculate pagination values
+	total := len(allImages)
+	totalPages := int(math.Ceil(float64(total) / float64(params.limit)))
+
+	// Ensure page is within valid range
+	if params.page > totalPages && totalPages > 0 {
+		params.page = totalPages
+	}
 
-		response := PaginatedResponse{
+	// Calculate start and end indices for the current page
+	startIdx := (params.page - 1) * params.limit
+	endIdx := startIdx + params.limit
+	if endIdx > total {
+		endIdx = total
+	}
+
+	// Extract the subset of images for the current page
+	var pagedImages []ImageInfo
+	if startIdx < total {
+		pagedImages = allImages[startIdx:endIdx]
+	} else {
+		pagedImages = []ImageInfo{}
+	}
+
+	// Send response
+	pagination := errors.Pagination{Page: params.page, Limit: params.limit, Total: total, TotalPages: totalPages}
+	if params.idsOnly {
+		refs := make([]ImageRef, len(pagedImages))
+		for i, image := range pagedImages {
+			refs[i] = ImageRef{ID: image.ID, URL: image.URL}
+		}
+		errors.WritePage(w, ImageRefsResponse{
 			Success:    true,
-			Images:     pagedImages,
+			Images:     refs,
 			Page:       params.page,
 			Limit:      params.limit,
 			TotalPages: totalPages,
 			Total:      total,
-		}
+		}, refs, pagination)
+		return
+	}
 
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			if cfg.DebugMode {
-				logger.Debug("Error encoding JSON response", zap.Error(err))
-			}
+	response := PaginatedResponse{
+		Success:    true,
+		Images:     pagedImages,
+		Page:       params.page,
+		Limit:      params.limit,
+		TotalPages: totalPages,
+		Total:      total,
+	}
+
+	if err := errors.WritePage(w, response, pagedImages, pagination); err != nil {
+		if cfg.DebugMode {
+			logger.Debug("Error encoding JSON response", zap.Error(err))
 		}
 	}
 }
 
 // Query parameters structure
 type queryParams struct {
-	orientation string
-	format      string
-	tag         string // Tag to filter by
-	page        int
-	limit       int
+	orientation    string
+	format         string
+	tags           []string  // Tags to filter by (tag and tags)
+	anyTag         bool      // Whether one of the tags is enough (tag_mode=any) rather than all of them
+	excludeTags    []string  // Tags the listed images must not have
+	uploadedAfter  time.Time // Earliest upload time, inclusive (zero for none)
+	uploadedBefore time.Time // Latest upload time, exclusive (zero for none)
+	visibility     string    // Visibility level to filter by (empty for all)
+	sort           string    // Sort key: empty or name for the filename, likes, uploadTime, size or expiry
+	ascending      bool      // Whether the sort key ascends (order=asc); lists descend by default
+	minLikes       int64     // Minimum number of likes
+	idsOnly        bool      // Whether only the IDs and URLs of the images are returned (fields=ids)
+	page           int
+	limit          int
 }
 
-// validateAPIKey checks if the provided API key is valid
-func validateAPIKey(w http.ResponseWriter, r *http.Request, configAPIKey string) bool {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		errors.HandleError(w, errors.ErrUnauthorized, "Authorization header not provided", nil)
-		return false
-	}
-
-	parts := strings.SplitN(authHeader, " ", 2)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		errors.HandleError(w, errors.ErrUnauthorized, "Invalid authorization format", nil)
-		return false
-	}
-
-	apiKey := parts[1]
-	if apiKey != configAPIKey {
-		errors.HandleError(w, errors.ErrUnauthorized, "Invalid API key", nil)
-		return false
+// matchesTags reports whether an image with the given tags passes the tag filters of the query
+func (p queryParams) matchesTags(imageTags []string) bool {
+	if p.anyTag && len(p.tags) > 0 {
+		return hasAnyTag(imageTags, p.tags) && matchesTags(imageTags, nil, p.excludeTags)
 	}
+	return matchesTags(imageTags, p.tags, p.excludeTags)
+}
 
-	return true
+// uploadedInRange reports whether an upload time is within the date range of the query
+func (p queryParams) uploadedInRange(uploadTime time.Time) bool {
+	return (p.uploadedAfter.IsZero() || !uploadTime.Before(p.uploadedAfter)) &&
+		(p.uploadedBefore.IsZero() || uploadTime.Before(p.uploadedBefore))
 }
 
 // parseQueryParams extracts and validates query parameters
-func parseQueryParams(r *http.Request) queryParams {
-	orientation := r.URL.Query().Get("orientation")
-	format := r.URL.Query().Get("format")
-	tag := r.URL.Query().Get("tag")
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
-
-	// Default values
-	if orientation == "" {
-		orientation = "all" // all, landscape, portrait
-	}
-	if format == "" {
-		format = "original" // original, webp, avif
-	}
-	// Tag can be empty, which means no tag filtering
-
-	// Set default pagination values
-	page := 1
-	limit := 12 // Default items per page
-
-	// Parse page number
-	if pageStr != "" {
-		pageVal, err := strconv.Atoi(pageStr)
-		if err == nil && pageVal > 0 {
-			page = pageVal
-		}
+func parseQueryParams(r *http.Request, cfg *config.Config) (queryParams, *errors.ErrorResponse) {
+	query := r.URL.Query()
+	var v paramValidator
+	idsOnly := v.Enum("fields", query.Get("fields"), "", "ids") == "ids"
+	maxLimit := cfg.ListMaxLimit
+	if idsOnly {
+		maxLimit = cfg.ListIDsMaxLimit
 	}
-
-	// Parse limit
-	if limitStr != "" {
-		limitVal, err := strconv.Atoi(limitStr)
-		if err == nil && limitVal > 0 && limitVal <= 50 { // Cap at 50 items per page
-			limit = limitVal
-		}
+	params := queryParams{
+		orientation: v.Enum("orientation", query.Get("orientation"), "all", "all", "landscape", "portrait"),
+		format:      v.Enum("format", query.Get("format"), "original", "original", "webp", "avif", "gif"),
+		// Support both a single tag and multiple tags, like the random API
+		tags:           append(v.Tags("tag", query.Get("tag")), v.Tags("tags", query.Get("tags"))...),
+		anyTag:         v.Enum("tag_mode", query.Get("tag_mode"), "all", "all", "any") == "any",
+		excludeTags:    v.Tags("exclude", query.Get("exclude")),
+		uploadedAfter:  v.Time("uploaded_after", query.Get("uploaded_after")),
+		uploadedBefore: v.Time("uploaded_before", query.Get("uploaded_before")),
+		visibility:     v.Enum("visibility", query.Get("visibility"), "", string(utils.VisibilityPublic), string(utils.VisibilityUnlisted), string(utils.VisibilityPrivate)),
+		sort:           v.Enum("sort", query.Get("sort"), "", sortName, sortLikes, sortUploadTime, sortSize, sortExpiry),
+		ascending:      v.Enum("order", query.Get("order"), "desc", "asc", "desc") == "asc",
+		minLikes:       v.Int64("min_likes", query.Get("min_likes"), 0, 0),
+		idsOnly:        idsOnly,
+		page:           v.Int("page", query.Get("page"), 1, 1, math.MaxInt32),
+		limit:          v.Int("limit", query.Get("limit"), cfg.ListDefaultLimit, 1, maxLimit),
 	}
-
-	return queryParams{
-		orientation: orientation,
-		format:      format,
-		tag:         tag,
-		page:        page,
-		limit:       limit,
+	if !params.uploadedAfter.IsZero() && !params.uploadedBefore.IsZero() && !params.uploadedAfter.Before(params.uploadedBefore) {
+		v.reject("uploaded_before", query.Get("uploaded_before"), "must be later than uploaded_after")
 	}
+	return params, v.Err()
 }
 
 // listImagesFromRedis retrieves images from Redis with optimized queries
@@ -242,31 +326,33 @@ func listImagesFromRedis(ctx context.Context, params queryParams, cfg *config.Co
 	var imageIDs []string
 	var err error
 
-	// Use pipeline for tag and ID retrieval
-	pipe := utils.RedisClient.Pipeline()
-	var tagCmd *redis.StringSliceCmd
-	var idsCmd *redis.StringSliceCmd
-
-	if params.tag != "" {
-		// Get images by tag
-		tagCmd = pipe.SMembers(ctx, utils.RedisPrefix+"tag:"+params.tag)
-	} else {
-		// Get all image IDs from sorted set
-		idsCmd = pipe.ZRevRange(ctx, utils.RedisPrefix+"images", 0, -1)
+	switch {
+	case len(params.tags) > 0 && params.anyTag:
+		// Get images that have ANY of the tags
+		imageIDs, err = utils.GetImagesByAnyTag(ctx, params.tags)
+	case len(params.tags) > 0:
+		// Get images that have ALL of the tags, like the random API
+		imageIDs, err = utils.GetImagesByMultipleTags(ctx, params.tags)
+	default:
+		// Get the image IDs uploaded within the date range from the sorted set, scored by upload time
+		byScore := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+		if !params.uploadedAfter.IsZero() {
+			byScore.Min = strconv.FormatInt(params.uploadedAfter.Unix(), 10)
+		}
+		if !params.uploadedBefore.IsZero() {
+			// Scores are whole seconds; imageInfoFromFields checks the exact bound
+			byScore.Max = strconv.FormatInt(params.uploadedBefore.Unix(), 10)
+		}
+		if params.sort == sortUploadTime && params.ascending {
+			imageIDs, err = utils.RedisClient.ZRangeByScore(ctx, utils.KeyPrefix(ctx)+"images", byScore).Result()
+		} else {
+			imageIDs, err = utils.RedisClient.ZRevRangeByScore(ctx, utils.KeyPrefix(ctx)+"images", byScore).Result()
+		}
 	}
-
-	_, err = pipe.Exec(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get image IDs: %v", err)
 	}
 
-	// Get results from commands
-	if params.tag != "" {
-		imageIDs = tagCmd.Val()
-	} else {
-		imageIDs = idsCmd.Val()
-	}
-
 	if len(imageIDs) == 0 {
 		return []ImageInfo{}, nil
 	}
@@ -275,11 +361,11 @@ func listImagesFromRedis(ctx context.Context, params queryParams, cfg *config.Co
 	images := make([]ImageInfo, 0, len(imageIDs))
 
 	// Use pipeline to get metadata for all images
-	pipe = utils.RedisClient.Pipeline()
+	pipe := utils.RedisClient.Pipeline()
 	metadataCommands := make(map[string]*redis.MapStringStringCmd, len(imageIDs))
 
 	for _, id := range imageIDs {
-		metadataCommands[id] = pipe.HGetAll(ctx, utils.RedisPrefix+"metadata:"+id)
+		metadataCommands[id] = pipe.HGetAll(ctx, utils.KeyPrefix(ctx)+"metadata:"+id)
 	}
 
 	_, err = pipe.Exec(ctx)
@@ -293,112 +379,244 @@ func listImagesFromRedis(ctx context.Context, params queryParams, cfg *config.Co
 		if err != nil || len(data) == 0 {
 			continue
 		}
+		data = utils.ExpandMetadataFields(id, data)
+		if imageInfo, ok := imageInfoFromFields(ctx, id, data, params, cfg); ok {
+			images = append(images, imageInfo)
+		}
+	}
 
-		// Filter by orientation if specified
-		if params.orientation != "all" && data["orientation"] != params.orientation {
-			continue
+	// The sorted set already orders unfiltered lists by upload time
+	if len(params.tags) > 0 || params.sort != sortUploadTime {
+		sortImages(images, params)
+	}
+	return images, nil
+}
+
+// imageInfoFromFields builds the list entry of an image from its metadata hash fields, reporting
+// false when the image is filtered out by the query
+func imageInfoFromFields(ctx context.Context, id string, data map[string]string, params queryParams, cfg *config.Config) (ImageInfo, bool) {
+	// Filter by orientation if specified
+	if params.orientation != "all" && data["orientation"] != params.orientation {
+		return ImageInfo{}, false
+	}
+
+	// Filter by visibility if specified
+	visibility := utils.VisibilityFromFields(data)
+	if visibility == "" {
+		visibility = utils.VisibilityPublic
+	}
+	if params.visibility != "" && string(visibility) != params.visibility {
+		return ImageInfo{}, false
+	}
+
+	// Filter by popularity if specified
+	likes, _ := strconv.ParseInt(data["likes"], 10, 64)
+	if likes < params.minLikes {
+		return ImageInfo{}, false
+	}
+
+	// Filter by tags and upload date if specified
+	if !params.matchesTags(strings.Split(data["tags"], ",")) {
+		return ImageInfo{}, false
+	}
+	uploadTime, _ := time.Parse(time.RFC3339, data["uploadTime"])
+	if !params.uploadedInRange(uploadTime) {
+		return ImageInfo{}, false
+	}
+
+	// Parse paths from JSON
+	var paths struct {
+		Original   string            `json:"original"`
+		WebP       string            `json:"webp"`
+		AVIF       string            `json:"avif"`
+		Thumbnails map[string]string `json:"thumbnails"`
+		Video      string            `json:"video"`
+	}
+	if pathsStr := data["paths"]; pathsStr != "" {
+		if err := json.Unmarshal([]byte(pathsStr), &paths); err != nil {
+			logger.Warn("Failed to unmarshal paths",
+				zap.String("image_id", id),
+				zap.Error(err))
 		}
+	}
 
-		// Parse paths from JSON
-		var paths struct {
-			Original string `json:"original"`
-			WebP     string `json:"webp"`
-			AVIF     string `json:"avif"`
+	// Create image info
+	imageInfo := ImageInfo{
+		ID:          id,
+		FileName:    data["originalName"],
+		Orientation: data["orientation"],
+		Format:      data["format"],
+		StorageType: string(cfg.StorageType),
+		Visibility:  string(visibility),
+		Likes:       likes,
+		Blurhash:    data["blurhash"],
+		URLs:        make(map[string]string, 3), // Pre-allocate with capacity
+	}
+	imageInfo.Width, _ = strconv.Atoi(data["width"])
+	imageInfo.Height, _ = strconv.Atoi(data["height"])
+	imageInfo.UploadTime = uploadTime
+	imageInfo.Serves, imageInfo.LastServed = utils.ParseServeFields(data)
+	if expiry, err := time.Parse(time.RFC3339, data["expiryTime"]); err == nil && !expiry.IsZero() {
+		imageInfo.ExpiryTime = &expiry
+	}
+
+	// Parse tags
+	if tags := data["tags"]; tags != "" {
+		imageInfo.Tags = strings.Split(tags, ",")
+	}
+
+	// Get base URL for image access
+	baseURL := imageBaseURL(ctx, cfg)
+
+	// Construct URLs based on paths
+	// GIFs and other animations are served as is in every format
+	animated := data["format"] == "gif" || data["animated"] == "true"
+
+	// The gif format lists only animations, linked to their original
+	format := params.format
+	if format == "gif" {
+		if !animated {
+			return ImageInfo{}, false
 		}
-		if pathsStr := data["paths"]; pathsStr != "" {
-			if err := json.Unmarshal([]byte(pathsStr), &paths); err != nil {
-				logger.Warn("Failed to unmarshal paths",
-					zap.String("image_id", id),
-					zap.Error(err))
-			}
+		format = "original"
+	}
+
+	if animated {
+		gifPath := paths.Original
+		if gifPath == "" {
+			gifPath = filepath.Join("gif", id+".gif")
+		}
+		animatedURL := fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(gifPath, "\\", "/"))
+		imageInfo.URLs["original"] = animatedURL
+		imageInfo.URLs["webp"] = animatedURL
+		imageInfo.URLs["avif"] = animatedURL
+	} else {
+		// Use stored paths if available
+		if paths.Original != "" {
+			imageInfo.URLs["original"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.Original, "\\", "/"))
+		} else {
+			originalPath := filepath.Join("original", data["orientation"], id+"."+data["format"])
+			imageInfo.URLs["original"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(originalPath, "\\", "/"))
 		}
 
-		// Create image info
-		imageInfo := ImageInfo{
-			ID:          id,
-			FileName:    data["originalName"],
-			Orientation: data["orientation"],
-			Format:      data["format"],
-			StorageType: string(cfg.StorageType),
-			URLs:        make(map[string]string, 3), // Pre-allocate with capacity
+		if paths.WebP != "" {
+			imageInfo.URLs["webp"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.WebP, "\\", "/"))
+		} else {
+			webpPath := filepath.Join(data["orientation"], "webp", id+".webp")
+			imageInfo.URLs["webp"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(webpPath, "\\", "/"))
 		}
 
-		// Parse tags
-		if tags := data["tags"]; tags != "" {
-			imageInfo.Tags = strings.Split(tags, ",")
+		if paths.AVIF != "" {
+			imageInfo.URLs["avif"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.AVIF, "\\", "/"))
+		} else {
+			avifPath := filepath.Join(data["orientation"], "avif", id+".avif")
+			imageInfo.URLs["avif"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(avifPath, "\\", "/"))
 		}
+	}
+
+	// Video clips link their video along with the poster and preview
+	if paths.Video != "" {
+		imageInfo.URLs["video"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.Video, "\\", "/"))
+	}
 
-		// Get base URL for image access
-		baseURL := cfg.GetBaseURL()
+	// Thumbnails let grids avoid downloading full-size images
+	if len(paths.Thumbnails) > 0 {
+		imageInfo.Thumbnails = make(map[string]string, len(paths.Thumbnails))
+		for size, path := range paths.Thumbnails {
+			imageInfo.Thumbnails[size] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(path, "\\", "/"))
+		}
+	}
 
-		// Construct URLs based on paths
-		isGIF := data["format"] == "gif"
+	// Set the requested format URL
+	imageInfo.URL = imageInfo.URLs[format]
 
-		if isGIF {
-			gifPath := filepath.Join("gif", id+".gif")
-			gifURL := fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(gifPath, "\\", "/"))
-			imageInfo.URLs["original"] = gifURL
-			imageInfo.URLs["webp"] = gifURL
-			imageInfo.URLs["avif"] = gifURL
-		} else {
-			// Use stored paths if available
-			if paths.Original != "" {
-				imageInfo.URLs["original"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.Original, "\\", "/"))
-			} else {
-				originalPath := filepath.Join("original", data["orientation"], id+"."+data["format"])
-				imageInfo.URLs["original"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(originalPath, "\\", "/"))
-			}
+	// Update filename based on format
+	if format != "original" {
+		baseName := strings.TrimSuffix(imageInfo.FileName, filepath.Ext(imageInfo.FileName))
+		imageInfo.FileName = baseName + "." + format
+	}
 
-			if paths.WebP != "" {
-				imageInfo.URLs["webp"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.WebP, "\\", "/"))
-			} else {
-				webpPath := filepath.Join(data["orientation"], "webp", id+".webp")
-				imageInfo.URLs["webp"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(webpPath, "\\", "/"))
+	// Get file size from metadata (works for both local and S3 storage)
+	if sizesStr := data["sizes"]; sizesStr != "" {
+		var storedSizes map[string]int64
+		if err := json.Unmarshal([]byte(sizesStr), &storedSizes); err == nil {
+			if size, exists := storedSizes[format]; exists && size > 0 {
+				imageInfo.Size = size
 			}
+		}
+	}
 
-			if paths.AVIF != "" {
-				imageInfo.URLs["avif"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(paths.AVIF, "\\", "/"))
-			} else {
-				avifPath := filepath.Join(data["orientation"], "avif", id+".avif")
-				imageInfo.URLs["avif"] = fmt.Sprintf("%s/%s", baseURL, strings.ReplaceAll(avifPath, "\\", "/"))
+	// Fallback: try the legacy size field for backward compatibility
+	if imageInfo.Size == 0 {
+		if sizeStr := data["size"]; sizeStr != "" {
+			if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
+				imageInfo.Size = size
 			}
 		}
+	}
 
-		// Set the requested format URL
-		imageInfo.URL = imageInfo.URLs[params.format]
+	return imageInfo, true
+}
 
-		// Update filename based on format
-		if params.format != "original" {
-			baseName := strings.TrimSuffix(imageInfo.FileName, filepath.Ext(imageInfo.FileName))
-			imageInfo.FileName = baseName + "." + params.format
-		}
+// Sort keys of the list APIs
+const (
+	sortName       = "name"
+	sortLikes      = "likes"
+	sortUploadTime = "uploadTime"
+	sortSize       = "size"
+	sortExpiry     = "expiry"
+)
 
-		// Get file size from Redis metadata (works for both local and S3 storage)
-		if sizesStr := data["sizes"]; sizesStr != "" {
-			var storedSizes map[string]int64
-			if err := json.Unmarshal([]byte(sizesStr), &storedSizes); err == nil {
-				if size, exists := storedSizes[params.format]; exists && size > 0 {
-					imageInfo.Size = size
-				}
+// sortImages orders listed images by the sort key of the query, descending unless it asks for
+// ascending order. Ties are broken by filename in the same direction, and images that never
+// expire come last when sorting by expiry.
+func sortImages(images []ImageInfo, params queryParams) {
+	slices.SortStableFunc(images, func(a, b ImageInfo) int {
+		if params.sort == sortExpiry && (a.ExpiryTime == nil) != (b.ExpiryTime == nil) {
+			if a.ExpiryTime == nil {
+				return 1
 			}
+			return -1
 		}
 
-		// Fallback: try the legacy size field for backward compatibility
-		if imageInfo.Size == 0 {
-			if sizeStr := data["size"]; sizeStr != "" {
-				if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
-					imageInfo.Size = size
-				}
+		var c int
+		switch params.sort {
+		case sortLikes:
+			c = cmp.Compare(a.Likes, b.Likes)
+		case sortUploadTime:
+			c = a.UploadTime.Compare(b.UploadTime)
+		case sortSize:
+			c = cmp.Compare(a.Size, b.Size)
+		case sortExpiry:
+			if a.ExpiryTime != nil {
+				c = a.ExpiryTime.Compare(*b.ExpiryTime)
 			}
 		}
+		if c == 0 {
+			c = strings.Compare(a.FileName, b.FileName)
+		}
+		if !params.ascending {
+			c = -c
+		}
+		return c
+	})
+}
 
-		images = append(images, imageInfo)
+// listImagesFromMetadata retrieves images from a metadata store without Redis indexes, reading
+// the metadata of every image of the tenant
+func listImagesFromMetadata(ctx context.Context, params queryParams, cfg *config.Config) ([]ImageInfo, error) {
+	allMetadata, err := utils.MetadataManager.GetAllMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %v", err)
 	}
 
-	// Sort by filename in descending order
-	sort.Slice(images, func(i, j int) bool {
-		return images[i].FileName > images[j].FileName
-	})
+	images := make([]ImageInfo, 0, len(allMetadata))
+	for _, metadata := range allMetadata {
+		if imageInfo, ok := imageInfoFromFields(ctx, metadata.ID, utils.MetadataFieldValues(metadata), params, cfg); ok {
+			images = append(images, imageInfo)
+		}
+	}
 
+	sortImages(images, params)
 	return images, nil
 }
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// LoggingRequest changes the logging of this instance; omitted fields are left unchanged
+type LoggingRequest struct {
+	Level      string            `json:"level"`      // Global level: debug, info, warn or error
+	Console    *bool             `json:"console"`    // Write entries to stdout as well
+	Modules    map[string]string `json:"modules"`    // Module levels to set; an empty level removes the override
+	RateLimits map[string]int    `json:"rateLimits"` // Entries per message and minute of hot path categories; 0 removes the limit
+}
+
+// LoggingResponse reports the logging in effect
+type LoggingResponse struct {
+	Success bool         `json:"success"`
+	Logging logger.State `json:"logging"`
+}
+
+// LoggingHandler shows and switches the log level, output and rate limits of this instance without a
+// restart (admin key only). Changes apply to the instance handling the request and last until
+// it restarts.
+//
+// GET  /api/logging    returns the level, console output and module overrides
+// POST /api/logging    changes them
+func LoggingHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req LoggingRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+				return
+			}
+			if req.Level != "" {
+				if err := logger.SetLevel(req.Level); err != nil {
+					errors.HandleError(w, errors.ErrInvalidParam, "Invalid log level", err.Error())
+					return
+				}
+			}
+			for module, level := range req.Modules {
+				if err := logger.SetModuleLevel(module, level); err != nil {
+					errors.HandleError(w, errors.ErrInvalidParam, "Invalid module log level", err.Error())
+					return
+				}
+			}
+			for category, limit := range req.RateLimits {
+				logger.SetRateLimit(category, limit)
+			}
+			if req.Console != nil {
+				logger.SetConsole(*req.Console)
+			}
+			logger.Info("Logging changed",
+				zap.Any("logging", logger.CurrentState()))
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(LoggingResponse{
+			Success: true,
+			Logging: logger.CurrentState(),
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// MetricsResponse reports the current load of this instance
+type MetricsResponse struct {
+	Success    bool                   `json:"success"`
+	WorkerPool utils.WorkerPoolStats  `json:"workerPool"` // Conversions running and waiting for a worker
+	Uploads    utils.UploadQueueStats `json:"uploads"`    // Uploaded files processed and queued
+}
+
+// MetricsHandler returns the load of the worker pool and upload queue of this instance at
+// GET /api/metrics, for monitoring how close it is to rejecting uploads with 503
+func MetricsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(MetricsResponse{
+			Success:    true,
+			WorkerPool: utils.GetWorkerPool().Stats(),
+			Uploads:    utils.Uploads.Stats(),
+		})
+	}
+}
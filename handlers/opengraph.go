@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// OEmbedResponse represents an oEmbed photo response (https://oembed.com)
+type OEmbedResponse struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	URL          string `json:"url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// viewPageData holds the values rendered into the image landing page
+type viewPageData struct {
+	Title     string
+	PageURL   string
+	ImageURL  string
+	OEmbedURL string
+	MimeType  string
+	Width     int
+	Height    int
+}
+
+var viewPageTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="ImageFlow">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.PageURL}}">
+<meta property="og:image" content="{{.ImageURL}}">
+<meta property="og:image:type" content="{{.MimeType}}">
+{{- if .Width}}
+<meta property="og:image:width" content="{{.Width}}">
+<meta property="og:image:height" content="{{.Height}}">
+{{- end}}
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:image" content="{{.ImageURL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<style>
+html,body{margin:0;height:100%;background:#111}
+body{display:flex;align-items:center;justify-content:center}
+img{max-width:100%;max-height:100vh;object-fit:contain}
+</style>
+</head>
+<body>
+<img src="{{.ImageURL}}" alt="{{.Title}}"{{if .Width}} width="{{.Width}}" height="{{.Height}}"{{end}}>
+</body>
+</html>
+`))
+
+// baseURL returns the public base URL of the server: the tenant's domain, the configured
+// public URL, or else derived from the request
+func baseURL(cfg *config.Config, r *http.Request) string {
+	if tenant := utils.TenantFromContext(r.Context()); tenant != nil && tenant.PublicBaseURL() != "" {
+		return tenant.PublicBaseURL()
+	}
+	if cfg.PublicURL != "" {
+		return cfg.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.Split(proto, ",")[0]
+	}
+	return scheme + "://" + r.Host
+}
+
+// absoluteURL makes a public image URL absolute; S3 URLs already are
+func absoluteURL(cfg *config.Config, r *http.Request, u string) string {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return u
+	}
+	return baseURL(cfg, r) + u
+}
+
+// ViewHandler renders an HTML landing page for an image at /v/{id} with Open Graph and
+// Twitter card tags so shared links unfurl in chat apps and social networks
+func ViewHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v/"), "/")
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), id)
+		if err != nil || metadata.Paths.Original == "" || !metadata.IsViewable() {
+			http.NotFound(w, r)
+			return
+		}
+
+		base := baseURL(cfg, r)
+		pageURL := base + "/v/" + id
+		data := viewPageData{
+			Title:     imageTitle(metadata),
+			PageURL:   pageURL,
+			ImageURL:  absoluteURL(cfg, r, getPublicURL(r.Context(), metadata.Paths.Original, cfg)),
+			OEmbedURL: base + "/oembed?format=json&url=" + url.QueryEscape(pageURL),
+			MimeType:  getContentType(FormatOriginal, metadata.Paths.Original),
+			Width:     metadata.Width,
+			Height:    metadata.Height,
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := viewPageTemplate.Execute(w, data); err != nil {
+			logger.Error("Failed to render view page",
+				zap.String("id", id),
+				zap.Error(err))
+		}
+	}
+}
+
+// OEmbedHandler implements the oEmbed endpoint for /v/{id} page URLs
+func OEmbedHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		query := r.URL.Query()
+		if format := query.Get("format"); format != "" && format != "json" {
+			// The oEmbed spec requires 501 for unsupported formats
+			http.Error(w, "Only json format is supported", http.StatusNotImplemented)
+			return
+		}
+
+		pageURL, err := url.Parse(query.Get("url"))
+		if err != nil || !strings.HasPrefix(pageURL.Path, "/v/") {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid url parameter", nil)
+			return
+		}
+		id := path.Base(pageURL.Path)
+
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), id)
+		if err != nil || metadata.Paths.Original == "" || !metadata.IsViewable() {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
+		}
+
+		width, height := fitDimensions(metadata.Width, metadata.Height,
+			atoiOrZero(query.Get("maxwidth")), atoiOrZero(query.Get("maxheight")))
+
+		base := baseURL(cfg, r)
+		response := OEmbedResponse{
+			Version:      "1.0",
+			Type:         "photo",
+			Title:        imageTitle(metadata),
+			ProviderName: "ImageFlow",
+			ProviderURL:  base,
+			URL:          absoluteURL(cfg, r, getPublicURL(r.Context(), metadata.Paths.Original, cfg)),
+			Width:        width,
+			Height:       height,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// imageTitle returns a display title for an image
+func imageTitle(metadata *utils.ImageMetadata) string {
+	if metadata.OriginalName != "" {
+		return metadata.OriginalName
+	}
+	return metadata.ID
+}
+
+// fitDimensions scales width and height down to fit within the given maximums, keeping aspect ratio
+func fitDimensions(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return width, height
+	}
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
+
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// PaletteResponse represents the colors extracted from an image
+type PaletteResponse struct {
+	ID string `json:"id"`
+	*utils.Palette
+}
+
+// PaletteHandler returns the colors of an image at /api/images/{id}/palette, so pages can theme
+// their UI around it. The response is JSON, or CSS custom properties with format=css or an
+// Accept header asking for text/css:
+//
+//	:root { --image-color-1: #1a2b3c; ...; --image-dominant: #1a2b3c; --image-text: #ffffff; }
+func PaletteHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		metadata, ok := viewableImage(w, r)
+		if !ok {
+			return
+		}
+
+		palette, err := utils.ImagePalette(r.Context(), metadata)
+		if err != nil {
+			logger.Error("Failed to extract palette",
+				zap.String("image_id", metadata.ID),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to extract palette", err.Error())
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Header().Add("Vary", "Accept")
+		format := r.URL.Query().Get("format")
+		if format == "css" || (format == "" && strings.Contains(r.Header.Get("Accept"), "text/css")) {
+			w.Header().Set("Content-Type", "text/css; charset=utf-8")
+			w.Write([]byte(paletteCSS(palette)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PaletteResponse{ID: metadata.ID, Palette: palette})
+	}
+}
+
+// paletteCSS renders a palette as custom properties of the document root
+func paletteCSS(palette *utils.Palette) string {
+	var b strings.Builder
+	b.WriteString(":root {\n")
+	for i, color := range palette.Colors {
+		fmt.Fprintf(&b, "  --image-color-%d: %s;\n", i+1, color.Hex)
+		fmt.Fprintf(&b, "  --image-color-%d-rgb: %d, %d, %d;\n", i+1, color.RGB[0], color.RGB[1], color.RGB[2])
+	}
+	fmt.Fprintf(&b, "  --image-dominant: %s;\n", palette.Dominant)
+	fmt.Fprintf(&b, "  --image-text: %s;\n", palette.Text)
+	b.WriteString("}\n")
+	return b.String()
+}
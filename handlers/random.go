@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,47 +31,28 @@ type RandomQueryParams struct {
 	ExcludeTags []string // Tags to exclude (comma-separated)
 	Orientation string   // portrait, landscape, or both
 	Format      string   // preferred format hint
+	MinLikes    int64    // Minimum number of likes
+	PreferTags  []string // Tags preferred by geo rules, schedules and the routing script
+	Collection  string   // Collection the image is picked from
+	Seed        string   // Picks the same image from the same pool on every request
 }
 
 // parseRandomQueryParams extracts and validates query parameters
-func parseRandomQueryParams(r *http.Request) *RandomQueryParams {
-	params := &RandomQueryParams{}
-	
-	// Parse tags - support both single tag and multiple tags
-	if tagStr := r.URL.Query().Get("tag"); tagStr != "" {
-		params.Tags = strings.Split(tagStr, ",")
-		// Trim spaces from each tag
-		for i, tag := range params.Tags {
-			params.Tags[i] = strings.TrimSpace(tag)
-		}
-	}
-	if tagsStr := r.URL.Query().Get("tags"); tagsStr != "" {
-		tags := strings.Split(tagsStr, ",")
-		for _, tag := range tags {
-			if trimmed := strings.TrimSpace(tag); trimmed != "" {
-				params.Tags = append(params.Tags, trimmed)
-			}
-		}
+func parseRandomQueryParams(r *http.Request) (*RandomQueryParams, *errors.ErrorResponse) {
+	query := r.URL.Query()
+	var v paramValidator
+	params := &RandomQueryParams{
+		// Support both a single tag and multiple tags
+		Tags:        append(v.Tags("tag", query.Get("tag")), v.Tags("tags", query.Get("tags"))...),
+		ExcludeTags: v.Tags("exclude", query.Get("exclude")),
+		Collection:  strings.TrimSpace(query.Get("collection")),
+		Seed:        query.Get("seed"),
+		// Auto-detected from the device when empty
+		Orientation: v.Enum("orientation", query.Get("orientation"), "", "portrait", "landscape"),
+		Format:      v.Enum("format", query.Get("format"), "", FormatOriginal, FormatWebP, FormatAVIF, "json"),
+		MinLikes:    v.Int64("min_likes", query.Get("min_likes"), 0, 0),
 	}
-	
-	// Parse exclude tags
-	if excludeStr := r.URL.Query().Get("exclude"); excludeStr != "" {
-		params.ExcludeTags = strings.Split(excludeStr, ",")
-		for i, tag := range params.ExcludeTags {
-			params.ExcludeTags[i] = strings.TrimSpace(tag)
-		}
-	}
-	
-	// Parse orientation
-	params.Orientation = strings.ToLower(r.URL.Query().Get("orientation"))
-	if params.Orientation != "portrait" && params.Orientation != "landscape" {
-		params.Orientation = "" // Will be auto-detected
-	}
-	
-	// Parse format preference
-	params.Format = strings.ToLower(r.URL.Query().Get("format"))
-	
-	return params
+	return params, v.Err()
 }
 
 // matchesTags checks if an image matches the tag criteria
@@ -99,6 +85,132 @@ func matchesTags(imageTags []string, requiredTags []string, excludeTags []string
 	return true
 }
 
+// hasAnyTag checks if an image has at least one of the given tags
+func hasAnyTag(imageTags []string, tags []string) bool {
+	for _, tag := range tags {
+		if slices.Contains(imageTags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRoutingRules applies the geo rules, language rules and tag schedules to the query of a
+// random image request, lets the routing script rewrite it and returns the orientation to
+// serve. The client's location, its matched language and the rules applied are reported in
+// response headers.
+func applyRoutingRules(w http.ResponseWriter, r *http.Request, params *RandomQueryParams, deviceType, orientation string) string {
+	req := &utils.RoutingRequest{
+		Tags:        params.Tags,
+		ExcludeTags: params.ExcludeTags,
+		Orientation: orientation,
+		Format:      params.Format,
+		MinLikes:    params.MinLikes,
+		Collection:  params.Collection,
+		Device:      deviceType,
+	}
+	if location, ok := utils.LookupGeo(clientIP(r)); ok {
+		req.Country, req.Region = location.Country, location.Region
+		w.Header().Set("X-ImageFlow-Country", location.Country)
+		if location.Region != "" {
+			w.Header().Set("X-ImageFlow-Region", location.Region)
+		}
+		if rule := utils.ApplyGeoRules(location, req); rule != "" {
+			w.Header().Set("X-ImageFlow-Geo-Rule", rule)
+		}
+	}
+
+	// The lang parameter replaces the languages the client accepts
+	languages := utils.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if lang := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("lang"))); lang != "" {
+		languages = []string{lang}
+	}
+	if len(languages) > 0 {
+		req.Language = languages[0]
+	}
+	if utils.LanguageRulesEnabled() {
+		w.Header().Add("Vary", "Accept-Language")
+		if language, rule := utils.ApplyLanguageRules(languages, req); rule != "" {
+			w.Header().Set("X-ImageFlow-Language", language)
+			w.Header().Set("X-ImageFlow-Language-Rule", rule)
+		}
+	}
+	utils.ApplySchedules(r.Context(), req, time.Now())
+	utils.ApplyRoutingScript(r, req)
+	params.Tags, params.ExcludeTags, params.PreferTags = req.Tags, req.ExcludeTags, req.PreferTags
+	params.Format, params.MinLikes, params.Collection = req.Format, req.MinLikes, req.Collection
+	return req.Orientation
+}
+
+// randomSessionCookie keeps the no-repeat session of clients requesting session=cookie
+const randomSessionCookie = "imageflow_random_session"
+
+// randomSession returns the no-repeat session of a random image request: the session
+// parameter or, for session=cookie, the session kept in a cookie, issued on first use. Without
+// the parameter or Redis there is no session.
+func randomSession(w http.ResponseWriter, r *http.Request, cfg *config.Config) (string, error) {
+	session := r.URL.Query().Get("session")
+	if session == "" || !utils.IsRedisMetadataStore() {
+		return "", nil
+	}
+	if session != "cookie" {
+		if !utils.ValidRandomSession(session) {
+			return "", fmt.Errorf("session must be 1-128 letters, digits, dots, colons, dashes or underscores")
+		}
+		return session, nil
+	}
+
+	if cookie, err := r.Cookie(randomSessionCookie); err == nil && utils.ValidRandomSession(cookie.Value) {
+		session = cookie.Value
+	} else if session, err = utils.NewRandomSession(); err != nil {
+		return "", err
+	}
+	// SameSite=None so the cookie is sent when the image is embedded on other sites
+	http.SetCookie(w, &http.Cookie{
+		Name:     randomSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   cfg.RandomSessionTTL * 60,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	return session, nil
+}
+
+// randomSessionSeen returns the images of a no-repeat session already served among the
+// candidate IDs. Once all of them were served the session starts over, so none count as seen.
+func randomSessionSeen(ctx context.Context, session string, ids []string) map[string]bool {
+	if session == "" {
+		return nil
+	}
+	seen, err := utils.RandomSessionSeen(ctx, session)
+	if err != nil {
+		logger.Error("Failed to get random session", zap.Error(err))
+		return nil
+	}
+	for _, id := range ids {
+		if !seen[id] {
+			return seen
+		}
+	}
+	if err := utils.ResetRandomSession(ctx, session); err != nil {
+		logger.Error("Failed to reset random session", zap.Error(err))
+	}
+	return nil
+}
+
+// markRandomSessionSeen records the image served in a no-repeat session
+func markRandomSessionSeen(ctx context.Context, cfg *config.Config, session, id string) {
+	if session == "" {
+		return
+	}
+	ttl := time.Duration(cfg.RandomSessionTTL) * time.Minute
+	if err := utils.MarkRandomSessionSeen(ctx, session, id, ttl); err != nil {
+		logger.Error("Failed to update random session", zap.Error(err))
+	}
+}
+
 // Image format constants
 const (
 	FormatAVIF     = "avif"
@@ -106,50 +218,96 @@ const (
 	FormatOriginal = "original"
 )
 
-// detectBestFormat determines optimal image format based on Accept headers
-func detectBestFormat(r *http.Request) string {
+// detectBestFormat determines optimal image format based on Accept headers. AVIF is only
+// chosen when enabled, and when the image's metadata is known only formats generated for it.
+func detectBestFormat(r *http.Request, cfg *config.Config, metadata *utils.ImageMetadata) string {
 	accept := r.Header.Get("Accept")
-	if strings.Contains(accept, "image/avif") {
+	if cfg.AvifSupport && strings.Contains(accept, "image/avif") && (metadata == nil || metadata.HasVariant(FormatAVIF)) {
 		return FormatAVIF
 	}
-	if strings.Contains(accept, "image/webp") {
+	if strings.Contains(accept, "image/webp") && (metadata == nil || metadata.HasVariant(FormatWebP)) {
+		return FormatWebP
+	}
+	if servesWatermark(metadata) {
 		return FormatWebP
 	}
 	return FormatOriginal
 }
 
+// servesWatermark reports whether an image is served as its watermarked WebP variant in place
+// of its original, which is stored without the watermark
+func servesWatermark(metadata *utils.ImageMetadata) bool {
+	return metadata != nil && metadata.Watermarked && metadata.HasVariant(FormatWebP)
+}
+
+// preferredFormat returns the format requested with the format query parameter, or the best
+// format for the client. AVIF is not served when disabled, nor the originals of watermarked
+// images. Animations are always served as their original.
+func preferredFormat(r *http.Request, cfg *config.Config, metadata *utils.ImageMetadata, requested string) string {
+	if metadata != nil && metadata.IsAnimated() {
+		return FormatOriginal
+	}
+	switch requested {
+	case FormatOriginal:
+		if !servesWatermark(metadata) {
+			return requested
+		}
+	case FormatWebP:
+		return requested
+	case FormatAVIF:
+		if cfg.AvifSupport {
+			return requested
+		}
+	}
+	return detectBestFormat(r, cfg, metadata)
+}
+
+// keepsTransparency reports whether an image is served as its original to preserve its
+// transparency. Opaque PNGs get converted formats like any other image, a format requested
+// explicitly is always served, and watermarked images keep their watermark.
+func keepsTransparency(metadata *utils.ImageMetadata, requested string) bool {
+	return metadata != nil && metadata.HasAlpha && requested != FormatWebP && requested != FormatAVIF && !servesWatermark(metadata)
+}
+
 // determineOrientation selects orientation based on device type and request parameters
 func determineOrientation(r *http.Request, deviceType string) string {
 	orientation := r.URL.Query().Get("orientation")
 	if orientation == "" {
-		if deviceType == utils.DeviceMobile {
-			return "portrait"
-		} else {
-			return "landscape"
-		}
+		return utils.DeviceOrientation(deviceType)
 	}
 	return orientation
 }
 
+// deviceResize returns the resize of a random image: the one requested with w and h or, with
+// device sizing enabled, the one fitting the client's screen. The client is asked for the hints
+// that size images, and the device type is reported in the X-ImageFlow-Device header.
+func deviceResize(w http.ResponseWriter, r *http.Request, cfg *config.Config, deviceType string, resize utils.ResizeOptions) utils.ResizeOptions {
+	w.Header().Set("X-ImageFlow-Device", deviceType)
+	if !resize.IsZero() || !cfg.DeviceSizing {
+		return resize
+	}
+	w.Header().Add("Accept-CH", utils.DeviceHints)
+	w.Header().Add("Vary", utils.DeviceHints)
+	return utils.DeviceResizeOptions(r, deviceType, cfg.MaxResizeDimension)
+}
+
+// fitsResize reports whether an image is known to be no wider than a width-only resize, so it
+// is served as stored rather than as a resized copy of the same size
+func fitsResize(metadata *utils.ImageMetadata, resize utils.ResizeOptions) bool {
+	return metadata != nil && metadata.Width > 0 && resize.Height == 0 && metadata.Width <= resize.Width
+}
+
 // getContentType returns the appropriate Content-Type based on format and filename
 func getContentType(format string, filename string) string {
 	if format == FormatAVIF {
-		return "image/avif"
+		return utils.ImageMimeTypes[".avif"]
 	}
 	if format == FormatWebP {
-		return "image/webp"
+		return utils.ImageMimeTypes[".webp"]
 	}
 
 	// Determine content type based on file extension
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".png":
-		return "image/png"
-	case ".gif":
-		return "image/gif"
-	default:
-		return "image/jpeg"
-	}
+	return utils.ImageMimeType(filename)
 }
 
 // setImageResponseHeaders sets standard HTTP headers for image responses
@@ -158,48 +316,153 @@ func setImageResponseHeaders(w http.ResponseWriter, contentType string) {
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	w.Header().Set("Vary", "Accept, User-Agent")
+	w.Header().Add("Vary", "Accept, User-Agent")
 }
 
-// getFormattedImagePath constructs the path to an image with the given format
-func getFormattedImagePath(format string, orientation string, filename string) string {
-	switch format {
-	case FormatAVIF:
-		return fmt.Sprintf("%s/avif/%s.avif", orientation, filename)
-	case FormatWebP:
-		return fmt.Sprintf("%s/webp/%s.webp", orientation, filename)
-	default:
-		// Keep original format and path
-		// Determine extension by checking if filename already has one
-		extension := filepath.Ext(filename)
-		if extension == "" {
-			extension = ".jpg" // Default to jpg if no extension
+// setSelectedImageHeaders tells clients which image a random request selected: its ID, its tags
+// (percent-encoded, comma-separated) and a link to its JSON details. Without metadata only the
+// ID is known.
+func setSelectedImageHeaders(w http.ResponseWriter, id string, metadata *utils.ImageMetadata) {
+	w.Header().Set("X-Image-Id", id)
+	if metadata != nil {
+		tags := make([]string, len(metadata.Tags))
+		for i, tag := range metadata.Tags {
+			tags[i] = url.PathEscape(tag)
 		}
-		return fmt.Sprintf("original/%s/%s%s", orientation, filename, extension)
+		w.Header().Set("X-Image-Tags", strings.Join(tags, ","))
 	}
+	w.Header().Set("Link", fmt.Sprintf(`</api/images/%s>; rel="describedby"; type="application/json"`, url.PathEscape(id)))
+}
+
+// wantsImageDetails reports whether a random request asked for the selected image's details
+// instead of the image, with format=json or an Accept header naming JSON
+func wantsImageDetails(r *http.Request, params *RandomQueryParams) bool {
+	return params.Format == "json" || (params.Format == "" && strings.Contains(r.Header.Get("Accept"), "application/json"))
+}
+
+// writeImageDetails describes the selected image as the list API does, with its URLs,
+// dimensions and blurhash, so frontends can show a placeholder before loading it
+func writeImageDetails(w http.ResponseWriter, r *http.Request, cfg *config.Config, metadata *utils.ImageMetadata) {
+	if metadata == nil {
+		errors.HandleError(w, errors.ErrNotFound, "Image metadata not found", nil)
+		return
+	}
+	params := queryParams{orientation: "all", format: "original"}
+	imageInfo, _ := imageInfoFromFields(r.Context(), metadata.ID, utils.MetadataFieldValues(metadata), params, cfg)
+	setImageResponseHeaders(w, "application/json")
+	json.NewEncoder(w).Encode(imageInfo)
+}
+
+// writeImage sends an image with the random image headers and its exact Content-Length, when
+// known. The format sent, e.g. webp or jpeg, is reported in X-Image-Format. HEAD requests only
+// get the headers.
+func writeImage(w http.ResponseWriter, r *http.Request, contentType string, size int64, body io.Reader) {
+	setImageResponseHeaders(w, contentType)
+	w.Header().Set("X-Image-Format", strings.TrimPrefix(contentType, "image/"))
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead || body == nil {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		logger.Error("Failed to send image", zap.Error(err))
+	}
+}
+
+// imageSize returns the size recorded in metadata for one of an image's stored files, or 0 when
+// the key is not a file recorded in the metadata
+func imageSize(metadata *utils.ImageMetadata, key string) int64 {
+	if metadata == nil {
+		return 0
+	}
+	switch key {
+	case metadata.Paths.Original:
+		return metadata.Sizes["original"]
+	case metadata.Paths.WebP:
+		return metadata.Sizes["webp"]
+	case metadata.Paths.AVIF:
+		return metadata.Sizes["avif"]
+	}
+	return 0
+}
+
+// variantKeyCandidates returns the storage keys a converted variant may live under,
+// starting with the path recorded in metadata when available
+func variantKeyCandidates(cfg *config.Config, metadata *utils.ImageMetadata, format, orientation, id string) []string {
+	var keys []string
+	if metadata != nil {
+		switch format {
+		case FormatAVIF:
+			if metadata.Paths.AVIF != "" {
+				keys = append(keys, metadata.Paths.AVIF)
+			}
+		case FormatWebP:
+			if metadata.Paths.WebP != "" {
+				keys = append(keys, metadata.Paths.WebP)
+			}
+		}
+	}
+	return append(keys, utils.VariantKeyCandidates(cfg.KeyLayout, orientation, format, id)...)
 }
 
 // RandomImageHandler serves random images from S3 storage
 func RandomImageHandler(s3Client *s3.Client, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
 		if !cfg.S3Enabled {
 			errors.HandleError(w, errors.ErrInternal, "S3 storage is not enabled", nil)
 			return
 		}
 
 		// Parse query parameters
-		params := parseRandomQueryParams(r)
+		params, errResp := parseRandomQueryParams(r)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		resize, err := utils.ParseResizeOptions(r.URL.Query(), cfg)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid resize parameters", err.Error())
+			return
+		}
+		if !resizeAllowed(cfg, r, "", resize) {
+			errors.HandleError(w, errors.ErrForbidden, "Resize size not allowed", resize.String())
+			return
+		}
+		session, err := randomSession(w, r, cfg)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid session", err.Error())
+			return
+		}
+		theme, err := requestTheme(w, r)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid theme", err.Error())
+			return
+		}
 		
-		// Determine device type and orientation
+		// Determine device type, orientation and size
 		deviceType := utils.DetectDeviceType(r)
 		orientation := determineOrientation(r, deviceType)
+		resize = deviceResize(w, r, cfg, deviceType, resize)
 		
 		// Override orientation if specified in params
 		if params.Orientation != "" {
 			orientation = params.Orientation
 		}
+		orientation = applyRoutingRules(w, r, params, deviceType, orientation)
+		if params.Collection != "" {
+			if _, err := utils.GetCollection(r.Context(), params.Collection); err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "Collection not found", params.Collection)
+				return
+			}
+		}
 
-		logger.Info("Processing random image request",
+		serveLog.Info("Processing random image request",
+			zap.String("collection", params.Collection),
 			zap.Strings("tags", params.Tags),
 			zap.Strings("exclude_tags", params.ExcludeTags),
 			zap.String("orientation", orientation),
@@ -207,37 +470,42 @@ func RandomImageHandler(s3Client *s3.Client, cfg *config.Config) http.HandlerFun
 
 		// Find matching images
 		var matchingImages []string
-		var err error
 
-		// Use Redis for efficient filtering if available and tags are specified
-		if (len(params.Tags) > 0 || len(params.ExcludeTags) > 0) && utils.IsRedisMetadataStore() {
+		// Use Redis for efficient filtering if available; only public images are candidates
+		if utils.IsRedisMetadataStore() {
 			var candidateIDs []string
 			
-			if len(params.Tags) > 0 {
+			if params.Collection != "" {
+				// Only images of the collection are candidates
+				candidateIDs, err = utils.CollectionImageIDs(r.Context(), params.Collection)
+				if err != nil {
+					logger.Error("Failed to get collection images from Redis", zap.Error(err))
+				}
+			} else if len(params.Tags) > 0 {
 				// Get images that have ALL required tags
-				candidateIDs, err = utils.GetImagesByMultipleTags(context.Background(), params.Tags)
+				candidateIDs, err = utils.GetImagesByMultipleTags(r.Context(), params.Tags)
 				if err != nil {
 					logger.Error("Failed to get images by tags from Redis", zap.Error(err))
 					// Fall back to traditional method
 				}
 			} else {
-				// Get all image IDs if only exclude filters are specified
-				candidateIDs, err = utils.GetAllImageIDs(context.Background())
+				// Without required tags every public image is a candidate
+				candidateIDs, err = utils.GetImageIDsByVisibility(r.Context(), utils.VisibilityPublic)
 				if err != nil {
-					logger.Error("Failed to get all image IDs from Redis", zap.Error(err))
+					logger.Error("Failed to get public image IDs from Redis", zap.Error(err))
 				}
 			}
 			
 			if err == nil && len(candidateIDs) > 0 {
 				// Filter by metadata
 				for _, id := range candidateIDs {
-					metadata, metaErr := utils.MetadataManager.GetMetadata(context.Background(), id)
-					if metaErr != nil {
+					metadata, metaErr := utils.MetadataManager.GetMetadata(r.Context(), id)
+					if metaErr != nil || !metadata.IsListable() {
 						continue
 					}
 					
-					// Check tag matching
-					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) {
+					// Check tag matching and popularity
+					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) || metadata.Likes < params.MinLikes {
 						continue
 					}
 					
@@ -247,17 +515,17 @@ func RandomImageHandler(s3Client *s3.Client, cfg *config.Config) http.HandlerFun
 					}
 				}
 				
-				logger.Info("Found matching images from Redis",
+				serveLog.Info("Found matching images from Redis",
 					zap.Int("count", len(matchingImages)))
 			}
 		}
 
-		// Fall back to S3 listing if Redis didn't work or no results
-		if len(matchingImages) == 0 {
-			// Build prefix for orientation directory
-			prefix := fmt.Sprintf("original/%s/", orientation)
+		// Fall back to S3 listing if Redis didn't work or no results; collections only exist in Redis
+		if len(matchingImages) == 0 && params.Collection == "" {
+			// Build prefix for orientation directory, in the tenant's namespace
+			prefix := utils.TenantStorageKey(r.Context(), fmt.Sprintf("original/%s/", orientation))
 			
-			output, err := s3Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+			output, err := s3Client.ListObjectsV2(r.Context(), &s3.ListObjectsV2Input{
 				Bucket: aws.String(cfg.S3Bucket),
 				Prefix: aws.String(prefix),
 			})
@@ -279,22 +547,24 @@ func RandomImageHandler(s3Client *s3.Client, cfg *config.Config) http.HandlerFun
 				id := strings.TrimSuffix(fileBaseName, filepath.Ext(fileBaseName))
 				
 				// Get metadata for tag filtering
-				if len(params.Tags) > 0 || len(params.ExcludeTags) > 0 {
-					metadata, metaErr := utils.MetadataManager.GetMetadata(context.Background(), id)
-					if metaErr != nil {
+				if len(params.Tags) > 0 || len(params.ExcludeTags) > 0 || params.MinLikes > 0 {
+					metadata, metaErr := utils.MetadataManager.GetMetadata(r.Context(), id)
+					if metaErr != nil || !metadata.IsListable() {
 						// Skip if metadata not found
 						continue
 					}
 					
-					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) {
+					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) || metadata.Likes < params.MinLikes {
 						continue
 					}
+				} else if !utils.IsImageListable(r.Context(), id) {
+					continue
 				}
 				
 				matchingImages = append(matchingImages, *obj.Key)
 			}
 			
-			logger.Info("Found matching images from S3 listing",
+			serveLog.Info("Found matching images from S3 listing",
 				zap.Int("count", len(matchingImages)))
 		}
 
@@ -307,99 +577,232 @@ func RandomImageHandler(s3Client *s3.Client, cfg *config.Config) http.HandlerFun
 			return
 		}
 
-		// Select random image
-		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-		randomIndex := rng.Intn(len(matchingImages))
+		// Skip images the session was served, until it was served all of them
+		if session != "" {
+			ids := make([]string, len(matchingImages))
+			for i, key := range matchingImages {
+				ids[i] = strings.TrimSuffix(filepath.Base(key), filepath.Ext(key))
+			}
+			if seen := randomSessionSeen(r.Context(), session, ids); len(seen) > 0 {
+				var unseen []string
+				for i, key := range matchingImages {
+					if !seen[ids[i]] {
+						unseen = append(unseen, key)
+					}
+				}
+				matchingImages = unseen
+			}
+		}
+
+		// Prefer images carrying a preferred tag, when there are any
+		if len(params.PreferTags) > 0 {
+			var preferred []string
+			for _, key := range matchingImages {
+				fileBaseName := filepath.Base(key)
+				id := strings.TrimSuffix(fileBaseName, filepath.Ext(fileBaseName))
+				metadata, metaErr := utils.MetadataManager.GetMetadata(r.Context(), id)
+				if metaErr == nil && hasAnyTag(metadata.Tags, params.PreferTags) {
+					preferred = append(preferred, key)
+				}
+			}
+			if len(preferred) > 0 {
+				matchingImages = preferred
+			}
+		}
+
+		// Select random image, or the image of the seed
+		var randomIndex int
+		if params.Seed != "" {
+			ids := make([]string, len(matchingImages))
+			for i, key := range matchingImages {
+				ids[i] = strings.TrimSuffix(filepath.Base(key), filepath.Ext(key))
+			}
+			randomIndex = utils.SeededIndex(params.Seed, ids)
+		} else {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			randomIndex = rng.Intn(len(matchingImages))
+		}
 		originalKey := matchingImages[randomIndex]
-		logger.Debug("Selected random image", zap.String("key", originalKey))
+		serveLog.Debug("Selected random image", zap.String("key", originalKey))
 
 		// Extract filename for format path generation
 		fileBaseName := filepath.Base(originalKey)
 		filename := strings.TrimSuffix(fileBaseName, filepath.Ext(fileBaseName))
+		markRandomSessionSeen(r.Context(), cfg, session, filename)
 
-		// Determine best format
-		bestFormat := detectBestFormat(r)
-		if params.Format != "" {
-			// Override with user preference if valid
-			switch params.Format {
-			case "avif", "webp", "original":
-				bestFormat = params.Format
-			}
+		// Metadata gives the recorded variant paths and sizes, so HEAD requests need no S3 call
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), filename)
+		if err != nil {
+			metadata = nil
 		}
 
-		// Handle PNG transparency preservation
-		isPNG := strings.HasSuffix(strings.ToLower(originalKey), ".png")
-		if isPNG && bestFormat == FormatOriginal {
-			serveS3Image(s3Client, cfg, w, r, originalKey, "image/png")
+		// Serve the paired variant suiting the requested theme
+		if metadata != nil && theme != "" {
+			if variant := utils.ThemeVariant(r.Context(), metadata, theme); variant != nil && variant.IsViewable() {
+				metadata, originalKey, filename = variant, variant.Paths.Original, variant.ID
+			}
+		}
+		setSelectedImageHeaders(w, filename, metadata)
+		if wantsImageDetails(r, params) {
+			writeImageDetails(w, r, cfg, metadata)
 			return
 		}
+		recordServe(r, filename)
+		if fitsResize(metadata, resize) {
+			resize = utils.ResizeOptions{}
+		}
 
-		// Try preferred format first
-		imageKey := getFormattedImagePath(bestFormat, orientation, filename)
-		contentType := getContentType(bestFormat, imageKey)
-		
-		// Try to serve the preferred format
-		data, err := s3Client.GetObject(r.Context(), &s3.GetObjectInput{
-			Bucket: aws.String(cfg.S3Bucket),
-			Key:    aws.String(imageKey),
-		})
-		
-		if err != nil {
-			// Fall back to original if preferred format not available
-			logger.Info("Preferred format not available, falling back to original",
-				zap.String("preferred", bestFormat))
-			serveS3Image(s3Client, cfg, w, r, originalKey, getContentType(FormatOriginal, originalKey))
+		// Determine best format, unless the user asked for one
+		bestFormat := preferredFormat(r, cfg, metadata, params.Format)
+		if keepsTransparency(metadata, params.Format) {
+			bestFormat = FormatOriginal
+		}
+		// Variants recently found missing are not looked for again while they are regenerated
+		if bestFormat != FormatOriginal && utils.VariantMissing(r.Context(), filename, bestFormat) {
+			bestFormat = FormatOriginal
+		}
+
+		if bestFormat == FormatOriginal {
+			serveS3Image(s3Client, cfg, w, r, originalKey, getContentType(FormatOriginal, originalKey), resize, metadata)
 			return
 		}
-		defer data.Body.Close()
 
-		// Serve the image
-		setImageResponseHeaders(w, contentType)
-		if _, err := io.Copy(w, data.Body); err != nil {
-			logger.Error("Failed to send image", zap.Error(err))
+		// Try preferred format first, under every key layout it may be stored in
+		contentType := getContentType(bestFormat, originalKey)
+		for _, imageKey := range variantKeyCandidates(cfg, metadata, bestFormat, orientation, filename) {
+			if !resize.IsZero() {
+				if exists, err := utils.Storage.Exists(r.Context(), imageKey); err == nil && exists {
+					serveResizedRandomImage(cfg, w, r, imageKey, contentType, resize)
+					return
+				}
+				continue
+			}
+
+			if err := sendS3Object(s3Client, cfg, w, r, imageKey, contentType, imageSize(metadata, imageKey)); err != nil {
+				continue
+			}
+			return
 		}
+
+		// Fall back to original if preferred format not available
+		serveLog.Info("Preferred format not available, falling back to original",
+			zap.String("preferred", bestFormat))
+		utils.MarkVariantMissing(r.Context(), cfg, filename, bestFormat)
+		serveS3Image(s3Client, cfg, w, r, originalKey, getContentType(FormatOriginal, originalKey), resize, metadata)
 	}
 }
 
-// serveS3Image is a helper function to serve images from S3
-func serveS3Image(s3Client *s3.Client, cfg *config.Config, w http.ResponseWriter, r *http.Request, key string, contentType string) {
+// serveResizedRandomImage resizes a stored image and sends it with the random image headers
+func serveResizedRandomImage(cfg *config.Config, w http.ResponseWriter, r *http.Request, key string, contentType string, resize utils.ResizeOptions) {
+	data, err := utils.GetResizedImage(r.Context(), cfg, key, resize)
+	if err != nil {
+		logger.Error("Failed to resize image", zap.String("key", key), zap.Error(err))
+		errors.HandleError(w, errors.ErrInternal, "Failed to resize image", err.Error())
+		return
+	}
+
+	writeImage(w, r, contentType, int64(len(data)), bytes.NewReader(data))
+}
+		
+// serveS3Image is a helper function to serve images from S3, resized when requested
+func serveS3Image(s3Client *s3.Client, cfg *config.Config, w http.ResponseWriter, r *http.Request, key string, contentType string, resize utils.ResizeOptions, metadata *utils.ImageMetadata) {
+	if !resize.IsZero() {
+		serveResizedRandomImage(cfg, w, r, key, contentType, resize)
+		return
+	}
+
+	if err := sendS3Object(s3Client, cfg, w, r, key, contentType, imageSize(metadata, key)); err != nil {
+		logger.Error("Failed to get image from S3", zap.String("key", key), zap.Error(err))
+		errors.HandleError(w, errors.ErrNotFound, "Image not found", err)
+	}
+}
+
+// sendS3Object sends an S3 object, failing only when nothing was written yet. HEAD requests
+// use the size recorded in metadata when given and only ask S3 for the object's size otherwise.
+func sendS3Object(s3Client *s3.Client, cfg *config.Config, w http.ResponseWriter, r *http.Request, key string, contentType string, size int64) error {
+	if r.Method == http.MethodHead {
+		if size == 0 {
+			head, err := s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{
+				Bucket: aws.String(cfg.S3Bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return err
+			}
+			size = aws.ToInt64(head.ContentLength)
+		}
+		writeImage(w, r, contentType, size, nil)
+		return nil
+	}
+
 	data, err := s3Client.GetObject(r.Context(), &s3.GetObjectInput{
 		Bucket: aws.String(cfg.S3Bucket),
 		Key:    aws.String(key),
 	})
-	
 	if err != nil {
-		logger.Error("Failed to get image from S3", zap.String("key", key), zap.Error(err))
-		errors.HandleError(w, errors.ErrNotFound, "Image not found", err)
-		return
+		return err
 	}
 	defer data.Body.Close()
 	
-	setImageResponseHeaders(w, contentType)
-	if _, err := io.Copy(w, data.Body); err != nil {
-		logger.Error("Failed to send image", zap.Error(err))
-	}
+	writeImage(w, r, contentType, aws.ToInt64(data.ContentLength), data.Body)
+	return nil
 }
 
-// LocalRandomImageHandler serves random images from local storage
+// LocalRandomImageHandler serves random images from local storage. Storage backends without a
+// dedicated handler, such as Azure Blob Storage, are served through the storage provider; they
+// need the Redis metadata store, as there is no directory to scan.
 func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
 		// Parse query parameters
-		params := parseRandomQueryParams(r)
+		params, errResp := parseRandomQueryParams(r)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		resize, err := utils.ParseResizeOptions(r.URL.Query(), cfg)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid resize parameters", err.Error())
+			return
+		}
+		if !resizeAllowed(cfg, r, "", resize) {
+			errors.HandleError(w, errors.ErrForbidden, "Resize size not allowed", resize.String())
+			return
+		}
+		session, err := randomSession(w, r, cfg)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid session", err.Error())
+			return
+		}
+		theme, err := requestTheme(w, r)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid theme", err.Error())
+			return
+		}
 		
-		// Determine device type and orientation
+		// Determine device type, orientation and size
 		deviceType := utils.DetectDeviceType(r)
-		orientation := "landscape" // Default for desktop
-		if deviceType == utils.DeviceMobile {
-			orientation = "portrait" // Mobile gets portrait
-		}
+		orientation := utils.DeviceOrientation(deviceType)
+		resize = deviceResize(w, r, cfg, deviceType, resize)
 		
 		// Override orientation if specified in params
 		if params.Orientation != "" {
 			orientation = params.Orientation
 		}
+		orientation = applyRoutingRules(w, r, params, deviceType, orientation)
+		if params.Collection != "" {
+			if _, err := utils.GetCollection(r.Context(), params.Collection); err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "Collection not found", params.Collection)
+				return
+			}
+		}
 
-		logger.Info("Processing random image request",
+		serveLog.Info("Processing random image request",
+			zap.String("collection", params.Collection),
 			zap.Strings("tags", params.Tags),
 			zap.Strings("exclude_tags", params.ExcludeTags),
 			zap.String("orientation", orientation),
@@ -407,36 +810,41 @@ func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 
 		// Find matching images
 		var matchingImages []*utils.ImageMetadata
-		var err error
 
-		// Use Redis for efficient filtering if available and filters are specified
-		if (len(params.Tags) > 0 || len(params.ExcludeTags) > 0) && utils.IsRedisMetadataStore() {
+		// Use Redis for efficient filtering if available; only public images are candidates
+		if utils.IsRedisMetadataStore() {
 			var candidateIDs []string
 			
-			if len(params.Tags) > 0 {
+			if params.Collection != "" {
+				// Only images of the collection are candidates
+				candidateIDs, err = utils.CollectionImageIDs(r.Context(), params.Collection)
+				if err != nil {
+					logger.Error("Failed to get collection images from Redis", zap.Error(err))
+				}
+			} else if len(params.Tags) > 0 {
 				// Get images that have ALL required tags
-				candidateIDs, err = utils.GetImagesByMultipleTags(context.Background(), params.Tags)
+				candidateIDs, err = utils.GetImagesByMultipleTags(r.Context(), params.Tags)
 				if err != nil {
 					logger.Error("Failed to get images by tags from Redis", zap.Error(err))
 				}
 			} else {
-				// Get all image IDs if only exclude filters are specified
-				candidateIDs, err = utils.GetAllImageIDs(context.Background())
+				// Without required tags every public image is a candidate
+				candidateIDs, err = utils.GetImageIDsByVisibility(r.Context(), utils.VisibilityPublic)
 				if err != nil {
-					logger.Error("Failed to get all image IDs from Redis", zap.Error(err))
+					logger.Error("Failed to get public image IDs from Redis", zap.Error(err))
 				}
 			}
 			
 			if err == nil && len(candidateIDs) > 0 {
 				// Filter by metadata
 				for _, id := range candidateIDs {
-					metadata, metaErr := utils.MetadataManager.GetMetadata(context.Background(), id)
-					if metaErr != nil {
+					metadata, metaErr := utils.MetadataManager.GetMetadata(r.Context(), id)
+					if metaErr != nil || !metadata.IsListable() {
 						continue
 					}
 					
-					// Check tag matching
-					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) {
+					// Check tag matching and popularity
+					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) || metadata.Likes < params.MinLikes {
 						continue
 					}
 					
@@ -446,18 +854,28 @@ func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 					}
 				}
 				
-				logger.Info("Found matching images from Redis",
+				serveLog.Info("Found matching images from Redis",
 					zap.Int("count", len(matchingImages)))
 			}
 		}
 
-		// Fall back to directory scanning if Redis didn't work or no results
-		if len(matchingImages) == 0 {
+		// Fall back to directory scanning if Redis didn't work or no results; collections only exist in Redis
+		if len(matchingImages) == 0 && cfg.StorageType == config.StorageTypeLocal && params.Collection == "" {
 			// Read files from the orientation directory
-			originalDir := filepath.Join(cfg.ImageBasePath, "original", orientation)
-			logger.Debug("Looking for images in directory", zap.String("dir", originalDir))
+			originalDir := filepath.Join(cfg.ImageBasePath, filepath.FromSlash(utils.TenantStorageKey(r.Context(), "original/"+orientation)))
+			serveLog.Debug("Looking for images in directory", zap.String("dir", originalDir))
 
-			files, err := os.ReadDir(originalDir)
+			// Walk recursively so sharded key layouts are found as well
+			var files []string
+			err := filepath.WalkDir(originalDir, func(path string, d os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && utils.IsImageFile(d.Name()) {
+					files = append(files, path)
+				}
+				return nil
+			})
 			if err != nil {
 				logger.Error("Failed to read directory",
 					zap.String("dir", originalDir),
@@ -468,42 +886,43 @@ func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 
 			// Process each file
 			for _, file := range files {
-				if file.IsDir() || !utils.IsImageFile(file.Name()) {
-					continue
-				}
+				fileName := filepath.Base(file)
+				id := strings.TrimSuffix(fileName, filepath.Ext(fileName))
 				
-				id := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-				
-				// Apply tag filtering if specified
-				if len(params.Tags) > 0 || len(params.ExcludeTags) > 0 {
-					metadata, metaErr := utils.MetadataManager.GetMetadata(context.Background(), id)
-					if metaErr != nil {
+				// Apply tag filtering if specified; preferred tags need the image's tags as well
+				if len(params.Tags) > 0 || len(params.ExcludeTags) > 0 || params.MinLikes > 0 || len(params.PreferTags) > 0 {
+					metadata, metaErr := utils.MetadataManager.GetMetadata(r.Context(), id)
+					if metaErr != nil || !metadata.IsListable() {
 						// Skip if metadata not available
 						continue
 					}
 					
-					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) {
+					if !matchesTags(metadata.Tags, params.Tags, params.ExcludeTags) || metadata.Likes < params.MinLikes {
 						continue
 					}
 					
 					matchingImages = append(matchingImages, metadata)
 				} else {
+					if !utils.IsImageListable(r.Context(), id) {
+						continue
+					}
+
+					relPath, err := filepath.Rel(cfg.ImageBasePath, file)
+					if err != nil {
+						continue
+					}
+
 					// No tag filtering, create basic metadata
-					matchingImages = append(matchingImages, &utils.ImageMetadata{
+					metadata := &utils.ImageMetadata{
 						ID:          id,
 						Orientation: orientation,
-						Paths: struct {
-							Original string `json:"original"`
-							WebP     string `json:"webp"`
-							AVIF     string `json:"avif"`
-						}{
-							Original: filepath.Join("original", orientation, file.Name()),
-						},
-					})
+					}
+					metadata.Paths.Original = relPath
+					matchingImages = append(matchingImages, metadata)
 				}
 			}
 			
-			logger.Info("Found matching images from directory scan",
+			serveLog.Info("Found matching images from directory scan",
 				zap.Int("count", len(matchingImages)))
 		}
 
@@ -516,71 +935,131 @@ func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		// Select random image
-		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-		randomIndex := rng.Intn(len(matchingImages))
+		// Skip images the session was served, until it was served all of them
+		if session != "" {
+			ids := make([]string, len(matchingImages))
+			for i, metadata := range matchingImages {
+				ids[i] = metadata.ID
+			}
+			if seen := randomSessionSeen(r.Context(), session, ids); len(seen) > 0 {
+				var unseen []*utils.ImageMetadata
+				for _, metadata := range matchingImages {
+					if !seen[metadata.ID] {
+						unseen = append(unseen, metadata)
+					}
+				}
+				matchingImages = unseen
+			}
+		}
+
+		// Prefer images carrying a preferred tag, when there are any
+		if len(params.PreferTags) > 0 {
+			var preferred []*utils.ImageMetadata
+			for _, metadata := range matchingImages {
+				if hasAnyTag(metadata.Tags, params.PreferTags) {
+					preferred = append(preferred, metadata)
+				}
+			}
+			if len(preferred) > 0 {
+				matchingImages = preferred
+			}
+		}
+
+		// Select random image, or the image of the seed
+		var randomIndex int
+		if params.Seed != "" {
+			ids := make([]string, len(matchingImages))
+			for i, metadata := range matchingImages {
+				ids[i] = metadata.ID
+			}
+			randomIndex = utils.SeededIndex(params.Seed, ids)
+		} else {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			randomIndex = rng.Intn(len(matchingImages))
+		}
 		selectedImage := matchingImages[randomIndex]
-		logger.Debug("Selected random image",
+		markRandomSessionSeen(r.Context(), cfg, session, selectedImage.ID)
+
+		// Serve the paired variant suiting the requested theme
+		if theme != "" {
+			if variant := utils.ThemeVariant(r.Context(), selectedImage, theme); variant != nil && variant.IsViewable() {
+				selectedImage = variant
+			}
+		}
+		serveLog.Debug("Selected random image",
 			zap.String("id", selectedImage.ID),
 			zap.String("orientation", selectedImage.Orientation))
+		setSelectedImageHeaders(w, selectedImage.ID, selectedImage)
+		if wantsImageDetails(r, params) {
+			writeImageDetails(w, r, cfg, selectedImage)
+			return
+		}
+		recordServe(r, selectedImage.ID)
 
-		// Determine best format
-		bestFormat := detectBestFormat(r)
-		if params.Format != "" {
-			// Override with user preference if valid
-			switch params.Format {
-			case "avif", "webp", "original":
-				bestFormat = params.Format
-			}
+		// Determine best format, unless the user asked for one. Images found by directory scan
+		// have no recorded variants, so every format is tried for them.
+		negotiated := selectedImage
+		if selectedImage.Sizes == nil {
+			negotiated = nil
+		}
+		bestFormat := preferredFormat(r, cfg, negotiated, params.Format)
+		if keepsTransparency(selectedImage, params.Format) {
+			bestFormat = FormatOriginal
+		}
+		// Variants recently found missing are not looked for again while they are regenerated
+		if bestFormat != FormatOriginal && utils.VariantMissing(r.Context(), selectedImage.ID, bestFormat) {
+			bestFormat = FormatOriginal
 		}
-		logger.Debug("Best format for client", zap.String("format", bestFormat))
+		serveLog.Debug("Best format for client", zap.String("format", bestFormat))
 
-		// Get image path and content type
-		var imagePath string
+		// Get image key and content type
+		var imageKey string
 		var contentType string
 
-		// Check if the image is PNG for transparency preservation
-		isPNG := false
-		if selectedImage.Format == "png" {
-			isPNG = true
-		} else {
-			isPNG = strings.HasSuffix(strings.ToLower(selectedImage.Paths.Original), ".png")
+		// Use the appropriate format based on browser support and preference
+		switch bestFormat {
+		case FormatAVIF, FormatWebP:
+			contentType = getContentType(bestFormat, selectedImage.Paths.Original)
+			candidates := variantKeyCandidates(cfg, selectedImage, bestFormat, selectedImage.Orientation, selectedImage.ID)
+			imageKey = candidates[0]
+			for _, key := range candidates {
+				if storedImageExists(r.Context(), cfg, key) {
+					imageKey = key
+					break
+				}
+			}
+		default:
+			imageKey = selectedImage.Paths.Original
+			contentType = getContentType(FormatOriginal, imageKey)
 		}
 
-		// Handle PNG transparency preservation
-		if isPNG && bestFormat == FormatOriginal {
-			imagePath = filepath.Join(cfg.ImageBasePath, selectedImage.Paths.Original)
-			contentType = "image/png"
-			logger.Debug("Using original PNG for transparency", zap.String("path", imagePath))
-		} else {
-			// Use the appropriate format based on browser support and preference
-			switch bestFormat {
-			case FormatAVIF:
-				imagePath = filepath.Join(cfg.ImageBasePath, selectedImage.Orientation, "avif", selectedImage.ID+".avif")
-				contentType = "image/avif"
-			case FormatWebP:
-				imagePath = filepath.Join(cfg.ImageBasePath, selectedImage.Orientation, "webp", selectedImage.ID+".webp")
-				contentType = "image/webp"
-			default:
-				imagePath = filepath.Join(cfg.ImageBasePath, selectedImage.Paths.Original)
-				contentType = getContentType(FormatOriginal, imagePath)
-			}
-			
-			logger.Debug("Using format and path",
-				zap.String("format", bestFormat),
-				zap.String("path", imagePath))
-
-			// Check if file exists, fall back to original if needed
-			if _, err := os.Stat(imagePath); os.IsNotExist(err) && bestFormat != FormatOriginal {
-				logger.Info("Format not available, falling back to original",
-					zap.String("format", bestFormat))
-				imagePath = filepath.Join(cfg.ImageBasePath, selectedImage.Paths.Original)
-				contentType = getContentType(FormatOriginal, imagePath)
-			}
+		serveLog.Debug("Using format and key",
+			zap.String("format", bestFormat),
+			zap.String("key", imageKey))
+
+		// Check if the variant exists, fall back to original if needed
+		if bestFormat != FormatOriginal && !storedImageExists(r.Context(), cfg, imageKey) {
+			serveLog.Info("Format not available, falling back to original",
+				zap.String("format", bestFormat))
+			utils.MarkVariantMissing(r.Context(), cfg, selectedImage.ID, bestFormat)
+			imageKey = selectedImage.Paths.Original
+			contentType = getContentType(FormatOriginal, imageKey)
 		}
 
-		// Read and serve the image
-		imageData, err := os.ReadFile(imagePath)
+		// Resize on the fly when requested
+		if !resize.IsZero() && !fitsResize(selectedImage, resize) {
+			serveResizedRandomImage(cfg, w, r, imageKey, contentType, resize)
+			return
+		}
+
+		if cfg.StorageType != config.StorageTypeLocal {
+			serveStoredImage(w, r, imageKey, contentType, imageSize(selectedImage, imageKey))
+			return
+		}
+
+		// Open and serve the image; HEAD requests only get its headers
+		imagePath := filepath.Join(cfg.ImageBasePath, imageKey)
+		file, err := os.Open(imagePath)
 		if err != nil {
 			logger.Error("Failed to read image",
 				zap.String("path", imagePath),
@@ -588,11 +1067,42 @@ func LocalRandomImageHandler(cfg *config.Config) http.HandlerFunc {
 			errors.HandleError(w, errors.ErrNotFound, "Image not found", err)
 			return
 		}
+		defer file.Close()
 
-		// Set response headers and send image
-		setImageResponseHeaders(w, contentType)
-		if _, err := w.Write(imageData); err != nil {
-			logger.Error("Failed to send image", zap.Error(err))
+		info, err := file.Stat()
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to read image", err)
+			return
 		}
+		writeImage(w, r, contentType, info.Size(), file)
+	}
+}
+
+// storedImageExists reports whether a key exists in the configured storage
+func storedImageExists(ctx context.Context, cfg *config.Config, key string) bool {
+	if cfg.StorageType == config.StorageTypeLocal {
+		_, err := os.Stat(filepath.Join(cfg.ImageBasePath, key))
+		return !os.IsNotExist(err)
+	}
+	exists, err := utils.Storage.Exists(ctx, key)
+	return err == nil && exists
+}
+
+// serveStoredImage sends an image read through the storage provider. HEAD requests are
+// answered from the size recorded in metadata when known.
+func serveStoredImage(w http.ResponseWriter, r *http.Request, key string, contentType string, size int64) {
+	if r.Method == http.MethodHead && size > 0 {
+		writeImage(w, r, contentType, size, nil)
+		return
+	}
+
+	data, err := utils.Storage.Get(r.Context(), key)
+	if err != nil {
+		logger.Error("Failed to read image",
+			zap.String("key", key),
+			zap.Error(err))
+		errors.HandleError(w, errors.ErrNotFound, "Image not found", err)
+		return
 	}
+	writeImage(w, r, contentType, int64(len(data)), bytes.NewReader(data))
 }
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// RateLimiter is a fixed-window, per-client request limiter
+type RateLimiter struct {
+	limit   int
+	window  time.Duration
+	mu      sync.Mutex
+	clients map[string]*rateWindow
+
+	name     string                         // Counter name in Redis; empty counts in memory only
+	clientOf func(r *http.Request) []string // Clients a request counts against; the client IP when nil
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// NewRateLimiter creates a limiter allowing limit requests per window and client.
+// A limit of zero or less disables limiting.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	rl := &RateLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*rateWindow),
+	}
+	if limit > 0 {
+		go rl.cleanup()
+	}
+	return rl
+}
+
+// NewAPIRateLimiter creates a limiter for an endpoint allowing limit requests per window and
+// client, where clients are API keys, client IPs or both, as RATE_LIMIT_BY configures. The
+// counters are kept in Redis when it is the metadata store, so the limit holds across
+// instances. A limit of zero or less disables limiting.
+func NewAPIRateLimiter(cfg *config.Config, name string, limit int, window time.Duration) *RateLimiter {
+	rl := NewRateLimiter(limit, window)
+	rl.name = name
+	rl.clientOf = func(r *http.Request) []string {
+		return rateLimitClients(cfg, r)
+	}
+	return rl
+}
+
+// rateLimitClients returns the clients a request counts against. Requests without a valid API
+// key are always told apart by client IP.
+func rateLimitClients(cfg *config.Config, r *http.Request) []string {
+	ip := "ip:" + clientIP(r)
+	key := requestAPIKey(cfg, r)
+	if key == nil || cfg.RateLimitBy == "ip" {
+		return []string{ip}
+	}
+	if cfg.RateLimitBy == "both" {
+		return []string{"key:" + key.ID, ip}
+	}
+	return []string{"key:" + key.ID}
+}
+
+// Allow reports whether a request from the given client may proceed, and if not,
+// how long the client has to wait
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if rl.limit <= 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	w, ok := rl.clients[client]
+	if !ok || now.Sub(w.start) >= rl.window {
+		rl.clients[client] = &rateWindow{start: now, count: 1}
+		return true, 0
+	}
+	if w.count >= rl.limit {
+		return false, rl.window - now.Sub(w.start)
+	}
+	w.count++
+	return true, 0
+}
+
+// cleanup periodically drops expired client windows
+func (rl *RateLimiter) cleanup() {
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.mu.Lock()
+		now := time.Now()
+		for client, w := range rl.clients {
+			if now.Sub(w.start) >= rl.window {
+				delete(rl.clients, client)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// allowShared is Allow with the counters in Redis for named limiters. Should Redis fail, the
+// request is counted in memory.
+func (rl *RateLimiter) allowShared(r *http.Request, client string) (bool, time.Duration) {
+	if rl.limit <= 0 || rl.name == "" || !utils.IsRedisMetadataStore() {
+		return rl.Allow(client)
+	}
+	count, remaining, err := utils.IncrRateCounter(r.Context(), rl.name, client, rl.window)
+	if err != nil {
+		logger.Warn("Failed to count request in Redis, limiting in memory",
+			zap.String("limiter", rl.name),
+			zap.Error(err))
+		return rl.Allow(client)
+	}
+	if count > int64(rl.limit) {
+		return false, remaining
+	}
+	return true, 0
+}
+
+// Middleware wraps a handler with the rate limiter
+func (rl *RateLimiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients := []string{clientIP(r)}
+		if rl.clientOf != nil {
+			clients = rl.clientOf(r)
+		}
+		for _, client := range clients {
+			if ok, retryAfter := rl.allowShared(r, client); !ok {
+				logger.Debug("Rate limit exceeded",
+					zap.String("client", client),
+					zap.String("path", r.URL.Path))
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the client address, honouring X-Forwarded-For set by reverse proxies
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
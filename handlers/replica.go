@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// readOnlyPOSTPaths are the endpoints that use POST without changing anything
+var readOnlyPOSTPaths = map[string]bool{
+	"/api/validate-api-key": true,
+	"/api/search/by-image":  true,
+}
+
+// ReadReplicaMiddleware rejects every request that could change images, tags, tenants or
+// settings when the instance runs as a read replica, so replicas behind a load balancer only
+// serve reads from the shared storage and Redis. It is a no-op on regular instances.
+func ReadReplicaMiddleware(cfg *config.Config, next http.Handler) http.Handler {
+	if !cfg.ReadReplica {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		case http.MethodPost:
+			if !readOnlyPOSTPaths[r.URL.Path] {
+				errors.HandleError(w, errors.ErrForbidden, "This instance is a read replica", r.URL.Path)
+				return
+			}
+		default:
+			errors.HandleError(w, errors.ErrForbidden, "This instance is a read replica", r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// maxReplicatedObjectSize bounds the size of a replicated object
+const maxReplicatedObjectSize = 256 << 20
+
+// validReplicatedKey reports whether a replicated object key is a clean relative path inside
+// the storage prefix of the request's tenant
+func validReplicatedKey(r *http.Request, key string) bool {
+	if key == "" || path.Clean("/" + key)[1:] != key {
+		return false
+	}
+	tenantID := ""
+	if tenant := utils.TenantFromContext(r.Context()); tenant != nil {
+		tenantID = tenant.ID
+	}
+	return utils.TenantIDFromStorageKey(key) == tenantID
+}
+
+// ReplicationObjectHandler receives the objects of a replicating primary at
+// /api/replication/objects?key=. HEAD reports whether the object exists, PUT stores it.
+func ReplicationObjectHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if !validReplicatedKey(r, key) {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid object key", key)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodHead:
+			exists, err := utils.Storage.Exists(r.Context(), key)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPut:
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxReplicatedObjectSize))
+			if err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Failed to read object", nil)
+				return
+			}
+			if err := utils.Storage.Store(r.Context(), key, data); err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to store object", err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+// ReplicationImageHandler receives image changes of a replicating primary at
+// /api/replication/images/{id}. PUT saves the image's metadata (its objects are sent first),
+// DELETE removes the image. Received changes are not replicated further.
+func ReplicationImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		ctx := utils.WithoutReplication(r.Context())
+
+		switch r.Method {
+		case http.MethodPut:
+			var metadata utils.ImageMetadata
+			if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil || metadata.ID != id {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid metadata", nil)
+				return
+			}
+			for _, key := range metadata.ObjectKeys() {
+				if !validReplicatedKey(r, key) {
+					errors.HandleError(w, errors.ErrInvalidParam, "Invalid object key", key)
+					return
+				}
+			}
+
+			// Keep the tenant's usage in step when an existing image is updated
+			if existing, err := utils.MetadataManager.GetMetadata(ctx, id); err == nil {
+				utils.AddTenantUsage(ctx, -utils.StoredBytes(existing))
+			}
+			if err := utils.MetadataManager.SaveMetadata(ctx, &metadata); err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to save metadata", err.Error())
+				return
+			}
+			utils.AddTenantUsage(ctx, utils.StoredBytes(&metadata))
+
+			// Objects arrive before the metadata, publicly readable
+			if !metadata.IsViewable() {
+				if err := utils.ApplyObjectAccess(ctx, &metadata); err != nil {
+					logger.Warn("Failed to update access of replicated objects",
+						zap.String("image_id", id),
+						zap.Error(err))
+				}
+			}
+
+		case http.MethodDelete:
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
+			if err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "Image not found", id)
+				return
+			}
+			for _, key := range metadata.ObjectKeys() {
+				if err := utils.Storage.Delete(ctx, key); err != nil {
+					logger.Warn("Failed to delete replicated object",
+						zap.String("key", key),
+						zap.Error(err))
+				}
+			}
+			if err := utils.MetadataManager.DeleteMetadata(ctx, id); err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to delete metadata", err.Error())
+				return
+			}
+			if err := utils.InvalidateImagePages(ctx, metadata); err != nil {
+				logger.Warn("Failed to clear page cache", zap.Error(err))
+			}
+
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		logger.Debug("Applied replicated change",
+			zap.String("method", r.Method),
+			zap.String("image_id", id))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	}
+}
+
+// ReplicationStatusHandler reports the replication queues (GET) at /api/replication/status
+// and requeues permanently failed jobs (POST) at /api/replication/retry
+func ReplicationStatusHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if utils.Replication == nil {
+			errors.HandleError(w, errors.ErrNotFound, "Replication is not enabled", nil)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/replication/status":
+			status, err := utils.Replication.Status(r.Context())
+			if err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to read replication status", err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/replication/retry":
+			requeued, err := utils.Replication.RequeueFailed(r.Context())
+			if err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to requeue jobs", err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"requeued": requeued,
+			})
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// tusVersion is the version of the tus resumable upload protocol implemented at /api/uploads
+const tusVersion = "1.0.0"
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated pairs of a key and a
+// base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// withUploadOptions returns a copy of a request whose form values are the options of a
+// resumable upload, so they are parsed like those of a regular upload
+func withUploadOptions(r *http.Request, metadata map[string]string) *http.Request {
+	form := url.Values{}
+	for key, value := range metadata {
+		form.Set(key, value)
+	}
+	r = r.Clone(r.Context())
+	r.Form = form
+	return r
+}
+
+// ResumableUploadHandler creates resumable uploads at POST /api/uploads following the tus
+// protocol (core and creation/termination extensions). Upload options such as tags,
+// expiryMinutes, visibility and profile are passed in the Upload-Metadata header.
+func ResumableUploadHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "方法不允许", nil)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			errors.HandleError(w, errors.ErrInvalidParam, "无效的 Upload-Length", r.Header.Get("Upload-Length"))
+			return
+		}
+		if maxSize := int64(cfg.ResumableUploadMaxSize) << 20; length > maxSize {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := utils.CheckTenantQuota(r.Context(), 1, length); err != nil {
+			errors.HandleError(w, errors.ErrForbidden, "超出租户配额", err.Error())
+			return
+		}
+
+		metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "无效的 Upload-Metadata", err.Error())
+			return
+		}
+		// Reject invalid options now rather than once the data was sent
+		if _, errResp := parseUploadOptions(withUploadOptions(r, metadata), cfg); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		session, err := utils.CreateUploadSession(r.Context(), length, metadata)
+		if err != nil {
+			logger.Error("Failed to create upload session", zap.Error(err))
+			errors.HandleError(w, errors.ErrImageUpload, "创建上传会话失败", nil)
+			return
+		}
+
+		logger.Debug("Created upload session",
+			zap.String("id", session.ID),
+			zap.Int64("length", length))
+		w.Header().Set("Location", apiPath(r, "/uploads/"+session.ID))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// UploadSessionHandler serves a resumable upload at /api/uploads/{id}: HEAD returns its
+// offset, PATCH appends data, DELETE cancels it and GET returns its state including the upload
+// result once all data was received and processed.
+func UploadSessionHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodGet && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		id := r.PathValue("id")
+		switch r.Method {
+		case http.MethodHead:
+			session, err := utils.GetUploadSession(r.Context(), id)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodGet:
+			session, err := utils.GetUploadSession(r.Context(), id)
+			if err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "上传会话不存在", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(session)
+
+		case http.MethodPatch:
+			patchUploadSession(w, r, cfg, id)
+
+		case http.MethodDelete:
+			if err := utils.DeleteUploadSession(r.Context(), id); err != nil {
+				if err == utils.ErrUploadSessionNotFound {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				logger.Error("Failed to delete upload session",
+					zap.String("id", id),
+					zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "方法不允许", nil)
+		}
+	}
+}
+
+// patchUploadSession appends the request body to a resumable upload and processes the image
+// once all data was received
+func patchUploadSession(w http.ResponseWriter, r *http.Request, cfg *config.Config, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		errors.HandleError(w, errors.ErrInvalidParam, "无效的 Upload-Offset", r.Header.Get("Upload-Offset"))
+		return
+	}
+
+	session, err := utils.AppendUploadSession(r.Context(), id, offset, r.Body)
+	switch {
+	case err == utils.ErrUploadSessionNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err == utils.ErrUploadOffsetMismatch:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil && session == nil:
+		logger.Error("Failed to append to upload session",
+			zap.String("id", id),
+			zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case err != nil:
+		// The connection dropped; the client resumes from the saved offset
+		logger.Debug("Upload interrupted",
+			zap.String("id", id),
+			zap.Int64("offset", session.Offset),
+			zap.Error(err))
+	}
+
+	if session.Complete() {
+		result := versionUploadResults(r, []UploadResult{processUploadSession(r, cfg, session)})[0]
+		if err := utils.CompleteUploadSession(r.Context(), session, result); err != nil {
+			logger.Warn("Failed to complete upload session",
+				zap.String("id", id),
+				zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// processUploadSession processes the data of a complete resumable upload like a regular upload
+func processUploadSession(r *http.Request, cfg *config.Config, session *utils.UploadSession) UploadResult {
+	name := session.Metadata["filename"]
+	if name == "" {
+		name = session.ID
+	}
+
+	file, err := utils.OpenUploadSessionData(r.Context(), session.ID)
+	if err != nil {
+		return UploadResult{
+			Filename: name,
+			Status:   "error",
+			Message:  fmt.Sprintf("Error reading file: %v", err),
+		}
+	}
+	defer file.Close()
+	// Options were validated when the upload was created, but profiles may have changed since
+	ctx, errResp := parseUploadOptions(withUploadOptions(r, session.Metadata), cfg)
+	if errResp != nil {
+		return UploadResult{
+			Filename: name,
+			Status:   "error",
+			Message:  errResp.Message,
+		}
+	}
+
+	result := processReserved(ctx, name, func() UploadResult {
+		return processSpooled(ctx, name, file, session.Offset)
+	})
+	logger.Info("Processed resumable upload",
+		zap.String("id", session.ID),
+		zap.String("status", result.Status),
+		zap.String("image_id", result.ID))
+	return result
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// Bounds of rotation intervals: shorter ones defeat caching, longer ones are better served by
+// a fixed seed
+const (
+	minRotateInterval = time.Minute
+	maxRotateInterval = 30 * 24 * time.Hour
+)
+
+// parseRotateInterval parses an interval like 30m, 1h or 1d. Days are not understood by
+// time.ParseDuration, so they are handled here.
+func parseRotateInterval(value string) (time.Duration, error) {
+	var interval time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval: %s", value)
+		}
+		interval = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid interval: %s", value)
+		}
+	}
+	if interval < minRotateInterval || interval > maxRotateInterval {
+		return 0, fmt.Errorf("interval must be between %s and %s", minRotateInterval, maxRotateInterval)
+	}
+	return interval, nil
+}
+
+// RotateHandler serves a random image that stays the same for each time bucket of an interval
+// at /api/rotate/{interval}, e.g. /api/rotate/1h. Buckets are aligned to the Unix epoch, so a
+// 1d interval changes at midnight UTC. The image is picked by the random handler with a seed
+// derived from the bucket, and cacheable until the bucket ends, so CDNs fetch one image per
+// bucket. It takes the parameters of /api/random; a seed gives a separate rotation.
+func RotateHandler(random http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		interval, err := parseRotateInterval(r.PathValue("interval"))
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid rotation interval", err.Error())
+			return
+		}
+
+		now := time.Now()
+		bucket := now.Unix() / int64(interval/time.Second)
+		expires := time.Unix((bucket+1)*int64(interval/time.Second), 0)
+
+		query := r.URL.Query()
+		query.Set("seed", fmt.Sprintf("%s/%s/%d", query.Get("seed"), interval, bucket))
+		rotated := r.Clone(r.Context())
+		rotated.URL.RawQuery = query.Encode()
+
+		rw := &rotateResponseWriter{ResponseWriter: w, expires: expires, now: now}
+		random(rw, rotated)
+		// HEAD responses write no body, so their status is only written here
+		if !rw.wroteHeader {
+			rw.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// rotateResponseWriter makes successful responses cacheable until the end of their time bucket,
+// replacing the no-store headers of random images. Errors and responses setting cookies keep
+// their headers.
+type rotateResponseWriter struct {
+	http.ResponseWriter
+	expires     time.Time
+	now         time.Time
+	wroteHeader bool
+}
+
+func (w *rotateResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK && w.Header().Get("Set-Cookie") == "" {
+		maxAge := int(w.expires.Sub(w.now).Seconds())
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		w.Header().Set("Expires", w.expires.UTC().Format(http.TimeFormat))
+		w.Header().Del("Pragma")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *rotateResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
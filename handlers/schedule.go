@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// ScheduleResponse describes a tag schedule and whether it is active now
+type ScheduleResponse struct {
+	*utils.Schedule
+	Active bool `json:"active"`
+}
+
+// SchedulesHandler manages the tag schedules of /api/random in the request's namespace.
+//
+// GET    /api/schedules         lists schedules and whether they are active
+// POST   /api/schedules         creates a schedule
+// PUT    /api/schedules         replaces a schedule
+// DELETE /api/schedules?name=   deletes a schedule
+func SchedulesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listSchedules(w, r)
+		case http.MethodPost, http.MethodPut:
+			saveSchedule(w, r)
+		case http.MethodDelete:
+			deleteSchedule(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := utils.ListSchedules(r.Context())
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list schedules", err.Error())
+		return
+	}
+
+	now := time.Now()
+	response := make([]ScheduleResponse, 0, len(schedules))
+	for _, schedule := range schedules {
+		response = append(response, ScheduleResponse{Schedule: schedule, Active: schedule.Active(now)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"schedules": response,
+	})
+}
+
+func saveSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule utils.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+
+	create := r.Method == http.MethodPost
+	if err := utils.SaveSchedule(r.Context(), &schedule, create); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to save schedule", err.Error())
+		return
+	}
+
+	logger.Info("Schedule saved",
+		zap.String("schedule", schedule.Name),
+		zap.Strings("tags", schedule.Tags))
+
+	w.Header().Set("Content-Type", "application/json")
+	if create {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(ScheduleResponse{Schedule: &schedule, Active: schedule.Active(time.Now())})
+}
+
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Schedule name is required", nil)
+		return
+	}
+
+	if err := utils.DeleteSchedule(r.Context(), name); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Schedule not found", nil)
+		return
+	}
+
+	logger.Info("Schedule deleted",
+		zap.String("schedule", name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "Schedule deleted"})
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSearchLimit    = 10
+	maxSearchLimit        = 50
+	defaultSearchDistance = 10 // Out of 64 bits; re-encoded or resized copies are usually below 5
+)
+
+// SearchMatch is a library image matching a search
+type SearchMatch struct {
+	ID          string            `json:"id"`
+	Distance    *int              `json:"distance,omitempty"`   // Hamming distance between perceptual hashes (search by image)
+	Similarity  float64           `json:"similarity,omitempty"` // 1 - distance/64 for image search, cosine similarity for semantic search
+	Orientation string            `json:"orientation"`
+	Format      string            `json:"format"`
+	Visibility  string            `json:"visibility"`
+	Tags        []string          `json:"tags"`
+	URLs        map[string]string `json:"urls"`
+	Snippet     string            `json:"snippet,omitempty"` // Matching extracted text (text search)
+}
+
+// newSearchMatch builds a search result from image metadata
+func newSearchMatch(ctx context.Context, metadata *utils.ImageMetadata, similarity float64, cfg *config.Config) SearchMatch {
+	public := newPublicImage(ctx, metadata, cfg)
+	return SearchMatch{
+		ID:          metadata.ID,
+		Similarity:  similarity,
+		Orientation: metadata.Orientation,
+		Format:      metadata.Format,
+		Visibility:  string(metadata.EffectiveVisibility()),
+		Tags:        public.Tags,
+		URLs:        public.URLs,
+	}
+}
+
+// SearchResponse represents the result of a search
+type SearchResponse struct {
+	Success bool          `json:"success"`
+	Hash    string        `json:"hash,omitempty"`  // Perceptual hash of the uploaded sample (search by image)
+	Query   string        `json:"query,omitempty"` // Text query (semantic search)
+	Matches []SearchMatch `json:"matches"`
+	Total   int           `json:"total,omitempty"` // Estimated number of matches (full-text search)
+}
+
+// SearchByImageHandler finds library images similar to an uploaded sample at /api/search/by-image.
+// The sample is sent as the multipart field "image"; it is hashed and discarded, never stored.
+//
+// Query parameters:
+//   - limit: maximum number of matches (default 10, max 50)
+//   - threshold: maximum Hamming distance out of 64 (default 10)
+func SearchByImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		limit, threshold, errResp := parseSimilarityParams(r)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid multipart form", err.Error())
+			return
+		}
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Image file is required", nil)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Failed to read image", nil)
+			return
+		}
+
+		hash, err := utils.PerceptualHash(data)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Unsupported or corrupt image", err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		similar, err := utils.FindSimilarImages(ctx, hash, threshold, limit)
+		if err != nil {
+			logger.Error("Reverse image search failed", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Search failed", nil)
+			return
+		}
+
+		matches := similarMatches(ctx, similar, "", cfg)
+
+		logger.Debug("Reverse image search completed",
+			zap.String("hash", utils.FormatPerceptualHash(hash)),
+			zap.Int("matches", len(matches)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Success: true,
+			Hash:    utils.FormatPerceptualHash(hash),
+			Matches: matches,
+		})
+	}
+}
+
+// SimilarImagesHandler finds library images visually similar to a stored image at
+// /api/images/{id}/similar, such as re-uploads differing only in compression or size. The
+// image itself is not among the matches.
+//
+// Query parameters:
+//   - limit: maximum number of matches (default 10, max 50)
+//   - threshold: maximum Hamming distance out of 64 (default 10)
+func SimilarImagesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInvalidParam, "Similar image search requires Redis", nil)
+			return
+		}
+		limit, threshold, errResp := parseSimilarityParams(r)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		ctx := r.Context()
+		id := r.PathValue("id")
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
+		if err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
+		}
+		if metadata.PHash == "" {
+			errors.HandleError(w, errors.ErrInvalidParam, "Image has no perceptual hash", id)
+			return
+		}
+		hash, err := utils.ParsePerceptualHash(metadata.PHash)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Invalid perceptual hash", id)
+			return
+		}
+
+		// One more match is asked for, as the image itself is always among them
+		similar, err := utils.FindSimilarImages(ctx, hash, threshold, limit+1)
+		if err != nil {
+			logger.Error("Similar image search failed",
+				zap.String("id", id),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Search failed", nil)
+			return
+		}
+		matches := similarMatches(ctx, similar, id, cfg)
+		if len(matches) > limit {
+			matches = matches[:limit]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Success: true,
+			Hash:    metadata.PHash,
+			Matches: matches,
+		})
+	}
+}
+
+// parseSimilarityParams reads the limit and threshold of a search by perceptual hash
+func parseSimilarityParams(r *http.Request) (int, int, *errors.ErrorResponse) {
+	var v paramValidator
+	limit := v.Int("limit", r.URL.Query().Get("limit"), defaultSearchLimit, 1, maxSearchLimit)
+	threshold := v.Int("threshold", r.URL.Query().Get("threshold"), defaultSearchDistance, 0, 64)
+	return limit, threshold, v.Err()
+}
+
+// similarMatches builds the search results of images found by perceptual hash, leaving out
+// the image searched from, if any
+func similarMatches(ctx context.Context, similar []utils.SimilarImage, exclude string, cfg *config.Config) []SearchMatch {
+	matches := make([]SearchMatch, 0, len(similar))
+	for _, s := range similar {
+		if s.ID == exclude {
+			continue
+		}
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, s.ID)
+		if err != nil {
+			continue
+		}
+		distance := s.Distance
+		match := newSearchMatch(ctx, metadata, 1-float64(distance)/64, cfg)
+		match.Distance = &distance
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// SemanticSearchHandler finds images matching a natural language description at
+// /api/search/semantic?q=snowy+mountains+at+night. It requires an embedding service.
+//
+// Query parameters:
+//   - q: text query
+//   - limit: maximum number of matches (default 10, max 50)
+//   - min_score: minimum cosine similarity (default 0)
+func SemanticSearchHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.SemanticSearchEnabled() {
+			errors.HandleError(w, errors.ErrForbidden, "Semantic search is not configured", nil)
+			return
+		}
+
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			errors.HandleError(w, errors.ErrInvalidParam, "Query is required", nil)
+			return
+		}
+		var v paramValidator
+		limit := v.Int("limit", r.URL.Query().Get("limit"), defaultSearchLimit, 1, maxSearchLimit)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		var minScore float64
+		if v := r.URL.Query().Get("min_score"); v != "" {
+			score, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid min_score", v)
+				return
+			}
+			minScore = score
+		}
+
+		ctx := r.Context()
+		vector, err := utils.Embedder.EmbedText(ctx, query)
+		if err != nil {
+			logger.Error("Failed to embed search query",
+				zap.String("query", query),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Embedding service unavailable", nil)
+			return
+		}
+
+		results, err := utils.SearchEmbeddings(ctx, vector, minScore, limit)
+		if err != nil {
+			logger.Error("Semantic search failed", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Search failed", nil)
+			return
+		}
+
+		matches := make([]SearchMatch, 0, len(results))
+		for _, result := range results {
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, result.ID)
+			if err != nil {
+				continue
+			}
+			matches = append(matches, newSearchMatch(r.Context(), metadata, result.Score, cfg))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Success: true,
+			Query:   query,
+			Matches: matches,
+		})
+	}
+}
+
+// TextSearchHandler finds images by the text OCR extracted from them at /api/search/text?q=.
+// Every word of the query must appear in the image text (case-insensitive).
+//
+// Query parameters:
+//   - q: text query
+//   - limit: maximum number of matches (default 10, max 50)
+func TextSearchHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			errors.HandleError(w, errors.ErrInvalidParam, "Query is required", nil)
+			return
+		}
+		var v paramValidator
+		limit := v.Int("limit", r.URL.Query().Get("limit"), defaultSearchLimit, 1, maxSearchLimit)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		ctx := r.Context()
+		results, err := utils.SearchImageText(ctx, query, limit)
+		if err != nil {
+			logger.Error("Text search failed", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Search failed", nil)
+			return
+		}
+
+		matches := make([]SearchMatch, 0, len(results))
+		for _, result := range results {
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, result.ID)
+			if err != nil {
+				continue
+			}
+			match := newSearchMatch(r.Context(), metadata, 0, cfg)
+			match.Snippet = result.Snippet
+			matches = append(matches, match)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Success: true,
+			Query:   query,
+			Matches: matches,
+		})
+	}
+}
+
+// FullTextSearchHandler searches the library in the external search engine at /api/search?q=.
+// The engine is kept in sync with the change feed; an empty query lists the filtered images.
+//
+// Query parameters:
+//   - q: text matched against original names, tags and OCR text
+//   - tag, tags: tags every match must have
+//   - orientation, visibility: filters
+//   - page, limit: pagination (default limit 10, max 50)
+func FullTextSearchHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if utils.SearchIndexing == nil {
+			errors.HandleError(w, errors.ErrForbidden, "Search engine is not configured", nil)
+			return
+		}
+
+		query := r.URL.Query()
+		var v paramValidator
+		search := utils.SearchQuery{
+			Text:        strings.TrimSpace(query.Get("q")),
+			Tags:        append(v.Tags("tag", query.Get("tag")), v.Tags("tags", query.Get("tags"))...),
+			Orientation: v.Enum("orientation", query.Get("orientation"), "", "landscape", "portrait"),
+			Visibility:  v.Enum("visibility", query.Get("visibility"), "", string(utils.VisibilityPublic), string(utils.VisibilityUnlisted), string(utils.VisibilityPrivate)),
+			Limit:       v.Int("limit", query.Get("limit"), defaultSearchLimit, 1, maxSearchLimit),
+		}
+		page := v.Int("page", query.Get("page"), 1, 1, math.MaxInt32/maxSearchLimit)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		search.Offset = (page - 1) * search.Limit
+
+		ctx := r.Context()
+		hits, err := utils.SearchIndexing.Search(ctx, search)
+		if err != nil {
+			logger.Error("Full-text search failed", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Search failed", nil)
+			return
+		}
+
+		// Images deleted since they were indexed are skipped
+		matches := make([]SearchMatch, 0, len(hits.IDs))
+		for _, id := range hits.IDs {
+			metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
+			if err != nil {
+				continue
+			}
+			matches = append(matches, newSearchMatch(ctx, metadata, 0, cfg))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SearchResponse{
+			Success: true,
+			Query:   search.Text,
+			Matches: matches,
+			Total:   hits.Total,
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// SelfTestResponse reports the self-test of the instance
+type SelfTestResponse struct {
+	Success bool                 `json:"success"`
+	Status  utils.SelfTestStatus `json:"status"`
+}
+
+// SelfTestHandler reports the self-test of this instance at /api/selftest.
+//
+// GET  /api/selftest  returns the recent runs, newest first
+// POST /api/selftest  runs the self-test now, then returns the runs
+func SelfTestHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if utils.SelfTest == nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "The self-test is disabled, set SELFTEST_INTERVAL", nil)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			utils.SelfTest.Run(r.Context())
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(SelfTestResponse{
+			Success: true,
+			Status:  utils.SelfTest.Status(),
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// serveLog rate limits the entries logged for every served image
+var serveLog = logger.Limited(logger.CategoryServe)
+
+// ImageHandler serves images under /images/. Keys are resolved across all historical key
+// layouts, so links created before a layout migration keep working. Local images are served
+// directly, images in S3 or other remote storage are redirected to their current public URL.
+// Private images need the API key or a URL signed by /api/sign, and are never redirected to a
+// public URL.
+func ImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/images/")), "/")
+		if key == "" || key == "." {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Tenant images live under tenants/<id>/, which also scopes their metadata lookups
+		if id := utils.TenantIDFromStorageKey(key); id != "" {
+			tenant, err := utils.GetTenant(r.Context(), id)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			r = r.WithContext(utils.WithTenant(r.Context(), tenant))
+		}
+
+		resolved, err := utils.ResolveImageKey(r.Context(), key)
+		if err != nil {
+			serveLog.Debug("Image not found",
+				zap.String("key", key),
+				zap.Error(err))
+			http.NotFound(w, r)
+			return
+		}
+
+		metadata, _ := utils.MetadataManager.GetMetadata(r.Context(), utils.ImageIDFromKey(resolved))
+
+		// The theme parameter swaps in the same file of the paired dark or light variant
+		theme, err := requestTheme(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if metadata != nil && theme != "" {
+			if variant := utils.ThemeVariant(r.Context(), metadata, theme); variant != nil {
+				if variantKey := variant.CorrespondingKey(metadata, resolved); variantKey != "" {
+					resolved, metadata = variantKey, variant
+				}
+			}
+		}
+
+		// Private images are only served to requests carrying the API key or a valid signature
+		private := metadata != nil && !metadata.IsViewable()
+		if private && !hasAPIKeyScope(cfg, r, utils.ScopeRead) {
+			query := r.URL.Query()
+			if _, ok := utils.VerifyImageSignature(cfg, key, query.Get("expires"), query.Get("signature")); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		if private {
+			// Resized variants are stored private as well
+			r = r.WithContext(utils.WithPrivateObjects(r.Context()))
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+
+		// Pre-serve hooks may refuse the request or add response headers
+		if err := utils.RunHooks(r.Context(), &utils.HookEvent{
+			Point:    utils.HookPreServe,
+			ImageID:  utils.ImageIDFromKey(resolved),
+			Key:      resolved,
+			Metadata: metadata,
+			Headers:  w.Header(),
+		}); err != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if metadata != nil {
+			recordServe(r, metadata.ID)
+		}
+
+		// SVG originals are documents; browsers opening one directly must not run scripts in it
+		if strings.EqualFold(filepath.Ext(resolved), ".svg") {
+			w.Header().Set("Content-Security-Policy", utils.SVGContentSecurityPolicy)
+		}
+
+		// Resize on the fly when w, h or fit are given; variants are cached in storage
+		opts, err := utils.ParseResizeOptions(r.URL.Query(), cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !opts.IsZero() {
+			if !resizeAllowed(cfg, r, key, opts) {
+				http.Error(w, "Resize size not allowed", http.StatusForbidden)
+				return
+			}
+			serveResized(w, r, cfg, resolved, opts)
+			return
+		}
+
+		if cfg.StorageType != config.StorageTypeLocal {
+			if private {
+				sendPrivateObject(w, r, resolved)
+				return
+			}
+			// Redirects are temporary, as keys resolved from the legacy layout and themed
+			// requests can resolve to another object later
+			http.Redirect(w, r, getPublicURL(r.Context(), filepath.ToSlash(resolved), cfg), http.StatusFound)
+			return
+		}
+
+		http.ServeFile(w, r, filepath.Join(cfg.ImageBasePath, resolved))
+	}
+}
+
+// recordServe counts a GET of an image in its access analytics without delaying the response
+func recordServe(r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		return
+	}
+	go utils.RecordServe(context.WithoutCancel(r.Context()), id)
+}
+
+// resizeAllowed reports whether a request may resize an image to opts. Every size creates
+// another cached object, so sizes outside RESIZE_SIZES are limited to clients with a read key
+// or, for a stored image, a URL signed for its key.
+func resizeAllowed(cfg *config.Config, r *http.Request, key string, opts utils.ResizeOptions) bool {
+	if utils.ResizeAllowed(cfg, opts) || hasAPIKeyScope(cfg, r, utils.ScopeRead) {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	query := r.URL.Query()
+	_, ok := utils.VerifyImageSignature(cfg, key, query.Get("expires"), query.Get("signature"))
+	return ok
+}
+
+// serveResized serves a resized variant of a stored image. Remote variants are redirected to
+// once cached, like the images themselves, unless private.
+func serveResized(w http.ResponseWriter, r *http.Request, cfg *config.Config, key string, opts utils.ResizeOptions) {
+	resizedKey := utils.ResizedImageKey(r.Context(), cfg, key, opts)
+	if cfg.StorageType != config.StorageTypeLocal {
+		if exists, err := utils.Storage.Exists(r.Context(), resizedKey); err != nil || !exists {
+			if _, err := utils.GetResizedImage(r.Context(), cfg, key, opts); err != nil {
+				logger.Error("Failed to resize image",
+					zap.String("key", key),
+					zap.Error(err))
+				http.Error(w, "Failed to resize image", http.StatusInternalServerError)
+				return
+			}
+		}
+		if utils.PrivateObjects(r.Context()) {
+			sendPrivateObject(w, r, resizedKey)
+			return
+		}
+		http.Redirect(w, r, getPublicURL(r.Context(), filepath.ToSlash(resizedKey), cfg), http.StatusFound)
+		return
+	}
+
+	data, err := utils.GetResizedImage(r.Context(), cfg, key, opts)
+	if err != nil {
+		logger.Error("Failed to resize image",
+			zap.String("key", key),
+			zap.Error(err))
+		http.Error(w, "Failed to resize image", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, resizedKey, time.Time{}, bytes.NewReader(data))
+}
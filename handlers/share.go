@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// ShareRequest represents the request body for creating a share link
+type ShareRequest struct {
+	ID        string `json:"id"`        // Image ID
+	Format    string `json:"format"`    // Format to serve: original (default), webp or avif
+	ExpiresIn string `json:"expiresIn"` // Optional link lifetime, e.g. "24h"; empty for a permanent link
+}
+
+// ShareLinkResponse describes a share link returned by the API
+type ShareLinkResponse struct {
+	*utils.ShareLink
+	URL string `json:"url"` // Relative short URL, e.g. /s/abc1234
+}
+
+// ShareHandler manages share links of an image.
+//
+// GET  /api/share?id={id}   lists the image's links with their click statistics
+// POST /api/share           creates a link
+// DELETE /api/share?code=   revokes a link
+func ShareHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listShareLinks(w, r)
+		case http.MethodPost:
+			createShareLink(w, r)
+		case http.MethodDelete:
+			deleteShareLink(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			logger.Warn("Invalid request method",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path))
+		}
+	}
+}
+
+func createShareLink(w http.ResponseWriter, r *http.Request) {
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+	if req.ID == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Image ID is required", nil)
+		return
+	}
+
+	switch req.Format {
+	case "":
+		req.Format = FormatOriginal
+	case FormatOriginal, FormatWebP, FormatAVIF:
+	default:
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid format", req.Format)
+		return
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid expiresIn duration", req.ExpiresIn)
+			return
+		}
+		ttl = d
+	}
+
+	metadata, err := utils.MetadataManager.GetMetadata(r.Context(), req.ID)
+	if err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+		return
+	}
+	if !metadata.IsViewable() {
+		errors.HandleError(w, errors.ErrForbidden, "Private images cannot be shared", nil)
+		return
+	}
+
+	link, err := utils.CreateShareLink(r.Context(), req.ID, req.Format, ttl)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to create share link", err.Error())
+		return
+	}
+
+	logger.Info("Share link created",
+		zap.String("image_id", req.ID),
+		zap.String("code", link.Code))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ShareLinkResponse{ShareLink: link, URL: "/s/" + link.Code})
+}
+
+func listShareLinks(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Image ID is required", nil)
+		return
+	}
+
+	links, err := utils.ListShareLinks(r.Context(), id)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list share links", err.Error())
+		return
+	}
+
+	response := make([]ShareLinkResponse, 0, len(links))
+	for _, link := range links {
+		response = append(response, ShareLinkResponse{ShareLink: link, URL: "/s/" + link.Code})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"links":   response,
+	})
+}
+
+func deleteShareLink(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Share code is required", nil)
+		return
+	}
+
+	if err := utils.DeleteShareLink(r.Context(), code); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Share link not found", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "Share link deleted"})
+}
+
+// ShortLinkHandler serves images behind /s/{code} short links without exposing storage paths
+func ShortLinkHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+		if code == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		link, err := utils.GetShareLink(ctx, code)
+		if err != nil || link.Expired() {
+			http.NotFound(w, r)
+			return
+		}
+
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, link.ImageID)
+		if err != nil || !metadata.IsViewable() {
+			http.NotFound(w, r)
+			return
+		}
+
+		key, _ := storedFormatKey(metadata, link.Format)
+		if key == "" {
+			key = metadata.Paths.Original
+		}
+
+		resolved, err := utils.ResolveImageKey(ctx, key)
+		if err != nil {
+			logger.Warn("Shared image not found in storage",
+				zap.String("code", code),
+				zap.String("key", key),
+				zap.Error(err))
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := utils.Storage.Get(ctx, resolved)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to read image", nil)
+			return
+		}
+
+		if err := utils.RecordShareLinkClick(ctx, code); err != nil {
+			logger.Warn("Failed to record share link click",
+				zap.String("code", code),
+				zap.Error(err))
+		}
+
+		format := link.Format
+		if resolved == metadata.Paths.Original {
+			format = FormatOriginal
+		}
+		w.Header().Set("Content-Type", getContentType(format, resolved))
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(data)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// privateRedirectTTL bounds how long the presigned URL a private image is redirected to stays valid
+const privateRedirectTTL = 5 * time.Minute
+
+// SignRequest represents the request body for signing an image URL
+type SignRequest struct {
+	ID        string `json:"id"`        // Image ID
+	Format    string `json:"format"`    // Format to serve: original (default), webp, avif or thumbnail_<size>
+	ExpiresIn string `json:"expiresIn"` // Optional URL lifetime, e.g. "15m"; SIGNED_URL_TTL when empty
+}
+
+// SignHandler issues time-limited URLs of an image at /api/sign, the way private images are
+// shared. Images in S3 get presigned URLs, others HMAC-signed /images/ URLs.
+func SignHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		var req SignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+			return
+		}
+		if req.Format == "" {
+			req.Format = FormatOriginal
+		}
+
+		ttl := time.Duration(cfg.SignedURLTTL) * time.Second
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid expiresIn duration", req.ExpiresIn)
+				return
+			}
+			ttl = d
+		}
+		if ttl > time.Duration(cfg.SignedURLMaxTTL)*time.Second {
+			errors.HandleError(w, errors.ErrInvalidParam, "expiresIn exceeds the longest allowed lifetime",
+				(time.Duration(cfg.SignedURLMaxTTL) * time.Second).String())
+			return
+		}
+
+		metadata, err := utils.MetadataManager.GetMetadata(r.Context(), req.ID)
+		if err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+			return
+		}
+		key, ok := storedFormatKey(metadata, req.Format)
+		if !ok {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid format", req.Format)
+			return
+		}
+
+		expires := time.Now().Add(ttl)
+		signedURL, presigned, err := utils.PresignObjectURL(r.Context(), key, ttl)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to presign URL", err.Error())
+			return
+		}
+		if !presigned {
+			expiresParam, signature := utils.SignImageKey(cfg, key, expires)
+			signedURL = absoluteURL(cfg, r, "/images/"+key+"?"+url.Values{
+				"expires":   {expiresParam},
+				"signature": {signature},
+			}.Encode())
+		}
+
+		logger.Info("Signed image URL",
+			zap.String("id", req.ID),
+			zap.String("format", req.Format),
+			zap.Duration("ttl", ttl))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"id":        req.ID,
+			"format":    req.Format,
+			"url":       signedURL,
+			"expiresAt": expires.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// storedFormatKey returns the key of an image's stored file in a format: original, webp, avif or
+// thumbnail_<size>. Variants that were not generated fall back to the original.
+func storedFormatKey(metadata *utils.ImageMetadata, format string) (string, bool) {
+	key := metadata.Paths.Original
+	switch {
+	case format == FormatOriginal:
+	case format == FormatWebP:
+		if metadata.Paths.WebP != "" {
+			key = metadata.Paths.WebP
+		}
+	case format == FormatAVIF:
+		if metadata.Paths.AVIF != "" {
+			key = metadata.Paths.AVIF
+		}
+	case strings.HasPrefix(format, "thumbnail_"):
+		if thumbnail := metadata.Paths.Thumbnails[strings.TrimPrefix(format, "thumbnail_")]; thumbnail != "" {
+			key = thumbnail
+		}
+	default:
+		return "", false
+	}
+	return key, true
+}
+
+// sendPrivateObject serves an object of a private image from remote storage, where it is not
+// publicly readable: S3 objects are redirected to a short-lived presigned URL, others streamed
+func sendPrivateObject(w http.ResponseWriter, r *http.Request, key string) {
+	presignedURL, presigned, err := utils.PresignObjectURL(r.Context(), key, privateRedirectTTL)
+	if err != nil {
+		logger.Warn("Failed to presign private image, streaming it",
+			zap.String("key", key),
+			zap.Error(err))
+	}
+	if presigned && err == nil {
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, presignedURL, http.StatusFound)
+		return
+	}
+	serveStoredImage(w, r, key, utils.ImageMimeType(key), 0)
+}
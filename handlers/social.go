@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	maxCommentLength = 500
+	maxAuthorLength  = 50
+)
+
+// LikesResponse describes the like state of an image
+type LikesResponse struct {
+	ID    string `json:"id"`
+	Likes int64  `json:"likes"`
+	Liked bool   `json:"liked"` // Whether the requesting client has liked the image
+}
+
+// CommentRequest represents the request body for adding a comment
+type CommentRequest struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// likeClientID identifies an anonymous client for like deduplication without storing raw IP addresses
+func likeClientID(r *http.Request) string {
+	sum := sha256.Sum256([]byte(clientIP(r) + "|" + r.UserAgent()))
+	return hex.EncodeToString(sum[:12])
+}
+
+// viewableImage loads the metadata of an image that anonymous clients may interact with
+func viewableImage(w http.ResponseWriter, r *http.Request) (*utils.ImageMetadata, bool) {
+	id := r.PathValue("id")
+	metadata, err := utils.MetadataManager.GetMetadata(r.Context(), id)
+	if err != nil || !metadata.IsViewable() {
+		errors.HandleError(w, errors.ErrNotFound, "Image not found", nil)
+		return nil, false
+	}
+	return metadata, true
+}
+
+// LikesHandler manages likes of an image at /api/images/{id}/likes.
+//
+// GET    returns the like count and whether the client has liked the image
+// POST   likes the image
+// DELETE removes the client's like
+func LikesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, ok := viewableImage(w, r)
+		if !ok {
+			return
+		}
+
+		ctx := r.Context()
+		client := likeClientID(r)
+		response := LikesResponse{ID: metadata.ID}
+		var err error
+
+		switch r.Method {
+		case http.MethodGet:
+			response.Likes, err = utils.GetLikeCount(ctx, metadata.ID)
+			if err == nil {
+				response.Liked, err = utils.HasLiked(ctx, metadata.ID, client)
+			}
+		case http.MethodPost:
+			response.Likes, _, err = utils.LikeImage(ctx, metadata.ID, client)
+			response.Liked = true
+		case http.MethodDelete:
+			response.Likes, _, err = utils.UnlikeImage(ctx, metadata.ID, client)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		if err != nil {
+			logger.Error("Failed to process like request",
+				zap.String("id", metadata.ID),
+				zap.String("method", r.Method),
+				zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to process like", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// CommentsHandler lists and adds comments of an image at /api/images/{id}/comments
+func CommentsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.CommentsEnabled {
+			errors.HandleError(w, errors.ErrForbidden, "Comments are disabled", nil)
+			return
+		}
+
+		metadata, ok := viewableImage(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			comments, err := utils.ListComments(r.Context(), metadata.ID)
+			if err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to list comments", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       metadata.ID,
+				"comments": comments,
+			})
+		case http.MethodPost:
+			var req CommentRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+				return
+			}
+			req.Text = strings.TrimSpace(req.Text)
+			req.Author = strings.TrimSpace(req.Author)
+			if req.Text == "" || utf8.RuneCountInString(req.Text) > maxCommentLength {
+				errors.HandleError(w, errors.ErrInvalidParam, "Comment must be between 1 and 500 characters", nil)
+				return
+			}
+			if utf8.RuneCountInString(req.Author) > maxAuthorLength {
+				errors.HandleError(w, errors.ErrInvalidParam, "Author must be at most 50 characters", nil)
+				return
+			}
+			if req.Author == "" {
+				req.Author = "Anonymous"
+			}
+
+			comment, err := utils.AddComment(r.Context(), metadata.ID, req.Author, req.Text)
+			if err != nil {
+				errors.HandleError(w, errors.ErrInternal, "Failed to add comment", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(comment)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+// DeleteCommentHandler removes a comment at /api/images/{id}/comments/{commentId} (moderation)
+func DeleteCommentHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		id := r.PathValue("id")
+		commentID := r.PathValue("commentId")
+		if err := utils.DeleteComment(r.Context(), id, commentID); err != nil {
+			errors.HandleError(w, errors.ErrNotFound, "Comment not found", nil)
+			return
+		}
+
+		logger.Info("Comment deleted",
+			zap.String("id", id),
+			zap.String("comment_id", commentID))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "Comment deleted"})
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Days of uploads reported by the statistics
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+)
+
+// StatsResponse carries the statistics of the library
+type StatsResponse struct {
+	Success bool                `json:"success"`
+	Stats   *utils.LibraryStats `json:"stats"`
+}
+
+// StatsHandler serves the statistics of the library for dashboards at /api/stats.
+//
+// GET  /api/stats?days=30  returns the totals and the uploads of the last days
+// POST /api/stats          recomputes the statistics from the metadata of every image
+func StatsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInternal, "Statistics require Redis metadata storage", nil)
+			return
+		}
+
+		var v paramValidator
+		days := v.Int("days", r.URL.Query().Get("days"), defaultStatsDays, 1, maxStatsDays)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := utils.RebuildStats(r.Context()); err != nil {
+				logger.Error("Failed to rebuild statistics", zap.Error(err))
+				errors.HandleError(w, errors.ErrInternal, "Failed to rebuild statistics", err.Error())
+				return
+			}
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		stats, err := utils.GetLibraryStats(r.Context(), days)
+		if err != nil {
+			logger.Error("Failed to read statistics", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read statistics", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(StatsResponse{
+			Success: true,
+			Stats:   stats,
+		})
+	}
+}
+
+// Images reported by the top served statistics
+const (
+	defaultTopServedLimit = 10
+	maxTopServedLimit     = 100
+)
+
+// TopServedResponse lists the most served images
+type TopServedResponse struct {
+	Success bool        `json:"success"`
+	Images  []ImageInfo `json:"images"` // Most served first
+}
+
+// TopServedHandler lists the most served images at /api/stats/top?limit=10, counting serves of
+// /images/ and /api/random as of the last flush
+func TopServedHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInternal, "Statistics require Redis metadata storage", nil)
+			return
+		}
+
+		var v paramValidator
+		limit := v.Int("limit", r.URL.Query().Get("limit"), defaultTopServedLimit, 1, maxTopServedLimit)
+		if errResp := v.Err(); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		top, err := utils.TopServedImages(r.Context(), limit)
+		if err != nil {
+			logger.Error("Failed to read top served images", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read statistics", err.Error())
+			return
+		}
+
+		params := queryParams{orientation: "all", format: "original"}
+		images := make([]ImageInfo, 0, len(top))
+		for _, served := range top {
+			metadata, err := utils.MetadataManager.GetMetadata(r.Context(), served.ID)
+			if err != nil {
+				continue
+			}
+			imageInfo, _ := imageInfoFromFields(r.Context(), metadata.ID, utils.MetadataFieldValues(metadata), params, cfg)
+			images = append(images, imageInfo)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TopServedResponse{
+			Success: true,
+			Images:  images,
+		})
+	}
+}
+
+// PublicStatsResponse is the subset of the statistics safe to publish: totals only, no tags,
+// names or per-image data
+type PublicStatsResponse struct {
+	Images     int64            `json:"images"`
+	TotalBytes int64            `json:"totalBytes"` // Bytes of every stored object
+	Formats    map[string]int64 `json:"formats"`    // Images by format of the original
+}
+
+// PublicStatsHandler serves aggregate statistics of the library at /stats.json without an API
+// key, for status pages. Enabled by PUBLIC_STATS_ENABLED; /api/stats has the full statistics.
+func PublicStatsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if !utils.IsRedisMetadataStore() {
+			errors.HandleError(w, errors.ErrInternal, "Statistics require Redis metadata storage", nil)
+			return
+		}
+
+		stats, err := utils.GetLibraryStats(r.Context(), 1)
+		if err != nil {
+			logger.Error("Failed to read statistics", zap.Error(err))
+			errors.HandleError(w, errors.ErrInternal, "Failed to read statistics", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		json.NewEncoder(w).Encode(PublicStatsResponse{
+			Images:     stats.Images,
+			TotalBytes: stats.StorageBytes,
+			Formats:    stats.ImagesByFormat,
+		})
+	}
+}
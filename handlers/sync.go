@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// SyncStatus reports the outcome of the last run of a sync source
+type SyncStatus struct {
+	Source    string    `json:"source"`
+	Type      string    `json:"type"`
+	Running   bool      `json:"running"`
+	LastRun   time.Time `json:"lastRun,omitempty"`
+	Imported  int       `json:"imported"` // Images added by the last run
+	Skipped   int       `json:"skipped"`  // Duplicates of library images skipped by the last run
+	Failed    int       `json:"failed"`   // Items that could not be imported in the last run
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Syncer periodically pulls new images from the configured sync sources
+type Syncer struct {
+	cfg      *config.Config
+	sources  []*utils.SyncSource
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup // Running syncs, awaited by Stop
+
+	mu     sync.Mutex
+	status map[string]*SyncStatus
+}
+
+// ImageSyncer is the running syncer, nil when no sync sources are configured
+var ImageSyncer *Syncer
+
+// InitSyncer loads the sync sources and starts syncing them when any are configured
+func InitSyncer(cfg *config.Config) error {
+	sources, err := utils.LoadSyncSources(cfg)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ImageSyncer = &Syncer{
+		cfg:      cfg,
+		sources:  sources,
+		interval: time.Duration(max(cfg.SyncInterval, 1)) * time.Minute,
+		ctx:      ctx,
+		cancel:   cancel,
+		status:   make(map[string]*SyncStatus, len(sources)),
+	}
+	for _, source := range sources {
+		ImageSyncer.status[source.Name] = &SyncStatus{Source: source.Name, Type: source.Type}
+	}
+	ImageSyncer.Start()
+	return nil
+}
+
+// Start syncs every source now and then periodically
+func (s *Syncer) Start() {
+	logger.Info("Starting source sync",
+		zap.Int("sources", len(s.sources)),
+		zap.Duration("interval", s.interval))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.syncAll()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.syncAll()
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates the sync task, waiting for the item being imported
+func (s *Syncer) Stop() {
+	s.cancel()
+	s.wg.Wait()
+	logger.Info("Source sync stopped")
+}
+
+// Trigger syncs a source (or every source when name is empty) in the background. It returns
+// false when the source does not exist.
+func (s *Syncer) Trigger(name string) bool {
+	for _, source := range s.sources {
+		if name == "" || source.Name == name {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.syncSource(source)
+			}()
+			if name != "" {
+				return true
+			}
+		}
+	}
+	return name == ""
+}
+
+// Status returns the status of every source
+func (s *Syncer) Status() []SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]SyncStatus, 0, len(s.sources))
+	for _, source := range s.sources {
+		statuses = append(statuses, *s.status[source.Name])
+	}
+	return statuses
+}
+
+func (s *Syncer) syncAll() {
+	for _, source := range s.sources {
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.syncSource(source)
+	}
+}
+
+// syncSource imports the new and changed items of a source
+func (s *Syncer) syncSource(source *utils.SyncSource) {
+	s.mu.Lock()
+	status := s.status[source.Name]
+	if status.Running {
+		s.mu.Unlock()
+		return
+	}
+	status.Running = true
+	s.mu.Unlock()
+
+	result := SyncStatus{Source: source.Name, Type: source.Type, LastRun: time.Now()}
+	defer func() {
+		s.mu.Lock()
+		*status = result
+		s.mu.Unlock()
+	}()
+
+	ctx := s.ctx
+	if source.Tenant != "" {
+		tenant, err := utils.GetTenant(ctx, source.Tenant)
+		if err != nil {
+			result.LastError = err.Error()
+			return
+		}
+		ctx = utils.WithTenant(ctx, tenant)
+	}
+
+	items, err := source.Remote().List(ctx)
+	if err != nil {
+		result.LastError = err.Error()
+		logger.Error("Failed to list sync source",
+			zap.String("source", source.Name),
+			zap.Error(err))
+		return
+	}
+
+	for _, item := range items {
+		if ctx.Err() != nil || (source.Limit > 0 && result.Imported >= source.Limit) {
+			break
+		}
+		if version, ok := utils.SyncedVersion(ctx, source.Name, item); ok && version == item.Version {
+			continue
+		}
+
+		imported, err := s.syncItem(ctx, source, item)
+		switch {
+		case err != nil:
+			result.Failed++
+			result.LastError = err.Error()
+			logger.Warn("Failed to sync item",
+				zap.String("source", source.Name),
+				zap.String("item", item.ID),
+				zap.Error(err))
+		case imported:
+			result.Imported++
+		default:
+			result.Skipped++
+		}
+	}
+
+	if result.Imported > 0 || result.Failed > 0 {
+		logger.Info("Synced source",
+			zap.String("source", source.Name),
+			zap.Int("imported", result.Imported),
+			zap.Int("skipped", result.Skipped),
+			zap.Int("failed", result.Failed))
+	}
+}
+
+// syncItem imports one item, returning false when it duplicates a library image
+func (s *Syncer) syncItem(ctx context.Context, source *utils.SyncSource, item utils.SyncItem) (bool, error) {
+	if err := utils.CheckTenantQuota(ctx, 1, 0); err != nil {
+		return false, err
+	}
+
+	data, err := source.Remote().Fetch(ctx, item)
+	if err != nil {
+		return false, err
+	}
+
+	if source.DedupeDistance >= 0 {
+		if hash, err := utils.PerceptualHash(data); err == nil {
+			matches, err := utils.FindSimilarImages(ctx, hash, source.DedupeDistance, 1)
+			if err == nil && len(matches) > 0 {
+				return false, utils.RecordSyncedItem(ctx, source.Name, item, matches[0].ID)
+			}
+		}
+	}
+
+	uploadCtx := &uploadContext{
+		reqCtx: ctx,
+		tags:   source.ItemTags(item),
+		cfg:    s.cfg,
+	}
+	visibility := source.Visibility
+	if visibility == "" {
+		visibility = s.cfg.DefaultVisibility
+	}
+	if uploadCtx.visibility, err = utils.ParseVisibility(visibility); err != nil {
+		uploadCtx.visibility = utils.VisibilityPublic
+	}
+	if source.Profile != "" {
+		uploadCtx.profile, _ = utils.GetProcessingProfile(s.cfg, source.Profile)
+	}
+
+	name := path.Base(item.Path)
+	result := processReserved(uploadCtx, name, func() UploadResult {
+		return processImageData(uploadCtx, name, data)
+	})
+	if result.Status != "success" {
+		return false, fmt.Errorf("%s", result.Message)
+	}
+	return true, utils.RecordSyncedItem(ctx, source.Name, item, result.ID)
+}
+
+// SyncHandler reports the status of the sync sources (GET) or starts a sync (POST) at
+// /api/sync. POST accepts an optional "source" query parameter to sync a single source.
+func SyncHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ImageSyncer == nil {
+			errors.HandleError(w, errors.ErrNotFound, "No sync sources configured", nil)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"sources": ImageSyncer.Status(),
+			})
+		case http.MethodPost:
+			source := r.URL.Query().Get("source")
+			if !ImageSyncer.Trigger(source) {
+				errors.HandleError(w, errors.ErrNotFound, "Sync source not found", source)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"message": "Sync started",
+			})
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
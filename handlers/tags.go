@@ -26,9 +26,12 @@ func TagsHandler(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Info("Processing tags request",
 			zap.String("storage_type", string(cfg.StorageType)))
+		if libraryNotModified(w, r) {
+			return
+		}
 
 		// Get all unique tags based on storage type
-		tags, err := getAllUniqueTags(string(cfg.StorageType), cfg.ImageBasePath)
+		tags, err := getAllUniqueTags(r.Context(), string(cfg.StorageType), cfg.ImageBasePath)
 		if err != nil {
 			logger.Error("Failed to retrieve tags", zap.Error(err))
 			errors.HandleError(w, errors.ErrInternal, "Failed to retrieve tags", err)
@@ -49,13 +52,12 @@ func TagsHandler(cfg *config.Config) http.HandlerFunc {
 	}
 }
 
-// getAllUniqueTags retrieves all unique tags from image metadata
-func getAllUniqueTags(storageType, basePath string) ([]string, error) {
-	// Get unique tags from Redis if enabled
-	if utils.IsRedisMetadataStore() {
-		logger.Debug("Using Redis to get unique tags")
-		// Use Redis to get all unique tags
-		return utils.GetAllUniqueTags(context.Background())
+// getAllUniqueTags retrieves all unique tags from image metadata of the context's tenant
+func getAllUniqueTags(ctx context.Context, storageType, basePath string) ([]string, error) {
+	// Get unique tags from the tag index if the metadata store has one
+	if utils.HasTagIndex() {
+		logger.Debug("Using the tag index to get unique tags")
+		return utils.GetAllUniqueTags(ctx)
 	}
 
 	logger.Debug("Using file-based storage to get unique tags",
@@ -69,15 +71,15 @@ func getAllUniqueTags(storageType, basePath string) ([]string, error) {
 	if storageType == "s3" {
 		// For S3 storage, we need to list all metadata files
 		// and extract tags from each one
-		return getS3UniqueTags(uniqueTags, &mu)
+		return getS3UniqueTags(ctx, uniqueTags, &mu)
 	} else {
 		// For local storage, we can read metadata files from the metadata directory
-		return getLocalUniqueTags(basePath, uniqueTags, &mu)
+		return getLocalUniqueTags(ctx, basePath, uniqueTags, &mu)
 	}
 }
 
 // getLocalUniqueTags retrieves unique tags from local metadata files
-func getLocalUniqueTags(basePath string, uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string, error) {
+func getLocalUniqueTags(ctx context.Context, basePath string, uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string, error) {
 	metadataDir := filepath.Join(basePath, "metadata")
 	logger.Debug("Reading metadata directory", zap.String("dir", metadataDir))
 
@@ -102,7 +104,7 @@ func getLocalUniqueTags(basePath string, uniqueTags map[string]struct{}, mu *syn
 		id = id[:len(id)-5] // Remove .json extension
 
 		// Get metadata
-		metadata, err := utils.MetadataManager.GetMetadata(context.Background(), id)
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
 		if err != nil || metadata == nil {
 			logger.Warn("Failed to get metadata",
 				zap.String("id", id),
@@ -128,11 +130,11 @@ func getLocalUniqueTags(basePath string, uniqueTags map[string]struct{}, mu *syn
 }
 
 // getS3UniqueTags retrieves unique tags from S3 metadata
-func getS3UniqueTags(uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string, error) {
+func getS3UniqueTags(ctx context.Context, uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string, error) {
 	logger.Debug("Getting unique tags from S3 metadata")
 
 	// Get all metadata from S3
-	s3Storage, ok := utils.Storage.(*utils.S3Storage)
+	s3Storage, ok := utils.StorageBackend().(*utils.S3Storage)
 	if !ok {
 		logger.Error("Failed to get S3 storage instance")
 		return nil, nil
@@ -140,7 +142,7 @@ func getS3UniqueTags(uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string,
 
 	// List all metadata objects
 	metadataPrefix := "metadata/"
-	objects, err := s3Storage.ListObjects(context.Background(), metadataPrefix)
+	objects, err := s3Storage.ListObjects(ctx, metadataPrefix)
 	if err != nil {
 		logger.Error("Failed to list S3 metadata objects",
 			zap.String("prefix", metadataPrefix),
@@ -162,7 +164,7 @@ func getS3UniqueTags(uniqueTags map[string]struct{}, mu *sync.Mutex) ([]string,
 		id = id[:len(id)-5] // Remove .json extension
 
 		// Get metadata
-		metadata, err := utils.MetadataManager.GetMetadata(context.Background(), id)
+		metadata, err := utils.MetadataManager.GetMetadata(ctx, id)
 		if err != nil || metadata == nil {
 			logger.Warn("Failed to get metadata",
 				zap.String("id", id),
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// TenantRequest represents the request body for creating a tenant
+type TenantRequest struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	MaxImages int64    `json:"maxImages"` // 0 = unlimited
+	MaxBytes  int64    `json:"maxBytes"`  // 0 = unlimited
+	Domains   []string `json:"domains"`   // Host names that select the tenant
+	BaseURL   string   `json:"baseURL"`   // Public base URL (defaults to https://<first domain>)
+}
+
+// TenantResponse describes a tenant with its current usage
+type TenantResponse struct {
+	*utils.Tenant
+	Usage  utils.TenantUsage `json:"usage"`
+	APIKey string            `json:"apiKey,omitempty"` // Only returned when the tenant is created
+}
+
+// TenantsHandler manages tenants (admin key only).
+//
+// GET    /api/tenants        lists tenants with their usage
+// POST   /api/tenants        creates a tenant and returns its API key
+// PUT    /api/tenants        replaces the domains and base URL of a tenant
+// DELETE /api/tenants?id=    deletes a tenant and revokes its key; its images are kept
+func TenantsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listTenants(w, r)
+		case http.MethodPost:
+			createTenant(w, r)
+		case http.MethodPut:
+			updateTenantDomains(w, r)
+		case http.MethodDelete:
+			deleteTenant(w, r)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+		}
+	}
+}
+
+func listTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := utils.ListTenants(r.Context())
+	if err != nil {
+		errors.HandleError(w, errors.ErrInternal, "Failed to list tenants", err.Error())
+		return
+	}
+
+	response := make([]TenantResponse, 0, len(tenants))
+	for _, tenant := range tenants {
+		usage, _ := utils.GetTenantUsage(utils.WithTenant(r.Context(), tenant))
+		response = append(response, TenantResponse{Tenant: tenant, Usage: usage})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"tenants": response,
+	})
+}
+
+func createTenant(w http.ResponseWriter, r *http.Request) {
+	var req TenantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+
+	tenant, apiKey, err := utils.CreateTenant(r.Context(), req.ID, req.Name, req.MaxImages, req.MaxBytes)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to create tenant", err.Error())
+		return
+	}
+	if len(req.Domains) > 0 || req.BaseURL != "" {
+		if tenant, err = utils.SetTenantDomains(r.Context(), tenant.ID, req.Domains, req.BaseURL); err != nil {
+			// Do not leave a half-configured tenant behind
+			utils.DeleteTenant(r.Context(), req.ID)
+			errors.HandleError(w, errors.ErrInvalidParam, "Failed to create tenant", err.Error())
+			return
+		}
+	}
+
+	logger.Info("Tenant created",
+		zap.String("tenant", tenant.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TenantResponse{Tenant: tenant, APIKey: apiKey})
+}
+
+func updateTenantDomains(w http.ResponseWriter, r *http.Request) {
+	var req TenantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+		return
+	}
+
+	if _, err := utils.GetTenant(r.Context(), req.ID); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Tenant not found", req.ID)
+		return
+	}
+	tenant, err := utils.SetTenantDomains(r.Context(), req.ID, req.Domains, req.BaseURL)
+	if err != nil {
+		errors.HandleError(w, errors.ErrInvalidParam, "Failed to update tenant domains", err.Error())
+		return
+	}
+
+	logger.Info("Tenant domains updated",
+		zap.String("tenant", tenant.ID),
+		zap.Strings("domains", tenant.Domains))
+
+	usage, _ := utils.GetTenantUsage(utils.WithTenant(r.Context(), tenant))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TenantResponse{Tenant: tenant, Usage: usage})
+}
+
+func deleteTenant(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		errors.HandleError(w, errors.ErrInvalidParam, "Tenant ID is required", nil)
+		return
+	}
+
+	if err := utils.DeleteTenant(r.Context(), id); err != nil {
+		errors.HandleError(w, errors.ErrNotFound, "Tenant not found", nil)
+		return
+	}
+
+	logger.Info("Tenant deleted",
+		zap.String("tenant", id))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteResponse{Success: true, Message: "Tenant deleted"})
+}
+
+// CurrentTenantHandler returns the tenant the request is scoped to and its usage at /api/tenant
+func CurrentTenantHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		tenant := utils.TenantFromContext(r.Context())
+		if tenant == nil {
+			tenant = &utils.Tenant{ID: "", Name: "default"}
+		}
+		usage, err := utils.GetTenantUsage(r.Context())
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to read usage", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TenantResponse{Tenant: tenant, Usage: usage})
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// ThemeVariantRequest represents the request body for pairing a dark-mode variant
+type ThemeVariantRequest struct {
+	Dark string `json:"dark"` // ID of the dark-mode variant
+}
+
+// ThemeVariantHandler pairs images with their dark-mode variants.
+//
+// POST   /api/images/{id}/theme   makes {"dark": "<id>"} the dark-mode variant of the image
+// DELETE /api/images/{id}/theme   removes the pairing of the image
+func ThemeVariantHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		var metadata *utils.ImageMetadata
+		var err error
+
+		switch r.Method {
+		case http.MethodPost:
+			var req ThemeVariantRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Dark == "" {
+				errors.HandleError(w, errors.ErrInvalidParam, "Dark variant ID is required", nil)
+				return
+			}
+			metadata, err = utils.PairThemeVariants(r.Context(), id, req.Dark)
+		case http.MethodDelete:
+			metadata, err = utils.UnpairThemeVariants(r.Context(), id)
+		default:
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		if err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Failed to update theme variant", err.Error())
+			return
+		}
+
+		logger.Info("Theme variant updated",
+			zap.String("image_id", id),
+			zap.String("method", r.Method),
+			zap.String("dark_variant", metadata.DarkVariant))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"image":   metadata,
+		})
+	}
+}
+
+// requestTheme returns the theme a request asks for with the theme parameter. With auto the
+// client is asked for its color scheme hint, and responses vary by it.
+func requestTheme(w http.ResponseWriter, r *http.Request) (string, error) {
+	param := r.URL.Query().Get("theme")
+	if param == utils.ThemeAuto {
+		w.Header().Add("Accept-CH", utils.ThemeHint)
+		w.Header().Add("Vary", utils.ThemeHint)
+	}
+	return utils.RequestedTheme(r, param)
+}
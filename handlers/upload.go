@@ -1,17 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	_ "github.com/gen2brain/avif"
+	_ "golang.org/x/image/webp"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	_ "golang.org/x/image/webp"
-	_ "github.com/gen2brain/avif"
+	"io"
 	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,42 +24,60 @@ import (
 	"github.com/Yuri-NagaSaki/ImageFlow/utils"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
 	"go.uber.org/zap"
 )
 
 // UploadResult represents the result of an image upload
 type UploadResult struct {
-	Filename    string            `json:"filename"`
-	Status      string            `json:"status"`
-	Message     string            `json:"message"`
-	Orientation string            `json:"orientation,omitempty"`
-	Format      string            `json:"format,omitempty"`
-	URLs        map[string]string `json:"urls,omitempty"`
-	ExpiryTime  string            `json:"expiryTime,omitempty"`
-	Tags        []string          `json:"tags,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	Filename     string            `json:"filename"`
+	Status       string            `json:"status"`
+	Message      string            `json:"message"`
+	Orientation  string            `json:"orientation,omitempty"`
+	Format       string            `json:"format,omitempty"`
+	SourceFormat string            `json:"sourceFormat,omitempty"` // Format of the upload when converted, e.g. heic
+	URLs         map[string]string `json:"urls,omitempty"`
+	Paths        map[string]string `json:"paths,omitempty"` // Storage keys of the stored objects, by the names of URLs (API version 2)
+	Sizes        map[string]int64  `json:"sizes,omitempty"` // Sizes of the stored objects in bytes (API version 2)
+	ExpiryTime   string            `json:"expiryTime,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Profile      string            `json:"profile,omitempty"`   // Processing profile applied
+	Duplicate    bool              `json:"duplicate,omitempty"` // Whether an identical image already existed and was returned instead
+	JobID        string            `json:"jobId,omitempty"`     // Conversion job of an async upload, see /api/jobs/{id}
 }
 
+// conversionLog rate limits the entries logged for every conversion of an upload
+var conversionLog = logger.Limited(logger.CategoryConversion)
+
 // getPublicURL constructs a public-facing URL for accessing an image
-func getPublicURL(key string, cfg *config.Config) string {
+func getPublicURL(ctx context.Context, key string, cfg *config.Config) string {
 	if cfg.StorageType == config.StorageTypeLocal {
-		return fmt.Sprintf("/images/%s", key)
-	}
-	// For S3 storage
-	if cfg.CustomDomain != "" {
-		return fmt.Sprintf("%s/%s", strings.TrimSuffix(cfg.CustomDomain, "/"), key)
+		return fmt.Sprintf("%s/%s", imageBaseURL(ctx, cfg), key)
 	}
-	// Fallback to S3 endpoint with bucket name
-	endpoint := strings.TrimSuffix(cfg.S3Endpoint, "/")
-	return fmt.Sprintf("%s/%s/%s", endpoint, cfg.S3Bucket, key)
+	// Remote storage is linked through the custom domain, or the bucket or container URL
+	return fmt.Sprintf("%s/%s", cfg.GetBaseURL(), key)
 }
 
-// determineImageOrientation classifies an image as landscape or portrait
-// Square images and portrait images are classified as portrait
-func determineImageOrientation(img image.Config) string {
-	if img.Width > img.Height {
-		return "landscape"
+// imageBaseURL returns the base URL of stored images. Locally stored images of a tenant with a
+// custom domain are linked through that domain; remote images keep the bucket or CDN domain.
+func imageBaseURL(ctx context.Context, cfg *config.Config) string {
+	if cfg.StorageType == config.StorageTypeLocal {
+		if tenant := utils.TenantFromContext(ctx); tenant != nil && tenant.PublicBaseURL() != "" {
+			return tenant.PublicBaseURL() + "/images"
+		}
 	}
-	return "portrait"
+	return cfg.GetBaseURL()
+}
+
+// spooledUpload is an upload in a file on disk: a multipart file spooled by the parser or the
+// data of a resumable upload. Video clips are processed and stored from the file; images are
+// read into memory for libvips, but their original is streamed from the file when stored as
+// uploaded.
+type spooledUpload struct {
+	path        string
+	size        int64
+	videoFormat string // Format of a video clip, empty for images
 }
 
 // processImage handles the processing of a single image file
@@ -74,238 +95,1088 @@ func processImage(ctx *uploadContext, fileHeader *multipart.FileHeader) UploadRe
 	}
 	defer file.Close()
 
-	// Read image configuration to determine orientation
-	img, _, err := image.DecodeConfig(file)
-	if err != nil {
-		return UploadResult{
-			Filename: fileHeader.Filename,
-			Status:   "error",
-			Message:  fmt.Sprintf("Error reading image configuration: %v", err),
-		}
+	// Files beyond the in-memory part of the form were spooled to disk by the multipart parser
+	if spooled, ok := file.(*os.File); ok {
+		return processSpooled(ctx, fileHeader.Filename, spooled, fileHeader.Size)
 	}
-	orientation := determineImageOrientation(img)
 
-	// Reset file pointer
-	if _, err := file.Seek(0, 0); err != nil {
+	// Read file content
+	data := make([]byte, fileHeader.Size)
+	if _, err := io.ReadFull(file, data); err != nil {
 		return UploadResult{
 			Filename: fileHeader.Filename,
 			Status:   "error",
-			Message:  fmt.Sprintf("Error resetting file pointer: %v", err),
+			Message:  fmt.Sprintf("Error reading file: %v", err),
 		}
 	}
 
-	// Read file content
-	data := make([]byte, fileHeader.Size)
-	if _, err := file.Read(data); err != nil {
+	return processImageData(ctx, fileHeader.Filename, data)
+}
+
+// processSpooled processes an upload in a file on disk. Video clips are never read into memory.
+// Images are checked against MAX_MEGAPIXELS from their header before they are read, as libvips
+// decodes them from memory.
+func processSpooled(ctx *uploadContext, name string, file *os.File, size int64) UploadResult {
+	readError := func(err error) UploadResult {
 		return UploadResult{
-			Filename: fileHeader.Filename,
+			Filename: name,
 			Status:   "error",
 			Message:  fmt.Sprintf("Error reading file: %v", err),
 		}
 	}
 
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(file, head)
+	if format := utils.VideoFormat(head[:n]); format != "" {
+		return processUpload(ctx, name, nil, &spooledUpload{path: file.Name(), size: size, videoFormat: format})
+	}
+
+	if ctx.cfg.MaxMegapixels > 0 {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return readError(err)
+		}
+		if img, _, err := image.DecodeConfig(file); err == nil {
+			if rejected := pixelLimit(ctx.cfg, name, img.Width, img.Height); rejected != nil {
+				return UploadResult{
+					Filename: name,
+					Status:   "error",
+					Message:  rejected.Message,
+				}
+			}
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return readError(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return readError(err)
+	}
+	return processUpload(ctx, name, data, &spooledUpload{path: file.Name(), size: size})
+}
+
+// processImageData stores an image under a new ID, converts it according to its processing
+// profile and saves its metadata
+func processImageData(ctx *uploadContext, name string, data []byte) UploadResult {
+	return processUpload(ctx, name, data, nil)
+}
+
+// imageUpload is the state of an upload handed from one step of processUpload to the next
+type imageUpload struct {
+	ctx      *uploadContext
+	reqCtx   context.Context // Traced request context, marked for private objects by applyProfile
+	id       string
+	name     string
+	pipeline *utils.PipelineLog
+	spooled  *spooledUpload
+	uploaded []byte // Data as uploaded; the original is streamed from a spooled file while it is unchanged
+
+	// Set by hashContent and decode
+	contentHash  string
+	data         []byte // Image every derivative is made from
+	fullSize     []byte // Image stored as the original, data unless kept apart from a downscaled image
+	svg          []byte // Sanitized SVG stored as the original of an SVG image
+	video        *utils.VideoClip
+	videoData    []byte // Clip as uploaded, nil when streamed from the spooled file
+	videoSize    int64
+	animated     bool
+	sourceFormat string
+	img          image.Config
+	orientation  string
+
+	// Set by normalize and fingerprint
+	format   utils.ImageFormatInfo
+	phash    string
+	blurhash string
+
+	// Set by applyProfile
+	profile     *utils.ProcessingProfile
+	convertOpts utils.ConvertOptions
+	tags        []string
+	expiryTime  time.Time
+	visibility  utils.Visibility
+
+	// Set by storeOriginal and storeVariants
+	saga            *utils.Saga
+	originalKey     string
+	originalSize    int64
+	videoKey        string
+	queueConversion bool
+	webp, avif      storedVariant
+	thumbnailKeys   map[string]string
+	thumbnailSizes  map[string]int64
+}
+
+// storedVariant is the outcome of storing the WebP or AVIF variant of an upload
+type storedVariant struct {
+	key    string
+	url    string
+	size   int64
+	failed bool
+}
+
+// processUpload is processImageData for an upload that may be spooled to disk, whose data is
+// nil for a video clip. Each step reports the error returned for the upload; objects stored
+// before a failing step are removed again.
+func processUpload(ctx *uploadContext, name string, data []byte, spooled *spooledUpload) UploadResult {
 	// Generate unique filename
 	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("%s_%d", timestamp, time.Now().UnixNano()%10000)
-	imageID := filename
+	imageID := fmt.Sprintf("%s_%d", timestamp, time.Now().UnixNano()%10000)
 
-	// Detect image format
-	imgFormat, err := utils.DetectImageFormat(data)
+	size := int64(len(data))
+	if spooled != nil {
+		size = spooled.size
+	}
+	reqCtx, span := tracing.Start(ctx.reqCtx, "upload.image",
+		tracing.String("image.id", imageID),
+		tracing.Int64("image.size", size))
+	defer span.End()
+
+	u := &imageUpload{
+		ctx:      ctx,
+		reqCtx:   reqCtx,
+		id:       imageID,
+		name:     name,
+		pipeline: utils.NewPipelineLog(imageID),
+		spooled:  spooled,
+		uploaded: data,
+		data:     data,
+	}
+
+	if err := u.hashContent(); err != nil {
+		return u.failed(err)
+	}
+	if existing := u.findDuplicate(); existing != nil {
+		return duplicateUploadResult(ctx, name, existing)
+	}
+	if err := u.decode(); err != nil {
+		return u.failed(err)
+	}
+	if err := u.applyLimits(); err != nil {
+		return u.failed(err)
+	}
+	if err := u.normalize(); err != nil {
+		return u.failed(err)
+	}
+	span.SetAttributes(tracing.String("image.format", u.format.Format))
+	u.fingerprint()
+	if err := u.applyProfile(); err != nil {
+		return u.failed(err)
+	}
+	if err := u.storeOriginal(); err != nil {
+		return u.failed(err)
+	}
+	u.storeVariants()
+	metadata, err := u.saveMetadata()
 	if err != nil {
-		return UploadResult{
-			Filename: fileHeader.Filename,
-			Status:   "error",
-			Message:  fmt.Sprintf("Error detecting image format: %v", err),
+		return u.failed(err)
+	}
+	return u.result(metadata)
+}
+
+// failed reports an upload that failed at one of its steps
+func (u *imageUpload) failed(err error) UploadResult {
+	return UploadResult{
+		Filename: u.name,
+		Status:   "error",
+		Message:  err.Error(),
+	}
+}
+
+// hashContent hashes the upload as received, streaming a spooled video clip from its file
+func (u *imageUpload) hashContent() error {
+	if u.data != nil {
+		u.contentHash = utils.ContentHash(u.data)
+		return nil
+	}
+	var err error
+	u.contentHash, err = utils.ContentHashFile(u.spooled.path)
+	return err
+}
+
+// findDuplicate returns the image stored from the same bytes, which identical uploads return
+// instead of another copy when deduplication is enabled
+func (u *imageUpload) findDuplicate() *utils.ImageMetadata {
+	enabled := u.ctx.dedupe == "true" || (u.ctx.dedupe == "" && u.ctx.cfg.DedupeUploads)
+	if !enabled {
+		return nil
+	}
+	existing, err := utils.FindByContentHash(u.reqCtx, u.contentHash)
+	if err != nil {
+		logger.Warn("Failed to look up identical image",
+			zap.String("filename", u.name),
+			zap.Error(err))
+		return nil
+	}
+	if existing == nil || !dedupeMatches(u.ctx, existing) {
+		return nil
+	}
+	logger.Info("Returning identical image",
+		zap.String("filename", u.name),
+		zap.String("image_id", existing.ID))
+	return existing
+}
+
+// decode turns the upload into the image every later step works on, and reads its dimensions
+// and orientation
+func (u *imageUpload) decode() error {
+	// SVG images are stored sanitized as the original; every other step works on a PNG
+	// rendering of them
+	if utils.IsSVG(u.data) {
+		if !u.ctx.cfg.SVGSupport {
+			return fmt.Errorf("SVG uploads are not enabled")
+		}
+		endStep := u.pipeline.Start("svg_sanitize")
+		sanitized, err := utils.SanitizeSVG(u.data)
+		endStep(int64(len(sanitized)), err)
+		if err != nil {
+			return fmt.Errorf("Error sanitizing SVG image: %v", err)
+		}
+		endStep = u.pipeline.Start("svg_rasterize")
+		raster, err := utils.RasterizeSVG(u.reqCtx, sanitized)
+		endStep(int64(len(raster)), err)
+		if err != nil {
+			return fmt.Errorf("Error rendering SVG image: %v", err)
 		}
+		u.svg, u.data = sanitized, raster
 	}
 
-	var originalKey string
-	if imgFormat.Format == "gif" {
-		originalKey = filepath.Join("gif", filename+imgFormat.Extension)
+	// Video clips are stored as uploaded, with a poster frame in place of the original and an
+	// animated preview in place of the WebP variant
+	u.videoData, u.videoSize = u.data, int64(len(u.data))
+	format := utils.VideoFormat(u.data)
+	if u.data == nil {
+		format, u.videoSize = u.spooled.videoFormat, u.spooled.size
+	}
+	if format != "" {
+		if !utils.VideoEnabled() {
+			return fmt.Errorf("Video uploads are not enabled")
+		}
+		endStep := u.pipeline.Start("video")
+		var clip *utils.VideoClip
+		var err error
+		if u.data == nil {
+			clip, err = utils.ProcessVideoFile(u.reqCtx, u.ctx.cfg, u.spooled.path, format)
+		} else {
+			clip, err = utils.ProcessVideo(u.reqCtx, u.ctx.cfg, u.data, format)
+		}
+		if err != nil {
+			endStep(0, err)
+			return fmt.Errorf("Error processing video: %v", err)
+		}
+		endStep(int64(len(clip.Poster)+len(clip.Preview)), nil)
+		u.video, u.data = clip, clip.Poster
+	}
+
+	// WASM transform plugins run first, so every later step sees the transformed image
+	if utils.HasWasmPlugins(utils.WasmTransform) {
+		endStep := u.pipeline.Start("wasm_transform")
+		transformed, err := utils.ApplyWasmTransforms(u.reqCtx, u.data)
+		endStep(int64(len(transformed)), err)
+		if err != nil {
+			return err
+		}
+		u.data = transformed
+	}
+
+	// Animations (GIFs, animated WebPs and APNGs) are stored and served as uploaded, as libvips
+	// would keep only their first frame
+	u.animated = utils.IsAnimated(u.data)
+
+	// HEIC/HEIF photos are stored as JPEG originals, keeping their format in the metadata
+	u.sourceFormat = utils.HEIFFormat(u.data)
+	if u.video != nil {
+		u.sourceFormat = u.video.Format
+	}
+
+	// Read the image dimensions from its header, which libvips also reads for HEIC/HEIF. Photos
+	// are classified by their displayed dimensions, swapped for photos rotated through EXIF.
+	endStep := u.pipeline.Start("decode")
+	width, height, err := utils.DisplayDimensions(u.data)
+	endStep(0, err)
+	if err != nil {
+		return fmt.Errorf("Error reading image configuration: %v", err)
+	}
+	u.img = image.Config{Width: width, Height: height}
+	u.orientation = utils.ClassifyOrientation(width, height)
+	return nil
+}
+
+// applyLimits rejects images beyond MAX_MEGAPIXELS and downscales those larger than
+// MAX_IMAGE_DIMENSION
+func (u *imageUpload) applyLimits() error {
+	cfg := u.ctx.cfg
+
+	// MAX_MEGAPIXELS also applies to uploads not checked before processing: URL, resumable and
+	// synced uploads, and formats whose dimensions are only known once decoded
+	if rejected := pixelLimit(cfg, u.name, u.img.Width, u.img.Height); rejected != nil {
+		return fmt.Errorf("%s", rejected.Message)
+	}
+
+	// Images larger than MAX_IMAGE_DIMENSION are downscaled right after their header is read,
+	// so HEIC/HEIF conversion, auto-rotation, EXIF stripping and every later step work on the
+	// smaller image. The original keeps its size, and the metadata its dimensions, unless
+	// DOWNSCALE_ORIGINAL is set; a full-size original is still decoded in full by those steps.
+	u.fullSize = u.data
+	if limit := cfg.MaxImageDimension; limit > 0 && !u.animated && max(u.img.Width, u.img.Height) > limit {
+		endStep := u.pipeline.Start("downscale")
+		downscaled, err := utils.DownscaleImage(u.reqCtx, u.data, limit)
+		endStep(int64(len(downscaled)), err)
+		if err != nil {
+			return fmt.Errorf("Error downscaling image: %v", err)
+		}
+		logger.Info("Downscaled oversized image",
+			zap.String("filename", u.name),
+			zap.Int("width", u.img.Width),
+			zap.Int("height", u.img.Height),
+			zap.Int("max_dimension", limit),
+			zap.Bool("original_downscaled", cfg.DownscaleOriginal))
+		u.data = downscaled
+		if cfg.DownscaleOriginal {
+			u.fullSize = u.data
+			if width, height, err := utils.DisplayDimensions(u.data); err == nil {
+				u.img.Width, u.img.Height = width, height
+			}
+		}
+	}
+	return nil
+}
+
+// normalize converts, rotates and strips the image used for derivatives, and the full-size
+// original when it was kept apart from it, then detects its format
+func (u *imageUpload) normalize() error {
+	separateOriginal := !sameBytes(u.fullSize, u.data)
+	var err error
+	if u.data, err = normalizeImage(u.reqCtx, u.ctx.cfg, u.pipeline, u.data, u.animated); err != nil {
+		return err
+	}
+	if !separateOriginal {
+		u.fullSize = u.data
+	} else if u.fullSize, err = normalizeImage(u.reqCtx, u.ctx.cfg, u.pipeline, u.fullSize, u.animated); err != nil {
+		return err
+	}
+
+	endStep := u.pipeline.Start("detect_format")
+	u.format, err = utils.DetectImageFormat(u.data)
+	endStep(0, err)
+	if err != nil {
+		return fmt.Errorf("Error detecting image format: %v", err)
+	}
+	if u.svg != nil {
+		u.format = utils.SVGFormat
+	}
+	return nil
+}
+
+// fingerprint computes the perceptual hash for reverse image search and the blurhash
+// placeholder for frontends. Failing either only leaves the image without it.
+func (u *imageUpload) fingerprint() {
+	endStep := u.pipeline.Start("phash")
+	hash, err := utils.PerceptualHash(u.data)
+	endStep(0, err)
+	if err == nil {
+		u.phash = utils.FormatPerceptualHash(hash)
 	} else {
-		originalKey = filepath.Join("original", orientation, filename+imgFormat.Extension)
+		logger.Warn("Failed to compute perceptual hash",
+			zap.String("filename", u.name),
+			zap.Error(err))
 	}
 
-	if err := utils.Storage.Store(ctx.r.Context(), originalKey, data); err != nil {
-		return UploadResult{
-			Filename: fileHeader.Filename,
-			Status:   "error",
-			Message:  fmt.Sprintf("Error storing original file: %v", err),
+	endStep = u.pipeline.Start("blurhash")
+	u.blurhash, err = utils.Blurhash(u.data)
+	endStep(0, err)
+	if err != nil {
+		logger.Warn("Failed to compute blurhash",
+			zap.String("filename", u.name),
+			zap.Error(err))
+	}
+}
+
+// applyProfile selects the processing profile of the upload and settles its conversion
+// options, tags, expiry and visibility, which pre-upload hooks may change or reject
+func (u *imageUpload) applyProfile() error {
+	ctx := u.ctx
+	u.profile = selectProfile(ctx, u.format.Format, u.img)
+	u.convertOpts = u.profile.ConvertOptions(ctx.cfg)
+	u.convertOpts.Watermark = u.convertOpts.Watermark.Override(ctx.watermark)
+	u.pipeline.SetProfile(u.profile.Name, u.convertOpts)
+
+	u.tags = ctx.tags
+	for _, tag := range u.profile.Tags {
+		if !slices.Contains(u.tags, tag) {
+			u.tags = append(slices.Clip(u.tags), tag)
+		}
+	}
+	if utils.HasWasmPlugins(utils.WasmTag) {
+		endStep := u.pipeline.Start("wasm_tag")
+		pluginTags, err := utils.WasmTags(u.reqCtx, u.data)
+		endStep(0, err)
+		if err != nil {
+			return err
+		}
+		for _, tag := range pluginTags {
+			if !slices.Contains(u.tags, tag) {
+				u.tags = append(slices.Clip(u.tags), tag)
+			}
+		}
+	}
+	u.expiryTime = ctx.expiryTime
+	if !ctx.expirySet && u.profile.ExpiryMinutes > 0 {
+		u.expiryTime = time.Now().Add(time.Duration(u.profile.ExpiryMinutes) * time.Minute)
+	}
+	u.visibility = ctx.visibility
+
+	// Pre-upload hooks may reject the upload or change its tags, visibility and expiry
+	if utils.HasHooks(utils.HookPreUpload) {
+		draft := &utils.ImageMetadata{
+			ID:           u.id,
+			OriginalName: u.name,
+			ExpiryTime:   u.expiryTime,
+			Format:       u.format.Format,
+			Orientation:  u.orientation,
+			Width:        u.img.Width,
+			Height:       u.img.Height,
+			Tags:         slices.Clone(u.tags),
+			Visibility:   u.visibility,
+			Profile:      u.profile.Name,
+		}
+		endStep := u.pipeline.Start("pre_upload_hooks")
+		err := utils.RunHooks(u.reqCtx, &utils.HookEvent{Point: utils.HookPreUpload, ImageID: u.id, Metadata: draft})
+		endStep(0, err)
+		if err != nil {
+			return err
 		}
+		u.tags, u.visibility, u.expiryTime = draft.Tags, draft.Visibility, draft.ExpiryTime
+	}
+	if u.visibility == utils.VisibilityPrivate {
+		// Objects of private images are only served through signed URLs
+		u.reqCtx = utils.WithPrivateObjects(u.reqCtx)
+	}
+	return nil
+}
+
+// storeOriginal stores the original image, and the clip of a video, as the first steps of the
+// upload's saga
+func (u *imageUpload) storeOriginal() error {
+	cfg := u.ctx.cfg
+	switch {
+	case u.format.Format == "gif":
+		u.originalKey = utils.TenantStorageKey(u.reqCtx, utils.GIFKey(cfg.KeyLayout, u.id, u.format.Extension))
+	case u.animated:
+		u.originalKey = utils.TenantStorageKey(u.reqCtx, utils.AnimatedKey(cfg.KeyLayout, u.id, u.format.Extension))
+	default:
+		u.originalKey = utils.TenantStorageKey(u.reqCtx, utils.OriginalKey(cfg.KeyLayout, u.orientation, u.id, u.format.Extension))
+	}
+
+	// Every object stored from here on is deleted again if the upload fails before its metadata
+	// is saved
+	u.saga = utils.NewSaga("upload " + u.id)
+
+	var err error
+	if u.video != nil {
+		u.videoKey = utils.TenantStorageKey(u.reqCtx, utils.VideoKey(cfg.KeyLayout, u.id, "."+u.video.Format))
+		endStep := u.pipeline.Start("store_video")
+		if u.videoData == nil {
+			err = storeSpooled(u.reqCtx, u.saga, u.videoKey, u.spooled)
+		} else {
+			err = u.saga.StoreObject(u.reqCtx, u.videoKey, u.videoData)
+		}
+		endStep(u.videoSize, err)
+		if err != nil {
+			return fmt.Errorf("Error storing video file: %v", err)
+		}
+	}
+
+	original := u.fullSize
+	if u.svg != nil {
+		original = u.svg
+	}
+	endStep := u.pipeline.Start("store_original")
+	if u.spooled != nil && sameBytes(original, u.uploaded) {
+		err = storeSpooled(u.reqCtx, u.saga, u.originalKey, u.spooled)
+	} else {
+		err = u.saga.StoreObject(u.reqCtx, u.originalKey, original)
+	}
+	endStep(int64(len(original)), err)
+	if err != nil {
+		u.saga.Rollback(u.reqCtx)
+		return fmt.Errorf("Error storing original file: %v", err)
 	}
 	logger.Info("Original image stored",
-		zap.String("key", originalKey),
-		zap.String("filename", fileHeader.Filename),
-		zap.String("format", imgFormat.Format),
-		zap.Int("size", len(data)))
+		zap.String("key", u.originalKey),
+		zap.String("filename", u.name),
+		zap.String("format", u.format.Format),
+		zap.Int("size", len(original)))
+	u.originalSize = int64(len(original))
+	return nil
+}
+
+// storeVariants generates and stores the thumbnails and the WebP and AVIF variants of the
+// upload concurrently. Failures only leave the variants out, to be served as the original.
+func (u *imageUpload) storeVariants() {
+	ctx, cfg := u.ctx, u.ctx.cfg
+	u.webp.key = utils.TenantStorageKey(u.reqCtx, utils.VariantKey(cfg.KeyLayout, u.orientation, "webp", u.id))
+	u.avif.key = utils.TenantStorageKey(u.reqCtx, utils.VariantKey(cfg.KeyLayout, u.orientation, "avif", u.id))
 
-	var originalSize, webpSize, avifSize int64
-	originalSize = int64(len(data))
+	// Async uploads leave the WebP/AVIF conversion to the conversion queue, serving the original
+	// until it is done
+	u.queueConversion = ctx.async && u.video == nil && !u.animated &&
+		(u.profile.Generates(FormatWebP) || (u.profile.Generates(FormatAVIF) && cfg.AvifSupport))
 
-	var webpURL, avifURL string
 	var wg sync.WaitGroup
 
-	if imgFormat.Format != "gif" {
-		// WebP conversion
+	// Thumbnails for listings, GIFs included, generated alongside the conversions
+	if len(cfg.ThumbnailSizes) > 0 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			logger.Debug("Starting WebP conversion",
-				zap.String("filename", fileHeader.Filename))
+			u.storeThumbnails()
+		}()
+	} else {
+		u.pipeline.Skip("thumbnails", "no thumbnail sizes configured")
+	}
 
-			webpData, err := utils.ConvertToWebPWithBimg(data, ctx.cfg)
-			if err != nil {
-				logger.Error("WebP conversion failed",
-					zap.String("filename", fileHeader.Filename),
-					zap.Error(err))
-				return
-			}
+	if u.video != nil {
+		// The preview is the WebP variant of a clip. AVIF would show the still poster to the
+		// browsers preferring it, so clips get none.
+		endStep := u.pipeline.Start("webp")
+		err := u.saga.StoreObject(u.reqCtx, u.webp.key, u.video.Preview)
+		endStep(int64(len(u.video.Preview)), err)
+		if err != nil {
+			u.webp.failed = true
+			logger.Error("Failed to store video preview",
+				zap.String("key", u.webp.key),
+				zap.Error(err))
+		} else {
+			u.webp.url = getPublicURL(u.reqCtx, u.webp.key, cfg)
+			u.webp.size = int64(len(u.video.Preview))
+		}
+		u.pipeline.Skip("avif", "video clips have no AVIF variant")
+	} else if u.queueConversion {
+		u.pipeline.Skip("webp", "queued for async conversion")
+		u.pipeline.Skip("avif", "queued for async conversion")
+	} else if !u.animated {
+		if u.profile.Generates(FormatWebP) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u.storeVariant(FormatWebP, "WebP", &u.webp, utils.ConvertToWebPWithOptions)
+			}()
+		} else {
+			u.pipeline.Skip("webp", "not generated by profile "+u.profile.Name)
+		}
+
+		if u.profile.Generates(FormatAVIF) && cfg.AvifSupport {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u.storeVariant(FormatAVIF, "AVIF", &u.avif, utils.ConvertToAVIFWithOptions)
+			}()
+		} else if !cfg.AvifSupport {
+			u.pipeline.Skip("avif", "AVIF disabled")
+		} else {
+			u.pipeline.Skip("avif", "not generated by profile "+u.profile.Name)
+		}
+	} else {
+		conversionLog.Info("Skipping conversions for animated image",
+			zap.String("filename", u.name),
+			zap.String("format", u.format.Format))
+		u.pipeline.Skip("webp", "animation served as is")
+		u.pipeline.Skip("avif", "animation served as is")
+	}
+	wg.Wait()
+}
+
+// storeThumbnails stores the thumbnails of the upload as steps of its saga
+func (u *imageUpload) storeThumbnails() {
+	sizes := u.ctx.cfg.ThumbnailSizes
+	endStep := u.pipeline.Start("thumbnails")
+	u.thumbnailKeys, u.thumbnailSizes = utils.StoreThumbnails(u.reqCtx, u.ctx.cfg, u.ctx.cfg.KeyLayout, u.id, u.data, sizes)
+	for _, key := range u.thumbnailKeys {
+		u.saga.Add("store "+key, func(ctx context.Context) error {
+			return utils.Storage.Delete(ctx, key)
+		})
+	}
+	var total int64
+	for _, size := range u.thumbnailSizes {
+		total += size
+	}
+	var err error
+	if len(u.thumbnailKeys) < len(sizes) {
+		err = fmt.Errorf("%d of %d thumbnails failed", len(sizes)-len(u.thumbnailKeys), len(sizes))
+	}
+	endStep(total, err)
+}
+
+// storeVariant converts the image to a variant format with the quality of the profile and
+// stores it under the variant's key, named by label in the log
+func (u *imageUpload) storeVariant(format, label string, variant *storedVariant,
+	convert func(context.Context, []byte, utils.ConvertOptions) ([]byte, error)) {
+	conversionLog.Debug("Starting "+label+" conversion",
+		zap.String("filename", u.name))
+	endStep := u.pipeline.Start(format)
+
+	opts := u.convertOpts
+	opts.Quality = u.profile.FormatQuality(u.ctx.cfg, format)
+	u.pipeline.SetQuality(format, opts.Quality)
+	data, err := convert(u.reqCtx, u.data, opts)
+	if err != nil {
+		variant.failed = true
+		endStep(0, fmt.Errorf("conversion failed: %v", err))
+		logger.Error(label+" conversion failed",
+			zap.String("filename", u.name),
+			zap.Error(err))
+		return
+	}
+
+	if err := u.saga.StoreObject(u.reqCtx, variant.key, data); err != nil {
+		variant.failed = true
+		endStep(int64(len(data)), fmt.Errorf("store failed: %v", err))
+		logger.Error("Failed to store "+label+" image",
+			zap.String("key", variant.key),
+			zap.Error(err))
+		return
+	}
+
+	variant.url = getPublicURL(u.reqCtx, variant.key, u.ctx.cfg)
+	variant.size = int64(len(data))
+	endStep(variant.size, nil)
+	conversionLog.Info(label+" conversion completed",
+		zap.String("key", variant.key),
+		zap.String("url", variant.url),
+		zap.Int64("size", variant.size))
+}
+
+// metadata describes the stored objects of the upload
+func (u *imageUpload) metadata() *utils.ImageMetadata {
+	metadata := &utils.ImageMetadata{
+		ID:            u.id,
+		OriginalName:  u.name,
+		UploadTime:    time.Now(),
+		Format:        u.format.Format,
+		Orientation:   u.orientation,
+		Width:         u.img.Width,
+		Height:        u.img.Height,
+		Tags:          u.tags,
+		Visibility:    u.visibility,
+		PHash:         u.phash,
+		ContentHash:   u.contentHash,
+		Blurhash:      u.blurhash,
+		Sizes:         make(map[string]int64),
+		LayoutVersion: utils.LayoutVersion(u.ctx.cfg.KeyLayout),
+		Profile:       u.profile.Name,
+		HasAlpha:      utils.HasTransparency(u.format.Format, u.data) || (u.svg != nil && utils.HasTransparency("png", u.data)),
+		Watermarked:   u.convertOpts.Watermark != nil && !u.animated && u.video == nil,
+		Animated:      u.animated && u.format.Format != "gif",
+		SourceFormat:  u.sourceFormat,
+	}
+
+	if !u.expiryTime.IsZero() {
+		metadata.ExpiryTime = u.expiryTime
+	}
+	// Variants whose conversion or storage failed are served as the original until the image is
+	// repaired
+	if u.webp.failed {
+		metadata.FailedVariants = append(metadata.FailedVariants, FormatWebP)
+	}
+	if u.avif.failed {
+		metadata.FailedVariants = append(metadata.FailedVariants, FormatAVIF)
+	}
+
+	// Set paths and sizes of the objects stored; formats without a variant of their own are
+	// served as the original
+	metadata.Paths.Original = u.originalKey
+	metadata.Sizes["original"] = u.originalSize
+	if u.webp.size > 0 {
+		metadata.Paths.WebP = u.webp.key
+		metadata.Sizes["webp"] = u.webp.size
+	}
+	if u.avif.size > 0 {
+		metadata.Paths.AVIF = u.avif.key
+		metadata.Sizes["avif"] = u.avif.size
+	}
+	if len(u.thumbnailKeys) > 0 {
+		metadata.Paths.Thumbnails = u.thumbnailKeys
+	}
+	if u.video != nil {
+		metadata.Paths.Video = u.videoKey
+		metadata.Sizes["video"] = u.videoSize
+		metadata.Duration = u.video.Duration
+	}
 
-			webpKey := filepath.Join(orientation, "webp", filename+".webp")
-			if err := utils.Storage.Store(ctx.r.Context(), webpKey, webpData); err != nil {
-				logger.Error("Failed to store WebP image",
-					zap.String("key", webpKey),
+	for size, n := range u.thumbnailSizes {
+		metadata.Sizes[utils.ThumbnailSizeKey(size)] = n
+	}
+	return metadata
+}
+
+// saveMetadata saves the metadata of the upload, completing its saga, after post-conversion
+// hooks had their say
+func (u *imageUpload) saveMetadata() (*utils.ImageMetadata, error) {
+	metadata := u.metadata()
+
+	// Post-conversion hooks may reject the image, whose stored objects are then removed, or
+	// change its metadata before it is saved
+	if utils.HasHooks(utils.HookPostConversion) {
+		endStep := u.pipeline.Start("post_conversion_hooks")
+		err := utils.RunHooks(u.reqCtx, &utils.HookEvent{Point: utils.HookPostConversion, ImageID: u.id, Metadata: metadata})
+		endStep(0, err)
+		if err != nil {
+			u.saga.Rollback(u.reqCtx)
+			return nil, err
+		}
+		if metadata.IsViewable() != (u.visibility != utils.VisibilityPrivate) {
+			if err := utils.ApplyObjectAccess(u.reqCtx, metadata); err != nil {
+				logger.Warn("Failed to update object access",
+					zap.String("id", u.id),
 					zap.Error(err))
-				return
 			}
+		}
+	}
 
-			webpURL = getPublicURL(webpKey, ctx.cfg)
-			webpSize = int64(len(webpData))
-			logger.Info("WebP conversion completed",
-				zap.String("key", webpKey),
-				zap.String("url", webpURL),
-				zap.Int64("size", webpSize))
-		}()
+	// An image without metadata cannot be listed, served by ID or deleted, so its objects are
+	// removed when the metadata cannot be saved. Metadata and its indexes are saved at once.
+	endStep := u.pipeline.Start("metadata")
+	err := saveUploadMetadata(u.reqCtx, metadata)
+	endStep(0, err)
+	if err != nil {
+		logger.Error("Failed to save metadata, removing stored objects",
+			zap.String("image_id", u.id),
+			zap.Error(err))
+		u.saga.Rollback(u.reqCtx)
+		return nil, fmt.Errorf("Error saving metadata: %v", err)
+	}
+	u.saga.Commit()
+	logger.Debug("Metadata saved successfully",
+		zap.String("image_id", u.id),
+		zap.String("format", u.format.Format),
+		zap.String("orientation", u.orientation))
+	if err := utils.AddTenantUsage(u.reqCtx, utils.StoredBytes(metadata)); err != nil {
+		logger.Warn("Failed to update tenant usage",
+			zap.String("image_id", u.id),
+			zap.Error(err))
+	}
 
-		// AVIF conversion
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			logger.Debug("Starting AVIF conversion",
-				zap.String("filename", fileHeader.Filename))
+	if utils.IsRedisMetadataStore() {
+		if err := utils.SavePipelineLog(u.reqCtx, u.pipeline); err != nil {
+			logger.Warn("Failed to save processing log",
+				zap.String("image_id", u.id),
+				zap.Error(err))
+		}
+	}
+	return metadata, nil
+}
+
+// result queues the conversion of an async upload, starts the background indexing of the
+// saved image and reports the URLs it is served at
+func (u *imageUpload) result(metadata *utils.ImageMetadata) UploadResult {
+	message := "File uploaded and converted successfully"
+	var jobID string
+	if u.queueConversion {
+		job, err := utils.Conversions.Enqueue(u.reqCtx, u.id, false)
+		if err != nil {
+			// The image stays served as the original until it is repaired
+			logger.Error("Failed to queue conversion",
+				zap.String("image_id", u.id),
+				zap.Error(err))
+			message = "File uploaded, conversion could not be queued"
+		} else {
+			jobID = job.ID
+			message = "File uploaded, conversion queued"
+		}
+	}
 
-			avifData, err := utils.ConvertToAVIFWithBimg(data, ctx.cfg)
-			if err != nil {
-				logger.Error("AVIF conversion failed",
-					zap.String("filename", fileHeader.Filename),
+	// Embeddings come from an external service; compute them without delaying the response
+	if utils.SemanticSearchEnabled() {
+		go func() {
+			if err := utils.IndexImageEmbedding(context.WithoutCancel(u.reqCtx), u.id, u.data); err != nil {
+				logger.Warn("Failed to compute image embedding",
+					zap.String("image_id", u.id),
 					zap.Error(err))
-				return
 			}
+		}()
+	}
 
-			avifKey := filepath.Join(orientation, "avif", filename+".avif")
-			if err := utils.Storage.Store(ctx.r.Context(), avifKey, avifData); err != nil {
-				logger.Error("Failed to store AVIF image",
-					zap.String("key", avifKey),
+	// OCR is slow; extract text in the background as well
+	if utils.OCREnabled() {
+		go func() {
+			if err := utils.ExtractAndStoreText(context.WithoutCancel(u.reqCtx), u.id, u.data); err != nil {
+				logger.Warn("Failed to extract image text",
+					zap.String("image_id", u.id),
 					zap.Error(err))
-				return
 			}
-
-			avifURL = getPublicURL(avifKey, ctx.cfg)
-			avifSize = int64(len(avifData))
-			logger.Info("AVIF conversion completed",
-				zap.String("key", avifKey),
-				zap.String("url", avifURL),
-				zap.Int64("size", avifSize))
 		}()
-
-		wg.Wait()
-	} else {
-		logger.Info("Skipping conversions for GIF image",
-			zap.String("filename", fileHeader.Filename))
-		// For GIF, all formats use the same file
-		webpSize = originalSize
-		avifSize = originalSize
 	}
 
-	// Get URL for original image
-	originalURL := getPublicURL(originalKey, ctx.cfg)
-
-	// Set WebP and AVIF URLs with defaults if conversion failed
+	// WebP and AVIF URLs fall back to the original when their conversion failed
+	originalURL := getPublicURL(u.reqCtx, u.originalKey, u.ctx.cfg)
+	webpURL, avifURL := u.webp.url, u.avif.url
 	if webpURL == "" {
-		logger.Debug("Using original URL for WebP",
-			zap.String("filename", fileHeader.Filename))
+		conversionLog.Debug("Using original URL for WebP",
+			zap.String("filename", u.name))
 		webpURL = originalURL
 	}
 	if avifURL == "" {
-		logger.Debug("Using original URL for AVIF",
-			zap.String("filename", fileHeader.Filename))
+		conversionLog.Debug("Using original URL for AVIF",
+			zap.String("filename", u.name))
 		avifURL = originalURL
 	}
+	urls := map[string]string{
+		"original": originalURL,
+		"webp":     webpURL,
+		"avif":     avifURL,
+	}
+	for size, key := range u.thumbnailKeys {
+		urls[utils.ThumbnailSizeKey(size)] = getPublicURL(u.reqCtx, key, u.ctx.cfg)
+	}
+	if u.video != nil {
+		urls["video"] = getPublicURL(u.reqCtx, u.videoKey, u.ctx.cfg)
+	}
 
-	var expiryTimeStr string
-	if !ctx.expiryTime.IsZero() {
-		expiryTimeStr = ctx.expiryTime.Format(time.RFC3339)
+	var expiryTime string
+	if !metadata.ExpiryTime.IsZero() {
+		expiryTime = metadata.ExpiryTime.Format(time.RFC3339)
 	}
+	return UploadResult{
+		ID:           u.id,
+		Filename:     u.name,
+		Status:       "success",
+		Message:      message,
+		Orientation:  u.orientation,
+		Format:       u.format.Format,
+		SourceFormat: u.sourceFormat,
+		ExpiryTime:   expiryTime,
+		Tags:         metadata.Tags,
+		Profile:      u.profile.Name,
+		URLs:         urls,
+		Paths:        objectPaths(metadata),
+		Sizes:        metadata.Sizes,
+		JobID:        jobID,
+	}
+}
 
-	metadata := &utils.ImageMetadata{
-		ID:           imageID,
-		OriginalName: fileHeader.Filename,
-		UploadTime:   time.Now(),
-		Format:       imgFormat.Format,
-		Orientation:  orientation,
-		Tags:         ctx.tags,
-		Sizes:        make(map[string]int64),
+// normalizeImage converts a HEIC/HEIF photo to JPEG, rotates a photo upright by its EXIF
+// orientation and strips its private metadata when STRIP_EXIF is set, before anything is
+// stored or derived from it
+func normalizeImage(ctx context.Context, cfg *config.Config, pipeline *utils.PipelineLog, data []byte, animated bool) ([]byte, error) {
+	if utils.HEIFFormat(data) != "" {
+		endStep := pipeline.Start("heif_convert")
+		converted, err := utils.ConvertHEIF(ctx, data)
+		endStep(int64(len(converted)), err)
+		if err != nil {
+			return nil, fmt.Errorf("Error converting HEIC/HEIF image: %v", err)
+		}
+		data = converted
 	}
 
-	if !ctx.expiryTime.IsZero() {
-		metadata.ExpiryTime = ctx.expiryTime
+	if !animated && utils.EXIFOrientation(data) > 1 {
+		endStep := pipeline.Start("auto_rotate")
+		rotated, err := utils.AutoRotate(ctx, data)
+		endStep(int64(len(rotated)), err)
+		if err != nil {
+			return nil, fmt.Errorf("Error rotating image: %v", err)
+		}
+		data = rotated
 	}
 
-	// Set paths
-	metadata.Paths.Original = originalKey
-	if webpURL != originalURL {
-		metadata.Paths.WebP = filepath.Join(orientation, "webp", imageID+".webp")
+	if cfg.StripEXIF {
+		endStep := pipeline.Start("strip_exif")
+		stripped, err := utils.StripEXIF(data, true)
+		endStep(int64(len(stripped)), err)
+		if err != nil {
+			return nil, fmt.Errorf("Error stripping image metadata: %v", err)
+		}
+		data = stripped
 	}
-	if avifURL != originalURL {
-		metadata.Paths.AVIF = filepath.Join(orientation, "avif", imageID+".avif")
+	return data, nil
+}
+
+// storeSpooled streams a spooled upload to storage as a step of the upload's saga
+func storeSpooled(ctx context.Context, saga *utils.Saga, key string, spooled *spooledUpload) error {
+	file, err := os.Open(spooled.path)
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %v", err)
 	}
+	defer file.Close()
+	return saga.StoreObjectStream(ctx, key, file, spooled.size)
+}
 
-	// Set file sizes - always store the actual sizes
-	metadata.Sizes["original"] = originalSize
-	if webpSize > 0 {
-		metadata.Sizes["webp"] = webpSize
-	} else {
-		// If WebP conversion failed, use original size as fallback
-		metadata.Sizes["webp"] = originalSize
+// sameBytes reports whether two slices are the same bytes in memory, not just equal ones
+func sameBytes(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// dedupeMatches reports whether an upload may be answered with an existing identical image.
+// Neither may expire and both must have the same visibility, so the upload is never served
+// to other clients or removed earlier than requested; otherwise it is stored as a copy.
+func dedupeMatches(ctx *uploadContext, existing *utils.ImageMetadata) bool {
+	return ctx.expiryTime.IsZero() && existing.ExpiryTime.IsZero() &&
+		existing.EffectiveVisibility() == ctx.visibility
+}
+
+// duplicateUploadResult reports an existing image identical to an upload, with the URLs it is
+// served at. The tags of the upload are added to those of the image; failing to save them only
+// leaves them out.
+func duplicateUploadResult(ctx *uploadContext, name string, metadata *utils.ImageMetadata) UploadResult {
+	if tags := mergeTags(metadata.Tags, ctx.tags); len(tags) > len(metadata.Tags) {
+		updated := *metadata
+		updated.Tags = tags
+		if err := saveUploadMetadata(ctx.reqCtx, &updated); err != nil {
+			logger.Warn("Failed to add tags to identical image",
+				zap.String("image_id", metadata.ID),
+				zap.Error(err))
+		} else {
+			metadata = &updated
+		}
 	}
-	if avifSize > 0 {
-		metadata.Sizes["avif"] = avifSize
-	} else {
-		// If AVIF conversion failed, use original size as fallback
-		metadata.Sizes["avif"] = originalSize
+
+	originalURL := getPublicURL(ctx.reqCtx, metadata.Paths.Original, ctx.cfg)
+	urls := map[string]string{
+		"original": originalURL,
+		"webp":     originalURL,
+		"avif":     originalURL,
+	}
+	if metadata.Paths.WebP != "" {
+		urls["webp"] = getPublicURL(ctx.reqCtx, metadata.Paths.WebP, ctx.cfg)
+	}
+	if metadata.Paths.AVIF != "" {
+		urls["avif"] = getPublicURL(ctx.reqCtx, metadata.Paths.AVIF, ctx.cfg)
+	}
+	for size, key := range metadata.Paths.Thumbnails {
+		urls[utils.ThumbnailSizeKey(size)] = getPublicURL(ctx.reqCtx, key, ctx.cfg)
+	}
+	if metadata.Paths.Video != "" {
+		urls["video"] = getPublicURL(ctx.reqCtx, metadata.Paths.Video, ctx.cfg)
 	}
 
-	if err := utils.MetadataManager.SaveMetadata(ctx.r.Context(), metadata); err != nil {
-		logger.Warn("Failed to save metadata",
-			zap.String("image_id", imageID),
+	var expiryTime string
+	if !metadata.ExpiryTime.IsZero() {
+		expiryTime = metadata.ExpiryTime.Format(time.RFC3339)
+	}
+	return UploadResult{
+		ID:           metadata.ID,
+		Filename:     name,
+		Status:       "success",
+		Message:      "Identical image already uploaded",
+		Orientation:  metadata.Orientation,
+		Format:       metadata.Format,
+		SourceFormat: metadata.SourceFormat,
+		URLs:         urls,
+		Paths:        objectPaths(metadata),
+		Sizes:        metadata.Sizes,
+		ExpiryTime:   expiryTime,
+		Tags:         metadata.Tags,
+		Profile:      metadata.Profile,
+		Duplicate:    true,
+	}
+}
+
+// mergeTags returns the tags followed by the added ones they do not contain yet
+func mergeTags(tags, added []string) []string {
+	merged := slices.Clip(tags)
+	for _, tag := range added {
+		if !slices.Contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// objectPaths returns the storage keys of an image's objects by the names of its URLs; formats
+// served as the original have none
+func objectPaths(metadata *utils.ImageMetadata) map[string]string {
+	paths := map[string]string{"original": metadata.Paths.Original}
+	if metadata.Paths.WebP != "" {
+		paths["webp"] = metadata.Paths.WebP
+	}
+	if metadata.Paths.AVIF != "" {
+		paths["avif"] = metadata.Paths.AVIF
+	}
+	for size, key := range metadata.Paths.Thumbnails {
+		paths[utils.ThumbnailSizeKey(size)] = key
+	}
+	if metadata.Paths.Video != "" {
+		paths["video"] = metadata.Paths.Video
+	}
+	return paths
+}
+
+// versionUploadResults leaves out the fields of upload results that clients written against
+// an older API version do not expect
+func versionUploadResults(r *http.Request, results []UploadResult) []UploadResult {
+	if requestAPIVersion(r) < apiVersionUploadObjects {
+		for i := range results {
+			results[i].Paths, results[i].Sizes = nil, nil
+		}
+	}
+	return results
+}
+
+// metadataSaveAttempts is how often saving the metadata of an upload is tried before its
+// stored objects are removed, riding out brief metadata store outages
+const metadataSaveAttempts = 3
+
+// saveUploadMetadata saves the metadata of an upload, retrying with a short backoff
+func saveUploadMetadata(ctx context.Context, metadata *utils.ImageMetadata) error {
+	var err error
+	for attempt := 1; attempt <= metadataSaveAttempts; attempt++ {
+		if err = utils.MetadataManager.SaveMetadata(ctx, metadata); err == nil {
+			return nil
+		}
+		logger.Warn("Metadata save attempt failed",
+			zap.String("image_id", metadata.ID),
+			zap.Int("attempt", attempt),
 			zap.Error(err))
-	} else {
-		logger.Debug("Metadata saved successfully",
-			zap.String("image_id", imageID),
-			zap.String("format", imgFormat.Format),
-			zap.String("orientation", orientation))
+		if attempt < metadataSaveAttempts {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+			}
+		}
 	}
+	return err
+}
 
-	return UploadResult{
-		Filename:    fileHeader.Filename,
-		Status:      "success",
-		Message:     "File uploaded and converted successfully",
-		Orientation: orientation,
-		Format:      imgFormat.Format,
-		ExpiryTime:  expiryTimeStr,
-		Tags:        ctx.tags,
-		URLs: map[string]string{
-			"original": originalURL,
-			"webp":     webpURL,
-			"avif":     avifURL,
-		},
+// selectProfile picks the processing profile of an upload: an explicitly requested profile,
+// then the screenshot profile (requested or detected), then the first profile matching the
+// upload's tags, then the default profile
+func selectProfile(ctx *uploadContext, format string, img image.Config) *utils.ProcessingProfile {
+	if ctx.profile != nil {
+		return ctx.profile
+	}
+
+	screenshot := ctx.screenshot == "true" ||
+		(ctx.screenshot == "" && ctx.cfg.ScreenshotDetection && utils.IsLikelyScreenshot(format, img.Width, img.Height))
+	if screenshot {
+		profile, _ := utils.GetProcessingProfile(ctx.cfg, utils.ProfileScreenshot)
+		return profile
+	}
+
+	if profile := utils.ProfileForTags(ctx.tags); profile != nil {
+		return profile
 	}
+
+	profile, _ := utils.GetProcessingProfile(ctx.cfg, utils.ProfileDefault)
+	return profile
 }
 
+// maxExpiryMinutes bounds the expiry of an upload to 100 years, keeping the expiry time
+// representable
+const maxExpiryMinutes = 100 * 365 * 24 * 60
+
 type uploadContext struct {
-	r          *http.Request
+	reqCtx     context.Context
 	expiryTime time.Time
+	expirySet  bool                     // Whether expiryMinutes was sent; profile expiry defaults apply otherwise
+	screenshot string                   // "true" forces the screenshot profile, "false" disables detection
+	dedupe     string                   // "true" returns an identical stored image, "false" always stores a copy, "" follows DEDUPE_UPLOADS
+	async      bool                     // Whether WebP/AVIF conversion is queued instead of awaited
+	profile    *utils.ProcessingProfile // Explicitly requested profile, nil to select automatically
+	watermark  *utils.Watermark         // Watermark settings of the upload, applied over those of the profile
 	tags       []string
+	visibility utils.Visibility
 	cfg        *config.Config
 }
 
@@ -317,10 +1188,9 @@ func UploadHandler(cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		// Parse multipart form with default max upload size (32MB)
-		if err := r.ParseMultipartForm(32 << 20); err != nil {
-			logger.Error("解析表单失败", zap.Error(err))
-			errors.HandleError(w, errors.ErrInvalidParam, "解析表单失败", nil)
+		// Parse multipart form, spooling the files to disk
+		if errResp := parseUploadForm(w, r, cfg, "解析表单失败"); errResp != nil {
+			errors.WriteError(w, errResp)
 			return
 		}
 
@@ -339,71 +1209,33 @@ func UploadHandler(cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		// Get expiry time parameter (in minutes)
-		expiryMinutes := 0 // Default: never expire
-		if expiryParam := r.FormValue("expiryMinutes"); expiryParam != "" {
-			if minutes, err := strconv.Atoi(expiryParam); err == nil && minutes >= 0 {
-				expiryMinutes = minutes
-			} else {
-				logger.Warn("无效的过期时间参数",
-					zap.String("expiry_minutes", expiryParam),
-					zap.Int("default_value", expiryMinutes))
-			}
-		}
-
-		// Calculate expiry time
-		var expiryTime time.Time
-		if expiryMinutes > 0 {
-			expiryTime = time.Now().Add(time.Duration(expiryMinutes) * time.Minute)
-			logger.Debug("设置图片过期时间",
-				zap.Time("expiry_time", expiryTime),
-				zap.Int("expiry_minutes", expiryMinutes))
+		// Reject files beyond MAX_FILE_SIZE or MAX_MEGAPIXELS before any is processed
+		if errResp := checkUploadLimits(cfg, files); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
 		}
 
-		// Get tags parameter
-		var tags []string
-		if tagsParam := r.FormValue("tags"); tagsParam != "" {
-			// Split by comma and trim spaces
-			for _, tag := range strings.Split(tagsParam, ",") {
-				trimmedTag := strings.TrimSpace(tag)
-				if trimmedTag != "" {
-					tags = append(tags, trimmedTag)
-				}
-			}
-			logger.Debug("图片标签", zap.Strings("tags", tags))
+		// Enforce the tenant's quotas (derived formats are counted once stored)
+		var uploadBytes int64
+		for _, fh := range files {
+			uploadBytes += fh.Size
 		}
-
-		ctx := &uploadContext{
-			r:          r,
-			expiryTime: expiryTime,
-			tags:       tags,
-			cfg:        cfg,
+		if err := utils.CheckTenantQuota(r.Context(), int64(len(files)), uploadBytes); err != nil {
+			errors.HandleError(w, errors.ErrForbidden, "超出租户配额", err.Error())
+			return
 		}
 
-		// Process images concurrently
-		resultsChan := make(chan UploadResult, len(files))
-		var wg sync.WaitGroup
-
-		for _, fileHeader := range files {
-			wg.Add(1)
-			go func(fh *multipart.FileHeader) {
-				defer wg.Done()
-				result := processImage(ctx, fh)
-				resultsChan <- result
-			}(fileHeader)
+		ctx, errResp := parseUploadOptions(r, cfg)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
 		}
 
-		// Start a goroutine to close results channel after all processing is done
-		go func() {
-			wg.Wait()
-			close(resultsChan)
-		}()
-
-		// Collect results
-		results := make([]UploadResult, 0, len(files))
-		for result := range resultsChan {
-			results = append(results, result)
+		// Reject the upload with 503 when this instance has too many files queued
+		if !admitUploads(w, len(files)) {
+			return
 		}
+		results := versionUploadResults(r, processImages(ctx, files))
 
 		// Return JSON response
 		w.Header().Set("Content-Type", "application/json")
@@ -417,3 +1249,129 @@ func UploadHandler(cfg *config.Config) http.HandlerFunc {
 		}
 	}
 }
+
+// processImages processes the admitted files of an upload concurrently through the upload
+// queue and returns their results in order
+func processImages(ctx *uploadContext, files []*multipart.FileHeader) []UploadResult {
+	names := make([]string, len(files))
+	for i, fh := range files {
+		names[i] = fh.Filename
+	}
+	return processQueued(ctx, names, func(i int) UploadResult {
+		return processImage(ctx, files[i])
+	})
+}
+
+// parseUploadOptions reads the expiry, tags, visibility and processing profile of an upload
+// from its form values
+func parseUploadOptions(r *http.Request, cfg *config.Config) (*uploadContext, *errors.ErrorResponse) {
+	var v paramValidator
+
+	// Get expiry time parameter (in minutes), 0 (the default) never expires
+	expirySet := r.FormValue("expiryMinutes") != ""
+	expiryMinutes := v.Int("expiryMinutes", r.FormValue("expiryMinutes"), 0, 0, maxExpiryMinutes)
+
+	// Calculate expiry time
+	var expiryTime time.Time
+	if expiryMinutes > 0 {
+		expiryTime = time.Now().Add(time.Duration(expiryMinutes) * time.Minute)
+		logger.Debug("设置图片过期时间",
+			zap.Time("expiry_time", expiryTime),
+			zap.Int("expiry_minutes", expiryMinutes))
+	}
+
+	// Get tags parameter
+	tags := v.Tags("tags", r.FormValue("tags"))
+	if errResp := v.Err(); errResp != nil {
+		return nil, errResp
+	}
+	if len(tags) > 0 {
+		logger.Debug("图片标签", zap.Strings("tags", tags))
+	}
+
+	// Get visibility parameter, falling back to the configured default
+	visibility, err := utils.ParseVisibility(cfg.DefaultVisibility)
+	if err != nil {
+		visibility = utils.VisibilityPublic
+	}
+	if visibilityParam := r.FormValue("visibility"); visibilityParam != "" {
+		v, err := utils.ParseVisibility(visibilityParam)
+		if err != nil {
+			return nil, errors.NewError(errors.ErrInvalidParam, "无效的可见性参数", visibilityParam)
+		}
+		visibility = v
+	} else if r.FormValue("public") == "true" {
+		visibility = utils.VisibilityPublic
+	}
+
+	// Get processing profile parameter
+	var profile *utils.ProcessingProfile
+	if profileParam := r.FormValue("profile"); profileParam != "" {
+		p, ok := utils.GetProcessingProfile(cfg, profileParam)
+		if !ok {
+			return nil, errors.NewError(errors.ErrInvalidParam, "未知的处理配置", profileParam)
+		}
+		profile = p
+	}
+
+	watermark, errResp := parseUploadWatermark(r)
+	if errResp != nil {
+		return nil, errResp
+	}
+
+	// Queued conversions apply the watermark of the profile, so custom watermarks need a
+	// synchronous upload
+	async := r.FormValue("async") == "true"
+	if async && utils.Conversions == nil {
+		return nil, errors.NewError(errors.ErrInvalidParam, "异步上传需要 Redis 元数据存储", nil)
+	}
+	if async && watermark != nil && !watermark.Disabled {
+		return nil, errors.NewError(errors.ErrInvalidParam, "异步上传不支持自定义水印", nil)
+	}
+
+	return &uploadContext{
+		reqCtx:     r.Context(),
+		expiryTime: expiryTime,
+		expirySet:  expirySet,
+		screenshot: r.FormValue("screenshot"),
+		dedupe:     r.FormValue("dedupe"),
+		async:      async,
+		profile:    profile,
+		watermark:  watermark,
+		tags:       tags,
+		visibility: visibility,
+		cfg:        cfg,
+	}, nil
+}
+
+// parseUploadWatermark reads the watermark settings of an upload: watermark=false turns the
+// watermark off, watermarkText, watermarkPosition, watermarkOpacity and watermarkSize replace
+// those of the profile. Watermark images can only be configured on the server.
+func parseUploadWatermark(r *http.Request) (*utils.Watermark, *errors.ErrorResponse) {
+	if r.FormValue("watermark") == "false" {
+		return &utils.Watermark{Disabled: true}, nil
+	}
+
+	watermark := &utils.Watermark{
+		Text:     strings.TrimSpace(r.FormValue("watermarkText")),
+		Position: r.FormValue("watermarkPosition"),
+	}
+	for field, value := range map[string]*float64{"watermarkOpacity": &watermark.Opacity, "watermarkSize": &watermark.Size} {
+		param := r.FormValue(field)
+		if param == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return nil, errors.NewError(errors.ErrInvalidParam, "无效的水印参数", field+"="+param)
+		}
+		*value = v
+	}
+	if *watermark == (utils.Watermark{}) {
+		return nil, nil
+	}
+	if err := watermark.Validate(); err != nil {
+		return nil, errors.NewError(errors.ErrInvalidParam, "无效的水印参数", err.Error())
+	}
+	return watermark, nil
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"image"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// uploadRetryAfter is the Retry-After of uploads rejected as the upload queue is full, in seconds
+const uploadRetryAfter = 5
+
+// uploadFormMemory is the part of a multipart upload kept in memory while it is parsed; the
+// files beyond it are spooled to temporary files, so videos are never read into memory whole
+const uploadFormMemory = 1 << 20
+
+// parseUploadForm parses a multipart upload, spooling its files to disk. With MAX_FILE_SIZE the
+// body is bounded to MAX_UPLOAD_COUNT files of that size, so an oversized request is cut off
+// while it is read and answered with a 413; other parse errors are reported with message.
+func parseUploadForm(w http.ResponseWriter, r *http.Request, cfg *config.Config, message string) *errors.ErrorResponse {
+	if cfg.MaxFileSize > 0 && cfg.MaxUploadCount > 0 {
+		// The slack covers the form fields and part headers
+		limit := int64(cfg.MaxUploadCount)*(int64(cfg.MaxFileSize)<<20) + uploadFormMemory
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	if err := r.ParseMultipartForm(uploadFormMemory); err != nil {
+		if tooLarge, ok := err.(*http.MaxBytesError); ok {
+			return errors.NewError(errors.ErrTooLarge,
+				fmt.Sprintf("Upload is larger than %dMB", tooLarge.Limit>>20), nil)
+		}
+		return errors.NewError(errors.ErrInvalidParam, message, err.Error())
+	}
+	return nil
+}
+
+// admitUploads reserves places in the upload queue for the files of a request, answering 503
+// with the load of the queue and a Retry-After header when it is full
+func admitUploads(w http.ResponseWriter, files int) bool {
+	if utils.Uploads.Admit(files) {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfter))
+	errors.WriteError(w, errors.NewError(errors.ErrUnavailable,
+		"Server is busy processing uploads, retry later", utils.Uploads.Stats()))
+	return false
+}
+
+// processQueued processes the files of an upload whose places in the upload queue are reserved,
+// each once it holds a slot, and returns their results in order. A request runs at most
+// MAX_CONCURRENT_UPLOADS goroutines, however many files it has.
+func processQueued(ctx *uploadContext, names []string, process func(i int) UploadResult) []UploadResult {
+	results := make([]UploadResult, len(names))
+	workers := len(names)
+	if limit := ctx.cfg.MaxConcurrentUploads; limit > 0 && limit < workers {
+		workers = limit
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				release, err := utils.Uploads.Acquire(ctx.reqCtx)
+				if err != nil {
+					results[i] = UploadResult{
+						Filename: names[i],
+						Status:   "error",
+						Message:  fmt.Sprintf("Upload canceled while queued: %v", err),
+					}
+					continue
+				}
+				results[i] = process(i)
+				release()
+			}
+		}()
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// processReserved processes a file accepted already (completed resumable uploads, synced and
+// ingested objects) once it holds a slot of the upload queue, waiting however full it is
+func processReserved(ctx *uploadContext, name string, process func() UploadResult) UploadResult {
+	utils.Uploads.Reserve(1)
+	return processQueued(ctx, []string{name}, func(int) UploadResult {
+		return process()
+	})[0]
+}
+
+// Reasons a file is rejected by the upload limits
+const (
+	LimitFileSize   = "file_size"  // Larger than MAX_FILE_SIZE
+	LimitMegapixels = "megapixels" // More pixels than MAX_MEGAPIXELS
+)
+
+// RejectedFile describes a file rejected by MAX_FILE_SIZE or MAX_MEGAPIXELS, listed in the
+// details of the 413 response
+type RejectedFile struct {
+	Filename      string `json:"filename"`
+	Reason        string `json:"reason"` // file_size or megapixels
+	Message       string `json:"message"`
+	Size          int64  `json:"size,omitempty"`          // Size of the file in bytes
+	MaxSize       int64  `json:"maxSize,omitempty"`       // MAX_FILE_SIZE in bytes
+	Width         int    `json:"width,omitempty"`         // Width of the image in pixels
+	Height        int    `json:"height,omitempty"`        // Height of the image in pixels
+	MaxMegapixels int    `json:"maxMegapixels,omitempty"` // MAX_MEGAPIXELS
+}
+
+// checkUploadLimits rejects the files of a multipart upload larger than MAX_FILE_SIZE or with
+// more pixels than MAX_MEGAPIXELS, listing every rejected file. Pixels are read from the image
+// headers; formats whose header Go cannot read (HEIC, SVG, video) are checked once decoded in
+// processImageData.
+func checkUploadLimits(cfg *config.Config, files []*multipart.FileHeader) *errors.ErrorResponse {
+	var rejected []RejectedFile
+	for _, fh := range files {
+		if file := fileSizeLimit(cfg, fh.Filename, fh.Size); file != nil {
+			rejected = append(rejected, *file)
+			continue
+		}
+		if cfg.MaxMegapixels <= 0 {
+			continue
+		}
+		f, err := fh.Open()
+		if err != nil {
+			continue
+		}
+		img, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if file := pixelLimit(cfg, fh.Filename, img.Width, img.Height); file != nil {
+			rejected = append(rejected, *file)
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	return errors.NewError(errors.ErrTooLarge, "Uploaded files exceed the size limits", rejected)
+}
+
+// fileSizeLimit returns the rejection of a file larger than MAX_FILE_SIZE, or nil
+func fileSizeLimit(cfg *config.Config, name string, size int64) *RejectedFile {
+	maxSize := int64(cfg.MaxFileSize) << 20
+	if maxSize <= 0 || size <= maxSize {
+		return nil
+	}
+	return &RejectedFile{
+		Filename: name,
+		Reason:   LimitFileSize,
+		Message:  fmt.Sprintf("File is %.1fMB, at most %dMB are allowed", float64(size)/(1<<20), cfg.MaxFileSize),
+		Size:     size,
+		MaxSize:  maxSize,
+	}
+}
+
+// pixelLimit returns the rejection of an image with more pixels than MAX_MEGAPIXELS, or nil
+func pixelLimit(cfg *config.Config, name string, width, height int) *RejectedFile {
+	if cfg.MaxMegapixels <= 0 || int64(width)*int64(height) <= int64(cfg.MaxMegapixels)*1_000_000 {
+		return nil
+	}
+	return &RejectedFile{
+		Filename:      name,
+		Reason:        LimitMegapixels,
+		Message:       fmt.Sprintf("Image is %dx%d (%.1f megapixels), at most %d megapixels are allowed", width, height, float64(width)*float64(height)/1_000_000, cfg.MaxMegapixels),
+		Width:         width,
+		Height:        height,
+		MaxMegapixels: cfg.MaxMegapixels,
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// processRemoteImage fetches an image from a URL and processes it like an uploaded file
+func processRemoteImage(ctx *uploadContext, rawURL string) UploadResult {
+	remote, err := utils.FetchRemoteImage(ctx.reqCtx, ctx.cfg, rawURL)
+	if err != nil {
+		logger.Warn("Failed to fetch remote image",
+			zap.String("url", rawURL),
+			zap.Error(err))
+		return UploadResult{
+			Filename: rawURL,
+			Status:   "error",
+			Message:  fmt.Sprintf("Error fetching image: %v", err),
+		}
+	}
+
+	// Quotas were checked for the image count up front; sizes are only known once fetched
+	if err := utils.CheckTenantQuota(ctx.reqCtx, 1, int64(len(remote.Data))); err != nil {
+		return UploadResult{
+			Filename: remote.Name,
+			Status:   "error",
+			Message:  err.Error(),
+		}
+	}
+
+	return processImageData(ctx, remote.Name, remote.Data)
+}
+
+// UploadURLHandler imports images from remote URLs at POST /api/upload-url. URLs are sent as
+// urls[] form fields (or one per line in urls) and accept the same options as /api/upload.
+func UploadURLHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "方法不允许", nil)
+			return
+		}
+
+		// Both URL-encoded and multipart forms are accepted
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			logger.Error("解析表单失败", zap.Error(err))
+			errors.HandleError(w, errors.ErrInvalidParam, "解析表单失败", nil)
+			return
+		}
+
+		var urls []string
+		for _, value := range append(r.Form["urls[]"], strings.Split(r.FormValue("urls"), "\n")...) {
+			if u := strings.TrimSpace(value); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			errors.HandleError(w, errors.ErrInvalidParam, "未提供图片 URL", nil)
+			return
+		}
+		if len(urls) > cfg.MaxUploadCount {
+			errors.HandleError(w, errors.ErrInvalidParam,
+				fmt.Sprintf("上传文件数量超过限制，最多允许上传 %d 个文件", cfg.MaxUploadCount),
+				nil)
+			return
+		}
+		if err := utils.CheckTenantQuota(r.Context(), int64(len(urls)), 0); err != nil {
+			errors.HandleError(w, errors.ErrForbidden, "超出租户配额", err.Error())
+			return
+		}
+
+		ctx, errResp := parseUploadOptions(r, cfg)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		// Fetch and process images concurrently through the upload queue, keeping the order of
+		// the URLs
+		if !admitUploads(w, len(urls)) {
+			return
+		}
+		results := versionUploadResults(r, processQueued(ctx, urls, func(i int) UploadResult {
+			return processRemoteImage(ctx, urls[i])
+		}))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": results,
+		}); err != nil {
+			logger.Error("编码响应失败", zap.Error(err))
+		}
+	}
+}
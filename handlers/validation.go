@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// maxTagLength bounds the length of a tag, in characters
+const maxTagLength = 50
+
+// paramValidator checks request parameters, collecting an error for every invalid one instead
+// of substituting defaults, so clients learn about all their mistakes at once. Missing
+// parameters get their default.
+type paramValidator struct {
+	fields []errors.FieldError
+}
+
+func (v *paramValidator) reject(field, value, format string, args ...interface{}) {
+	v.fields = append(v.fields, errors.FieldError{Field: field, Message: fmt.Sprintf(format, args...), Value: value})
+}
+
+// Int parses an integer between lo and hi
+func (v *paramValidator) Int(field, value string, def, lo, hi int) int {
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		v.reject(field, value, "must be an integer between %d and %d", lo, hi)
+		return def
+	}
+	return n
+}
+
+// Int64 parses an integer of at least lo
+func (v *paramValidator) Int64(field, value string, def, lo int64) int64 {
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < lo {
+		v.reject(field, value, "must be an integer of at least %d", lo)
+		return def
+	}
+	return n
+}
+
+// Enum accepts one of the allowed values, case-insensitively, returning it as spelled in allowed
+func (v *paramValidator) Enum(field, value, def string, allowed ...string) string {
+	if value == "" {
+		return def
+	}
+	i := slices.IndexFunc(allowed, func(a string) bool {
+		return strings.EqualFold(a, value)
+	})
+	if i < 0 {
+		v.reject(field, value, "must be one of %s", strings.Join(allowed, ", "))
+		return def
+	}
+	return allowed[i]
+}
+
+// Time parses an RFC 3339 timestamp or a YYYY-MM-DD date, taken as midnight UTC
+func (v *paramValidator) Time(field, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	v.reject(field, value, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return time.Time{}
+}
+
+// Tag accepts a single tag
+func (v *paramValidator) Tag(field, value string) string {
+	value = strings.TrimSpace(value)
+	if value != "" && !validTag(value) {
+		v.reject(field, value, "tags may only contain letters, digits, spaces, '-', '_', '.' and ':', up to %d characters", maxTagLength)
+		return ""
+	}
+	return value
+}
+
+// Tags accepts a comma-separated list of tags, ignoring empty entries
+func (v *paramValidator) Tags(field, value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = v.Tag(field, tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Err returns the validation error listing every rejected parameter, or nil when all are valid
+func (v *paramValidator) Err() *errors.ErrorResponse {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return errors.NewValidationError(v.fields)
+}
+
+// validTag reports whether a tag is made of letters (any script), digits, spaces and '-', '_',
+// '.', ':' only. Commas separate tags and control characters would corrupt the tag index.
+func validTag(tag string) bool {
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return false
+	}
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !unicode.IsMark(c) && c != ' ' && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+)
+
+// apiVersionHeader is the request header clients send the API version they are written
+// against, and the response header reporting the version served. Requests to unversioned
+// paths without it get version 1.
+const apiVersionHeader = "X-API-Version"
+
+// latestAPIVersion is the newest version served under /api/v{N}/
+const latestAPIVersion = 2
+
+// Versions whose responses differ from the version before
+const (
+	apiVersionUploadObjects = 2 // Upload results include the paths and sizes of the stored objects
+)
+
+// deprecatedAPIVersions holds the versions being phased out with the date (RFC 1123) they stop
+// being served. Their responses carry Deprecation and Sunset headers until then.
+var deprecatedAPIVersions = map[int]string{}
+
+// apiVersionKey is the context key of the version a request's path asked for
+type apiVersionKey struct{}
+
+// APIVersionMiddleware serves /api/v{N}/... as the unversioned /api/... route, so every
+// version shares its handlers and the unversioned paths stay as legacy aliases. The version
+// of the path takes precedence over the X-API-Version header. JSON responses of versioned
+// paths are sent in an errors.Envelope; the legacy aliases keep their original shapes.
+func APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		version, route, versioned := splitAPIVersion(r.URL.Path)
+		if !versioned {
+			setAPIVersionHeaders(w, requestAPIVersion(r))
+			next.ServeHTTP(w, r)
+			return
+		}
+		w, finish := errors.WrapEnvelope(w, errors.RequestID(r))
+		defer finish()
+		if version < 1 || version > latestAPIVersion {
+			errors.HandleError(w, errors.ErrNotFound, "Unsupported API version", version)
+			return
+		}
+
+		r2 := r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = route
+		r2.URL.RawPath = ""
+		setAPIVersionHeaders(w, version)
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// splitAPIVersion splits /api/v{N}/route into N and /api/route
+func splitAPIVersion(path string) (int, string, bool) {
+	segment, route, _ := strings.Cut(strings.TrimPrefix(path, "/api/"), "/")
+	number, ok := strings.CutPrefix(segment, "v")
+	if !ok {
+		return 0, "", false
+	}
+	version, err := strconv.Atoi(number)
+	if err != nil {
+		return 0, "", false
+	}
+	return version, "/api/" + route, true
+}
+
+// setAPIVersionHeaders reports the version a response is served with, and its sunset when
+// the version is deprecated
+func setAPIVersionHeaders(w http.ResponseWriter, version int) {
+	w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+	if sunset, ok := deprecatedAPIVersions[version]; ok {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", sunset)
+		w.Header().Add("Link", fmt.Sprintf(`</api/v%d/>; rel="successor-version"`, latestAPIVersion))
+	}
+}
+
+// requestAPIVersion returns the API version a request is written against: the version of its
+// path, else its X-API-Version header, else 1
+func requestAPIVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	if v, err := strconv.Atoi(r.Header.Get(apiVersionHeader)); err == nil && v > 0 {
+		return min(v, latestAPIVersion)
+	}
+	return 1
+}
+
+// apiPath returns the path of an API route under the version prefix the request used, so links
+// in responses keep clients on the version they asked for
+func apiPath(r *http.Request, route string) string {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return fmt.Sprintf("/api/v%d%s", version, route)
+	}
+	return "/api" + route
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/errors"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Lifetimes of upload widget tokens, which cannot be revoked before they expire
+const (
+	defaultWidgetTokenTTL = 30 * 24 * time.Hour
+	maxWidgetTokenTTL     = 365 * 24 * time.Hour
+)
+
+// WidgetTokenRequest represents the request body for issuing an upload widget token
+type WidgetTokenRequest struct {
+	Origins       []string `json:"origins"`       // Origins of the pages embedding the widget, e.g. https://blog.example.com
+	Tags          []string `json:"tags"`          // Tags of every upload
+	Profile       string   `json:"profile"`       // Processing profile of every upload
+	Visibility    string   `json:"visibility"`    // Visibility of every upload, DEFAULT_VISIBILITY when empty
+	ExpiryMinutes int      `json:"expiryMinutes"` // Expiry of every upload (0 = never)
+	MaxFiles      int      `json:"maxFiles"`      // Files per request, MAX_UPLOAD_COUNT when 0
+	MaxFileSize   int64    `json:"maxFileSize"`   // Bytes per file, unlimited when 0
+	ExpiresIn     string   `json:"expiresIn"`     // Token lifetime, e.g. "720h" (default)
+}
+
+// WidgetTokenHandler issues upload widget tokens at /api/widget/tokens. A token lets the pages
+// of a static site upload through the widget with the settings it was issued with, without the
+// API key. Tokens issued for a tenant upload to that tenant.
+func WidgetTokenHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		var req WidgetTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errors.HandleError(w, errors.ErrInvalidParam, "Invalid request body", nil)
+			return
+		}
+
+		ttl := defaultWidgetTokenTTL
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid expiresIn duration", req.ExpiresIn)
+				return
+			}
+			ttl = d
+		}
+		if ttl > maxWidgetTokenTTL {
+			errors.HandleError(w, errors.ErrInvalidParam, "expiresIn exceeds the longest allowed lifetime", maxWidgetTokenTTL.String())
+			return
+		}
+		if req.ExpiryMinutes < 0 || req.MaxFiles < 0 || req.MaxFileSize < 0 {
+			errors.HandleError(w, errors.ErrInvalidParam, "Limits must not be negative", nil)
+			return
+		}
+
+		token := &utils.WidgetToken{
+			ExpiryMinutes: req.ExpiryMinutes,
+			MaxFiles:      req.MaxFiles,
+			MaxFileSize:   req.MaxFileSize,
+			ExpiresAt:     time.Now().Add(ttl).Unix(),
+		}
+		for _, origin := range req.Origins {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid origin", origin)
+				return
+			}
+			token.Origins = append(token.Origins, strings.ToLower(u.Scheme+"://"+u.Host))
+		}
+		for _, tag := range req.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				token.Tags = append(token.Tags, tag)
+			}
+		}
+		if req.Profile != "" {
+			if _, ok := utils.GetProcessingProfile(cfg, req.Profile); !ok {
+				errors.HandleError(w, errors.ErrInvalidParam, "Unknown processing profile", req.Profile)
+				return
+			}
+			token.Profile = req.Profile
+		}
+		if req.Visibility != "" {
+			visibility, err := utils.ParseVisibility(req.Visibility)
+			if err != nil {
+				errors.HandleError(w, errors.ErrInvalidParam, "Invalid visibility", req.Visibility)
+				return
+			}
+			token.Visibility = visibility
+		}
+		if tenant := utils.TenantFromContext(r.Context()); tenant != nil {
+			token.Tenant = tenant.ID
+		}
+
+		signed, err := utils.SignWidgetToken(cfg, token)
+		if err != nil {
+			errors.HandleError(w, errors.ErrInternal, "Failed to issue widget token", err.Error())
+			return
+		}
+
+		logger.Info("Issued upload widget token",
+			zap.Strings("origins", token.Origins),
+			zap.String("tenant", token.Tenant),
+			zap.Duration("ttl", ttl))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"token":     signed,
+			"expiresAt": time.Unix(token.ExpiresAt, 0).UTC().Format(time.RFC3339),
+			"snippet": fmt.Sprintf("<div data-imageflow-token=\"%s\"></div>\n<script src=\"%s\" async></script>",
+				html.EscapeString(signed), html.EscapeString(absoluteURL(cfg, r, "/api/widget.js"))),
+		})
+	}
+}
+
+// WidgetUploadHandler accepts uploads from the upload widget at /api/widget/upload. Requests
+// carry a widget token in the token form field instead of an API key, and are uploaded with
+// the settings of the token; the form fields of /api/upload other than images[] are ignored.
+// Responses carry absolute URLs, as the widget runs on another site.
+func WidgetUploadHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+
+		if errResp := parseUploadForm(w, r, cfg, "Failed to parse form"); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+
+		token, err := utils.VerifyWidgetToken(cfg, r.FormValue("token"))
+		if err != nil {
+			errors.HandleError(w, errors.ErrUnauthorized, "Invalid widget token", err.Error())
+			return
+		}
+		// Browsers send the origin of the embedding page, which keeps other sites from using the
+		// token; clients outside browsers can set any origin
+		if origin := r.Header.Get("Origin"); !token.AllowsOrigin(origin) {
+			errors.HandleError(w, errors.ErrForbidden, "Origin not allowed for this widget token", origin)
+			return
+		}
+		// Uploads go to the tenant of the token, whichever the Host header or tenant parameter selects
+		var tenant *utils.Tenant
+		if token.Tenant != "" {
+			if tenant, err = utils.GetTenant(r.Context(), token.Tenant); err != nil {
+				errors.HandleError(w, errors.ErrNotFound, "Tenant not found", token.Tenant)
+				return
+			}
+		}
+		r = r.WithContext(utils.WithTenant(r.Context(), tenant))
+
+		files := r.MultipartForm.File["images[]"]
+		if len(files) == 0 {
+			errors.HandleError(w, errors.ErrInvalidParam, "No files uploaded", nil)
+			return
+		}
+		maxFiles := cfg.MaxUploadCount
+		if token.MaxFiles > 0 {
+			maxFiles = min(maxFiles, token.MaxFiles)
+		}
+		if len(files) > maxFiles {
+			errors.HandleError(w, errors.ErrInvalidParam,
+				fmt.Sprintf("Too many files, at most %d are allowed", maxFiles), nil)
+			return
+		}
+		var uploadBytes int64
+		for _, fh := range files {
+			if token.MaxFileSize > 0 && fh.Size > token.MaxFileSize {
+				errors.HandleError(w, errors.ErrInvalidParam,
+					fmt.Sprintf("File too large, at most %d bytes are allowed", token.MaxFileSize), fh.Filename)
+				return
+			}
+			uploadBytes += fh.Size
+		}
+		if errResp := checkUploadLimits(cfg, files); errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		if err := utils.CheckTenantQuota(r.Context(), int64(len(files)), uploadBytes); err != nil {
+			errors.HandleError(w, errors.ErrForbidden, "Tenant quota exceeded", err.Error())
+			return
+		}
+
+		ctx, errResp := widgetUploadContext(r, cfg, token)
+		if errResp != nil {
+			errors.WriteError(w, errResp)
+			return
+		}
+		if !admitUploads(w, len(files)) {
+			return
+		}
+		results := versionUploadResults(r, processImages(ctx, files))
+		for _, result := range results {
+			for format, u := range result.URLs {
+				result.URLs[format] = absoluteURL(cfg, r, u)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": results,
+		})
+	}
+}
+
+// widgetUploadContext returns the upload settings of a widget token
+func widgetUploadContext(r *http.Request, cfg *config.Config, token *utils.WidgetToken) (*uploadContext, *errors.ErrorResponse) {
+	ctx := &uploadContext{
+		reqCtx:     r.Context(),
+		expirySet:  token.ExpiryMinutes > 0,
+		tags:       token.Tags,
+		visibility: token.Visibility,
+		cfg:        cfg,
+	}
+	if token.ExpiryMinutes > 0 {
+		ctx.expiryTime = time.Now().Add(time.Duration(token.ExpiryMinutes) * time.Minute)
+	}
+	if ctx.visibility == "" {
+		visibility, err := utils.ParseVisibility(cfg.DefaultVisibility)
+		if err != nil {
+			visibility = utils.VisibilityPublic
+		}
+		ctx.visibility = visibility
+	}
+	if token.Profile != "" {
+		// The profile may have been removed since the token was issued
+		profile, ok := utils.GetProcessingProfile(cfg, token.Profile)
+		if !ok {
+			return nil, errors.NewError(errors.ErrInvalidParam, "Unknown processing profile", token.Profile)
+		}
+		ctx.profile = profile
+	}
+	return ctx, nil
+}
+
+// WidgetScriptHandler serves the upload widget at /api/widget.js. The script turns every
+// element with a data-imageflow-token attribute into a drop zone uploading to the instance it
+// was loaded from, lists the URLs of the uploaded images and dispatches imageflow:upload events
+// with the results (imageflow:error on failure) from the element.
+func WidgetScriptHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errors.HandleError(w, errors.ErrInvalidParam, "Method not allowed", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte(widgetScript))
+	}
+}
+
+// widgetScript is the upload widget. Elements can set data-label (the text of the drop zone)
+// and data-multiple="false" (one file at a time); ImageFlowWidget.init(element) sets up
+// elements added after the page loaded.
+const widgetScript = `(function () {
+  "use strict";
+  var script = document.currentScript;
+  var base = new URL(script ? script.src : "/", location.href).origin;
+
+  var style = document.createElement("style");
+  style.textContent =
+    ".imageflow-dropzone{border:2px dashed #9ca3af;border-radius:8px;padding:24px;text-align:center;cursor:pointer;color:#4b5563}" +
+    ".imageflow-dropzone.imageflow-dragover{border-color:#3b82f6;background:rgba(59,130,246,.08)}" +
+    ".imageflow-dropzone.imageflow-busy{opacity:.6;pointer-events:none}" +
+    ".imageflow-results{list-style:none;padding:0;margin:8px 0 0}" +
+    ".imageflow-results li{margin:4px 0;word-break:break-all}" +
+    ".imageflow-results .imageflow-error{color:#dc2626}";
+  document.head.appendChild(style);
+
+  function init(el) {
+    if (el.imageflowWidget) return;
+    el.imageflowWidget = true;
+    var token = el.getAttribute("data-imageflow-token");
+
+    var input = document.createElement("input");
+    input.type = "file";
+    input.accept = "image/*";
+    input.multiple = el.getAttribute("data-multiple") !== "false";
+    input.hidden = true;
+    var zone = document.createElement("div");
+    zone.className = "imageflow-dropzone";
+    zone.tabIndex = 0;
+    zone.setAttribute("role", "button");
+    zone.textContent = el.getAttribute("data-label") || "Drop images here or click to upload";
+    var list = document.createElement("ul");
+    list.className = "imageflow-results";
+    el.appendChild(zone);
+    el.appendChild(input);
+    el.appendChild(list);
+
+    function report(text, href, error) {
+      var item = document.createElement("li");
+      if (href) {
+        var link = document.createElement("a");
+        link.href = href;
+        link.target = "_blank";
+        link.rel = "noopener";
+        link.textContent = text;
+        item.appendChild(link);
+      } else {
+        item.textContent = text;
+      }
+      if (error) item.className = "imageflow-error";
+      list.appendChild(item);
+    }
+
+    function emit(name, detail) {
+      el.dispatchEvent(new CustomEvent(name, { detail: detail, bubbles: true }));
+    }
+
+    function upload(files) {
+      if (!files || !files.length) return;
+      var form = new FormData();
+      form.append("token", token);
+      for (var i = 0; i < files.length; i++) form.append("images[]", files[i]);
+      zone.classList.add("imageflow-busy");
+      fetch(base + "/api/widget/upload", { method: "POST", body: form })
+        .then(function (res) {
+          return res.json().then(function (body) {
+            if (!res.ok) throw new Error(body.message || res.statusText);
+            return body.results;
+          });
+        })
+        .then(function (results) {
+          results.forEach(function (result) {
+            if (result.status === "success") {
+              var url = result.urls.webp || result.urls.original;
+              report(url, url, false);
+            } else {
+              report(result.filename + ": " + result.message, null, true);
+            }
+          });
+          emit("imageflow:upload", { results: results });
+        })
+        .catch(function (err) {
+          report(err.message, null, true);
+          emit("imageflow:error", { error: err.message });
+        })
+        .then(function () {
+          zone.classList.remove("imageflow-busy");
+        });
+    }
+
+    zone.addEventListener("click", function () { input.click(); });
+    zone.addEventListener("keydown", function (e) {
+      if (e.key === "Enter" || e.key === " ") {
+        e.preventDefault();
+        input.click();
+      }
+    });
+    zone.addEventListener("dragover", function (e) {
+      e.preventDefault();
+      zone.classList.add("imageflow-dragover");
+    });
+    zone.addEventListener("dragleave", function () { zone.classList.remove("imageflow-dragover"); });
+    zone.addEventListener("drop", function (e) {
+      e.preventDefault();
+      zone.classList.remove("imageflow-dragover");
+      upload(e.dataTransfer.files);
+    });
+    input.addEventListener("change", function () {
+      upload(input.files);
+      input.value = "";
+    });
+  }
+
+  function scan() {
+    var elements = document.querySelectorAll("[data-imageflow-token]");
+    for (var i = 0; i < elements.length; i++) init(elements[i]);
+  }
+
+  window.ImageFlowWidget = { init: init };
+  if (document.readyState === "loading") {
+    document.addEventListener("DOMContentLoaded", scan);
+  } else {
+    scan();
+  }
+})();
+`
@@ -17,6 +17,7 @@ import (
 	"github.com/Yuri-NagaSaki/ImageFlow/handlers"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 )
@@ -58,8 +59,12 @@ func corsMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Set other CORS headers
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, "+
+			"Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, X-API-Version, X-Request-Id, If-None-Match")
+		// Resumable upload clients read the tus headers of responses
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Max-Size, Upload-Offset, Upload-Length, "+
+			"X-Image-Id, X-Image-Tags, X-Image-Format, Link, X-API-Version, Deprecation, Sunset, X-Request-Id, ETag")
 		w.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 
 		// Handle preflight requests
@@ -95,6 +100,11 @@ func main() {
 		logger.Fatal("Failed to initialize logger", zap.Error(err))
 	}
 	defer logger.Log.Sync()
+	// SIGUSR1 toggles debug logging, SIGUSR2 console output
+	logger.WatchSignals()
+
+	// Tracing must be set up before the storage provider and Redis client it instruments
+	tracing.Init(cfg)
 
 	// Initialize libvips for image processing
 	utils.InitVips(cfg)
@@ -117,28 +127,177 @@ func main() {
 	if err := utils.InitMetadataStore(cfg); err != nil {
 		logger.Fatal("Failed to initialize metadata store", zap.Error(err))
 	}
+	if err := utils.LoadProcessingProfiles(cfg); err != nil {
+		logger.Fatal("Failed to load processing profiles", zap.Error(err))
+	}
+	if err := utils.InitFeatureFlags(cfg); err != nil {
+		logger.Fatal("Failed to load feature flags", zap.Error(err))
+	}
+	if err := utils.LoadHooks(cfg); err != nil {
+		logger.Fatal("Failed to load hooks", zap.Error(err))
+	}
+	if err := utils.LoadWasmPlugins(cfg); err != nil {
+		logger.Fatal("Failed to load WASM plugins", zap.Error(err))
+	}
+	if err := utils.InitRoutingScript(cfg); err != nil {
+		logger.Fatal("Failed to load routing script", zap.Error(err))
+	}
+	if err := utils.InitGeoIP(cfg); err != nil {
+		logger.Fatal("Failed to load GeoIP database", zap.Error(err))
+	}
+	if err := utils.InitDeviceRules(cfg); err != nil {
+		logger.Fatal("Failed to load device rules", zap.Error(err))
+	}
+	if err := utils.InitLanguageRules(cfg); err != nil {
+		logger.Fatal("Failed to load language rules", zap.Error(err))
+	}
+	utils.InitEmbeddingClient(cfg)
+	utils.InitOCR(cfg)
+	utils.InitVideo(cfg)
+	utils.InitUploadSessions(cfg)
+	utils.InitUploadQueue(cfg)
+	utils.InitChangeFeed(cfg)
 
 	// Ensure image directories exist
 	ensureDirectories(cfg)
 
-	// Initialize and start image cleaner
-	utils.InitCleaner(cfg)
-	logger.Info("Image cleaner started")
+	// Background tasks write to the shared storage and Redis, so only the primary runs them
+	ingestCtx, stopIngestion := context.WithCancel(context.Background())
+	defer stopIngestion()
+	if cfg.ReadReplica {
+		logger.Info("Running as read replica; uploads, changes and background tasks are disabled")
+	} else {
+		if err := utils.BackfillVisibilityIndex(context.Background()); err != nil {
+			logger.Warn("Failed to backfill visibility index", zap.Error(err))
+		}
+		go func() {
+			if err := utils.BackfillStats(context.Background()); err != nil {
+				logger.Warn("Failed to backfill library statistics", zap.Error(err))
+			}
+		}()
+		go func() {
+			if err := utils.BackfillPerceptualHashes(context.Background()); err != nil {
+				logger.Warn("Failed to backfill perceptual hashes", zap.Error(err))
+			}
+			if err := utils.BackfillEmbeddings(context.Background()); err != nil {
+				logger.Warn("Failed to backfill image embeddings", zap.Error(err))
+			}
+		}()
+
+		// Import images uploaded directly to the bucket
+		if cfg.IngestEnabled() && cfg.IngestSQSQueueURL != "" {
+			if err := handlers.StartSQSIngestion(ingestCtx, cfg); err != nil {
+				logger.Fatal("Failed to start SQS ingestion", zap.Error(err))
+			}
+		}
+
+		// Forward every change to the standby instance or bucket
+		if err := utils.InitReplication(cfg); err != nil {
+			logger.Fatal("Failed to start replication", zap.Error(err))
+		}
+
+		// Convert the variants of async uploads in the background
+		utils.InitConversionQueue(cfg)
+
+		// Move serve counts into the metadata of the images
+		utils.InitServeStats(cfg)
+
+		// Push library changes to the external search engine
+		if err := utils.InitSearchIndex(cfg); err != nil {
+			logger.Fatal("Failed to start search indexing", zap.Error(err))
+		}
+
+		// Mirror remote sources into the library
+		if err := handlers.InitSyncer(cfg); err != nil {
+			logger.Fatal("Failed to load sync sources", zap.Error(err))
+		}
+
+		// Exercise the API periodically, alerting when it fails
+		if err := utils.InitSelfTest(cfg); err != nil {
+			logger.Fatal("Failed to start self-test", zap.Error(err))
+		}
+
+		// Initialize and start image cleaner
+		utils.InitCleaner(cfg)
+		logger.Info("Image cleaner started")
+	}
+
+	// Summarize the dependencies and features of this instance for support requests
+	utils.ReportStartup(context.Background(), cfg)
 
 	// Configure MIME types
 	configureMIMETypes()
 
 	// Create routes
 	http.HandleFunc("/api/validate-api-key", handlers.ValidateAPIKey(cfg))
-	http.HandleFunc("/api/upload", handlers.RequireAPIKey(cfg, handlers.UploadHandler(cfg)))
+	uploadLimiter := handlers.NewAPIRateLimiter(cfg, "upload", cfg.UploadRateLimit, time.Hour)
+	http.HandleFunc("/api/upload", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload,
+		uploadLimiter.Middleware(handlers.UploadHandler(cfg))))
+	http.HandleFunc("/api/upload-url", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload,
+		uploadLimiter.Middleware(handlers.RequireFeature(utils.FeatureUploadURL, handlers.UploadURLHandler(cfg)))))
+	http.HandleFunc("/api/uploads", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload,
+		handlers.RequireFeature(utils.FeatureResumableUploads, handlers.ResumableUploadHandler(cfg))))
+	http.HandleFunc("/api/uploads/{id}", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload,
+		handlers.RequireFeature(utils.FeatureResumableUploads, handlers.UploadSessionHandler(cfg))))
+	// Conversion jobs of async uploads
+	http.HandleFunc("/api/jobs/{id}", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload, handlers.JobHandler(cfg)))
+	// Upload widget for static sites, uploading with signed tokens instead of the API key
+	http.HandleFunc("/api/widget.js", handlers.RequireFeature(utils.FeatureUploadWidget, handlers.WidgetScriptHandler(cfg)))
+	http.HandleFunc("/api/widget/tokens", handlers.RequireAPIKeyScope(cfg, utils.ScopeUpload,
+		handlers.RequireFeature(utils.FeatureUploadWidget, handlers.WidgetTokenHandler(cfg))))
+	http.HandleFunc("/api/widget/upload", uploadLimiter.Middleware(
+		handlers.RequireFeature(utils.FeatureUploadWidget, handlers.WidgetUploadHandler(cfg))))
 	http.HandleFunc("/api/images", handlers.RequireAPIKey(cfg, handlers.ListImagesHandler(cfg)))
 	http.HandleFunc("/api/delete-image", handlers.RequireAPIKey(cfg, handlers.DeleteImageHandler(cfg)))
 	http.HandleFunc("/api/config", handlers.RequireAPIKey(cfg, handlers.ConfigHandler(cfg)))
 	http.HandleFunc("/api/tags", handlers.RequireAPIKey(cfg, handlers.TagsHandler(cfg)))
-	http.HandleFunc("/api/debug/tags", handlers.RequireAPIKey(cfg, handlers.DebugTagsHandler(cfg)))
+	http.HandleFunc("/api/stats", handlers.RequireAPIKey(cfg, handlers.StatsHandler(cfg)))
+	http.HandleFunc("/api/stats/top", handlers.RequireAPIKey(cfg, handlers.TopServedHandler(cfg)))
+	http.HandleFunc("/api/selftest", handlers.RequireAdminKey(cfg, handlers.SelfTestHandler(cfg)))
+	http.HandleFunc("/api/changes", handlers.RequireAPIKey(cfg, handlers.ChangesHandler(cfg)))
+	http.HandleFunc("/api/schedules", handlers.RequireAPIKey(cfg, handlers.SchedulesHandler(cfg)))
+	http.HandleFunc("/api/collections", handlers.RequireAPIKey(cfg, handlers.CollectionsHandler(cfg)))
+	http.HandleFunc("/api/collections/{id}/images", handlers.RequireAPIKey(cfg, handlers.CollectionImagesHandler(cfg)))
+	http.HandleFunc("/api/share", handlers.RequireAPIKey(cfg, handlers.ShareHandler(cfg)))
+	http.HandleFunc("/api/sign", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead, handlers.SignHandler(cfg)))
+	http.HandleFunc("/s/", handlers.ShortLinkHandler(cfg))
+	http.HandleFunc("/api/images/visibility", handlers.RequireAPIKey(cfg, handlers.VisibilityHandler(cfg)))
+	http.HandleFunc("/api/images/{id}", handlers.RequireAPIKey(cfg, handlers.ImageDetailHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/repair", handlers.RequireAPIKey(cfg, handlers.RepairImageHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/reprocess", handlers.RequireAPIKey(cfg, handlers.ReprocessImageHandler(cfg)))
+	http.HandleFunc("/api/images/reprocess", handlers.RequireAPIKey(cfg, handlers.ReprocessLibraryHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/pipeline", handlers.RequireAPIKey(cfg, handlers.ImagePipelineHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/theme", handlers.RequireAPIKey(cfg, handlers.ThemeVariantHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/similar", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead,
+		handlers.RequireFeature(utils.FeatureImageSearch, handlers.SimilarImagesHandler(cfg))))
+	http.HandleFunc("/api/tenants", handlers.RequireAdminKey(cfg, handlers.TenantsHandler(cfg)))
+	http.HandleFunc("/api/features", handlers.RequireAdminKey(cfg, handlers.FeatureFlagsHandler(cfg)))
+	http.HandleFunc("/api/logging", handlers.RequireAdminKey(cfg, handlers.LoggingHandler(cfg)))
+	http.HandleFunc("/api/keys", handlers.RequireAdminKey(cfg, handlers.APIKeysHandler(cfg)))
+	http.HandleFunc("/api/tenant", handlers.RequireAPIKey(cfg, handlers.CurrentTenantHandler(cfg)))
+	http.HandleFunc("/api/search/by-image", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead,
+		handlers.RequireFeature(utils.FeatureImageSearch, handlers.SearchByImageHandler(cfg))))
+	http.HandleFunc("/api/search/semantic", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead, handlers.SemanticSearchHandler(cfg)))
+	http.HandleFunc("/api/search/text", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead, handlers.TextSearchHandler(cfg)))
+	http.HandleFunc("/api/search", handlers.RequireAPIKeyScope(cfg, utils.ScopeRead, handlers.FullTextSearchHandler(cfg)))
+	if cfg.IngestEnabled() {
+		http.HandleFunc("/api/ingest/s3", handlers.S3EventHandler(cfg))
+	}
+	http.HandleFunc("/api/sync", handlers.RequireAdminKey(cfg, handlers.SyncHandler(cfg)))
+
+	// Replication (receiving side and queue status)
+	http.HandleFunc("/api/replication/objects", handlers.RequireAdminKey(cfg, handlers.ReplicationObjectHandler(cfg)))
+	http.HandleFunc("/api/replication/images/{id}", handlers.RequireAdminKey(cfg, handlers.ReplicationImageHandler(cfg)))
+	http.HandleFunc("/api/replication/status", handlers.RequireAdminKey(cfg, handlers.ReplicationStatusHandler(cfg)))
+	http.HandleFunc("/api/replication/retry", handlers.RequireAdminKey(cfg, handlers.ReplicationStatusHandler(cfg)))
+	http.HandleFunc("/v/", handlers.ViewHandler(cfg))
+	http.HandleFunc("/oembed", handlers.OEmbedHandler(cfg))
+	http.HandleFunc("/api/debug/tags", handlers.RequireAdminKey(cfg, handlers.DebugTagsHandler(cfg)))
+	http.HandleFunc("/api/debug/startup", handlers.RequireAdminKey(cfg, handlers.DebugStartupHandler(cfg)))
+	http.HandleFunc("/api/metrics", handlers.RequireAdminKey(cfg, handlers.MetricsHandler(cfg)))
 
 	// Add cleanup trigger endpoint
-	http.HandleFunc("/api/trigger-cleanup", handlers.RequireAPIKey(cfg, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/trigger-cleanup", handlers.RequireAdminKey(cfg, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -154,17 +313,47 @@ func main() {
 		})
 	}))
 
+	// Public gallery (anonymous, read-only, rate limited)
+	if cfg.PublicGalleryEnabled {
+		publicLimiter := handlers.NewRateLimiter(cfg.PublicRateLimit, time.Minute)
+		http.HandleFunc("/api/public/images", publicLimiter.Middleware(handlers.PublicGalleryHandler(cfg)))
+		http.HandleFunc("/api/public/random", publicLimiter.Middleware(handlers.PublicRandomHandler(cfg)))
+		logger.Info("Public gallery enabled",
+			zap.Int("rate_limit_per_minute", cfg.PublicRateLimit))
+	}
+
+	// Aggregate statistics for status pages (anonymous, rate limited)
+	if cfg.PublicStatsEnabled {
+		statsLimiter := handlers.NewRateLimiter(cfg.PublicRateLimit, time.Minute)
+		http.HandleFunc("/stats.json", statsLimiter.Middleware(handlers.PublicStatsHandler(cfg)))
+	}
+
+	// Likes and comments (anonymous, rate limited); deleting comments requires the API key
+	socialLimiter := handlers.NewRateLimiter(cfg.PublicRateLimit, time.Minute)
+	http.HandleFunc("/api/images/{id}/likes", socialLimiter.Middleware(handlers.LikesHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/comments", socialLimiter.Middleware(handlers.CommentsHandler(cfg)))
+	http.HandleFunc("/api/images/{id}/comments/{commentId}", handlers.RequireAPIKey(cfg, handlers.DeleteCommentHandler(cfg)))
+
+	// Colors of an image as JSON or CSS custom properties (anonymous, rate limited)
+	http.HandleFunc("/api/images/{id}/palette", socialLimiter.Middleware(handlers.PaletteHandler(cfg)))
+
 	// Use appropriate random image handler based on storage type
+	randomLimiter := handlers.NewAPIRateLimiter(cfg, "random", cfg.RandomRateLimit, time.Minute)
+	var randomHandler http.HandlerFunc
 	if cfg.StorageType == config.StorageTypeS3 {
-		http.HandleFunc("/api/random", handlers.RandomImageHandler(utils.S3Client, cfg))
+		randomHandler = handlers.RandomImageHandler(utils.S3Client, cfg)
 	} else {
-		http.HandleFunc("/api/random", handlers.LocalRandomImageHandler(cfg))
+		randomHandler = handlers.LocalRandomImageHandler(cfg)
 		// Serve local images
 		if !filepath.IsAbs(cfg.ImageBasePath) {
 			cfg.ImageBasePath = filepath.Join(".", cfg.ImageBasePath)
 		}
-		http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(cfg.ImageBasePath))))
 	}
+	http.HandleFunc("/api/random", randomLimiter.Middleware(randomHandler))
+	// Random images changing once per interval, cacheable until then
+	http.HandleFunc("/api/rotate/{interval}", randomLimiter.Middleware(handlers.RotateHandler(randomHandler)))
+	// Serve images, resolving keys written under older key layouts
+	http.HandleFunc("/images/", handlers.ImageHandler(cfg))
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("static"))
@@ -212,10 +401,18 @@ func main() {
 		}
 	})
 
-	// Create HTTP server
+	// Create HTTP server; versioned API paths (/api/v1/...) are served by the routes above
+	handler := corsMiddleware(handlers.TenantMiddleware(cfg, handlers.ReadReplicaMiddleware(cfg, http.DefaultServeMux)))
 	server := &http.Server{
 		Addr:    cfg.ServerAddr,
-		Handler: corsMiddleware(http.DefaultServeMux),
+		Handler: handlers.APIVersionMiddleware(tracing.Middleware(http.DefaultServeMux, handler)),
+	}
+	if cfg.TLSEnabled() {
+		certificates, err := utils.NewCertificateStore(cfg)
+		if err != nil {
+			logger.Fatal("Failed to load TLS certificates", zap.Error(err))
+		}
+		server.TLSConfig = certificates.TLSConfig()
 	}
 
 	// Set up graceful shutdown
@@ -223,14 +420,35 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	// Stop when another instance changes the shared storage configuration
+	clusterCtx, stopClusterWatch := context.WithCancel(context.Background())
+	defer stopClusterWatch()
+	if utils.ClusterStateRegistered != nil {
+		utils.WatchClusterState(clusterCtx, utils.ClusterStateRegistered, func(err error) {
+			logger.Error("Storage configuration no longer matches the cluster", zap.Error(err))
+			select {
+			case quit <- syscall.SIGTERM:
+			default:
+			}
+		})
+	}
+
 	// Start server in a goroutine
 	go func() {
 		logger.Info("Starting server",
 			zap.String("address", cfg.ServerAddr),
 			zap.String("storage_type", string(cfg.StorageType)),
-			zap.Bool("cors_enabled", true))
+			zap.Bool("cors_enabled", true),
+			zap.Bool("read_replica", cfg.ReadReplica),
+			zap.Bool("tls_enabled", cfg.TLSEnabled()))
 
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if cfg.TLSEnabled() {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server error", zap.Error(err))
 		}
 	}()
@@ -243,11 +461,47 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Shut down the worker pool
-	workerPool := utils.GetWorkerPool()
-	if workerPool != nil {
-		logger.Info("Shutting down worker pool...")
-		workerPool.Shutdown()
+	// Stop the self-test before the API it exercises
+	if utils.SelfTest != nil {
+		utils.SelfTest.Stop()
+	}
+
+	// Stop accepting requests, waiting for the uploads in flight
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Server forced to shutdown", zap.Error(err))
+	}
+
+	// Stop consuming bucket events
+	stopIngestion()
+	handlers.WaitSQSIngestion()
+
+	// Stop replication; queued jobs resume on next start
+	if utils.Replication != nil {
+		logger.Info("Stopping replication...")
+		utils.Replication.Stop()
+	}
+
+	// Stop converting; jobs being converted are queued again
+	if utils.Conversions != nil {
+		logger.Info("Stopping conversion queue...")
+		utils.Conversions.Stop()
+	}
+
+	// Stop flushing serve counts; pending counts are flushed on next start
+	if utils.ServeStats != nil {
+		utils.ServeStats.Stop()
+	}
+
+	// Stop search indexing; changes not pushed yet are pushed on next start
+	if utils.SearchIndexing != nil {
+		logger.Info("Stopping search indexing...")
+		utils.SearchIndexing.Stop()
+	}
+
+	// Stop syncing sources
+	if handlers.ImageSyncer != nil {
+		logger.Info("Stopping source sync...")
+		handlers.ImageSyncer.Stop()
 	}
 
 	// Stop the cleaner
@@ -256,11 +510,16 @@ func main() {
 		utils.Cleaner.Stop()
 	}
 
-	// Attempt to shut down the server gracefully
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Error("Server forced to shutdown", zap.Error(err))
+	// Shut down the worker pool last, once nothing submits conversions anymore
+	workerPool := utils.GetWorkerPool()
+	if workerPool != nil {
+		logger.Info("Shutting down worker pool...")
+		workerPool.Shutdown()
 	}
 
+	// Export the spans of the last requests
+	tracing.Shutdown(ctx)
+
 	close(done)
 	logger.Info("Server shutdown completed")
 }
@@ -272,11 +531,9 @@ func configureMIMETypes() {
 	mime.AddExtensionType(".js", "application/javascript")
 	mime.AddExtensionType(".svg", "image/svg+xml")
 	mime.AddExtensionType(".ico", "image/x-icon")
-	mime.AddExtensionType(".png", "image/png")
-	mime.AddExtensionType(".jpg", "image/jpeg")
-	mime.AddExtensionType(".jpeg", "image/jpeg")
-	mime.AddExtensionType(".webp", "image/webp")
-	mime.AddExtensionType(".avif", "image/avif")
+	for ext, mimeType := range utils.ImageMimeTypes {
+		mime.AddExtensionType(ext, mimeType)
+	}
 }
 
 // ensureDirectories creates necessary directory structure for images
@@ -289,6 +546,8 @@ func ensureDirectories(cfg *config.Config) {
 		filepath.Join(cfg.ImageBasePath, "portrait", "webp"),
 		filepath.Join(cfg.ImageBasePath, "portrait", "avif"),
 		filepath.Join(cfg.ImageBasePath, "gif"),
+		filepath.Join(cfg.ImageBasePath, "animated"),
+		filepath.Join(cfg.ImageBasePath, "video"),
 	}
 
 	for _, dir := range dirs {
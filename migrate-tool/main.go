@@ -98,7 +98,7 @@ func loadConfig() (*Config, error) {
 		RedisPassword:   os.Getenv("REDIS_PASSWORD"),
 		RedisDB:         redisDB,
 		RedisTLSEnabled: redisTLS,
-		RedisPrefix:     getEnvOrDefault("REDIS_PREFIX", "imageflow:"),
+		RedisPrefix:     os.Getenv("REDIS_PREFIX"),
 		ImageBasePath:   getEnvOrDefault("LOCAL_STORAGE_PATH", "static/images"),
 		StorageType:     getEnvOrDefault("STORAGE_TYPE", "local"),
 		S3Endpoint:      os.Getenv("S3_ENDPOINT"),
@@ -108,8 +108,10 @@ func loadConfig() (*Config, error) {
 		S3Bucket:        os.Getenv("S3_BUCKET"),
 	}
 
-	// Ensure Redis prefix ends with ":"
-	if !strings.HasSuffix(cfg.RedisPrefix, ":") {
+	// Without REDIS_PREFIX, use the per-storage prefix like the server does
+	if cfg.RedisPrefix == "" {
+		cfg.RedisPrefix = "imageflow:" + cfg.StorageType + ":"
+	} else if !strings.HasSuffix(cfg.RedisPrefix, ":") {
 		cfg.RedisPrefix += ":"
 	}
 
@@ -541,13 +543,15 @@ func main() {
 			}()))
 	}
 
-	// Try different prefixes to find the data
-	possiblePrefixes := []string{
-		cfg.RedisPrefix,
-		"imageflow:s3:",
-		"imageflow:local:",
-		"imageflow:",
-		"",
+	// Try different prefixes to find the data, unless the prefix is configured explicitly
+	possiblePrefixes := []string{cfg.RedisPrefix}
+	if os.Getenv("REDIS_PREFIX") == "" {
+		possiblePrefixes = append(possiblePrefixes,
+			"imageflow:s3:",
+			"imageflow:local:",
+			"imageflow:",
+			"",
+		)
 	}
 
 	var foundPrefix string
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// webpAnimationFlag marks animated WebPs in the flags of their VP8X header
+const webpAnimationFlag = 0x02
+
+// IsAnimated reports whether image data holds an animation: a GIF, an animated WebP or an APNG.
+// libvips only converts and resizes the first frame of an animation, so animations are stored
+// and served as uploaded. GIFs count as animated whatever their frame count, as they always
+// have been served as is.
+func IsAnimated(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return true
+	case len(data) >= 21 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		// Animated WebPs start with an extended (VP8X) header
+		return string(data[12:16]) == "VP8X" && data[20]&webpAnimationFlag != 0
+	case bytes.HasPrefix(data, pngSignature):
+		// APNGs announce their animation in an acTL chunk before the image data
+		for pos := len(pngSignature); pos+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			switch string(data[pos+4 : pos+8]) {
+			case "acTL":
+				return true
+			case "IDAT":
+				return false
+			}
+			pos += 12 + length
+		}
+	}
+	return false
+}
+
+// IsAnimated reports whether the image is an animation stored and served as uploaded, without
+// converted variants
+func (m *ImageMetadata) IsAnimated() bool {
+	return m.Animated || m.Format == "gif"
+}
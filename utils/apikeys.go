@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scopes of a managed API key
+const (
+	ScopeRead   = "read"   // List, search and view images, including private ones
+	ScopeUpload = "upload" // Upload images
+	ScopeAdmin  = "admin"  // Everything, including key management and other admin endpoints
+)
+
+var apiKeyScopes = []string{ScopeRead, ScopeUpload, ScopeAdmin}
+
+// APIKey is a managed API key. The registry stores a hash of the key itself, which is only
+// returned when the key is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Tenant    string    `json:"tenant,omitempty"` // Tenant the key is bound to, empty for the whole instance
+	Prefix    string    `json:"prefix"`           // First characters of the key, to tell keys apart
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HasScope reports whether the key grants a scope. The admin scope grants all of them.
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+// The key registry lives in the global namespace, keyed by the hash of each key
+func apiKeysKey() string {
+	return RedisPrefix + "api_keys"
+}
+
+// CreateAPIKey registers a key with the given scopes, bound to a tenant unless tenant is
+// empty, and returns it with the key itself
+func CreateAPIKey(ctx context.Context, name string, scopes []string, tenant string) (*APIKey, string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, "", fmt.Errorf("redis not enabled")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	var normalized []string
+	for _, scope := range scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return nil, "", fmt.Errorf("unknown scope: %s", scope)
+		}
+		if !slices.Contains(normalized, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	if tenant != "" {
+		if _, err := GetTenant(ctx, tenant); err != nil {
+			return nil, "", err
+		}
+	}
+
+	keyBytes := make([]byte, 24)
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	apiKey := "ik_" + hex.EncodeToString(keyBytes)
+
+	key := &APIKey{
+		ID:        hex.EncodeToString(idBytes),
+		Name:      name,
+		Scopes:    normalized,
+		Tenant:    tenant,
+		Prefix:    apiKey[:10],
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal API key: %v", err)
+	}
+	if err := RedisClient.HSet(ctx, apiKeysKey(), hashAPIKey(apiKey), data).Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to save API key: %v", err)
+	}
+	return key, apiKey, nil
+}
+
+// APIKeyByToken returns the managed key a Bearer token is
+func APIKeyByToken(ctx context.Context, token string) (*APIKey, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	data, err := RedisClient.HGet(ctx, apiKeysKey(), hashAPIKey(token)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %v", err)
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, fmt.Errorf("failed to parse API key: %v", err)
+	}
+	return &key, nil
+}
+
+// ListAPIKeys returns all managed keys, oldest first
+func ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.HGetAll(ctx, apiKeysKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+
+	keys := make([]*APIKey, 0, len(items))
+	for _, data := range items {
+		var key APIKey
+		if err := json.Unmarshal([]byte(data), &key); err == nil {
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// RevokeAPIKey removes a managed key by ID
+func RevokeAPIKey(ctx context.Context, id string) error {
+	removed, err := revokeAPIKeys(ctx, func(key *APIKey) bool { return key.ID == id })
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("API key not found: %s", id)
+	}
+	return nil
+}
+
+// revokeAPIKeys removes the managed keys matching a predicate and returns how many there were
+func revokeAPIKeys(ctx context.Context, match func(*APIKey) bool) (int, error) {
+	if !IsRedisMetadataStore() {
+		return 0, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.HGetAll(ctx, apiKeysKey()).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	removed := 0
+	for hash, data := range items {
+		var key APIKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil || !match(&key) {
+			continue
+		}
+		if err := RedisClient.HDel(ctx, apiKeysKey(), hash).Err(); err != nil {
+			return removed, fmt.Errorf("failed to revoke API key: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
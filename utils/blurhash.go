@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// blurhashCharacters is the base 83 alphabet of BlurHash strings
+const blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// maxBlurhashSamples bounds the pixels read along each axis so large images encode quickly;
+// a placeholder this blurry loses nothing to the subsampling
+const maxBlurhashSamples = 64
+
+// Blurhash encodes an image as a BlurHash (https://blurha.sh), a short string frontends decode
+// into a blurred placeholder shown while the image loads. Landscape images use 4x3 components,
+// portrait images 3x4. Transparent pixels are blended onto white.
+func Blurhash(data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %v", err)
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return "", fmt.Errorf("image is empty")
+	}
+	componentsX, componentsY := 4, 3
+	if bounds.Dy() > bounds.Dx() {
+		componentsX, componentsY = 3, 4
+	}
+
+	// Sample the image into a grid of linear RGB pixels
+	width := min(bounds.Dx(), maxBlurhashSamples)
+	height := min(bounds.Dy(), maxBlurhashSamples)
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+			// Colors are premultiplied, so blending onto white adds the missing coverage
+			background := 0xffff - a
+			pixels[y*width+x] = [3]float64{
+				srgbToLinear(float64(r+background) / 0xffff),
+				srgbToLinear(float64(g+background) / 0xffff),
+				srgbToLinear(float64(b+background) / 0xffff),
+			}
+		}
+	}
+
+	// Project the pixels onto the cosine basis of each component
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+					pixel := pixels[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	var maxAC float64
+	for _, factor := range ac {
+		maxAC = max(maxAC, math.Abs(factor[0]), math.Abs(factor[1]), math.Abs(factor[2]))
+	}
+	quantisedMax := max(0, min(82, int(math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantisedMax+1) / 166
+	hash.WriteString(encodeBase83(quantisedMax, 1))
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		quantise := func(v float64) int {
+			return max(0, min(18, int(math.Floor(signedPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String(), nil
+}
+
+// encodeBase83 writes a value as length base 83 digits, most significant first
+func encodeBase83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = blurhashCharacters[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// CertificateStore selects the TLS certificate of a connection by its SNI host name, so
+// tenant domains can be served directly. Per-domain certificates are loaded on first use
+// from <dir>/<host>.crt and <dir>/<host>.key; other hosts get the default certificate.
+type CertificateStore struct {
+	dir         string
+	defaultCert *tls.Certificate
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewCertificateStore loads the default certificate and prepares the per-domain directory
+func NewCertificateStore(cfg *config.Config) (*CertificateStore, error) {
+	store := &CertificateStore{
+		dir:   cfg.TLSCertDir,
+		certs: make(map[string]*tls.Certificate),
+	}
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load default certificate: %v", err)
+		}
+		store.defaultCert = &cert
+	}
+	return store, nil
+}
+
+// TLSConfig returns a TLS configuration using the store for certificate selection
+func (s *CertificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := NormalizeHost(hello.ServerName)
+	if s.dir != "" && ValidHost(host) {
+		if cert := s.domainCertificate(host); cert != nil {
+			return cert, nil
+		}
+	}
+	if s.defaultCert == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.defaultCert, nil
+}
+
+// domainCertificate returns the cached certificate of a host, loading it on first use
+func (s *CertificateStore) domainCertificate(host string) *tls.Certificate {
+	s.mu.RLock()
+	cert, ok := s.certs[host]
+	s.mu.RUnlock()
+	if ok {
+		return cert
+	}
+
+	loaded, err := tls.LoadX509KeyPair(filepath.Join(s.dir, host+".crt"), filepath.Join(s.dir, host+".key"))
+	if err != nil {
+		// Not cached, so certificates added later are picked up without a restart
+		return nil
+	}
+
+	logger.Info("Loaded TLS certificate", zap.String("host", host))
+	s.mu.Lock()
+	s.certs[host] = &loaded
+	s.mu.Unlock()
+	return &loaded
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Types of the changes recorded in the change feed
+const (
+	ChangeCreated = "created" // An image was uploaded
+	ChangeUpdated = "updated" // The metadata of an image changed, e.g. its tags or visibility
+	ChangeDeleted = "deleted" // An image was deleted
+)
+
+// Change is an entry of a tenant's change feed. Sequence numbers increase with every change,
+// so clients resume from the last one they processed.
+type Change struct {
+	Seq  int64     `json:"seq"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"` // ID of the changed image
+	Time time.Time `json:"time"`
+}
+
+// changeFeedMaxLength bounds the entries kept in a change feed; older ones are trimmed
+var changeFeedMaxLength int64
+
+// InitChangeFeed configures how many changes a change feed keeps
+func InitChangeFeed(cfg *config.Config) {
+	changeFeedMaxLength = int64(cfg.ChangeFeedMaxLength)
+}
+
+// changeFeedKey is the stream of a tenant's changes. Entry IDs are <seq>-0, so the stream is
+// ordered by sequence number.
+func changeFeedKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "changes"
+}
+
+// changeSeqKey holds the sequence number of a tenant's latest change
+func changeSeqKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "changes_seq"
+}
+
+// recordChangeScript numbers a change and appends it to the feed in one step, so entries are
+// added in sequence order whichever instance records them
+var recordChangeScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[1], seq .. '-0', 'type', ARGV[2], 'id', ARGV[3], 'time', ARGV[4])
+return seq
+`)
+
+// recordChange appends a change to the feed through c, which may be a transaction pipeline so
+// the change is recorded together with the mutation
+func recordChange(ctx context.Context, c redis.Scripter, changeType, id string) *redis.Cmd {
+	return recordChangeScript.Eval(ctx, c, []string{changeSeqKey(ctx), changeFeedKey(ctx)},
+		changeFeedMaxLength, changeType, id, time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// ChangePage is a page of a change feed
+type ChangePage struct {
+	Changes []Change `json:"changes"`
+	Latest  int64    `json:"latest"` // Sequence number of the latest change
+	// Truncated reports that changes after the requested sequence number were already trimmed
+	// from the feed, so the client must list the library again before following the feed
+	Truncated bool `json:"truncated"`
+}
+
+// Changes returns up to limit changes of the tenant recorded after the since sequence number,
+// oldest first
+func Changes(ctx context.Context, since int64, limit int64) (*ChangePage, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis is not enabled")
+	}
+
+	pipe := RedisClient.Pipeline()
+	seqCmd := pipe.Get(ctx, changeSeqKey(ctx))
+	firstCmd := pipe.XRangeN(ctx, changeFeedKey(ctx), "-", "+", 1)
+	entriesCmd := pipe.XRangeN(ctx, changeFeedKey(ctx), strconv.FormatInt(since+1, 10)+"-0", "+", limit)
+	pipe.Exec(ctx)
+	for _, cmd := range []redis.Cmder{seqCmd, firstCmd, entriesCmd} {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read change feed: %v", err)
+		}
+	}
+
+	page := &ChangePage{Changes: make([]Change, 0, len(entriesCmd.Val()))}
+	page.Latest, _ = seqCmd.Int64()
+	if first := firstCmd.Val(); len(first) > 0 {
+		page.Truncated = changeSeq(first[0].ID) > since+1
+	} else {
+		// Every change was trimmed, or none was recorded yet
+		page.Truncated = page.Latest > since
+	}
+	for _, entry := range entriesCmd.Val() {
+		change := Change{Seq: changeSeq(entry.ID)}
+		change.Type, _ = entry.Values["type"].(string)
+		change.ID, _ = entry.Values["id"].(string)
+		if t, ok := entry.Values["time"].(string); ok {
+			change.Time, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	return page, nil
+}
+
+// changeSeq returns the sequence number of a change feed entry ID
+func changeSeq(entryID string) int64 {
+	seq, _, _ := strings.Cut(entryID, "-")
+	n, _ := strconv.ParseInt(seq, 10, 64)
+	return n
+}
@@ -56,9 +56,16 @@ func (ic *ImageCleaner) Stop() {
 	logger.Info("Image cleaner stopped")
 }
 
-// cleanExpiredImages removes all expired images
+// cleanExpiredImages removes all expired images of every tenant
 func (ic *ImageCleaner) cleanExpiredImages() {
-	ctx := context.Background()
+	for _, ctx := range TenantContexts(context.Background()) {
+		ic.cleanExpiredImagesIn(ctx)
+	}
+	CleanExpiredUploadSessions()
+}
+
+// cleanExpiredImagesIn removes the expired images of the context's tenant
+func (ic *ImageCleaner) cleanExpiredImagesIn(ctx context.Context) {
 	expiredImages, err := MetadataManager.ListExpiredImages(ctx)
 	if err != nil {
 		logger.Error("Failed to list expired images", zap.Error(err))
@@ -74,67 +81,92 @@ func (ic *ImageCleaner) cleanExpiredImages() {
 		zap.Int("count", len(expiredImages)))
 
 	for _, metadata := range expiredImages {
-		logger.Debug("Processing expired image",
-			zap.String("id", metadata.ID),
-			zap.Time("expiry_time", metadata.ExpiryTime))
-
-		// Delete original image
-		if metadata.Paths.Original != "" {
-			if err := Storage.Delete(ctx, metadata.Paths.Original); err != nil {
-				logger.Error("Failed to delete original image",
-					zap.String("path", metadata.Paths.Original),
-					zap.Error(err))
-			} else {
-				logger.Debug("Deleted original image",
-					zap.String("path", metadata.Paths.Original))
-			}
+		deleteExpiredImage(ctx, metadata)
+	}
+
+	// Clear page cache after deleting all expired images
+	if err := ClearPageCache(ctx); err != nil {
+		logger.Warn("Failed to clear page cache",
+			zap.Error(err))
+	} else {
+		logger.Debug("Page cache cleared after cleanup")
+	}
+
+	logger.Info("Completed cleanup of expired images",
+		zap.Int("total_cleaned", len(expiredImages)))
+}
+
+// deleteExpiredImage removes the files and metadata of an expired image
+func deleteExpiredImage(ctx context.Context, metadata *ImageMetadata) {
+	logger.Debug("Processing expired image",
+		zap.String("id", metadata.ID),
+		zap.Time("expiry_time", metadata.ExpiryTime))
+
+	// Delete original image
+	if metadata.Paths.Original != "" {
+		if err := Storage.Delete(ctx, metadata.Paths.Original); err != nil {
+			logger.Error("Failed to delete original image",
+				zap.String("path", metadata.Paths.Original),
+				zap.Error(err))
+		} else {
+			logger.Debug("Deleted original image",
+				zap.String("path", metadata.Paths.Original))
 		}
+	}
 
-		// Delete WebP format
-		if metadata.Paths.WebP != "" {
-			if err := Storage.Delete(ctx, metadata.Paths.WebP); err != nil {
-				logger.Error("Failed to delete WebP image",
-					zap.String("path", metadata.Paths.WebP),
-					zap.Error(err))
-			} else {
-				logger.Debug("Deleted WebP image",
-					zap.String("path", metadata.Paths.WebP))
-			}
+	// Delete WebP format
+	if metadata.Paths.WebP != "" {
+		if err := Storage.Delete(ctx, metadata.Paths.WebP); err != nil {
+			logger.Error("Failed to delete WebP image",
+				zap.String("path", metadata.Paths.WebP),
+				zap.Error(err))
+		} else {
+			logger.Debug("Deleted WebP image",
+				zap.String("path", metadata.Paths.WebP))
 		}
+	}
 
-		// Delete AVIF format
-		if metadata.Paths.AVIF != "" {
-			if err := Storage.Delete(ctx, metadata.Paths.AVIF); err != nil {
-				logger.Error("Failed to delete AVIF image",
-					zap.String("path", metadata.Paths.AVIF),
-					zap.Error(err))
-			} else {
-				logger.Debug("Deleted AVIF image",
-					zap.String("path", metadata.Paths.AVIF))
-			}
+	// Delete AVIF format
+	if metadata.Paths.AVIF != "" {
+		if err := Storage.Delete(ctx, metadata.Paths.AVIF); err != nil {
+			logger.Error("Failed to delete AVIF image",
+				zap.String("path", metadata.Paths.AVIF),
+				zap.Error(err))
+		} else {
+			logger.Debug("Deleted AVIF image",
+				zap.String("path", metadata.Paths.AVIF))
 		}
+	}
 
-		// Delete metadata
-		if err := MetadataManager.DeleteMetadata(ctx, metadata.ID); err != nil {
-			logger.Error("Failed to delete metadata",
-				zap.String("id", metadata.ID),
+	// Delete thumbnails
+	for _, path := range metadata.Paths.Thumbnails {
+		if err := Storage.Delete(ctx, path); err != nil {
+			logger.Error("Failed to delete thumbnail",
+				zap.String("path", path),
 				zap.Error(err))
 		} else {
-			logger.Debug("Deleted metadata",
-				zap.String("id", metadata.ID))
+			logger.Debug("Deleted thumbnail",
+				zap.String("path", path))
 		}
 	}
 
-	// Clear page cache after deleting all expired images
-	if err := ClearPageCache(ctx); err != nil {
-		logger.Warn("Failed to clear page cache",
+	// Delete metadata
+	if err := MetadataManager.DeleteMetadata(ctx, metadata.ID); err != nil {
+		logger.Error("Failed to delete metadata",
+			zap.String("id", metadata.ID),
 			zap.Error(err))
 	} else {
-		logger.Debug("Page cache cleared after cleanup")
+		logger.Debug("Deleted metadata",
+			zap.String("id", metadata.ID))
 	}
 
-	logger.Info("Completed cleanup of expired images",
-		zap.Int("total_cleaned", len(expiredImages)))
+	if err := DeleteThemeVariantLinks(ctx, metadata); err != nil {
+		logger.Warn("Failed to unlink theme variant",
+			zap.String("id", metadata.ID),
+			zap.Error(err))
+	}
+
+	RunHooks(ctx, &HookEvent{Point: HookPostDelete, ImageID: metadata.ID, Metadata: metadata})
 }
 
 // Global cleaner instance
@@ -144,6 +176,12 @@ var Cleaner *ImageCleaner
 func InitCleaner(cfg *config.Config) {
 	Cleaner = NewImageCleaner(cfg)
 	Cleaner.Start()
+
+	// Expiry notifications delete images as they expire; the periodic cleanup stays as a
+	// fallback for notifications missed while disconnected
+	if cfg.ExpiryNotifications && IsRedisMetadataStore() {
+		WatchExpiryNotifications(Cleaner.ctx, cfg)
+	}
 }
 
 // TriggerCleanup manually triggers the cleanup process
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// clusterStateKey holds the configuration shared by every instance using the same Redis. It
+// lives outside the key prefix, which itself depends on the configuration being checked.
+const clusterStateKey = "imageflow:cluster"
+
+// clusterStateCheckInterval is how often running instances look for configuration changes
+const clusterStateCheckInterval = time.Minute
+
+// ClusterState is the storage configuration instances sharing a Redis must agree on. Its
+// version increases every time an instance deliberately changes it.
+type ClusterState struct {
+	Version     int64     `json:"version"`
+	StorageType string    `json:"storageType"`
+	RedisPrefix string    `json:"redisPrefix"`
+	KeyLayout   string    `json:"keyLayout"`
+	S3Bucket    string    `json:"s3Bucket,omitempty"`
+	Container   string    `json:"container,omitempty"` // Azure Blob Storage container
+	UpdatedAt   time.Time `json:"updatedAt"`
+	UpdatedBy   string    `json:"updatedBy"` // Host name of the instance that wrote the state
+}
+
+// ClusterStateRegistered is the cluster state this instance registered, nil without Redis
+var ClusterStateRegistered *ClusterState
+
+// newClusterState returns the cluster state described by this instance's configuration
+func newClusterState(cfg *config.Config) *ClusterState {
+	state := &ClusterState{
+		StorageType: string(cfg.StorageType),
+		RedisPrefix: RedisPrefix,
+		KeyLayout:   string(cfg.KeyLayout),
+		UpdatedAt:   time.Now(),
+	}
+	if cfg.StorageType == config.StorageTypeS3 {
+		state.S3Bucket = cfg.S3Bucket
+	}
+	if cfg.StorageType == config.StorageTypeAzure {
+		state.Container = cfg.AzureAccount + "/" + cfg.AzureContainer
+	}
+	state.UpdatedBy, _ = os.Hostname()
+	return state
+}
+
+// Drift lists the settings that differ between two cluster states
+func (s *ClusterState) Drift(other *ClusterState) []string {
+	var drift []string
+	check := func(name, a, b string) {
+		if a != b {
+			drift = append(drift, fmt.Sprintf("%s %q != %q", name, a, b))
+		}
+	}
+	check("storage type", s.StorageType, other.StorageType)
+	check("redis prefix", s.RedisPrefix, other.RedisPrefix)
+	check("key layout", s.KeyLayout, other.KeyLayout)
+	check("s3 bucket", s.S3Bucket, other.S3Bucket)
+	check("azure container", s.Container, other.Container)
+	return drift
+}
+
+// GetClusterState returns the shared cluster state, or nil when none was recorded yet
+func GetClusterState(ctx context.Context) (*ClusterState, error) {
+	return readClusterState(ctx, RedisClient)
+}
+
+func readClusterState(ctx context.Context, client interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+}) (*ClusterState, error) {
+	data, err := client.Get(ctx, clusterStateKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state ClusterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid cluster state: %v", err)
+	}
+	return &state, nil
+}
+
+// RegisterClusterState checks this instance's configuration against the shared cluster state,
+// recording it when it is the first instance. A mismatch is an error unless ClusterReconfigure
+// is set, in which case the configuration becomes the new cluster state with a higher version;
+// running instances with the old configuration then stop.
+func RegisterClusterState(ctx context.Context, cfg *config.Config) (*ClusterState, error) {
+	local := newClusterState(cfg)
+
+	for {
+		var registered *ClusterState
+		err := RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := readClusterState(ctx, tx)
+			if err != nil {
+				return err
+			}
+			if current != nil {
+				drift := local.Drift(current)
+				if len(drift) == 0 {
+					registered = current
+					return nil
+				}
+				if !cfg.ClusterReconfigure {
+					return fmt.Errorf("configuration differs from cluster state version %d written by %s: %s",
+						current.Version, current.UpdatedBy, strings.Join(drift, ", "))
+				}
+				logger.Warn("Replacing cluster state",
+					zap.Int64("version", current.Version),
+					zap.Strings("drift", drift))
+				local.Version = current.Version
+			}
+			local.Version++
+
+			data, err := json.Marshal(local)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, clusterStateKey, data, 0)
+				return nil
+			})
+			registered = local
+			return err
+		}, clusterStateKey)
+
+		// Another instance wrote the state concurrently; check against its version
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Registered cluster state",
+			zap.Int64("version", registered.Version),
+			zap.String("storage_type", registered.StorageType),
+			zap.String("redis_prefix", registered.RedisPrefix))
+		return registered, nil
+	}
+}
+
+// WatchClusterState periodically compares the shared cluster state with the registered one
+// until the context is cancelled, calling onDrift once when another instance changes it to a
+// configuration this instance no longer matches
+func WatchClusterState(ctx context.Context, registered *ClusterState, onDrift func(error)) {
+	go func() {
+		ticker := time.NewTicker(clusterStateCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := GetClusterState(ctx)
+			if err != nil {
+				logger.Warn("Failed to read cluster state", zap.Error(err))
+				continue
+			}
+			if current == nil || current.Version == registered.Version {
+				continue
+			}
+			if drift := registered.Drift(current); len(drift) > 0 {
+				onDrift(fmt.Errorf("cluster state changed to version %d by %s: %s",
+					current.Version, current.UpdatedBy, strings.Join(drift, ", ")))
+				return
+			}
+			registered = current
+		}
+	}()
+}
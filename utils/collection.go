@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var collectionIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Collection is a named, ordered set of images, like an album. An image can belong to any
+// number of collections.
+type Collection struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Images      int64     `json:"images"` // Number of images, counted when read
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Collections are stored in a hash by ID. Each collection's images are a sorted set scored by
+// when they were added, and each image has a set of the collections it belongs to, so deleting
+// the image can remove it from them.
+func collectionsKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "collections"
+}
+
+func collectionImagesKey(ctx context.Context, id string) string {
+	return KeyPrefix(ctx) + "collection:" + id
+}
+
+func imageCollectionsKey(ctx context.Context, imageID string) string {
+	return KeyPrefix(ctx) + "image_collections:" + imageID
+}
+
+// CreateCollection creates an empty collection
+func CreateCollection(ctx context.Context, id, name, description string) (*Collection, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+	if !collectionIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid collection ID: use 1-64 lowercase letters, digits, dashes or underscores")
+	}
+	if name == "" {
+		name = id
+	}
+
+	now := time.Now()
+	collection := &Collection{ID: id, Name: name, Description: description, CreatedAt: now, UpdatedAt: now}
+	data, err := json.Marshal(collection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal collection: %v", err)
+	}
+	created, err := RedisClient.HSetNX(ctx, collectionsKey(ctx), id, data).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save collection: %v", err)
+	}
+	if !created {
+		return nil, fmt.Errorf("collection already exists: %s", id)
+	}
+	return collection, nil
+}
+
+// GetCollection returns a collection by ID with its number of images
+func GetCollection(ctx context.Context, id string) (*Collection, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	data, err := RedisClient.HGet(ctx, collectionsKey(ctx), id).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("collection not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collection: %v", err)
+	}
+
+	var collection Collection
+	if err := json.Unmarshal([]byte(data), &collection); err != nil {
+		return nil, fmt.Errorf("failed to parse collection: %v", err)
+	}
+	collection.Images, _ = RedisClient.ZCard(ctx, collectionImagesKey(ctx, id)).Result()
+	return &collection, nil
+}
+
+// ListCollections returns all collections ordered by ID, with their number of images
+func ListCollections(ctx context.Context) ([]*Collection, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.HGetAll(ctx, collectionsKey(ctx)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %v", err)
+	}
+
+	collections := make([]*Collection, 0, len(items))
+	pipe := RedisClient.Pipeline()
+	counts := make([]*redis.IntCmd, 0, len(items))
+	for _, data := range items {
+		var collection Collection
+		if err := json.Unmarshal([]byte(data), &collection); err != nil {
+			continue
+		}
+		collections = append(collections, &collection)
+		counts = append(counts, pipe.ZCard(ctx, collectionImagesKey(ctx, collection.ID)))
+	}
+	if len(counts) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to count collection images: %v", err)
+		}
+	}
+	for i, collection := range collections {
+		collection.Images = counts[i].Val()
+	}
+
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].ID < collections[j].ID
+	})
+	return collections, nil
+}
+
+// UpdateCollection replaces the name and description of a collection
+func UpdateCollection(ctx context.Context, id, name, description string) (*Collection, error) {
+	collection, err := GetCollection(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		collection.Name = name
+	}
+	collection.Description = description
+	collection.UpdatedAt = time.Now()
+	if err := saveCollection(ctx, collection); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func saveCollection(ctx context.Context, collection *Collection) error {
+	images := collection.Images
+	collection.Images = 0
+	data, err := json.Marshal(collection)
+	collection.Images = images
+	if err != nil {
+		return fmt.Errorf("failed to marshal collection: %v", err)
+	}
+	if err := RedisClient.HSet(ctx, collectionsKey(ctx), collection.ID, data).Err(); err != nil {
+		return fmt.Errorf("failed to save collection: %v", err)
+	}
+	return nil
+}
+
+// DeleteCollection removes a collection. Its images are kept.
+func DeleteCollection(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	removed, err := RedisClient.HDel(ctx, collectionsKey(ctx), id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete collection: %v", err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("collection not found: %s", id)
+	}
+
+	imageIDs, err := RedisClient.ZRange(ctx, collectionImagesKey(ctx, id), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list collection images: %v", err)
+	}
+	pipe := RedisClient.Pipeline()
+	for _, imageID := range imageIDs {
+		pipe.SRem(ctx, imageCollectionsKey(ctx, imageID), id)
+	}
+	pipe.Del(ctx, collectionImagesKey(ctx, id))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// AddToCollection adds images to a collection and returns how many were not in it yet.
+// Images that do not exist are rejected.
+func AddToCollection(ctx context.Context, id string, imageIDs []string) (int64, error) {
+	collection, err := GetCollection(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, imageID := range imageIDs {
+		if _, err := MetadataManager.GetMetadata(ctx, imageID); err != nil {
+			return 0, fmt.Errorf("image not found: %s", imageID)
+		}
+	}
+
+	now := float64(time.Now().UnixMilli())
+	pipe := RedisClient.TxPipeline()
+	added := make([]*redis.IntCmd, 0, len(imageIDs))
+	for _, imageID := range imageIDs {
+		// NX keeps the position of images already in the collection
+		added = append(added, pipe.ZAddNX(ctx, collectionImagesKey(ctx, id), redis.Z{Score: now, Member: imageID}))
+		pipe.SAdd(ctx, imageCollectionsKey(ctx, imageID), id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to add images to collection: %v", err)
+	}
+
+	var count int64
+	for _, cmd := range added {
+		count += cmd.Val()
+	}
+	if count > 0 {
+		collection.UpdatedAt = time.Now()
+		if err := saveCollection(ctx, collection); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// RemoveFromCollection removes images from a collection and returns how many were in it
+func RemoveFromCollection(ctx context.Context, id string, imageIDs []string) (int64, error) {
+	collection, err := GetCollection(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	pipe := RedisClient.TxPipeline()
+	removed := make([]*redis.IntCmd, 0, len(imageIDs))
+	for _, imageID := range imageIDs {
+		removed = append(removed, pipe.ZRem(ctx, collectionImagesKey(ctx, id), imageID))
+		pipe.SRem(ctx, imageCollectionsKey(ctx, imageID), id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to remove images from collection: %v", err)
+	}
+
+	var count int64
+	for _, cmd := range removed {
+		count += cmd.Val()
+	}
+	if count > 0 {
+		collection.UpdatedAt = time.Now()
+		if err := saveCollection(ctx, collection); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// CollectionImageIDs returns the IDs of a collection's images, most recently added first
+func CollectionImageIDs(ctx context.Context, id string) ([]string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	imageIDs, err := RedisClient.ZRevRange(ctx, collectionImagesKey(ctx, id), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collection images: %v", err)
+	}
+	return imageIDs, nil
+}
+
+// ImageCollections returns the IDs of the collections an image belongs to
+func ImageCollections(ctx context.Context, imageID string) ([]string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	ids, err := RedisClient.SMembers(ctx, imageCollectionsKey(ctx, imageID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list image collections: %v", err)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// DeleteImageCollections removes a deleted image from every collection it belonged to
+func DeleteImageCollections(ctx context.Context, imageID string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	ids, err := RedisClient.SMembers(ctx, imageCollectionsKey(ctx, imageID)).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to list image collections: %v", err)
+	}
+
+	pipe := RedisClient.Pipeline()
+	for _, id := range ids {
+		pipe.ZRem(ctx, collectionImagesKey(ctx, id), imageID)
+	}
+	pipe.Del(ctx, imageCollectionsKey(ctx, imageID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,369 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Conversion job states
+const (
+	JobQueued     = "queued"     // Waiting for a worker
+	JobProcessing = "processing" // Being converted
+	JobDone       = "done"       // Variants stored
+	JobFailed     = "failed"     // Exhausted its attempts; the image is served as the original
+)
+
+const (
+	// conversionMaxAttempts is how often a job is tried before it fails
+	conversionMaxAttempts = 3
+	// conversionJobTTL is how long the state of a job is kept after its last change
+	conversionJobTTL = 7 * 24 * time.Hour
+	// conversionJobTimeout is how long a job may be processing without a heartbeat before it is
+	// considered abandoned by a crashed instance and queued again
+	conversionJobTimeout = 10 * time.Minute
+	// conversionJobHeartbeat is how often the instance converting a job refreshes its Updated
+	// time, well within conversionJobTimeout
+	conversionJobHeartbeat = time.Minute
+)
+
+var ErrConversionJobNotFound = errors.New("conversion job not found")
+
+// ConversionJob converts the WebP/AVIF variants of an image uploaded with async=true, served
+// as the original until the job is done, or reprocesses an image's variants
+type ConversionJob struct {
+	ID        string    `json:"id"`
+	ImageID   string    `json:"imageId"`
+	Reprocess bool      `json:"reprocess,omitempty"` // Converts stored variants again, see ReprocessImage
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`   // Last failure
+	Changes   []string  `json:"changes,omitempty"` // What the conversion did, once done
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+// conversionTask is an entry of the conversion queue
+type conversionTask struct {
+	Job    string `json:"job"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// ConversionQueue converts the variants of async uploads in the background. Jobs are queued in
+// Redis, so they survive restarts and are shared by instances using the same Redis; a job is
+// moved to a processing list while converted, from which jobs of crashed instances are
+// recovered.
+type ConversionQueue struct {
+	cfg     *config.Config
+	workers int
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Conversions is the running conversion queue, nil without Redis
+var Conversions *ConversionQueue
+
+// Conversion queues live in the global namespace; tasks carry their tenant
+func conversionQueueKey() string {
+	return RedisPrefix + "conversion:queue"
+}
+
+func conversionProcessingKey() string {
+	return RedisPrefix + "conversion:processing"
+}
+
+// conversionJobKey holds the state of a job, under its tenant's namespace so it can only be
+// read with the tenant's keys
+func conversionJobKey(ctx context.Context, id string) string {
+	return KeyPrefix(ctx) + "job:" + id
+}
+
+// InitConversionQueue starts the conversion workers when Redis stores the metadata
+func InitConversionQueue(cfg *config.Config) {
+	if !IsRedisMetadataStore() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	Conversions = &ConversionQueue{
+		cfg:     cfg,
+		workers: cfg.ConversionWorkers,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	Conversions.Start()
+}
+
+// Enqueue queues the conversion of an image's missing variants, or of all of them when
+// reprocessing, and returns its job
+func (q *ConversionQueue) Enqueue(ctx context.Context, imageID string, reprocess bool) (*ConversionJob, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate job ID: %v", err)
+	}
+	now := time.Now().UTC()
+	job := &ConversionJob{
+		ID:        hex.EncodeToString(idBytes),
+		ImageID:   imageID,
+		Reprocess: reprocess,
+		Status:    JobQueued,
+		Created:   now,
+		Updated:   now,
+	}
+	task := conversionTask{Job: job.ID}
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		task.Tenant = tenant.ID
+	}
+
+	jobData, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	taskData, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	pipe := RedisClient.TxPipeline()
+	pipe.Set(ctx, conversionJobKey(ctx, job.ID), jobData, conversionJobTTL)
+	pipe.RPush(ctx, conversionQueueKey(), taskData)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to queue conversion: %v", err)
+	}
+	return job, nil
+}
+
+// GetConversionJob returns a job of the context's tenant
+func GetConversionJob(ctx context.Context, id string) (*ConversionJob, error) {
+	if !IsRedisMetadataStore() {
+		return nil, ErrConversionJobNotFound
+	}
+	data, err := RedisClient.Get(ctx, conversionJobKey(ctx, id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrConversionJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conversion job: %v", err)
+	}
+	var job ConversionJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to decode conversion job: %v", err)
+	}
+	return &job, nil
+}
+
+func saveConversionJob(ctx context.Context, job *ConversionJob) error {
+	job.Updated = time.Now().UTC()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return RedisClient.Set(ctx, conversionJobKey(ctx, job.ID), data, conversionJobTTL).Err()
+}
+
+// Start runs the workers and the recovery of abandoned jobs until Stop is called
+func (q *ConversionQueue) Start() {
+	logger.Info("Starting conversion queue",
+		zap.Int("workers", q.workers))
+
+	q.wg.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+
+	go func() {
+		for {
+			q.recoverAbandoned()
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// Stop terminates the workers; jobs being converted are queued again
+func (q *ConversionQueue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+	logger.Info("Conversion queue stopped")
+}
+
+func (q *ConversionQueue) worker() {
+	defer q.wg.Done()
+	for q.ctx.Err() == nil {
+		data, err := RedisClient.BLMove(q.ctx, conversionQueueKey(), conversionProcessingKey(), "LEFT", "RIGHT", 5*time.Second).Result()
+		if err != nil {
+			if err != redis.Nil && q.ctx.Err() == nil {
+				logger.Warn("Failed to read conversion queue", zap.Error(err))
+				select {
+				case <-q.ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+		q.process(data)
+	}
+}
+
+// process runs one task taken from the queue, queueing it again after a failure until the job
+// exhausts its attempts
+func (q *ConversionQueue) process(data string) {
+	// Bookkeeping outlives Stop, so an interrupted job is put back rather than lost
+	bg := context.WithoutCancel(q.ctx)
+	done := func() {
+		RedisClient.LRem(bg, conversionProcessingKey(), 1, data)
+	}
+
+	var task conversionTask
+	if err := json.Unmarshal([]byte(data), &task); err != nil {
+		logger.Error("Dropping invalid conversion task", zap.Error(err))
+		done()
+		return
+	}
+	ctx := q.ctx
+	if task.Tenant != "" {
+		tenant, err := GetTenant(ctx, task.Tenant)
+		if err != nil {
+			// The tenant was deleted; nothing left to convert
+			done()
+			return
+		}
+		ctx = WithTenant(ctx, tenant)
+	}
+	job, err := GetConversionJob(ctx, task.Job)
+	if err != nil {
+		logger.Warn("Dropping conversion task without job",
+			zap.String("job", task.Job),
+			zap.Error(err))
+		done()
+		return
+	}
+
+	job.Status = JobProcessing
+	job.Attempts++
+	if err := saveConversionJob(ctx, job); err != nil {
+		logger.Warn("Failed to update conversion job",
+			zap.String("job", job.ID),
+			zap.Error(err))
+	}
+
+	rebuild := RepairImage
+	if job.Reprocess {
+		rebuild = ReprocessImage
+	}
+	stopHeartbeat := heartbeatConversionJob(context.WithoutCancel(ctx), *job)
+	report, err := rebuild(ctx, q.cfg, job.ImageID)
+	stopHeartbeat()
+	jobCtx := context.WithoutCancel(ctx)
+	switch {
+	case err == nil:
+		job.Status = JobDone
+		job.Error = ""
+		job.Changes = report.Changes
+		logger.Info("Conversion job done",
+			zap.String("job", job.ID),
+			zap.String("image_id", job.ImageID))
+	case q.ctx.Err() != nil:
+		// Interrupted by Stop; the attempt does not count
+		job.Status = JobQueued
+		job.Attempts--
+		saveConversionJob(jobCtx, job)
+		RedisClient.LPush(bg, conversionQueueKey(), data)
+		done()
+		return
+	case job.Attempts >= conversionMaxAttempts:
+		job.Status = JobFailed
+		job.Error = err.Error()
+		logger.Error("Conversion job failed",
+			zap.String("job", job.ID),
+			zap.String("image_id", job.ImageID),
+			zap.Int("attempts", job.Attempts),
+			zap.Error(err))
+	default:
+		job.Status = JobQueued
+		job.Error = err.Error()
+		logger.Warn("Conversion job failed, retrying",
+			zap.String("job", job.ID),
+			zap.String("image_id", job.ImageID),
+			zap.Int("attempts", job.Attempts),
+			zap.Error(err))
+		RedisClient.RPush(bg, conversionQueueKey(), data)
+	}
+	if err := saveConversionJob(jobCtx, job); err != nil {
+		logger.Warn("Failed to update conversion job",
+			zap.String("job", job.ID),
+			zap.Error(err))
+	}
+	done()
+}
+
+// heartbeatConversionJob saves a job being converted every conversionJobHeartbeat until the
+// returned function is called, so recoverAbandoned leaves long conversions alone
+func heartbeatConversionJob(ctx context.Context, job ConversionJob) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(conversionJobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := saveConversionJob(ctx, &job); err != nil {
+					logger.Warn("Failed to refresh conversion job",
+						zap.String("job", job.ID),
+						zap.Error(err))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// recoverAbandoned queues again the tasks left in the processing list by instances that
+// crashed while converting them
+func (q *ConversionQueue) recoverAbandoned() {
+	tasks, err := RedisClient.LRange(q.ctx, conversionProcessingKey(), 0, -1).Result()
+	if err != nil {
+		return
+	}
+	for _, data := range tasks {
+		var task conversionTask
+		if json.Unmarshal([]byte(data), &task) != nil {
+			continue
+		}
+		ctx := q.ctx
+		if task.Tenant != "" {
+			if tenant, err := GetTenant(ctx, task.Tenant); err == nil {
+				ctx = WithTenant(ctx, tenant)
+			}
+		}
+		job, err := GetConversionJob(ctx, task.Job)
+		if err == nil && time.Since(job.Updated) < conversionJobTimeout {
+			continue
+		}
+		// Only the instance that removes the entry requeues it
+		if removed, err := RedisClient.LRem(q.ctx, conversionProcessingKey(), 1, data).Result(); err == nil && removed > 0 {
+			logger.Warn("Requeueing abandoned conversion job",
+				zap.String("job", task.Job))
+			RedisClient.RPush(q.ctx, conversionQueueKey(), data)
+		}
+	}
+}
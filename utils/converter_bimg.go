@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -19,23 +20,109 @@ func InitVips(cfg *config.Config) {
 
 	bimg.Initialize()
 
+	// Without an AVIF encoder in libvips, AVIF variants are neither generated nor negotiated
+	if cfg.AvifSupport && !bimg.IsTypeSupportedSave(bimg.AVIF) {
+		logger.Warn("libvips was built without AVIF support, disabling AVIF")
+		cfg.AvifSupport = false
+	}
+
 	// Initialize worker pool
 	InitWorkerPool(cfg)
 	logger.Info("Initialized image processing worker pool",
 		zap.Int("workers", cfg.WorkerPoolSize))
 }
 
+// ConvertOptions controls the encoder settings of a single conversion
+type ConvertOptions struct {
+	Quality   int        // Encoding quality (1-100)
+	Speed     int        // Encoding speed (0-8, 0=slowest/highest quality)
+	Lossless  bool       // Encode losslessly (WebP only), preserving sharp text and edges
+	Watermark *Watermark // Overlay drawn on the converted image, nil for none
+}
+
+// ConvertOptionsFromConfig returns the globally configured encoder settings
+func ConvertOptionsFromConfig(cfg *config.Config) ConvertOptions {
+	return ConvertOptions{
+		Quality: cfg.ImageQuality,
+		Speed:   cfg.Speed,
+	}
+}
+
+// conversionLog rate limits the entries logged for every conversion
+var conversionLog = logger.Limited(logger.CategoryConversion)
+
+// conversionAttempts is how often a conversion is tried before it fails, as libvips
+// occasionally produces empty or corrupt output that another attempt encodes correctly
+const conversionAttempts = 2
+
+// processVerified converts image data with bimg, retrying when the output is not a valid image
+// of the requested type with the dimensions of the input
+func processVerified(data []byte, options bimg.Options) ([]byte, error) {
+	var err error
+	for attempt := 1; attempt <= conversionAttempts; attempt++ {
+		var result []byte
+		if result, err = bimg.NewImage(data).Process(options); err == nil {
+			if err = verifyConversion(data, result, options.Type); err == nil {
+				return result, nil
+			}
+		}
+		logger.Warn("Conversion attempt failed",
+			zap.String("format", bimg.ImageTypeName(options.Type)),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+	}
+	return nil, err
+}
+
+// verifyConversion checks that conversion output is not empty, is an image of the requested
+// type and has a header decoding to the displayed dimensions of the input
+func verifyConversion(source, result []byte, imageType bimg.ImageType) error {
+	if len(result) == 0 {
+		return fmt.Errorf("empty output")
+	}
+	if bimg.DetermineImageType(result) != imageType {
+		return fmt.Errorf("output is not a valid %s image", bimg.ImageTypeName(imageType))
+	}
+	size, err := bimg.Size(result)
+	if err != nil {
+		return fmt.Errorf("failed to decode output: %v", err)
+	}
+	if size.Width <= 0 || size.Height <= 0 {
+		return fmt.Errorf("output has invalid dimensions %dx%d", size.Width, size.Height)
+	}
+	// Conversions rotate images upright, so the output has the displayed dimensions
+	if width, height, err := DisplayDimensions(source); err == nil && (size.Width != width || size.Height != height) {
+		return fmt.Errorf("output dimensions %dx%d do not match the input's %dx%d", size.Width, size.Height, width, height)
+	}
+	return nil
+}
+
 // ConvertToWebPWithBimg converts image data to WebP format using bimg/libvips
 func ConvertToWebPWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
-	logger.Debug("Queuing WebP conversion task",
+	opts := ConvertOptionsFromConfig(cfg)
+	opts.Quality = cfg.OutputQuality("webp")
+	return ConvertToWebPWithOptions(context.Background(), data, opts)
+}
+
+// ConvertToAVIFWithBimg converts image data to AVIF format using bimg/libvips
+func ConvertToAVIFWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
+	opts := ConvertOptionsFromConfig(cfg)
+	opts.Quality = cfg.OutputQuality("avif")
+	return ConvertToAVIFWithOptions(context.Background(), data, opts)
+}
+
+// ConvertToWebPWithOptions converts image data to WebP format with explicit encoder settings
+func ConvertToWebPWithOptions(ctx context.Context, data []byte, opts ConvertOptions) ([]byte, error) {
+	conversionLog.Debug("Queuing WebP conversion task",
 		zap.Int("input_size", len(data)))
 
 	// Submit conversion task to worker pool and wait for result
-	return GetWorkerPool().ProcessTask(func() ([]byte, error) {
-		logger.Debug("Starting WebP conversion",
+	return GetWorkerPool().ProcessTaskContext(ctx, "convert.webp", func() ([]byte, error) {
+		conversionLog.Debug("Starting WebP conversion",
 			zap.Int("input_size", len(data)),
-			zap.Int("quality", cfg.ImageQuality),
-			zap.Int("speed", cfg.Speed))
+			zap.Int("quality", opts.Quality),
+			zap.Int("speed", opts.Speed),
+			zap.Bool("lossless", opts.Lossless))
 
 		// Detect image format
 		imgFormat, err := DetectImageFormat(data)
@@ -44,30 +131,34 @@ func ConvertToWebPWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
 			return nil, fmt.Errorf("failed to detect image format: %v", err)
 		}
 
-		// Return original data for GIF images
-		if imgFormat.Format == "gif" {
-			logger.Debug("GIF detected, skipping WebP conversion")
+		// Return original data for animations, which would lose every frame but the first
+		if IsAnimated(data) {
+			conversionLog.Debug("Animation detected, skipping WebP conversion",
+				zap.String("format", imgFormat.Format))
 			return data, nil
 		}
 
-		// Create bimg image object
-		img := bimg.NewImage(data)
-
 		options := bimg.Options{
-			Type:    bimg.WEBP,
-			Quality: cfg.ImageQuality,
-			Speed:   cfg.Speed,
+			Type:     bimg.WEBP,
+			Quality:  opts.Quality,
+			Speed:    opts.Speed,
+			Lossless: opts.Lossless,
+		}
+		if opts.Watermark != nil {
+			if options.WatermarkImage, err = watermarkImageOptions(data, opts.Watermark); err != nil {
+				return nil, err
+			}
 		}
 
-		// Perform conversion
-		result, err := img.Process(options)
+		// Perform conversion, verifying its output
+		result, err := processVerified(data, options)
 		if err != nil {
 			logger.Error("WebP conversion failed", zap.Error(err))
 			return nil, fmt.Errorf("webp conversion failed: %v", err)
 		}
 
 		compressionRatio := float64(len(result)) * 100 / float64(len(data))
-		logger.Info("WebP conversion completed",
+		conversionLog.Info("WebP conversion completed",
 			zap.Int("output_size", len(result)),
 			zap.Float64("compression_ratio", compressionRatio))
 
@@ -75,17 +166,17 @@ func ConvertToWebPWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
 	})
 }
 
-// ConvertToAVIFWithBimg converts image data to AVIF format using bimg/libvips
-func ConvertToAVIFWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
-	logger.Debug("Queuing AVIF conversion task",
+// ConvertToAVIFWithOptions converts image data to AVIF format with explicit encoder settings
+func ConvertToAVIFWithOptions(ctx context.Context, data []byte, opts ConvertOptions) ([]byte, error) {
+	conversionLog.Debug("Queuing AVIF conversion task",
 		zap.Int("input_size", len(data)))
 
 	// Submit conversion task to worker pool and wait for result
-	return GetWorkerPool().ProcessTask(func() ([]byte, error) {
-		logger.Debug("Starting AVIF conversion",
+	return GetWorkerPool().ProcessTaskContext(ctx, "convert.avif", func() ([]byte, error) {
+		conversionLog.Debug("Starting AVIF conversion",
 			zap.Int("input_size", len(data)),
-			zap.Int("quality", cfg.ImageQuality),
-			zap.Int("speed", cfg.Speed))
+			zap.Int("quality", opts.Quality),
+			zap.Int("speed", opts.Speed))
 
 		// Detect image format
 		imgFormat, err := DetectImageFormat(data)
@@ -94,30 +185,33 @@ func ConvertToAVIFWithBimg(data []byte, cfg *config.Config) ([]byte, error) {
 			return nil, fmt.Errorf("failed to detect image format: %v", err)
 		}
 
-		// Return original data for GIF images
-		if imgFormat.Format == "gif" {
-			logger.Debug("GIF detected, skipping AVIF conversion")
+		// Return original data for animations, which would lose every frame but the first
+		if IsAnimated(data) {
+			conversionLog.Debug("Animation detected, skipping AVIF conversion",
+				zap.String("format", imgFormat.Format))
 			return data, nil
 		}
 
-		// Create bimg image object
-		img := bimg.NewImage(data)
-
 		options := bimg.Options{
 			Type:    bimg.AVIF,
-			Quality: cfg.ImageQuality,
-			Speed:   cfg.Speed,
+			Quality: opts.Quality,
+			Speed:   opts.Speed,
+		}
+		if opts.Watermark != nil {
+			if options.WatermarkImage, err = watermarkImageOptions(data, opts.Watermark); err != nil {
+				return nil, err
+			}
 		}
 
-		// Perform conversion
-		result, err := img.Process(options)
+		// Perform conversion, verifying its output
+		result, err := processVerified(data, options)
 		if err != nil {
 			logger.Error("AVIF conversion failed", zap.Error(err))
 			return nil, fmt.Errorf("avif conversion failed: %v", err)
 		}
 
 		compressionRatio := float64(len(result)) * 100 / float64(len(data))
-		logger.Info("AVIF conversion completed",
+		conversionLog.Info("AVIF conversion completed",
 			zap.Int("output_size", len(result)),
 			zap.Float64("compression_ratio", compressionRatio))
 
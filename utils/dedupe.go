@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The content hash index maps the SHA-256 of uploaded bytes to the image stored from them
+func contentHashIndexKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "content_hash"
+}
+
+// ContentHash returns the SHA-256 (hex) of uploaded bytes, as recorded in metadata
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ContentHashFile is ContentHash for an upload spooled to a file, read without loading it
+func ContentHashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read upload: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// FindByContentHash returns the image stored from identical bytes, or nil when there is none.
+// Entries of deleted or expired images are ignored, those of deleted images removed. Without
+// Redis there is no index and uploads are never deduplicated.
+func FindByContentHash(ctx context.Context, hash string) (*ImageMetadata, error) {
+	if !IsRedisMetadataStore() {
+		return nil, nil
+	}
+	id, err := RedisClient.HGet(ctx, contentHashIndexKey(ctx), hash).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content hash index: %v", err)
+	}
+
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil || metadata.ContentHash != hash {
+		RedisClient.HDel(ctx, contentHashIndexKey(ctx), hash)
+		return nil, nil
+	}
+	if !metadata.ExpiryTime.IsZero() && metadata.ExpiryTime.Before(time.Now()) {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// RemoveContentHash removes an image from the content hash index, unless an identical image
+// stored later took its place
+func RemoveContentHash(ctx context.Context, metadata *ImageMetadata) error {
+	if metadata.ContentHash == "" {
+		return nil
+	}
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	id, err := RedisClient.HGet(ctx, contentHashIndexKey(ctx), metadata.ContentHash).Result()
+	if err == redis.Nil || (err == nil && id != metadata.ID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return RedisClient.HDel(ctx, contentHashIndexKey(ctx), metadata.ContentHash).Err()
+}
@@ -1,9 +1,20 @@
 package utils
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
 )
 
 type DeviceType int
@@ -16,36 +27,174 @@ const (
 // String constants for device types
 const (
 	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceTV      = "tv"
 	DeviceDesktop = "desktop"
 )
 
+// deviceTypes are the device types rules and the device query parameter may name
+var deviceTypes = []string{DeviceMobile, DeviceTablet, DeviceTV, DeviceDesktop}
+
+// IsDeviceType reports whether a string names a device type
+func IsDeviceType(deviceType string) bool {
+	return slices.Contains(deviceTypes, deviceType)
+}
+
+// DeviceRule classifies User-Agents matching its pattern as a device type, ahead of the
+// built-in detection
+type DeviceRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"` // Regular expression matched case-insensitively against the User-Agent
+	Device  string `json:"device"`  // mobile, tablet, tv or desktop
+
+	regex *regexp.Regexp
+}
+
+// deviceCacheSize bounds the number of classified User-Agents kept; the cache is emptied when full
+const deviceCacheSize = 10000
+
 var (
-	mobileRegex = regexp.MustCompile(`(?i)(android|webos|iphone|ipad|ipod|blackberry|windows phone)`)
+	deviceRules   []*DeviceRule
+	deviceCache   = make(map[string]string)
+	deviceCacheMu sync.RWMutex
 )
 
-// DetectDevice returns the DeviceType enum (Mobile or Desktop) based on User-Agent
+// InitDeviceRules loads the device rules file of the configuration. A missing file leaves
+// only the built-in detection.
+func InitDeviceRules(cfg *config.Config) error {
+	rules, err := loadDeviceRules(cfg.DeviceRulesFile)
+	if err != nil {
+		return err
+	}
+
+	deviceRules = rules
+	deviceCacheMu.Lock()
+	deviceCache = make(map[string]string)
+	deviceCacheMu.Unlock()
+	if len(rules) > 0 {
+		logger.Info("Loaded device rules",
+			zap.Int("rules", len(rules)))
+	}
+	return nil
+}
+
+func loadDeviceRules(path string) ([]*DeviceRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device rules file: %v", err)
+	}
+
+	var file struct {
+		Rules []*DeviceRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse device rules file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range file.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("device rule without a name")
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate device rule: %s", rule.Name)
+		}
+		seen[rule.Name] = true
+		if !IsDeviceType(rule.Device) {
+			return nil, fmt.Errorf("device rule %s: invalid device %q: use mobile, tablet, tv or desktop", rule.Name, rule.Device)
+		}
+		regex, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("device rule %s: invalid pattern %q", rule.Name, rule.Pattern)
+		}
+		rule.regex = regex
+	}
+	return file.Rules, nil
+}
+
+// DetectDevice returns the DeviceType enum (Mobile or Desktop) based on User-Agent. Tablets
+// count as mobile devices and TVs as desktops.
 func DetectDevice(r *http.Request) DeviceType {
-	userAgent := r.Header.Get("User-Agent")
-	if mobileRegex.MatchString(userAgent) {
+	switch GetDeviceTypeFromUserAgent(r.Header.Get("User-Agent")) {
+	case DeviceMobile, DeviceTablet:
 		return Mobile
 	}
 	return Desktop
 }
 
-// DetectDeviceType returns a string identifier ("mobile" or "desktop") based on User-Agent
+// DetectDeviceType returns a string identifier ("mobile", "tablet", "tv" or "desktop") based on
+// User-Agent. A device type named by the device query parameter overrides the detection.
 func DetectDeviceType(r *http.Request) string {
+	if device := strings.ToLower(r.URL.Query().Get("device")); IsDeviceType(device) {
+		return device
+	}
+
 	// Detect device type from User-Agent
 	userAgent := r.Header.Get("User-Agent")
 	return GetDeviceTypeFromUserAgent(userAgent)
 }
 
-// GetDeviceTypeFromUserAgent extracts device type from a User-Agent string
+// GetDeviceTypeFromUserAgent extracts device type from a User-Agent string with the device
+// rules, falling back to the built-in detection. Results are cached per User-Agent.
 func GetDeviceTypeFromUserAgent(userAgent string) string {
+	deviceCacheMu.RLock()
+	deviceType, ok := deviceCache[userAgent]
+	deviceCacheMu.RUnlock()
+	if ok {
+		return deviceType
+	}
+
+	deviceType = classifyUserAgent(userAgent)
+	deviceCacheMu.Lock()
+	if len(deviceCache) >= deviceCacheSize {
+		deviceCache = make(map[string]string)
+	}
+	deviceCache[userAgent] = deviceType
+	deviceCacheMu.Unlock()
+	return deviceType
+}
+
+// classifyUserAgent applies the first matching device rule, or the built-in detection. TVs
+// are checked first, as their browsers often claim to run on Android or Linux.
+func classifyUserAgent(userAgent string) string {
+	for _, rule := range deviceRules {
+		if rule.regex.MatchString(userAgent) {
+			return rule.Device
+		}
+	}
+
 	userAgent = strings.ToLower(userAgent)
+	tvPlatforms := []string{
+		"smart-tv", "smarttv", "googletv", "google tv", "android tv", "appletv", "apple tv",
+		"hbbtv", "netcast", "web0s", "roku", "bravia", "crkey", "aftb", "aftm", "aftt", "afts",
+	}
+	tabletPlatforms := []string{
+		"ipad", "tablet", "kindle", "silk/", "playbook",
+	}
 	mobilePlatforms := []string{
-		"android", "webos", "iphone", "ipad", "ipod", "blackberry", "windows phone",
+		"android", "webos", "iphone", "ipod", "blackberry", "windows phone",
 	}
 
+	for _, platform := range tvPlatforms {
+		if strings.Contains(userAgent, platform) {
+			return DeviceTV
+		}
+	}
+	for _, platform := range tabletPlatforms {
+		if strings.Contains(userAgent, platform) {
+			return DeviceTablet
+		}
+	}
+	// Android tablets leave "mobile" out of their User-Agent
+	if strings.Contains(userAgent, "android") && !strings.Contains(userAgent, "mobile") {
+		return DeviceTablet
+	}
 	for _, platform := range mobilePlatforms {
 		if strings.Contains(userAgent, platform) {
 			return DeviceMobile
@@ -53,3 +202,73 @@ func GetDeviceTypeFromUserAgent(userAgent string) string {
 	}
 	return DeviceDesktop
 }
+
+// DeviceOrientation returns the orientation of the images served to a device type: portrait
+// for phones and tablets, landscape for desktops and TVs
+func DeviceOrientation(deviceType string) string {
+	if deviceType == DeviceMobile || deviceType == DeviceTablet {
+		return "portrait"
+	}
+	return "landscape"
+}
+
+// DeviceHints are the client hints used to size images to the client's screen, announced in
+// Accept-CH so browsers send them on following requests
+const DeviceHints = "Sec-CH-DPR, Sec-CH-Viewport-Width"
+
+// deviceViewportWidths are the CSS pixel widths assumed for each device type when the client
+// sends no viewport width hint
+var deviceViewportWidths = map[string]int{
+	DeviceMobile:  412,
+	DeviceTablet:  820,
+	DeviceDesktop: 1920,
+	DeviceTV:      1920,
+}
+
+// deviceWidthSteps are the widths images are sized to for devices. Rounding up to them keeps
+// the number of cached resized variants small.
+var deviceWidthSteps = []int{640, 960, 1280, 1920, 2560, 3840}
+
+// ClientDPR returns the device pixel ratio sent in the Sec-CH-DPR or DPR client hint, between
+// 1 and 4, or 1 when none is sent
+func ClientDPR(r *http.Request) float64 {
+	for _, header := range []string{"Sec-CH-DPR", "DPR"} {
+		if dpr, err := strconv.ParseFloat(r.Header.Get(header), 64); err == nil && dpr > 0 {
+			return math.Min(math.Max(dpr, 1), 4)
+		}
+	}
+	return 1
+}
+
+// clientViewportWidth returns the viewport width in CSS pixels sent in the Sec-CH-Viewport-Width
+// or Viewport-Width client hint, or 0 when none is sent
+func clientViewportWidth(r *http.Request) int {
+	for _, header := range []string{"Sec-CH-Viewport-Width", "Viewport-Width"} {
+		if width, err := strconv.Atoi(r.Header.Get(header)); err == nil && width > 0 {
+			return width
+		}
+	}
+	return 0
+}
+
+// DeviceResizeOptions returns the resize fitting an image to the client's screen: its viewport
+// width, or the typical width of its device type, times its pixel ratio, rounded up to the next
+// width step and bounded by maxDimension
+func DeviceResizeOptions(r *http.Request, deviceType string, maxDimension int) ResizeOptions {
+	width := clientViewportWidth(r)
+	if width == 0 {
+		width = deviceViewportWidths[deviceType]
+	}
+	if width == 0 {
+		width = deviceViewportWidths[DeviceDesktop]
+	}
+
+	target := int(math.Ceil(float64(width) * ClientDPR(r)))
+	for _, step := range deviceWidthSteps {
+		if step >= target {
+			target = step
+			break
+		}
+	}
+	return ResizeOptions{Width: min(target, maxDimension), Fit: FitContain}
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// EmbeddingClient talks to an external embedding model service (e.g. CLIP) that maps images
+// and text into the same vector space.
+//
+// The service receives POST {"image": "<base64>"} or {"text": "..."} and answers
+// {"embedding": [float, ...]}.
+type EmbeddingClient struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// Embedder is the configured embedding client, nil when semantic search is disabled
+var Embedder *EmbeddingClient
+
+// SemanticMatch is a library image matching a semantic query
+type SemanticMatch struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"` // Cosine similarity between the query and the image (-1 to 1)
+}
+
+type embeddingRequest struct {
+	Image string `json:"image,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+type embeddingResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+func embeddingIndexKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "embeddings"
+}
+
+// InitEmbeddingClient configures the embedding client when an embedding service is set
+func InitEmbeddingClient(cfg *config.Config) {
+	if cfg.EmbeddingServiceURL == "" {
+		return
+	}
+
+	Embedder = &EmbeddingClient{
+		url:    cfg.EmbeddingServiceURL,
+		apiKey: cfg.EmbeddingAPIKey,
+		client: &http.Client{Timeout: time.Duration(cfg.EmbeddingTimeout) * time.Second},
+	}
+	logger.Info("Semantic search enabled",
+		zap.String("embedding_service", cfg.EmbeddingServiceURL))
+}
+
+// SemanticSearchEnabled reports whether embeddings can be computed and stored
+func SemanticSearchEnabled() bool {
+	return Embedder != nil && IsRedisMetadataStore() && FeatureEnabled(FeatureSemanticSearch)
+}
+
+// EmbedImage computes the embedding of an encoded image
+func (c *EmbeddingClient) EmbedImage(ctx context.Context, data []byte) ([]float32, error) {
+	return c.embed(ctx, embeddingRequest{Image: base64.StdEncoding.EncodeToString(data)})
+}
+
+// EmbedText computes the embedding of a text query
+func (c *EmbeddingClient) EmbedText(ctx context.Context, text string) ([]float32, error) {
+	return c.embed(ctx, embeddingRequest{Text: text})
+}
+
+func (c *EmbeddingClient) embed(ctx context.Context, body embeddingRequest) ([]float32, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embedding request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedding request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embedding service request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embedding service returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var result embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embedding response: %v", err)
+	}
+	if len(result.Embedding) == 0 {
+		return nil, fmt.Errorf("embedding service returned an empty vector")
+	}
+	return normalizeVector(result.Embedding), nil
+}
+
+// normalizeVector scales a vector to unit length so cosine similarity is a dot product
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+func encodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(x))
+	}
+	return buf
+}
+
+func decodeVector(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
+
+// StoreImageEmbedding saves the embedding of an image
+func StoreImageEmbedding(ctx context.Context, id string, vector []float32) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HSet(ctx, embeddingIndexKey(ctx), id, encodeVector(vector)).Err()
+}
+
+// DeleteImageEmbedding removes the embedding of an image
+func DeleteImageEmbedding(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HDel(ctx, embeddingIndexKey(ctx), id).Err()
+}
+
+// IndexImageEmbedding computes and stores the embedding of an image. It is a no-op when
+// semantic search is disabled.
+func IndexImageEmbedding(ctx context.Context, id string, data []byte) error {
+	if !SemanticSearchEnabled() {
+		return nil
+	}
+	vector, err := Embedder.EmbedImage(ctx, data)
+	if err != nil {
+		return err
+	}
+	return StoreImageEmbedding(ctx, id, vector)
+}
+
+// SearchEmbeddings returns the images whose embeddings are most similar to the query vector.
+// Vectors are compared exhaustively, which stays fast for libraries of tens of thousands of images.
+func SearchEmbeddings(ctx context.Context, query []float32, minScore float64, limit int) ([]SemanticMatch, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	vectors, err := RedisClient.HGetAll(ctx, embeddingIndexKey(ctx)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embeddings: %v", err)
+	}
+
+	matches := make([]SemanticMatch, 0)
+	for id, raw := range vectors {
+		vector := decodeVector([]byte(raw))
+		if len(vector) != len(query) {
+			// Stored with a different model; skipped until re-indexed
+			continue
+		}
+		var score float64
+		for i := range query {
+			score += float64(query[i]) * float64(vector[i])
+		}
+		if score >= minScore {
+			matches = append(matches, SemanticMatch{ID: id, Score: score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// BackfillEmbeddings computes embeddings for images that do not have one yet
+func BackfillEmbeddings(ctx context.Context) error {
+	if !SemanticSearchEnabled() {
+		return nil
+	}
+
+	ids, err := GetAllImageIDs(ctx)
+	if err != nil {
+		return err
+	}
+	indexed, err := RedisClient.HKeys(ctx, embeddingIndexKey(ctx)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read embeddings: %v", err)
+	}
+	seen := make(map[string]bool, len(indexed))
+	for _, id := range indexed {
+		seen[id] = true
+	}
+
+	embedded := 0
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		metadata, err := MetadataManager.GetMetadata(ctx, id)
+		if err != nil {
+			continue
+		}
+		key, err := ResolveImageKey(ctx, metadata.Paths.Original)
+		if err != nil {
+			continue
+		}
+		data, err := Storage.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+		if err := IndexImageEmbedding(ctx, id, data); err != nil {
+			// The service is likely unavailable; retry on next start
+			return fmt.Errorf("failed to embed %s: %v", id, err)
+		}
+		embedded++
+	}
+
+	if embedded > 0 {
+		logger.Info("Backfilled image embeddings", zap.Int("images", embedded))
+	}
+	return nil
+}
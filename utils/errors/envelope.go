@@ -0,0 +1,207 @@
+package errors
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader carries the ID of a request, taken from the client when it sends a usable
+// one and generated otherwise
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 64
+
+// Envelope is the shape of every JSON response of the versioned API: the response body in
+// Data on success, the error in Error otherwise, and the request ID and pagination in Meta
+type Envelope struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *ErrorResponse  `json:"error,omitempty"`
+	Meta  Meta            `json:"meta"`
+}
+
+// Meta describes the request an envelope answers
+type Meta struct {
+	RequestID  string      `json:"requestId"`
+	Pagination *Pagination `json:"pagination,omitempty"` // Set by list endpoints through WritePage
+}
+
+// Pagination describes the page of a list response
+type Pagination struct {
+	Page       int `json:"page"`
+	Limit      int `json:"limit"`
+	Total      int `json:"total"`
+	TotalPages int `json:"totalPages"`
+}
+
+// RequestID returns the ID of a request: its X-Request-Id header when it is made of at most 64
+// letters, digits, dashes and underscores, else a random ID
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" && len(id) <= maxRequestIDLength && isRequestIDToken(id) {
+		return id
+	}
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func isRequestIDToken(id string) bool {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// envelopeWriter buffers the JSON responses of a request to send them in an Envelope. Other
+// responses (images, CSS, tus uploads) pass through unchanged.
+type envelopeWriter struct {
+	http.ResponseWriter
+	requestID   string
+	status      int
+	wroteHeader bool
+	buffering   bool
+	body        bytes.Buffer
+	pagination  *Pagination
+}
+
+// WrapEnvelope makes the JSON responses written to the returned writer be sent in an Envelope
+// carrying requestID, which is also set as the X-Request-Id response header. The returned
+// function sends the buffered envelope and must be called once the handler returned.
+func WrapEnvelope(w http.ResponseWriter, requestID string) (http.ResponseWriter, func()) {
+	w.Header().Set(RequestIDHeader, requestID)
+	ew := &envelopeWriter{ResponseWriter: w, requestID: requestID}
+	return ew, ew.finish
+}
+
+func (w *envelopeWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType == "application/json" && code != http.StatusNoContent && code != http.StatusNotModified {
+		w.buffering = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *envelopeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes through responses that are not enveloped; enveloped ones are sent by finish
+func (w *envelopeWriter) Flush() {
+	if !w.buffering {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *envelopeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends the buffered JSON response in its envelope. Success bodies become the data,
+// without their redundant "success" field; error bodies become the error, those not written by
+// WriteError keeping their body as the details.
+func (w *envelopeWriter) finish() {
+	if !w.buffering {
+		return
+	}
+	envelope := Envelope{Meta: Meta{RequestID: w.requestID, Pagination: w.pagination}}
+	body := bytes.TrimSpace(w.body.Bytes())
+	if w.status >= http.StatusBadRequest {
+		var errResp ErrorResponse
+		if json.Unmarshal(body, &errResp) != nil || errResp.Message == "" {
+			errResp = ErrorResponse{Code: statusErrorCode(w.status), Message: http.StatusText(w.status)}
+			if json.Valid(body) {
+				errResp.Details = json.RawMessage(body)
+			}
+		}
+		envelope.Error = &errResp
+	} else if json.Valid(body) {
+		envelope.Data = withoutSuccessField(body)
+	}
+
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	if err := json.NewEncoder(w.ResponseWriter).Encode(envelope); err != nil {
+		logger.Debug("Failed to write response envelope", zap.Error(err))
+	}
+}
+
+// withoutSuccessField drops the "success" field of an object, which the envelope replaces
+func withoutSuccessField(body []byte) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+	if _, ok := fields["success"]; !ok {
+		return body
+	}
+	delete(fields, "success")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return data
+}
+
+// statusErrorCode maps an HTTP status back to the error code reported for it
+func statusErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrInvalidParam
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return ErrInternal
+	}
+}
+
+// envelopeOf returns the envelope writer a response is written through, if any
+func envelopeOf(w http.ResponseWriter) *envelopeWriter {
+	for {
+		switch rw := w.(type) {
+		case *envelopeWriter:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// WritePage writes a page of a list. Enveloped responses carry the items as their data and the
+// pagination in their meta; other responses get the legacy body.
+func WritePage(w http.ResponseWriter, legacy interface{}, items interface{}, page Pagination) error {
+	body := legacy
+	if ew := envelopeOf(w); ew != nil {
+		ew.pagination = &page
+		body = items
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(body)
+}
@@ -16,6 +16,8 @@ const (
 	ErrUnauthorized ErrorCode = 1002 // Unauthorized
 	ErrForbidden    ErrorCode = 1003 // Forbidden
 	ErrNotFound     ErrorCode = 1004 // Resource not found
+	ErrTooLarge     ErrorCode = 1005 // Request or uploaded file too large
+	ErrUnavailable  ErrorCode = 1006 // Server saturated, retry later
 
 	ErrImageProcess ErrorCode = 2000 // Image processing error
 	ErrImageUpload  ErrorCode = 2001 // Image upload error
@@ -30,6 +32,13 @@ type ErrorResponse struct {
 	Details interface{} `json:"details,omitempty"` // Error details
 }
 
+// FieldError describes why a request parameter was rejected
+type FieldError struct {
+	Field   string `json:"field"`           // Name of the parameter
+	Message string `json:"message"`         // What a valid value looks like
+	Value   string `json:"value,omitempty"` // The rejected value
+}
+
 func (code ErrorCode) HTTPError() int {
 	switch code {
 	case ErrInvalidParam:
@@ -40,6 +49,10 @@ func (code ErrorCode) HTTPError() int {
 		return http.StatusForbidden
 	case ErrNotFound:
 		return http.StatusNotFound
+	case ErrTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable
 	default:
 		return http.StatusInternalServerError
 	}
@@ -53,6 +66,12 @@ func NewError(code ErrorCode, message string, details interface{}) *ErrorRespons
 	}
 }
 
+// NewValidationError reports invalid request parameters, listing every rejected field in the
+// details
+func NewValidationError(fields []FieldError) *ErrorResponse {
+	return NewError(ErrInvalidParam, "Invalid parameters", fields)
+}
+
 func WriteError(w http.ResponseWriter, err *ErrorResponse) {
 	logFields := []zap.Field{
 		zap.Int("error_code", int(err.Code)),
@@ -65,8 +84,10 @@ func WriteError(w http.ResponseWriter, err *ErrorResponse) {
 	switch err.Code {
 	case ErrInternal, ErrImageProcess, ErrImageUpload, ErrImageDelete, ErrImageList, ErrMetadata:
 		logger.Error("Internal server error occurred", logFields...)
-	case ErrInvalidParam:
+	case ErrInvalidParam, ErrTooLarge:
 		logger.Warn("Invalid parameter error", logFields...)
+	case ErrUnavailable:
+		logger.Warn("Server saturated", logFields...)
 	case ErrUnauthorized, ErrForbidden, ErrNotFound:
 		logger.Info("Access control error", logFields...)
 	default:
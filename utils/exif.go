@@ -0,0 +1,320 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Metadata stripping works on the containers of JPEG, PNG and WebP directly, so originals are
+// stored without re-encoding. Other formats are stored unchanged.
+
+// StripEXIF removes EXIF, XMP and other embedded metadata that may reveal where, when or by
+// whom a photo was taken (GPS coordinates, camera serials, comments) from JPEG, PNG and WebP
+// images. Color profiles are kept. With keepOrientation, an EXIF orientation other than the
+// default is written back on its own, so rotated photos still display upright.
+func StripEXIF(data []byte, keepOrientation bool) ([]byte, error) {
+	switch {
+	case len(data) > 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return stripJPEGMetadata(data, keepOrientation)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNGMetadata(data, keepOrientation)
+	case len(data) > 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebPMetadata(data, keepOrientation)
+	}
+	return data, nil
+}
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader   = []byte("Exif\x00\x00")
+	xmpHeader    = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// EXIFOrientation returns the EXIF orientation (1-8) of a JPEG, PNG or WebP image, or 0 when it
+// has none
+func EXIFOrientation(data []byte) int {
+	tiff, _ := findEXIF(data)
+	return exifOrientation(tiff)
+}
+
+// resetEXIFOrientation marks a JPEG, PNG or WebP image as upright in its EXIF data, in place
+func resetEXIFOrientation(data []byte) {
+	tiff, pngChunk := findEXIF(data)
+	offset, order := exifOrientationOffset(tiff)
+	if offset < 0 {
+		return
+	}
+	order.PutUint16(tiff[offset:], 1)
+	if pngChunk >= 0 {
+		// The CRC of a PNG chunk covers its type and data
+		length := int(binary.BigEndian.Uint32(data[pngChunk:]))
+		crc := crc32.ChecksumIEEE(data[pngChunk+4 : pngChunk+8+length])
+		binary.BigEndian.PutUint32(data[pngChunk+8+length:], crc)
+	}
+}
+
+// findEXIF returns the TIFF-structured EXIF data of a JPEG, PNG or WebP image as a slice of the
+// image data, or nil. For PNGs the offset of the eXIf chunk is returned as well, -1 otherwise.
+func findEXIF(data []byte) ([]byte, int) {
+	switch {
+	case len(data) > 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return jpegEXIF(data[2:]), -1
+	case bytes.HasPrefix(data, pngSignature):
+		for pos := len(pngSignature); pos+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			if pos+12+length > len(data) {
+				break
+			}
+			if string(data[pos+4:pos+8]) == "eXIf" {
+				return data[pos+8 : pos+8+length], pos
+			}
+			pos += 12 + length
+		}
+	case len(data) > 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		for pos := 12; pos+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+			if pos+8+size > len(data) {
+				break
+			}
+			if string(data[pos:pos+4]) == "EXIF" {
+				return bytes.TrimPrefix(data[pos+8:pos+8+size], exifHeader), -1
+			}
+			pos += 8 + size + size%2
+		}
+	}
+	return nil, -1
+}
+
+// exifOrientation returns the orientation (1-8) stored in the first IFD of TIFF-structured
+// EXIF data, or 0 when there is none
+func exifOrientation(tiff []byte) int {
+	offset, order := exifOrientationOffset(tiff)
+	if offset < 0 {
+		return 0
+	}
+	if value := int(order.Uint16(tiff[offset:])); value >= 1 && value <= 8 {
+		return value
+	}
+	return 0
+}
+
+// exifOrientationOffset returns the offset of the orientation value in TIFF-structured EXIF
+// data and the byte order of the data, or -1 when there is no orientation
+func exifOrientationOffset(tiff []byte) (int, binary.ByteOrder) {
+	if len(tiff) < 8 {
+		return -1, nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return -1, nil
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return -1, nil
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return -1, nil
+		}
+		// Orientation is tag 0x0112, a single SHORT stored in the entry itself
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return entry + 8, order
+		}
+	}
+	return -1, nil
+}
+
+// orientationTIFF returns minimal TIFF-structured EXIF data holding only an orientation
+func orientationTIFF(orientation int) []byte {
+	tiff := make([]byte, 26)
+	copy(tiff, "MM\x00\x2a")
+	binary.BigEndian.PutUint32(tiff[4:], 8)                    // Offset of the first IFD
+	binary.BigEndian.PutUint16(tiff[8:], 1)                    // One entry
+	binary.BigEndian.PutUint16(tiff[10:], 0x0112)              // Orientation
+	binary.BigEndian.PutUint16(tiff[12:], 3)                   // SHORT
+	binary.BigEndian.PutUint32(tiff[14:], 1)                   // One value
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation)) // Value, padded to 4 bytes
+	return tiff                                                // Next IFD offset 0 ends the chain
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF, XMP), APP13 (IPTC) and COM segments of a JPEG,
+// keeping everything from the start of scan on as is
+func stripJPEGMetadata(data []byte, keepOrientation bool) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	pos := 2
+	wroteOrientation := !keepOrientation
+	for {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG segment at offset %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte before a marker
+			pos++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, fmt.Errorf("invalid JPEG segment length at offset %d", pos)
+		}
+		segment := data[pos : pos+2+length]
+		payload := segment[4:]
+
+		// The orientation goes after the JFIF header, where EXIF is expected
+		if !wroteOrientation && marker != 0xE0 {
+			if orientation := exifOrientation(jpegEXIF(data[pos:])); orientation > 1 {
+				exif := append(append([]byte{}, exifHeader...), orientationTIFF(orientation)...)
+				out.Write([]byte{0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)})
+				out.Write(exif)
+			}
+			wroteOrientation = true
+		}
+
+		switch {
+		case marker == 0xDA:
+			// Start of scan: the compressed data and everything after it is kept
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		case marker == 0xE1 && (bytes.HasPrefix(payload, exifHeader) || bytes.HasPrefix(payload, xmpHeader)),
+			marker == 0xED, marker == 0xFE:
+		default:
+			out.Write(segment)
+		}
+		pos += 2 + length
+	}
+}
+
+// jpegEXIF returns the TIFF-structured EXIF data of the JPEG segments starting at data, or nil
+func jpegEXIF(data []byte) []byte {
+	for pos := 0; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			return nil
+		}
+		payload := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			return payload[len(exifHeader):]
+		}
+		pos += 2 + length
+	}
+	return nil
+}
+
+// stripPNGMetadata drops the eXIf and text chunks (tEXt, zTXt, iTXt, which hold XMP and
+// comments) of a PNG
+func stripPNGMetadata(data []byte, keepOrientation bool) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	orientation := 0
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk at offset %d", pos)
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+length > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk length at offset %d", pos)
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		chunk := data[pos : pos+12+length]
+		pos += 12 + length
+
+		switch chunkType {
+		case "eXIf":
+			orientation = exifOrientation(chunk[8 : 8+length])
+		case "tEXt", "zTXt", "iTXt":
+		case "IDAT", "IEND":
+			// eXIf precedes the image data, so it is known by the first IDAT chunk
+			if keepOrientation && orientation > 1 {
+				writePNGChunk(out, "eXIf", orientationTIFF(orientation))
+				orientation = 0
+			}
+			out.Write(chunk)
+		default:
+			out.Write(chunk)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	out.WriteString(chunkType)
+	out.Write(payload)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of an extended WebP and clears their flags
+// in the VP8X header
+func stripWebPMetadata(data []byte, keepOrientation bool) ([]byte, error) {
+	const exifFlag, xmpFlag = 0x08, 0x04
+
+	var chunks [][]byte
+	orientation := 0
+	vp8x := -1
+	limit := min(len(data), 8+int(binary.LittleEndian.Uint32(data[4:8])))
+	for pos := 12; pos < limit; {
+		if pos+8 > limit {
+			return nil, fmt.Errorf("invalid WebP chunk at offset %d", pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2 // Chunks are padded to an even size
+		if end > limit {
+			return nil, fmt.Errorf("invalid WebP chunk size at offset %d", pos)
+		}
+		chunk := data[pos:end]
+		pos = end
+
+		switch string(chunk[0:4]) {
+		case "EXIF":
+			payload := chunk[8 : 8+size]
+			orientation = exifOrientation(bytes.TrimPrefix(payload, exifHeader))
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(chunks)
+			chunks = append(chunks, append([]byte{}, chunk...))
+		default:
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	// Simple WebPs have no VP8X header and therefore no metadata chunks
+	if vp8x < 0 {
+		return data, nil
+	}
+	chunks[vp8x][8] &^= exifFlag | xmpFlag
+	if keepOrientation && orientation > 1 {
+		chunks[vp8x][8] |= exifFlag
+		exif := make([]byte, 8, 8+26)
+		copy(exif, "EXIF")
+		binary.LittleEndian.PutUint32(exif[4:], 26)
+		chunks = append(chunks, append(exif, orientationTIFF(orientation)...))
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.Write(chunk)
+	}
+	out := bytes.NewBuffer(make([]byte, 0, 8+body.Len()))
+	out.WriteString("RIFF")
+	binary.Write(out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// expiryClaimTTL bounds how long an instance holds the claim on deleting an expired image, so
+// an instance stopping mid-deletion leaves the image to the periodic cleanup
+const expiryClaimTTL = time.Minute
+
+// expiryNotifications is whether new metadata gets an expiring shadow key
+var expiryNotifications bool
+
+// expiryShadowKey returns the key Redis expires at an image's expiry time. Its expiration event
+// triggers the deletion of the image.
+func expiryShadowKey(ctx context.Context, id string) string {
+	return KeyPrefix(ctx) + "expires:" + id
+}
+
+// enableExpiredEvents makes sure Redis publishes expired key events, keeping any notification
+// classes already enabled on the server
+func enableExpiredEvents(ctx context.Context) error {
+	current, err := RedisClient.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	flags := current["notify-keyspace-events"]
+	missing := ""
+	if !strings.Contains(flags, "E") {
+		missing += "E"
+	}
+	if !strings.Contains(flags, "x") && !strings.Contains(flags, "A") {
+		missing += "x"
+	}
+	if missing == "" {
+		return nil
+	}
+	return RedisClient.ConfigSet(ctx, "notify-keyspace-events", flags+missing).Err()
+}
+
+// parseExpiryShadowKey returns the tenant context and image ID of an expired shadow key
+func parseExpiryShadowKey(ctx context.Context, key string) (context.Context, string, bool) {
+	rest, ok := strings.CutPrefix(key, RedisPrefix)
+	if !ok {
+		return nil, "", false
+	}
+	if tenantRest, ok := strings.CutPrefix(rest, "tenant:"); ok {
+		tenantID, after, found := strings.Cut(tenantRest, ":")
+		if !found {
+			return nil, "", false
+		}
+		tenant, err := GetTenant(ctx, tenantID)
+		if err != nil {
+			logger.Warn("Ignoring expired image of unknown tenant",
+				zap.String("tenant", tenantID),
+				zap.Error(err))
+			return nil, "", false
+		}
+		ctx = WithTenant(ctx, tenant)
+		rest = after
+	}
+	id, ok := strings.CutPrefix(rest, "expires:")
+	if !ok || id == "" {
+		return nil, "", false
+	}
+	return ctx, id, true
+}
+
+// WatchExpiryNotifications subscribes to the expired key events of the configured Redis
+// database until the context is cancelled, deleting each image as soon as its shadow key
+// expires. Every instance receives the events; a short-lived claim makes sure only one of them
+// deletes a given image.
+func WatchExpiryNotifications(ctx context.Context, cfg *config.Config) {
+	if err := enableExpiredEvents(ctx); err != nil {
+		logger.Warn("Failed to enable Redis expired events; set notify-keyspace-events to Ex on the server",
+			zap.Error(err))
+	}
+
+	channel := fmt.Sprintf("__keyevent@%d__:expired", cfg.RedisDB)
+	pubsub := RedisClient.Subscribe(ctx, channel)
+	logger.Info("Watching Redis expiry notifications",
+		zap.String("channel", channel))
+
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				tenantCtx, id, ok := parseExpiryShadowKey(ctx, msg.Payload)
+				if !ok {
+					continue
+				}
+				cleanExpiredImage(tenantCtx, id)
+			}
+		}
+	}()
+}
+
+// cleanExpiredImage deletes an image whose shadow key expired, unless another instance already
+// claimed it or its expiry was extended in the meantime
+func cleanExpiredImage(ctx context.Context, id string) {
+	claimed, err := RedisClient.SetNX(ctx, KeyPrefix(ctx)+"expiring:"+id, 1, expiryClaimTTL).Result()
+	if err != nil {
+		logger.Warn("Failed to claim expired image",
+			zap.String("id", id),
+			zap.Error(err))
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		// Usually already deleted, by the periodic cleanup or a user
+		logger.Debug("Skipping expiry notification",
+			zap.String("id", id),
+			zap.Error(err))
+		return
+	}
+	if metadata.ExpiryTime.IsZero() || metadata.ExpiryTime.After(time.Now()) {
+		return
+	}
+
+	deleteExpiredImage(ctx, metadata)
+	if err := InvalidateImagePages(ctx, metadata); err != nil {
+		logger.Warn("Failed to clear page cache",
+			zap.Error(err))
+	}
+	logger.Info("Deleted expired image on expiry notification",
+		zap.String("id", id))
+}
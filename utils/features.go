@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Feature flags gating optional subsystems
+const (
+	FeatureSemanticSearch   = "semantic_search"
+	FeatureOCR              = "ocr"
+	FeatureImageSearch      = "image_search"
+	FeatureUploadURL        = "upload_url"
+	FeatureResumableUploads = "resumable_uploads"
+	FeatureWasmPlugins      = "wasm_plugins"
+	FeatureUploadWidget     = "upload_widget"
+)
+
+// FeatureFlag describes a subsystem that can be switched off per deployment
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"` // Built-in state when neither FEATURE_FLAGS nor a runtime toggle sets it
+}
+
+// FeatureFlags lists every known flag. New experimental subsystems register their flag here
+// and check FeatureEnabled before running.
+var FeatureFlags = []FeatureFlag{
+	{FeatureSemanticSearch, "Compute image embeddings and serve semantic search", true},
+	{FeatureOCR, "Extract text from uploads for text search", true},
+	{FeatureImageSearch, "Search the library by a sample image", true},
+	{FeatureUploadURL, "Import images from remote URLs at /api/upload-url", true},
+	{FeatureResumableUploads, "Resumable uploads over the tus protocol at /api/uploads", true},
+	{FeatureWasmPlugins, "Run the WASM transform and tag plugins on uploads", true},
+	{FeatureUploadWidget, "Embeddable upload widget at /api/widget.js, uploading with widget tokens", true},
+}
+
+// FeatureFlagState is a flag with its effective state and where the state comes from
+type FeatureFlagState struct {
+	FeatureFlag
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"` // default, config or runtime
+}
+
+// featureRefreshInterval bounds how long runtime toggles made on another instance take to apply
+const featureRefreshInterval = 30 * time.Second
+
+var (
+	featureConfig    map[string]bool // FEATURE_FLAGS
+	featureMu        sync.Mutex
+	featureOverrides map[string]bool // Runtime toggles persisted in Redis
+	featureLoaded    time.Time
+)
+
+func featureFlagsKey() string {
+	return RedisPrefix + "feature_flags"
+}
+
+func findFeatureFlag(name string) (FeatureFlag, bool) {
+	for _, flag := range FeatureFlags {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return FeatureFlag{}, false
+}
+
+// InitFeatureFlags applies the flags set in the configuration, rejecting unknown names
+func InitFeatureFlags(cfg *config.Config) error {
+	for name := range cfg.FeatureFlags {
+		if _, ok := findFeatureFlag(name); !ok {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+	}
+	featureConfig = cfg.FeatureFlags
+
+	for _, state := range FeatureFlagStates(context.Background()) {
+		if !state.Enabled {
+			logger.Info("Feature disabled",
+				zap.String("feature", state.Name),
+				zap.String("source", state.Source))
+		}
+	}
+	return nil
+}
+
+// runtimeFeatureOverrides returns the runtime toggles, reloading them from Redis when stale
+func runtimeFeatureOverrides(ctx context.Context) map[string]bool {
+	featureMu.Lock()
+	defer featureMu.Unlock()
+
+	if !IsRedisMetadataStore() || time.Since(featureLoaded) < featureRefreshInterval {
+		return featureOverrides
+	}
+	featureLoaded = time.Now()
+
+	values, err := RedisClient.HGetAll(ctx, featureFlagsKey()).Result()
+	if err != nil {
+		logger.Warn("Failed to load feature flags", zap.Error(err))
+		return featureOverrides
+	}
+	overrides := make(map[string]bool, len(values))
+	for name, value := range values {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			overrides[name] = enabled
+		}
+	}
+	featureOverrides = overrides
+	return overrides
+}
+
+// featureFlagState resolves a flag: runtime toggles take precedence over FEATURE_FLAGS, which
+// takes precedence over the built-in default
+func featureFlagState(ctx context.Context, flag FeatureFlag) FeatureFlagState {
+	if enabled, ok := runtimeFeatureOverrides(ctx)[flag.Name]; ok {
+		return FeatureFlagState{FeatureFlag: flag, Enabled: enabled, Source: "runtime"}
+	}
+	if enabled, ok := featureConfig[flag.Name]; ok {
+		return FeatureFlagState{FeatureFlag: flag, Enabled: enabled, Source: "config"}
+	}
+	return FeatureFlagState{FeatureFlag: flag, Enabled: flag.Default, Source: "default"}
+}
+
+// FeatureEnabled reports whether a feature is enabled. Unknown features are disabled.
+func FeatureEnabled(name string) bool {
+	flag, ok := findFeatureFlag(name)
+	if !ok {
+		return false
+	}
+	return featureFlagState(context.Background(), flag).Enabled
+}
+
+// FeatureFlagStates returns the effective state of every flag
+func FeatureFlagStates(ctx context.Context) []FeatureFlagState {
+	states := make([]FeatureFlagState, 0, len(FeatureFlags))
+	for _, flag := range FeatureFlags {
+		states = append(states, featureFlagState(ctx, flag))
+	}
+	return states
+}
+
+// SetFeatureFlag toggles a flag at runtime on every instance sharing the Redis database. A nil
+// state removes the toggle, restoring the configured state.
+func SetFeatureFlag(ctx context.Context, name string, enabled *bool) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	if _, ok := findFeatureFlag(name); !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+
+	var err error
+	if enabled == nil {
+		err = RedisClient.HDel(ctx, featureFlagsKey(), name).Err()
+	} else {
+		err = RedisClient.HSet(ctx, featureFlagsKey(), name, strconv.FormatBool(*enabled)).Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Apply the change on this instance right away
+	featureMu.Lock()
+	featureLoaded = time.Time{}
+	featureMu.Unlock()
+	return nil
+}
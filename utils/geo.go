@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/oschwald/geoip2-golang"
+	"go.uber.org/zap"
+)
+
+var (
+	countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	regionCodePattern  = regexp.MustCompile(`^[A-Z]{2}-[A-Z0-9]{1,3}$`)
+)
+
+// GeoLocation is where a client address is located
+type GeoLocation struct {
+	Continent string // Continent code, e.g. EU
+	Country   string // ISO 3166-1 country code, e.g. DE
+	Region    string // ISO 3166-2 subdivision code, e.g. DE-BY; only known with a City database
+}
+
+// GeoRule applies to random image requests from its countries, regions or continents. A rule
+// without any of them matches every located client, as a fallback after the others.
+type GeoRule struct {
+	Name        string   `json:"name"`
+	Countries   []string `json:"countries"`  // ISO 3166-1 codes, e.g. CN
+	Regions     []string `json:"regions"`    // ISO 3166-2 codes, e.g. US-CA; need a City database
+	Continents  []string `json:"continents"` // Continent codes: AF, AN, AS, EU, NA, OC, SA
+	Tags        []string `json:"tags"`       // Tags added to the required tags, selecting a localized collection
+	ExcludeTags []string `json:"exclude"`    // Tags added to the excluded tags
+	PreferTags  []string `json:"prefer"`     // Tags added to the preferred tags, biasing the selection
+	Collection  string   `json:"collection"` // Collection to pick from, unless the request names one
+}
+
+func (g *GeoRule) matches(location GeoLocation) bool {
+	if len(g.Countries) == 0 && len(g.Regions) == 0 && len(g.Continents) == 0 {
+		return true
+	}
+	return slices.Contains(g.Countries, location.Country) ||
+		(location.Region != "" && slices.Contains(g.Regions, location.Region)) ||
+		slices.Contains(g.Continents, location.Continent)
+}
+
+var (
+	geoReader *geoip2.Reader
+	geoCity   bool // Whether the database has subdivisions
+	geoRules  []*GeoRule
+)
+
+// InitGeoIP opens the GeoIP database and loads the geo rules file of the configuration. Without
+// a database geo rules are off; a missing rules file only leaves them empty.
+func InitGeoIP(cfg *config.Config) error {
+	if cfg.GeoIPDatabase == "" {
+		return nil
+	}
+	reader, err := geoip2.Open(cfg.GeoIPDatabase)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	databaseType := reader.Metadata().DatabaseType
+	if !strings.Contains(databaseType, "City") && !strings.Contains(databaseType, "Country") {
+		reader.Close()
+		return fmt.Errorf("unsupported GeoIP database type %s: use a Country or City database", databaseType)
+	}
+
+	rules, err := loadGeoRules(cfg.GeoRulesFile)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	geoReader = reader
+	geoCity = strings.Contains(databaseType, "City")
+	geoRules = rules
+	logger.Info("Loaded GeoIP database",
+		zap.String("type", databaseType),
+		zap.Int("rules", len(geoRules)))
+	return nil
+}
+
+func loadGeoRules(path string) ([]*GeoRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geo rules file: %v", err)
+	}
+
+	var file struct {
+		Rules []*GeoRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse geo rules file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range file.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("geo rule without a name")
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate geo rule: %s", rule.Name)
+		}
+		seen[rule.Name] = true
+		for i, country := range rule.Countries {
+			rule.Countries[i] = strings.ToUpper(country)
+			if !countryCodePattern.MatchString(rule.Countries[i]) {
+				return nil, fmt.Errorf("geo rule %s: invalid country code %s", rule.Name, country)
+			}
+		}
+		for i, region := range rule.Regions {
+			rule.Regions[i] = strings.ToUpper(region)
+			if !regionCodePattern.MatchString(rule.Regions[i]) {
+				return nil, fmt.Errorf("geo rule %s: invalid region code %s", rule.Name, region)
+			}
+		}
+		for i, continent := range rule.Continents {
+			rule.Continents[i] = strings.ToUpper(continent)
+		}
+	}
+	return file.Rules, nil
+}
+
+// GeoIPEnabled reports whether client addresses are located
+func GeoIPEnabled() bool {
+	return geoReader != nil
+}
+
+// LookupGeo locates a client address. Private and unknown addresses are not located.
+func LookupGeo(address string) (GeoLocation, bool) {
+	var location GeoLocation
+	ip := net.ParseIP(address)
+	if geoReader == nil || ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() {
+		return location, false
+	}
+
+	if geoCity {
+		city, err := geoReader.City(ip)
+		if err != nil {
+			return location, false
+		}
+		location.Continent = city.Continent.Code
+		location.Country = city.Country.IsoCode
+		if len(city.Subdivisions) > 0 && city.Subdivisions[0].IsoCode != "" && location.Country != "" {
+			location.Region = location.Country + "-" + city.Subdivisions[0].IsoCode
+		}
+	} else {
+		country, err := geoReader.Country(ip)
+		if err != nil {
+			return location, false
+		}
+		location.Continent = country.Continent.Code
+		location.Country = country.Country.IsoCode
+	}
+	return location, location.Country != "" || location.Continent != ""
+}
+
+// ApplyGeoRules adds the tags of the first geo rule matching a location to a random image
+// request and returns the rule's name, or "" when none matches
+func ApplyGeoRules(location GeoLocation, req *RoutingRequest) string {
+	for _, rule := range geoRules {
+		if !rule.matches(location) {
+			continue
+		}
+		req.Tags = appendMissing(req.Tags, rule.Tags)
+		req.ExcludeTags = appendMissing(req.ExcludeTags, rule.ExcludeTags)
+		req.PreferTags = appendMissing(req.PreferTags, rule.PreferTags)
+		if req.Collection == "" {
+			req.Collection = rule.Collection
+		}
+		return rule.Name
+	}
+	return ""
+}
+
+// appendMissing appends the values not yet in a list
+func appendMissing(list []string, values []string) []string {
+	for _, value := range values {
+		if !slices.Contains(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/h2non/bimg"
+)
+
+// Brands of HEIF files holding HEVC images. mif1 and msf1 are generic brands AVIF files can
+// carry as well, so files with them are only HEIF when they are not compatible with AVIF.
+var (
+	heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs"}
+	heifBrands = []string{"mif1", "msf1"}
+	avifBrands = []string{"avif", "avis"}
+)
+
+// heifJPEGQuality is the quality HEIF images are converted to JPEG with, high enough for an
+// original
+const heifJPEGQuality = 92
+
+// HEIFFormat returns the format of a HEIF image, iPhone photos among them: heic for the HEVC
+// brands, heif for generic ones. It returns "" for other images, AVIF included.
+func HEIFFormat(data []byte) string {
+	// The file type box comes first: size, "ftyp", major brand, minor version, compatible brands
+	if len(data) < 16 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return ""
+	}
+	major := string(data[8:12])
+	if slices.Contains(heicBrands, major) {
+		return "heic"
+	}
+	if !slices.Contains(heifBrands, major) {
+		return ""
+	}
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	for offset := 16; offset+4 <= min(size, len(data)); offset += 4 {
+		if slices.Contains(avifBrands, string(data[offset:offset+4])) {
+			return ""
+		}
+	}
+	return "heif"
+}
+
+// ConvertHEIF converts a HEIF image to a JPEG through libvips and libheif, as browsers and the
+// image decoders of later upload steps do not read HEIF. libheif applies the rotation of the
+// image, so the JPEG is marked upright.
+func ConvertHEIF(ctx context.Context, data []byte) ([]byte, error) {
+	if !bimg.IsTypeSupported(bimg.HEIF) {
+		return nil, fmt.Errorf("HEIC/HEIF images are not supported by the installed libvips")
+	}
+	return GetWorkerPool().ProcessTaskContext(ctx, "heif_convert", func() ([]byte, error) {
+		converted, err := bimg.NewImage(data).Process(bimg.Options{
+			Type:         bimg.JPEG,
+			Quality:      heifJPEGQuality,
+			NoAutoRotate: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert HEIF image: %v", err)
+		}
+		resetEXIFOrientation(converted)
+		return converted, nil
+	})
+}
@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"plugin"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
+	"go.uber.org/zap"
+)
+
+// Extension points at which hooks run
+const (
+	HookPreUpload      = "pre-upload"      // Before an upload is stored; may change tags, visibility and expiry
+	HookPostConversion = "post-conversion" // After the derivatives were generated, before the metadata is saved
+	HookPreServe       = "pre-serve"       // Before an image is served under /images/; may add response headers
+	HookPostDelete     = "post-delete"     // After an image was deleted; cannot veto
+)
+
+var hookPoints = []string{HookPreUpload, HookPostConversion, HookPreServe, HookPostDelete}
+
+// HookEvent is passed to the hooks of an extension point. Hooks may change Metadata, except
+// the ID, paths and sizes of the image, and add response headers to Headers at pre-serve.
+type HookEvent struct {
+	Point    string         `json:"point"`
+	ImageID  string         `json:"imageId"`
+	Tenant   string         `json:"tenant,omitempty"`   // Tenant of the image, empty for the default tenant
+	Key      string         `json:"key,omitempty"`      // Storage key being served (pre-serve)
+	Metadata *ImageMetadata `json:"metadata,omitempty"` // Metadata of the image, as far as known at this point
+	Headers  http.Header    `json:"-"`                  // Response headers (pre-serve)
+}
+
+// Hook runs at an extension point. Returning an error vetoes the operation, except at
+// post-delete where errors are only logged.
+type Hook func(ctx context.Context, event *HookEvent) error
+
+// HookVetoError is returned by RunHooks when a hook rejected the operation
+type HookVetoError struct {
+	Hook   string
+	Reason string
+}
+
+func (e *HookVetoError) Error() string {
+	return fmt.Sprintf("rejected by hook %s: %s", e.Hook, e.Reason)
+}
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+// hooks are registered at startup, by Go plugins first and then from the hooks file
+var hooks = make(map[string][]namedHook)
+
+// RegisterHook adds a hook at an extension point. It is meant to be called from the init
+// function of a Go plugin listed in HOOK_PLUGINS and panics on unknown points.
+func RegisterHook(point, name string, hook Hook) {
+	if !slices.Contains(hookPoints, point) {
+		panic(fmt.Sprintf("unknown hook point %q", point))
+	}
+	hooks[point] = append(hooks[point], namedHook{name: name, hook: hook})
+}
+
+// HasHooks reports whether any hook runs at an extension point
+func HasHooks(point string) bool {
+	return len(hooks[point]) > 0
+}
+
+// RunHooks runs the hooks of the event's point in registration order, stopping at the first
+// veto, which is returned as a *HookVetoError
+func RunHooks(ctx context.Context, event *HookEvent) error {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		event.Tenant = tenant.ID
+	}
+	for _, h := range hooks[event.Point] {
+		err := h.hook(ctx, event)
+		if err == nil {
+			continue
+		}
+		if event.Point == HookPostDelete {
+			logger.Warn("Hook failed",
+				zap.String("hook", h.name),
+				zap.String("point", event.Point),
+				zap.String("id", event.ImageID),
+				zap.Error(err))
+			continue
+		}
+		veto, ok := err.(*HookVetoError)
+		if !ok {
+			veto = &HookVetoError{Hook: h.name, Reason: err.Error()}
+		}
+		logger.Info("Operation vetoed by hook",
+			zap.String("hook", veto.Hook),
+			zap.String("point", event.Point),
+			zap.String("id", event.ImageID),
+			zap.String("reason", veto.Reason))
+		return veto
+	}
+	return nil
+}
+
+// HookConfig is a webhook or script hook from the hooks file. It receives the event as JSON
+// (POST body or stdin) and may answer with a hookResponse; an empty answer allows the
+// operation unchanged.
+type HookConfig struct {
+	Name     string   `json:"name"`
+	Points   []string `json:"points"`   // Extension points the hook runs at
+	URL      string   `json:"url"`      // Webhook receiving the event
+	Command  []string `json:"command"`  // Script and arguments receiving the event on stdin
+	Timeout  int      `json:"timeout"`  // Timeout in seconds (default 5)
+	Required bool     `json:"required"` // Veto when the hook fails to answer instead of ignoring it
+}
+
+// hookResponse is the answer of a webhook or script hook
+type hookResponse struct {
+	Allow    *bool             `json:"allow"`    // false vetoes the operation
+	Reason   string            `json:"reason"`   // Reason reported with a veto
+	Metadata json.RawMessage   `json:"metadata"` // Metadata fields to replace, e.g. {"tags": [...]}
+	Headers  map[string]string `json:"headers"`  // Response headers to add (pre-serve)
+}
+
+// LoadHooks loads the Go plugins and the hooks file of the configuration. A missing hooks file
+// is not an error; hooks are optional.
+func LoadHooks(cfg *config.Config) error {
+	for _, path := range cfg.HookPlugins {
+		// Plugins register their hooks from their init functions
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("failed to load hook plugin %s: %v", path, err)
+		}
+		logger.Info("Loaded hook plugin", zap.String("path", path))
+	}
+
+	if cfg.HooksFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.HooksFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read hooks file: %v", err)
+	}
+
+	var file struct {
+		Hooks []*HookConfig `json:"hooks"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse hooks file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range file.Hooks {
+		if h.Name == "" {
+			return fmt.Errorf("hook without a name")
+		}
+		if seen[h.Name] {
+			return fmt.Errorf("duplicate hook: %s", h.Name)
+		}
+		seen[h.Name] = true
+		if (h.URL == "") == (len(h.Command) == 0) {
+			return fmt.Errorf("hook %s: exactly one of url and command must be set", h.Name)
+		}
+		if len(h.Points) == 0 {
+			return fmt.Errorf("hook %s: no points", h.Name)
+		}
+		for _, point := range h.Points {
+			if !slices.Contains(hookPoints, point) {
+				return fmt.Errorf("hook %s: unknown point %s", h.Name, point)
+			}
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = 5
+		}
+	}
+
+	for _, h := range file.Hooks {
+		for _, point := range h.Points {
+			RegisterHook(point, h.Name, h.run)
+		}
+	}
+	logger.Info("Loaded hooks",
+		zap.String("file", cfg.HooksFile),
+		zap.Int("hooks", len(file.Hooks)))
+	return nil
+}
+
+// run calls the webhook or script and applies its answer to the event
+func (h *HookConfig) run(ctx context.Context, event *HookEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.Timeout)*time.Second)
+	defer cancel()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var output []byte
+	if h.URL != "" {
+		output, err = h.callWebhook(ctx, event.Point, payload)
+	} else {
+		output, err = h.runCommand(ctx, payload)
+	}
+	if err != nil {
+		if h.Required {
+			return &HookVetoError{Hook: h.Name, Reason: err.Error()}
+		}
+		logger.Warn("Hook failed, ignoring it",
+			zap.String("hook", h.Name),
+			zap.String("point", event.Point),
+			zap.Error(err))
+		return nil
+	}
+
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+	var resp hookResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		if h.Required {
+			return &HookVetoError{Hook: h.Name, Reason: "invalid response"}
+		}
+		logger.Warn("Invalid hook response, ignoring it",
+			zap.String("hook", h.Name),
+			zap.Error(err))
+		return nil
+	}
+	if resp.Allow != nil && !*resp.Allow {
+		return &HookVetoError{Hook: h.Name, Reason: resp.Reason}
+	}
+	if len(resp.Metadata) > 0 && event.Metadata != nil {
+		if err := applyHookMetadata(event.Metadata, resp.Metadata); err != nil {
+			logger.Warn("Invalid metadata from hook",
+				zap.String("hook", h.Name),
+				zap.Error(err))
+		}
+	}
+	if event.Headers != nil {
+		for name, value := range resp.Headers {
+			event.Headers.Set(name, value)
+		}
+	}
+	return nil
+}
+
+func (h *HookConfig) callWebhook(ctx context.Context, point string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-ImageFlow-Hook", point)
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return body, nil
+}
+
+func (h *HookConfig) runCommand(ctx context.Context, payload []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// applyHookMetadata replaces the metadata fields set by a hook, keeping the fields that locate
+// the image's objects
+func applyHookMetadata(metadata *ImageMetadata, fields json.RawMessage) error {
+	id, format, paths, sizes, layoutVersion := metadata.ID, metadata.Format, metadata.Paths, maps.Clone(metadata.Sizes), metadata.LayoutVersion
+	paths.Thumbnails = maps.Clone(paths.Thumbnails)
+	err := json.Unmarshal(fields, metadata)
+	metadata.ID, metadata.Format, metadata.Paths, metadata.Sizes, metadata.LayoutVersion = id, format, paths, sizes, layoutVersion
+	return err
+}
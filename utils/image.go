@@ -29,7 +29,40 @@ type ImageFormatInfo struct {
 }
 
 // SupportedImageExtensions contains all file extensions recognized by the application
-var SupportedImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif"}
+var SupportedImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".svg"}
+
+// ImageMimeTypes maps image file extensions, and those of video clips, to their MIME types.
+// Format detection, storage uploads and serving all use it, so an image is reported with the
+// same type everywhere.
+var ImageMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".svg":  "image/svg+xml",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+}
+
+// formatExtensions maps the formats reported by image decoders to file extensions
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+	"avif": ".avif",
+}
+
+// ImageMimeType returns the MIME type of an image key or file name from its extension, or
+// application/octet-stream for other files
+func ImageMimeType(name string) string {
+	if mimeType, ok := ImageMimeTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
 
 // Global random source with proper seeding
 var globalRand = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -57,47 +90,18 @@ func DetectImageFormat(data []byte) (ImageFormatInfo, error) {
 	logger.Debug("Detected image format", zap.String("format", format))
 
 	// Map format to extension and MIME type
-	switch format {
-	case "jpeg":
-		return ImageFormatInfo{
-			Format:    format,
-			Extension: ".jpg",
-			MimeType:  "image/jpg",
-		}, nil
-	case "png":
-		return ImageFormatInfo{
-			Format:    format,
-			Extension: ".png",
-			MimeType:  "image/png",
-		}, nil
-	case "gif":
-		return ImageFormatInfo{
-			Format:    format,
-			Extension: ".gif",
-			MimeType:  "image/gif",
-		}, nil
-	case "webp":
-		return ImageFormatInfo{
-			Format:    format,
-			Extension: ".webp",
-			MimeType:  "image/webp",
-		}, nil
-	case "avif":
-		return ImageFormatInfo{
-			Format:    format,
-			Extension: ".avif",
-			MimeType:  "image/avif",
-		}, nil
-	default:
+	extension, ok := formatExtensions[format]
+	if !ok {
 		// Default to jpeg for unknown formats
 		logger.Debug("Unknown format detected, defaulting to JPEG",
 			zap.String("original_format", format))
-		return ImageFormatInfo{
-			Format:    "jpeg",
-			Extension: ".jpg",
-			MimeType:  "image/jpeg",
-		}, nil
+		format, extension = "jpeg", ".jpg"
 	}
+	return ImageFormatInfo{
+		Format:    format,
+		Extension: extension,
+		MimeType:  ImageMimeType(extension),
+	}, nil
 }
 
 // IsImageFile checks if a filename has a supported image extension
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// IngestedObject is an object creation reported by an S3 event notification
+type IngestedObject struct {
+	Bucket string
+	Key    string
+	ETag   string
+	Size   int64
+}
+
+// s3Event is the S3 event notification format, also used by MinIO and most S3-compatible stores
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsEnvelope wraps S3 events delivered through SNS
+type snsEnvelope struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+func ingestedObjectsKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "ingested"
+}
+
+// ParseS3Event returns the objects created according to an S3 event notification, unwrapping
+// SNS envelopes. Test events and events other than object creation yield no objects.
+func ParseS3Event(body []byte) ([]IngestedObject, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Type != "" {
+		switch envelope.Type {
+		case "Notification":
+			body = []byte(envelope.Message)
+		case "SubscriptionConfirmation":
+			logger.Warn("SNS subscription must be confirmed by visiting its SubscribeURL",
+				zap.String("subscribe_url", envelope.SubscribeURL))
+			return nil, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	var event s3Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid S3 event: %v", err)
+	}
+
+	objects := make([]IngestedObject, 0, len(event.Records))
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") && !strings.HasPrefix(record.EventName, "s3:ObjectCreated:") {
+			continue
+		}
+		// Keys are URL-encoded in event notifications
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		objects = append(objects, IngestedObject{
+			Bucket: record.S3.Bucket.Name,
+			Key:    key,
+			ETag:   strings.Trim(record.S3.Object.ETag, `"`),
+			Size:   record.S3.Object.Size,
+		})
+	}
+	return objects, nil
+}
+
+func (o IngestedObject) ingestField() string {
+	return o.Key + "@" + o.ETag
+}
+
+// ClaimIngestedObject marks an object as being imported. It returns false when the object was
+// already imported or is being imported, since event notifications may be delivered twice.
+func ClaimIngestedObject(ctx context.Context, object IngestedObject) (bool, error) {
+	if !IsRedisMetadataStore() {
+		return true, nil
+	}
+	return RedisClient.HSetNX(ctx, ingestedObjectsKey(ctx), object.ingestField(), "pending").Result()
+}
+
+// CompleteIngestedObject records the image an object was imported as
+func CompleteIngestedObject(ctx context.Context, object IngestedObject, imageID string) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+	return RedisClient.HSet(ctx, ingestedObjectsKey(ctx), object.ingestField(), imageID).Err()
+}
+
+// ReleaseIngestedObject clears a claim after a failed import so a redelivered event can retry it
+func ReleaseIngestedObject(ctx context.Context, object IngestedObject) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+	return RedisClient.HDel(ctx, ingestedObjectsKey(ctx), object.ingestField()).Err()
+}
@@ -0,0 +1,406 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// allKeyLayouts lists every supported key layout, used when resolving keys of unknown layout
+var allKeyLayouts = []config.KeyLayout{config.KeyLayoutFlat, config.KeyLayoutSharded}
+
+// ShardPath returns the two-level hash prefix for an image ID (e.g. "ab/cd")
+func ShardPath(id string) string {
+	sum := md5.Sum([]byte(id))
+	h := hex.EncodeToString(sum[:2])
+	return filepath.Join(h[:2], h[2:4])
+}
+
+// withLayout places a filename inside dir according to the key layout
+func withLayout(layout config.KeyLayout, dir, id, filename string) string {
+	if layout == config.KeyLayoutSharded {
+		return filepath.Join(dir, ShardPath(id), filename)
+	}
+	return filepath.Join(dir, filename)
+}
+
+// OriginalKey returns the storage key of an original image
+func OriginalKey(layout config.KeyLayout, orientation, id, ext string) string {
+	return withLayout(layout, filepath.Join("original", orientation), id, id+ext)
+}
+
+// GIFKey returns the storage key of a GIF image
+func GIFKey(layout config.KeyLayout, id, ext string) string {
+	return withLayout(layout, "gif", id, id+ext)
+}
+
+// AnimatedKey returns the storage key of an animated WebP or PNG image
+func AnimatedKey(layout config.KeyLayout, id, ext string) string {
+	return withLayout(layout, "animated", id, id+ext)
+}
+
+// VideoKey returns the storage key of an uploaded video clip
+func VideoKey(layout config.KeyLayout, id, ext string) string {
+	return withLayout(layout, "video", id, id+ext)
+}
+
+// VariantKey returns the storage key of a converted variant (webp, avif)
+func VariantKey(layout config.KeyLayout, orientation, format, id string) string {
+	return withLayout(layout, filepath.Join(orientation, format), id, id+"."+format)
+}
+
+// ThumbnailKey returns the storage key of a thumbnail fitting inside a size×size box
+func ThumbnailKey(layout config.KeyLayout, size int, id string) string {
+	return withLayout(layout, "thumbnails", id, fmt.Sprintf("%s.%d.webp", id, size))
+}
+
+// VariantKeyCandidates returns the keys a variant may be stored under, preferred layout first
+func VariantKeyCandidates(preferred config.KeyLayout, orientation, format, id string) []string {
+	keys := []string{VariantKey(preferred, orientation, format, id)}
+	for _, layout := range allKeyLayouts {
+		if layout != preferred {
+			keys = append(keys, VariantKey(layout, orientation, format, id))
+		}
+	}
+	return keys
+}
+
+// ImageDirCandidates returns the directories (relative to the storage root) that may contain
+// files of the given image in any layout, used for glob/prefix based deletion
+func ImageDirCandidates(id string) []string {
+	var dirs []string
+	for _, orientation := range []string{"landscape", "portrait"} {
+		for _, dir := range []string{
+			filepath.Join("original", orientation),
+			filepath.Join(orientation, "webp"),
+			filepath.Join(orientation, "avif"),
+		} {
+			dirs = append(dirs, dir, filepath.Join(dir, ShardPath(id)))
+		}
+	}
+	for _, dir := range []string{"gif", "animated", "video", "thumbnails", "resized"} {
+		dirs = append(dirs, dir, filepath.Join(dir, ShardPath(id)))
+	}
+	return dirs
+}
+
+// relayoutKey rewrites a stored key into the target layout, keeping its directory and filename
+func relayoutKey(key, id string, layout config.KeyLayout) string {
+	dir := filepath.Dir(key)
+	filename := filepath.Base(key)
+	shard := ShardPath(id)
+	if strings.HasSuffix(dir, string(filepath.Separator)+shard) {
+		dir = strings.TrimSuffix(dir, string(filepath.Separator)+shard)
+	}
+	return withLayout(layout, dir, id, filename)
+}
+
+// MigrateKeyLayout moves the stored images of the default namespace and every tenant to the
+// given key layout and updates their metadata. It returns the number of images moved per
+// tenant ID, "" being the default namespace.
+func MigrateKeyLayout(ctx context.Context, layout config.KeyLayout) (map[string]int, error) {
+	if MetadataManager == nil || Storage == nil {
+		return nil, fmt.Errorf("storage and metadata store must be initialized")
+	}
+
+	moved := make(map[string]int)
+	total := 0
+	for _, tenantCtx := range TenantContexts(ctx) {
+		var tenantID string
+		if tenant := TenantFromContext(tenantCtx); tenant != nil {
+			tenantID = tenant.ID
+		}
+		n, err := migrateKeyLayoutIn(tenantCtx, layout)
+		moved[tenantID] = n
+		total += n
+		if err != nil {
+			return moved, err
+		}
+		logger.Info("Migrated tenant image keys",
+			zap.String("tenant", tenantID),
+			zap.Int("moved", n))
+	}
+
+	logger.Info("Key layout migration completed",
+		zap.String("layout", string(layout)),
+		zap.Int("moved", total))
+	return moved, nil
+}
+
+// migrateKeyLayoutIn moves the stored images of the context's tenant to the given key layout,
+// returning the number of images moved
+func migrateKeyLayoutIn(ctx context.Context, layout config.KeyLayout) (int, error) {
+	allMetadata, err := MetadataManager.GetAllMetadata(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list metadata: %v", err)
+	}
+
+	moved := 0
+	for _, metadata := range allMetadata {
+		changed, err := migrateImageKeys(ctx, metadata, layout)
+		if err != nil {
+			return moved, err
+		}
+		if !changed {
+			// Images without objects to move only record the layout
+			if metadata.LayoutVersion == LayoutVersion(layout) {
+				continue
+			}
+			metadata.LayoutVersion = LayoutVersion(layout)
+			if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+				return moved, fmt.Errorf("failed to save metadata for %s: %v", metadata.ID, err)
+			}
+		}
+		moved++
+		logger.Debug("Migrated image keys",
+			zap.String("id", metadata.ID),
+			zap.String("layout", string(layout)))
+	}
+
+	if err := ClearPageCache(ctx); err != nil {
+		logger.Warn("Failed to clear page cache", zap.Error(err))
+	}
+	return moved, nil
+}
+
+// migrateImageKeys copies the objects of an image to the keys of a layout, saves its metadata
+// with the new keys and only then deletes the old objects, so the metadata never references a
+// missing object. When a copy or the save fails, the copies are deleted and the old objects
+// kept. It reports whether any object was moved.
+func migrateImageKeys(ctx context.Context, metadata *ImageMetadata, layout config.KeyLayout) (bool, error) {
+	paths := []*string{&metadata.Paths.Original, &metadata.Paths.WebP, &metadata.Paths.AVIF, &metadata.Paths.Video}
+	thumbnailSizes := slices.Sorted(maps.Keys(metadata.Paths.Thumbnails))
+	thumbnailKeys := make([]string, len(thumbnailSizes))
+	for i, size := range thumbnailSizes {
+		thumbnailKeys[i] = metadata.Paths.Thumbnails[size]
+		paths = append(paths, &thumbnailKeys[i])
+	}
+
+	type move struct {
+		path   *string
+		oldKey string
+		newKey string
+	}
+	var moves []move
+	removeCopies := func() {
+		for _, m := range moves {
+			if err := Storage.Delete(ctx, m.newKey); err != nil {
+				logger.Warn("Failed to delete copy after failed key migration",
+					zap.String("key", m.newKey),
+					zap.Error(err))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		newKey := relayoutKey(*path, metadata.ID, layout)
+		if newKey == *path {
+			continue
+		}
+
+		data, err := Storage.Get(ctx, *path)
+		if err != nil {
+			logger.Warn("Failed to read object for key migration",
+				zap.String("id", metadata.ID),
+				zap.String("key", *path),
+				zap.Error(err))
+			continue
+		}
+		if err := Storage.Store(ObjectAccessContext(ctx, metadata), newKey, data); err != nil {
+			removeCopies()
+			return false, fmt.Errorf("failed to store %s: %v", newKey, err)
+		}
+		moves = append(moves, move{path: path, oldKey: *path, newKey: newKey})
+	}
+	if len(moves) == 0 {
+		return false, nil
+	}
+
+	for _, m := range moves {
+		*m.path = m.newKey
+	}
+	for i, size := range thumbnailSizes {
+		metadata.Paths.Thumbnails[size] = thumbnailKeys[i]
+	}
+	previousVersion := metadata.LayoutVersion
+	metadata.LayoutVersion = LayoutVersion(layout)
+	if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+		// Restore the keys the stored metadata still references
+		for _, m := range moves {
+			*m.path = m.oldKey
+		}
+		for i, size := range thumbnailSizes {
+			metadata.Paths.Thumbnails[size] = thumbnailKeys[i]
+		}
+		metadata.LayoutVersion = previousVersion
+		removeCopies()
+		return false, fmt.Errorf("failed to save metadata for %s: %v", metadata.ID, err)
+	}
+
+	for _, m := range moves {
+		if err := Storage.Delete(ctx, m.oldKey); err != nil {
+			logger.Warn("Failed to delete object after key migration",
+				zap.String("key", m.oldKey),
+				zap.Error(err))
+		}
+	}
+	return true, nil
+}
+
+// Key layout versions recorded in metadata. New layouts must get a new version so
+// images written with older layouts can still be located.
+const (
+	LayoutVersionFlat    = 1
+	LayoutVersionSharded = 2
+)
+
+// LayoutVersion returns the metadata layout version for a key layout
+func LayoutVersion(layout config.KeyLayout) int {
+	if layout == config.KeyLayoutSharded {
+		return LayoutVersionSharded
+	}
+	return LayoutVersionFlat
+}
+
+// layoutForVersion returns the key layout for a metadata layout version.
+// Metadata written before versions were recorded is treated as flat.
+func layoutForVersion(version int) config.KeyLayout {
+	if version == LayoutVersionSharded {
+		return config.KeyLayoutSharded
+	}
+	return config.KeyLayoutFlat
+}
+
+// parsedKey describes the components of a storage key
+type parsedKey struct {
+	kind        string // original, gif, animated, video, webp or avif
+	orientation string
+	id          string
+	ext         string
+}
+
+// parseImageKey extracts the image ID, kind and orientation from a key of any known layout
+func parseImageKey(key string) (parsedKey, bool) {
+	key = filepath.ToSlash(filepath.Clean(key))
+	parts := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	if len(parts) < 2 {
+		return parsedKey{}, false
+	}
+
+	filename := parts[len(parts)-1]
+	ext := filepath.Ext(filename)
+	pk := parsedKey{id: strings.TrimSuffix(filename, ext), ext: ext}
+
+	switch {
+	case parts[0] == "gif" || parts[0] == "animated" || parts[0] == "video":
+		pk.kind = parts[0]
+	case parts[0] == "original" && len(parts) >= 3:
+		pk.kind = "original"
+		pk.orientation = parts[1]
+	case len(parts) >= 3 && (parts[1] == "webp" || parts[1] == "avif"):
+		pk.kind = parts[1]
+		pk.orientation = parts[0]
+	default:
+		return parsedKey{}, false
+	}
+	if pk.orientation != "" && pk.orientation != "landscape" && pk.orientation != "portrait" {
+		return parsedKey{}, false
+	}
+	return pk, true
+}
+
+// keysForLayout builds the key of a parsed key's object in the given layout and orientation
+func keysForLayout(pk parsedKey, layout config.KeyLayout, orientation string) string {
+	switch pk.kind {
+	case "gif":
+		return GIFKey(layout, pk.id, pk.ext)
+	case "animated":
+		return AnimatedKey(layout, pk.id, pk.ext)
+	case "video":
+		return VideoKey(layout, pk.id, pk.ext)
+	case "original":
+		return OriginalKey(layout, orientation, pk.id, pk.ext)
+	default:
+		return VariantKey(layout, orientation, pk.kind, pk.id)
+	}
+}
+
+// ResolveImageKey locates the object a (possibly historical) key refers to. It checks the key
+// itself, the path recorded in metadata and finally every known layout and orientation, so
+// links created before a layout change or a reclassification keep working. Keys of tenant
+// images are resolved under the prefix of the tenant in the context.
+func ResolveImageKey(ctx context.Context, key string) (string, error) {
+	if exists, err := Storage.Exists(ctx, key); err == nil && exists {
+		return key, nil
+	}
+
+	pk, ok := parseImageKey(strings.TrimPrefix(key, TenantStorageKey(ctx, "")))
+	if !ok {
+		return "", fmt.Errorf("unrecognized image key: %s", key)
+	}
+
+	var candidates []string
+	if MetadataManager != nil {
+		if metadata, err := MetadataManager.GetMetadata(ctx, pk.id); err == nil {
+			switch pk.kind {
+			case "original", "gif", "animated":
+				candidates = append(candidates, metadata.Paths.Original)
+			case "video":
+				candidates = append(candidates, metadata.Paths.Video)
+			case "webp":
+				candidates = append(candidates, metadata.Paths.WebP)
+			case "avif":
+				candidates = append(candidates, metadata.Paths.AVIF)
+			}
+			candidates = append(candidates, TenantStorageKey(ctx, keysForLayout(pk, layoutForVersion(metadata.LayoutVersion), metadata.Orientation)))
+		}
+	}
+	for _, layout := range allKeyLayouts {
+		for _, orientation := range []string{pk.orientation, "landscape", "portrait"} {
+			candidates = append(candidates, TenantStorageKey(ctx, keysForLayout(pk, layout, orientation)))
+		}
+	}
+
+	seen := map[string]bool{key: true}
+	for _, candidate := range candidates {
+		if candidate == "" || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+
+		exists, err := Storage.Exists(ctx, candidate)
+		if err != nil {
+			logger.Debug("Failed to check candidate key",
+				zap.String("key", candidate),
+				zap.Error(err))
+			continue
+		}
+		if exists {
+			logger.Debug("Resolved legacy image key",
+				zap.String("requested", key),
+				zap.String("resolved", candidate))
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("image not found for key: %s", key)
+}
+
+// ImageIDFromKey returns the image ID a storage key belongs to. Keys of derived objects such as
+// thumbnails and resized variants carry more than one extension (<id>.256.webp).
+func ImageIDFromKey(key string) string {
+	id, _, _ := strings.Cut(filepath.Base(key), ".")
+	return id
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.InitBasicLogger(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize logger: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// memoryStorage is a StorageProvider over a set of existing keys
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Store(ctx context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s memoryStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", key)
+	}
+	return data, nil
+}
+
+func (s memoryStorage) Delete(ctx context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+func (s memoryStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, ok := s[key]
+	return ok, nil
+}
+
+func TestParseImageKey(t *testing.T) {
+	shard := ShardPath("abc")
+	tests := []struct {
+		key  string
+		want parsedKey
+		ok   bool
+	}{
+		{"original/landscape/abc.jpg", parsedKey{"original", "landscape", "abc", ".jpg"}, true},
+		{"original/portrait/" + shard + "/abc.png", parsedKey{"original", "portrait", "abc", ".png"}, true},
+		{"/landscape/webp/abc.webp", parsedKey{"webp", "landscape", "abc", ".webp"}, true},
+		{"portrait/avif/" + shard + "/abc.avif", parsedKey{"avif", "portrait", "abc", ".avif"}, true},
+		{"gif/abc.gif", parsedKey{"gif", "", "abc", ".gif"}, true},
+		{"animated/" + shard + "/abc.webp", parsedKey{"animated", "", "abc", ".webp"}, true},
+		{"video/abc.mp4", parsedKey{"video", "", "abc", ".mp4"}, true},
+		{"abc.jpg", parsedKey{}, false},
+		{"original/abc.jpg", parsedKey{}, false},
+		{"square/webp/abc.webp", parsedKey{}, false},
+		{"thumbnails/abc.256.webp", parsedKey{}, false},
+		{"tenants/t1/original/landscape/abc.jpg", parsedKey{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, ok := parseImageKey(tt.key)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseImageKey(%q) = %+v, %v; want %+v, %v", tt.key, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKeysForLayout(t *testing.T) {
+	shard := ShardPath("abc")
+	tests := []struct {
+		key         string
+		layout      config.KeyLayout
+		orientation string
+		want        string
+	}{
+		{"original/landscape/abc.jpg", config.KeyLayoutFlat, "portrait", "original/portrait/abc.jpg"},
+		{"original/landscape/abc.jpg", config.KeyLayoutSharded, "landscape", "original/landscape/" + shard + "/abc.jpg"},
+		{"landscape/webp/" + shard + "/abc.webp", config.KeyLayoutFlat, "landscape", "landscape/webp/abc.webp"},
+		{"portrait/avif/abc.avif", config.KeyLayoutSharded, "portrait", "portrait/avif/" + shard + "/abc.avif"},
+		{"gif/abc.gif", config.KeyLayoutSharded, "landscape", "gif/" + shard + "/abc.gif"},
+		{"animated/" + shard + "/abc.png", config.KeyLayoutFlat, "", "animated/abc.png"},
+		{"video/abc.mp4", config.KeyLayoutSharded, "", "video/" + shard + "/abc.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"/"+string(tt.layout), func(t *testing.T) {
+			pk, ok := parseImageKey(tt.key)
+			if !ok {
+				t.Fatalf("parseImageKey(%q) failed", tt.key)
+			}
+			if got := keysForLayout(pk, tt.layout, tt.orientation); got != tt.want {
+				t.Errorf("keysForLayout(%q, %s, %q) = %q, want %q", tt.key, tt.layout, tt.orientation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImageKey(t *testing.T) {
+	shard := ShardPath("abc")
+	tenant := WithTenant(context.Background(), &Tenant{ID: "t1"})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		stored  string
+		key     string
+		wantErr bool
+	}{
+		{"existing key", context.Background(), "original/landscape/abc.jpg", "original/landscape/abc.jpg", false},
+		{"flat to sharded", context.Background(), "original/landscape/" + shard + "/abc.jpg", "original/landscape/abc.jpg", false},
+		{"sharded to flat", context.Background(), "landscape/webp/abc.webp", "landscape/webp/" + shard + "/abc.webp", false},
+		{"reclassified", context.Background(), "portrait/avif/" + shard + "/abc.avif", "landscape/avif/abc.avif", false},
+		{"tenant flat to sharded", tenant, "tenants/t1/original/portrait/" + shard + "/abc.png", "tenants/t1/original/portrait/abc.png", false},
+		{"tenant reclassified", tenant, "tenants/t1/landscape/webp/abc.webp", "tenants/t1/portrait/webp/" + shard + "/abc.webp", false},
+		{"other tenant", tenant, "tenants/t2/gif/" + shard + "/abc.gif", "tenants/t1/gif/abc.gif", true},
+		{"default namespace from tenant", tenant, "gif/" + shard + "/abc.gif", "tenants/t1/gif/abc.gif", true},
+		{"missing", context.Background(), "original/landscape/xyz.jpg", "original/landscape/abc.jpg", true},
+		{"unrecognized", context.Background(), "thumbnails/abc.256.webp", "thumbnails/abc.128.webp", true},
+	}
+
+	previous, previousMetadata := Storage, MetadataManager
+	defer func() { Storage, MetadataManager = previous, previousMetadata }()
+	MetadataManager = nil
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Storage = memoryStorage{tt.stored: nil}
+			got, err := ResolveImageKey(tt.ctx, tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ResolveImageKey(%q) = %q, want an error", tt.key, got)
+				}
+				return
+			}
+			if err != nil || got != tt.stored {
+				t.Errorf("ResolveImageKey(%q) = %q, %v; want %q", tt.key, got, err, tt.stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+var languageTagPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+
+// LanguageRule applies to random image requests whose clients accept one of its languages
+type LanguageRule struct {
+	Name        string   `json:"name"`
+	Languages   []string `json:"languages"` // Language tags, e.g. zh or zh-tw; zh also matches zh-cn
+	Tags        []string `json:"tags"`      // Tags added to the required tags
+	ExcludeTags []string `json:"exclude"`   // Tags added to the excluded tags
+	PreferTags  []string `json:"prefer"`    // Tags added to the preferred tags, biasing the selection
+}
+
+var languageRules []*LanguageRule
+
+// InitLanguageRules loads the language rules file of the configuration. A missing file leaves
+// language rules off.
+func InitLanguageRules(cfg *config.Config) error {
+	rules, err := loadLanguageRules(cfg.LanguageRulesFile)
+	if err != nil {
+		return err
+	}
+
+	languageRules = rules
+	if len(rules) > 0 {
+		logger.Info("Loaded language rules",
+			zap.Int("rules", len(rules)))
+	}
+	return nil
+}
+
+func loadLanguageRules(path string) ([]*LanguageRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read language rules file: %v", err)
+	}
+
+	var file struct {
+		Rules []*LanguageRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse language rules file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range file.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("language rule without a name")
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate language rule: %s", rule.Name)
+		}
+		seen[rule.Name] = true
+		if len(rule.Languages) == 0 {
+			return nil, fmt.Errorf("language rule %s: at least one language is required", rule.Name)
+		}
+		for i, language := range rule.Languages {
+			rule.Languages[i] = strings.ToLower(language)
+			if !languageTagPattern.MatchString(rule.Languages[i]) {
+				return nil, fmt.Errorf("language rule %s: invalid language %s", rule.Name, language)
+			}
+		}
+	}
+	return file.Rules, nil
+}
+
+// LanguageRulesEnabled reports whether random images depend on the client's languages
+func LanguageRulesEnabled() bool {
+	return len(languageRules) > 0
+}
+
+// ParseAcceptLanguage returns the lowercase language tags of an Accept-Language header, most
+// preferred first. Languages with q=0 and the * wildcard are left out.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = q
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, weighted{tag, quality})
+		}
+	}
+
+	// Stable, so languages of equal quality keep the client's order
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.tag
+	}
+	return tags
+}
+
+// ApplyLanguageRules adds the tags of the language rule matching the client's most preferred
+// language to a random image request. A rule language matches the same tag or a more specific
+// one, so zh matches zh-cn; exact matches win. It returns the matched language and the rule's
+// name, or empty strings when no rule matches.
+func ApplyLanguageRules(languages []string, req *RoutingRequest) (string, string) {
+	for _, language := range languages {
+		rule := matchLanguageRule(language)
+		if rule == nil {
+			continue
+		}
+		req.Tags = appendMissing(req.Tags, rule.Tags)
+		req.ExcludeTags = appendMissing(req.ExcludeTags, rule.ExcludeTags)
+		req.PreferTags = appendMissing(req.PreferTags, rule.PreferTags)
+		return language, rule.Name
+	}
+	return "", ""
+}
+
+func matchLanguageRule(language string) *LanguageRule {
+	for _, rule := range languageRules {
+		if slices.Contains(rule.Languages, language) {
+			return rule
+		}
+	}
+	for _, rule := range languageRules {
+		for _, ruleLanguage := range rule.Languages {
+			if strings.HasPrefix(language, ruleLanguage+"-") {
+				return rule
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// libraryVersionKey holds a counter bumped on every change of a tenant's library. Every change
+// clears or invalidates cached list pages, which is where the counter is bumped.
+func libraryVersionKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "library_version"
+}
+
+// LibraryVersion returns the version of the library, which changes whenever an image is added,
+// changed or removed. Without Redis there is no version and ok is false.
+func LibraryVersion(ctx context.Context) (version int64, ok bool, err error) {
+	if !IsRedisMetadataStore() {
+		return 0, false, nil
+	}
+	version, err = RedisClient.Get(ctx, libraryVersionKey(ctx)).Int64()
+	if err == redis.Nil {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+func bumpLibraryVersion(ctx context.Context) error {
+	return RedisClient.Incr(ctx, libraryVersionKey(ctx)).Err()
+}
@@ -3,16 +3,32 @@ package logger
 import (
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
 	Log       *zap.Logger
 	debugMode bool
+	// callerLog reports the caller of the package functions rather than this file, which
+	// per-module levels are matched against
+	callerLog *zap.Logger
+
+	// level is the global log level, switchable at runtime
+	level = zap.NewAtomicLevel()
+	// configuredLevel is the level set by the configuration, restored by ToggleDebug
+	configuredLevel zapcore.Level
+	// console tells whether entries are also written to stdout
+	console atomic.Bool
+
+	modulesMu sync.RWMutex
+	modules   map[string]zapcore.Level // Per-module level overrides
+	// minLevel is the lowest of the global and module levels, checked before an entry is built
+	minLevel atomic.Int32
 )
 
 func InitBasicLogger() error {
@@ -32,17 +48,18 @@ func InitBasicLogger() error {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
 
-	core := zapcore.NewCore(
+	core := &redactingCore{Core: zapcore.NewCore(
 		zapcore.NewConsoleEncoder(config.EncoderConfig),
 		zapcore.AddSync(os.Stdout),
 		zapcore.InfoLevel,
-	)
+	)}
 
 	Log = zap.New(core, zap.AddCaller())
 
 	if Log == nil {
 		return fmt.Errorf("failed to initialize basic logger")
 	}
+	callerLog = Log.WithOptions(zap.AddCallerSkip(1))
 
 	return nil
 }
@@ -50,15 +67,28 @@ func InitBasicLogger() error {
 func InitLogger(cfg *config.Config) error {
 	debugMode = cfg.DebugMode
 
-	config := zap.NewProductionConfig()
-
+	configuredLevel = zapcore.InfoLevel
+	if cfg.LogLevel != "" {
+		if err := configuredLevel.Set(cfg.LogLevel); err != nil {
+			return fmt.Errorf("invalid log level %q", cfg.LogLevel)
+		}
+	}
 	if debugMode {
-		config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
-	} else {
-		config.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+		configuredLevel = zapcore.DebugLevel
+	}
+	level.SetLevel(configuredLevel)
+	console.Store(debugMode)
+	for module, moduleLevel := range cfg.LogModules {
+		if err := SetModuleLevel(module, moduleLevel); err != nil {
+			return err
+		}
+	}
+	updateMinLevel()
+	for category, limit := range cfg.LogRateLimits {
+		SetRateLimit(category, limit)
 	}
 
-	config.EncoderConfig = zapcore.EncoderConfig{
+	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "time",
 		LevelKey:       "level",
 		NameKey:        "logger",
@@ -73,69 +103,57 @@ func InitLogger(cfg *config.Config) error {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
 
-	var cores []zapcore.Core
-
-	// Configure lumberjack for log rotation
-	logRotator := &lumberjack.Logger{
-		Filename:   "logs/imageflow.log", // Log file path
-		MaxSize:    100,                  // Max size per log file: 100MB
-		MaxBackups: 30,                   // Keep 30 backup files
-		MaxAge:     7,                    // Keep logs for 7 days
-		Compress:   true,                 // Compress old log files
+	// Levels are checked by the filtering cores, so the console can be switched on at runtime
+	cores, err := sinkCores(cfg, encoderConfig)
+	if err != nil {
+		return err
 	}
-
-	cores = append(cores, zapcore.NewCore(
-		zapcore.NewJSONEncoder(config.EncoderConfig),
-		zapcore.AddSync(logRotator),
-		config.Level,
-	))
-
-	if debugMode {
-		cores = append(cores, zapcore.NewCore(
-			zapcore.NewConsoleEncoder(config.EncoderConfig),
-			zapcore.AddSync(os.Stdout),
-			config.Level,
-		))
+	var core zapcore.Core = zapcore.NewTee(cores...)
+	if cfg.LogSamplingFirst > 0 {
+		core = sampledCore(core, cfg.LogSamplingFirst, cfg.LogSamplingThereafter)
 	}
-
-	core := zapcore.NewTee(cores...)
 	Log = zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
 
 	if Log == nil {
 		return fmt.Errorf("failed to initialize logger with config")
 	}
+	callerLog = Log.WithOptions(zap.AddCallerSkip(1))
 
 	Info("Logger initialized",
 		zap.Bool("debug_mode", debugMode),
-		zap.String("log_level", config.Level.String()))
+		zap.String("log_level", level.String()),
+		zap.Any("modules", cfg.LogModules),
+		zap.Int("sampling_first", cfg.LogSamplingFirst),
+		zap.Int("sampling_thereafter", cfg.LogSamplingThereafter),
+		zap.Any("rate_limits", cfg.LogRateLimits),
+		zap.Strings("sinks", cfg.LogSinks))
 
 	return nil
 }
 
+// IsDebugMode reports whether debug entries are currently logged
 func IsDebugMode() bool {
-	return debugMode
+	return level.Enabled(zapcore.DebugLevel)
 }
 
 func Debug(msg string, fields ...zap.Field) {
-	if debugMode {
-		Log.Debug(msg, fields...)
-	}
+	callerLog.Debug(msg, fields...)
 }
 
 func Info(msg string, fields ...zap.Field) {
-	Log.Info(msg, fields...)
+	callerLog.Info(msg, fields...)
 }
 
 func Warn(msg string, fields ...zap.Field) {
-	Log.Warn(msg, fields...)
+	callerLog.Warn(msg, fields...)
 }
 
 func Error(msg string, fields ...zap.Field) {
-	Log.Error(msg, fields...)
+	callerLog.Error(msg, fields...)
 }
 
 func Fatal(msg string, fields ...zap.Field) {
-	Log.Fatal(msg, fields...)
+	callerLog.Fatal(msg, fields...)
 }
 
 func With(fields ...zap.Field) *zap.Logger {
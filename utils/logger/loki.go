@@ -0,0 +1,237 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	lokiBatchSize    = 500             // Entries sent per push request
+	lokiPushInterval = time.Second     // Longest delay before queued entries are pushed
+	lokiQueueSize    = 8192            // Entries queued at most; further entries are dropped
+	lokiSyncTimeout  = 5 * time.Second // Longest wait for queued entries to be pushed on Sync
+)
+
+// lokiEntry is an encoded entry waiting to be pushed
+type lokiEntry struct {
+	time  time.Time
+	level zapcore.Level
+	line  string
+}
+
+// lokiCore encodes entries as JSON lines and queues them for the Loki pusher. Logging never
+// waits for Loki: entries are dropped while the queue is full.
+type lokiCore struct {
+	encoder zapcore.Encoder
+	pusher  *lokiPusher
+}
+
+func newLokiCore(cfg *config.Config, encoderConfig zapcore.EncoderConfig) zapcore.Core {
+	pusher := &lokiPusher{
+		url:      cfg.LokiURL + "/loki/api/v1/push",
+		labels:   cfg.LokiLabels,
+		tenant:   cfg.LokiTenant,
+		username: cfg.LokiUsername,
+		password: cfg.LokiPassword,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan lokiEntry, lokiQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go pusher.run()
+	return &lokiCore{encoder: zapcore.NewJSONEncoder(encoderConfig), pusher: pusher}
+}
+
+func (c *lokiCore) Enabled(zapcore.Level) bool {
+	return true
+}
+
+func (c *lokiCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &lokiCore{encoder: encoder, pusher: c.pusher}
+}
+
+func (c *lokiCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
+
+func (c *lokiCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.pusher.enqueue(lokiEntry{time: ent.Time, level: ent.Level, line: strings.TrimSuffix(buf.String(), "\n")})
+	buf.Free()
+	return nil
+}
+
+// Sync pushes the queued entries, waiting at most lokiSyncTimeout
+func (c *lokiCore) Sync() error {
+	c.pusher.sync(lokiSyncTimeout)
+	return nil
+}
+
+// lokiPusher batches entries and posts them to the Loki push API, one stream per level
+type lokiPusher struct {
+	url      string
+	labels   map[string]string
+	tenant   string
+	username string
+	password string
+	client   *http.Client
+
+	queue   chan lokiEntry
+	flush   chan chan struct{}
+	dropped atomic.Int64 // Entries dropped since the last push
+	failing bool         // Whether the last push failed, so failures are reported once
+}
+
+func (p *lokiPusher) enqueue(entry lokiEntry) {
+	select {
+	case p.queue <- entry:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *lokiPusher) run() {
+	ticker := time.NewTicker(lokiPushInterval)
+	defer ticker.Stop()
+
+	batch := make([]lokiEntry, 0, lokiBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			p.push(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case entry := <-p.queue:
+			batch = append(batch, entry)
+			if len(batch) == lokiBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-p.flush:
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+				if len(batch) == lokiBatchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func (p *lokiPusher) sync(timeout time.Duration) {
+	done := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case p.flush <- done:
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// Loki push API structures (loghttp.PushRequest)
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // Nanosecond timestamp and line
+}
+
+// push posts a batch of entries. Failed batches are dropped, reported once until a push
+// succeeds again; logging must never hold up requests when Loki is unavailable.
+func (p *lokiPusher) push(batch []lokiEntry) {
+	streams := make(map[zapcore.Level]*lokiStream)
+	for _, entry := range batch {
+		stream, ok := streams[entry.level]
+		if !ok {
+			labels := make(map[string]string, len(p.labels)+1)
+			for name, value := range p.labels {
+				labels[name] = value
+			}
+			labels["level"] = entry.level.String()
+			stream = &lokiStream{Stream: labels}
+			streams[entry.level] = stream
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.time.UnixNano(), 10), entry.line})
+	}
+	payload := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		payload.Streams = append(payload.Streams, stream)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		p.failed(fmt.Errorf("failed to encode entries: %v", err), len(batch))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		p.failed(err, len(batch))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", p.tenant)
+	}
+	if p.username != "" || p.password != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.failed(err, len(batch))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		p.failed(fmt.Errorf("push rejected: %s", resp.Status), len(batch))
+		return
+	}
+
+	if p.failing {
+		p.failing = false
+		Log.Info("Pushing log entries to Loki again")
+	}
+	if dropped := p.dropped.Swap(0); dropped > 0 {
+		Log.Warn("Dropped log entries, Loki queue full",
+			zap.Int64("dropped", dropped))
+	}
+}
+
+// failed reports the first failed push of a series. It also goes to stderr, as Loki may be
+// the only sink.
+func (p *lokiPusher) failed(err error, entries int) {
+	if p.failing {
+		return
+	}
+	p.failing = true
+	fmt.Fprintf(os.Stderr, "Failed to push %d log entries to Loki: %v\n", entries, err)
+	Log.Warn("Failed to push log entries to Loki",
+		zap.Int("entries", entries),
+		zap.Error(err))
+}
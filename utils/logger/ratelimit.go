@@ -0,0 +1,147 @@
+package logger
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Hot path categories whose entries are rate limited by LOG_RATE_LIMITS
+const (
+	CategoryConversion = "conversion" // WebP/AVIF conversions and their storage
+	CategoryServe      = "serve"      // Serving random and requested images
+)
+
+// rateLimitWindow is the period LOG_RATE_LIMITS count entries over
+const rateLimitWindow = time.Minute
+
+var (
+	rateLimitsMu sync.RWMutex
+	rateLimits   map[string]int // Entries per message and window by category, 0 for no limit
+
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*Limiter)
+)
+
+// Limiter logs the Debug and Info entries of a hot path category, dropping the entries of a
+// message beyond the category's limit per minute. The number of dropped entries is logged once
+// the minute is over.
+type Limiter struct {
+	category   string
+	mu         sync.Mutex
+	window     time.Time
+	counts     map[string]int // Entries per message in the current window
+	suppressed int
+}
+
+// Limited returns the limiter of a category, shared by every caller
+func Limited(category string) *Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	limiter, ok := limiters[category]
+	if !ok {
+		limiter = &Limiter{category: category, counts: make(map[string]int)}
+		limiters[category] = limiter
+	}
+	return limiter
+}
+
+// SetRateLimit sets the entries per message and minute of a category; 0 removes the limit
+func SetRateLimit(category string, limit int) {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	if rateLimits == nil {
+		rateLimits = make(map[string]int)
+	}
+	if limit <= 0 {
+		delete(rateLimits, category)
+		return
+	}
+	rateLimits[category] = limit
+}
+
+func rateLimit(category string) int {
+	rateLimitsMu.RLock()
+	defer rateLimitsMu.RUnlock()
+	return rateLimits[category]
+}
+
+// allow counts an entry of a message, reporting the entries dropped in the previous window
+func (l *Limiter) allow(msg string) bool {
+	limit := rateLimit(l.category)
+	if limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	suppressed := 0
+	if now.Sub(l.window) >= rateLimitWindow {
+		suppressed = l.suppressed
+		l.window = now
+		l.suppressed = 0
+		clear(l.counts)
+	}
+	l.counts[msg]++
+	allowed := l.counts[msg] <= limit
+	if !allowed {
+		l.suppressed++
+	}
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		Log.Info("Log entries suppressed",
+			zap.String("category", l.category),
+			zap.Int("suppressed", suppressed),
+			zap.Int("limit_per_minute", limit))
+	}
+	return allowed
+}
+
+// Debug and Info write an entry when its level is enabled and the message is within the limit.
+// Levels are checked first so disabled entries do not count, and directly in each method so
+// the caller skip of callerLog reports the caller.
+func (l *Limiter) Debug(msg string, fields ...zap.Field) {
+	if ce := callerLog.Check(zapcore.DebugLevel, msg); ce != nil && l.allow(msg) {
+		ce.Write(fields...)
+	}
+}
+
+func (l *Limiter) Info(msg string, fields ...zap.Field) {
+	if ce := callerLog.Check(zapcore.InfoLevel, msg); ce != nil && l.allow(msg) {
+		ce.Write(fields...)
+	}
+}
+
+// levelCore passes the entries of some levels on to its core
+type levelCore struct {
+	zapcore.Core
+	levels zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.levels.Enabled(lvl) && c.Core.Enabled(lvl)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), levels: c.levels}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// sampledCore samples the entries below warn of each message: the first entries per second
+// are logged, then every thereafter-th. Warnings and errors are never sampled.
+func sampledCore(core zapcore.Core, first, thereafter int) zapcore.Core {
+	below := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool { return lvl < zapcore.WarnLevel })
+	return zapcore.NewTee(
+		&levelCore{Core: zapcore.NewSamplerWithOptions(core, time.Second, first, thereafter), levels: below},
+		&levelCore{Core: core, levels: zapcore.WarnLevel},
+	)
+}
@@ -0,0 +1,166 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// sensitiveWords mark a field or query parameter as holding a secret when they are one of the
+// words of its name (provided_key, X-Amz-Signature)
+var sensitiveWords = map[string]bool{
+	"password":      true,
+	"passwd":        true,
+	"secret":        true,
+	"token":         true,
+	"auth":          true,
+	"authorization": true,
+	"credential":    true,
+	"credentials":   true,
+	"signature":     true,
+	"cookie":        true,
+	"apikey":        true,
+}
+
+// secretKeyWords mark a "key" word as a secret rather than a storage key when they precede it
+// (api_key, access_key, provided_key)
+var secretKeyWords = map[string]bool{
+	"api":      true,
+	"access":   true,
+	"account":  true,
+	"secret":   true,
+	"private":  true,
+	"provided": true,
+	"signing":  true,
+	"admin":    true,
+	"peer":     true,
+}
+
+// SensitiveField reports whether a log field or query parameter of this name holds a secret,
+// whose value is redacted before it is written
+func SensitiveField(name string) bool {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == ' '
+	})
+	for i, word := range words {
+		if sensitiveWords[word] {
+			return true
+		}
+		if word == "key" && i > 0 && secretKeyWords[words[i-1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces a secret with a short fingerprint, so entries logging the same value can be
+// correlated without revealing it
+func Redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// RedactURL removes the password and sensitive query parameters of a URL (endpoints with
+// credentials, signed URLs). Other values are returned unchanged.
+func RedactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+		changed = true
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name, values := range query {
+			if !SensitiveField(name) {
+				continue
+			}
+			for i := range values {
+				values[i] = "redacted"
+			}
+			changed = true
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+		}
+	}
+	if !changed {
+		return value
+	}
+	return u.String()
+}
+
+// redactField masks the value of a sensitive field and the credentials of URLs in string
+// fields, reporting whether it changed
+func redactField(field zapcore.Field) (zapcore.Field, bool) {
+	if SensitiveField(field.Key) {
+		switch field.Type {
+		case zapcore.SkipType:
+			return field, false
+		case zapcore.StringType:
+			field.String = Redact(field.String)
+			return field, true
+		default:
+			// Structured values are replaced as a whole, as their secrets cannot be told apart
+			return zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: "redacted"}, true
+		}
+	}
+	if field.Type == zapcore.StringType {
+		if redacted := RedactURL(field.String); redacted != field.String {
+			field.String = redacted
+			return field, true
+		}
+	}
+	return field, false
+}
+
+// redactFields returns the fields with sensitive values masked, copying them only when one is
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	var redacted []zapcore.Field
+	for i, field := range fields {
+		if masked, ok := redactField(field); ok {
+			if redacted == nil {
+				redacted = append(make([]zapcore.Field, 0, len(fields)), fields...)
+			}
+			redacted[i] = masked
+		}
+	}
+	if redacted == nil {
+		return fields
+	}
+	return redacted
+}
+
+// redactingCore redacts the fields of every entry before its core encodes them, so API keys,
+// passwords and credentials in URLs never reach a log file or the console. It wraps the
+// encoding cores, below the samplers and filters whose Check it would otherwise bypass.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, redactFields(fields))
+}
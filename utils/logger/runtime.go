@@ -0,0 +1,172 @@
+package logger
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// State is the logging configuration currently in effect
+type State struct {
+	Level      string            `json:"level"`      // Global level
+	Console    bool              `json:"console"`    // Whether entries are also written to stdout
+	Modules    map[string]string `json:"modules"`    // Per-module level overrides
+	RateLimits map[string]int    `json:"rateLimits"` // Entries per message and minute of hot path categories
+}
+
+// filteredCore applies the runtime level, module overrides and console switch to a core
+// that accepts every level
+type filteredCore struct {
+	zapcore.Core
+	console bool // Written only while console output is on
+}
+
+func (c *filteredCore) Enabled(lvl zapcore.Level) bool {
+	if c.console && !console.Load() {
+		return false
+	}
+	return lvl >= zapcore.Level(minLevel.Load())
+}
+
+func (c *filteredCore) With(fields []zapcore.Field) zapcore.Core {
+	return &filteredCore{Core: c.Core.With(fields), console: c.console}
+}
+
+func (c *filteredCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write drops entries below the level of their module; the caller is only known here, as
+// zap resolves it after Check
+func (c *filteredCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !levelFor(ent.Caller).Enabled(ent.Level) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// levelFor returns the level of the module an entry was logged from. A module is a package
+// (handlers, utils, main) or the start of a file name (storage matches storage.go and
+// storage_azure.go); file matches take precedence, the longest first.
+func levelFor(caller zapcore.EntryCaller) zapcore.Level {
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+	if len(modules) == 0 || !caller.Defined {
+		return level.Level()
+	}
+
+	file := strings.TrimSuffix(filepath.Base(caller.File), ".go")
+	match := ""
+	for module := range modules {
+		if strings.HasPrefix(file, module) && len(module) > len(match) {
+			match = module
+		}
+	}
+	if match != "" {
+		return modules[match]
+	}
+	if moduleLevel, ok := modules[filepath.Base(filepath.Dir(caller.File))]; ok {
+		return moduleLevel
+	}
+	return level.Level()
+}
+
+// updateMinLevel recomputes the lowest level any entry may be written at
+func updateMinLevel() {
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+	lowest := level.Level()
+	for _, moduleLevel := range modules {
+		lowest = min(lowest, moduleLevel)
+	}
+	minLevel.Store(int32(lowest))
+}
+
+// SetLevel switches the global log level (debug, info, warn or error)
+func SetLevel(name string) error {
+	var lvl zapcore.Level
+	if err := lvl.Set(name); err != nil {
+		return fmt.Errorf("invalid log level %q", name)
+	}
+	level.SetLevel(lvl)
+	updateMinLevel()
+	return nil
+}
+
+// SetConsole switches writing entries to stdout in addition to the log file
+func SetConsole(enabled bool) {
+	console.Store(enabled)
+}
+
+// SetModuleLevel overrides the level of a module; an empty level removes the override
+func SetModuleLevel(module, name string) error {
+	module = strings.TrimSpace(module)
+	if module == "" {
+		return fmt.Errorf("empty log module")
+	}
+	modulesMu.Lock()
+	if name == "" {
+		delete(modules, module)
+	} else {
+		var lvl zapcore.Level
+		if err := lvl.Set(name); err != nil {
+			modulesMu.Unlock()
+			return fmt.Errorf("invalid log level %q for module %s", name, module)
+		}
+		if modules == nil {
+			modules = make(map[string]zapcore.Level)
+		}
+		modules[module] = lvl
+	}
+	modulesMu.Unlock()
+	updateMinLevel()
+	return nil
+}
+
+// ToggleDebug switches between debug and the configured level, for SIGUSR1
+func ToggleDebug() {
+	next := zapcore.DebugLevel
+	if level.Level() == zapcore.DebugLevel {
+		next = configuredLevel
+		if next == zapcore.DebugLevel {
+			next = zapcore.InfoLevel
+		}
+	}
+	level.SetLevel(next)
+	updateMinLevel()
+	Info("Log level switched", zap.String("level", next.String()))
+}
+
+// ToggleConsole switches console output, for SIGUSR2
+func ToggleConsole() {
+	enabled := !console.Load()
+	console.Store(enabled)
+	Info("Console logging switched", zap.Bool("console", enabled))
+}
+
+// CurrentState returns the logging configuration in effect
+func CurrentState() State {
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+	state := State{
+		Level:   level.String(),
+		Console: console.Load(),
+		Modules: make(map[string]string, len(modules)),
+	}
+	for module, moduleLevel := range modules {
+		state.Modules[module] = moduleLevel.String()
+	}
+	rateLimitsMu.RLock()
+	state.RateLimits = make(map[string]int, len(rateLimits))
+	for category, limit := range rateLimits {
+		state.RateLimits[category] = limit
+	}
+	rateLimitsMu.RUnlock()
+	return state
+}
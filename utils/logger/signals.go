@@ -0,0 +1,25 @@
+//go:build !windows
+
+package logger
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchSignals switches debug logging on SIGUSR1 and console output on SIGUSR2
+func WatchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				ToggleDebug()
+			case syscall.SIGUSR2:
+				ToggleConsole()
+			}
+		}
+	}()
+}
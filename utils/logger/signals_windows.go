@@ -0,0 +1,4 @@
+package logger
+
+// WatchSignals does nothing on Windows, which has no SIGUSR1 and SIGUSR2; use /api/logging
+func WatchSignals() {}
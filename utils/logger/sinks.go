@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// sinkCores builds a core per configured log sink, plus the console core unless stdout already
+// carries the JSON entries. Every core accepts every level; the filtering cores wrapped around
+// them apply the runtime levels and the redacting cores below them the redaction.
+func sinkCores(cfg *config.Config, encoderConfig zapcore.EncoderConfig) ([]zapcore.Core, error) {
+	var cores []zapcore.Core
+	add := func(core zapcore.Core) {
+		cores = append(cores, &filteredCore{Core: &redactingCore{Core: core}})
+	}
+
+	for _, sink := range cfg.LogSinks {
+		switch sink {
+		case config.LogSinkFile:
+			// Configure lumberjack for log rotation
+			logRotator := &lumberjack.Logger{
+				Filename:   cfg.LogFile, // Log file path
+				MaxSize:    100,         // Max size per log file: 100MB
+				MaxBackups: 30,          // Keep 30 backup files
+				MaxAge:     7,           // Keep logs for 7 days
+				Compress:   true,        // Compress old log files
+			}
+			add(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(logRotator), zapcore.DebugLevel))
+		case config.LogSinkStdout:
+			add(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.Lock(os.Stdout), zapcore.DebugLevel))
+		case config.LogSinkSyslog:
+			core, err := newSyslogCore(cfg, encoderConfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+			}
+			add(core)
+		case config.LogSinkLoki:
+			add(newLokiCore(cfg, encoderConfig))
+		default:
+			return nil, fmt.Errorf("unsupported log sink %q", sink)
+		}
+	}
+
+	// The console core is switched at runtime; with the stdout sink every entry is on stdout
+	// already, so it stays off
+	if !slices.Contains(cfg.LogSinks, config.LogSinkStdout) {
+		cores = append(cores, &filteredCore{Core: &redactingCore{Core: zapcore.NewCore(
+			zapcore.NewConsoleEncoder(encoderConfig),
+			zapcore.AddSync(os.Stdout),
+			zapcore.DebugLevel,
+		)}, console: true})
+	}
+	return cores, nil
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+
+package logger
+
+import (
+	"log/syslog"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogCore writes entries as JSON messages to syslog, at the syslog severity of their level
+type syslogCore struct {
+	encoder zapcore.Encoder
+	writer  *syslog.Writer
+}
+
+// newSyslogCore connects to the syslog server of SYSLOG_ADDR (network://host:port), or to the
+// local syslog when it is empty
+func newSyslogCore(cfg *config.Config, encoderConfig zapcore.EncoderConfig) (zapcore.Core, error) {
+	var network, addr string
+	if cfg.SyslogAddr != "" {
+		network, addr, _ = strings.Cut(cfg.SyslogAddr, "://")
+	}
+	writer, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, cfg.SyslogTag)
+	if err != nil {
+		return nil, err
+	}
+	// Syslog stamps messages itself
+	encoderConfig.TimeKey = zapcore.OmitKey
+	return &syslogCore{encoder: zapcore.NewJSONEncoder(encoderConfig), writer: writer}, nil
+}
+
+func (c *syslogCore) Enabled(zapcore.Level) bool {
+	return true
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	return &syslogCore{encoder: encoder, writer: c.writer}
+}
+
+func (c *syslogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce.AddCore(ent, c)
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	msg := buf.String()
+	buf.Free()
+
+	switch ent.Level {
+	case zapcore.DebugLevel:
+		return c.writer.Debug(msg)
+	case zapcore.InfoLevel:
+		return c.writer.Info(msg)
+	case zapcore.WarnLevel:
+		return c.writer.Warning(msg)
+	case zapcore.ErrorLevel:
+		return c.writer.Err(msg)
+	default:
+		return c.writer.Crit(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
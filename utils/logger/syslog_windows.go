@@ -0,0 +1,13 @@
+package logger
+
+import (
+	"fmt"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"go.uber.org/zap/zapcore"
+)
+
+// newSyslogCore fails on Windows, which has no syslog; use the file, stdout or loki sink
+func newSyslogCore(cfg *config.Config, encoderConfig zapcore.EncoderConfig) (zapcore.Core, error) {
+	return nil, fmt.Errorf("syslog is not supported on Windows")
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,21 +21,69 @@ import (
 
 // ImageMetadata stores metadata information for images
 type ImageMetadata struct {
-	ID           string              `json:"id"`           // Image ID (without extension)
-	OriginalName string              `json:"originalName"` // Original filename
-	UploadTime   time.Time           `json:"uploadTime"`   // Upload timestamp
-	ExpiryTime   time.Time           `json:"expiryTime"`   // Expiry timestamp (if set)
-	Format       string              `json:"format"`       // Original format
-	Orientation  string              `json:"orientation"`  // Image orientation
-	Tags         []string            `json:"tags"`         // Image tags for categorization
-	Sizes        map[string]int64    `json:"sizes"`        // File sizes for different formats
-	Paths        struct {
-		Original string `json:"original"` // Path to original image
-		WebP     string `json:"webp"`     // Path to WebP format
-		AVIF     string `json:"avif"`     // Path to AVIF format
+	ID             string           `json:"id"`                       // Image ID (without extension)
+	OriginalName   string           `json:"originalName"`             // Original filename
+	UploadTime     time.Time        `json:"uploadTime"`               // Upload timestamp
+	ExpiryTime     time.Time        `json:"expiryTime"`               // Expiry timestamp (if set)
+	Format         string           `json:"format"`                   // Original format
+	Orientation    string           `json:"orientation"`              // Image orientation
+	Width          int              `json:"width,omitempty"`          // Width in pixels
+	Height         int              `json:"height,omitempty"`         // Height in pixels
+	Tags           []string         `json:"tags"`                     // Image tags for categorization
+	Visibility     Visibility       `json:"visibility,omitempty"`     // public, unlisted or private
+	Likes          int64            `json:"likes,omitempty"`          // Number of likes (maintained by LikeImage)
+	Serves         int64            `json:"serves,omitempty"`         // Number of times the image was served (flushed by ServeStats)
+	LastServed     *time.Time       `json:"lastServed,omitempty"`     // When the image was last served, as of the last flush
+	PHash          string           `json:"phash,omitempty"`          // Perceptual hash (hex) used by reverse image search
+	ContentHash    string           `json:"contentHash,omitempty"`    // SHA-256 (hex) of the uploaded bytes, used to deduplicate uploads
+	Blurhash       string           `json:"blurhash,omitempty"`       // BlurHash of the image, decoded by frontends into a placeholder
+	OCRText        string           `json:"ocrText,omitempty"`        // Text extracted by OCR (maintained by ExtractAndStoreText)
+	Profile        string           `json:"profile,omitempty"`        // Processing profile the derivatives were generated with
+	HasAlpha       bool             `json:"hasAlpha,omitempty"`       // Whether the original has transparent pixels (PNG only)
+	Watermarked    bool             `json:"watermarked,omitempty"`    // Whether the WebP and AVIF variants carry a watermark
+	Animated       bool             `json:"animated,omitempty"`       // Whether the original is an animated WebP or PNG, served as is
+	SourceFormat   string           `json:"sourceFormat,omitempty"`   // Format of the upload when the original was converted, e.g. heic
+	FailedVariants []string         `json:"failedVariants,omitempty"` // Variants (webp, avif) whose conversion failed, served as the original
+	Duration       float64          `json:"duration,omitempty"`       // Length in seconds of a video clip, whose poster is the original
+	DarkVariant    string           `json:"darkVariant,omitempty"`    // ID of the image's dark-mode variant (maintained by PairThemeVariants)
+	LightVariant   string           `json:"lightVariant,omitempty"`   // ID of the image this is the dark-mode variant of
+	Sizes          map[string]int64 `json:"sizes"`                    // File sizes for different formats
+	LayoutVersion  int              `json:"layoutVersion,omitempty"`  // Key layout version the paths were written with
+	Paths          struct {
+		Original   string            `json:"original"`             // Path to original image
+		WebP       string            `json:"webp"`                 // Path to WebP format
+		AVIF       string            `json:"avif"`                 // Path to AVIF format
+		Thumbnails map[string]string `json:"thumbnails,omitempty"` // Paths to WebP thumbnails by size ("256", "512")
+		Video      string            `json:"video,omitempty"`      // Path to the uploaded video clip, for clips
 	} `json:"paths"`
 }
 
+// HasVariant reports whether a converted variant (webp or avif) was generated for the image
+func (m *ImageMetadata) HasVariant(format string) bool {
+	switch format {
+	case "webp":
+		return m.Paths.WebP != ""
+	case "avif":
+		return m.Paths.AVIF != ""
+	}
+	return false
+}
+
+// ObjectKeys returns the storage keys of every object of the image: the original, its converted
+// variants, the video clip it is the poster of and its thumbnails
+func (m *ImageMetadata) ObjectKeys() []string {
+	var keys []string
+	for _, key := range []string{m.Paths.Original, m.Paths.WebP, m.Paths.AVIF, m.Paths.Video} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	for _, size := range slices.Sorted(maps.Keys(m.Paths.Thumbnails)) {
+		keys = append(keys, m.Paths.Thumbnails[size])
+	}
+	return keys
+}
+
 // MetadataStore defines the interface for metadata storage operations
 type MetadataStore interface {
 	SaveMetadata(ctx context.Context, metadata *ImageMetadata) error
@@ -142,7 +192,11 @@ func (lms *LocalMetadataStore) ListExpiredImages(ctx context.Context) ([]*ImageM
 // DeleteMetadata deletes image metadata
 func (lms *LocalMetadataStore) DeleteMetadata(ctx context.Context, id string) error {
 	metadataPath := filepath.Join(lms.BasePath, "metadata", id+".json")
-	return os.Remove(metadataPath)
+	if err := os.Remove(metadataPath); err != nil {
+		return err
+	}
+	deleteResizedVariants(ctx, id)
+	return nil
 }
 
 // GetAllMetadata retrieves all image metadata from local storage
@@ -283,7 +337,11 @@ func (sms *S3MetadataStore) ListExpiredImages(ctx context.Context) ([]*ImageMeta
 // DeleteMetadata deletes image metadata from S3
 func (sms *S3MetadataStore) DeleteMetadata(ctx context.Context, id string) error {
 	key := sms.prefix + id + ".json"
-	return sms.client.Delete(ctx, key)
+	if err := sms.client.Delete(ctx, key); err != nil {
+		return err
+	}
+	deleteResizedVariants(ctx, id)
+	return nil
 }
 
 // GetAllMetadata retrieves all image metadata from S3
@@ -291,7 +349,7 @@ func (s3ms *S3MetadataStore) GetAllMetadata(ctx context.Context) ([]*ImageMetada
 	var allMetadata []*ImageMetadata
 	metadataPrefix := "metadata/"
 
-	s3Storage, ok := Storage.(*S3Storage)
+	s3Storage, ok := StorageBackend().(*S3Storage)
 	if !ok {
 		return nil, fmt.Errorf("failed to get S3 storage instance")
 	}
@@ -334,6 +392,13 @@ func InitMetadataStore(cfg *config.Config) error {
 	}
 
 	if IsRedisMetadataStore() {
+		// Refuse to share Redis with instances using a different storage configuration
+		state, err := RegisterClusterState(context.Background(), cfg)
+		if err != nil {
+			return err
+		}
+		ClusterStateRegistered = state
+
 		MetadataManager = NewRedisMetadataStore()
 		logger.Info("Redis metadata store initialized")
 
@@ -356,12 +421,25 @@ func InitMetadataStore(cfg *config.Config) error {
 		return nil
 	}
 
+	if cfg.MetadataStoreType == config.MetadataStoreTypeSQLite {
+		path := cfg.SQLitePath
+		if path == "" {
+			path = filepath.Join(cfg.ImageBasePath, "metadata.db")
+		}
+		store, err := NewSQLiteMetadataStore(path)
+		if err != nil {
+			return err
+		}
+		MetadataManager = store
+		return nil
+	}
+
 	if cfg.StorageType == config.StorageTypeS3 {
 		if S3Client == nil {
 			return fmt.Errorf("S3 client not initialized")
 		}
 
-		s3Storage, ok := Storage.(*S3Storage)
+		s3Storage, ok := StorageBackend().(*S3Storage)
 		if !ok {
 			return fmt.Errorf("failed to get S3 storage instance")
 		}
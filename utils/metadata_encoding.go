@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// compactMetadataField holds the packed static fields of compactly encoded metadata. Fields
+// changed on their own (visibility, likes, phash, ocrText) stay separate hash fields in both
+// encodings, so they can still be updated in place.
+const compactMetadataField = "m"
+
+// compactMetadataVersion is the first byte of a packed value
+const compactMetadataVersion = 1
+
+// staticMetadataFields are the hash fields packed by the compact encoding
+var staticMetadataFields = []string{
+	"id", "originalName", "uploadTime", "expiryTime", "format", "orientation", "tags",
+	"paths", "sizes", "layoutVersion", "width", "height", "profile", "hasAlpha",
+}
+
+// metadataEncoding is the encoding new metadata is written with
+var metadataEncoding = config.MetadataEncodingDefault
+
+// metadataFields returns the hash fields of an image's metadata in the configured encoding
+func metadataFields(metadata *ImageMetadata) (map[string]interface{}, error) {
+	if metadataEncoding == config.MetadataEncodingCompact {
+		return map[string]interface{}{
+			compactMetadataField: encodeCompactMetadata(metadata),
+			"visibility":         string(metadata.EffectiveVisibility()),
+		}, nil
+	}
+
+	pathsJSON, err := json.Marshal(metadata.Paths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal paths: %v", err)
+	}
+	sizesJSON, err := json.Marshal(metadata.Sizes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal sizes: %v", err)
+	}
+	return map[string]interface{}{
+		"id":            metadata.ID,
+		"originalName":  metadata.OriginalName,
+		"uploadTime":    metadata.UploadTime.Format(time.RFC3339),
+		"expiryTime":    metadata.ExpiryTime.Format(time.RFC3339),
+		"format":        metadata.Format,
+		"orientation":   metadata.Orientation,
+		"tags":          strings.Join(metadata.Tags, ","),
+		"paths":         string(pathsJSON),
+		"sizes":         string(sizesJSON),
+		"layoutVersion": metadata.LayoutVersion,
+		"width":         metadata.Width,
+		"height":        metadata.Height,
+		"visibility":    string(metadata.EffectiveVisibility()),
+		"profile":       metadata.Profile,
+		"hasAlpha":      strconv.FormatBool(metadata.HasAlpha),
+	}, nil
+}
+
+// staleMetadataFields returns the hash fields of the other encoding, removed when metadata is
+// rewritten so a hash never mixes both encodings
+func staleMetadataFields() []string {
+	if metadataEncoding == config.MetadataEncodingCompact {
+		return staticMetadataFields
+	}
+	return []string{compactMetadataField}
+}
+
+// encodeCompactMetadata packs the static fields into varints and length-prefixed strings. The
+// image ID is left out of paths (it is part of the key), which removes most of their size.
+func encodeCompactMetadata(metadata *ImageMetadata) []byte {
+	buf := make([]byte, 0, 128)
+	putString := func(s string) {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	putTime := func(t time.Time) {
+		if t.IsZero() {
+			buf = binary.AppendVarint(buf, 0)
+		} else {
+			buf = binary.AppendVarint(buf, t.Unix())
+		}
+	}
+	putPath := func(p string) {
+		if metadata.ID != "" {
+			p = strings.ReplaceAll(p, metadata.ID, "\x00")
+		}
+		putString(p)
+	}
+
+	buf = append(buf, compactMetadataVersion)
+	putString(metadata.OriginalName)
+	putTime(metadata.UploadTime)
+	putTime(metadata.ExpiryTime)
+	putString(metadata.Format)
+	putString(metadata.Orientation)
+	buf = binary.AppendUvarint(buf, uint64(len(metadata.Tags)))
+	for _, tag := range metadata.Tags {
+		putString(tag)
+	}
+	putPath(metadata.Paths.Original)
+	putPath(metadata.Paths.WebP)
+	putPath(metadata.Paths.AVIF)
+	formats := make([]string, 0, len(metadata.Sizes))
+	for format := range metadata.Sizes {
+		formats = append(formats, format)
+	}
+	slices.Sort(formats)
+	buf = binary.AppendUvarint(buf, uint64(len(formats)))
+	for _, format := range formats {
+		putString(format)
+		buf = binary.AppendVarint(buf, metadata.Sizes[format])
+	}
+	buf = binary.AppendUvarint(buf, uint64(metadata.LayoutVersion))
+	buf = binary.AppendUvarint(buf, uint64(metadata.Width))
+	buf = binary.AppendUvarint(buf, uint64(metadata.Height))
+	putString(metadata.Profile)
+	var hasAlpha uint64
+	if metadata.HasAlpha {
+		hasAlpha = 1
+	}
+	buf = binary.AppendUvarint(buf, hasAlpha)
+	sizes := slices.Sorted(maps.Keys(metadata.Paths.Thumbnails))
+	buf = binary.AppendUvarint(buf, uint64(len(sizes)))
+	for _, size := range sizes {
+		putString(size)
+		putPath(metadata.Paths.Thumbnails[size])
+	}
+	putPath(metadata.Paths.Video)
+	return buf
+}
+
+// decodeCompactMetadata unpacks the static fields of an image
+func decodeCompactMetadata(id string, data []byte) (*ImageMetadata, error) {
+	if len(data) == 0 || data[0] != compactMetadataVersion {
+		return nil, fmt.Errorf("unsupported compact metadata version")
+	}
+	data = data[1:]
+
+	var failed bool
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	str := func() string {
+		n := uvarint()
+		if failed || n > uint64(len(data)) {
+			failed = true
+			return ""
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s
+	}
+	timestamp := func() time.Time {
+		if sec := varint(); sec != 0 {
+			return time.Unix(sec, 0).UTC()
+		}
+		return time.Time{}
+	}
+	path := func() string {
+		return strings.ReplaceAll(str(), "\x00", id)
+	}
+
+	metadata := &ImageMetadata{ID: id}
+	metadata.OriginalName = str()
+	metadata.UploadTime = timestamp()
+	metadata.ExpiryTime = timestamp()
+	metadata.Format = str()
+	metadata.Orientation = str()
+	for n := uvarint(); n > 0 && !failed; n-- {
+		metadata.Tags = append(metadata.Tags, str())
+	}
+	metadata.Paths.Original = path()
+	metadata.Paths.WebP = path()
+	metadata.Paths.AVIF = path()
+	metadata.Sizes = make(map[string]int64)
+	for n := uvarint(); n > 0 && !failed; n-- {
+		format := str()
+		metadata.Sizes[format] = varint()
+	}
+	metadata.LayoutVersion = int(uvarint())
+	metadata.Width = int(uvarint())
+	metadata.Height = int(uvarint())
+	metadata.Profile = str()
+	// Values packed before the alpha flag was added end here
+	if len(data) > 0 {
+		metadata.HasAlpha = uvarint() == 1
+	}
+	// Values packed before thumbnails were added end here
+	if len(data) > 0 {
+		for n := uvarint(); n > 0 && !failed; n-- {
+			if metadata.Paths.Thumbnails == nil {
+				metadata.Paths.Thumbnails = make(map[string]string)
+			}
+			size := str()
+			metadata.Paths.Thumbnails[size] = path()
+		}
+	}
+	// Values packed before video clips were added end here
+	if len(data) > 0 {
+		metadata.Paths.Video = path()
+	}
+
+	if failed {
+		return nil, fmt.Errorf("truncated compact metadata")
+	}
+	return metadata, nil
+}
+
+// ExpandMetadataFields returns the fields of a metadata hash with compactly encoded values
+// unpacked into the regular hash fields, so readers handle both encodings alike
+func ExpandMetadataFields(id string, data map[string]string) map[string]string {
+	packed, ok := data[compactMetadataField]
+	if !ok {
+		return data
+	}
+
+	metadata, err := decodeCompactMetadata(id, []byte(packed))
+	if err != nil {
+		logger.Warn("Failed to decode compact metadata",
+			zap.String("id", id),
+			zap.Error(err))
+		return data
+	}
+	expanded := make(map[string]string, len(data)+len(staticMetadataFields))
+	for field, value := range data {
+		if field != compactMetadataField {
+			expanded[field] = value
+		}
+	}
+	setStaticFieldValues(expanded, metadata)
+	return expanded
+}
+
+// MetadataFieldValues returns an image's metadata as the fields of a regular metadata hash, for
+// stores without hashes to share the readers of Redis metadata
+func MetadataFieldValues(metadata *ImageMetadata) map[string]string {
+	fields := make(map[string]string, len(staticMetadataFields)+2)
+	setStaticFieldValues(fields, metadata)
+	fields["visibility"] = string(metadata.EffectiveVisibility())
+	fields["likes"] = strconv.FormatInt(metadata.Likes, 10)
+	fields["blurhash"] = metadata.Blurhash
+	fields["serves"] = strconv.FormatInt(metadata.Serves, 10)
+	if metadata.LastServed != nil {
+		fields["lastServed"] = strconv.FormatInt(metadata.LastServed.Unix(), 10)
+	}
+	return fields
+}
+
+// setStaticFieldValues sets the static hash fields of an image as strings
+func setStaticFieldValues(fields map[string]string, metadata *ImageMetadata) {
+	pathsJSON, _ := json.Marshal(metadata.Paths)
+	sizesJSON, _ := json.Marshal(metadata.Sizes)
+
+	fields["id"] = metadata.ID
+	fields["originalName"] = metadata.OriginalName
+	fields["uploadTime"] = metadata.UploadTime.Format(time.RFC3339)
+	fields["expiryTime"] = metadata.ExpiryTime.Format(time.RFC3339)
+	fields["format"] = metadata.Format
+	fields["orientation"] = metadata.Orientation
+	fields["tags"] = strings.Join(metadata.Tags, ",")
+	fields["paths"] = string(pathsJSON)
+	fields["sizes"] = string(sizesJSON)
+	fields["layoutVersion"] = strconv.Itoa(metadata.LayoutVersion)
+	fields["width"] = strconv.Itoa(metadata.Width)
+	fields["height"] = strconv.Itoa(metadata.Height)
+	fields["profile"] = metadata.Profile
+	fields["hasAlpha"] = strconv.FormatBool(metadata.HasAlpha)
+}
+
+// ReencodeMetadata rewrites the metadata of every image of every tenant in the configured
+// encoding, leaving indexes untouched. It returns the number of rewritten images.
+func ReencodeMetadata(ctx context.Context) (int, error) {
+	rms := NewRedisMetadataStore()
+	rewritten := 0
+
+	for _, tenantCtx := range TenantContexts(ctx) {
+		ids, err := RedisClient.ZRange(tenantCtx, KeyPrefix(tenantCtx)+"images", 0, -1).Result()
+		if err != nil {
+			return rewritten, err
+		}
+
+		for batch := range slices.Chunk(ids, 500) {
+			pipe := RedisClient.Pipeline()
+			for _, id := range batch {
+				metadata, err := rms.GetMetadata(tenantCtx, id)
+				if err != nil {
+					logger.Warn("Skipping unreadable metadata",
+						zap.String("id", id),
+						zap.Error(err))
+					continue
+				}
+				fields, err := metadataFields(metadata)
+				if err != nil {
+					return rewritten, err
+				}
+				key := rms.metadataPrefix(tenantCtx) + id
+				pipe.HDel(tenantCtx, key, staleMetadataFields()...)
+				pipe.HSet(tenantCtx, key, fields)
+				rewritten++
+			}
+			if _, err := pipe.Exec(tenantCtx); err != nil {
+				return rewritten, err
+			}
+		}
+	}
+	return rewritten, nil
+}
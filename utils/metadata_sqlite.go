@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// sqliteDriverName is the database/sql driver the SQLite metadata store opens. The driver is
+// registered by modernc.org/sqlite (see sqlite_driver.go).
+const sqliteDriverName = "sqlite"
+
+// sqliteSchema creates the tables of the SQLite metadata store. The full metadata is kept as
+// JSON; the columns beside it only serve the expiry and tag queries.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS images (
+	tenant      TEXT    NOT NULL,
+	id          TEXT    NOT NULL,
+	upload_time INTEGER NOT NULL,
+	expiry_time INTEGER NOT NULL DEFAULT 0,
+	data        TEXT    NOT NULL,
+	PRIMARY KEY (tenant, id)
+);
+CREATE INDEX IF NOT EXISTS images_upload_time ON images (tenant, upload_time);
+CREATE INDEX IF NOT EXISTS images_expiry_time ON images (tenant, expiry_time) WHERE expiry_time > 0;
+CREATE TABLE IF NOT EXISTS image_tags (
+	tenant TEXT NOT NULL,
+	tag    TEXT NOT NULL,
+	id     TEXT NOT NULL,
+	PRIMARY KEY (tenant, tag, id)
+);
+`
+
+// SQLiteMetadataStore implements metadata storage in an embedded SQLite database, for
+// single-node deployments running without Redis
+type SQLiteMetadataStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteMetadataStore opens (creating if needed) the SQLite database at path
+func NewSQLiteMetadataStore(path string) (*SQLiteMetadataStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+	// A single connection serializes writes, so concurrent uploads never fail with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", sqliteSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize sqlite database: %v", err)
+		}
+	}
+
+	logger.Info("SQLite metadata store opened",
+		zap.String("path", path))
+	return &SQLiteMetadataStore{db: db}, nil
+}
+
+// IsSQLiteMetadataStore reports whether metadata is stored in SQLite
+func IsSQLiteMetadataStore() bool {
+	_, ok := MetadataManager.(*SQLiteMetadataStore)
+	return ok
+}
+
+// HasTagIndex reports whether the metadata store answers tag queries (GetAllUniqueTags,
+// GetImagesByTag and GetImagesByMultipleTags) without reading every image's metadata
+func HasTagIndex() bool {
+	return IsRedisMetadataStore() || IsSQLiteMetadataStore()
+}
+
+// sqliteTenant returns the tenant column value of a request; the default tenant is empty
+func sqliteTenant(ctx context.Context) string {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		return tenant.ID
+	}
+	return ""
+}
+
+func (s *SQLiteMetadataStore) SaveMetadata(ctx context.Context, metadata *ImageMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %v", err)
+	}
+	var expiry int64
+	if !metadata.ExpiryTime.IsZero() {
+		expiry = metadata.ExpiryTime.Unix()
+	}
+	tenant := sqliteTenant(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO images (tenant, id, upload_time, expiry_time, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, id) DO UPDATE SET
+			upload_time = excluded.upload_time, expiry_time = excluded.expiry_time, data = excluded.data`,
+		tenant, metadata.ID, metadata.UploadTime.Unix(), expiry, string(data)); err != nil {
+		return fmt.Errorf("failed to save metadata: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_tags WHERE tenant = ? AND id = ?`, tenant, metadata.ID); err != nil {
+		return fmt.Errorf("failed to update tags: %v", err)
+	}
+	for _, tag := range metadata.Tags {
+		if tag == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO image_tags (tenant, tag, id) VALUES (?, ?, ?)`,
+			tenant, tag, metadata.ID); err != nil {
+			return fmt.Errorf("failed to update tags: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteMetadataStore) GetMetadata(ctx context.Context, id string) (*ImageMetadata, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM images WHERE tenant = ? AND id = ?`,
+		sqliteTenant(ctx), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("metadata not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %v", err)
+	}
+
+	var metadata ImageMetadata
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+	return &metadata, nil
+}
+
+// queryMetadata returns the metadata of the images a query selects the data column of
+func (s *SQLiteMetadataStore) queryMetadata(ctx context.Context, query string, args ...interface{}) ([]*ImageMetadata, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*ImageMetadata
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var metadata ImageMetadata
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			logger.Warn("Skipping unreadable metadata",
+				zap.Error(err))
+			continue
+		}
+		result = append(result, &metadata)
+	}
+	return result, rows.Err()
+}
+
+// queryStrings returns the single string column a query selects
+func (s *SQLiteMetadataStore) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteMetadataStore) ListExpiredImages(ctx context.Context) ([]*ImageMetadata, error) {
+	return s.queryMetadata(ctx, `SELECT data FROM images WHERE tenant = ? AND expiry_time > 0 AND expiry_time <= ?`,
+		sqliteTenant(ctx), time.Now().Unix())
+}
+
+func (s *SQLiteMetadataStore) DeleteMetadata(ctx context.Context, id string) error {
+	tenant := sqliteTenant(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM images WHERE tenant = ? AND id = ?`, tenant, id); err != nil {
+		return fmt.Errorf("failed to delete metadata: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM image_tags WHERE tenant = ? AND id = ?`, tenant, id); err != nil {
+		return fmt.Errorf("failed to delete tags: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteResizedVariants(ctx, id)
+	return nil
+}
+
+// GetAllMetadata returns the metadata of every image, most recently uploaded first
+func (s *SQLiteMetadataStore) GetAllMetadata(ctx context.Context) ([]*ImageMetadata, error) {
+	return s.queryMetadata(ctx, `SELECT data FROM images WHERE tenant = ? ORDER BY upload_time DESC`,
+		sqliteTenant(ctx))
+}
+
+// GetAllUniqueTags returns every tag in use, sorted
+func (s *SQLiteMetadataStore) GetAllUniqueTags(ctx context.Context) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT DISTINCT tag FROM image_tags WHERE tenant = ? ORDER BY tag`,
+		sqliteTenant(ctx))
+}
+
+// GetImagesByTag returns the IDs of the images with a tag
+func (s *SQLiteMetadataStore) GetImagesByTag(ctx context.Context, tag string) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT id FROM image_tags WHERE tenant = ? AND tag = ?`,
+		sqliteTenant(ctx), tag)
+}
+
+// GetImagesByMultipleTags returns the IDs of the images with all of the tags
+func (s *SQLiteMetadataStore) GetImagesByMultipleTags(ctx context.Context, tags []string) ([]string, error) {
+	tags = slices.Compact(slices.Sorted(slices.Values(tags)))
+	if len(tags) == 0 {
+		return []string{}, nil
+	}
+
+	args := make([]interface{}, 0, len(tags)+2)
+	args = append(args, sqliteTenant(ctx))
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	args = append(args, len(tags))
+	query := `SELECT id FROM image_tags WHERE tenant = ? AND tag IN (?` + strings.Repeat(", ?", len(tags)-1) + `)
+		GROUP BY id HAVING COUNT(*) = ?`
+	return s.queryStrings(ctx, query, args...)
+}
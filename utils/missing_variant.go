@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// MissingVariantTTL is how long a WebP or AVIF variant found missing is remembered, serving
+// the original without asking storage for the variant again while it is regenerated
+const MissingVariantTTL = 5 * time.Minute
+
+// regeneratingVariants holds the images whose variants are being regenerated by this process
+var regeneratingVariants sync.Map
+
+// A missing variant is a key expiring after MissingVariantTTL, removed once it is regenerated
+func missingVariantKey(ctx context.Context, id, format string) string {
+	return KeyPrefix(ctx) + "missing_variant:" + id + ":" + format
+}
+
+// VariantMissing reports whether a variant of an image was recently found missing. Without
+// Redis, missing variants are not remembered.
+func VariantMissing(ctx context.Context, id, format string) bool {
+	if !IsRedisMetadataStore() {
+		return false
+	}
+	count, err := RedisClient.Exists(ctx, missingVariantKey(ctx, id, format)).Result()
+	return err == nil && count > 0
+}
+
+// MarkVariantMissing remembers that a variant of an image is missing. The first request finding
+// it missing regenerates the image's variants in the background by repairing the image, which
+// forgets the variant was missing once it is stored again.
+func MarkVariantMissing(ctx context.Context, cfg *config.Config, id, format string) {
+	if !IsRedisMetadataStore() {
+		return
+	}
+	key := missingVariantKey(ctx, id, format)
+	first, err := RedisClient.SetNX(ctx, key, time.Now().Format(time.RFC3339), MissingVariantTTL).Result()
+	if err != nil {
+		logger.Warn("Failed to record missing variant",
+			zap.String("id", id),
+			zap.String("format", format),
+			zap.Error(err))
+		return
+	}
+	if !first {
+		return
+	}
+	// Both variants of an image may be found missing at once, one repair regenerates them all
+	repairKey := KeyPrefix(ctx) + id
+	if _, running := regeneratingVariants.LoadOrStore(repairKey, true); running {
+		return
+	}
+
+	go func() {
+		defer regeneratingVariants.Delete(repairKey)
+		ctx := context.WithoutCancel(ctx)
+		report, err := RepairImage(ctx, cfg, id)
+		if err != nil {
+			logger.Warn("Failed to regenerate missing variant",
+				zap.String("id", id),
+				zap.String("format", format),
+				zap.Error(err))
+			return
+		}
+		for _, variant := range []string{"webp", "avif"} {
+			if !report.Image.HasVariant(variant) {
+				continue
+			}
+			if err := RedisClient.Del(ctx, missingVariantKey(ctx, id, variant)).Err(); err != nil {
+				logger.Warn("Failed to clear missing variant", zap.String("id", id), zap.Error(err))
+			}
+		}
+		logger.Info("Regenerated missing variant",
+			zap.String("id", id),
+			zap.String("format", format),
+			zap.Strings("changes", report.Changes))
+	}()
+}
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// maxOCRTextLength caps the stored text of a single image
+const maxOCRTextLength = 10000
+
+// TextExtractor extracts text from an encoded image
+type TextExtractor interface {
+	ExtractText(ctx context.Context, data []byte) (string, error)
+}
+
+// OCR is the configured text extractor, nil when OCR is disabled
+var OCR TextExtractor
+
+// TextMatch is a library image whose extracted text matches a query
+type TextMatch struct {
+	ID      string `json:"id"`
+	Snippet string `json:"snippet"` // Extracted text around the first match
+}
+
+// TesseractExtractor runs the tesseract command line tool
+type TesseractExtractor struct {
+	languages string
+	timeout   time.Duration
+}
+
+// ExtractText pipes the image through tesseract and returns the recognized text
+func (t *TesseractExtractor) ExtractText(ctx context.Context, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	args := []string{"stdin", "stdout"}
+	if t.languages != "" {
+		args = append(args, "-l", t.languages)
+	}
+	cmd := exec.CommandContext(ctx, "tesseract", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tesseract failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// APIExtractor calls an external OCR service that receives POST {"image": "<base64>"}
+// and answers {"text": "..."}
+type APIExtractor struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// ExtractText sends the image to the OCR service and returns the recognized text
+func (a *APIExtractor) ExtractText(ctx context.Context, data []byte) (string, error) {
+	payload, err := json.Marshal(map[string]string{"image": base64.StdEncoding.EncodeToString(data)})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal OCR request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create OCR request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.apiKey)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OCR service request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("OCR service returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode OCR response: %v", err)
+	}
+	return result.Text, nil
+}
+
+func ocrIndexKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "ocr_text"
+}
+
+// InitOCR configures the text extractor selected by OCR_ENGINE
+func InitOCR(cfg *config.Config) {
+	timeout := time.Duration(cfg.OCRTimeout) * time.Second
+
+	switch cfg.OCREngine {
+	case config.OCREngineTesseract:
+		if _, err := exec.LookPath("tesseract"); err != nil {
+			logger.Warn("OCR disabled: tesseract not found in PATH")
+			return
+		}
+		OCR = &TesseractExtractor{languages: cfg.OCRLanguages, timeout: timeout}
+	case config.OCREngineAPI:
+		if cfg.OCRAPIURL == "" {
+			logger.Warn("OCR disabled: OCR_API_URL is not set")
+			return
+		}
+		OCR = &APIExtractor{
+			url:    cfg.OCRAPIURL,
+			apiKey: cfg.OCRAPIKey,
+			client: &http.Client{Timeout: timeout},
+		}
+	default:
+		return
+	}
+
+	logger.Info("OCR enabled", zap.String("engine", string(cfg.OCREngine)))
+}
+
+// OCREnabled reports whether uploads are run through OCR
+func OCREnabled() bool {
+	return OCR != nil && IsRedisMetadataStore() && FeatureEnabled(FeatureOCR)
+}
+
+// normalizeOCRText collapses whitespace and truncates the text for storage
+func normalizeOCRText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxOCRTextLength {
+		text = string(runes[:maxOCRTextLength])
+	}
+	return text
+}
+
+// ExtractAndStoreText runs OCR on an image and saves the text to its metadata and the
+// search index. It is a no-op when OCR is disabled.
+func ExtractAndStoreText(ctx context.Context, id string, data []byte) error {
+	if !OCREnabled() {
+		return nil
+	}
+
+	text, err := OCR.ExtractText(ctx, data)
+	if err != nil {
+		return err
+	}
+	text = normalizeOCRText(text)
+	if text == "" {
+		return nil
+	}
+
+	pipe := RedisClient.Pipeline()
+	pipe.HSet(ctx, KeyPrefix(ctx)+"metadata:"+id, "ocrText", text)
+	pipe.HSet(ctx, ocrIndexKey(ctx), id, text)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store extracted text: %v", err)
+	}
+	return nil
+}
+
+// DeleteImageText removes an image from the text search index
+func DeleteImageText(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HDel(ctx, ocrIndexKey(ctx), id).Err()
+}
+
+// SearchImageText returns images whose extracted text contains every word of the query
+// (case-insensitive), newest first
+func SearchImageText(ctx context.Context, query string, limit int) ([]TextMatch, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return []TextMatch{}, nil
+	}
+
+	texts, err := RedisClient.HGetAll(ctx, ocrIndexKey(ctx)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read text index: %v", err)
+	}
+
+	matches := make([]TextMatch, 0)
+	for id, text := range texts {
+		lower := strings.ToLower(text)
+		matched := true
+		for _, term := range terms {
+			if !strings.Contains(lower, term) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, TextMatch{ID: id, Snippet: textSnippet(text, lower, terms[0])})
+		}
+	}
+
+	// Image IDs start with the upload timestamp
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID > matches[j].ID
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// textSnippet returns about 40 bytes of context on each side of the first match
+func textSnippet(text, lower, term string) string {
+	const radius = 40
+
+	idx := strings.Index(lower, term)
+	if idx < 0 || len(lower) != len(text) {
+		// Lowercasing changed byte offsets; fall back to the start of the text
+		idx = 0
+	}
+	start := max(0, idx-radius)
+	end := min(len(text), idx+len(term)+radius)
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+
+	snippet := text[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
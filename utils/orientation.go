@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/h2non/bimg"
+	"go.uber.org/zap"
+)
+
+// ClassifyOrientation classifies display dimensions as landscape or portrait. Square images
+// are classified as portrait.
+func ClassifyOrientation(width, height int) string {
+	if width > height {
+		return "landscape"
+	}
+	return "portrait"
+}
+
+// DisplayDimensions returns the dimensions an image is displayed with: its pixel dimensions,
+// swapped when its EXIF orientation rotates it by 90 degrees. Converted variants are rotated
+// the same way, so these are also their dimensions.
+func DisplayDimensions(data []byte) (int, int, error) {
+	if meta, err := bimg.NewImage(data).Metadata(); err == nil {
+		// EXIF orientations 5 to 8 are transposed or rotated by 90 or 270 degrees
+		if meta.Orientation >= 5 && meta.Orientation <= 8 {
+			return meta.Size.Height, meta.Size.Width, nil
+		}
+		return meta.Size.Width, meta.Size.Height, nil
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// autoRotateQuality is the quality photos are re-encoded with once rotated upright, high enough
+// for an original
+const autoRotateQuality = 92
+
+// AutoRotate rotates and flips a JPEG, PNG or WebP image upright by its EXIF orientation and
+// marks it as upright, so stored originals display the same with or without EXIF support. It
+// returns the data unchanged when the image is upright already or in another format.
+func AutoRotate(ctx context.Context, data []byte) ([]byte, error) {
+	if EXIFOrientation(data) <= 1 {
+		return data, nil
+	}
+
+	return GetWorkerPool().ProcessTaskContext(ctx, "auto_rotate", func() ([]byte, error) {
+		rotated, err := bimg.NewImage(data).Process(bimg.Options{Quality: autoRotateQuality})
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate image: %v", err)
+		}
+		// libvips keeps the orientation tag of rotated images
+		resetEXIFOrientation(rotated)
+		return rotated, nil
+	})
+}
+
+// reorientKey returns the key of an image object once the image is moved to another
+// orientation. Keys without an orientation (GIFs) are returned unchanged.
+func reorientKey(ctx context.Context, key string, metadata *ImageMetadata, orientation string) string {
+	tenantPrefix := TenantStorageKey(ctx, "")
+	pk, ok := parseImageKey(strings.TrimPrefix(key, tenantPrefix))
+	if !ok || pk.id != metadata.ID || pk.orientation == "" {
+		return key
+	}
+	return TenantStorageKey(ctx, keysForLayout(pk, layoutForVersion(metadata.LayoutVersion), orientation))
+}
+
+// ReclassifyOrientations recomputes the orientation of every image of every tenant from its
+// pixel data, moving the objects of misclassified images to the keys of their new orientation
+// and updating their metadata. Links to the old keys keep working through ResolveImageKey. It
+// returns the number of reclassified images.
+func ReclassifyOrientations(ctx context.Context) (int, error) {
+	if MetadataManager == nil || Storage == nil {
+		return 0, fmt.Errorf("storage and metadata store must be initialized")
+	}
+
+	reclassified := 0
+	for _, tenantCtx := range TenantContexts(ctx) {
+		allMetadata, err := MetadataManager.GetAllMetadata(tenantCtx)
+		if err != nil {
+			return reclassified, fmt.Errorf("failed to list metadata: %v", err)
+		}
+
+		for _, metadata := range allMetadata {
+			changed, err := reclassifyOrientation(tenantCtx, metadata)
+			if err != nil {
+				return reclassified, err
+			}
+			if changed {
+				reclassified++
+			}
+		}
+
+		if err := ClearPageCache(tenantCtx); err != nil {
+			logger.Warn("Failed to clear page cache", zap.Error(err))
+		}
+	}
+
+	logger.Info("Orientation reclassification completed",
+		zap.Int("reclassified", reclassified))
+	return reclassified, nil
+}
+
+// reclassifyOrientation moves a single image to the orientation of its pixel data, reporting
+// whether it changed. Unreadable images are skipped with a warning.
+func reclassifyOrientation(ctx context.Context, metadata *ImageMetadata) (bool, error) {
+	originalKey, err := ResolveImageKey(ctx, metadata.Paths.Original)
+	if err != nil {
+		logger.Warn("Skipping image without original for reclassification",
+			zap.String("id", metadata.ID),
+			zap.Error(err))
+		return false, nil
+	}
+	data, err := Storage.Get(ctx, originalKey)
+	if err != nil {
+		logger.Warn("Failed to read original for reclassification",
+			zap.String("id", metadata.ID),
+			zap.String("key", originalKey),
+			zap.Error(err))
+		return false, nil
+	}
+	width, height, err := DisplayDimensions(data)
+	if err != nil {
+		logger.Warn("Failed to read dimensions for reclassification",
+			zap.String("id", metadata.ID),
+			zap.Error(err))
+		return false, nil
+	}
+
+	orientation := ClassifyOrientation(width, height)
+	if orientation == metadata.Orientation {
+		return false, nil
+	}
+
+	metadata.Paths.Original = originalKey
+	if err := moveToOrientation(ctx, metadata, orientation); err != nil {
+		return false, err
+	}
+
+	logger.Info("Reclassified image orientation",
+		zap.String("id", metadata.ID),
+		zap.String("from", metadata.Orientation),
+		zap.String("to", orientation))
+	metadata.Orientation = orientation
+	metadata.Width, metadata.Height = width, height
+	if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+		return false, fmt.Errorf("failed to save metadata for %s: %v", metadata.ID, err)
+	}
+	return true, nil
+}
+
+// moveToOrientation moves the objects of an image to the keys of another orientation, updating
+// the paths in its metadata. Objects that cannot be read are left in place.
+func moveToOrientation(ctx context.Context, metadata *ImageMetadata, orientation string) error {
+	for _, path := range []*string{&metadata.Paths.Original, &metadata.Paths.WebP, &metadata.Paths.AVIF} {
+		if *path == "" {
+			continue
+		}
+		newKey := reorientKey(ctx, *path, metadata, orientation)
+		if newKey == *path {
+			continue
+		}
+
+		objectData, err := Storage.Get(ctx, *path)
+		if err != nil {
+			logger.Warn("Failed to read object for reclassification",
+				zap.String("id", metadata.ID),
+				zap.String("key", *path),
+				zap.Error(err))
+			continue
+		}
+		if err := Storage.Store(ObjectAccessContext(ctx, metadata), newKey, objectData); err != nil {
+			return fmt.Errorf("failed to store %s: %v", newKey, err)
+		}
+		if err := Storage.Delete(ctx, *path); err != nil {
+			logger.Warn("Failed to delete object after reclassification",
+				zap.String("key", *path),
+				zap.Error(err))
+		}
+		*path = newKey
+	}
+	return nil
+}
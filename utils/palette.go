@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// PaletteColor is a color of an image's palette
+type PaletteColor struct {
+	Hex   string  `json:"hex"`   // CSS hex notation, e.g. #1a2b3c
+	RGB   [3]int  `json:"rgb"`   // Red, green and blue, 0-255
+	Share float64 `json:"share"` // Fraction of the image's opaque pixels close to the color
+}
+
+// Palette holds the colors extracted from an image, most common first
+type Palette struct {
+	Colors   []PaletteColor `json:"colors"`
+	Dominant string         `json:"dominant"` // Hex of the most common color
+	Text     string         `json:"text"`     // Black or white, whichever reads better on the dominant color
+	Dark     bool           `json:"dark"`     // Whether the dominant color is dark
+}
+
+// PaletteSize is the number of colors extracted from an image
+const PaletteSize = 6
+
+const (
+	// maxPaletteSamples bounds the pixels read along each axis so large images are quick
+	maxPaletteSamples = 100
+	// paletteMergeDistance is the RGB distance under which two colors count as one
+	paletteMergeDistance = 40
+)
+
+// ExtractPalette returns the most common colors of an encoded image. Pixels are quantized to
+// 4 bits per channel, and quantized colors closer than paletteMergeDistance are merged so
+// shades of one color do not crowd out the others. Transparent pixels are ignored.
+func ExtractPalette(data []byte, count int) (*Palette, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	bounds := img.Bounds()
+	stepX := max(1, bounds.Dx()/maxPaletteSamples)
+	stepY := max(1, bounds.Dy()/maxPaletteSamples)
+	var total int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// Undo the alpha premultiplication of semi-transparent pixels
+			r, g, b = r*0xffff/a>>8, g*0xffff/a>>8, b*0xffff/a>>8
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			bkt := buckets[key]
+			if bkt == nil {
+				bkt = &bucket{}
+				buckets[key] = bkt
+			}
+			bkt.r += int(r)
+			bkt.g += int(g)
+			bkt.b += int(b)
+			bkt.n++
+			total++
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("image has no opaque pixels")
+	}
+
+	// Merge buckets into the most common nearby colors, largest first
+	sorted := slices.Collect(maps.Values(buckets))
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].n > sorted[j].n
+	})
+	var merged []*bucket
+	for _, bkt := range sorted {
+		var target *bucket
+		for _, m := range merged {
+			if colorDistance(bkt.r/bkt.n, bkt.g/bkt.n, bkt.b/bkt.n, m.r/m.n, m.g/m.n, m.b/m.n) < paletteMergeDistance {
+				target = m
+				break
+			}
+		}
+		if target == nil {
+			merged = append(merged, &bucket{r: bkt.r, g: bkt.g, b: bkt.b, n: bkt.n})
+			continue
+		}
+		target.r += bkt.r
+		target.g += bkt.g
+		target.b += bkt.b
+		target.n += bkt.n
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].n > merged[j].n
+	})
+
+	palette := &Palette{Colors: make([]PaletteColor, 0, count)}
+	for _, m := range merged[:min(count, len(merged))] {
+		rgb := [3]int{m.r / m.n, m.g / m.n, m.b / m.n}
+		palette.Colors = append(palette.Colors, PaletteColor{
+			Hex:   fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]),
+			RGB:   rgb,
+			Share: float64(int(float64(m.n)/float64(total)*1000+0.5)) / 1000,
+		})
+	}
+
+	dominant := palette.Colors[0]
+	palette.Dominant = dominant.Hex
+	palette.Dark = relativeLuminance(dominant.RGB) < 0.179
+	palette.Text = "#000000"
+	if palette.Dark {
+		palette.Text = "#ffffff"
+	}
+	return palette, nil
+}
+
+func colorDistance(r1, g1, b1, r2, g2, b2 int) float64 {
+	dr, dg, db := float64(r1-r2), float64(g1-g2), float64(b1-b2)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+// relativeLuminance is the WCAG relative luminance of a color, 0 for black and 1 for white.
+// Text on colors below 0.179 contrasts more in white than in black.
+func relativeLuminance(rgb [3]int) float64 {
+	var channels [3]float64
+	for i, c := range rgb {
+		v := float64(c) / 255
+		if v <= 0.03928 {
+			channels[i] = v / 12.92
+		} else {
+			channels[i] = math.Pow((v+0.055)/1.055, 2.4)
+		}
+	}
+	return 0.2126*channels[0] + 0.7152*channels[1] + 0.0722*channels[2]
+}
+
+// ImagePalette returns the palette of an image, extracting it from the image's smallest stored
+// file on first use. With Redis the palette is cached in the image's metadata.
+func ImagePalette(ctx context.Context, metadata *ImageMetadata) (*Palette, error) {
+	key := KeyPrefix(ctx) + "metadata:" + metadata.ID
+	if IsRedisMetadataStore() {
+		if cached, err := RedisClient.HGet(ctx, key, "palette").Result(); err == nil {
+			var palette Palette
+			if json.Unmarshal([]byte(cached), &palette) == nil {
+				return &palette, nil
+			}
+		}
+	}
+
+	data, err := Storage.Get(ctx, paletteSourceKey(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	palette, err := ExtractPalette(data, PaletteSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsRedisMetadataStore() {
+		if encoded, err := json.Marshal(palette); err == nil {
+			RedisClient.HSet(ctx, key, "palette", encoded)
+		}
+	}
+	return palette, nil
+}
+
+// paletteSourceKey returns the smallest file of an image that keeps its colors: the smallest
+// thumbnail, else the WebP variant, else the original
+func paletteSourceKey(metadata *ImageMetadata) string {
+	smallest := -1
+	var key string
+	for size, thumbnail := range metadata.Paths.Thumbnails {
+		if n, err := strconv.Atoi(size); err == nil && (smallest < 0 || n < smallest) {
+			smallest, key = n, thumbnail
+		}
+	}
+	if key != "" {
+		return key
+	}
+	if metadata.Paths.WebP != "" {
+		return metadata.Paths.WebP
+	}
+	return metadata.Paths.Original
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// PipelineStep records one step of an image's upload processing
+type PipelineStep struct {
+	Name       string    `json:"name"`              // Step name, e.g. store_original, webp or avif
+	Started    time.Time `json:"started"`           // When the step started
+	DurationMs int64     `json:"durationMs"`        // How long the step took
+	Size       int64     `json:"size,omitempty"`    // Bytes produced by the step
+	Skipped    string    `json:"skipped,omitempty"` // Why the step did not run
+	Error      string    `json:"error,omitempty"`   // Why the step failed
+}
+
+// PipelineEncoder records the encoder and settings the derivatives were generated with
+type PipelineEncoder struct {
+	Libvips   string         `json:"libvips"`
+	Bimg      string         `json:"bimg"`
+	Profile   string         `json:"profile"`
+	Quality   int            `json:"quality"`
+	Qualities map[string]int `json:"qualities,omitempty"` // Quality of each derived format
+	Speed     int            `json:"speed"`
+	Lossless  bool           `json:"lossless"`
+	Watermark *Watermark     `json:"watermark,omitempty"`
+}
+
+// PipelineLog is the processing log of an uploaded image, kept to explain missing or
+// unexpectedly large derivatives. Steps may be recorded concurrently.
+type PipelineLog struct {
+	ID      string          `json:"id"`
+	Started time.Time       `json:"started"`
+	Encoder PipelineEncoder `json:"encoder"`
+	Steps   []PipelineStep  `json:"steps"`
+	mu      sync.Mutex
+}
+
+// NewPipelineLog starts the processing log of an image
+func NewPipelineLog(id string) *PipelineLog {
+	return &PipelineLog{
+		ID:      id,
+		Started: time.Now(),
+		Encoder: PipelineEncoder{Libvips: bimg.VipsVersion, Bimg: bimg.Version},
+		Steps:   []PipelineStep{},
+	}
+}
+
+// SetProfile records the processing profile and encoder settings of the image
+func (l *PipelineLog) SetProfile(name string, opts ConvertOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Encoder.Profile = name
+	l.Encoder.Quality = opts.Quality
+	l.Encoder.Speed = opts.Speed
+	l.Encoder.Lossless = opts.Lossless
+	l.Encoder.Watermark = opts.Watermark
+}
+
+// SetQuality records the quality a derived format is encoded at
+func (l *PipelineLog) SetQuality(format string, quality int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Encoder.Qualities == nil {
+		l.Encoder.Qualities = make(map[string]int)
+	}
+	l.Encoder.Qualities[format] = quality
+}
+
+// Start begins a step and returns the function ending it with the bytes produced and the
+// error of the step, if any
+func (l *PipelineLog) Start(name string) func(size int64, err error) {
+	started := time.Now()
+	return func(size int64, err error) {
+		step := PipelineStep{
+			Name:       name,
+			Started:    started,
+			DurationMs: time.Since(started).Milliseconds(),
+			Size:       size,
+		}
+		if err != nil {
+			step.Error = err.Error()
+		}
+		l.mu.Lock()
+		l.Steps = append(l.Steps, step)
+		l.mu.Unlock()
+	}
+}
+
+// Skip records a step that did not run
+func (l *PipelineLog) Skip(name, reason string) {
+	l.mu.Lock()
+	l.Steps = append(l.Steps, PipelineStep{Name: name, Started: time.Now(), Skipped: reason})
+	l.mu.Unlock()
+}
+
+func pipelineLogKey(ctx context.Context, id string) string {
+	return KeyPrefix(ctx) + "pipeline:" + id
+}
+
+// SavePipelineLog stores the processing log of an image next to its metadata
+func SavePipelineLog(ctx context.Context, log *PipelineLog) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	log.mu.Lock()
+	data, err := json.Marshal(log)
+	log.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return RedisClient.Set(ctx, pipelineLogKey(ctx, log.ID), data, 0).Err()
+}
+
+// GetPipelineLog returns the processing log of an image
+func GetPipelineLog(ctx context.Context, id string) (*PipelineLog, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+	data, err := RedisClient.Get(ctx, pipelineLogKey(ctx, id)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var log PipelineLog
+	if err := json.Unmarshal(data, &log); err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+// DeletePipelineLog removes the processing log of an image
+func DeletePipelineLog(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.Del(ctx, pipelineLogKey(ctx, id)).Err()
+}
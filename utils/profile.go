@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"os"
+	"slices"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Built-in profile names
+const (
+	ProfileDefault    = "default"
+	ProfileScreenshot = "screenshot"
+)
+
+// ScreenshotTag is added to uploads processed with the screenshot profile
+const ScreenshotTag = "screenshot"
+
+// ProcessingProfile controls how an upload is converted and stored
+type ProcessingProfile struct {
+	Name          string     `json:"name"`
+	Quality       int        `json:"quality"`       // Quality of every derived format (1-100), 0 for the qualities of OUTPUT_FORMATS
+	Lossless      bool       `json:"lossless"`      // Encode WebP losslessly
+	Formats       []string   `json:"formats"`       // Derived formats to generate, among OUTPUT_FORMATS
+	Tags          []string   `json:"tags"`          // Tags added to every upload using the profile
+	ExpiryMinutes int        `json:"expiryMinutes"` // Expiry applied when the upload requests none (0 = never)
+	MatchTags     []string   `json:"matchTags"`     // Uploads carrying any of these tags use the profile
+	Watermark     *Watermark `json:"watermark"`     // Watermark of the variants, overriding the global one
+}
+
+// customProfiles are the profiles loaded from the profiles file, in file order
+var customProfiles []*ProcessingProfile
+
+// Generates reports whether the profile produces the given derived format
+func (p *ProcessingProfile) Generates(format string) bool {
+	return slices.Contains(p.Formats, format)
+}
+
+// ConvertOptions returns the encoder settings of the profile. The quality is the profile's or
+// IMAGE_QUALITY; FormatQuality gives the quality of each derived format.
+func (p *ProcessingProfile) ConvertOptions(cfg *config.Config) ConvertOptions {
+	opts := ConvertOptionsFromConfig(cfg)
+	if p.Quality > 0 {
+		opts.Quality = p.Quality
+	}
+	opts.Lossless = p.Lossless
+	opts.Watermark = GlobalWatermark(cfg).Override(p.Watermark)
+	return opts
+}
+
+// FormatQuality returns the quality a derived format is encoded at: the profile's quality when
+// it sets one, else the format's quality from OUTPUT_FORMATS
+func (p *ProcessingProfile) FormatQuality(cfg *config.Config, format string) int {
+	if p.Quality > 0 {
+		return p.Quality
+	}
+	return cfg.OutputQuality(format)
+}
+
+// DefaultProfile returns the profile used for regular uploads, generating every format of
+// OUTPUT_FORMATS
+func DefaultProfile(cfg *config.Config) *ProcessingProfile {
+	return &ProcessingProfile{
+		Name:    ProfileDefault,
+		Formats: cfg.OutputFormatNames(),
+	}
+}
+
+// ScreenshotProfile returns the profile for screenshots: lossy encoding blurs text, so WebP
+// is encoded losslessly, when OUTPUT_FORMATS has it, and AVIF (lossy only) is skipped
+func ScreenshotProfile(cfg *config.Config) *ProcessingProfile {
+	formats := []string{}
+	if slices.Contains(cfg.OutputFormatNames(), "webp") {
+		formats = append(formats, "webp")
+	}
+	return &ProcessingProfile{
+		Name:          ProfileScreenshot,
+		Lossless:      true,
+		Formats:       formats,
+		Tags:          []string{ScreenshotTag},
+		ExpiryMinutes: cfg.ScreenshotExpiryMinutes,
+	}
+}
+
+// LoadProcessingProfiles reads custom profiles from the configured profiles file. A missing
+// file is not an error; profiles are optional.
+func LoadProcessingProfiles(cfg *config.Config) error {
+	// Profiles fall back to the global watermark, so it is checked along with them
+	if watermark := GlobalWatermark(cfg); watermark != nil {
+		if err := watermark.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ProfilesFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.ProfilesFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read profiles file: %v", err)
+	}
+
+	var file struct {
+		Profiles []*ProcessingProfile `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse profiles file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range file.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile without a name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate profile: %s", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Quality < 0 || p.Quality > 100 {
+			return fmt.Errorf("profile %s: quality must be between 0 and 100", p.Name)
+		}
+		if p.ExpiryMinutes < 0 {
+			return fmt.Errorf("profile %s: expiryMinutes must not be negative", p.Name)
+		}
+		for _, format := range p.Formats {
+			if !slices.Contains(config.SupportedOutputFormats, format) {
+				return fmt.Errorf("profile %s: unsupported format %s", p.Name, format)
+			}
+			if !slices.Contains(cfg.OutputFormatNames(), format) {
+				return fmt.Errorf("profile %s: format %s is not in OUTPUT_FORMATS", p.Name, format)
+			}
+		}
+		if p.Watermark != nil {
+			if err := p.Watermark.Validate(); err != nil {
+				return fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+		}
+		if p.Formats == nil {
+			p.Formats = cfg.OutputFormatNames()
+		}
+	}
+
+	customProfiles = file.Profiles
+	logger.Info("Loaded processing profiles",
+		zap.String("file", cfg.ProfilesFile),
+		zap.Int("profiles", len(customProfiles)))
+	return nil
+}
+
+// GetProcessingProfile returns a profile by name. Profiles from the profiles file take
+// precedence over the built-in default and screenshot profiles.
+func GetProcessingProfile(cfg *config.Config, name string) (*ProcessingProfile, bool) {
+	for _, p := range customProfiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	switch name {
+	case ProfileDefault:
+		return DefaultProfile(cfg), true
+	case ProfileScreenshot:
+		return ScreenshotProfile(cfg), true
+	}
+	return nil, false
+}
+
+// ProfileForTags returns the first custom profile matching any of the tags, or nil
+func ProfileForTags(tags []string) *ProcessingProfile {
+	for _, p := range customProfiles {
+		for _, tag := range p.MatchTags {
+			if slices.Contains(tags, tag) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// screenResolutions lists common display and phone resolutions in landscape form
+var screenResolutions = [][2]int{
+	{1280, 720}, {1280, 800}, {1366, 768}, {1440, 900}, {1536, 864}, {1600, 900},
+	{1680, 1050}, {1920, 1080}, {1920, 1200}, {2560, 1080}, {2560, 1440}, {2560, 1600},
+	{2880, 1800}, {3024, 1964}, {3440, 1440}, {3456, 2234}, {3840, 2160},
+	{1334, 750}, {1792, 828}, {2340, 1080}, {2400, 1080}, {2532, 1170},
+	{2556, 1179}, {2688, 1242}, {2778, 1284}, {2796, 1290}, {3200, 1440},
+}
+
+// IsLikelyScreenshot guesses whether an image is a screenshot: a lossless PNG whose
+// dimensions exactly match a common screen resolution in either orientation
+func IsLikelyScreenshot(format string, width, height int) bool {
+	if format != "png" {
+		return false
+	}
+	if height > width {
+		width, height = height, width
+	}
+	for _, r := range screenResolutions {
+		if width == r[0] && height == r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTransparency reports whether a PNG has any pixel that is not fully opaque. An alpha
+// channel alone is not enough: many PNGs carry one without using it.
+func HasTransparency(format string, data []byte) bool {
+	if format != "png" {
+		return false
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	// Every image type the PNG decoder returns can tell whether it is opaque
+	opaque, ok := img.(interface{ Opaque() bool })
+	return ok && !opaque.Opaque()
+}
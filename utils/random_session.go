@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var randomSessionPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// ValidRandomSession reports whether a string can identify a no-repeat session
+func ValidRandomSession(session string) bool {
+	return randomSessionPattern.MatchString(session)
+}
+
+// NewRandomSession generates the ID of a no-repeat session
+func NewRandomSession() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %v", err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// The images served in a no-repeat session of /api/random are a set, expiring when the
+// session is idle for its TTL
+func randomSessionKey(ctx context.Context, session string) string {
+	return KeyPrefix(ctx) + "random_session:" + session
+}
+
+// RandomSessionSeen returns the IDs of the images already served in a no-repeat session
+func RandomSessionSeen(ctx context.Context, session string) (map[string]bool, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	ids, err := RedisClient.SMembers(ctx, randomSessionKey(ctx, session)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random session: %v", err)
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen, nil
+}
+
+// MarkRandomSessionSeen records an image as served in a no-repeat session and keeps the
+// session for ttl from now
+func MarkRandomSessionSeen(ctx context.Context, session, imageID string, ttl time.Duration) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	pipe := RedisClient.TxPipeline()
+	pipe.SAdd(ctx, randomSessionKey(ctx, session), imageID)
+	pipe.Expire(ctx, randomSessionKey(ctx, session), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update random session: %v", err)
+	}
+	return nil
+}
+
+// ResetRandomSession forgets the images served in a no-repeat session, once all were served
+func ResetRandomSession(ctx context.Context, session string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.Del(ctx, randomSessionKey(ctx, session)).Err()
+}
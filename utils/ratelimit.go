@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// IncrRateCounter counts a request of a client against a rate limit and returns the number of
+// requests in the current fixed window and the time left in it. The counters live in Redis, so
+// every instance sharing the server enforces the same limit.
+func IncrRateCounter(ctx context.Context, name, client string, window time.Duration) (int64, time.Duration, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+	key := fmt.Sprintf("%sratelimit:%s:%s:%d", RedisPrefix, name, client, start.Unix())
+
+	pipe := RedisClient.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to count request: %v", err)
+	}
+	return count.Val(), start.Add(window).Sub(now), nil
+}
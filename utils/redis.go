@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
@@ -37,25 +40,43 @@ func IsRedisMetadataStore() bool {
 
 // ImageInfo represents information about an image
 type ImageInfo struct {
-	ID          string            `json:"id"`          // Filename without extension
-	FileName    string            `json:"filename"`    // Full filename with extension
-	URL         string            `json:"url"`         // URL to access the image
-	URLs        map[string]string `json:"urls"`        // URLs for all available formats
-	Orientation string            `json:"orientation"` // landscape or portrait
-	Format      string            `json:"format"`      // original, webp, avif
-	Size        int64             `json:"size"`        // File size in bytes
-	Path        string            `json:"path"`        // Path relative to storage root
-	StorageType string            `json:"storageType"` // "local" or "s3"
-	Tags        []string          `json:"tags"`        // Image tags for categorization
+	ID          string            `json:"id"`                   // Filename without extension
+	FileName    string            `json:"filename"`             // Full filename with extension
+	URL         string            `json:"url"`                  // URL to access the image
+	URLs        map[string]string `json:"urls"`                 // URLs for all available formats
+	Thumbnails  map[string]string `json:"thumbnails,omitempty"` // Thumbnail URLs by size ("256", "512")
+	Orientation string            `json:"orientation"`          // landscape or portrait
+	Format      string            `json:"format"`               // original, webp, avif
+	Size        int64             `json:"size"`                 // File size in bytes
+	Path        string            `json:"path"`                 // Path relative to storage root
+	StorageType string            `json:"storageType"`          // "local" or "s3"
+	Tags        []string          `json:"tags"`                 // Image tags for categorization
+	Visibility  string            `json:"visibility"`           // public, unlisted or private
+	Likes       int64             `json:"likes"`                // Number of likes
+	Serves      int64             `json:"serves"`               // Number of times the image was served
+	LastServed  *time.Time        `json:"lastServed,omitempty"` // When the image was last served
+	Width       int               `json:"width,omitempty"`      // Width in pixels
+	Height      int               `json:"height,omitempty"`     // Height in pixels
+	Blurhash    string            `json:"blurhash,omitempty"`   // Placeholder shown while the image loads
+	UploadTime  time.Time         `json:"uploadTime"`           // Upload timestamp
+	ExpiryTime  *time.Time        `json:"expiryTime,omitempty"` // Expiry timestamp, nil when the image never expires
 }
 
 // CachedPageKey represents a unique key for cached page results
 type CachedPageKey struct {
-	Orientation string `json:"orientation"`
-	Format      string `json:"format"`
-	Tag         string `json:"tag"`
-	Page        int    `json:"page"`
-	Limit       int    `json:"limit"`
+	Orientation string    `json:"orientation"`
+	Format      string    `json:"format"`
+	Tags        []string  `json:"tags"`         // Required tags
+	AnyTag      bool      `json:"any_tag"`      // Whether one of the tags is enough
+	ExcludeTags []string  `json:"exclude_tags"` // Tags listed images must not have
+	After       time.Time `json:"after"`        // Earliest upload time (zero for none)
+	Before      time.Time `json:"before"`       // Latest upload time, exclusive (zero for none)
+	Visibility  string    `json:"visibility"`
+	Sort        string    `json:"sort"`
+	Ascending   bool      `json:"ascending"`
+	MinLikes    int64     `json:"min_likes"`
+	Page        int       `json:"page"`
+	Limit       int       `json:"limit"`
 }
 
 // PageCache represents cached page data
@@ -66,7 +87,18 @@ type PageCache struct {
 
 // String returns a string representation of CachedPageKey
 func (k CachedPageKey) String() string {
-	return fmt.Sprintf("%s:%s:%s:%d:%d", k.Orientation, k.Format, k.Tag, k.Page, k.Limit)
+	return fmt.Sprintf("%s:%s:%s:%t:%s:%d:%d:%s:%s:%t:%d:%d:%d", k.Orientation, k.Format,
+		strings.Join(k.Tags, ","), k.AnyTag, strings.Join(k.ExcludeTags, ","), k.After.Unix(), k.Before.Unix(),
+		k.Visibility, k.Sort, k.Ascending, k.MinLikes, k.Page, k.Limit)
+}
+
+// indexTag is the tag a page is indexed under for selective invalidation: a tag every image it
+// lists has, or "" when it lists images without a common tag
+func (k CachedPageKey) indexTag() string {
+	if len(k.Tags) == 0 || (k.AnyTag && len(k.Tags) > 1) {
+		return ""
+	}
+	return k.Tags[0]
 }
 
 // getCachedPage retrieves cached page data if available
@@ -78,7 +110,7 @@ func getCachedPage(ctx context.Context, key CachedPageKey) (*PageCache, error) {
 		return nil, fmt.Errorf("redis not enabled")
 	}
 
-	cacheKey := RedisPrefix + "page_cache:" + key.String()
+	cacheKey := pageCacheKey(ctx, key)
 	data, err := RedisClient.Get(ctx, cacheKey).Bytes()
 	if err == nil {
 		var cache PageCache
@@ -110,26 +142,136 @@ func setCachedPage(ctx context.Context, key CachedPageKey, data []ImageInfo) err
 		return err
 	}
 
-	cacheKey := RedisPrefix + "page_cache:" + key.String()
-	return RedisClient.Set(ctx, cacheKey, cacheData, PageCacheExpiration).Err()
+	cacheKey := pageCacheKey(ctx, key)
+	member := redis.Z{Score: float64(cache.ExpiresAt.Unix()), Member: cacheKey}
+	expired := "(" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	pipe := RedisClient.TxPipeline()
+	pipe.Set(ctx, cacheKey, cacheData, PageCacheExpiration)
+	// Register the entry for clearing, and under its filters for selective invalidation. The
+	// sets are scored by expiry, so entries that expired are dropped whenever one is added, and
+	// the sets themselves expire with their last entry.
+	for _, setKey := range []string{pageCacheRegistryKey(ctx), pageCacheIndexKey(ctx, key.Orientation, key.indexTag())} {
+		pipe.ZAdd(ctx, setKey, member)
+		pipe.ZRemRangeByScore(ctx, setKey, "-inf", expired)
+		pipe.Expire(ctx, setKey, PageCacheExpiration)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func pageCacheKey(ctx context.Context, key CachedPageKey) string {
+	return KeyPrefix(ctx) + "page_cache:" + key.String()
 }
 
-// ClearPageCache clears all page cache entries
+// pageCacheRegistryKey is the sorted set of all page cache entries of a tenant
+func pageCacheRegistryKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "page_cache_keys"
+}
+
+// pageCacheIndexKey is the sorted set of the page cache entries filtering by an orientation
+// ("all" for none) and a tag ("" for none)
+func pageCacheIndexKey(ctx context.Context, orientation, tag string) string {
+	return KeyPrefix(ctx) + "page_cache_index:" + orientation + ":" + tag
+}
+
+// ClearPageCache clears all page cache entries. Like InvalidatePageCache, it bumps the library
+// version, as both are called on every change of the library.
 func ClearPageCache(ctx context.Context) error {
 	if !IsRedisMetadataStore() {
 		return nil // Redis is not enabled, no need to clear cache
 	}
+	if err := bumpLibraryVersion(ctx); err != nil {
+		return err
+	}
 
-	pattern := RedisPrefix + "page_cache:*"
-	keys, err := RedisClient.Keys(ctx, pattern).Result()
+	registry := pageCacheRegistryKey(ctx)
+	keys, err := RedisClient.ZRange(ctx, registry, 0, -1).Result()
 	if err != nil {
 		return err
 	}
 
-	if len(keys) > 0 {
-		return RedisClient.Del(ctx, keys...).Err()
+	// Index sets are left to expire; entries they still list are gone
+	return RedisClient.Del(ctx, append(keys, registry)...).Err()
+}
+
+// InvalidatePageCache removes the cached pages that can list images of the given orientations
+// and tags: the pages filtering by one of them and the pages filtering by neither orientation
+// nor tag. Pages filtering by other tags and orientations stay cached.
+func InvalidatePageCache(ctx context.Context, orientations, tags []string) error {
+	if !IsRedisMetadataStore() {
+		return nil
 	}
-	return nil
+	if err := bumpLibraryVersion(ctx); err != nil {
+		return err
+	}
+
+	var indexes []string
+	for _, orientation := range append([]string{"all"}, orientations...) {
+		for _, tag := range append([]string{""}, tags...) {
+			if index := pageCacheIndexKey(ctx, orientation, tag); !slices.Contains(indexes, index) {
+				indexes = append(indexes, index)
+			}
+		}
+	}
+
+	pipe := RedisClient.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(indexes))
+	for i, index := range indexes {
+		cmds[i] = pipe.ZRange(ctx, index, 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	pipe = RedisClient.Pipeline()
+	var keys []interface{}
+	for i, cmd := range cmds {
+		members := make([]interface{}, len(cmd.Val()))
+		for j, key := range cmd.Val() {
+			members[j] = key
+		}
+		if len(members) == 0 {
+			continue
+		}
+		// Members are removed one by one, keeping entries added since they were read
+		pipe.ZRem(ctx, indexes[i], members...)
+		keys = append(keys, members...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	pipe.ZRem(ctx, pageCacheRegistryKey(ctx), keys...)
+	for _, key := range keys {
+		pipe.Del(ctx, key.(string))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// InvalidateImagePages removes the cached pages that can list the given images, e.g. an image
+// before and after a change; nil images are skipped. Without any image, all pages are cleared.
+func InvalidateImagePages(ctx context.Context, images ...*ImageMetadata) error {
+	var orientations, tags []string
+	known := false
+	for _, image := range images {
+		if image == nil {
+			continue
+		}
+		known = true
+		if !slices.Contains(orientations, image.Orientation) {
+			orientations = append(orientations, image.Orientation)
+		}
+		for _, tag := range image.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if !known {
+		return ClearPageCache(ctx)
+	}
+	return InvalidatePageCache(ctx, orientations, tags)
 }
 
 // InitRedisClient initializes the Redis client
@@ -142,12 +284,9 @@ func InitRedisClient(cfg *config.Config) error {
 		return nil
 	}
 
-	// Set Redis prefix based on storage type
-	if cfg.StorageType == config.StorageTypeS3 {
-		RedisPrefix = "imageflow:s3:"
-	} else {
-		RedisPrefix = "imageflow:local:"
-	}
+	RedisPrefix = cfg.RedisPrefix
+	metadataEncoding = cfg.MetadataEncoding
+	expiryNotifications = cfg.ExpiryNotifications
 
 	// Clear page cache when storage type changes
 	if err := ClearPageCache(context.Background()); err != nil {
@@ -164,6 +303,9 @@ func InitRedisClient(cfg *config.Config) error {
 		redisOptions.TLSConfig = &tls.Config{}
 	}
 	RedisClient = redis.NewClient(redisOptions)
+	if tracing.Enabled() {
+		RedisClient.AddHook(redisTracingHook{})
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -184,15 +326,16 @@ func InitRedisClient(cfg *config.Config) error {
 
 // RedisMetadataStore implements metadata storage using Redis
 // RedisMetadataStore is the structure for metadata operations using Redis.
-type RedisMetadataStore struct {
-	prefix string
-}
+type RedisMetadataStore struct{}
 
 // NewRedisMetadataStore creates a new Redis metadata store
 func NewRedisMetadataStore() *RedisMetadataStore {
-	return &RedisMetadataStore{
-		prefix: RedisPrefix + "metadata:",
-	}
+	return &RedisMetadataStore{}
+}
+
+// metadataPrefix returns the metadata key prefix of the context's tenant
+func (rms *RedisMetadataStore) metadataPrefix(ctx context.Context) string {
+	return KeyPrefix(ctx) + "metadata:"
 }
 
 // SaveMetadata saves image metadata to Redis with optimized structure
@@ -201,58 +344,107 @@ func (rms *RedisMetadataStore) SaveMetadata(ctx context.Context, metadata *Image
 		return fmt.Errorf("redis not enabled")
 	}
 
-	pipe := RedisClient.Pipeline()
+	// The pages listing the image as it was are invalidated along with those listing it now
+	previous, _ := rms.GetMetadata(ctx, metadata.ID)
+
+	// The metadata and its indexes are written in one transaction, so a failed save leaves no
+	// index entries pointing at metadata that was never written
+	pipe := RedisClient.TxPipeline()
 
-	// Convert paths to JSON string
-	pathsJSON, err := json.Marshal(metadata.Paths)
+	fields, err := metadataFields(metadata)
 	if err != nil {
-		return fmt.Errorf("failed to marshal paths: %v", err)
+		return err
 	}
 
-	// Convert sizes to JSON string
-	sizesJSON, err := json.Marshal(metadata.Sizes)
-	if err != nil {
-		return fmt.Errorf("failed to marshal sizes: %v", err)
-	}
-
-	// Store metadata in hash
-	key := rms.prefix + metadata.ID
-	pipe.HSet(ctx, key, map[string]interface{}{
-		"id":           metadata.ID,
-		"originalName": metadata.OriginalName,
-		"uploadTime":   metadata.UploadTime.Format(time.RFC3339),
-		"expiryTime":   metadata.ExpiryTime.Format(time.RFC3339),
-		"format":       metadata.Format,
-		"orientation":  metadata.Orientation,
-		"tags":         strings.Join(metadata.Tags, ","),
-		"paths":        string(pathsJSON),
-		"sizes":        string(sizesJSON),
-	})
+	// Store metadata in hash, dropping fields of the other encoding
+	key := rms.metadataPrefix(ctx) + metadata.ID
+	pipe.HDel(ctx, key, staleMetadataFields()...)
+	pipe.HSet(ctx, key, fields)
+
+	// Theme variant links, the watermark and animation flags, the source format, the failed
+	// variants, the clip duration, the content hash and the blurhash are separate fields in both
+	// encodings
+	watermarked, animated, duration := "", "", ""
+	if metadata.Watermarked {
+		watermarked = "true"
+	}
+	if metadata.Animated {
+		animated = "true"
+	}
+	if metadata.Duration > 0 {
+		duration = strconv.FormatFloat(metadata.Duration, 'f', -1, 64)
+	}
+	separateFields := map[string]string{
+		"darkVariant":    metadata.DarkVariant,
+		"lightVariant":   metadata.LightVariant,
+		"watermarked":    watermarked,
+		"animated":       animated,
+		"sourceFormat":   metadata.SourceFormat,
+		"failedVariants": strings.Join(metadata.FailedVariants, ","),
+		"duration":       duration,
+		"contentHash":    metadata.ContentHash,
+		"blurhash":       metadata.Blurhash,
+	}
+	for field, value := range separateFields {
+		if value != "" {
+			pipe.HSet(ctx, key, field, value)
+		} else {
+			pipe.HDel(ctx, key, field)
+		}
+	}
+
+	// Maintain the perceptual hash index used by reverse image search
+	if metadata.PHash != "" {
+		pipe.HSet(ctx, key, "phash", metadata.PHash)
+		pipe.HSet(ctx, perceptualHashIndexKey(ctx), metadata.ID, metadata.PHash)
+	}
+
+	// Maintain the content hash index used to deduplicate uploads
+	if metadata.ContentHash != "" {
+		pipe.HSet(ctx, contentHashIndexKey(ctx), metadata.ContentHash, metadata.ID)
+	}
 
 	// Add to sorted set for pagination
-	pipe.ZAdd(ctx, RedisPrefix+"images", redis.Z{
+	pipe.ZAdd(ctx, KeyPrefix(ctx)+"images", redis.Z{
 		Score:  float64(metadata.UploadTime.Unix()),
 		Member: metadata.ID,
 	})
 
 	// Add to expiry index if expiry time is set
 	if !metadata.ExpiryTime.IsZero() {
-		expiryKey := RedisPrefix + "expiry"
+		expiryKey := KeyPrefix(ctx) + "expiry"
 		pipe.ZAdd(ctx, expiryKey, redis.Z{
 			Score:  float64(metadata.ExpiryTime.Unix()),
 			Member: metadata.ID,
 		})
+		if expiryNotifications {
+			pipe.SetArgs(ctx, expiryShadowKey(ctx, metadata.ID), 1, redis.SetArgs{ExpireAt: metadata.ExpiryTime})
+		}
+	} else if expiryNotifications {
+		pipe.Del(ctx, expiryShadowKey(ctx, metadata.ID))
+	}
+
+	// Maintain visibility indexes
+	for _, v := range AllVisibilities {
+		if v == metadata.EffectiveVisibility() {
+			pipe.ZAdd(ctx, visibilityIndexKey(ctx, v), redis.Z{
+				Score:  float64(metadata.UploadTime.Unix()),
+				Member: metadata.ID,
+			})
+		} else {
+			pipe.ZRem(ctx, visibilityIndexKey(ctx, v), metadata.ID)
+		}
 	}
 
 	// Add tags
 	if len(metadata.Tags) > 0 {
 		for _, tag := range metadata.Tags {
-			tagKey := RedisPrefix + "tag:" + tag
+			tagKey := KeyPrefix(ctx) + "tag:" + tag
 			pipe.SAdd(ctx, tagKey, metadata.ID)
 		}
 
 		// Add to all tags set
-		allTagsKey := RedisPrefix + "all_tags"
+		allTagsKey := KeyPrefix(ctx) + "all_tags"
 		tagsInterface := make([]interface{}, len(metadata.Tags))
 		for i, tag := range metadata.Tags {
 			tagsInterface[i] = tag
@@ -260,16 +452,30 @@ func (rms *RedisMetadataStore) SaveMetadata(ctx context.Context, metadata *Image
 		pipe.SAdd(ctx, allTagsKey, tagsInterface...)
 	}
 
+	// Update the library statistics
+	updateStats(ctx, pipe, previous, metadata)
+
+	// Record the change in the change feed
+	changeType := ChangeUpdated
+	if previous == nil {
+		changeType = ChangeCreated
+	}
+	recordChange(ctx, pipe, changeType, metadata.ID)
+
 	// Execute pipeline
 	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to save metadata to Redis: %v", err)
 	}
 
-	// Clear page cache when new data is added
-	if err := ClearPageCache(ctx); err != nil {
+	// Invalidate the cached pages the image appears on
+	if err := InvalidateImagePages(ctx, previous, metadata); err != nil {
 		logger.Warn("Failed to clear page cache", zap.Error(err))
 	}
 
+	// Forward the change to the replication target and the search engine
+	EnqueueReplication(ctx, ReplicatePut, metadata.ID)
+	SearchIndexing.Notify()
+
 	logger.Debug("Metadata saved to Redis",
 		zap.String("id", metadata.ID),
 		zap.Int("tags", len(metadata.Tags)))
@@ -282,7 +488,7 @@ func (rms *RedisMetadataStore) GetMetadata(ctx context.Context, id string) (*Ima
 		return nil, fmt.Errorf("redis not enabled")
 	}
 
-	key := rms.prefix + id
+	key := rms.metadataPrefix(ctx) + id
 	data, err := RedisClient.HGetAll(ctx, key).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metadata from Redis: %v", err)
@@ -290,6 +496,7 @@ func (rms *RedisMetadataStore) GetMetadata(ctx context.Context, id string) (*Ima
 	if len(data) == 0 {
 		return nil, fmt.Errorf("metadata not found for ID: %s", id)
 	}
+	data = ExpandMetadataFields(id, data)
 
 	metadata := &ImageMetadata{
 		ID:           data["id"],
@@ -311,6 +518,65 @@ func (rms *RedisMetadataStore) GetMetadata(ctx context.Context, id string) (*Ima
 		metadata.Tags = strings.Split(tags, ",")
 	}
 
+	// Parse layout version
+	if version, err := strconv.Atoi(data["layoutVersion"]); err == nil {
+		metadata.LayoutVersion = version
+	}
+
+	// Parse dimensions
+	metadata.Width, _ = strconv.Atoi(data["width"])
+	metadata.Height, _ = strconv.Atoi(data["height"])
+
+	// Parse visibility
+	metadata.Visibility = VisibilityFromFields(data)
+
+	// Parse like count (maintained separately from SaveMetadata)
+	metadata.Likes, _ = strconv.ParseInt(data["likes"], 10, 64)
+
+	// Parse processing profile
+	metadata.Profile = data["profile"]
+
+	// Parse transparency
+	metadata.HasAlpha, _ = strconv.ParseBool(data["hasAlpha"])
+
+	// Parse perceptual hash
+	metadata.PHash = data["phash"]
+
+	// Parse content hash
+	metadata.ContentHash = data["contentHash"]
+
+	// Parse blurhash placeholder
+	metadata.Blurhash = data["blurhash"]
+
+	// Parse OCR text (maintained separately from SaveMetadata)
+	metadata.OCRText = data["ocrText"]
+
+	// Parse serve statistics (maintained separately from SaveMetadata)
+	metadata.Serves, metadata.LastServed = ParseServeFields(data)
+
+	// Parse theme variant links
+	metadata.DarkVariant = data["darkVariant"]
+	metadata.LightVariant = data["lightVariant"]
+
+	// Parse watermark flag
+	metadata.Watermarked = data["watermarked"] == "true"
+
+	// Parse animation flag
+	metadata.Animated = data["animated"] == "true"
+
+	// Parse source format
+	metadata.SourceFormat = data["sourceFormat"]
+
+	// Parse clip duration
+	if duration, err := strconv.ParseFloat(data["duration"], 64); err == nil {
+		metadata.Duration = duration
+	}
+
+	// Parse failed variants
+	if failed := data["failedVariants"]; failed != "" {
+		metadata.FailedVariants = strings.Split(failed, ",")
+	}
+
 	// Parse paths
 	if paths := data["paths"]; paths != "" {
 		json.Unmarshal([]byte(paths), &metadata.Paths)
@@ -330,7 +596,7 @@ func (rms *RedisMetadataStore) GetMetadata(ctx context.Context, id string) (*Ima
 // ListExpiredImages lists all expired images
 func (rms *RedisMetadataStore) ListExpiredImages(ctx context.Context) ([]*ImageMetadata, error) {
 	now := time.Now()
-	expiryKey := RedisPrefix + "expiry"
+	expiryKey := KeyPrefix(ctx) + "expiry"
 
 	// Get all expired image IDs (score <= current timestamp)
 	expiredIDs, err := RedisClient.ZRangeByScore(ctx, expiryKey, &redis.ZRangeBy{
@@ -372,7 +638,7 @@ func (rms *RedisMetadataStore) DeleteMetadata(ctx context.Context, id string) er
 
 	// Remove from tag indexes
 	for _, tag := range metadata.Tags {
-		tagKey := RedisPrefix + "tag:" + tag
+		tagKey := KeyPrefix(ctx) + "tag:" + tag
 		if err := RedisClient.SRem(ctx, tagKey, id).Err(); err != nil {
 			logger.Warn("Failed to remove from tag index",
 				zap.String("tag", tag),
@@ -382,39 +648,151 @@ func (rms *RedisMetadataStore) DeleteMetadata(ctx context.Context, id string) er
 	}
 
 	// Remove from expiry index
-	expiryKey := RedisPrefix + "expiry"
+	expiryKey := KeyPrefix(ctx) + "expiry"
 	if err := RedisClient.ZRem(ctx, expiryKey, id).Err(); err != nil {
 		logger.Warn("Failed to remove from expiry index",
 			zap.String("id", id),
 			zap.Error(err))
 	}
 
+	if err := RedisClient.Del(ctx, expiryShadowKey(ctx, id)).Err(); err != nil {
+		logger.Warn("Failed to remove expiry shadow key",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
 	// Remove from main images index
-	imagesKey := RedisPrefix + "images"
+	imagesKey := KeyPrefix(ctx) + "images"
 	if err := RedisClient.ZRem(ctx, imagesKey, id).Err(); err != nil {
 		logger.Warn("Failed to remove from main images index",
 			zap.String("id", id),
 			zap.Error(err))
 	}
 
+	// Remove from visibility indexes
+	for _, v := range AllVisibilities {
+		if err := RedisClient.ZRem(ctx, visibilityIndexKey(ctx, v), id).Err(); err != nil {
+			logger.Warn("Failed to remove from visibility index",
+				zap.String("visibility", string(v)),
+				zap.String("id", id),
+				zap.Error(err))
+		}
+	}
+
+	// Release the tenant's storage quota
+	if err := AddTenantUsage(ctx, -StoredBytes(metadata)); err != nil {
+		logger.Warn("Failed to update tenant usage",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove from perceptual hash index
+	if err := RemovePerceptualHash(ctx, id); err != nil {
+		logger.Warn("Failed to remove from perceptual hash index",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove from content hash index
+	if err := RemoveContentHash(ctx, metadata); err != nil {
+		logger.Warn("Failed to remove from content hash index",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove from semantic search index
+	if err := DeleteImageEmbedding(ctx, id); err != nil {
+		logger.Warn("Failed to delete image embedding",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove from text search index
+	if err := DeleteImageText(ctx, id); err != nil {
+		logger.Warn("Failed to delete extracted text",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove the processing log
+	if err := DeletePipelineLog(ctx, id); err != nil {
+		logger.Warn("Failed to delete processing log",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove cached resized variants
+	deleteResizedVariants(ctx, id)
+
+	// Remove serve statistics
+	if err := DeleteServeStats(ctx, id); err != nil {
+		logger.Warn("Failed to delete serve statistics",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove likes and comments
+	if err := DeleteImageSocialData(ctx, id); err != nil {
+		logger.Warn("Failed to delete likes and comments",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove share links pointing to the image
+	if err := DeleteImageShareLinks(ctx, id); err != nil {
+		logger.Warn("Failed to delete share links",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Remove from collections
+	if err := DeleteImageCollections(ctx, id); err != nil {
+		logger.Warn("Failed to remove from collections",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
 	// Delete metadata
-	key := rms.prefix + id
+	key := rms.metadataPrefix(ctx) + id
 	if err := RedisClient.Del(ctx, key).Err(); err != nil {
 		return fmt.Errorf("failed to delete metadata from Redis: %v", err)
 	}
 
+	// Remove the image from the library statistics
+	pipe := RedisClient.Pipeline()
+	updateStats(ctx, pipe, metadata, nil)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warn("Failed to update library statistics",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Record the deletion in the change feed
+	if err := recordChange(ctx, RedisClient, ChangeDeleted, id).Err(); err != nil {
+		logger.Warn("Failed to record deletion in change feed",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	// Forward the deletion to the replication target and the search engine
+	EnqueueReplication(ctx, ReplicateDelete, id, metadata.ObjectKeys()...)
+	SearchIndexing.Notify()
+
 	logger.Info("Metadata deleted from Redis",
 		zap.String("id", id))
 	return nil
 }
 
-// GetAllUniqueTags retrieves all unique tags from Redis
+// GetAllUniqueTags retrieves all unique tags from the Redis or SQLite tag index
 func GetAllUniqueTags(ctx context.Context) ([]string, error) {
+	if store, ok := MetadataManager.(*SQLiteMetadataStore); ok {
+		return store.GetAllUniqueTags(ctx)
+	}
 	if !IsRedisMetadataStore() {
 		return nil, fmt.Errorf("redis is not enabled")
 	}
 
-	allTagsKey := RedisPrefix + "all_tags"
+	allTagsKey := KeyPrefix(ctx) + "all_tags"
 	tags, err := RedisClient.SMembers(ctx, allTagsKey).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tags from Redis: %v", err)
@@ -425,11 +803,14 @@ func GetAllUniqueTags(ctx context.Context) ([]string, error) {
 
 // GetImagesByTag retrieves all image IDs with a specific tag
 func GetImagesByTag(ctx context.Context, tag string) ([]string, error) {
+	if store, ok := MetadataManager.(*SQLiteMetadataStore); ok {
+		return store.GetImagesByTag(ctx, tag)
+	}
 	if !IsRedisMetadataStore() {
 		return nil, fmt.Errorf("redis is not enabled")
 	}
 
-	tagKey := RedisPrefix + "tag:" + tag
+	tagKey := KeyPrefix(ctx) + "tag:" + tag
 	imageIDs, err := RedisClient.SMembers(ctx, tagKey).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get images by tag from Redis: %v", err)
@@ -440,6 +821,9 @@ func GetImagesByTag(ctx context.Context, tag string) ([]string, error) {
 
 // GetImagesByMultipleTags retrieves image IDs that have ALL specified tags (AND logic)
 func GetImagesByMultipleTags(ctx context.Context, tags []string) ([]string, error) {
+	if store, ok := MetadataManager.(*SQLiteMetadataStore); ok {
+		return store.GetImagesByMultipleTags(ctx, tags)
+	}
 	if !IsRedisMetadataStore() {
 		return nil, fmt.Errorf("redis is not enabled")
 	}
@@ -456,7 +840,7 @@ func GetImagesByMultipleTags(ctx context.Context, tags []string) ([]string, erro
 	// Multiple tags - use Redis SET intersection
 	tagKeys := make([]string, len(tags))
 	for i, tag := range tags {
-		tagKeys[i] = RedisPrefix + "tag:" + tag
+		tagKeys[i] = KeyPrefix(ctx) + "tag:" + tag
 	}
 	
 	imageIDs, err := RedisClient.SInter(ctx, tagKeys...).Result()
@@ -471,6 +855,27 @@ func GetImagesByMultipleTags(ctx context.Context, tags []string) ([]string, erro
 	return imageIDs, nil
 }
 
+// GetImagesByAnyTag retrieves image IDs that have AT LEAST ONE of the specified tags (OR logic)
+func GetImagesByAnyTag(ctx context.Context, tags []string) ([]string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis is not enabled")
+	}
+	if len(tags) == 0 {
+		return []string{}, nil
+	}
+
+	tagKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		tagKeys[i] = KeyPrefix(ctx) + "tag:" + tag
+	}
+
+	imageIDs, err := RedisClient.SUnion(ctx, tagKeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get images by any tag from Redis: %v", err)
+	}
+	return imageIDs, nil
+}
+
 // GetAllImageIDs retrieves all image IDs from Redis metadata
 func GetAllImageIDs(ctx context.Context) ([]string, error) {
 	if !IsRedisMetadataStore() {
@@ -478,7 +883,7 @@ func GetAllImageIDs(ctx context.Context) ([]string, error) {
 	}
 	
 	// Use SCAN to get all metadata keys
-	pattern := RedisPrefix + "metadata:*"
+	pattern := KeyPrefix(ctx) + "metadata:*"
 	var allKeys []string
 	var cursor uint64
 	
@@ -498,7 +903,7 @@ func GetAllImageIDs(ctx context.Context) ([]string, error) {
 	
 	// Extract image IDs from metadata keys
 	imageIDs := make([]string, 0, len(allKeys))
-	metadataPrefix := RedisPrefix + "metadata:"
+	metadataPrefix := KeyPrefix(ctx) + "metadata:"
 	
 	for _, key := range allKeys {
 		if strings.HasPrefix(key, metadataPrefix) {
@@ -592,7 +997,7 @@ func (rms *RedisMetadataStore) GetAllMetadata(ctx context.Context) ([]*ImageMeta
 	}
 
 	// Get all keys matching the metadata prefix pattern
-	pattern := rms.prefix + "*"
+	pattern := rms.metadataPrefix(ctx) + "*"
 	keys, err := RedisClient.Keys(ctx, pattern).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metadata keys from Redis: %v", err)
@@ -601,7 +1006,7 @@ func (rms *RedisMetadataStore) GetAllMetadata(ctx context.Context) ([]*ImageMeta
 	var allMetadata []*ImageMetadata
 	for _, key := range keys {
 		// Extract ID from key
-		id := strings.TrimPrefix(key, rms.prefix)
+		id := strings.TrimPrefix(key, rms.metadataPrefix(ctx))
 
 		// Get metadata for this ID
 		metadata, err := rms.GetMetadata(ctx, id)
@@ -629,3 +1034,41 @@ func GetCachedPage(ctx context.Context, key CachedPageKey) (*PageCache, error) {
 func SetCachedPage(ctx context.Context, key CachedPageKey, data []ImageInfo) error {
 	return setCachedPage(ctx, key, data)
 }
+
+// MigrateRedisPrefix renames every Redis key under the old prefix to the configured RedisPrefix,
+// e.g. after setting REDIS_PREFIX on a deployment that used the per-storage prefix. Keys that
+// already exist under the new prefix are left alone and reported. It returns the number of
+// renamed keys.
+func MigrateRedisPrefix(ctx context.Context, from string) (int, error) {
+	if from == "" || from == RedisPrefix {
+		return 0, fmt.Errorf("old prefix must differ from the configured prefix %q", RedisPrefix)
+	}
+
+	pattern := strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(from) + "*"
+	renamed := 0
+	iter := RedisClient.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		// The new prefix may itself start with the old one
+		if key == clusterStateKey || strings.HasPrefix(key, RedisPrefix) {
+			continue
+		}
+
+		target := RedisPrefix + strings.TrimPrefix(key, from)
+		ok, err := RedisClient.RenameNX(ctx, key, target).Result()
+		if err != nil {
+			return renamed, fmt.Errorf("failed to rename %s: %v", key, err)
+		}
+		if !ok {
+			logger.Warn("Key already exists under the new prefix, skipping",
+				zap.String("key", key),
+				zap.String("target", target))
+			continue
+		}
+		renamed++
+	}
+	if err := iter.Err(); err != nil {
+		return renamed, err
+	}
+	return renamed, nil
+}
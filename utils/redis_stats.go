@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisKeyTypeStats reports the memory used by one type of Redis key
+type RedisKeyTypeStats struct {
+	Type      string           `json:"type"`      // Key type, e.g. metadata, tag or page_cache
+	Keys      int64            `json:"keys"`      // Number of keys
+	Bytes     int64            `json:"bytes"`     // Memory used by the keys, as reported by MEMORY USAGE
+	Encodings map[string]int64 `json:"encodings"` // Keys per internal encoding (listpack, hashtable...)
+}
+
+// redisKeyType returns the type of a key below the prefix: the first key segment, with the
+// tenant namespace removed so every tenant's keys are counted together
+func redisKeyType(key string) string {
+	rest := strings.TrimPrefix(key, RedisPrefix)
+	if tenantRest, ok := strings.CutPrefix(rest, "tenant:"); ok {
+		if _, after, found := strings.Cut(tenantRest, ":"); found {
+			rest = after
+		}
+	}
+	if i := strings.IndexByte(rest, ':'); i >= 0 {
+		return rest[:i]
+	}
+	return rest
+}
+
+// RedisMemoryStats reports the memory used by every type of key under the prefix, largest
+// first. It scans the whole keyspace of the prefix, so it is meant for maintenance rather than
+// frequent monitoring.
+func RedisMemoryStats(ctx context.Context) ([]RedisKeyTypeStats, error) {
+	stats := make(map[string]*RedisKeyTypeStats)
+	pattern := strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(RedisPrefix) + "*"
+
+	var batch []string
+	flush := func() error {
+		pipe := RedisClient.Pipeline()
+		usage := make([]*redis.IntCmd, len(batch))
+		encodings := make([]*redis.StringCmd, len(batch))
+		for i, key := range batch {
+			usage[i] = pipe.MemoryUsage(ctx, key)
+			encodings[i] = pipe.ObjectEncoding(ctx, key)
+		}
+		// Keys deleted since the scan report redis.Nil and are skipped below
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		for i, key := range batch {
+			bytes, err := usage[i].Result()
+			if err != nil {
+				continue
+			}
+			keyType := redisKeyType(key)
+			s, ok := stats[keyType]
+			if !ok {
+				s = &RedisKeyTypeStats{Type: keyType, Encodings: make(map[string]int64)}
+				stats[keyType] = s
+			}
+			s.Keys++
+			s.Bytes += bytes
+			if encoding, err := encodings[i].Result(); err == nil {
+				s.Encodings[encoding]++
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	iter := RedisClient.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) >= 500 {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]RedisKeyTypeStats, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	slices.SortFunc(result, func(a, b RedisKeyTypeStats) int {
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+)
+
+// RemoteImage is an image fetched from a URL for upload
+type RemoteImage struct {
+	Name string // File name taken from the URL path
+	Data []byte
+}
+
+// FetchRemoteImage downloads an image for upload by URL. Only http and https URLs are
+// accepted; responses must carry an image content type and stay within the configured size.
+// Unless allowed by the configuration, URLs resolving to loopback, private or link-local
+// addresses are refused, including through redirects.
+func FetchRemoteImage(ctx context.Context, cfg *config.Config, rawURL string) (*RemoteImage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL: %s", rawURL)
+	}
+
+	// The dialer sees the addresses the client connects to, which through a proxy would be
+	// the proxy's only; HTTP(S)_PROXY is therefore used only when private addresses are allowed
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if cfg.RemoteUploadAllowPrivate {
+		transport.Proxy = http.ProxyFromEnvironment
+	} else {
+		dialer.Control = rejectPrivateAddress
+	}
+	client := &http.Client{
+		Timeout:   time.Duration(cfg.RemoteUploadTimeout) * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote server returned %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil, fmt.Errorf("unsupported content type %q", resp.Header.Get("Content-Type"))
+	}
+	maxSize := int64(cfg.RemoteUploadMaxSize) << 20
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("image exceeds %dMB", cfg.RemoteUploadMaxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("image exceeds %dMB", cfg.RemoteUploadMaxSize)
+	}
+
+	name := path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		name = resp.Request.URL.Host
+	}
+	return &RemoteImage{Name: name, Data: data}, nil
+}
+
+// rejectPrivateAddress refuses connections to addresses outside the public internet. It runs
+// after name resolution, so hosts resolving to internal addresses are refused as well.
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not allowed", host)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// RepairReport describes the repair of a single image
+type RepairReport struct {
+	Image   *ImageMetadata `json:"image"`   // Metadata after the repair
+	Changes []string       `json:"changes"` // What was fixed, empty when nothing was wrong
+}
+
+// RepairImage rebuilds an image from its stored original: it re-detects the format,
+// orientation, dimensions and transparency, moves the image when its orientation changes,
+// regenerates missing WebP/AVIF derivatives of its processing profile and thumbnails,
+// recomputes the sizes and saves the metadata again, which rewrites its indexes.
+func RepairImage(ctx context.Context, cfg *config.Config, id string) (*RepairReport, error) {
+	return rebuildImage(ctx, cfg, id, false)
+}
+
+// ReprocessImage repairs an image and converts its WebP/AVIF derivatives again even when they
+// are stored, applying the current quality settings and encoder, e.g. after changing
+// IMAGE_QUALITY or upgrading libvips. Thumbnails are only generated when missing.
+func ReprocessImage(ctx context.Context, cfg *config.Config, id string) (*RepairReport, error) {
+	return rebuildImage(ctx, cfg, id, true)
+}
+
+// rebuildImage repairs an image, converting its derivatives again when regenerate is set
+func rebuildImage(ctx context.Context, cfg *config.Config, id string, regenerate bool) (*RepairReport, error) {
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Regenerated objects keep the access of the image's visibility
+	ctx = ObjectAccessContext(ctx, metadata)
+	report := &RepairReport{Image: metadata, Changes: []string{}}
+	changed := func(format string, args ...interface{}) {
+		report.Changes = append(report.Changes, fmt.Sprintf(format, args...))
+	}
+	storedBefore := StoredBytes(metadata)
+
+	originalKey, err := ResolveImageKey(ctx, metadata.Paths.Original)
+	if err != nil {
+		return nil, fmt.Errorf("original not found: %v", err)
+	}
+	if originalKey != metadata.Paths.Original {
+		changed("original path: %s -> %s", metadata.Paths.Original, originalKey)
+		metadata.Paths.Original = originalKey
+	}
+	data, err := Storage.Get(ctx, originalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original: %v", err)
+	}
+
+	originalSize := int64(len(data))
+
+	// SVG originals are repaired from their rendering, as on upload
+	svg := IsSVG(data)
+	if svg {
+		if data, err = RasterizeSVG(ctx, data); err != nil {
+			return nil, err
+		}
+	}
+	imgFormat, err := DetectImageFormat(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect format: %v", err)
+	}
+	hasAlpha := HasTransparency(imgFormat.Format, data)
+	if svg {
+		imgFormat = SVGFormat
+	}
+	if imgFormat.Format != metadata.Format {
+		changed("format: %s -> %s", metadata.Format, imgFormat.Format)
+		metadata.Format = imgFormat.Format
+	}
+
+	width, height, err := DisplayDimensions(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dimensions: %v", err)
+	}
+	if width != metadata.Width || height != metadata.Height {
+		changed("dimensions: %dx%d -> %dx%d", metadata.Width, metadata.Height, width, height)
+		metadata.Width, metadata.Height = width, height
+	}
+	if orientation := ClassifyOrientation(width, height); orientation != metadata.Orientation {
+		if err := moveToOrientation(ctx, metadata, orientation); err != nil {
+			return nil, err
+		}
+		changed("orientation: %s -> %s", metadata.Orientation, orientation)
+		metadata.Orientation = orientation
+	}
+	if hasAlpha != metadata.HasAlpha {
+		changed("transparency: %t -> %t", metadata.HasAlpha, hasAlpha)
+		metadata.HasAlpha = hasAlpha
+	}
+	// Originals kept larger than MAX_IMAGE_DIMENSION are converted from a downscaled copy, as
+	// on upload
+	if data, err = DownscaleImage(ctx, data, cfg.MaxImageDimension); err != nil {
+		return nil, err
+	}
+	if hash, err := PerceptualHash(data); err == nil {
+		if phash := FormatPerceptualHash(hash); phash != metadata.PHash {
+			changed("perceptual hash recomputed")
+			metadata.PHash = phash
+		}
+	}
+	if blurhash, err := Blurhash(data); err == nil && blurhash != metadata.Blurhash {
+		changed("blurhash recomputed")
+		metadata.Blurhash = blurhash
+	}
+
+	if animated := IsAnimated(data) && metadata.Format != "gif"; animated != metadata.Animated {
+		changed("animation: %t -> %t", metadata.Animated, animated)
+		metadata.Animated = animated
+	}
+
+	sizes := map[string]int64{"original": originalSize}
+	var replaced []string // Derivatives stored under another key now, deleted once the metadata is saved
+	if metadata.IsAnimated() {
+		// Animations are served as is in every format, so single-frame variants converted
+		// before they were detected are dropped
+		for format, path := range map[string]*string{"webp": &metadata.Paths.WebP, "avif": &metadata.Paths.AVIF} {
+			if *path == "" {
+				continue
+			}
+			if err := Storage.Delete(ctx, *path); err != nil {
+				logger.Warn("Failed to delete still variant of animation",
+					zap.String("id", metadata.ID),
+					zap.String("key", *path),
+					zap.Error(err))
+			}
+			changed("%s path removed, animations are served as is", format)
+			*path = ""
+		}
+	} else {
+		profile, ok := GetProcessingProfile(cfg, metadata.Profile)
+		if !ok {
+			profile = DefaultProfile(cfg)
+		}
+		// Variants are regenerated with the watermark of the profile if they had one
+		opts := profile.ConvertOptions(cfg)
+		if !metadata.Watermarked {
+			opts.Watermark = nil
+		}
+		layout := layoutForVersion(metadata.LayoutVersion)
+		variants := []struct {
+			format  string
+			path    *string
+			enabled bool
+			convert func(context.Context, []byte, ConvertOptions) ([]byte, error)
+		}{
+			{"webp", &metadata.Paths.WebP, profile.Generates("webp"), ConvertToWebPWithOptions},
+			{"avif", &metadata.Paths.AVIF, profile.Generates("avif") && cfg.AvifSupport, ConvertToAVIFWithOptions},
+		}
+		if metadata.Paths.Video != "" {
+			// The WebP variant of a clip is its animated preview, and clips have no AVIF
+			variants[0].enabled = true
+			variants[0].convert = func(ctx context.Context, _ []byte, _ ConvertOptions) ([]byte, error) {
+				return VideoPreview(ctx, cfg, metadata.Paths.Video)
+			}
+			variants[1].enabled = false
+			sizes["video"] = metadata.Sizes["video"]
+		}
+		for _, variant := range variants {
+			// Only variants that exist have a size; the others are served as the original.
+			// Reprocessing converts the variants of the profile again whatever is stored.
+			if *variant.path != "" && (!regenerate || !variant.enabled) {
+				if variantData, err := Storage.Get(ctx, *variant.path); err == nil {
+					sizes[variant.format] = int64(len(variantData))
+					continue
+				}
+			}
+			if !variant.enabled {
+				if *variant.path != "" {
+					changed("%s path removed, the object is missing", variant.format)
+					*variant.path = ""
+				}
+				continue
+			}
+
+			key := TenantStorageKey(ctx, VariantKey(layout, metadata.Orientation, variant.format, metadata.ID))
+			variantOpts := opts
+			variantOpts.Quality = profile.FormatQuality(cfg, variant.format)
+			variantData, err := variant.convert(ctx, data, variantOpts)
+			if err != nil {
+				return nil, fmt.Errorf("%s conversion failed: %v", variant.format, err)
+			}
+			if err := StoreVerified(ctx, key, variantData); err != nil {
+				return nil, fmt.Errorf("failed to store %s: %v", key, err)
+			}
+			changed("%s regenerated", variant.format)
+			if *variant.path != "" && *variant.path != key {
+				replaced = append(replaced, *variant.path)
+			}
+			*variant.path = key
+			sizes[variant.format] = int64(len(variantData))
+		}
+		// Conversions that failed on upload are resolved once their variant is stored
+		if failed := slices.DeleteFunc(slices.Clone(metadata.FailedVariants), metadata.HasVariant); len(failed) != len(metadata.FailedVariants) {
+			changed("failed variants: %v -> %v", metadata.FailedVariants, failed)
+			metadata.FailedVariants = failed
+		}
+	}
+	for format, size := range sizes {
+		if metadata.Sizes[format] != size {
+			changed("sizes recomputed")
+			break
+		}
+	}
+	// Uploads once recorded the size of the original for variants that were never stored
+	for _, format := range []string{"webp", "avif"} {
+		if _, ok := metadata.Sizes[format]; ok && sizes[format] == 0 {
+			changed("%s size removed, the variant does not exist", format)
+		}
+	}
+
+	// Thumbnails whose object is missing are dropped, then regenerated with the missing sizes
+	for size, key := range metadata.Paths.Thumbnails {
+		if thumbnail, err := Storage.Get(ctx, key); err == nil {
+			sizes[ThumbnailSizeKey(size)] = int64(len(thumbnail))
+		} else {
+			changed("thumbnail %s path removed, the object is missing", size)
+			delete(metadata.Paths.Thumbnails, size)
+		}
+	}
+	metadata.Sizes = sizes
+	for _, size := range addThumbnails(ctx, cfg, metadata, data) {
+		changed("thumbnail %s generated", size)
+	}
+
+	if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %v", err)
+	}
+	for _, key := range replaced {
+		if err := Storage.Delete(ctx, key); err != nil {
+			logger.Warn("Failed to delete replaced derivative",
+				zap.String("id", id),
+				zap.String("key", key),
+				zap.Error(err))
+		}
+	}
+	if err := AddTenantUsage(ctx, StoredBytes(metadata)-storedBefore); err != nil {
+		logger.Warn("Failed to update tenant usage",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+
+	logger.Info("Repaired image",
+		zap.String("id", id),
+		zap.Strings("changes", report.Changes))
+	return report, nil
+}
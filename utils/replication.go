@@ -0,0 +1,476 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Replication operations
+const (
+	ReplicatePut    = "put"    // Create or update an image on the target
+	ReplicateDelete = "delete" // Delete an image from the target
+)
+
+// ReplicationJob is a pending change to forward to the replication target
+type ReplicationJob struct {
+	Op       string   `json:"op"`
+	ID       string   `json:"id"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Keys     []string `json:"keys,omitempty"` // Stored objects of a deleted image
+	Attempts int      `json:"attempts"`
+	Error    string   `json:"error,omitempty"` // Last failure
+}
+
+// ReplicationTarget receives replicated images
+type ReplicationTarget interface {
+	// HasObject reports whether the target already stores an object
+	HasObject(ctx context.Context, key string) (bool, error)
+	PutObject(ctx context.Context, key string, data []byte) error
+	PutMetadata(ctx context.Context, metadata *ImageMetadata) error
+	DeleteImage(ctx context.Context, id string, keys []string) error
+	String() string
+}
+
+// ReplicationStatus reports the state of the replication queues
+type ReplicationStatus struct {
+	Target   string `json:"target"`
+	Queued   int64  `json:"queued"`   // Jobs waiting to be sent
+	Retrying int64  `json:"retrying"` // Failed jobs waiting for their next attempt
+	Failed   int64  `json:"failed"`   // Jobs that exhausted their attempts
+}
+
+// Replicator forwards uploads and deletions to a replication target in the background. Jobs
+// are queued in Redis, so they survive restarts and are shared by instances using the same
+// Redis; failed jobs are retried with exponential backoff.
+type Replicator struct {
+	target      ReplicationTarget
+	maxAttempts int
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// Replication is the running replicator, nil when replication is disabled
+var Replication *Replicator
+
+type noReplicationKey struct{}
+
+// WithoutReplication marks a context whose changes must not be replicated, e.g. changes that
+// were themselves received from a replication source
+func WithoutReplication(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noReplicationKey{}, true)
+}
+
+// Replication queues live in the global namespace; jobs carry their tenant
+func replicationQueueKey() string {
+	return RedisPrefix + "replication:queue"
+}
+
+func replicationRetryKey() string {
+	return RedisPrefix + "replication:retry"
+}
+
+func replicationFailedKey() string {
+	return RedisPrefix + "replication:failed"
+}
+
+// InitReplication starts the replicator when a replication target is configured
+func InitReplication(cfg *config.Config) error {
+	var target ReplicationTarget
+	switch {
+	case cfg.ReplicationPeerURL != "":
+		target = &peerReplicationTarget{
+			baseURL: strings.TrimSuffix(cfg.ReplicationPeerURL, "/"),
+			apiKey:  cfg.ReplicationPeerAPIKey,
+			client:  &http.Client{Timeout: 2 * time.Minute},
+		}
+	case cfg.ReplicationS3Bucket != "":
+		t, err := newS3ReplicationTarget(cfg)
+		if err != nil {
+			return err
+		}
+		target = t
+	default:
+		return nil
+	}
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("replication requires the Redis metadata store")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	Replication = &Replicator{
+		target:      target,
+		maxAttempts: max(cfg.ReplicationMaxAttempts, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	Replication.Start()
+	return nil
+}
+
+// EnqueueReplication queues a change for replication. It is a no-op when replication is
+// disabled or the context was marked with WithoutReplication.
+func EnqueueReplication(ctx context.Context, op, id string, keys ...string) {
+	if Replication == nil || ctx.Value(noReplicationKey{}) != nil {
+		return
+	}
+
+	job := ReplicationJob{Op: op, ID: id, Keys: keys}
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		job.Tenant = tenant.ID
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = RedisClient.RPush(ctx, replicationQueueKey(), data).Err()
+	}
+	if err != nil {
+		logger.Error("Failed to queue replication job",
+			zap.String("op", op),
+			zap.String("id", id),
+			zap.Error(err))
+	}
+}
+
+// Start processes the replication queue until Stop is called
+func (rp *Replicator) Start() {
+	logger.Info("Starting replication",
+		zap.String("target", rp.target.String()))
+
+	go func() {
+		for rp.ctx.Err() == nil {
+			rp.promoteRetries()
+
+			data, err := RedisClient.LPop(rp.ctx, replicationQueueKey()).Bytes()
+			if err != nil {
+				if err != redis.Nil && rp.ctx.Err() == nil {
+					logger.Warn("Failed to read replication queue", zap.Error(err))
+				}
+				select {
+				case <-rp.ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			var job ReplicationJob
+			if err := json.Unmarshal(data, &job); err != nil {
+				logger.Error("Dropping invalid replication job", zap.Error(err))
+				continue
+			}
+			if err := rp.process(job); err != nil {
+				rp.retry(job, err)
+			}
+		}
+	}()
+}
+
+// Stop terminates the replicator; queued jobs are processed on next start
+func (rp *Replicator) Stop() {
+	rp.cancel()
+	logger.Info("Replication stopped")
+}
+
+// Status returns the length of the replication queues
+func (rp *Replicator) Status(ctx context.Context) (ReplicationStatus, error) {
+	status := ReplicationStatus{Target: rp.target.String()}
+	pipe := RedisClient.Pipeline()
+	queued := pipe.LLen(ctx, replicationQueueKey())
+	retrying := pipe.ZCard(ctx, replicationRetryKey())
+	failed := pipe.LLen(ctx, replicationFailedKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return status, fmt.Errorf("failed to read replication queues: %v", err)
+	}
+	status.Queued = queued.Val()
+	status.Retrying = retrying.Val()
+	status.Failed = failed.Val()
+	return status, nil
+}
+
+// RequeueFailed moves jobs that exhausted their attempts back to the queue
+func (rp *Replicator) RequeueFailed(ctx context.Context) (int, error) {
+	requeued := 0
+	for {
+		data, err := RedisClient.LPop(ctx, replicationFailedKey()).Bytes()
+		if err == redis.Nil {
+			return requeued, nil
+		}
+		if err != nil {
+			return requeued, err
+		}
+		var job ReplicationJob
+		if json.Unmarshal(data, &job) != nil {
+			continue
+		}
+		job.Attempts = 0
+		job.Error = ""
+		if data, err = json.Marshal(job); err == nil {
+			RedisClient.RPush(ctx, replicationQueueKey(), data)
+			requeued++
+		}
+	}
+}
+
+// process sends one job to the target
+func (rp *Replicator) process(job ReplicationJob) error {
+	ctx := rp.ctx
+	if job.Tenant != "" {
+		tenant, err := GetTenant(ctx, job.Tenant)
+		if err != nil {
+			// The tenant was deleted; nothing left to replicate
+			return nil
+		}
+		ctx = WithTenant(ctx, tenant)
+	}
+
+	switch job.Op {
+	case ReplicateDelete:
+		return rp.target.DeleteImage(ctx, job.ID, job.Keys)
+	case ReplicatePut:
+		metadata, err := MetadataManager.GetMetadata(ctx, job.ID)
+		if err != nil {
+			// Deleted before it was replicated; the delete job follows
+			return nil
+		}
+		for _, key := range metadata.ObjectKeys() {
+			exists, err := rp.target.HasObject(ctx, key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			data, err := Storage.Get(ctx, key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", key, err)
+			}
+			if err := rp.target.PutObject(ctx, key, data); err != nil {
+				return err
+			}
+		}
+		return rp.target.PutMetadata(ctx, metadata)
+	default:
+		return nil
+	}
+}
+
+// retry schedules a failed job with exponential backoff, or parks it in the failed list
+func (rp *Replicator) retry(job ReplicationJob, cause error) {
+	job.Attempts++
+	job.Error = cause.Error()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+
+	if job.Attempts >= rp.maxAttempts {
+		logger.Error("Replication job failed permanently",
+			zap.String("op", job.Op),
+			zap.String("id", job.ID),
+			zap.Int("attempts", job.Attempts),
+			zap.Error(cause))
+		RedisClient.RPush(rp.ctx, replicationFailedKey(), data)
+		return
+	}
+
+	delay := min(time.Duration(1<<min(job.Attempts, 12))*time.Second, time.Hour)
+	logger.Warn("Replication job failed, retrying",
+		zap.String("op", job.Op),
+		zap.String("id", job.ID),
+		zap.Int("attempts", job.Attempts),
+		zap.Duration("retry_in", delay),
+		zap.Error(cause))
+	RedisClient.ZAdd(rp.ctx, replicationRetryKey(), redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: data,
+	})
+}
+
+// promoteRetries moves retries that are due back to the queue
+func (rp *Replicator) promoteRetries() {
+	due, err := RedisClient.ZRangeByScore(rp.ctx, replicationRetryKey(), &redis.ZRangeBy{
+		Min: "0",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		return
+	}
+	for _, data := range due {
+		// Only the instance that removes the entry requeues it
+		if removed, err := RedisClient.ZRem(rp.ctx, replicationRetryKey(), data).Result(); err == nil && removed > 0 {
+			RedisClient.RPush(rp.ctx, replicationQueueKey(), data)
+		}
+	}
+}
+
+// peerReplicationTarget replicates to another ImageFlow instance through its replication API
+type peerReplicationTarget struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (t *peerReplicationTarget) String() string {
+	return t.baseURL
+}
+
+func (t *peerReplicationTarget) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		query.Set("tenant", tenant.ID)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.baseURL+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %v", method, path, err)
+	}
+	return resp, nil
+}
+
+func (t *peerReplicationTarget) expect(resp *http.Response, err error, codes ...int) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("peer returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+func (t *peerReplicationTarget) HasObject(ctx context.Context, key string) (bool, error) {
+	resp, err := t.do(ctx, http.MethodHead, "/api/replication/objects", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("peer returned %d", resp.StatusCode)
+	}
+}
+
+func (t *peerReplicationTarget) PutObject(ctx context.Context, key string, data []byte) error {
+	resp, err := t.do(ctx, http.MethodPut, "/api/replication/objects", url.Values{"key": {key}}, data)
+	return t.expect(resp, err, http.StatusOK)
+}
+
+func (t *peerReplicationTarget) PutMetadata(ctx context.Context, metadata *ImageMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(ctx, http.MethodPut, "/api/replication/images/"+url.PathEscape(metadata.ID), url.Values{}, data)
+	return t.expect(resp, err, http.StatusOK)
+}
+
+func (t *peerReplicationTarget) DeleteImage(ctx context.Context, id string, keys []string) error {
+	resp, err := t.do(ctx, http.MethodDelete, "/api/replication/images/"+url.PathEscape(id), url.Values{}, nil)
+	return t.expect(resp, err, http.StatusOK, http.StatusNotFound)
+}
+
+// s3ReplicationTarget copies objects to another bucket, with each image's metadata stored as
+// a JSON object under _metadata/ so the library can be rebuilt from the bucket
+type s3ReplicationTarget struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3ReplicationTarget(cfg *config.Config) (*s3ReplicationTarget, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(cfg.ReplicationS3Region),
+	}
+	if cfg.ReplicationS3AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			cfg.ReplicationS3AccessKey, cfg.ReplicationS3SecretKey, "")))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.ReplicationS3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.ReplicationS3Endpoint)
+		}
+		o.UsePathStyle = cfg.S3ForcePathStyle
+	})
+	return &s3ReplicationTarget{client: client, bucket: cfg.ReplicationS3Bucket}, nil
+}
+
+func (t *s3ReplicationTarget) String() string {
+	return "s3://" + t.bucket
+}
+
+func metadataObjectKey(ctx context.Context, id string) string {
+	return TenantStorageKey(ctx, "_metadata/"+id+".json")
+}
+
+func (t *s3ReplicationTarget) HasObject(ctx context.Context, key string) (bool, error) {
+	_, err := t.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// HeadObject reports missing objects as an error; upload again in doubt
+		return false, nil
+	}
+	return true, nil
+}
+
+func (t *s3ReplicationTarget) PutObject(ctx context.Context, key string, data []byte) error {
+	_, err := t.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return nil
+}
+
+func (t *s3ReplicationTarget) PutMetadata(ctx context.Context, metadata *ImageMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return t.PutObject(ctx, metadataObjectKey(ctx, metadata.ID), data)
+}
+
+func (t *s3ReplicationTarget) DeleteImage(ctx context.Context, id string, keys []string) error {
+	for _, key := range append(keys, metadataObjectKey(ctx, id)) {
+		if _, err := t.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(t.bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	return nil
+}
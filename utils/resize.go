@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/h2non/bimg"
+	"go.uber.org/zap"
+)
+
+// Resize fit modes
+const (
+	FitContain = "contain" // Scale to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // Scale and crop to fill the box exactly
+	FitFill    = "fill"    // Stretch to the box, ignoring the aspect ratio
+)
+
+// ResizeOptions describes an on-the-fly resize requested through query parameters
+type ResizeOptions struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+// IsZero reports whether no resize was requested
+func (o ResizeOptions) IsZero() bool {
+	return o.Width == 0 && o.Height == 0
+}
+
+// String identifies the resize in cached variant keys, e.g. "800x600-cover"
+func (o ResizeOptions) String() string {
+	return fmt.Sprintf("%dx%d-%s", o.Width, o.Height, o.Fit)
+}
+
+// ParseResizeOptions reads the w, h and fit query parameters. Dimensions are bounded by the
+// configured maximum; without a fit mode the image is scaled to fit inside the box.
+func ParseResizeOptions(query url.Values, cfg *config.Config) (ResizeOptions, error) {
+	var opts ResizeOptions
+	for _, dim := range []struct {
+		name  string
+		value *int
+	}{{"w", &opts.Width}, {"h", &opts.Height}} {
+		raw := query.Get(dim.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v <= 0 || v > cfg.MaxResizeDimension {
+			return ResizeOptions{}, fmt.Errorf("%s must be between 1 and %d", dim.name, cfg.MaxResizeDimension)
+		}
+		*dim.value = v
+	}
+
+	opts.Fit = strings.ToLower(query.Get("fit"))
+	switch opts.Fit {
+	case "":
+		opts.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+	default:
+		return ResizeOptions{}, fmt.Errorf("fit must be contain, cover or fill")
+	}
+	if opts.IsZero() && query.Get("fit") != "" {
+		return ResizeOptions{}, fmt.Errorf("fit requires w or h")
+	}
+	return opts, nil
+}
+
+// ResizeAllowed reports whether every dimension of a resize is one of RESIZE_SIZES, which
+// bounds the resized variants anonymous clients can make the instance generate and cache
+func ResizeAllowed(cfg *config.Config, opts ResizeOptions) bool {
+	for _, v := range []int{opts.Width, opts.Height} {
+		if v != 0 && !slices.Contains(cfg.ResizeSizes, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResizedKey returns the storage key caching a resized variant of an image
+func ResizedKey(layout config.KeyLayout, id string, opts ResizeOptions, ext string) string {
+	return withLayout(layout, "resized", id, id+"."+opts.String()+ext)
+}
+
+// ResizeImage resizes image data with bimg, keeping its format. GIFs, animated WebPs and APNGs
+// are returned unchanged so animations are preserved.
+func ResizeImage(ctx context.Context, data []byte, opts ResizeOptions) ([]byte, error) {
+	return GetWorkerPool().ProcessTaskContext(ctx, "resize", func() ([]byte, error) {
+		// Animations would lose all but their first frame; SVG images scale by themselves
+		if IsAnimated(data) || IsSVG(data) {
+			return data, nil
+		}
+
+		options := bimg.Options{
+			Width:  opts.Width,
+			Height: opts.Height,
+		}
+		switch opts.Fit {
+		case FitCover:
+			// With a single dimension there is nothing to crop; the image is only scaled
+			options.Crop = opts.Width > 0 && opts.Height > 0
+			options.Gravity = bimg.GravitySmart
+		case FitFill:
+			options.Force = opts.Width > 0 && opts.Height > 0
+		}
+
+		result, err := bimg.NewImage(data).Process(options)
+		if err != nil {
+			return nil, fmt.Errorf("resize failed: %v", err)
+		}
+		return result, nil
+	})
+}
+
+// downscaleQuality is the quality oversized images are re-encoded with once downscaled, high
+// enough for an original
+const downscaleQuality = 92
+
+// DownscaleImage shrinks an image wider or taller than maxDimension to fit within it, keeping
+// its aspect ratio and format. Photos are rotated upright by their EXIF orientation, and
+// HEIC/HEIF photos written as JPEG, as they would be converted next. Smaller images, animations
+// and SVG images are returned unchanged, as is every image when maxDimension is 0.
+func DownscaleImage(ctx context.Context, data []byte, maxDimension int) ([]byte, error) {
+	if maxDimension <= 0 || IsAnimated(data) || IsSVG(data) {
+		return data, nil
+	}
+	width, height, err := DisplayDimensions(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dimensions: %v", err)
+	}
+	if width <= maxDimension && height <= maxDimension {
+		return data, nil
+	}
+
+	return GetWorkerPool().ProcessTaskContext(ctx, "downscale", func() ([]byte, error) {
+		// Bounding the longer side alone lets libvips derive the other one
+		options := bimg.Options{Quality: downscaleQuality}
+		if width >= height {
+			options.Width = maxDimension
+		} else {
+			options.Height = maxDimension
+		}
+		if HEIFFormat(data) != "" {
+			options.Type = bimg.JPEG
+		}
+		result, err := bimg.NewImage(data).Process(options)
+		if err != nil {
+			return nil, fmt.Errorf("downscale failed: %v", err)
+		}
+		// libvips keeps the orientation tag of rotated images
+		resetEXIFOrientation(result)
+		return result, nil
+	})
+}
+
+// resizedKeyPrefix returns the prefix shared by the keys of an image's cached resized variants
+// in a layout
+func resizedKeyPrefix(layout config.KeyLayout, id string) string {
+	return withLayout(layout, "resized", id, id+".")
+}
+
+// ResizedImageKey returns the storage key caching a resized variant of a stored image
+func ResizedImageKey(ctx context.Context, cfg *config.Config, key string, opts ResizeOptions) string {
+	return TenantStorageKey(ctx, ResizedKey(cfg.KeyLayout, ImageIDFromKey(key), opts, filepath.Ext(key)))
+}
+
+// GetResizedImage returns a resized variant of a stored image, generating and caching it under
+// ResizedImageKey in the storage provider on first request
+func GetResizedImage(ctx context.Context, cfg *config.Config, key string, opts ResizeOptions) ([]byte, error) {
+	id := ImageIDFromKey(key)
+	resizedKey := ResizedImageKey(ctx, cfg, key, opts)
+
+	if data, err := Storage.Get(ctx, resizedKey); err == nil {
+		return data, nil
+	}
+
+	source, err := Storage.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	data, err := ResizeImage(ctx, source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Storage.Store(ctx, resizedKey, data); err != nil {
+		logger.Warn("Failed to cache resized image",
+			zap.String("key", resizedKey),
+			zap.Error(err))
+		return data, nil
+	}
+	if IsRedisMetadataStore() {
+		RedisClient.SAdd(ctx, resizedVariantsKey(ctx, id), resizedKey)
+	}
+	logger.Debug("Cached resized image",
+		zap.String("key", resizedKey),
+		zap.Int("size", len(data)))
+	return data, nil
+}
+
+// deleteResizedVariants removes the cached resized variants of a deleted image, logging
+// failures, as metadata stores do once the metadata is gone
+func deleteResizedVariants(ctx context.Context, id string) {
+	if err := DeleteResizedImages(ctx, id); err != nil {
+		logger.Warn("Failed to delete resized variants",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+}
+
+// resizedVariantsKey returns the Redis set of an image's cached resized variants
+func resizedVariantsKey(ctx context.Context, id string) string {
+	return KeyPrefix(ctx) + "resized:" + id
+}
+
+// DeleteResizedImages removes the cached resized variants of an image. Storage listing keys
+// finds them by the prefix derived from the image ID in every layout; the Redis set of
+// variants covers other storage.
+func DeleteResizedImages(ctx context.Context, id string) error {
+	var keys []string
+	if lister, ok := StorageBackend().(ObjectLister); ok {
+		for _, layout := range allKeyLayouts {
+			found, err := lister.ListKeys(ctx, TenantStorageKey(ctx, resizedKeyPrefix(layout, id)))
+			if err != nil {
+				return err
+			}
+			keys = append(keys, found...)
+		}
+	}
+	if IsRedisMetadataStore() {
+		members, err := RedisClient.SMembers(ctx, resizedVariantsKey(ctx, id)).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range members {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if err := Storage.Delete(ctx, key); err != nil {
+			logger.Warn("Failed to delete resized image",
+				zap.String("key", key),
+				zap.Error(err))
+		}
+	}
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+	return RedisClient.Del(ctx, resizedVariantsKey(ctx, id)).Err()
+}
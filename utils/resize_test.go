@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+)
+
+func TestParseResizeOptions(t *testing.T) {
+	cfg := &config.Config{MaxResizeDimension: 4096}
+	tests := []struct {
+		query   string
+		want    ResizeOptions
+		wantErr bool
+	}{
+		{"", ResizeOptions{Fit: FitContain}, false},
+		{"w=800", ResizeOptions{Width: 800, Fit: FitContain}, false},
+		{"h=600&fit=cover", ResizeOptions{Height: 600, Fit: FitCover}, false},
+		{"w=800&h=600&fit=FILL", ResizeOptions{Width: 800, Height: 600, Fit: FitFill}, false},
+		{"w=4096", ResizeOptions{Width: 4096, Fit: FitContain}, false},
+		{"w=4097", ResizeOptions{}, true},
+		{"w=0", ResizeOptions{}, true},
+		{"h=-1", ResizeOptions{}, true},
+		{"w=abc", ResizeOptions{}, true},
+		{"w=800&fit=stretch", ResizeOptions{}, true},
+		{"fit=cover", ResizeOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseResizeOptions(query, cfg)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseResizeOptions(%q) = %+v, %v; want %+v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResizeAllowed(t *testing.T) {
+	cfg := &config.Config{ResizeSizes: []int{320, 640, 1280}}
+	tests := []struct {
+		opts ResizeOptions
+		want bool
+	}{
+		{ResizeOptions{Width: 640, Fit: FitContain}, true},
+		{ResizeOptions{Height: 1280, Fit: FitContain}, true},
+		{ResizeOptions{Width: 640, Height: 320, Fit: FitCover}, true},
+		{ResizeOptions{Width: 641, Fit: FitContain}, false},
+		{ResizeOptions{Width: 640, Height: 321, Fit: FitFill}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opts.String(), func(t *testing.T) {
+			if got := ResizeAllowed(cfg, tt.opts); got != tt.want {
+				t.Errorf("ResizeAllowed(%s) = %v, want %v", tt.opts, got, tt.want)
+			}
+		})
+	}
+}
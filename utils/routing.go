@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.uber.org/zap"
+)
+
+const (
+	routingScriptTimeout  = 50 * time.Millisecond // Longest run of the route function per request
+	routingReloadInterval = 10 * time.Second      // How often the script file is checked for changes
+)
+
+// RoutingRequest is the random image query a routing script may rewrite
+type RoutingRequest struct {
+	Tags        []string // Required tags
+	ExcludeTags []string // Excluded tags
+	PreferTags  []string // Images with any of these tags are picked when there are some
+	Orientation string   // portrait or landscape
+	Format      string   // Requested format, empty for content negotiation
+	MinLikes    int64
+	Collection  string // Collection the image is picked from, empty for all images
+	Device      string // Detected device type, read-only
+	Country     string // Client country from the GeoIP database, read-only
+	Region      string // Client subdivision (ISO 3166-2) from the GeoIP database, read-only
+	Language    string // Client's most preferred language, or the lang parameter, read-only
+}
+
+// routingScript is a compiled routing script. Lua states are expensive to create, so each
+// keeps a pool of states that already ran the script.
+type routingScript struct {
+	path    string
+	modTime time.Time
+	proto   *lua.FunctionProto
+	states  sync.Pool
+}
+
+var (
+	routingMu      sync.Mutex
+	routing        *routingScript
+	routingChecked time.Time
+)
+
+// InitRoutingScript compiles the routing script of the configuration. A missing script is not
+// an error; random images are then selected by their query parameters only.
+func InitRoutingScript(cfg *config.Config) error {
+	if cfg.RoutingScript == "" {
+		return nil
+	}
+	script, err := compileRoutingScript(cfg.RoutingScript)
+	if err != nil || script == nil {
+		return err
+	}
+	routing = script
+	routingChecked = time.Now()
+	logger.Info("Loaded routing script", zap.String("path", cfg.RoutingScript))
+	return nil
+}
+
+// compileRoutingScript compiles a script and checks that it defines route. It returns nil
+// without an error when the file does not exist.
+func compileRoutingScript(path string) (*routingScript, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing script: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing script: %v", err)
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing script: %v", err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile routing script: %v", err)
+	}
+
+	script := &routingScript{path: path, modTime: info.ModTime(), proto: proto}
+	L, err := script.newState()
+	if err != nil {
+		return nil, err
+	}
+	script.states.Put(L)
+	return script, nil
+}
+
+// newState creates a sandboxed Lua state without file, OS or module access and runs the script
+func (s *routingScript) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 64, RegistryMaxSize: 1 << 16})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run routing script: %v", err)
+	}
+	if L.GetGlobal("route").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("routing script does not define function route(req)")
+	}
+	return L, nil
+}
+
+// currentRoutingScript returns the routing script, recompiling it when the file changed. A
+// script that fails to compile keeps the previous one in place.
+func currentRoutingScript() *routingScript {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	if routing == nil || time.Since(routingChecked) < routingReloadInterval {
+		return routing
+	}
+	routingChecked = time.Now()
+	info, err := os.Stat(routing.path)
+	if err != nil || info.ModTime().Equal(routing.modTime) {
+		return routing
+	}
+	script, err := compileRoutingScript(routing.path)
+	if err != nil || script == nil {
+		logger.Warn("Failed to reload routing script, keeping the previous version",
+			zap.String("path", routing.path),
+			zap.Error(err))
+		routing.modTime = info.ModTime()
+		return routing
+	}
+	logger.Info("Reloaded routing script", zap.String("path", routing.path))
+	routing = script
+	return routing
+}
+
+// ApplyRoutingScript passes a random image request through the route function of the routing
+// script, which may change the request in place or return a new one. Script errors leave the
+// request unchanged.
+func ApplyRoutingScript(r *http.Request, req *RoutingRequest) {
+	script := currentRoutingScript()
+	if script == nil {
+		return
+	}
+	if err := script.route(r, req); err != nil {
+		logger.Warn("Routing script failed, ignoring it", zap.Error(err))
+	}
+}
+
+func (s *routingScript) route(r *http.Request, req *RoutingRequest) error {
+	L, _ := s.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = s.newState(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), routingScriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	arg := routingTable(L, r, req)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("route"), NRet: 1, Protect: true}, arg)
+	if err != nil {
+		// The state may be left mid-call; it is not reused
+		L.Close()
+		return err
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	L.RemoveContext()
+
+	if table, ok := result.(*lua.LTable); ok {
+		arg = table
+	}
+	readRoutingTable(arg, req)
+	s.states.Put(L)
+	return nil
+}
+
+// routingTable builds the req argument of route: the query fields, the request time and the
+// request's path, query parameters and headers (lower-cased names)
+func routingTable(L *lua.LState, r *http.Request, req *RoutingRequest) *lua.LTable {
+	now := time.Now()
+	table := L.NewTable()
+	table.RawSetString("tags", stringList(L, req.Tags))
+	table.RawSetString("exclude", stringList(L, req.ExcludeTags))
+	table.RawSetString("prefer", stringList(L, req.PreferTags))
+	table.RawSetString("orientation", lua.LString(req.Orientation))
+	table.RawSetString("format", lua.LString(req.Format))
+	table.RawSetString("min_likes", lua.LNumber(req.MinLikes))
+	table.RawSetString("collection", lua.LString(req.Collection))
+	table.RawSetString("device", lua.LString(req.Device))
+	table.RawSetString("country", lua.LString(req.Country))
+	table.RawSetString("region", lua.LString(req.Region))
+	table.RawSetString("language", lua.LString(req.Language))
+	table.RawSetString("path", lua.LString(r.URL.Path))
+	if tenant := TenantFromContext(r.Context()); tenant != nil {
+		table.RawSetString("tenant", lua.LString(tenant.ID))
+	}
+
+	table.RawSetString("year", lua.LNumber(now.Year()))
+	table.RawSetString("month", lua.LNumber(now.Month()))
+	table.RawSetString("day", lua.LNumber(now.Day()))
+	table.RawSetString("weekday", lua.LNumber(now.Weekday())) // 0 is Sunday
+	table.RawSetString("hour", lua.LNumber(now.Hour()))
+	table.RawSetString("minute", lua.LNumber(now.Minute()))
+
+	query := L.NewTable()
+	for name, values := range r.URL.Query() {
+		query.RawSetString(name, lua.LString(values[0]))
+	}
+	table.RawSetString("query", query)
+	headers := L.NewTable()
+	for name := range r.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(r.Header.Get(name)))
+	}
+	table.RawSetString("headers", headers)
+	return table
+}
+
+// readRoutingTable copies the query fields of a route result back into the request
+func readRoutingTable(table *lua.LTable, req *RoutingRequest) {
+	req.Tags = readStringList(table.RawGetString("tags"), req.Tags)
+	req.ExcludeTags = readStringList(table.RawGetString("exclude"), req.ExcludeTags)
+	req.PreferTags = readStringList(table.RawGetString("prefer"), req.PreferTags)
+	if orientation, ok := table.RawGetString("orientation").(lua.LString); ok {
+		if o := strings.ToLower(string(orientation)); o == "portrait" || o == "landscape" {
+			req.Orientation = o
+		}
+	}
+	if format, ok := table.RawGetString("format").(lua.LString); ok {
+		req.Format = strings.ToLower(string(format))
+	}
+	if minLikes, ok := table.RawGetString("min_likes").(lua.LNumber); ok && minLikes >= 0 {
+		req.MinLikes = int64(minLikes)
+	}
+	if collection, ok := table.RawGetString("collection").(lua.LString); ok {
+		req.Collection = strings.TrimSpace(string(collection))
+	}
+}
+
+func stringList(L *lua.LState, values []string) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+// readStringList reads an array of strings, returning fallback when value is not a table
+func readStringList(value lua.LValue, fallback []string) []string {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return fallback
+	}
+	var values []string
+	for i := 1; i <= table.Len(); i++ {
+		if s := strings.TrimSpace(lua.LVAsString(table.RawGetInt(i))); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
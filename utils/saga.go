@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Saga coordinates an operation made of steps that cannot share a transaction, like storing
+// the objects of an upload and then saving its metadata. Each step registers a compensation
+// undoing it; when a later step fails, Rollback runs them newest first, so a failed operation
+// leaves no orphaned objects behind. Steps may run concurrently.
+type Saga struct {
+	name  string
+	mu    sync.Mutex
+	steps []sagaStep
+}
+
+type sagaStep struct {
+	name       string
+	compensate func(context.Context) error
+}
+
+// NewSaga starts a saga, named in the log messages of its rollback
+func NewSaga(name string) *Saga {
+	return &Saga{name: name}
+}
+
+// Add registers the compensation of a step
+func (s *Saga) Add(step string, compensate func(context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, sagaStep{name: step, compensate: compensate})
+}
+
+// StoreObject stores an object with StoreVerified as a step compensated by deleting it. An
+// object failing verification may have been written anyway, so it is deleted right away.
+func (s *Saga) StoreObject(ctx context.Context, key string, data []byte) error {
+	deleteObject := func(ctx context.Context) error {
+		return Storage.Delete(ctx, key)
+	}
+	if err := StoreVerified(ctx, key, data); err != nil {
+		deleteObject(context.WithoutCancel(ctx))
+		return err
+	}
+	s.Add("store "+key, deleteObject)
+	return nil
+}
+
+// StoreObjectStream is StoreObject for an object of size bytes read from r
+func (s *Saga) StoreObjectStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	deleteObject := func(ctx context.Context) error {
+		return Storage.Delete(ctx, key)
+	}
+	if err := StoreStreamVerified(ctx, key, r, size); err != nil {
+		deleteObject(context.WithoutCancel(ctx))
+		return err
+	}
+	s.Add("store "+key, deleteObject)
+	return nil
+}
+
+// Rollback runs the compensations of every registered step, newest first. Compensations run
+// even when the request was canceled; their failures are logged and do not stop the others.
+func (s *Saga) Rollback(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	s.mu.Lock()
+	steps := slices.Clone(s.steps)
+	s.steps = nil
+	s.mu.Unlock()
+
+	for _, step := range slices.Backward(steps) {
+		if err := step.compensate(ctx); err != nil {
+			logger.Warn("Failed to compensate step",
+				zap.String("saga", s.name),
+				zap.String("step", step.name),
+				zap.Error(err))
+		}
+	}
+	logger.Info("Rolled back saga",
+		zap.String("saga", s.name),
+		zap.Int("steps", len(steps)))
+}
+
+// Commit ends the saga once every step succeeded, so nothing is compensated anymore
+func (s *Saga) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = nil
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduleCacheTTL bounds how long other instances take to pick up schedule changes
+const scheduleCacheTTL = 30 * time.Second
+
+var scheduleNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Schedule limits a collection of tagged images to date and time windows, like a seasonal
+// collection. Outside its window the tags are excluded from random images; inside it they
+// are served as usual, or preferred.
+type Schedule struct {
+	Name      string    `json:"name"`
+	Tags      []string  `json:"tags"`      // Tags of the collection
+	Start     string    `json:"start"`     // First day: YYYY-MM-DD, or MM-DD to recur every year
+	End       string    `json:"end"`       // Last day, in the same form as start; recurring windows may span the year end
+	Weekdays  []int     `json:"weekdays"`  // Days of the week, 0 (Sunday) to 6; empty for every day
+	From      string    `json:"from"`      // Daily start time HH:MM
+	To        string    `json:"to"`        // Daily end time HH:MM, exclusive; may be past midnight
+	Timezone  string    `json:"timezone"`  // IANA time zone, server local time when empty
+	Prefer    bool      `json:"prefer"`    // Prefer the tags while the schedule is active
+	UpdatedAt time.Time `json:"updatedAt"` // Set when saved
+
+	location *time.Location
+}
+
+// Validate checks the fields of a schedule and resolves its time zone
+func (s *Schedule) Validate() error {
+	if !scheduleNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("invalid schedule name: use 1-64 lowercase letters, digits, dashes or underscores")
+	}
+	if len(s.Tags) == 0 {
+		return fmt.Errorf("at least one tag is required")
+	}
+
+	recurring := len(s.Start) == len("01-02") || len(s.End) == len("01-02")
+	for _, day := range []string{s.Start, s.End} {
+		if day == "" {
+			continue
+		}
+		layout := "2006-01-02"
+		if recurring {
+			layout = "01-02"
+		}
+		if _, err := time.Parse(layout, day); err != nil {
+			return fmt.Errorf("invalid day %q: use YYYY-MM-DD, or MM-DD for both start and end", day)
+		}
+	}
+	if recurring && (s.Start == "" || s.End == "") {
+		return fmt.Errorf("recurring windows need both start and end")
+	}
+	if !recurring && s.Start != "" && s.End != "" && s.Start > s.End {
+		return fmt.Errorf("start is after end")
+	}
+
+	for _, weekday := range s.Weekdays {
+		if weekday < 0 || weekday > 6 {
+			return fmt.Errorf("invalid weekday %d: use 0 (Sunday) to 6", weekday)
+		}
+	}
+	if (s.From == "") != (s.To == "") {
+		return fmt.Errorf("daily windows need both from and to")
+	}
+	for _, clock := range []string{s.From, s.To} {
+		if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+			return fmt.Errorf("invalid time %q: use HH:MM", clock)
+		}
+	}
+
+	s.location = time.Local
+	if s.Timezone != "" {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %s", s.Timezone)
+		}
+		s.location = location
+	}
+	return nil
+}
+
+// Active reports whether the schedule's window includes a point in time. Days and times are
+// compared as zero-padded strings, which order like the dates they stand for.
+func (s *Schedule) Active(now time.Time) bool {
+	location := s.location
+	if location == nil {
+		location = time.Local
+	}
+	now = now.In(location)
+
+	if len(s.Start) == len("01-02") {
+		if !inWindow(now.Format("01-02"), s.Start, s.End) {
+			return false
+		}
+	} else {
+		day := now.Format("2006-01-02")
+		if (s.Start != "" && day < s.Start) || (s.End != "" && day > s.End) {
+			return false
+		}
+	}
+
+	if len(s.Weekdays) > 0 && !slices.Contains(s.Weekdays, int(now.Weekday())) {
+		return false
+	}
+	if s.From != "" {
+		clock := now.Format("15:04")
+		// The end time is exclusive
+		if s.From <= s.To {
+			return clock >= s.From && clock < s.To
+		}
+		return clock >= s.From || clock < s.To
+	}
+	return true
+}
+
+// inWindow reports whether value lies in the inclusive window start-end, which wraps around
+// when start is after end
+func inWindow(value, start, end string) bool {
+	if start <= end {
+		return value >= start && value <= end
+	}
+	return value >= start || value <= end
+}
+
+type scheduleCacheEntry struct {
+	schedules []*Schedule
+	loaded    time.Time
+}
+
+// scheduleCache holds the schedules of each namespace, keyed by Redis key prefix, so random
+// image requests do not read them from Redis every time
+var scheduleCache sync.Map
+
+func schedulesKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "schedules"
+}
+
+// ListSchedules returns the schedules of the context's namespace ordered by name
+func ListSchedules(ctx context.Context) ([]*Schedule, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.HGetAll(ctx, schedulesKey(ctx)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %v", err)
+	}
+
+	schedules := make([]*Schedule, 0, len(items))
+	for _, data := range items {
+		var schedule Schedule
+		if err := json.Unmarshal([]byte(data), &schedule); err != nil || schedule.Validate() != nil {
+			continue
+		}
+		schedules = append(schedules, &schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Name < schedules[j].Name
+	})
+	return schedules, nil
+}
+
+// SaveSchedule stores a schedule of the context's namespace. With create set it fails when a
+// schedule of the same name exists, otherwise when none does.
+func SaveSchedule(ctx context.Context, schedule *Schedule, create bool) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	exists, err := RedisClient.HExists(ctx, schedulesKey(ctx), schedule.Name).Result()
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %v", err)
+	}
+	if create && exists {
+		return fmt.Errorf("schedule already exists: %s", schedule.Name)
+	}
+	if !create && !exists {
+		return fmt.Errorf("schedule not found: %s", schedule.Name)
+	}
+
+	schedule.UpdatedAt = time.Now()
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule: %v", err)
+	}
+	if err := RedisClient.HSet(ctx, schedulesKey(ctx), schedule.Name, data).Err(); err != nil {
+		return fmt.Errorf("failed to save schedule: %v", err)
+	}
+	scheduleCache.Delete(KeyPrefix(ctx))
+	return nil
+}
+
+// DeleteSchedule removes a schedule of the context's namespace
+func DeleteSchedule(ctx context.Context, name string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	removed, err := RedisClient.HDel(ctx, schedulesKey(ctx), name).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %v", err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("schedule not found: %s", name)
+	}
+	scheduleCache.Delete(KeyPrefix(ctx))
+	return nil
+}
+
+// cachedSchedules returns the schedules of the context's namespace, read from Redis at most
+// once per scheduleCacheTTL
+func cachedSchedules(ctx context.Context) []*Schedule {
+	prefix := KeyPrefix(ctx)
+	if entry, ok := scheduleCache.Load(prefix); ok {
+		if cached := entry.(*scheduleCacheEntry); time.Since(cached.loaded) < scheduleCacheTTL {
+			return cached.schedules
+		}
+	}
+	schedules, err := ListSchedules(ctx)
+	if err != nil {
+		return nil
+	}
+	scheduleCache.Store(prefix, &scheduleCacheEntry{schedules: schedules, loaded: time.Now()})
+	return schedules
+}
+
+// ApplySchedules adds the tags of inactive schedules to the excluded tags of a random image
+// request and, for active schedules that prefer them, to the preferred tags. Tags the request
+// requires, or that an active schedule includes, are not excluded.
+func ApplySchedules(ctx context.Context, req *RoutingRequest, now time.Time) {
+	if !IsRedisMetadataStore() {
+		return
+	}
+	schedules := cachedSchedules(ctx)
+	active := make(map[string]bool)
+	for _, schedule := range schedules {
+		if !schedule.Active(now) {
+			continue
+		}
+		for _, tag := range schedule.Tags {
+			active[tag] = true
+			if schedule.Prefer && !slices.Contains(req.PreferTags, tag) {
+				req.PreferTags = append(req.PreferTags, tag)
+			}
+		}
+	}
+	for _, schedule := range schedules {
+		for _, tag := range schedule.Tags {
+			if !active[tag] && !slices.Contains(req.Tags, tag) && !slices.Contains(req.ExcludeTags, tag) {
+				req.ExcludeTags = append(req.ExcludeTags, tag)
+			}
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// searchSyncBatch is the number of changes pushed to the search engine at once
+const searchSyncBatch = 500
+
+// SearchDocument is an image as indexed in the external search engine. Documents of every
+// tenant share the index; Key tells them apart and Tenant restricts searches.
+type SearchDocument struct {
+	Key          string   `json:"key"` // Unique key of the document: the image ID, prefixed with the tenant's
+	ID           string   `json:"id"`
+	Tenant       string   `json:"tenant"` // Tenant of the image, empty for the default tenant
+	OriginalName string   `json:"originalName"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text,omitempty"` // Text extracted by OCR
+	Orientation  string   `json:"orientation"`
+	Format       string   `json:"format"`
+	Visibility   string   `json:"visibility"`
+	UploadTime   int64    `json:"uploadTime"` // Unix seconds
+}
+
+// SearchQuery is a full-text search of the external search engine
+type SearchQuery struct {
+	Text        string
+	Tenant      string
+	Tags        []string // Tags every match must have
+	Orientation string   // Empty for any
+	Visibility  string   // Empty for any
+	Offset      int
+	Limit       int
+}
+
+// SearchHits are the IDs of the images matching a search, best first
+type SearchHits struct {
+	IDs   []string
+	Total int // Estimated number of matches
+}
+
+// SearchIndex is an external search engine the library is indexed in
+type SearchIndex interface {
+	// Setup creates the index if needed and declares the fields used to filter
+	Setup(ctx context.Context) error
+	Upsert(ctx context.Context, docs []SearchDocument) error
+	Delete(ctx context.Context, keys []string) error
+	Search(ctx context.Context, query SearchQuery) (*SearchHits, error)
+	String() string
+}
+
+// SearchIndexer keeps the external search index in sync with the library by following the
+// change feed of every tenant. The position reached in a feed is stored in Redis and only
+// advanced once the changes were accepted by the engine, so changes are pushed at least once.
+// Changes made through this instance are pushed right away; the interval catches the others.
+type SearchIndexer struct {
+	index    SearchIndex
+	interval time.Duration
+	wake     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// SearchIndexing is the running search indexer, nil when no search engine is configured
+var SearchIndexing *SearchIndexer
+
+// InitSearchIndex starts the search indexer when a search engine is configured
+func InitSearchIndex(cfg *config.Config) error {
+	if cfg.SearchEngine == config.SearchEngineNone {
+		return nil
+	}
+	if cfg.SearchEngineURL == "" {
+		return fmt.Errorf("SEARCH_ENGINE_URL is required by the %s search engine", cfg.SearchEngine)
+	}
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("search indexing requires the Redis metadata store")
+	}
+
+	client := searchEngineClient{
+		baseURL: strings.TrimSuffix(cfg.SearchEngineURL, "/"),
+		index:   cfg.SearchIndex,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	var index SearchIndex
+	switch cfg.SearchEngine {
+	case config.SearchEngineMeilisearch:
+		if cfg.SearchEngineAPIKey != "" {
+			client.authorization = "Bearer " + cfg.SearchEngineAPIKey
+		}
+		index = &meilisearchIndex{client}
+	case config.SearchEngineElasticsearch:
+		if cfg.SearchEngineAPIKey != "" {
+			client.authorization = "ApiKey " + cfg.SearchEngineAPIKey
+		}
+		index = &elasticsearchIndex{client}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	SearchIndexing = &SearchIndexer{
+		index:    index,
+		interval: time.Duration(cfg.SearchSyncInterval) * time.Second,
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	SearchIndexing.Start()
+	return nil
+}
+
+// Start pushes new changes to the search engine every interval until Stop is called
+func (s *SearchIndexer) Start() {
+	logger.Info("Starting search indexing",
+		zap.String("engine", s.index.String()))
+
+	go func() {
+		// The engine may still be starting; setup is retried until it succeeds
+		for {
+			err := s.index.Setup(s.ctx)
+			if err == nil {
+				break
+			}
+			logger.Warn("Failed to set up search index", zap.Error(err))
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(s.interval):
+			}
+		}
+
+		for s.ctx.Err() == nil {
+			for _, ctx := range TenantContexts(s.ctx) {
+				if err := s.syncTenant(ctx); err != nil && s.ctx.Err() == nil {
+					logger.Warn("Failed to sync search index",
+						zap.String("prefix", KeyPrefix(ctx)),
+						zap.Error(err))
+				}
+			}
+			select {
+			case <-s.ctx.Done():
+			case <-s.wake:
+			case <-time.After(s.interval):
+			}
+		}
+	}()
+}
+
+// Notify wakes the indexer after a change of the library, so uploads, deletions and tag edits
+// become searchable without waiting for the interval. Changes recorded while a sync runs are
+// pushed by one more sync. It is a no-op on a nil indexer.
+func (s *SearchIndexer) Notify() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop terminates the indexer; changes not pushed yet are pushed on next start
+func (s *SearchIndexer) Stop() {
+	s.cancel()
+	logger.Info("Search indexing stopped")
+}
+
+// Search runs a full-text search of the request's tenant
+func (s *SearchIndexer) Search(ctx context.Context, query SearchQuery) (*SearchHits, error) {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		query.Tenant = tenant.ID
+	}
+	return s.index.Search(ctx, query)
+}
+
+// searchIndexCursorKey holds the sequence number of the last change of a tenant pushed to the
+// search engine
+func searchIndexCursorKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "search_index:cursor"
+}
+
+// searchIndexLockKey is held by the instance syncing a tenant, so instances sharing Redis do
+// not push the same changes concurrently
+func searchIndexLockKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "search_index:lock"
+}
+
+// syncTenant pushes the changes of a tenant made since the last sync. A tenant never synced
+// before, or whose feed was trimmed past the last sync, is indexed again in full.
+func (s *SearchIndexer) syncTenant(ctx context.Context) error {
+	locked, err := RedisClient.SetNX(ctx, searchIndexLockKey(ctx), 1, time.Minute).Result()
+	if err != nil || !locked {
+		return err
+	}
+	defer RedisClient.Del(context.WithoutCancel(ctx), searchIndexLockKey(ctx))
+
+	cursor, err := RedisClient.Get(ctx, searchIndexCursorKey(ctx)).Int64()
+	full := err == redis.Nil
+	if err != nil && !full {
+		return fmt.Errorf("failed to read search index cursor: %v", err)
+	}
+
+	for {
+		page, err := Changes(ctx, cursor, searchSyncBatch)
+		if err != nil {
+			return err
+		}
+		if full || page.Truncated {
+			// Changes made while reindexing are replayed from the latest change seen before
+			if err := s.reindex(ctx); err != nil {
+				return err
+			}
+			full = false
+			cursor = page.Latest
+		} else if len(page.Changes) > 0 {
+			if err := s.push(ctx, page.Changes); err != nil {
+				return err
+			}
+			cursor = page.Changes[len(page.Changes)-1].Seq
+		} else {
+			return nil
+		}
+		if err := RedisClient.Set(ctx, searchIndexCursorKey(ctx), cursor, 0).Err(); err != nil {
+			return fmt.Errorf("failed to save search index cursor: %v", err)
+		}
+		if len(page.Changes) < searchSyncBatch {
+			return nil
+		}
+	}
+}
+
+// push indexes the images changed in a page of the change feed, as they are now
+func (s *SearchIndexer) push(ctx context.Context, changes []Change) error {
+	var docs []SearchDocument
+	var deleted []string
+	seen := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		if seen[change.ID] {
+			continue
+		}
+		seen[change.ID] = true
+
+		metadata, err := MetadataManager.GetMetadata(ctx, change.ID)
+		if err != nil {
+			// Deleted since, whatever the change was
+			deleted = append(deleted, searchDocumentKey(ctx, change.ID))
+			continue
+		}
+		docs = append(docs, newSearchDocument(ctx, metadata))
+	}
+
+	if len(docs) > 0 {
+		if err := s.index.Upsert(ctx, docs); err != nil {
+			return err
+		}
+	}
+	if len(deleted) > 0 {
+		if err := s.index.Delete(ctx, deleted); err != nil {
+			return err
+		}
+	}
+	logger.Debug("Pushed changes to search index",
+		zap.Int("indexed", len(docs)),
+		zap.Int("deleted", len(deleted)))
+	return nil
+}
+
+// reindex indexes every image of a tenant. Documents of images deleted while their changes
+// were trimmed are left in the index; searches skip them.
+func (s *SearchIndexer) reindex(ctx context.Context) error {
+	images, err := MetadataManager.GetAllMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %v", err)
+	}
+	for start := 0; start < len(images); start += searchSyncBatch {
+		batch := images[start:min(start+searchSyncBatch, len(images))]
+		docs := make([]SearchDocument, len(batch))
+		for i, metadata := range batch {
+			docs[i] = newSearchDocument(ctx, metadata)
+		}
+		if err := s.index.Upsert(ctx, docs); err != nil {
+			return err
+		}
+	}
+	logger.Info("Reindexed library in search engine",
+		zap.String("prefix", KeyPrefix(ctx)),
+		zap.Int("images", len(images)))
+	return nil
+}
+
+func newSearchDocument(ctx context.Context, metadata *ImageMetadata) SearchDocument {
+	doc := SearchDocument{
+		Key:          searchDocumentKey(ctx, metadata.ID),
+		ID:           metadata.ID,
+		OriginalName: metadata.OriginalName,
+		Tags:         metadata.Tags,
+		Text:         metadata.OCRText,
+		Orientation:  metadata.Orientation,
+		Format:       metadata.Format,
+		Visibility:   string(metadata.EffectiveVisibility()),
+		UploadTime:   metadata.UploadTime.Unix(),
+	}
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		doc.Tenant = tenant.ID
+	}
+	if doc.Tags == nil {
+		doc.Tags = []string{}
+	}
+	return doc
+}
+
+// searchDocumentKey returns the document key of an image, unique across tenants
+func searchDocumentKey(ctx context.Context, id string) string {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		return tenant.ID + "-" + id
+	}
+	return id
+}
+
+// searchEngineClient sends JSON requests to a search engine
+type searchEngineClient struct {
+	baseURL       string
+	index         string
+	authorization string
+	client        *http.Client
+}
+
+// request sends a request to the engine and decodes its JSON answer into out, if not nil
+func (c *searchEngineClient) request(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create search engine request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("search engine request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &searchEngineError{status: resp.StatusCode, message: string(bytes.TrimSpace(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode search engine response: %v", err)
+	}
+	return nil
+}
+
+// requestJSON sends a JSON body to the engine
+func (c *searchEngineClient) requestJSON(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal search engine request: %v", err)
+	}
+	return c.request(ctx, method, path, "application/json", payload, out)
+}
+
+type searchEngineError struct {
+	status  int
+	message string
+}
+
+func (e *searchEngineError) Error() string {
+	return fmt.Sprintf("search engine returned %d: %s", e.status, e.message)
+}
+
+// searchFilterFields are the document fields searches filter on
+var searchFilterFields = []string{"tenant", "tags", "orientation", "visibility", "format"}
+
+// meilisearchIndex indexes the library in Meilisearch. Writes are asynchronous tasks of the
+// engine, so pushed changes become searchable shortly after.
+type meilisearchIndex struct {
+	searchEngineClient
+}
+
+func (m *meilisearchIndex) String() string {
+	return "meilisearch " + m.baseURL + "/indexes/" + m.index
+}
+
+func (m *meilisearchIndex) path(suffix string) string {
+	return "/indexes/" + url.PathEscape(m.index) + suffix
+}
+
+func (m *meilisearchIndex) Setup(ctx context.Context) error {
+	// Creating an existing index fails as an asynchronous task, which is ignored
+	err := m.requestJSON(ctx, http.MethodPost, "/indexes", map[string]string{"uid": m.index, "primaryKey": "key"}, nil)
+	if err != nil {
+		return err
+	}
+	return m.requestJSON(ctx, http.MethodPatch, m.path("/settings"), map[string]interface{}{
+		"searchableAttributes": []string{"originalName", "tags", "text"},
+		"filterableAttributes": searchFilterFields,
+		"sortableAttributes":   []string{"uploadTime"},
+		// One typo is forgiven in words of 4 letters, two from 8, so "sunest" finds "sunset"
+		"typoTolerance": map[string]interface{}{
+			"enabled":             true,
+			"minWordSizeForTypos": map[string]int{"oneTypo": 4, "twoTypos": 8},
+		},
+	}, nil)
+}
+
+func (m *meilisearchIndex) Upsert(ctx context.Context, docs []SearchDocument) error {
+	return m.requestJSON(ctx, http.MethodPost, m.path("/documents?primaryKey=key"), docs, nil)
+}
+
+func (m *meilisearchIndex) Delete(ctx context.Context, keys []string) error {
+	return m.requestJSON(ctx, http.MethodPost, m.path("/documents/delete-batch"), keys, nil)
+}
+
+func (m *meilisearchIndex) Search(ctx context.Context, query SearchQuery) (*SearchHits, error) {
+	filters := []string{"tenant = " + meilisearchQuote(query.Tenant)}
+	for _, tag := range query.Tags {
+		filters = append(filters, "tags = "+meilisearchQuote(tag))
+	}
+	if query.Orientation != "" {
+		filters = append(filters, "orientation = "+meilisearchQuote(query.Orientation))
+	}
+	if query.Visibility != "" {
+		filters = append(filters, "visibility = "+meilisearchQuote(query.Visibility))
+	}
+
+	var result struct {
+		Hits []struct {
+			ID string `json:"id"`
+		} `json:"hits"`
+		EstimatedTotalHits int `json:"estimatedTotalHits"`
+	}
+	err := m.requestJSON(ctx, http.MethodPost, m.path("/search"), map[string]interface{}{
+		"q":                    query.Text,
+		"filter":               filters,
+		"offset":               query.Offset,
+		"limit":                query.Limit,
+		"attributesToRetrieve": []string{"id"},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := &SearchHits{IDs: make([]string, len(result.Hits)), Total: result.EstimatedTotalHits}
+	for i, hit := range result.Hits {
+		hits.IDs[i] = hit.ID
+	}
+	return hits, nil
+}
+
+// meilisearchQuote quotes a value of a Meilisearch filter expression
+func meilisearchQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// elasticsearchIndex indexes the library in Elasticsearch
+type elasticsearchIndex struct {
+	searchEngineClient
+}
+
+func (e *elasticsearchIndex) String() string {
+	return "elasticsearch " + e.baseURL + "/" + e.index
+}
+
+func (e *elasticsearchIndex) Setup(ctx context.Context) error {
+	properties := map[string]interface{}{
+		"originalName": map[string]string{"type": "text"},
+		"text":         map[string]string{"type": "text"},
+		"uploadTime":   map[string]string{"type": "long"},
+	}
+	for _, field := range searchFilterFields {
+		properties[field] = map[string]string{"type": "keyword"}
+	}
+	err := e.requestJSON(ctx, http.MethodPut, "/"+url.PathEscape(e.index), map[string]interface{}{
+		"mappings": map[string]interface{}{"properties": properties},
+	}, nil)
+	if engineErr, ok := err.(*searchEngineError); ok && engineErr.status == http.StatusBadRequest &&
+		strings.Contains(engineErr.message, "resource_already_exists_exception") {
+		return nil
+	}
+	return err
+}
+
+func (e *elasticsearchIndex) Upsert(ctx context.Context, docs []SearchDocument) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		encoder.Encode(map[string]interface{}{"index": map[string]string{"_index": e.index, "_id": doc.Key}})
+		encoder.Encode(doc)
+	}
+	return e.bulk(ctx, body.Bytes())
+}
+
+func (e *elasticsearchIndex) Delete(ctx context.Context, keys []string) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, key := range keys {
+		encoder.Encode(map[string]interface{}{"delete": map[string]string{"_index": e.index, "_id": key}})
+	}
+	return e.bulk(ctx, body.Bytes())
+}
+
+// bulk sends a bulk request, failing when any of its actions failed. Deleting a missing
+// document is not a failure.
+func (e *elasticsearchIndex) bulk(ctx context.Context, body []byte) error {
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := e.request(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body, &result); err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for action, status := range item {
+			if status.Error != nil && !(action == "delete" && status.Status == http.StatusNotFound) {
+				return fmt.Errorf("search engine rejected %s: %s", action, status.Error)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *elasticsearchIndex) Search(ctx context.Context, query SearchQuery) (*SearchHits, error) {
+	filters := []interface{}{
+		map[string]interface{}{"term": map[string]string{"tenant": query.Tenant}},
+	}
+	for _, tag := range query.Tags {
+		filters = append(filters, map[string]interface{}{"term": map[string]string{"tags": tag}})
+	}
+	if query.Orientation != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]string{"orientation": query.Orientation}})
+	}
+	if query.Visibility != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]string{"visibility": query.Visibility}})
+	}
+	boolQuery := map[string]interface{}{"filter": filters}
+	if query.Text != "" {
+		boolQuery["must"] = map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":     query.Text,
+				"fields":    []string{"originalName", "tags", "text"},
+				"fuzziness": "AUTO", // Typo tolerance matching Meilisearch's
+			},
+		}
+	}
+
+	var result struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source struct {
+					ID string `json:"id"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := e.requestJSON(ctx, http.MethodPost, "/"+url.PathEscape(e.index)+"/_search", map[string]interface{}{
+		"query":   map[string]interface{}{"bool": boolQuery},
+		"from":    query.Offset,
+		"size":    query.Limit,
+		"_source": []string{"id"},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := &SearchHits{IDs: make([]string, len(result.Hits.Hits)), Total: result.Hits.Total.Value}
+	for i, hit := range result.Hits.Hits {
+		hits.IDs[i] = hit.Source.ID
+	}
+	return hits, nil
+}
@@ -0,0 +1,33 @@
+package utils
+
+import "hash/fnv"
+
+// SeededIndex picks one of a pool of image IDs for a seed, by rendezvous hashing: every ID is
+// scored by a hash of the seed and the ID, and the highest score wins. The same seed therefore
+// picks the same image from the same pool on every instance and regardless of the pool's order.
+// Removing other images never changes the pick, and an added image only takes over when it
+// outscores the current pick, which happens for about one seed in the new pool size.
+func SeededIndex(seed string, ids []string) int {
+	best := 0
+	var bestScore uint64
+	for i, id := range ids {
+		h := fnv.New64a()
+		h.Write([]byte(seed))
+		h.Write([]byte{0})
+		h.Write([]byte(id))
+		if score := mix64(h.Sum64()); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer, spreading FNV hashes of similar IDs over the whole range
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
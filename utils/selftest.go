@@ -0,0 +1,375 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// selfTestHistory is the number of runs kept for /api/selftest
+const selfTestHistory = 50
+
+// SelfTestStep is one request of a self-test run
+type SelfTestStep struct {
+	Name       string `json:"name"`             // upload, random or delete
+	OK         bool   `json:"ok"`               // Whether the step succeeded
+	Status     int    `json:"status,omitempty"` // HTTP status of the response
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SelfTestRun is a run of the self-test
+type SelfTestRun struct {
+	Time       time.Time      `json:"time"`
+	OK         bool           `json:"ok"` // Whether every step succeeded
+	DurationMs int64          `json:"durationMs"`
+	Steps      []SelfTestStep `json:"steps"`
+}
+
+// SelfTestStatus reports the recent runs of the self-test, newest first
+type SelfTestStatus struct {
+	Enabled             bool          `json:"enabled"`
+	Interval            int           `json:"interval"` // Minutes between runs
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	Runs                []SelfTestRun `json:"runs"`
+}
+
+// SelfTester is a synthetic monitor: it periodically uploads a tiny image through the instance's
+// own API, requests it from /api/random and deletes it again, keeping the results and calling a
+// webhook when the instance starts failing and when it recovers
+type SelfTester struct {
+	baseURL    string
+	apiKey     string
+	webhookURL string
+	interval   time.Duration
+	client     *http.Client
+
+	mu       sync.Mutex
+	runs     []SelfTestRun // Newest first
+	failures int           // Consecutive failed runs
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// SelfTest is the running self-test, nil when disabled
+var SelfTest *SelfTester
+
+// InitSelfTest starts the self-test when SELFTEST_INTERVAL is set. It requests the API of the
+// instance at SELFTEST_URL, by default the listen address on the loopback interface.
+func InitSelfTest(cfg *config.Config) error {
+	if cfg.SelfTestInterval <= 0 {
+		return nil
+	}
+	if cfg.APIKey == "" {
+		return fmt.Errorf("the self-test requires API_KEY")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	baseURL := strings.TrimSuffix(cfg.SelfTestURL, "/")
+	if baseURL == "" {
+		host, port, err := net.SplitHostPort(cfg.ServerAddr)
+		if err != nil {
+			return fmt.Errorf("invalid server address %s: %v", cfg.ServerAddr, err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		scheme := "http"
+		if cfg.TLSEnabled() {
+			// The certificates name the public domains, not the loopback address
+			scheme = "https"
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		baseURL = scheme + "://" + net.JoinHostPort(host, port)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	SelfTest = &SelfTester{
+		baseURL:    baseURL,
+		apiKey:     cfg.APIKey,
+		webhookURL: cfg.SelfTestWebhookURL,
+		interval:   time.Duration(cfg.SelfTestInterval) * time.Minute,
+		client:     &http.Client{Timeout: time.Minute, Transport: transport},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	SelfTest.Start()
+	return nil
+}
+
+// Start runs the self-test every interval until Stop is called
+func (s *SelfTester) Start() {
+	logger.Info("Starting self-test",
+		zap.String("url", s.baseURL),
+		zap.Duration("interval", s.interval))
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(s.interval):
+			}
+			s.Run(s.ctx)
+		}
+	}()
+}
+
+// Stop terminates the self-test
+func (s *SelfTester) Stop() {
+	s.cancel()
+}
+
+// Status returns the recent runs
+func (s *SelfTester) Status() SelfTestStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SelfTestStatus{
+		Enabled:             true,
+		Interval:            int(s.interval / time.Minute),
+		ConsecutiveFailures: s.failures,
+		Runs:                append([]SelfTestRun{}, s.runs...),
+	}
+}
+
+// Run runs the self-test once, records the run and alerts when the result changed
+func (s *SelfTester) Run(ctx context.Context) SelfTestRun {
+	run := s.run(ctx)
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, not a failure of the instance
+		return run
+	}
+
+	s.mu.Lock()
+	previousFailures := s.failures
+	if run.OK {
+		s.failures = 0
+	} else {
+		s.failures++
+	}
+	s.runs = append([]SelfTestRun{run}, s.runs[:min(len(s.runs), selfTestHistory-1)]...)
+	failures := s.failures
+	s.mu.Unlock()
+
+	if run.OK {
+		logger.Debug("Self-test passed", zap.Int64("duration_ms", run.DurationMs))
+	} else {
+		logger.Error("Self-test failed",
+			zap.Int("consecutive_failures", failures),
+			zap.Any("steps", run.Steps))
+	}
+	switch {
+	case !run.OK && previousFailures == 0:
+		s.alert("selftest.failed", run)
+	case run.OK && previousFailures > 0:
+		s.alert("selftest.recovered", run)
+	}
+	return run
+}
+
+// run uploads a test image under a tag of its own, requests it from /api/random and deletes it
+func (s *SelfTester) run(ctx context.Context) (run SelfTestRun) {
+	run = SelfTestRun{Time: time.Now().UTC(), OK: true}
+	start := time.Now()
+	step := func(name string, do func() (int, error)) bool {
+		stepStart := time.Now()
+		status, err := do()
+		result := SelfTestStep{Name: name, OK: err == nil, Status: status, DurationMs: time.Since(stepStart).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+			run.OK = false
+		}
+		run.Steps = append(run.Steps, result)
+		return err == nil
+	}
+	defer func() {
+		run.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	tag := "selftest-" + hex.EncodeToString(nonce)
+
+	// The image is public so /api/random serves it, and expires in an hour should the delete fail
+	var id string
+	if !step("upload", func() (int, error) {
+		status, uploaded, err := s.upload(ctx, tag)
+		id = uploaded
+		return status, err
+	}) {
+		return run
+	}
+
+	step("random", func() (int, error) {
+		resp, err := s.request(ctx, http.MethodGet, "/api/random?tags="+url.QueryEscape(tag), "", nil)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return resp.StatusCode, err
+		}
+		switch {
+		case resp.StatusCode != http.StatusOK:
+			return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+		case resp.Header.Get("X-Image-Id") != id:
+			return resp.StatusCode, fmt.Errorf("served image %q instead of %q", resp.Header.Get("X-Image-Id"), id)
+		case len(body) == 0:
+			return resp.StatusCode, fmt.Errorf("empty image")
+		}
+		return resp.StatusCode, nil
+	})
+
+	step("delete", func() (int, error) {
+		payload, _ := json.Marshal(map[string]string{"id": id})
+		var result struct {
+			Success bool   `json:"success"`
+			Message string `json:"message"`
+		}
+		status, err := s.requestJSON(ctx, http.MethodPost, "/api/delete-image", "application/json", payload, &result)
+		if err == nil && !result.Success {
+			err = fmt.Errorf("delete failed: %s", result.Message)
+		}
+		return status, err
+	})
+	return run
+}
+
+// upload uploads a tiny test image and returns its ID
+func (s *SelfTester) upload(ctx context.Context, tag string) (int, string, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(8, 8, color.RGBA{R: 0x33, G: 0x66, B: 0x99, A: 0xff})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("images[]", "selftest.png")
+	if err != nil {
+		return 0, "", err
+	}
+	if err := png.Encode(part, img); err != nil {
+		return 0, "", err
+	}
+	for field, value := range map[string]string{
+		"tags":          tag,
+		"visibility":    string(VisibilityPublic),
+		"expiryMinutes": "60",
+		"dedupe":        "false",
+	} {
+		form.WriteField(field, value)
+	}
+	form.Close()
+
+	var result struct {
+		Results []struct {
+			ID      string `json:"id"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"results"`
+	}
+	status, err := s.requestJSON(ctx, http.MethodPost, "/api/upload", form.FormDataContentType(), body.Bytes(), &result)
+	if err != nil {
+		return status, "", err
+	}
+	if len(result.Results) != 1 || result.Results[0].Status != "success" || result.Results[0].ID == "" {
+		if len(result.Results) == 1 {
+			return status, "", fmt.Errorf("upload failed: %s", result.Results[0].Message)
+		}
+		return status, "", fmt.Errorf("unexpected upload response")
+	}
+	return status, result.Results[0].ID, nil
+}
+
+// request sends a request with the API key to the instance
+func (s *SelfTester) request(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("User-Agent", "ImageFlow-SelfTest")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.client.Do(req)
+}
+
+// requestJSON sends a request and decodes its JSON answer, failing on error statuses
+func (s *SelfTester) requestJSON(ctx context.Context, method, path, contentType string, body []byte, out interface{}) (int, error) {
+	resp, err := s.request(ctx, method, path, contentType, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid response: %v", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// alert posts a self-test event to SELFTEST_WEBHOOK_URL
+func (s *SelfTester) alert(event string, run SelfTestRun) {
+	if s.webhookURL == "" {
+		return
+	}
+	hostname, _ := os.Hostname()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":    event,
+		"instance": hostname,
+		"url":      s.baseURL,
+		"run":      run,
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(s.ctx), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		logger.Warn("Failed to create self-test alert", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Warn("Failed to send self-test alert",
+			zap.String("event", event),
+			zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Warn("Self-test alert rejected",
+			zap.String("event", event),
+			zap.String("status", resp.Status))
+	}
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// ServeStatsFlusher periodically moves the serve counts recorded by RecordServe into the
+// metadata of the images. Serves are counted in small Redis hashes first, so serving an image
+// costs one cheap write instead of a metadata update.
+type ServeStatsFlusher struct {
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// ServeStats is the running flusher, nil without Redis
+var ServeStats *ServeStatsFlusher
+
+// servesPendingKey holds the serves of each image counted since the last flush
+func servesPendingKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "serves:pending"
+}
+
+// servesLastKey holds the Unix time each image was last served since the last flush
+func servesLastKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "serves:last"
+}
+
+// servesTopKey is the sorted set of images scored by their flushed serve counts
+func servesTopKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "serves:top"
+}
+
+// flushServesScript adds the pending serve counts to the metadata hashes and the top served
+// set, skipping images deleted since they were served, and clears them in one step
+var flushServesScript = redis.NewScript(`
+local counts = redis.call('HGETALL', KEYS[1])
+local flushed = 0
+for i = 1, #counts, 2 do
+	local id, n = counts[i], counts[i + 1]
+	local key = ARGV[1] .. id
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('HINCRBY', key, 'serves', n)
+		local last = redis.call('HGET', KEYS[2], id)
+		if last then
+			redis.call('HSET', key, 'lastServed', last)
+		end
+		redis.call('ZINCRBY', KEYS[3], n, id)
+		flushed = flushed + 1
+	end
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+return flushed
+`)
+
+// InitServeStats starts flushing serve counts into the metadata when Redis stores it
+func InitServeStats(cfg *config.Config) {
+	if !IsRedisMetadataStore() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ServeStats = &ServeStatsFlusher{
+		interval: time.Duration(cfg.ServeStatsFlushInterval) * time.Second,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	ServeStats.Start()
+}
+
+// RecordServe counts a serve of an image. It is a no-op without Redis.
+func RecordServe(ctx context.Context, id string) {
+	if !IsRedisMetadataStore() {
+		return
+	}
+	pipe := RedisClient.Pipeline()
+	pipe.HIncrBy(ctx, servesPendingKey(ctx), id, 1)
+	pipe.HSet(ctx, servesLastKey(ctx), id, time.Now().Unix())
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Debug("Failed to record serve",
+			zap.String("id", id),
+			zap.Error(err))
+	}
+}
+
+// Start flushes the serve counts of every namespace each interval until Stop is called
+func (f *ServeStatsFlusher) Start() {
+	go func() {
+		for {
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-time.After(f.interval):
+			}
+			for _, ctx := range TenantContexts(f.ctx) {
+				if err := flushServes(ctx); err != nil && f.ctx.Err() == nil {
+					logger.Warn("Failed to flush serve counts",
+						zap.String("prefix", KeyPrefix(ctx)),
+						zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Stop terminates the flusher; pending counts are flushed on next start
+func (f *ServeStatsFlusher) Stop() {
+	f.cancel()
+}
+
+func flushServes(ctx context.Context) error {
+	keys := []string{servesPendingKey(ctx), servesLastKey(ctx), servesTopKey(ctx)}
+	flushed, err := flushServesScript.Run(ctx, RedisClient, keys, KeyPrefix(ctx)+"metadata:").Int()
+	if err != nil {
+		return err
+	}
+	if flushed > 0 {
+		logger.Debug("Flushed serve counts", zap.Int("images", flushed))
+	}
+	return nil
+}
+
+// ServedImage is an image with its flushed serve count
+type ServedImage struct {
+	ID     string
+	Serves int64
+}
+
+// TopServedImages returns the most served images, most served first
+func TopServedImages(ctx context.Context, limit int) ([]ServedImage, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis is not enabled")
+	}
+	top, err := RedisClient.ZRevRangeWithScores(ctx, servesTopKey(ctx), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read top served images: %v", err)
+	}
+	images := make([]ServedImage, 0, len(top))
+	for _, z := range top {
+		if id, ok := z.Member.(string); ok {
+			images = append(images, ServedImage{ID: id, Serves: int64(z.Score)})
+		}
+	}
+	return images, nil
+}
+
+// DeleteServeStats removes an image from the serve statistics
+func DeleteServeStats(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+	pipe := RedisClient.Pipeline()
+	pipe.ZRem(ctx, servesTopKey(ctx), id)
+	pipe.HDel(ctx, servesPendingKey(ctx), id)
+	pipe.HDel(ctx, servesLastKey(ctx), id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ParseServeFields reads the serve count and last serve time of a metadata hash
+func ParseServeFields(data map[string]string) (int64, *time.Time) {
+	serves, _ := strconv.ParseInt(data["serves"], 10, 64)
+	unix, err := strconv.ParseInt(data["lastServed"], 10, 64)
+	if err != nil || unix == 0 {
+		return serves, nil
+	}
+	lastServed := time.Unix(unix, 0).UTC()
+	return serves, &lastServed
+}
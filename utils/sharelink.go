@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	shortCodeAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	shortCodeLength   = 7
+)
+
+// ShareLink represents a short link pointing to an image
+type ShareLink struct {
+	Code      string    `json:"code"`                // Short code used in /s/{code}
+	ImageID   string    `json:"imageId"`             // ID of the shared image
+	Format    string    `json:"format"`              // Format served by the link: original, webp or avif
+	CreatedAt time.Time `json:"createdAt"`           // Creation timestamp
+	ExpiresAt time.Time `json:"expiresAt,omitempty"` // Expiry timestamp (zero if the link never expires)
+	Clicks    int64     `json:"clicks"`              // Number of times the link was opened
+	LastClick time.Time `json:"lastClick,omitempty"` // Timestamp of the last click
+}
+
+// Expired reports whether the share link has expired
+func (l *ShareLink) Expired() bool {
+	return !l.ExpiresAt.IsZero() && time.Now().After(l.ExpiresAt)
+}
+
+func shareLinkKey(ctx context.Context, code string) string {
+	return KeyPrefix(ctx) + "share:" + code
+}
+
+func imageShareLinksKey(ctx context.Context, imageID string) string {
+	return KeyPrefix(ctx) + "shares:" + imageID
+}
+
+// generateShortCode returns a random short code using an alphabet without ambiguous characters
+func generateShortCode() (string, error) {
+	code := make([]byte, shortCodeLength)
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// CreateShareLink creates a short link for an image. A ttl of zero creates a link that never expires.
+func CreateShareLink(ctx context.Context, imageID, format string, ttl time.Duration) (*ShareLink, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	link := &ShareLink{
+		ImageID:   imageID,
+		Format:    format,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		link.ExpiresAt = link.CreatedAt.Add(ttl)
+	}
+
+	// Retry a few times in the unlikely case of a code collision
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := generateShortCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate short code: %v", err)
+		}
+
+		fields := map[string]interface{}{
+			"imageId":   imageID,
+			"format":    format,
+			"createdAt": link.CreatedAt.Format(time.RFC3339),
+			"clicks":    0,
+		}
+		if !link.ExpiresAt.IsZero() {
+			fields["expiresAt"] = link.ExpiresAt.Format(time.RFC3339)
+		}
+
+		created, err := RedisClient.HSetNX(ctx, shareLinkKey(ctx, code), "imageId", imageID).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create share link: %v", err)
+		}
+		if !created {
+			continue
+		}
+
+		pipe := RedisClient.Pipeline()
+		pipe.HSet(ctx, shareLinkKey(ctx, code), fields)
+		if ttl > 0 {
+			pipe.Expire(ctx, shareLinkKey(ctx, code), ttl)
+		}
+		pipe.SAdd(ctx, imageShareLinksKey(ctx, imageID), code)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to save share link: %v", err)
+		}
+
+		link.Code = code
+		logger.Debug("Share link created",
+			zap.String("code", code),
+			zap.String("image_id", imageID),
+			zap.Duration("ttl", ttl))
+		return link, nil
+	}
+
+	return nil, fmt.Errorf("failed to allocate a unique short code")
+}
+
+// GetShareLink retrieves a share link by its code
+func GetShareLink(ctx context.Context, code string) (*ShareLink, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	data, err := RedisClient.HGetAll(ctx, shareLinkKey(ctx, code)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share link: %v", err)
+	}
+	if len(data) == 0 || data["imageId"] == "" {
+		return nil, fmt.Errorf("share link not found: %s", code)
+	}
+
+	link := &ShareLink{
+		Code:    code,
+		ImageID: data["imageId"],
+		Format:  data["format"],
+	}
+	link.CreatedAt, _ = time.Parse(time.RFC3339, data["createdAt"])
+	if expiresAt := data["expiresAt"]; expiresAt != "" {
+		link.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	}
+	if lastClick := data["lastClick"]; lastClick != "" {
+		link.LastClick, _ = time.Parse(time.RFC3339, lastClick)
+	}
+	link.Clicks, _ = strconv.ParseInt(data["clicks"], 10, 64)
+
+	return link, nil
+}
+
+// RecordShareLinkClick increments the click counter of a share link
+func RecordShareLinkClick(ctx context.Context, code string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	pipe := RedisClient.Pipeline()
+	pipe.HIncrBy(ctx, shareLinkKey(ctx, code), "clicks", 1)
+	pipe.HSet(ctx, shareLinkKey(ctx, code), "lastClick", time.Now().Format(time.RFC3339))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ListShareLinks returns all live share links of an image, newest first
+func ListShareLinks(ctx context.Context, imageID string) ([]*ShareLink, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	codes, err := RedisClient.SMembers(ctx, imageShareLinksKey(ctx, imageID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to list share links: %v", err)
+	}
+
+	links := make([]*ShareLink, 0, len(codes))
+	for _, code := range codes {
+		link, err := GetShareLink(ctx, code)
+		if err != nil {
+			// Expired links are removed by Redis, drop them from the index as well
+			RedisClient.SRem(ctx, imageShareLinksKey(ctx, imageID), code)
+			continue
+		}
+		links = append(links, link)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links, nil
+}
+
+// DeleteShareLink removes a single share link
+func DeleteShareLink(ctx context.Context, code string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	link, err := GetShareLink(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	pipe := RedisClient.Pipeline()
+	pipe.Del(ctx, shareLinkKey(ctx, code))
+	pipe.SRem(ctx, imageShareLinksKey(ctx, link.ImageID), code)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeleteImageShareLinks removes all share links of an image
+func DeleteImageShareLinks(ctx context.Context, imageID string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	codes, err := RedisClient.SMembers(ctx, imageShareLinksKey(ctx, imageID)).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to list share links: %v", err)
+	}
+
+	pipe := RedisClient.Pipeline()
+	for _, code := range codes {
+		pipe.Del(ctx, shareLinkKey(ctx, code))
+	}
+	pipe.Del(ctx, imageShareLinksKey(ctx, imageID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
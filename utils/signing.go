@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// ObjectAccessController is implemented by storage providers controlling public read access
+// per object, like S3 through object ACLs
+type ObjectAccessController interface {
+	SetObjectAccess(ctx context.Context, key string, private bool) error
+}
+
+// ObjectPresigner is implemented by storage providers that can issue time-limited URLs for
+// objects that are not publicly readable
+type ObjectPresigner interface {
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+type privateObjectsKey struct{}
+
+// WithPrivateObjects marks a context as storing the objects of a private image, which storage
+// providers then keep from public read access
+func WithPrivateObjects(ctx context.Context) context.Context {
+	return context.WithValue(ctx, privateObjectsKey{}, true)
+}
+
+// PrivateObjects reports whether objects stored with the context belong to a private image
+func PrivateObjects(ctx context.Context) bool {
+	private, _ := ctx.Value(privateObjectsKey{}).(bool)
+	return private
+}
+
+// ObjectAccessContext returns the context for storing objects of an image: marked private when
+// the image is private
+func ObjectAccessContext(ctx context.Context, metadata *ImageMetadata) context.Context {
+	if metadata != nil && !metadata.IsViewable() {
+		return WithPrivateObjects(ctx)
+	}
+	return ctx
+}
+
+// ApplyObjectAccess updates the public read access of an image's stored objects to its
+// visibility. Storage without per-object access control is left as is.
+func ApplyObjectAccess(ctx context.Context, metadata *ImageMetadata) error {
+	controller, ok := StorageBackend().(ObjectAccessController)
+	if !ok {
+		return nil
+	}
+	private := !metadata.IsViewable()
+	for _, key := range metadata.ObjectKeys() {
+		if err := controller.SetObjectAccess(ctx, key, private); err != nil {
+			return fmt.Errorf("failed to update access of %s: %v", key, err)
+		}
+	}
+	logger.Info("Updated object access",
+		zap.String("id", metadata.ID),
+		zap.Bool("private", private))
+	return nil
+}
+
+// PresignObjectURL returns a time-limited URL for a stored object, when the storage provider
+// supports presigned URLs
+func PresignObjectURL(ctx context.Context, key string, ttl time.Duration) (string, bool, error) {
+	presigner, ok := StorageBackend().(ObjectPresigner)
+	if !ok {
+		return "", false, nil
+	}
+	url, err := presigner.PresignGet(ctx, key, ttl)
+	return url, true, err
+}
+
+// signingKey returns the secret signing image URLs, the API key unless set separately
+func signingKey(cfg *config.Config) []byte {
+	if cfg.SigningSecret != "" {
+		return []byte(cfg.SigningSecret)
+	}
+	return []byte(cfg.APIKey)
+}
+
+func imageSignature(cfg *config.Config, key string, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey(cfg))
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignImageKey returns the expires and signature query parameters granting access to the
+// image served under /images/<key> until expires
+func SignImageKey(cfg *config.Config, key string, expires time.Time) (string, string) {
+	unix := expires.Unix()
+	return strconv.FormatInt(unix, 10), imageSignature(cfg, key, unix)
+}
+
+// VerifyImageSignature reports whether the expires and signature query parameters grant
+// access to the image served under /images/<key>, returning when the access ends
+func VerifyImageSignature(cfg *config.Config, key, expires, signature string) (time.Time, bool) {
+	if expires == "" || signature == "" || len(signingKey(cfg)) == 0 {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return time.Time{}, false
+	}
+	if !hmac.Equal([]byte(signature), []byte(imageSignature(cfg, key, unix))) {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
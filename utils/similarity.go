@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// SimilarImage is a library image close to a searched sample
+type SimilarImage struct {
+	ID       string `json:"id"`
+	Distance int    `json:"distance"` // Hamming distance between perceptual hashes (0 = identical)
+}
+
+// maxSamplesPerCell bounds the pixels read per hash cell so large images hash quickly
+const maxSamplesPerCell = 16
+
+func perceptualHashIndexKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "phash"
+}
+
+// PerceptualHash computes a 64-bit difference hash (dHash) of an encoded image. Visually
+// similar images, including re-encoded or resized copies, produce hashes with a small
+// Hamming distance.
+func PerceptualHash(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	// Downscale to a 9x8 grayscale grid and compare horizontally adjacent cells
+	const w, h = 9, 8
+	var grid [h][w]float64
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			grid[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grid[y][x] < grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// averageLuma returns the mean luminance of a rectangle, sampling at most
+// maxSamplesPerCell pixels along each axis
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	stepX := max(1, (x1-x0)/maxSamplesPerCell)
+	stepY := max(1, (y1-y0)/maxSamplesPerCell)
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+// HashDistance returns the Hamming distance between two perceptual hashes
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatPerceptualHash encodes a hash the way it is stored in metadata
+func FormatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParsePerceptualHash decodes a hash stored in metadata
+func ParsePerceptualHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// IndexPerceptualHash stores the perceptual hash of an image in the search index
+func IndexPerceptualHash(ctx context.Context, id, hash string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HSet(ctx, perceptualHashIndexKey(ctx), id, hash).Err()
+}
+
+// RemovePerceptualHash removes an image from the search index
+func RemovePerceptualHash(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HDel(ctx, perceptualHashIndexKey(ctx), id).Err()
+}
+
+// FindSimilarImages returns indexed images whose hash is within maxDistance of the given
+// hash, closest first
+func FindSimilarImages(ctx context.Context, hash uint64, maxDistance, limit int) ([]SimilarImage, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	hashes, err := RedisClient.HGetAll(ctx, perceptualHashIndexKey(ctx)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash index: %v", err)
+	}
+
+	matches := make([]SimilarImage, 0)
+	for id, value := range hashes {
+		h, err := ParsePerceptualHash(value)
+		if err != nil {
+			continue
+		}
+		if d := HashDistance(hash, h); d <= maxDistance {
+			matches = append(matches, SimilarImage{ID: id, Distance: d})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// BackfillPerceptualHashes hashes images uploaded before reverse image search existed.
+// Images already in the index are skipped, so it is cheap to run on every start.
+func BackfillPerceptualHashes(ctx context.Context) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+
+	ids, err := GetAllImageIDs(ctx)
+	if err != nil {
+		return err
+	}
+	indexed, err := RedisClient.HKeys(ctx, perceptualHashIndexKey(ctx)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read hash index: %v", err)
+	}
+	seen := make(map[string]bool, len(indexed))
+	for _, id := range indexed {
+		seen[id] = true
+	}
+
+	hashed := 0
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		metadata, err := MetadataManager.GetMetadata(ctx, id)
+		if err != nil {
+			continue
+		}
+		key, err := ResolveImageKey(ctx, metadata.Paths.Original)
+		if err != nil {
+			continue
+		}
+		data, err := Storage.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+		hash, err := PerceptualHash(data)
+		if err != nil {
+			logger.Debug("Skipping image that cannot be hashed",
+				zap.String("id", id),
+				zap.Error(err))
+			continue
+		}
+
+		value := FormatPerceptualHash(hash)
+		if err := RedisClient.HSet(ctx, KeyPrefix(ctx)+"metadata:"+id, "phash", value).Err(); err != nil {
+			return fmt.Errorf("failed to store hash of %s: %v", id, err)
+		}
+		if err := IndexPerceptualHash(ctx, id, value); err != nil {
+			return fmt.Errorf("failed to index %s: %v", id, err)
+		}
+		hashed++
+	}
+
+	if hashed > 0 {
+		logger.Info("Backfilled perceptual hashes", zap.Int("images", hashed))
+	}
+	return nil
+}
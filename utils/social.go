@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Comment represents a comment left on an image
+type Comment struct {
+	ID        string    `json:"id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func likesKey(ctx context.Context, imageID string) string {
+	return KeyPrefix(ctx) + "likes:" + imageID
+}
+
+func commentsKey(ctx context.Context, imageID string) string {
+	return KeyPrefix(ctx) + "comments:" + imageID
+}
+
+// LikeImage records a like from the given client. It returns the new like count and
+// whether the like was newly added (a client can only like an image once).
+func LikeImage(ctx context.Context, imageID, client string) (int64, bool, error) {
+	if !IsRedisMetadataStore() {
+		return 0, false, fmt.Errorf("redis not enabled")
+	}
+
+	added, err := RedisClient.SAdd(ctx, likesKey(ctx, imageID), client).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to add like: %v", err)
+	}
+	if added == 0 {
+		count, err := GetLikeCount(ctx, imageID)
+		return count, false, err
+	}
+
+	return updateLikeCount(ctx, imageID, 1)
+}
+
+// UnlikeImage removes a like from the given client and returns the new like count
+func UnlikeImage(ctx context.Context, imageID, client string) (int64, bool, error) {
+	if !IsRedisMetadataStore() {
+		return 0, false, fmt.Errorf("redis not enabled")
+	}
+
+	removed, err := RedisClient.SRem(ctx, likesKey(ctx, imageID), client).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to remove like: %v", err)
+	}
+	if removed == 0 {
+		count, err := GetLikeCount(ctx, imageID)
+		return count, false, err
+	}
+
+	return updateLikeCount(ctx, imageID, -1)
+}
+
+// updateLikeCount keeps the like counter stored in the metadata hash in sync, so listings
+// can sort and filter by likes without extra lookups
+func updateLikeCount(ctx context.Context, imageID string, delta int64) (int64, bool, error) {
+	count, err := RedisClient.HIncrBy(ctx, KeyPrefix(ctx)+"metadata:"+imageID, "likes", delta).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to update like count: %v", err)
+	}
+
+	// Like counts change list ordering of the pages listing the image
+	metadata, _ := MetadataManager.GetMetadata(ctx, imageID)
+	if err := InvalidateImagePages(ctx, metadata); err != nil {
+		logger.Warn("Failed to clear page cache", zap.Error(err))
+	}
+	return count, true, nil
+}
+
+// GetLikeCount returns the number of likes of an image
+func GetLikeCount(ctx context.Context, imageID string) (int64, error) {
+	if !IsRedisMetadataStore() {
+		return 0, fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.SCard(ctx, likesKey(ctx, imageID)).Result()
+}
+
+// HasLiked reports whether the given client has liked an image
+func HasLiked(ctx context.Context, imageID, client string) (bool, error) {
+	if !IsRedisMetadataStore() {
+		return false, fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.SIsMember(ctx, likesKey(ctx, imageID), client).Result()
+}
+
+// AddComment appends a comment to an image
+func AddComment(ctx context.Context, imageID, author, text string) (*Comment, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate comment ID: %v", err)
+	}
+
+	comment := &Comment{
+		ID:        hex.EncodeToString(idBytes),
+		Author:    author,
+		Text:      text,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal comment: %v", err)
+	}
+
+	if err := RedisClient.RPush(ctx, commentsKey(ctx, imageID), data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to save comment: %v", err)
+	}
+	return comment, nil
+}
+
+// ListComments returns the comments of an image, oldest first
+func ListComments(ctx context.Context, imageID string) ([]Comment, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.LRange(ctx, commentsKey(ctx, imageID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list comments: %v", err)
+	}
+
+	comments := make([]Comment, 0, len(items))
+	for _, item := range items {
+		var comment Comment
+		if err := json.Unmarshal([]byte(item), &comment); err == nil {
+			comments = append(comments, comment)
+		}
+	}
+	return comments, nil
+}
+
+// DeleteComment removes a comment from an image
+func DeleteComment(ctx context.Context, imageID, commentID string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.LRange(ctx, commentsKey(ctx, imageID), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list comments: %v", err)
+	}
+
+	for _, item := range items {
+		var comment Comment
+		if err := json.Unmarshal([]byte(item), &comment); err != nil || comment.ID != commentID {
+			continue
+		}
+		return RedisClient.LRem(ctx, commentsKey(ctx, imageID), 1, item).Err()
+	}
+	return fmt.Errorf("comment not found: %s", commentID)
+}
+
+// DeleteImageSocialData removes likes and comments of an image
+func DeleteImageSocialData(ctx context.Context, imageID string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	return RedisClient.Del(ctx, likesKey(ctx, imageID), commentsKey(ctx, imageID)).Err()
+}
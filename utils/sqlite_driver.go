@@ -0,0 +1,5 @@
+package utils
+
+// The SQLite metadata store uses the pure Go driver, so the binary still builds without cgo
+// beyond libvips
+import _ "modernc.org/sqlite"
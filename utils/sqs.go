@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// SQSClient is a minimal SQS client for consuming bucket event notifications. It speaks the
+// SQS JSON protocol with SigV4 signing and reuses the S3 credentials.
+type SQSClient struct {
+	queueURL    string
+	endpoint    string
+	region      string
+	credentials aws.Credentials
+	signer      *v4.Signer
+	client      *http.Client
+}
+
+// SQSMessage is a message received from a queue
+type SQSMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// sqsPollWait is the long polling duration of a receive call
+const sqsPollWait = 20 * time.Second
+
+// NewSQSClient creates a client for the configured ingest queue
+func NewSQSClient(cfg *config.Config) (*SQSClient, error) {
+	u, err := url.Parse(cfg.IngestSQSQueueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL: %s", cfg.IngestSQSQueueURL)
+	}
+
+	// The region is part of the queue host (sqs.<region>.amazonaws.com)
+	region := cfg.S3Region
+	if parts := strings.Split(u.Host, "."); len(parts) > 2 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+
+	return &SQSClient{
+		queueURL: cfg.IngestSQSQueueURL,
+		endpoint: u.Scheme + "://" + u.Host + "/",
+		region:   region,
+		credentials: aws.Credentials{
+			AccessKeyID:     cfg.S3AccessKey,
+			SecretAccessKey: cfg.S3SecretKey,
+		},
+		signer: v4.NewSigner(),
+		client: &http.Client{Timeout: sqsPollWait + 10*time.Second},
+	}, nil
+}
+
+// ReceiveMessages long-polls the queue for up to 10 messages
+func (c *SQSClient) ReceiveMessages(ctx context.Context) ([]SQSMessage, error) {
+	var result struct {
+		Messages []SQSMessage `json:"Messages"`
+	}
+	err := c.call(ctx, "ReceiveMessage", map[string]interface{}{
+		"QueueUrl":            c.queueURL,
+		"MaxNumberOfMessages": 10,
+		"WaitTimeSeconds":     int(sqsPollWait / time.Second),
+	}, &result)
+	return result.Messages, err
+}
+
+// DeleteMessage removes a processed message from the queue
+func (c *SQSClient) DeleteMessage(ctx context.Context, receiptHandle string) error {
+	return c.call(ctx, "DeleteMessage", map[string]interface{}{
+		"QueueUrl":      c.queueURL,
+		"ReceiptHandle": receiptHandle,
+	}, nil)
+}
+
+func (c *SQSClient) call(ctx context.Context, action string, input interface{}, output interface{}) error {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request: %v", action, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %v", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+
+	hash := sha256.Sum256(payload)
+	if err := c.signer.SignHTTP(ctx, c.credentials, req, hex.EncodeToString(hash[:]), "sqs", c.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign %s request: %v", action, err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", action, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if output == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
+	"github.com/h2non/bimg"
+	"go.uber.org/zap"
+)
+
+// startupProbeKey is the object the storage latency probe checks for; it does not need to exist
+const startupProbeKey = ".startup-probe"
+
+// StartupStorage describes the storage backend and how fast it answered at startup
+type StartupStorage struct {
+	Type      string  `json:"type"`            // local, s3 or azure
+	Location  string  `json:"location"`        // Directory, bucket or container
+	KeyLayout string  `json:"keyLayout"`       // flat or sharded
+	LatencyMs float64 `json:"latencyMs"`       // Duration of an existence check
+	Error     string  `json:"error,omitempty"` // Why the probe failed
+}
+
+// StartupRedis describes the Redis connection and how fast it answered at startup
+type StartupRedis struct {
+	Mode      string  `json:"mode"` // standalone, or disabled when Redis is not used
+	Addr      string  `json:"addr,omitempty"`
+	DB        int     `json:"db"`
+	TLS       bool    `json:"tls"`
+	Prefix    string  `json:"prefix,omitempty"`
+	LatencyMs float64 `json:"latencyMs,omitempty"` // Duration of a PING
+	Error     string  `json:"error,omitempty"`
+}
+
+// StartupMetadata describes the metadata store in use, which falls back to files when Redis
+// is configured but unreachable
+type StartupMetadata struct {
+	Store    string `json:"store"`              // redis, sqlite, s3 or local
+	Encoding string `json:"encoding,omitempty"` // Layout of the Redis hashes
+}
+
+// StartupLibvips describes the image library and the formats it can read and write
+type StartupLibvips struct {
+	Version string   `json:"version"`
+	Bimg    string   `json:"bimg"`
+	Threads int      `json:"threads"`
+	Load    []string `json:"load"` // Formats libvips can decode
+	Save    []string `json:"save"` // Formats libvips can encode
+}
+
+// StartupWorkers describes the concurrency of image processing
+type StartupWorkers struct {
+	PoolSize             int `json:"poolSize"`             // Conversions run at once by the worker pool
+	QueueSize            int `json:"queueSize"`            // Tasks waiting for a worker before callers block
+	ConversionWorkers    int `json:"conversionWorkers"`    // Jobs of the conversion queue run at once, 0 without Redis
+	MaxConcurrentUploads int `json:"maxConcurrentUploads"` // Uploaded files processed at once, 0 for no limit
+	UploadQueueSize      int `json:"uploadQueueSize"`      // Uploaded files queued before uploads are rejected
+}
+
+// StartupReport summarizes the dependencies and features an instance started with. It is logged
+// once at startup and kept for /api/debug/startup, so support requests can include it.
+type StartupReport struct {
+	Time        time.Time             `json:"time"`
+	Hostname    string                `json:"hostname"`
+	GoVersion   string                `json:"goVersion"`
+	ReadReplica bool                  `json:"readReplica"`
+	Storage     StartupStorage        `json:"storage"`
+	Redis       StartupRedis          `json:"redis"`
+	Metadata    StartupMetadata       `json:"metadata"`
+	Libvips     StartupLibvips        `json:"libvips"`
+	Outputs     []config.OutputFormat `json:"outputFormats"` // Derived formats generated for uploads
+	Workers     StartupWorkers        `json:"workers"`
+	Features    []string              `json:"features"` // Enabled optional subsystems and feature flags
+}
+
+// Startup is the report of this instance, nil until ReportStartup ran
+var Startup *StartupReport
+
+// startupFormats are the formats whose support is reported, by name
+var startupFormats = []struct {
+	name      string
+	imageType bimg.ImageType
+}{
+	{"jpeg", bimg.JPEG},
+	{"png", bimg.PNG},
+	{"gif", bimg.GIF},
+	{"webp", bimg.WEBP},
+	{"avif", bimg.AVIF},
+	{"heif", bimg.HEIF},
+	{"svg", bimg.SVG},
+	{"tiff", bimg.TIFF},
+}
+
+// ReportStartup probes the storage backend and Redis, logs the summary of the instance and
+// keeps it in Startup. It runs once every subsystem has been initialized.
+func ReportStartup(ctx context.Context, cfg *config.Config) *StartupReport {
+	report := &StartupReport{
+		Time:        time.Now().UTC(),
+		GoVersion:   runtime.Version(),
+		ReadReplica: cfg.ReadReplica,
+		Storage:     probeStorage(ctx, cfg),
+		Redis:       probeRedis(ctx, cfg),
+		Metadata:    startupMetadata(cfg),
+		Libvips: StartupLibvips{
+			Version: bimg.VipsVersion,
+			Bimg:    bimg.Version,
+			Threads: cfg.WorkerThreads,
+			Load:    []string{},
+			Save:    []string{},
+		},
+		Outputs: cfg.OutputFormats,
+		Workers: StartupWorkers{
+			PoolSize:             cfg.WorkerPoolSize,
+			QueueSize:            cfg.WorkerPoolSize * 2,
+			MaxConcurrentUploads: cfg.MaxConcurrentUploads,
+			UploadQueueSize:      cfg.UploadQueueSize,
+		},
+		Features: startupFeatures(ctx, cfg),
+	}
+	report.Hostname, _ = os.Hostname()
+	for _, format := range startupFormats {
+		if bimg.IsTypeSupported(format.imageType) {
+			report.Libvips.Load = append(report.Libvips.Load, format.name)
+		}
+		if bimg.IsTypeSupportedSave(format.imageType) {
+			report.Libvips.Save = append(report.Libvips.Save, format.name)
+		}
+	}
+	if Conversions != nil {
+		report.Workers.ConversionWorkers = Conversions.workers
+	}
+
+	logger.Info("ImageFlow started",
+		zap.String("hostname", report.Hostname),
+		zap.Bool("read_replica", report.ReadReplica),
+		zap.Any("storage", report.Storage),
+		zap.Any("redis", report.Redis),
+		zap.Any("metadata", report.Metadata),
+		zap.Any("libvips", report.Libvips),
+		zap.Any("output_formats", report.Outputs),
+		zap.Any("workers", report.Workers),
+		zap.Strings("features", report.Features))
+
+	Startup = report
+	return report
+}
+
+// probeStorage times an existence check against the storage backend
+func probeStorage(ctx context.Context, cfg *config.Config) StartupStorage {
+	storage := StartupStorage{
+		Type:      string(cfg.StorageType),
+		KeyLayout: string(cfg.KeyLayout),
+	}
+	switch cfg.StorageType {
+	case config.StorageTypeS3:
+		storage.Location = cfg.S3Bucket
+	case config.StorageTypeAzure:
+		storage.Location = cfg.AzureAccount + "/" + cfg.AzureContainer
+	default:
+		storage.Location = cfg.ImageBasePath
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := Storage.Exists(ctx, startupProbeKey)
+	storage.LatencyMs = milliseconds(time.Since(start))
+	if err != nil {
+		storage.Error = err.Error()
+	}
+	return storage
+}
+
+// probeRedis times a PING of the Redis server
+func probeRedis(ctx context.Context, cfg *config.Config) StartupRedis {
+	if cfg.MetadataStoreType != config.MetadataStoreTypeRedis {
+		return StartupRedis{Mode: "disabled"}
+	}
+	redisInfo := StartupRedis{
+		Mode:   "standalone",
+		Addr:   cfg.RedisHost + ":" + cfg.RedisPort,
+		DB:     cfg.RedisDB,
+		TLS:    cfg.RedisTLS,
+		Prefix: cfg.RedisPrefix,
+	}
+	if RedisClient == nil {
+		redisInfo.Error = "not connected, metadata falls back to files"
+		return redisInfo
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := RedisClient.Ping(ctx).Err()
+	redisInfo.LatencyMs = milliseconds(time.Since(start))
+	if err != nil {
+		redisInfo.Error = err.Error()
+	}
+	return redisInfo
+}
+
+// startupMetadata names the metadata store in use
+func startupMetadata(cfg *config.Config) StartupMetadata {
+	switch MetadataManager.(type) {
+	case *RedisMetadataStore:
+		return StartupMetadata{Store: "redis", Encoding: string(cfg.MetadataEncoding)}
+	case *SQLiteMetadataStore:
+		return StartupMetadata{Store: "sqlite"}
+	case *S3MetadataStore:
+		return StartupMetadata{Store: "s3"}
+	default:
+		return StartupMetadata{Store: "local"}
+	}
+}
+
+// startupFeatures lists the optional subsystems running on this instance and the enabled
+// feature flags
+func startupFeatures(ctx context.Context, cfg *config.Config) []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"avif", cfg.AvifSupport},
+		{"tls", cfg.TLSEnabled()},
+		{"tracing", tracing.Enabled()},
+		{"video", videoEnabled},
+		{"svg", cfg.SVGSupport},
+		{"strip_exif", cfg.StripEXIF},
+		{"watermark", cfg.WatermarkText != "" || cfg.WatermarkImage != ""},
+		{"public_gallery", cfg.PublicGalleryEnabled},
+		{"public_stats", cfg.PublicStatsEnabled},
+		{"comments", cfg.CommentsEnabled},
+		{"embeddings", Embedder != nil},
+		{"ocr_engine", OCR != nil},
+		{"search_index", SearchIndexing != nil},
+		{"replication", Replication != nil},
+		{"conversion_queue", Conversions != nil},
+		{"serve_stats", ServeStats != nil},
+		{"ingest", cfg.IngestEnabled()},
+		{"sync", cfg.SyncSourcesFile != ""},
+		{"selftest", SelfTest != nil},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	for _, state := range FeatureFlagStates(ctx) {
+		if state.Enabled {
+			features = append(features, state.Name)
+		}
+	}
+	return features
+}
+
+// milliseconds converts a duration to fractional milliseconds, as probes are often sub-millisecond
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// statsVariants are the converted formats whose savings over the originals are reported
+var statsVariants = []string{"webp", "avif"}
+
+// LibraryStats summarizes a tenant's library
+type LibraryStats struct {
+	Images         int64                        `json:"images"`
+	StorageBytes   int64                        `json:"storageBytes"`   // Bytes of every stored object
+	BytesByFormat  map[string]int64             `json:"bytesByFormat"`  // Stored bytes of the originals, each variant, video clips and thumbnails
+	ImagesByFormat map[string]int64             `json:"imagesByFormat"` // Images by format of the original
+	Orientations   map[string]int64             `json:"orientations"`   // Images by orientation
+	Tags           map[string]int64             `json:"tags"`           // Images by tag
+	Savings        map[string]ConversionSavings `json:"savings"`        // Savings of each converted format
+	UploadsPerDay  []DailyUploads               `json:"uploadsPerDay"`  // Oldest first
+}
+
+// ConversionSavings compares the size of a converted format with the originals it was
+// generated from
+type ConversionSavings struct {
+	Images         int64   `json:"images"`         // Images having the format
+	OriginalBytes  int64   `json:"originalBytes"`  // Bytes of their originals
+	ConvertedBytes int64   `json:"convertedBytes"` // Bytes of their converted files
+	Ratio          float64 `json:"ratio"`          // Share of the original bytes saved, 1 - converted/original
+}
+
+// DailyUploads is the number of images uploaded on a day (UTC)
+type DailyUploads struct {
+	Date    string `json:"date"` // YYYY-MM-DD
+	Uploads int64  `json:"uploads"`
+}
+
+// statsKey is the hash of a tenant's counters, maintained incrementally by SaveMetadata and
+// DeleteMetadata so reading the statistics never scans the library
+func statsKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "stats"
+}
+
+// statsUploadsKey is the hash of a tenant's upload counts by day
+func statsUploadsKey(ctx context.Context) string {
+	return KeyPrefix(ctx) + "stats:uploads"
+}
+
+// statsCounters returns the counters an image contributes to the statistics
+func statsCounters(metadata *ImageMetadata) map[string]int64 {
+	counters := map[string]int64{
+		"images":                              1,
+		"format:" + metadata.Format:           1,
+		"orientation:" + metadata.Orientation: 1,
+		"bytes:original":                      metadata.Sizes["original"],
+	}
+	for _, tag := range metadata.Tags {
+		counters["tag:"+tag]++
+	}
+	for _, variant := range statsVariants {
+		if !metadata.HasVariant(variant) {
+			continue
+		}
+		counters["bytes:"+variant] += metadata.Sizes[variant]
+		counters["savings:"+variant+":images"]++
+		counters["savings:"+variant+":original"] += metadata.Sizes["original"]
+		counters["savings:"+variant+":converted"] += metadata.Sizes[variant]
+	}
+	if metadata.Paths.Video != "" {
+		counters["bytes:video"] += metadata.Sizes["video"]
+	}
+	for size := range metadata.Paths.Thumbnails {
+		counters["bytes:thumbnails"] += metadata.Sizes[ThumbnailSizeKey(size)]
+	}
+	return counters
+}
+
+// updateStats queues the counter changes of an image going from previous to current through
+// pipe; either may be nil for a new or deleted image. A new image counts as an upload.
+func updateStats(ctx context.Context, pipe redis.Pipeliner, previous, current *ImageMetadata) {
+	deltas := make(map[string]int64)
+	if previous != nil {
+		for field, n := range statsCounters(previous) {
+			deltas[field] -= n
+		}
+	}
+	if current != nil {
+		for field, n := range statsCounters(current) {
+			deltas[field] += n
+		}
+	}
+	for field, delta := range deltas {
+		if delta != 0 {
+			pipe.HIncrBy(ctx, statsKey(ctx), field, delta)
+		}
+	}
+	if previous == nil && current != nil {
+		pipe.HIncrBy(ctx, statsUploadsKey(ctx), current.UploadTime.UTC().Format(time.DateOnly), 1)
+	}
+}
+
+// GetLibraryStats returns the statistics of the tenant, with the uploads of the given number of
+// days up to today
+func GetLibraryStats(ctx context.Context, days int) (*LibraryStats, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis is not enabled")
+	}
+
+	today := time.Now().UTC()
+	dates := make([]string, days)
+	for i := range dates {
+		dates[i] = today.AddDate(0, 0, i-days+1).Format(time.DateOnly)
+	}
+
+	pipe := RedisClient.Pipeline()
+	countersCmd := pipe.HGetAll(ctx, statsKey(ctx))
+	uploadsCmd := pipe.HMGet(ctx, statsUploadsKey(ctx), dates...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read statistics: %v", err)
+	}
+
+	stats := &LibraryStats{
+		BytesByFormat:  make(map[string]int64),
+		ImagesByFormat: make(map[string]int64),
+		Orientations:   make(map[string]int64),
+		Tags:           make(map[string]int64),
+		Savings:        make(map[string]ConversionSavings),
+		UploadsPerDay:  make([]DailyUploads, days),
+	}
+	for field, value := range countersCmd.Val() {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		if n == 0 {
+			continue
+		}
+		kind, name, _ := strings.Cut(field, ":")
+		switch kind {
+		case "images":
+			stats.Images = n
+		case "bytes":
+			stats.BytesByFormat[name] = n
+			stats.StorageBytes += n
+		case "format":
+			stats.ImagesByFormat[name] = n
+		case "orientation":
+			stats.Orientations[name] = n
+		case "tag":
+			stats.Tags[name] = n
+		}
+	}
+	for _, variant := range statsVariants {
+		counter := func(name string) int64 {
+			n, _ := strconv.ParseInt(countersCmd.Val()["savings:"+variant+":"+name], 10, 64)
+			return n
+		}
+		savings := ConversionSavings{
+			Images:         counter("images"),
+			OriginalBytes:  counter("original"),
+			ConvertedBytes: counter("converted"),
+		}
+		if savings.OriginalBytes > 0 {
+			savings.Ratio = 1 - float64(savings.ConvertedBytes)/float64(savings.OriginalBytes)
+		}
+		stats.Savings[variant] = savings
+	}
+	for i, date := range dates {
+		stats.UploadsPerDay[i].Date = date
+		if value, ok := uploadsCmd.Val()[i].(string); ok {
+			stats.UploadsPerDay[i].Uploads, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return stats, nil
+}
+
+// RebuildStats recomputes the statistics of the tenant from the metadata of every image, for
+// libraries that predate them or counters that drifted
+func RebuildStats(ctx context.Context) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis is not enabled")
+	}
+
+	images, err := MetadataManager.GetAllMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %v", err)
+	}
+	counters := make(map[string]interface{})
+	uploads := make(map[string]interface{})
+	for _, metadata := range images {
+		for field, n := range statsCounters(metadata) {
+			current, _ := counters[field].(int64)
+			counters[field] = current + n
+		}
+		date := metadata.UploadTime.UTC().Format(time.DateOnly)
+		current, _ := uploads[date].(int64)
+		uploads[date] = current + 1
+	}
+
+	pipe := RedisClient.TxPipeline()
+	pipe.Del(ctx, statsKey(ctx), statsUploadsKey(ctx))
+	if len(counters) > 0 {
+		pipe.HSet(ctx, statsKey(ctx), counters)
+		pipe.HSet(ctx, statsUploadsKey(ctx), uploads)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to save statistics: %v", err)
+	}
+
+	logger.Info("Rebuilt library statistics",
+		zap.String("prefix", KeyPrefix(ctx)),
+		zap.Int("images", len(images)))
+	return nil
+}
+
+// BackfillStats builds the statistics of every namespace that has none yet
+func BackfillStats(ctx context.Context) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+	for _, ctx := range TenantContexts(ctx) {
+		exists, err := RedisClient.Exists(ctx, statsKey(ctx)).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			if err := RebuildStats(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,14 +3,17 @@ package utils
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -28,8 +31,24 @@ type StorageProvider interface {
 	Store(ctx context.Context, key string, data []byte) error
 	Get(ctx context.Context, key string) ([]byte, error)
 	Delete(ctx context.Context, key string) error
+	Exists(ctx context.Context, key string) (bool, error)
 }
 
+// StreamStorer is implemented by storage providers storing objects from a reader, so large
+// objects such as video clips are never held in memory as a whole
+type StreamStorer interface {
+	StoreStream(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+// ObjectLister is implemented by storage providers listing the keys of their objects by prefix
+type ObjectLister interface {
+	ListKeys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// s3PartSize is the size of the parts of objects streamed to S3, and the most of such an
+// object held in memory at once
+const s3PartSize = 8 << 20
+
 // LocalStorage implements StorageProvider for local filesystem
 type LocalStorage struct {
 	BasePath string
@@ -78,6 +97,41 @@ func (ls *LocalStorage) Store(ctx context.Context, key string, data []byte) erro
 	return nil
 }
 
+// StoreStream writes an object to a temporary file next to it and renames it into place, so
+// an interrupted copy never leaves a partial object
+func (ls *LocalStorage) StoreStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	fullPath := filepath.Join(ls.BasePath, key)
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	file, err := os.CreateTemp(dir, ".stream-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file in %s: %v", dir, err)
+	}
+	defer os.Remove(file.Name())
+	written, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %v", fullPath, err)
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", fullPath, err)
+	}
+	if err := os.Rename(file.Name(), fullPath); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", fullPath, err)
+	}
+
+	logger.Info("File stored locally",
+		zap.String("key", key),
+		zap.String("path", fullPath),
+		zap.Int64("size", written))
+	return nil
+}
+
 func (ls *LocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
 	return os.ReadFile(filepath.Join(ls.BasePath, key))
 }
@@ -86,6 +140,32 @@ func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
 	return os.Remove(filepath.Join(ls.BasePath, key))
 }
 
+// ListKeys returns the keys of the files whose path starts with prefix
+func (ls *LocalStorage) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(ls.BasePath, prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if key, err := filepath.Rel(ls.BasePath, match); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (ls *LocalStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(ls.BasePath, key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
 // S3Storage implements StorageProvider for S3-compatible storage
 type S3Storage struct {
 	client       *s3.Client
@@ -112,24 +192,16 @@ func (s *S3Storage) Store(ctx context.Context, key string, data []byte) error {
 		zap.String("key", key),
 		zap.Int("size", len(data)))
 
-	contentType := "application/octet-stream"
-	ext := strings.ToLower(filepath.Ext(key))
-	switch ext {
-	case ".jpg", ".jpeg":
-		contentType = "image/jpeg"
-	case ".webp":
-		contentType = "image/webp"
-	case ".avif":
-		contentType = "image/avif"
-	}
+	contentType := ImageMimeType(key)
+	acl, cacheControl := objectAccess(ctx)
 
 	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:       aws.String(s.bucket),
 		Key:          aws.String(key),
 		Body:         bytes.NewReader(data),
 		ContentType:  aws.String(contentType),
-		ACL:          types.ObjectCannedACLPublicRead,
-		CacheControl: aws.String("public, max-age=31536000"), // Cache for one year
+		ACL:          acl,
+		CacheControl: aws.String(cacheControl),
 	})
 	if err != nil {
 		logger.Error("Failed to store object in S3",
@@ -151,6 +223,96 @@ func (s *S3Storage) Store(ctx context.Context, key string, data []byte) error {
 	return nil
 }
 
+// objectAccess returns the ACL and Cache-Control of objects stored in a context. Objects of
+// private images are only reachable through presigned URLs.
+func objectAccess(ctx context.Context) (types.ObjectCannedACL, string) {
+	if PrivateObjects(ctx) {
+		return types.ObjectCannedACLPrivate, "private, max-age=31536000"
+	}
+	return types.ObjectCannedACLPublicRead, "public, max-age=31536000" // Cache for one year
+}
+
+// StoreStream uploads objects larger than a part as a multipart upload, holding one part in
+// memory at a time; smaller objects are stored with Store
+func (s *S3Storage) StoreStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size <= s3PartSize {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read object: %v", err)
+		}
+		return s.Store(ctx, key, data)
+	}
+
+	logger.Info("Streaming to S3",
+		zap.String("bucket", s.bucket),
+		zap.String("key", key),
+		zap.Int64("size", size))
+
+	acl, cacheControl := objectAccess(ctx)
+	upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ContentType:  aws.String(ImageMimeType(key)),
+		ACL:          acl,
+		CacheControl: aws.String(cacheControl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload to S3: %v", err)
+	}
+	abort := func(err error) error {
+		logger.Error("Failed to stream object to S3",
+			zap.String("bucket", s.bucket),
+			zap.String("key", key),
+			zap.Error(err))
+		s.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+
+	var parts []types.CompletedPart
+	buf := make([]byte, s3PartSize)
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return abort(fmt.Errorf("failed to read object: %v", err))
+		}
+		part, uploadErr := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if uploadErr != nil {
+			return abort(fmt.Errorf("failed to upload part %d to S3: %v", partNumber, uploadErr))
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(partNumber)})
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(fmt.Errorf("failed to complete multipart upload to S3: %v", err))
+	}
+	logger.Info("Successfully streamed object to S3",
+		zap.String("key", key),
+		zap.Int("parts", len(parts)))
+	return nil
+}
+
 func (s *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
 	logger.Debug("Getting object from S3",
 		zap.String("bucket", s.bucket),
@@ -206,6 +368,50 @@ func (s *S3Storage) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+func (s *S3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check object in S3: %v", err)
+	}
+	return true, nil
+}
+
+// SetObjectAccess switches an object between public-read and private
+func (s *S3Storage) SetObjectAccess(ctx context.Context, key string, private bool) error {
+	acl := types.ObjectCannedACLPublicRead
+	if private {
+		acl = types.ObjectCannedACLPrivate
+	}
+	_, err := s.client.PutObjectAcl(ctx, &s3.PutObjectAclInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		ACL:    acl,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set object ACL in S3: %v", err)
+	}
+	return nil
+}
+
+// PresignGet returns a presigned GET URL of an object, valid for ttl
+func (s *S3Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign object URL: %v", err)
+	}
+	return req.URL, nil
+}
+
 // ListObjects lists objects in S3 with the given prefix
 func (s *S3Storage) ListObjects(ctx context.Context, prefix string) ([]S3Object, error) {
 	logger.Debug("Listing objects in S3",
@@ -243,30 +449,113 @@ func (s *S3Storage) ListObjects(ctx context.Context, prefix string) ([]S3Object,
 	return objects, nil
 }
 
+// ListKeys returns the keys of the objects whose key starts with prefix
+func (s *S3Storage) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := s.ListObjects(ctx, filepath.ToSlash(prefix))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	return keys, nil
+}
+
 // StorageConfig represents the storage configuration
 type StorageConfig struct {
 	Type      string // "local" or "s3"
 	LocalPath string // base path for local storage
 }
 
-// NewStorageProvider creates a new storage provider based on configuration
-func NewStorageProvider(cfg *config.Config) (StorageProvider, error) {
-	switch cfg.StorageType {
-	case config.StorageTypeLocal:
+// StorageFactory creates a storage provider from the configuration
+type StorageFactory func(cfg *config.Config) (StorageProvider, error)
+
+// storageFactories holds the registered storage backends by storage type
+var storageFactories = map[config.StorageType]StorageFactory{}
+
+// RegisterStorageProvider makes a storage backend available under a storage type. Backends
+// register themselves from an init function in their own file.
+func RegisterStorageProvider(storageType config.StorageType, factory StorageFactory) {
+	if _, exists := storageFactories[storageType]; exists {
+		panic(fmt.Sprintf("storage provider already registered: %s", storageType))
+	}
+	storageFactories[storageType] = factory
+}
+
+func init() {
+	RegisterStorageProvider(config.StorageTypeLocal, func(cfg *config.Config) (StorageProvider, error) {
 		return NewLocalStorage(cfg.ImageBasePath)
-	case config.StorageTypeS3:
+	})
+	RegisterStorageProvider(config.StorageTypeS3, func(cfg *config.Config) (StorageProvider, error) {
 		return NewS3Storage(cfg)
-	default:
+	})
+}
+
+// NewStorageProvider creates a new storage provider based on configuration
+func NewStorageProvider(cfg *config.Config) (StorageProvider, error) {
+	factory, ok := storageFactories[cfg.StorageType]
+	if !ok {
 		return nil, fmt.Errorf("unsupported storage type: %s", cfg.StorageType)
 	}
+	return factory(cfg)
 }
 
 // Global storage instance
 var Storage StorageProvider
 
-// InitStorage initializes the global storage provider
+// InitStorage initializes the global storage provider, traced when tracing is enabled
 func InitStorage(cfg *config.Config) error {
 	var err error
 	Storage, err = NewStorageProvider(cfg)
+	if err == nil && tracing.Enabled() {
+		Storage = &tracedStorage{StorageProvider: Storage, storageType: string(cfg.StorageType)}
+	}
 	return err
 }
+
+// StoreStream stores an object of size bytes read from r, streamed when the storage provider
+// supports it and read into memory otherwise
+func StoreStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	return storeStream(ctx, Storage, key, r, size)
+}
+
+func storeStream(ctx context.Context, provider StorageProvider, key string, r io.Reader, size int64) error {
+	if streamer, ok := provider.(StreamStorer); ok {
+		return streamer.StoreStream(ctx, key, r, size)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read object: %v", err)
+	}
+	return provider.Store(ctx, key, data)
+}
+
+// StoreStreamVerified is StoreVerified for an object read from r
+func StoreStreamVerified(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := StoreStream(ctx, key, r, size); err != nil {
+		return err
+	}
+	return verifyStored(ctx, key)
+}
+
+// StoreVerified stores an object and checks that storage reports it afterwards, so nothing is
+// recorded in metadata for an object a provider failed to write without an error
+func StoreVerified(ctx context.Context, key string, data []byte) error {
+	if err := Storage.Store(ctx, key, data); err != nil {
+		return err
+	}
+	return verifyStored(ctx, key)
+}
+
+// verifyStored checks that storage reports an object just stored
+func verifyStored(ctx context.Context, key string) error {
+	exists, err := Storage.Exists(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %v", key, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s is missing after it was stored", key)
+	}
+	return nil
+}
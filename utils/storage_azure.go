@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// azureAPIVersion is the Blob service REST API version requests are made with
+const azureAPIVersion = "2021-08-06"
+
+func init() {
+	RegisterStorageProvider(config.StorageTypeAzure, func(cfg *config.Config) (StorageProvider, error) {
+		return NewAzureBlobStorage(cfg)
+	})
+}
+
+// AzureBlobStorage implements StorageProvider for Azure Blob Storage through the Blob service
+// REST API, authenticating with the storage account's shared key
+type AzureBlobStorage struct {
+	client    *http.Client
+	account   string
+	key       []byte
+	endpoint  string
+	container string
+}
+
+func NewAzureBlobStorage(cfg *config.Config) (*AzureBlobStorage, error) {
+	if cfg.AzureAccount == "" || cfg.AzureAccountKey == "" || cfg.AzureContainer == "" {
+		return nil, fmt.Errorf("azure storage requires AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY and AZURE_STORAGE_CONTAINER")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.AzureAccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure storage key: %v", err)
+	}
+
+	logger.Info("Azure Blob Storage initialized",
+		zap.String("account", cfg.AzureAccount),
+		zap.String("container", cfg.AzureContainer),
+		zap.String("endpoint", cfg.AzureBlobEndpoint()))
+	return &AzureBlobStorage{
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		account:   cfg.AzureAccount,
+		key:       key,
+		endpoint:  cfg.AzureBlobEndpoint(),
+		container: cfg.AzureContainer,
+	}, nil
+}
+
+// blobURL returns the URL of a blob, escaping each segment of its key
+func (a *AzureBlobStorage) blobURL(key string) string {
+	segments := strings.Split(strings.TrimPrefix(filepath.ToSlash(key), "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return a.endpoint + "/" + a.container + "/" + strings.Join(segments, "/")
+}
+
+// sign adds the Shared Key authorization header to a request
+// (https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key)
+func (a *AzureBlobStorage) sign(req *http.Request, contentLength int64) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	length := ""
+	if contentLength > 0 {
+		length = strconv.FormatInt(contentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	slices.Sort(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, name := range msHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonicalResource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	slices.Sort(params)
+	for _, name := range params {
+		values := query[name]
+		slices.Sort(values)
+		canonicalResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// do sends a signed request for a blob
+func (a *AzureBlobStorage) do(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.blobURL(key), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	a.sign(req, int64(len(body)))
+	return a.client.Do(req)
+}
+
+// azureError describes a failed Blob service response
+func azureError(resp *http.Response) error {
+	code := resp.Header.Get("x-ms-error-code")
+	if code == "" {
+		code = resp.Status
+	}
+	return fmt.Errorf("azure blob service returned %d: %s", resp.StatusCode, code)
+}
+
+func (a *AzureBlobStorage) Store(ctx context.Context, key string, data []byte) error {
+	logger.Info("Storing to Azure Blob Storage",
+		zap.String("container", a.container),
+		zap.String("key", key),
+		zap.Int("size", len(data)))
+
+	contentType := ImageMimeType(key)
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("x-ms-blob-cache-control", "public, max-age=31536000") // Cache for one year
+	resp, err := a.do(ctx, http.MethodPut, key, data, header)
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		err := azureError(resp)
+		logger.Error("Failed to store blob",
+			zap.String("container", a.container),
+			zap.String("key", key),
+			zap.Error(err))
+		return fmt.Errorf("failed to store blob: %v", err)
+	}
+
+	logger.Info("Successfully stored blob",
+		zap.String("key", key),
+		zap.String("url", a.blobURL(key)))
+	return nil
+}
+
+func (a *AzureBlobStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := a.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get blob %s: %v", key, azureError(resp))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", key, err)
+	}
+	return data, nil
+}
+
+// Delete removes a blob. Like S3, deleting a blob that does not exist succeeds.
+func (a *AzureBlobStorage) Delete(ctx context.Context, key string) error {
+	resp, err := a.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete blob: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete blob %s: %v", key, azureError(resp))
+	}
+
+	logger.Info("Successfully deleted blob",
+		zap.String("key", key))
+	return nil
+}
+
+func (a *AzureBlobStorage) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := a.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check blob: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check blob %s: %v", key, azureError(resp))
+	}
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// Elements removed from SVG uploads along with their content: scripts, embedded HTML and
+// elements loading other documents
+var svgBlockedElements = []string{"script", "foreignobject", "iframe", "embed", "object", "handler", "listener"}
+
+// Attributes holding references, which may only point inside the document or to embedded images
+var svgReferenceAttributes = []string{"href", "src", "action", "formaction"}
+
+// SVGContentSecurityPolicy is sent with SVG images, a second line of defense behind
+// sanitization
+const SVGContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+// SVGFormat is reported for SVG images, which the image decoders do not know
+var SVGFormat = ImageFormatInfo{Format: "svg", Extension: ".svg", MimeType: "image/svg+xml"}
+
+// svgCSSURL matches the targets of url() references in styles and presentation attributes
+var svgCSSURL = regexp.MustCompile(`url\(\s*['"]?\s*([^'")\s]*)`)
+
+// IsSVG reports whether data looks like an SVG document
+func IsSVG(data []byte) bool {
+	head := bytes.TrimLeft(data[:min(len(data), 1024)], "\xef\xbb\xbf \t\r\n")
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg"))
+}
+
+// SanitizeSVG rewrites an SVG document without scripts, event handlers, embedded HTML,
+// external references, comments and document type declarations, so it is safe to serve from
+// the image domain. Malformed documents and undefined entities are rejected.
+func SanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	var stack []string // Open elements, lowercased
+	skipped := 0       // Depth inside a removed element
+	sawRoot := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SVG: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			local := strings.ToLower(t.Name.Local)
+			if skipped > 0 || slices.Contains(svgBlockedElements, local) || setsReference(t) {
+				skipped++
+				continue
+			}
+			if len(stack) == 0 {
+				if sawRoot || local != "svg" {
+					return nil, fmt.Errorf("invalid SVG: root element must be a single svg element")
+				}
+				sawRoot = true
+			}
+			stack = append(stack, local)
+
+			out.WriteString("<" + svgName(t.Name))
+			for _, attr := range t.Attr {
+				if !safeSVGAttribute(attr) {
+					continue
+				}
+				out.WriteString(" " + svgName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipped > 0 {
+				skipped--
+				continue
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("invalid SVG: unexpected end element")
+			}
+			stack = stack[:len(stack)-1]
+			out.WriteString("</" + svgName(t.Name) + ">")
+		case xml.CharData:
+			// Text outside the root element is dropped, and style sheets loading anything
+			// from outside the document
+			if skipped > 0 || len(stack) == 0 || (stack[len(stack)-1] == "style" && unsafeSVGStyle(string(t))) {
+				continue
+			}
+			xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && out.Len() == 0 {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		// Comments and directives (DOCTYPE, entity declarations) are dropped
+	}
+
+	if !sawRoot || len(stack) > 0 {
+		return nil, fmt.Errorf("invalid SVG: missing svg element")
+	}
+	return out.Bytes(), nil
+}
+
+// RasterizeSVG renders a sanitized SVG document to a PNG at its intrinsic size, the image
+// its previews, thumbnails and hashes are made from
+func RasterizeSVG(ctx context.Context, data []byte) ([]byte, error) {
+	if !bimg.IsTypeSupported(bimg.SVG) {
+		return nil, fmt.Errorf("SVG images are not supported by the installed libvips")
+	}
+	return GetWorkerPool().ProcessTaskContext(ctx, "svg_rasterize", func() ([]byte, error) {
+		raster, err := bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG})
+		if err != nil {
+			return nil, fmt.Errorf("failed to rasterize SVG: %v", err)
+		}
+		return raster, nil
+	})
+}
+
+func svgName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// safeSVGAttribute reports whether an attribute is kept: event handlers are dropped, as are
+// references and styles pointing outside the document
+func safeSVGAttribute(attr xml.Attr) bool {
+	local := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(local, "on") {
+		return false
+	}
+	if slices.Contains(svgReferenceAttributes, local) && !localSVGReference(attr.Value) {
+		return false
+	}
+	return !unsafeSVGStyle(attr.Value)
+}
+
+// setsReference reports whether an animation element changes a reference attribute, which
+// could point it outside the document after sanitization
+func setsReference(element xml.StartElement) bool {
+	switch strings.ToLower(element.Name.Local) {
+	case "animate", "set":
+		for _, attr := range element.Attr {
+			if strings.ToLower(attr.Name.Local) == "attributename" {
+				name := strings.ToLower(strings.TrimSpace(attr.Value))
+				if i := strings.LastIndex(name, ":"); i >= 0 {
+					name = name[i+1:]
+				}
+				return slices.Contains(svgReferenceAttributes, name)
+			}
+		}
+	}
+	return false
+}
+
+// localSVGReference reports whether a reference points inside the document or to an embedded
+// raster image
+func localSVGReference(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return strings.HasPrefix(value, "#") ||
+		(strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg"))
+}
+
+// unsafeSVGStyle reports whether CSS imports other documents, runs script or references
+// anything outside the document
+func unsafeSVGStyle(css string) bool {
+	lower := strings.ToLower(css)
+	if strings.Contains(lower, "@import") || strings.Contains(lower, "expression(") || strings.Contains(lower, "javascript:") {
+		return true
+	}
+	for _, match := range svgCSSURL.FindAllStringSubmatch(lower, -1) {
+		if !localSVGReference(match[1]) {
+			return true
+		}
+	}
+	return false
+}
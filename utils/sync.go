@@ -0,0 +1,427 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+)
+
+// Sync source types
+const (
+	SyncSourceS3    = "s3"
+	SyncSourceHTTP  = "http"
+	SyncSourceLocal = "local"
+)
+
+// maxSyncObjectSize bounds the size of a single synced image
+const maxSyncObjectSize = 64 << 20
+
+// SyncSource is a remote collection mirrored into the library
+type SyncSource struct {
+	Name           string     `json:"name"`
+	Type           string     `json:"type"`           // s3, http or local
+	Tenant         string     `json:"tenant"`         // Tenant receiving the images (empty = default namespace)
+	Tags           []string   `json:"tags"`           // Tags added to every synced image
+	PathTags       bool       `json:"pathTags"`       // Add the item's directory names as tags
+	Rules          []SyncRule `json:"rules"`          // Tags added to items whose path matches
+	Visibility     string     `json:"visibility"`     // Visibility of synced images (default: DEFAULT_VISIBILITY)
+	Profile        string     `json:"profile"`        // Processing profile (default: selected automatically)
+	Limit          int        `json:"limit"`          // Maximum images imported per run (0 = unlimited)
+	DedupeDistance int        `json:"dedupeDistance"` // Skip images within this perceptual hash distance of a library image (-1 = disabled)
+
+	// S3 sources
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	PathStyle bool   `json:"pathStyle"`
+
+	// HTTP sources: a JSON array of URLs (or of objects with a "url" field), or an HTML page
+	// whose links to images are followed
+	URL string `json:"url"`
+
+	// Local sources
+	Path string `json:"path"`
+
+	remote SyncRemote
+}
+
+// SyncRule adds tags to items whose path matches a regular expression
+type SyncRule struct {
+	Match string   `json:"match"`
+	Tags  []string `json:"tags"`
+
+	pattern *regexp.Regexp
+}
+
+// SyncItem is an image available from a sync source
+type SyncItem struct {
+	ID      string // Stable identifier within the source (key, URL or relative path)
+	Path    string // Slash-separated path used for tagging rules
+	Version string // Changes when the item is modified (empty if unknown)
+}
+
+// SyncRemote lists and fetches the images of a sync source
+type SyncRemote interface {
+	List(ctx context.Context) ([]SyncItem, error)
+	Fetch(ctx context.Context, item SyncItem) ([]byte, error)
+}
+
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif"}
+
+// IsImageFileName reports whether a file name has a supported image extension
+func IsImageFileName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range imageExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSyncSources reads sync sources from the configured sources file. A missing file is not
+// an error; syncing is optional.
+func LoadSyncSources(cfg *config.Config) ([]*SyncSource, error) {
+	if cfg.SyncSourcesFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(cfg.SyncSourcesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync sources file: %v", err)
+	}
+
+	var file struct {
+		Sources []*SyncSource `json:"sources"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse sync sources file: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range file.Sources {
+		if s.Name == "" {
+			return nil, fmt.Errorf("sync source without a name")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate sync source: %s", s.Name)
+		}
+		seen[s.Name] = true
+
+		if s.Visibility != "" {
+			if _, err := ParseVisibility(s.Visibility); err != nil {
+				return nil, fmt.Errorf("sync source %s: %v", s.Name, err)
+			}
+		}
+		if s.Profile != "" {
+			if _, ok := GetProcessingProfile(cfg, s.Profile); !ok {
+				return nil, fmt.Errorf("sync source %s: unknown profile %s", s.Name, s.Profile)
+			}
+		}
+		for i := range s.Rules {
+			pattern, err := regexp.Compile(s.Rules[i].Match)
+			if err != nil {
+				return nil, fmt.Errorf("sync source %s: invalid rule %q: %v", s.Name, s.Rules[i].Match, err)
+			}
+			s.Rules[i].pattern = pattern
+		}
+
+		switch s.Type {
+		case SyncSourceS3:
+			if s.Bucket == "" {
+				return nil, fmt.Errorf("sync source %s: bucket is required", s.Name)
+			}
+			remote, err := newS3SyncRemote(s)
+			if err != nil {
+				return nil, fmt.Errorf("sync source %s: %v", s.Name, err)
+			}
+			s.remote = remote
+		case SyncSourceHTTP:
+			if _, err := url.ParseRequestURI(s.URL); err != nil {
+				return nil, fmt.Errorf("sync source %s: invalid url", s.Name)
+			}
+			s.remote = &httpSyncRemote{index: s.URL, client: &http.Client{Timeout: time.Minute}}
+		case SyncSourceLocal:
+			if s.Path == "" {
+				return nil, fmt.Errorf("sync source %s: path is required", s.Name)
+			}
+			s.remote = &localSyncRemote{root: s.Path}
+		default:
+			return nil, fmt.Errorf("sync source %s: unsupported type %s", s.Name, s.Type)
+		}
+	}
+
+	logger.Info("Loaded sync sources",
+		zap.String("file", cfg.SyncSourcesFile),
+		zap.Int("sources", len(file.Sources)))
+	return file.Sources, nil
+}
+
+// Remote returns the client of the source
+func (s *SyncSource) Remote() SyncRemote {
+	return s.remote
+}
+
+// ItemTags returns the tags of a synced item: the source's tags, its directory names when
+// pathTags is set, and the tags of every matching rule
+func (s *SyncSource) ItemTags(item SyncItem) []string {
+	tags := append([]string(nil), s.Tags...)
+	add := func(tag string) {
+		tag = strings.TrimSpace(tag)
+		for _, t := range tags {
+			if t == tag {
+				return
+			}
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if s.PathTags {
+		if dir := path.Dir(item.Path); dir != "." && dir != "/" {
+			for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+				add(part)
+			}
+		}
+	}
+	for _, rule := range s.Rules {
+		if rule.pattern.MatchString(item.Path) {
+			for _, tag := range rule.Tags {
+				add(tag)
+			}
+		}
+	}
+	return tags
+}
+
+func syncStateKey(ctx context.Context, source string) string {
+	return KeyPrefix(ctx) + "sync:" + source
+}
+
+// SyncedVersion returns the version of an item recorded by the last sync, and whether the
+// item was synced at all
+func SyncedVersion(ctx context.Context, source string, item SyncItem) (string, bool) {
+	if !IsRedisMetadataStore() {
+		return "", false
+	}
+	value, err := RedisClient.HGet(ctx, syncStateKey(ctx, source), item.ID).Result()
+	if err != nil {
+		return "", false
+	}
+	version, _, _ := strings.Cut(value, "|")
+	return version, true
+}
+
+// RecordSyncedItem records that an item was synced as the given image (or skipped as a
+// duplicate of it)
+func RecordSyncedItem(ctx context.Context, source string, item SyncItem, imageID string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+	return RedisClient.HSet(ctx, syncStateKey(ctx, source), item.ID, item.Version+"|"+imageID).Err()
+}
+
+// s3SyncRemote mirrors a prefix of another S3-compatible bucket
+type s3SyncRemote struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3SyncRemote(s *SyncSource) (*s3SyncRemote, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(s.Region),
+	}
+	if s.AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(s.AccessKey, s.SecretKey, "")))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if s.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s.Endpoint)
+		}
+		o.UsePathStyle = s.PathStyle
+	})
+	return &s3SyncRemote{client: client, bucket: s.Bucket, prefix: s.Prefix}, nil
+}
+
+func (r *s3SyncRemote) List(ctx context.Context) ([]SyncItem, error) {
+	var items []SyncItem
+	paginator := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %v", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if !IsImageFileName(key) || aws.ToInt64(obj.Size) > maxSyncObjectSize {
+				continue
+			}
+			items = append(items, SyncItem{
+				ID:      key,
+				Path:    strings.TrimPrefix(strings.TrimPrefix(key, r.prefix), "/"),
+				Version: strings.Trim(aws.ToString(obj.ETag), `"`),
+			})
+		}
+	}
+	return items, nil
+}
+
+func (r *s3SyncRemote) Fetch(ctx context.Context, item SyncItem) ([]byte, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(item.ID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %v", err)
+	}
+	defer result.Body.Close()
+	return io.ReadAll(io.LimitReader(result.Body, maxSyncObjectSize))
+}
+
+// httpSyncRemote follows the image links of an index page or JSON list
+type httpSyncRemote struct {
+	index  string
+	client *http.Client
+}
+
+var htmlLinkPattern = regexp.MustCompile(`(?i)(?:href|src)\s*=\s*["']([^"'#]+)["']`)
+
+func (r *httpSyncRemote) get(ctx context.Context, u string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %d", u, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSyncObjectSize))
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+func (r *httpSyncRemote) List(ctx context.Context) ([]SyncItem, error) {
+	data, contentType, err := r.get(ctx, r.index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch index: %v", err)
+	}
+	base, _ := url.Parse(r.index)
+
+	var links []string
+	if strings.Contains(contentType, "json") {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON index: %v", err)
+		}
+		for _, entry := range entries {
+			var link string
+			var object struct {
+				URL string `json:"url"`
+			}
+			if json.Unmarshal(entry, &link) != nil && json.Unmarshal(entry, &object) == nil {
+				link = object.URL
+			}
+			links = append(links, link)
+		}
+	} else {
+		for _, match := range htmlLinkPattern.FindAllSubmatch(data, -1) {
+			links = append(links, string(match[1]))
+		}
+	}
+
+	seen := make(map[string]bool)
+	var items []SyncItem
+	for _, link := range links {
+		u, err := base.Parse(strings.TrimSpace(link))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !IsImageFileName(u.Path) {
+			continue
+		}
+		id := u.String()
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		items = append(items, SyncItem{ID: id, Path: strings.TrimPrefix(u.Path, "/")})
+	}
+	return items, nil
+}
+
+func (r *httpSyncRemote) Fetch(ctx context.Context, item SyncItem) ([]byte, error) {
+	data, _, err := r.get(ctx, item.ID)
+	return data, err
+}
+
+// localSyncRemote mirrors a local directory tree
+type localSyncRemote struct {
+	root string
+}
+
+func (r *localSyncRemote) List(ctx context.Context) ([]SyncItem, error) {
+	var items []SyncItem
+	err := filepath.WalkDir(r.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !IsImageFileName(d.Name()) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > maxSyncObjectSize {
+			return nil
+		}
+		rel, err := filepath.Rel(r.root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		items = append(items, SyncItem{
+			ID:      rel,
+			Path:    rel,
+			Version: fmt.Sprintf("%d-%d", info.Size(), info.ModTime().Unix()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %v", r.root, err)
+	}
+	return items, nil
+}
+
+func (r *localSyncRemote) Fetch(ctx context.Context, item SyncItem) ([]byte, error) {
+	return os.ReadFile(filepath.Join(r.root, filepath.FromSlash(item.ID)))
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"context"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// TagMismatch describes an image whose metadata tags differ from its tag index membership
+type TagMismatch struct {
+	ID            string   `json:"id"`
+	NotIndexed    []string `json:"notIndexed,omitempty"`    // Tags in the metadata whose tag set lacks the image
+	NotInMetadata []string `json:"notInMetadata,omitempty"` // Tag sets containing the image although its metadata lacks the tag
+}
+
+// StaleTagMember is an image ID left in a tag set after its metadata was deleted
+type StaleTagMember struct {
+	Tag string `json:"tag"`
+	ID  string `json:"id"`
+}
+
+// TagIndexReport lists the inconsistencies between image metadata, the Redis tag indexes and
+// the stored images of a tenant
+type TagIndexReport struct {
+	Images       int              `json:"images"`       // Images in the image index
+	Tags         int              `json:"tags"`         // Tags in all_tags or with a tag set
+	Mismatches   []TagMismatch    `json:"mismatches"`   // Images whose metadata tags and tag sets differ
+	StaleMembers []StaleTagMember `json:"staleMembers"` // Tag set members without metadata
+	OrphanedTags []string         `json:"orphanedTags"` // Tags no image carries, left in all_tags or a tag set
+	Unindexed    []string         `json:"unindexed"`    // IDs of stored originals missing from the image index
+	Repaired     bool             `json:"repaired"`     // Whether the tag indexes were repaired
+}
+
+// CheckTagIndexes compares the tag indexes of the request's tenant with its image metadata and
+// stored originals. With repair set, tag sets and all_tags are rewritten to match the metadata;
+// unindexed images are only reported, as they have no metadata to index.
+func CheckTagIndexes(ctx context.Context, cfg *config.Config, repair bool) (*TagIndexReport, error) {
+	prefix := KeyPrefix(ctx)
+	report := &TagIndexReport{
+		Mismatches:   []TagMismatch{},
+		StaleMembers: []StaleTagMember{},
+		OrphanedTags: []string{},
+		Unindexed:    []string{},
+	}
+
+	ids, err := RedisClient.ZRange(ctx, prefix+"images", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	report.Images = len(ids)
+	imageTags := make(map[string][]string, len(ids))
+	for _, id := range ids {
+		metadata, err := MetadataManager.GetMetadata(ctx, id)
+		if err != nil {
+			continue
+		}
+		imageTags[id] = slices.DeleteFunc(slices.Clone(metadata.Tags), func(tag string) bool { return tag == "" })
+	}
+
+	// Every tag listed in all_tags or owning a tag set
+	tags, err := RedisClient.SMembers(ctx, prefix+"all_tags").Result()
+	if err != nil {
+		return nil, err
+	}
+	pattern := strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(prefix+"tag:") + "*"
+	iter := RedisClient.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		tags = append(tags, strings.TrimPrefix(iter.Val(), prefix+"tag:"))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	report.Tags = len(tags)
+
+	members := make(map[string][]string, len(tags))
+	for _, tag := range tags {
+		if members[tag], err = RedisClient.SMembers(ctx, prefix+"tag:"+tag).Result(); err != nil {
+			return nil, err
+		}
+	}
+
+	mismatches := make(map[string]*TagMismatch)
+	mismatch := func(id string) *TagMismatch {
+		if m, ok := mismatches[id]; ok {
+			return m
+		}
+		m := &TagMismatch{ID: id}
+		mismatches[id] = m
+		return m
+	}
+	carried := make(map[string]bool)
+	for _, id := range ids {
+		for _, tag := range imageTags[id] {
+			carried[tag] = true
+			if !slices.Contains(members[tag], id) {
+				mismatch(id).NotIndexed = append(mismatch(id).NotIndexed, tag)
+			}
+		}
+	}
+	for _, tag := range tags {
+		if !carried[tag] {
+			report.OrphanedTags = append(report.OrphanedTags, tag)
+		}
+		for _, id := range members[tag] {
+			itags, ok := imageTags[id]
+			if !ok {
+				report.StaleMembers = append(report.StaleMembers, StaleTagMember{Tag: tag, ID: id})
+			} else if !slices.Contains(itags, tag) {
+				mismatch(id).NotInMetadata = append(mismatch(id).NotInMetadata, tag)
+			}
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(mismatches)) {
+		report.Mismatches = append(report.Mismatches, *mismatches[id])
+	}
+
+	stored, err := storedImageIDs(ctx, cfg)
+	if err != nil {
+		logger.Warn("Failed to list stored images",
+			zap.Error(err))
+	}
+	indexed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		indexed[id] = true
+	}
+	for _, id := range stored {
+		if !indexed[id] {
+			report.Unindexed = append(report.Unindexed, id)
+		}
+	}
+
+	if repair {
+		pipe := RedisClient.Pipeline()
+		for _, m := range report.Mismatches {
+			for _, tag := range m.NotIndexed {
+				pipe.SAdd(ctx, prefix+"tag:"+tag, m.ID)
+				pipe.SAdd(ctx, prefix+"all_tags", tag)
+			}
+			for _, tag := range m.NotInMetadata {
+				pipe.SRem(ctx, prefix+"tag:"+tag, m.ID)
+			}
+		}
+		for _, member := range report.StaleMembers {
+			pipe.SRem(ctx, prefix+"tag:"+member.Tag, member.ID)
+		}
+		for _, tag := range report.OrphanedTags {
+			pipe.Del(ctx, prefix+"tag:"+tag)
+			pipe.SRem(ctx, prefix+"all_tags", tag)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return report, err
+		}
+		if err := ClearPageCache(ctx); err != nil {
+			logger.Warn("Failed to clear page cache", zap.Error(err))
+		}
+		report.Repaired = true
+		logger.Info("Repaired tag indexes",
+			zap.Int("mismatches", len(report.Mismatches)),
+			zap.Int("stale_members", len(report.StaleMembers)),
+			zap.Int("orphaned_tags", len(report.OrphanedTags)))
+	}
+	return report, nil
+}
+
+// storedImageIDs returns the IDs of the originals and animations stored for the request's tenant,
+// sorted. Storage backends that cannot list objects return nothing.
+func storedImageIDs(ctx context.Context, cfg *config.Config) ([]string, error) {
+	var ids []string
+	for _, dir := range []string{"original", "gif", "animated"} {
+		prefix := TenantStorageKey(ctx, dir)
+		switch storage := StorageBackend().(type) {
+		case *LocalStorage:
+			root := filepath.Join(cfg.ImageBasePath, prefix)
+			err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if path == root {
+						return fs.SkipDir
+					}
+					return err
+				}
+				if !d.IsDir() && slices.Contains(SupportedImageExtensions, strings.ToLower(filepath.Ext(path))) {
+					ids = append(ids, ImageIDFromKey(path))
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		case *S3Storage:
+			objects, err := storage.ListObjects(ctx, prefix+"/")
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range objects {
+				if slices.Contains(SupportedImageExtensions, strings.ToLower(filepath.Ext(obj.Key))) {
+					ids = append(ids, ImageIDFromKey(obj.Key))
+				}
+			}
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
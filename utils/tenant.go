@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Tenant is a logical site hosted on the instance. Each tenant has its own API key,
+// Redis namespace (images, tags, caches, share links...) and storage prefix.
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	MaxImages int64     `json:"maxImages"` // Maximum number of images (0 = unlimited)
+	MaxBytes  int64     `json:"maxBytes"`  // Maximum total stored bytes across all formats (0 = unlimited)
+	Domains   []string  `json:"domains"`   // Host names that select the tenant
+	BaseURL   string    `json:"baseURL"`   // Public base URL of the tenant (defaults to https://<first domain>)
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PublicBaseURL returns the base URL links to the tenant's images and pages are built with,
+// or "" when the tenant is only reachable through the instance's own domain
+func (t *Tenant) PublicBaseURL() string {
+	if t.BaseURL != "" {
+		return t.BaseURL
+	}
+	if len(t.Domains) > 0 {
+		return "https://" + t.Domains[0]
+	}
+	return ""
+}
+
+// TenantUsage reports the resources used by a tenant
+type TenantUsage struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type tenantContextKey struct{}
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var hostPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// WithTenant returns a context scoped to the given tenant
+func WithTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of a context, or nil for the default namespace
+func TenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// KeyPrefix returns the Redis key prefix of the context's tenant. Keys of the default
+// namespace keep the plain RedisPrefix, so single-tenant deployments are unaffected.
+func KeyPrefix(ctx context.Context) string {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		return RedisPrefix + "tenant:" + tenant.ID + ":"
+	}
+	return RedisPrefix
+}
+
+// TenantStorageKey prefixes a storage key with the storage directory of the context's tenant
+func TenantStorageKey(ctx context.Context, key string) string {
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		return "tenants/" + tenant.ID + "/" + key
+	}
+	return key
+}
+
+// TenantIDFromStorageKey returns the tenant owning a storage key, or "" for the default namespace
+func TenantIDFromStorageKey(key string) string {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(key, "/"), "tenants/")
+	if !ok {
+		return ""
+	}
+	id, _, _ := strings.Cut(rest, "/")
+	return id
+}
+
+// Tenant registry keys live in the global namespace
+func tenantsKey() string {
+	return RedisPrefix + "tenants"
+}
+
+func tenantAPIKeysKey() string {
+	return RedisPrefix + "tenant_keys"
+}
+
+func tenantDomainsKey() string {
+	return RedisPrefix + "tenant_domains"
+}
+
+// NormalizeHost lowercases a Host header or SNI name and strips its port and trailing dot
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, port, ok := strings.Cut(host, ":"); ok && !strings.Contains(port, ":") {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// ValidHost reports whether a normalized host name is syntactically valid
+func ValidHost(host string) bool {
+	return len(host) <= 253 && hostPattern.MatchString(host)
+}
+
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateTenant registers a tenant and returns it with its API key. The key is only
+// returned here; the registry stores a hash of it.
+func CreateTenant(ctx context.Context, id, name string, maxImages, maxBytes int64) (*Tenant, string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, "", fmt.Errorf("redis not enabled")
+	}
+	if !tenantIDPattern.MatchString(id) {
+		return nil, "", fmt.Errorf("invalid tenant ID: use 1-32 lowercase letters, digits or dashes")
+	}
+	if maxImages < 0 || maxBytes < 0 {
+		return nil, "", fmt.Errorf("quotas must not be negative")
+	}
+
+	keyBytes := make([]byte, 24)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	apiKey := "tk_" + hex.EncodeToString(keyBytes)
+
+	tenant := &Tenant{
+		ID:        id,
+		Name:      name,
+		MaxImages: maxImages,
+		MaxBytes:  maxBytes,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal tenant: %v", err)
+	}
+
+	created, err := RedisClient.HSetNX(ctx, tenantsKey(), id, data).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to save tenant: %v", err)
+	}
+	if !created {
+		return nil, "", fmt.Errorf("tenant already exists: %s", id)
+	}
+	if err := RedisClient.HSet(ctx, tenantAPIKeysKey(), hashAPIKey(apiKey), id).Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to save tenant API key: %v", err)
+	}
+	return tenant, apiKey, nil
+}
+
+// GetTenant returns a tenant by ID
+func GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	data, err := RedisClient.HGet(ctx, tenantsKey(), id).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("tenant not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant: %v", err)
+	}
+
+	var tenant Tenant
+	if err := json.Unmarshal([]byte(data), &tenant); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant: %v", err)
+	}
+	return &tenant, nil
+}
+
+// TenantByHost returns the tenant a host name is mapped to
+func TenantByHost(ctx context.Context, host string) (*Tenant, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	id, err := RedisClient.HGet(ctx, tenantDomainsKey(), NormalizeHost(host)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("unknown host")
+	}
+	return GetTenant(ctx, id)
+}
+
+// SetTenantDomains replaces the domains and base URL of a tenant. A domain can only belong
+// to one tenant.
+func SetTenantDomains(ctx context.Context, id string, domains []string, baseURL string) (*Tenant, error) {
+	tenant, err := GetTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		host := NormalizeHost(domain)
+		if !ValidHost(host) {
+			return nil, fmt.Errorf("invalid domain: %s", domain)
+		}
+		owner, err := RedisClient.HGet(ctx, tenantDomainsKey(), host).Result()
+		if err == nil && owner != id {
+			return nil, fmt.Errorf("domain %s already belongs to tenant %s", host, owner)
+		}
+		if !slices.Contains(normalized, host) {
+			normalized = append(normalized, host)
+		}
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL != "" && !strings.HasPrefix(baseURL, "https://") && !strings.HasPrefix(baseURL, "http://") {
+		return nil, fmt.Errorf("base URL must start with http:// or https://")
+	}
+
+	for _, host := range tenant.Domains {
+		if !slices.Contains(normalized, host) {
+			RedisClient.HDel(ctx, tenantDomainsKey(), host)
+		}
+	}
+	for _, host := range normalized {
+		if err := RedisClient.HSet(ctx, tenantDomainsKey(), host, id).Err(); err != nil {
+			return nil, fmt.Errorf("failed to map domain %s: %v", host, err)
+		}
+	}
+
+	tenant.Domains = normalized
+	tenant.BaseURL = baseURL
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tenant: %v", err)
+	}
+	if err := RedisClient.HSet(ctx, tenantsKey(), id, data).Err(); err != nil {
+		return nil, fmt.Errorf("failed to save tenant: %v", err)
+	}
+	return tenant, nil
+}
+
+// TenantByAPIKey returns the tenant owning an API key
+func TenantByAPIKey(ctx context.Context, apiKey string) (*Tenant, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	id, err := RedisClient.HGet(ctx, tenantAPIKeysKey(), hashAPIKey(apiKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	return GetTenant(ctx, id)
+}
+
+// ListTenants returns all tenants ordered by ID
+func ListTenants(ctx context.Context) ([]*Tenant, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis not enabled")
+	}
+
+	items, err := RedisClient.HGetAll(ctx, tenantsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %v", err)
+	}
+
+	tenants := make([]*Tenant, 0, len(items))
+	for _, data := range items {
+		var tenant Tenant
+		if err := json.Unmarshal([]byte(data), &tenant); err == nil {
+			tenants = append(tenants, &tenant)
+		}
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+	return tenants, nil
+}
+
+// DeleteTenant removes a tenant, revokes its API keys and releases its domains. Its images and metadata are kept
+// so they can be recovered by recreating the tenant with the same ID.
+func DeleteTenant(ctx context.Context, id string) error {
+	if !IsRedisMetadataStore() {
+		return fmt.Errorf("redis not enabled")
+	}
+
+	if tenant, err := GetTenant(ctx, id); err == nil {
+		for _, host := range tenant.Domains {
+			RedisClient.HDel(ctx, tenantDomainsKey(), host)
+		}
+	}
+
+	removed, err := RedisClient.HDel(ctx, tenantsKey(), id).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete tenant: %v", err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("tenant not found: %s", id)
+	}
+
+	keys, err := RedisClient.HGetAll(ctx, tenantAPIKeysKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to revoke tenant API keys: %v", err)
+	}
+	for hash, owner := range keys {
+		if owner == id {
+			RedisClient.HDel(ctx, tenantAPIKeysKey(), hash)
+		}
+	}
+	if _, err := revokeAPIKeys(ctx, func(key *APIKey) bool { return key.Tenant == id }); err != nil {
+		return fmt.Errorf("failed to revoke tenant API keys: %v", err)
+	}
+	return nil
+}
+
+// GetTenantUsage returns the number of images and stored bytes of the context's namespace
+func GetTenantUsage(ctx context.Context) (TenantUsage, error) {
+	var usage TenantUsage
+	if !IsRedisMetadataStore() {
+		return usage, fmt.Errorf("redis not enabled")
+	}
+
+	images, err := RedisClient.ZCard(ctx, KeyPrefix(ctx)+"images").Result()
+	if err != nil {
+		return usage, fmt.Errorf("failed to count images: %v", err)
+	}
+	bytes, err := RedisClient.Get(ctx, KeyPrefix(ctx)+"usage_bytes").Int64()
+	if err != nil && err != redis.Nil {
+		return usage, fmt.Errorf("failed to read usage: %v", err)
+	}
+
+	usage.Images = images
+	usage.Bytes = bytes
+	return usage, nil
+}
+
+// AddTenantUsage adjusts the stored byte counter of the context's tenant. The default
+// namespace has no quota and is not tracked.
+func AddTenantUsage(ctx context.Context, delta int64) error {
+	if TenantFromContext(ctx) == nil || !IsRedisMetadataStore() || delta == 0 {
+		return nil
+	}
+	return RedisClient.IncrBy(ctx, KeyPrefix(ctx)+"usage_bytes", delta).Err()
+}
+
+// CheckTenantQuota returns an error when adding the given number of images and bytes would
+// exceed the quota of the context's tenant
+func CheckTenantQuota(ctx context.Context, images, bytes int64) error {
+	tenant := TenantFromContext(ctx)
+	if tenant == nil || (tenant.MaxImages == 0 && tenant.MaxBytes == 0) {
+		return nil
+	}
+
+	usage, err := GetTenantUsage(ctx)
+	if err != nil {
+		return err
+	}
+	if tenant.MaxImages > 0 && usage.Images+images > tenant.MaxImages {
+		return fmt.Errorf("image quota exceeded: %d of %d images used", usage.Images, tenant.MaxImages)
+	}
+	if tenant.MaxBytes > 0 && usage.Bytes+bytes > tenant.MaxBytes {
+		return fmt.Errorf("storage quota exceeded: %d of %d bytes used", usage.Bytes, tenant.MaxBytes)
+	}
+	return nil
+}
+
+// StoredBytes returns the total stored size of an image across all formats
+func StoredBytes(metadata *ImageMetadata) int64 {
+	var total int64
+	total += metadata.Sizes["original"]
+	if metadata.Paths.WebP != "" {
+		total += metadata.Sizes["webp"]
+	}
+	if metadata.Paths.AVIF != "" {
+		total += metadata.Sizes["avif"]
+	}
+	if metadata.Paths.Video != "" {
+		total += metadata.Sizes["video"]
+	}
+	for size := range metadata.Paths.Thumbnails {
+		total += metadata.Sizes[ThumbnailSizeKey(size)]
+	}
+	return total
+}
+
+// TenantContexts returns a context for the default namespace followed by one per tenant, for
+// background jobs that must visit every namespace
+func TenantContexts(ctx context.Context) []context.Context {
+	contexts := []context.Context{ctx}
+	tenants, err := ListTenants(ctx)
+	if err != nil {
+		return contexts
+	}
+	for _, tenant := range tenants {
+		contexts = append(contexts, WithTenant(ctx, tenant))
+	}
+	return contexts
+}
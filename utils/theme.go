@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Themes of images
+const (
+	ThemeDark  = "dark"
+	ThemeLight = "light"
+	ThemeAuto  = "auto" // The client's preferred color scheme, from a client hint
+)
+
+// ThemeHint is the client hint telling the preferred color scheme of the client
+const ThemeHint = "Sec-CH-Prefers-Color-Scheme"
+
+// RequestedTheme returns the theme named by a theme parameter, dark or light. With auto it is
+// the color scheme the client prefers, or "" when the client does not say.
+func RequestedTheme(r *http.Request, theme string) (string, error) {
+	switch strings.ToLower(theme) {
+	case "":
+		return "", nil
+	case ThemeDark:
+		return ThemeDark, nil
+	case ThemeLight:
+		return ThemeLight, nil
+	case ThemeAuto:
+		switch strings.Trim(strings.ToLower(r.Header.Get(ThemeHint)), `"`) {
+		case ThemeDark:
+			return ThemeDark, nil
+		case ThemeLight:
+			return ThemeLight, nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("theme must be dark, light or auto")
+}
+
+// ThemeVariant returns the image to serve for a theme in place of an image: its dark-mode
+// variant for dark, or the image it is the variant of for light. It returns nil when the image
+// already suits the theme or has no paired variant.
+func ThemeVariant(ctx context.Context, metadata *ImageMetadata, theme string) *ImageMetadata {
+	var id string
+	switch theme {
+	case ThemeDark:
+		id = metadata.DarkVariant
+	case ThemeLight:
+		id = metadata.LightVariant
+	}
+	if id == "" {
+		return nil
+	}
+	variant, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return variant
+}
+
+// CorrespondingKey returns the key of the file of a paired variant matching a file of the
+// image: the original for the original, the same converted format or thumbnail size
+// otherwise. It returns "" when the variant has no matching file.
+func (m *ImageMetadata) CorrespondingKey(image *ImageMetadata, key string) string {
+	switch key {
+	case image.Paths.Original:
+		return m.Paths.Original
+	case image.Paths.WebP:
+		return m.Paths.WebP
+	case image.Paths.AVIF:
+		return m.Paths.AVIF
+	}
+	for size, thumbnail := range image.Paths.Thumbnails {
+		if thumbnail == key {
+			return m.Paths.Thumbnails[size]
+		}
+	}
+	return ""
+}
+
+// PairThemeVariants makes an image the dark-mode variant of another, replacing earlier pairings
+// of both. An image is either a light image with a dark variant or a dark variant, not both.
+func PairThemeVariants(ctx context.Context, id, darkID string) (*ImageMetadata, error) {
+	if id == darkID {
+		return nil, fmt.Errorf("an image cannot be its own dark variant")
+	}
+	light, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("image not found: %s", id)
+	}
+	dark, err := MetadataManager.GetMetadata(ctx, darkID)
+	if err != nil {
+		return nil, fmt.Errorf("image not found: %s", darkID)
+	}
+	if light.LightVariant != "" {
+		return nil, fmt.Errorf("image %s is the dark variant of %s", id, light.LightVariant)
+	}
+	if dark.DarkVariant != "" {
+		return nil, fmt.Errorf("image %s has a dark variant of its own", darkID)
+	}
+	if light.DarkVariant == darkID {
+		return light, nil
+	}
+
+	// Release the previous partners of both images
+	if err := unlinkThemeVariant(ctx, light.DarkVariant, func(m *ImageMetadata) { m.LightVariant = "" }); err != nil {
+		return nil, err
+	}
+	if err := unlinkThemeVariant(ctx, dark.LightVariant, func(m *ImageMetadata) { m.DarkVariant = "" }); err != nil {
+		return nil, err
+	}
+
+	light.DarkVariant = darkID
+	dark.LightVariant = id
+	if err := MetadataManager.SaveMetadata(ctx, dark); err != nil {
+		return nil, err
+	}
+	if err := MetadataManager.SaveMetadata(ctx, light); err != nil {
+		return nil, err
+	}
+	return light, nil
+}
+
+// UnpairThemeVariants removes the pairing of an image with its dark-mode variant, or with the
+// image it is the variant of
+func UnpairThemeVariants(ctx context.Context, id string) (*ImageMetadata, error) {
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("image not found: %s", id)
+	}
+	if metadata.DarkVariant == "" && metadata.LightVariant == "" {
+		return nil, fmt.Errorf("image %s has no paired variant", id)
+	}
+
+	if err := unlinkThemeVariant(ctx, metadata.DarkVariant, func(m *ImageMetadata) { m.LightVariant = "" }); err != nil {
+		return nil, err
+	}
+	if err := unlinkThemeVariant(ctx, metadata.LightVariant, func(m *ImageMetadata) { m.DarkVariant = "" }); err != nil {
+		return nil, err
+	}
+	metadata.DarkVariant, metadata.LightVariant = "", ""
+	if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// unlinkThemeVariant clears the link of a partner image back to an image. Partners that no
+// longer exist are skipped.
+func unlinkThemeVariant(ctx context.Context, id string, clear func(*ImageMetadata)) error {
+	if id == "" {
+		return nil
+	}
+	partner, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil
+	}
+	clear(partner)
+	return MetadataManager.SaveMetadata(ctx, partner)
+}
+
+// DeleteThemeVariantLinks clears the links of the partner of a deleted image back to it
+func DeleteThemeVariantLinks(ctx context.Context, metadata *ImageMetadata) error {
+	if err := unlinkThemeVariant(ctx, metadata.DarkVariant, func(m *ImageMetadata) { m.LightVariant = "" }); err != nil {
+		return err
+	}
+	return unlinkThemeVariant(ctx, metadata.LightVariant, func(m *ImageMetadata) { m.DarkVariant = "" })
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/h2non/bimg"
+	"go.uber.org/zap"
+)
+
+// ThumbnailSizeKey returns the key of a thumbnail's size in ImageMetadata.Sizes
+func ThumbnailSizeKey(size string) string {
+	return "thumbnail_" + size
+}
+
+// GenerateThumbnail scales an image to fit inside a size×size box and encodes it as WebP.
+// Smaller images are not enlarged and animations keep their first frame.
+func GenerateThumbnail(ctx context.Context, data []byte, size, quality int) ([]byte, error) {
+	return GetWorkerPool().ProcessTaskContext(ctx, "thumbnail", func() ([]byte, error) {
+		result, err := bimg.NewImage(data).Process(bimg.Options{
+			Width:   size,
+			Height:  size,
+			Type:    bimg.WEBP,
+			Quality: quality,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("thumbnail generation failed: %v", err)
+		}
+		return result, nil
+	})
+}
+
+// StoreThumbnails generates and stores thumbnails of an image, returning their keys and byte
+// sizes by thumbnail size ("256", "512"). Thumbnails that fail are logged and left out, so the
+// image is still listed with its full-size URLs.
+func StoreThumbnails(ctx context.Context, cfg *config.Config, layout config.KeyLayout, id string, data []byte, thumbnailSizes []int) (map[string]string, map[string]int64) {
+	keys := make(map[string]string, len(thumbnailSizes))
+	sizes := make(map[string]int64, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		thumbnail, err := GenerateThumbnail(ctx, data, size, cfg.ImageQuality)
+		if err != nil {
+			logger.Warn("Failed to generate thumbnail",
+				zap.String("id", id),
+				zap.Int("size", size),
+				zap.Error(err))
+			continue
+		}
+		key := TenantStorageKey(ctx, ThumbnailKey(layout, size, id))
+		if err := StoreVerified(ctx, key, thumbnail); err != nil {
+			logger.Warn("Failed to store thumbnail",
+				zap.String("key", key),
+				zap.Error(err))
+			continue
+		}
+		keys[strconv.Itoa(size)] = key
+		sizes[strconv.Itoa(size)] = int64(len(thumbnail))
+	}
+	return keys, sizes
+}
+
+// missingThumbnails returns the configured thumbnail sizes an image has no thumbnail for
+func missingThumbnails(cfg *config.Config, metadata *ImageMetadata) []int {
+	var missing []int
+	for _, size := range cfg.ThumbnailSizes {
+		if metadata.Paths.Thumbnails[strconv.Itoa(size)] == "" {
+			missing = append(missing, size)
+		}
+	}
+	return missing
+}
+
+// addThumbnails generates the missing thumbnails of an image from its original and records
+// them in its metadata, returning the sizes that were added
+func addThumbnails(ctx context.Context, cfg *config.Config, metadata *ImageMetadata, data []byte) []string {
+	missing := missingThumbnails(cfg, metadata)
+	if len(missing) == 0 {
+		return nil
+	}
+	keys, sizes := StoreThumbnails(ObjectAccessContext(ctx, metadata), cfg, layoutForVersion(metadata.LayoutVersion), metadata.ID, data, missing)
+	if len(keys) == 0 {
+		return nil
+	}
+	if metadata.Paths.Thumbnails == nil {
+		metadata.Paths.Thumbnails = make(map[string]string, len(keys))
+	}
+	if metadata.Sizes == nil {
+		metadata.Sizes = make(map[string]int64)
+	}
+	for size, key := range keys {
+		metadata.Paths.Thumbnails[size] = key
+		metadata.Sizes[ThumbnailSizeKey(size)] = sizes[size]
+	}
+	return slices.Sorted(maps.Keys(keys))
+}
+
+// BackfillThumbnails generates the missing thumbnails of every image of every tenant, for
+// images uploaded before thumbnails were enabled or before a size was added. It returns the
+// number of updated images.
+func BackfillThumbnails(ctx context.Context, cfg *config.Config) (int, error) {
+	if MetadataManager == nil || Storage == nil {
+		return 0, fmt.Errorf("storage and metadata store must be initialized")
+	}
+
+	updated := 0
+	for _, tenantCtx := range TenantContexts(ctx) {
+		allMetadata, err := MetadataManager.GetAllMetadata(tenantCtx)
+		if err != nil {
+			return updated, fmt.Errorf("failed to list metadata: %v", err)
+		}
+
+		for _, metadata := range allMetadata {
+			if len(missingThumbnails(cfg, metadata)) == 0 {
+				continue
+			}
+			originalKey, err := ResolveImageKey(tenantCtx, metadata.Paths.Original)
+			if err != nil {
+				logger.Warn("Skipping image without original for thumbnails",
+					zap.String("id", metadata.ID),
+					zap.Error(err))
+				continue
+			}
+			data, err := Storage.Get(tenantCtx, originalKey)
+			if err != nil {
+				logger.Warn("Failed to read original for thumbnails",
+					zap.String("id", metadata.ID),
+					zap.String("key", originalKey),
+					zap.Error(err))
+				continue
+			}
+
+			storedBefore := StoredBytes(metadata)
+			if len(addThumbnails(tenantCtx, cfg, metadata, data)) == 0 {
+				continue
+			}
+			if err := MetadataManager.SaveMetadata(tenantCtx, metadata); err != nil {
+				return updated, fmt.Errorf("failed to save metadata for %s: %v", metadata.ID, err)
+			}
+			if err := AddTenantUsage(tenantCtx, StoredBytes(metadata)-storedBefore); err != nil {
+				logger.Warn("Failed to update tenant usage",
+					zap.String("id", metadata.ID),
+					zap.Error(err))
+			}
+			updated++
+		}
+
+		if err := ClearPageCache(tenantCtx); err != nil {
+			logger.Warn("Failed to clear page cache", zap.Error(err))
+		}
+	}
+
+	logger.Info("Thumbnail backfill completed",
+		zap.Int("updated", updated))
+	return updated, nil
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
+	"github.com/redis/go-redis/v9"
+)
+
+// tracedStorage records a span around every call to a storage provider
+type tracedStorage struct {
+	StorageProvider
+	storageType string
+}
+
+func (s *tracedStorage) Store(ctx context.Context, key string, data []byte) error {
+	ctx, span := tracing.StartKind(ctx, "storage.store", tracing.KindClient,
+		tracing.String("storage.type", s.storageType),
+		tracing.String("storage.key", key),
+		tracing.Int64("storage.size", int64(len(data))))
+	defer span.End()
+	err := s.StorageProvider.Store(ctx, key, data)
+	span.RecordError(err)
+	return err
+}
+
+func (s *tracedStorage) StoreStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	ctx, span := tracing.StartKind(ctx, "storage.store", tracing.KindClient,
+		tracing.String("storage.type", s.storageType),
+		tracing.String("storage.key", key),
+		tracing.Int64("storage.size", size),
+		tracing.Bool("storage.stream", true))
+	defer span.End()
+	err := storeStream(ctx, s.StorageProvider, key, r, size)
+	span.RecordError(err)
+	return err
+}
+
+func (s *tracedStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := tracing.StartKind(ctx, "storage.get", tracing.KindClient,
+		tracing.String("storage.type", s.storageType),
+		tracing.String("storage.key", key))
+	defer span.End()
+	data, err := s.StorageProvider.Get(ctx, key)
+	span.RecordError(err)
+	span.SetAttributes(tracing.Int64("storage.size", int64(len(data))))
+	return data, err
+}
+
+func (s *tracedStorage) Delete(ctx context.Context, key string) error {
+	ctx, span := tracing.StartKind(ctx, "storage.delete", tracing.KindClient,
+		tracing.String("storage.type", s.storageType),
+		tracing.String("storage.key", key))
+	defer span.End()
+	err := s.StorageProvider.Delete(ctx, key)
+	span.RecordError(err)
+	return err
+}
+
+func (s *tracedStorage) Exists(ctx context.Context, key string) (bool, error) {
+	ctx, span := tracing.StartKind(ctx, "storage.exists", tracing.KindClient,
+		tracing.String("storage.type", s.storageType),
+		tracing.String("storage.key", key))
+	defer span.End()
+	exists, err := s.StorageProvider.Exists(ctx, key)
+	span.RecordError(err)
+	span.SetAttributes(tracing.Bool("storage.exists", exists))
+	return exists, err
+}
+
+// StorageBackend returns the configured storage provider without its tracing wrapper, for
+// code depending on a specific backend
+func StorageBackend() StorageProvider {
+	if traced, ok := Storage.(*tracedStorage); ok {
+		return traced.StorageProvider
+	}
+	return Storage
+}
+
+// redisTracingHook records a span for every Redis command and pipeline run within a trace
+type redisTracingHook struct{}
+
+func (redisTracingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisTracingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, span := tracing.StartKind(ctx, "redis."+cmd.Name(), tracing.KindClient,
+			tracing.String("db.system", "redis"),
+			tracing.String("db.operation", cmd.Name()))
+		defer span.End()
+		err := next(ctx, cmd)
+		if err != redis.Nil {
+			span.RecordError(err)
+		}
+		return err
+	}
+}
+
+func (redisTracingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		names := make([]string, 0, len(cmds))
+		for _, cmd := range cmds {
+			names = append(names, cmd.Name())
+		}
+		ctx, span := tracing.StartKind(ctx, "redis.pipeline", tracing.KindClient,
+			tracing.String("db.system", "redis"),
+			tracing.String("db.operation", strings.Join(names, " ")),
+			tracing.Int64("db.redis.commands", int64(len(cmds))))
+		defer span.End()
+		err := next(ctx, cmds)
+		if err != redis.Nil {
+			span.RecordError(err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,240 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	exportBatchSize = 512             // Spans sent per export request
+	exportInterval  = 5 * time.Second // Longest delay before queued spans are exported
+	exportQueueSize = 4096            // Spans queued at most; further spans are dropped
+)
+
+// exporter is nil while tracing is disabled
+var exporter *spanExporter
+
+// spanExporter batches finished spans and posts them to an OTLP/HTTP traces endpoint
+type spanExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+
+	queue   chan *Span
+	flush   chan chan struct{}
+	dropped atomic.Int64 // Spans dropped since the last export
+}
+
+func newSpanExporter(cfg *config.Config) *spanExporter {
+	return &spanExporter{
+		endpoint:    cfg.TracingEndpoint,
+		headers:     cfg.TracingHeaders,
+		serviceName: cfg.TracingServiceName,
+		sampleRatio: cfg.TracingSampleRatio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, exportQueueSize),
+		flush:       make(chan chan struct{}),
+	}
+}
+
+// enqueue queues a finished span without blocking the traced operation
+func (e *spanExporter) enqueue(span *Span) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == exportBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) == exportBatchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+func (e *spanExporter) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// OTLP/JSON structures (opentelemetry-proto, trace/v1)
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		var value otlpValue
+		switch v := attr.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		result = append(result, otlpAttribute{Key: attr.Key, Value: value})
+	}
+	return result
+}
+
+func toOTLPSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(span.attrs),
+	}
+	if span.parentID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	if span.errMsg != "" {
+		s.Status = otlpStatus{Code: 2, Message: span.errMsg}
+	}
+	return s
+}
+
+// export posts a batch of spans. Failed batches are dropped; tracing must never hold up
+// requests or exhaust memory when the collector is unavailable.
+func (e *spanExporter) export(batch []*Span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, toOTLPSpan(span))
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]Attribute{String("service.name", e.serviceName)}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/Yuri-NagaSaki/ImageFlow"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Warn("Failed to encode spans", zap.Error(err))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed to create span export request", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		logger.Warn("Failed to export spans",
+			zap.Int("spans", len(batch)),
+			zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Warn("Span export rejected",
+			zap.Int("spans", len(batch)),
+			zap.String("status", resp.Status))
+	}
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		logger.Warn("Dropped spans, export queue full",
+			zap.Int64("dropped", dropped))
+	}
+}
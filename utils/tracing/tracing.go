@@ -0,0 +1,268 @@
+// Package tracing records OpenTelemetry spans and exports them to an OTLP/HTTP collector
+// (JSON encoding). Traces are continued from and propagated with W3C traceparent headers.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Span kinds as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Attribute is a key/value pair recorded on a span
+type Attribute struct {
+	Key   string
+	Value interface{} // string, int64, float64 or bool
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 returns an integer attribute
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a timed operation of a trace. All methods are safe on a nil span, which is what
+// Start returns when the operation is not traced.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []Attribute
+	errMsg string
+}
+
+// SetAttributes records attributes on the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed. Nil errors are ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End completes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	exporter.enqueue(s)
+}
+
+// Inject sets the traceparent header of an outgoing request to the context's span, so the
+// called service continues the trace
+func Inject(ctx context.Context, header http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])))
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span of a context, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Enabled reports whether spans are exported
+func Enabled() bool {
+	return exporter != nil
+}
+
+// Start starts a span as a child of the context's span. Operations outside a traced request
+// are not traced: without a parent span, the context is returned unchanged with a nil span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// StartKind is Start with an explicit span kind
+func StartKind(ctx context.Context, name string, kind int, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startRoot starts the server span of a request, continuing the trace of its traceparent
+// header or starting a sampled new trace
+func startRoot(ctx context.Context, traceparent, name string, attrs ...Attribute) (context.Context, *Span) {
+	span := &Span{
+		name:  name,
+		kind:  KindServer,
+		start: time.Now(),
+		attrs: attrs,
+	}
+	if traceID, parentID, sampled, ok := parseTraceParent(traceparent); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		if mathrand.Float64() >= exporter.sampleRatio {
+			return ctx, nil
+		}
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// parseTraceParent parses a W3C traceparent header: version-traceid-parentid-flags
+func parseTraceParent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware traces every request with a server span named after the route it matches in mux
+func Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := r.URL.Path
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		ctx, span := startRoot(r.Context(), r.Header.Get("traceparent"), r.Method+" "+route,
+			String("http.request.method", r.Method),
+			String("http.route", route),
+			String("url.path", r.URL.Path))
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(Int64("http.response.status_code", int64(recorder.status)))
+		if recorder.status >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("%s", http.StatusText(recorder.status)))
+		}
+	})
+}
+
+// Init starts exporting spans to the configured OTLP endpoint. Tracing stays disabled when no
+// endpoint is configured.
+func Init(cfg *config.Config) {
+	if cfg.TracingEndpoint == "" {
+		return
+	}
+	exporter = newSpanExporter(cfg)
+	go exporter.run()
+	logger.Info("Tracing enabled",
+		zap.String("endpoint", cfg.TracingEndpoint),
+		zap.String("service", cfg.TracingServiceName),
+		zap.Float64("sample_ratio", cfg.TracingSampleRatio))
+}
+
+// Shutdown exports the spans still queued
+func Shutdown(ctx context.Context) {
+	if exporter == nil {
+		return
+	}
+	exporter.shutdown(ctx)
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// UploadQueue caps the uploaded files this instance processes at once. Files of admitted
+// requests wait in the queue for a slot; once the queue is full, further requests are rejected
+// instead of piling up goroutines and memory until conversions time out.
+type UploadQueue struct {
+	slots     chan struct{}
+	queueSize int
+
+	mu       sync.Mutex
+	queued   int   // Files reserved a place and not holding a slot yet
+	rejected int64 // Requests rejected as saturated since startup
+}
+
+// UploadQueueStats reports the load of the upload queue
+type UploadQueueStats struct {
+	MaxConcurrent int   `json:"maxConcurrent"` // MAX_CONCURRENT_UPLOADS
+	QueueSize     int   `json:"queueSize"`     // UPLOAD_QUEUE_SIZE
+	InFlight      int   `json:"inFlight"`      // Files being processed
+	Queued        int   `json:"queued"`        // Files waiting for a slot
+	Rejected      int64 `json:"rejected"`      // Requests rejected as saturated since startup
+}
+
+// Uploads is the upload queue of this instance, nil when MAX_CONCURRENT_UPLOADS is 0
+var Uploads *UploadQueue
+
+// InitUploadQueue sets up the upload queue from MAX_CONCURRENT_UPLOADS and UPLOAD_QUEUE_SIZE
+func InitUploadQueue(cfg *config.Config) {
+	if cfg.MaxConcurrentUploads <= 0 {
+		return
+	}
+	Uploads = &UploadQueue{
+		slots:     make(chan struct{}, cfg.MaxConcurrentUploads),
+		queueSize: cfg.UploadQueueSize,
+	}
+	logger.Info("Upload queue initialized",
+		zap.Int("max_concurrent", cfg.MaxConcurrentUploads),
+		zap.Int("queue_size", cfg.UploadQueueSize))
+}
+
+// Admit reserves places for the files of a request, reporting false when they do not fit in
+// the free slots and queue. An idle instance admits a request however many files it has.
+func (q *UploadQueue) Admit(files int) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	load := len(q.slots) + q.queued
+	if load > 0 && load+files > cap(q.slots)+q.queueSize {
+		q.rejected++
+		return false
+	}
+	q.queued += files
+	return true
+}
+
+// Reserve reserves places for files accepted already, such as completed resumable uploads and
+// synced objects, which wait for a slot however full the queue is
+func (q *UploadQueue) Reserve(files int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.queued += files
+	q.mu.Unlock()
+}
+
+// Acquire waits for a slot for a file with a reserved place, giving up the place when the
+// context ends first. The returned function frees the slot.
+func (q *UploadQueue) Acquire(ctx context.Context) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	var err error
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.mu.Lock()
+	q.queued--
+	q.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return func() { <-q.slots }, nil
+}
+
+// Stats returns the current load of the upload queue
+func (q *UploadQueue) Stats() UploadQueueStats {
+	if q == nil {
+		return UploadQueueStats{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return UploadQueueStats{
+		MaxConcurrent: cap(q.slots),
+		QueueSize:     q.queueSize,
+		InFlight:      len(q.slots),
+		Queued:        q.queued,
+		Rejected:      q.rejected,
+	}
+}
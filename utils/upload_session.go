@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadOffsetMismatch  = errors.New("upload offset mismatch")
+)
+
+// UploadSession is a resumable upload. Its data is appended to a file next to the session
+// until it reaches the announced length, then processed like a regular upload.
+type UploadSession struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`             // Total size announced at creation
+	Offset   int64             `json:"offset"`             // Bytes received so far
+	Metadata map[string]string `json:"metadata,omitempty"` // Upload options (filename, tags, expiryMinutes...)
+	Created  time.Time         `json:"created"`
+	Result   json.RawMessage   `json:"result,omitempty"` // Upload result once the data was processed
+}
+
+// Complete reports whether all data of the upload was received
+func (s *UploadSession) Complete() bool {
+	return s.Offset == s.Length
+}
+
+var (
+	uploadSessionDir   string
+	uploadSessionTTL   time.Duration
+	uploadSessionLocks sync.Map // Session ID -> *sync.Mutex serializing appends
+)
+
+// InitUploadSessions configures the directory and lifetime of resumable uploads
+func InitUploadSessions(cfg *config.Config) {
+	uploadSessionDir = cfg.UploadSessionPath
+	uploadSessionTTL = time.Duration(cfg.UploadSessionTTL) * time.Hour
+}
+
+// uploadSessionPath returns the path of a session file without extension. Sessions of a tenant
+// live under its own directory, so they cannot be reached with another tenant's key.
+func uploadSessionPath(ctx context.Context, id string) string {
+	return filepath.Join(uploadSessionDir, filepath.FromSlash(TenantStorageKey(ctx, id)))
+}
+
+func validUploadSessionID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+func saveUploadSession(ctx context.Context, s *UploadSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	path := uploadSessionPath(ctx, s.ID) + ".json"
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// CreateUploadSession starts a resumable upload of the given length
+func CreateUploadSession(ctx context.Context, length int64, metadata map[string]string) (*UploadSession, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate upload ID: %v", err)
+	}
+	s := &UploadSession{
+		ID:       hex.EncodeToString(idBytes),
+		Length:   length,
+		Metadata: metadata,
+		Created:  time.Now(),
+	}
+
+	path := uploadSessionPath(ctx, s.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	if err := os.WriteFile(path+".bin", nil, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	if err := saveUploadSession(ctx, s); err != nil {
+		os.Remove(path + ".bin")
+		return nil, fmt.Errorf("failed to save upload session: %v", err)
+	}
+	return s, nil
+}
+
+// GetUploadSession returns a resumable upload of the request's tenant
+func GetUploadSession(ctx context.Context, id string) (*UploadSession, error) {
+	if !validUploadSessionID(id) {
+		return nil, ErrUploadSessionNotFound
+	}
+	data, err := os.ReadFile(uploadSessionPath(ctx, id) + ".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUploadSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var s UploadSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// AppendUploadSession appends data to a resumable upload at the given offset, which must match
+// the bytes received so far. Data beyond the announced length is ignored. Progress is kept when
+// the body is interrupted, so the client can resume from the returned offset.
+func AppendUploadSession(ctx context.Context, id string, offset int64, body io.Reader) (*UploadSession, error) {
+	lock, _ := uploadSessionLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	s, err := GetUploadSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != s.Offset || s.Complete() {
+		return s, ErrUploadOffsetMismatch
+	}
+
+	f, err := os.OpenFile(uploadSessionPath(ctx, id)+".bin", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(body, s.Length-s.Offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	s.Offset += n
+	if err := saveUploadSession(ctx, s); err != nil {
+		return nil, fmt.Errorf("failed to save upload session: %v", err)
+	}
+	return s, copyErr
+}
+
+// OpenUploadSessionData opens the file holding the data received by a resumable upload
+func OpenUploadSessionData(ctx context.Context, id string) (*os.File, error) {
+	return os.Open(uploadSessionPath(ctx, id) + ".bin")
+}
+
+// CompleteUploadSession records the result of a processed upload and removes its data. The
+// session is kept until it expires so clients can fetch the result.
+func CompleteUploadSession(ctx context.Context, s *UploadSession, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	s.Result = data
+	if err := saveUploadSession(ctx, s); err != nil {
+		return err
+	}
+	if err := os.Remove(uploadSessionPath(ctx, s.ID) + ".bin"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DeleteUploadSession cancels a resumable upload
+func DeleteUploadSession(ctx context.Context, id string) error {
+	if _, err := GetUploadSession(ctx, id); err != nil {
+		return err
+	}
+	path := uploadSessionPath(ctx, id)
+	for _, ext := range []string{".bin", ".json"} {
+		if err := os.Remove(path + ext); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	uploadSessionLocks.Delete(id)
+	return nil
+}
+
+// CleanExpiredUploadSessions removes the resumable uploads of every tenant left untouched for
+// the configured lifetime, finished or not
+func CleanExpiredUploadSessions() {
+	if uploadSessionDir == "" || uploadSessionTTL <= 0 {
+		return
+	}
+
+	removed := 0
+	err := filepath.WalkDir(uploadSessionDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadSessionTTL {
+			return nil
+		}
+		base := strings.TrimSuffix(path, ".json")
+		os.Remove(base + ".bin")
+		if err := os.Remove(path); err == nil {
+			uploadSessionLocks.Delete(filepath.Base(base))
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("Failed to clean expired upload sessions", zap.Error(err))
+		return
+	}
+	if removed > 0 {
+		logger.Info("Removed expired upload sessions",
+			zap.Int("count", removed))
+	}
+}
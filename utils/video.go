@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Major brands of the MP4 files accepted as video clips
+var mp4Brands = []string{"isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "M4V ", "mmp4"}
+
+// ebmlMagic starts Matroska files, WebM among them
+var ebmlMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+
+// Settings of the images derived from video clips
+const (
+	videoPreviewSeconds = 5   // Length of the animated preview
+	videoPreviewFPS     = 12  // Frame rate of the animated preview
+	videoPreviewWidth   = 480 // Largest width of the animated preview
+	videoPreviewQuality = 60  // WebP quality of the animated preview
+	videoTimeout        = 2 * time.Minute
+)
+
+// videoEnabled is set by InitVideo when clips are accepted and ffmpeg is installed
+var videoEnabled bool
+
+// VideoClip is an uploaded video clip with the images derived from it
+type VideoClip struct {
+	Format   string  // mp4 or webm
+	Duration float64 // Length in seconds
+	Poster   []byte  // JPEG of a frame near the start, stored as the clip's original
+	Preview  []byte  // Animated WebP of the first seconds, stored as the clip's WebP variant
+}
+
+// InitVideo enables video clip uploads when VIDEO_SUPPORT is set and ffmpeg and ffprobe are
+// installed
+func InitVideo(cfg *config.Config) {
+	if !cfg.VideoSupport {
+		return
+	}
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			logger.Warn("Video support disabled: " + tool + " not found in PATH")
+			return
+		}
+	}
+	videoEnabled = true
+	logger.Info("Video support enabled", zap.Int("max_duration", cfg.MaxVideoDuration))
+}
+
+// VideoEnabled reports whether video clips are accepted
+func VideoEnabled() bool {
+	return videoEnabled
+}
+
+// VideoFormat returns the format of a video clip, mp4 or webm, or "" for other data
+func VideoFormat(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp" && slices.Contains(mp4Brands, string(data[8:12])):
+		return "mp4"
+	case bytes.HasPrefix(data, ebmlMagic) && bytes.Contains(data[:min(len(data), 64)], []byte("webm")):
+		return "webm"
+	}
+	return ""
+}
+
+// ProcessVideo derives the poster and the animated preview of a video clip with ffmpeg,
+// rejecting clips longer than MAX_VIDEO_DURATION
+func ProcessVideo(ctx context.Context, cfg *config.Config, data []byte, format string) (*VideoClip, error) {
+	// MP4 files may keep their index at the end, so ffmpeg reads clips from a file
+	file, err := os.CreateTemp("", "imageflow-video-*."+format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	return ProcessVideoFile(ctx, cfg, file.Name(), format)
+}
+
+// ProcessVideoFile is ProcessVideo for a clip in a file, such as an upload spooled to disk,
+// which is read by ffmpeg without loading it into memory
+func ProcessVideoFile(ctx context.Context, cfg *config.Config, path string, format string) (*VideoClip, error) {
+	duration, err := probeVideoDuration(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxVideoDuration > 0 && duration > float64(cfg.MaxVideoDuration) {
+		return nil, fmt.Errorf("video is %.1f seconds long, at most %d seconds are allowed", duration, cfg.MaxVideoDuration)
+	}
+
+	// The first frames are often black, so the poster is taken a little later
+	poster, err := runFFmpeg(ctx, "video.poster",
+		"-ss", strconv.FormatFloat(min(1, duration/3), 'f', 2, 64),
+		"-i", path,
+		"-frames:v", "1", "-c:v", "mjpeg", "-q:v", "2", "-f", "image2pipe", "pipe:1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract poster frame: %v", err)
+	}
+	preview, err := runFFmpeg(ctx, "video.preview",
+		"-t", strconv.Itoa(videoPreviewSeconds),
+		"-i", path,
+		"-an", "-vf", fmt.Sprintf("fps=%d,scale='min(%d,iw)':-2", videoPreviewFPS, videoPreviewWidth),
+		"-c:v", "libwebp", "-q:v", strconv.Itoa(videoPreviewQuality), "-loop", "0", "-f", "webp", "pipe:1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate preview: %v", err)
+	}
+
+	return &VideoClip{
+		Format:   format,
+		Duration: duration,
+		Poster:   poster,
+		Preview:  preview,
+	}, nil
+}
+
+// probeVideoDuration reads the length of a clip in seconds with ffprobe
+func probeVideoDuration(ctx context.Context, path string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, videoTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(stdout.String()), 64)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("failed to read video duration")
+	}
+	return duration, nil
+}
+
+// runFFmpeg runs ffmpeg in the worker pool and returns what it writes to stdout
+func runFFmpeg(ctx context.Context, task string, args ...string) ([]byte, error) {
+	return GetWorkerPool().ProcessTaskContext(ctx, task, func() ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, videoTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-v", "error", "-nostdin"}, args...)...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		if stdout.Len() == 0 {
+			return nil, fmt.Errorf("ffmpeg produced no output")
+		}
+		return stdout.Bytes(), nil
+	})
+}
+
+// VideoPreview generates the animated preview of a stored clip again
+func VideoPreview(ctx context.Context, cfg *config.Config, key string) ([]byte, error) {
+	if !VideoEnabled() {
+		return nil, fmt.Errorf("video support is not enabled")
+	}
+	data, err := Storage.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video: %v", err)
+	}
+	clip, err := ProcessVideo(ctx, cfg, data, strings.TrimPrefix(filepath.Ext(key), "."))
+	if err != nil {
+		return nil, err
+	}
+	return clip.Preview, nil
+}
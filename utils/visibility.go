@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Visibility controls who can discover and view an image
+type Visibility string
+
+const (
+	// VisibilityPublic images are served to anyone and appear in random, gallery and feeds
+	VisibilityPublic Visibility = "public"
+	// VisibilityUnlisted images are served to anyone with a link but never listed anonymously
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPrivate images are only served to requests carrying the API key
+	VisibilityPrivate Visibility = "private"
+)
+
+// AllVisibilities lists every visibility level
+var AllVisibilities = []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
+// ParseVisibility validates a visibility level name
+func ParseVisibility(s string) (Visibility, error) {
+	v := Visibility(strings.ToLower(strings.TrimSpace(s)))
+	for _, known := range AllVisibilities {
+		if v == known {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("invalid visibility: %s", s)
+}
+
+// EffectiveVisibility returns the image's visibility. Images stored before visibility levels
+// existed were served to everyone and are treated as public.
+func (m *ImageMetadata) EffectiveVisibility() Visibility {
+	if m.Visibility == "" {
+		return VisibilityPublic
+	}
+	return m.Visibility
+}
+
+// IsListable reports whether the image may appear in anonymous listings (random, gallery, feeds)
+func (m *ImageMetadata) IsListable() bool {
+	return m.EffectiveVisibility() == VisibilityPublic
+}
+
+// IsViewable reports whether the image may be served to anonymous clients that know its URL
+func (m *ImageMetadata) IsViewable() bool {
+	return m.EffectiveVisibility() != VisibilityPrivate
+}
+
+// VisibilityFromFields reads the visibility from a Redis metadata hash, including the
+// boolean "public" flag written by earlier versions
+func VisibilityFromFields(data map[string]string) Visibility {
+	if v, err := ParseVisibility(data["visibility"]); err == nil {
+		return v
+	}
+	if data["public"] == "true" {
+		return VisibilityPublic
+	}
+	return ""
+}
+
+func visibilityIndexKey(ctx context.Context, v Visibility) string {
+	return KeyPrefix(ctx) + "visibility:" + string(v)
+}
+
+// GetImageIDsByVisibility returns the IDs of all images with the given visibility, newest first
+func GetImageIDsByVisibility(ctx context.Context, v Visibility) ([]string, error) {
+	if !IsRedisMetadataStore() {
+		return nil, fmt.Errorf("redis is not enabled")
+	}
+
+	ids, err := RedisClient.ZRevRange(ctx, visibilityIndexKey(ctx, v), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s images from Redis: %v", v, err)
+	}
+	return ids, nil
+}
+
+// SetImageVisibility changes the visibility of an image
+func SetImageVisibility(ctx context.Context, id string, v Visibility) (*ImageMetadata, error) {
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Visibility == v {
+		return metadata, nil
+	}
+
+	wasViewable := metadata.IsViewable()
+	metadata.Visibility = v
+	if err := MetadataManager.SaveMetadata(ctx, metadata); err != nil {
+		return nil, err
+	}
+
+	// Objects of private images are not publicly readable in storage
+	if metadata.IsViewable() != wasViewable {
+		if err := ApplyObjectAccess(ctx, metadata); err != nil {
+			logger.Warn("Failed to update object access",
+				zap.String("id", id),
+				zap.Error(err))
+		}
+	}
+	return metadata, nil
+}
+
+// IsImageListable reports whether the image with the given ID may appear in anonymous listings.
+// Files without metadata predate the metadata store and are treated as public.
+func IsImageListable(ctx context.Context, id string) bool {
+	if MetadataManager == nil {
+		return true
+	}
+	metadata, err := MetadataManager.GetMetadata(ctx, id)
+	if err != nil {
+		return true
+	}
+	return metadata.IsListable()
+}
+
+// BackfillVisibilityIndex adds images stored before visibility levels existed to the public
+// index. It runs once per Redis prefix.
+func BackfillVisibilityIndex(ctx context.Context) error {
+	if !IsRedisMetadataStore() {
+		return nil
+	}
+
+	markerKey := KeyPrefix(ctx) + "visibility_indexed"
+	if done, err := RedisClient.Exists(ctx, markerKey).Result(); err != nil || done > 0 {
+		return err
+	}
+
+	images, err := RedisClient.ZRangeWithScores(ctx, KeyPrefix(ctx)+"images", 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list images: %v", err)
+	}
+
+	indexed := 0
+	for _, z := range images {
+		id, ok := z.Member.(string)
+		if !ok {
+			continue
+		}
+		v, err := RedisClient.HGet(ctx, KeyPrefix(ctx)+"metadata:"+id, "visibility").Result()
+		if err == nil && v != "" {
+			continue
+		}
+		pipe := RedisClient.Pipeline()
+		pipe.HSet(ctx, KeyPrefix(ctx)+"metadata:"+id, "visibility", string(VisibilityPublic))
+		pipe.ZAdd(ctx, visibilityIndexKey(ctx, VisibilityPublic), redis.Z{Score: z.Score, Member: id})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to index %s: %v", id, err)
+		}
+		indexed++
+	}
+
+	if indexed > 0 {
+		logger.Info("Backfilled visibility index", zap.Int("images", indexed))
+	}
+	return RedisClient.Set(ctx, markerKey, "1", 0).Err()
+}
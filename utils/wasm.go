@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.uber.org/zap"
+)
+
+// Functions a WASM plugin exports. A plugin exports alloc and memory, and transform, tag or both.
+//
+//	alloc(size u32) -> ptr u32        reserves size bytes of guest memory for the input image
+//	transform(ptr, len u32) -> u64    returns the new image as ptr<<32|len; len 0 keeps the image
+//	tag(ptr, len u32) -> u64          returns comma or newline separated tags as ptr<<32|len
+const (
+	WasmTransform = "transform"
+	WasmTag       = "tag"
+)
+
+// WasmPlugin is a sandboxed WebAssembly module from the WASM plugins file. Modules run in the
+// worker pool without file system, network or environment access, and are stopped when they
+// exceed their memory limit or timeout.
+type WasmPlugin struct {
+	Name          string `json:"name"`
+	Path          string `json:"path"`          // Compiled module (.wasm)
+	MemoryLimitMB int    `json:"memoryLimitMB"` // Largest guest memory in MB, input image included (default 128)
+	Timeout       int    `json:"timeout"`       // Longest run in seconds (default 10)
+	Required      bool   `json:"required"`      // Reject the upload when the plugin fails instead of skipping it
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	exports  map[string]bool
+}
+
+// wasmPlugins are compiled at startup and run in file order
+var wasmPlugins []*WasmPlugin
+
+// LoadWasmPlugins compiles the plugins of the WASM plugins file. A missing file is not an
+// error; plugins are optional.
+func LoadWasmPlugins(cfg *config.Config) error {
+	if cfg.WasmPluginsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(cfg.WasmPluginsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WASM plugins file: %v", err)
+	}
+
+	var file struct {
+		Plugins []*WasmPlugin `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse WASM plugins file: %v", err)
+	}
+
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	for _, p := range file.Plugins {
+		if p.Name == "" {
+			return fmt.Errorf("WASM plugin without a name")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate WASM plugin: %s", p.Name)
+		}
+		seen[p.Name] = true
+		if p.MemoryLimitMB <= 0 {
+			p.MemoryLimitMB = 128
+		}
+		if p.Timeout <= 0 {
+			p.Timeout = 10
+		}
+		if err := p.compile(ctx); err != nil {
+			return fmt.Errorf("WASM plugin %s: %v", p.Name, err)
+		}
+	}
+
+	wasmPlugins = file.Plugins
+	for _, p := range wasmPlugins {
+		logger.Info("Loaded WASM plugin",
+			zap.String("plugin", p.Name),
+			zap.Bool("transform", p.exports[WasmTransform]),
+			zap.Bool("tag", p.exports[WasmTag]),
+			zap.Int("memory_limit_mb", p.MemoryLimitMB))
+	}
+	return nil
+}
+
+// compile validates and compiles the module once; every call then runs a fresh instance
+func (p *WasmPlugin) compile(ctx context.Context) error {
+	code, err := os.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+
+	// 64 KiB pages; CloseOnContextDone interrupts modules running past their timeout
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(p.MemoryLimitMB) * 16).
+		WithCloseOnContextDone(true)
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	wasi_snapshot_preview1.MustInstantiate(ctx, p.runtime)
+
+	p.compiled, err = p.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return fmt.Errorf("failed to compile module: %v", err)
+	}
+
+	exported := p.compiled.ExportedFunctions()
+	if _, ok := exported["alloc"]; !ok {
+		return fmt.Errorf("module does not export alloc")
+	}
+	if _, ok := p.compiled.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("module does not export memory")
+	}
+	p.exports = make(map[string]bool)
+	for _, name := range []string{WasmTransform, WasmTag} {
+		if _, ok := exported[name]; ok {
+			p.exports[name] = true
+		}
+	}
+	if len(p.exports) == 0 {
+		return fmt.Errorf("module exports neither transform nor tag")
+	}
+	return nil
+}
+
+// call runs an exported function of a new module instance on data and returns its output,
+// nil when the function returned none
+func (p *WasmPlugin) call(ctx context.Context, function string, data []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout)*time.Second)
+	defer cancel()
+
+	// Reactor modules initialize through _initialize; start functions a module lacks are skipped
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate module: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	results, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc failed: %v", err)
+	}
+	ptr := api.DecodeU32(results[0])
+	if !mod.Memory().Write(ptr, data) {
+		return nil, fmt.Errorf("alloc returned an invalid buffer")
+	}
+
+	results, err = mod.ExportedFunction(function).Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s exceeded the timeout of %ds", function, p.Timeout)
+		}
+		return nil, fmt.Errorf("%s failed: %v", function, err)
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	if outLen == 0 {
+		return nil, nil
+	}
+	output, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("%s returned an invalid buffer", function)
+	}
+	// The view into guest memory is released with the instance
+	return append([]byte(nil), output...), nil
+}
+
+// run calls a plugin function in the worker pool
+func (p *WasmPlugin) run(ctx context.Context, function string, data []byte) ([]byte, error) {
+	return GetWorkerPool().ProcessTaskContext(ctx, "wasm."+p.Name+"."+function, func() ([]byte, error) {
+		return p.call(ctx, function, data)
+	})
+}
+
+// HasWasmPlugins reports whether any enabled plugin exports a function (WasmTransform or WasmTag)
+func HasWasmPlugins(function string) bool {
+	if len(wasmPlugins) == 0 || !FeatureEnabled(FeatureWasmPlugins) {
+		return false
+	}
+	for _, p := range wasmPlugins {
+		if p.exports[function] {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyWasmTransforms passes an uploaded image through every transform plugin in turn. Failed
+// plugins are skipped unless required.
+func ApplyWasmTransforms(ctx context.Context, data []byte) ([]byte, error) {
+	for _, p := range wasmPlugins {
+		if !p.exports[WasmTransform] {
+			continue
+		}
+		output, err := p.run(ctx, WasmTransform, data)
+		if err != nil {
+			if p.Required {
+				return nil, fmt.Errorf("WASM plugin %s: %v", p.Name, err)
+			}
+			logger.Warn("WASM transform failed, skipping it",
+				zap.String("plugin", p.Name),
+				zap.Error(err))
+			continue
+		}
+		if output != nil {
+			data = output
+		}
+	}
+	return data, nil
+}
+
+// WasmTags returns the tags the tag plugins derive from an image. Failed plugins are skipped
+// unless required.
+func WasmTags(ctx context.Context, data []byte) ([]string, error) {
+	var tags []string
+	for _, p := range wasmPlugins {
+		if !p.exports[WasmTag] {
+			continue
+		}
+		output, err := p.run(ctx, WasmTag, data)
+		if err != nil {
+			if p.Required {
+				return nil, fmt.Errorf("WASM plugin %s: %v", p.Name, err)
+			}
+			logger.Warn("WASM tagger failed, skipping it",
+				zap.String("plugin", p.Name),
+				zap.Error(err))
+			continue
+		}
+		for _, tag := range strings.FieldsFunc(string(output), func(r rune) bool { return r == ',' || r == '\n' }) {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"sync"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+	"github.com/h2non/bimg"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark positions
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// Watermark defaults
+const (
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkSize    = 0.2
+)
+
+// Watermark is an overlay drawn on the WebP and AVIF variants of uploads. Originals are stored
+// without it.
+type Watermark struct {
+	Text     string  `json:"text,omitempty"`     // Text drawn as the watermark
+	Image    string  `json:"image,omitempty"`    // PNG file drawn as the watermark instead of the text
+	Position string  `json:"position,omitempty"` // top-left, top-right, bottom-left, bottom-right (default) or center
+	Opacity  float64 `json:"opacity,omitempty"`  // 0-1 (default 0.5)
+	Size     float64 `json:"size,omitempty"`     // Width as a fraction of the image width (default 0.2)
+	Disabled bool    `json:"disabled,omitempty"` // Turns off the watermark a profile or upload would get
+}
+
+// GlobalWatermark returns the watermark configured with the WATERMARK_* settings, or nil
+func GlobalWatermark(cfg *config.Config) *Watermark {
+	if cfg.WatermarkText == "" && cfg.WatermarkImage == "" {
+		return nil
+	}
+	return &Watermark{
+		Text:     cfg.WatermarkText,
+		Image:    cfg.WatermarkImage,
+		Position: cfg.WatermarkPosition,
+		Opacity:  cfg.WatermarkOpacity,
+		Size:     cfg.WatermarkSize,
+	}
+}
+
+// Validate checks the settings of a watermark and that its image can be loaded
+func (w *Watermark) Validate() error {
+	switch w.Position {
+	case "", WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter:
+	default:
+		return fmt.Errorf("invalid watermark position: %s", w.Position)
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+	if w.Size < 0 || w.Size > 1 {
+		return fmt.Errorf("watermark size must be between 0 and 1")
+	}
+	if w.Image != "" {
+		if _, err := loadWatermarkImage(w.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Override returns the watermark with the settings of another applied: none when the other is
+// disabled, otherwise the settings the other sets replacing those of the watermark. It returns
+// nil when the result has neither text nor image.
+func (w *Watermark) Override(other *Watermark) *Watermark {
+	if other == nil {
+		return w
+	}
+	if other.Disabled {
+		return nil
+	}
+
+	var result Watermark
+	if w != nil {
+		result = *w
+	}
+	if other.Text != "" || other.Image != "" {
+		result.Text, result.Image = other.Text, other.Image
+	}
+	if other.Position != "" {
+		result.Position = other.Position
+	}
+	if other.Opacity > 0 {
+		result.Opacity = other.Opacity
+	}
+	if other.Size > 0 {
+		result.Size = other.Size
+	}
+	if result.Text == "" && result.Image == "" {
+		return nil
+	}
+	return &result
+}
+
+// watermarkImages caches decoded watermark image files by path
+var watermarkImages sync.Map
+
+var (
+	watermarkFont     *opentype.Font
+	watermarkFontOnce sync.Once
+	watermarkFontErr  error
+)
+
+// watermarkImageOptions renders a watermark for an image to the overlay bimg draws during
+// conversion, scaled to the image and placed at its position with a margin
+func watermarkImageOptions(data []byte, w *Watermark) (bimg.WatermarkImage, error) {
+	width, height, err := DisplayDimensions(data)
+	if err != nil {
+		return bimg.WatermarkImage{}, fmt.Errorf("failed to read image dimensions: %v", err)
+	}
+
+	size := w.Size
+	if size == 0 {
+		size = defaultWatermarkSize
+	}
+	// The overlay fits inside the image with its margin on every side
+	margin := max(width, height) / 50
+	maxWidth, maxHeight := width-2*margin, height-2*margin
+	targetWidth := min(max(int(float64(width)*size), 16), maxWidth)
+
+	var overlay image.Image
+	if w.Image != "" {
+		overlay, err = loadWatermarkImage(w.Image)
+	} else {
+		overlay, err = renderWatermarkText(w.Text)
+	}
+	if err != nil {
+		return bimg.WatermarkImage{}, err
+	}
+	bounds := overlay.Bounds()
+	targetHeight := bounds.Dy() * targetWidth / bounds.Dx()
+	if targetHeight > maxHeight {
+		targetWidth, targetHeight = bounds.Dx()*maxHeight/bounds.Dy(), maxHeight
+	}
+	if targetWidth <= 0 || targetHeight <= 0 {
+		return bimg.WatermarkImage{}, fmt.Errorf("image too small for a watermark")
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), overlay, bounds, draw.Src, nil)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaled); err != nil {
+		return bimg.WatermarkImage{}, fmt.Errorf("failed to encode watermark: %v", err)
+	}
+
+	left, top := margin, margin
+	switch w.Position {
+	case WatermarkTopRight:
+		left = width - margin - targetWidth
+	case WatermarkBottomLeft:
+		top = height - margin - targetHeight
+	case WatermarkCenter:
+		left, top = (width-targetWidth)/2, (height-targetHeight)/2
+	case WatermarkTopLeft:
+	default:
+		left, top = width-margin-targetWidth, height-margin-targetHeight
+	}
+
+	opacity := w.Opacity
+	if opacity == 0 {
+		opacity = defaultWatermarkOpacity
+	}
+	return bimg.WatermarkImage{
+		Left:    left,
+		Top:     top,
+		Buf:     buf.Bytes(),
+		Opacity: float32(opacity),
+	}, nil
+}
+
+func loadWatermarkImage(path string) (image.Image, error) {
+	if cached, ok := watermarkImages.Load(path); ok {
+		return cached.(image.Image), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark image: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark image: %v", err)
+	}
+	watermarkImages.Store(path, img)
+	return img, nil
+}
+
+// renderWatermarkText draws text in white with a dark outline, legible on light and dark
+// images, large enough to be scaled down to any watermark size
+func renderWatermarkText(text string) (image.Image, error) {
+	watermarkFontOnce.Do(func() {
+		watermarkFont, watermarkFontErr = opentype.Parse(gobold.TTF)
+	})
+	if watermarkFontErr != nil {
+		return nil, fmt.Errorf("failed to load watermark font: %v", watermarkFontErr)
+	}
+	face, err := opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: 96, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watermark font: %v", err)
+	}
+	defer face.Close()
+
+	const outline = 3
+	metrics := face.Metrics()
+	textWidth := font.MeasureString(face, text).Ceil()
+	if textWidth == 0 {
+		return nil, fmt.Errorf("watermark text is empty")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, textWidth+2*outline, (metrics.Ascent+metrics.Descent).Ceil()+2*outline))
+	baseline := fixed.P(outline, outline+metrics.Ascent.Ceil())
+
+	drawer := &font.Drawer{Dst: img, Face: face, Src: image.NewUniform(color.NRGBA{0, 0, 0, 160})}
+	for dx := -outline; dx <= outline; dx += outline {
+		for dy := -outline; dy <= outline; dy += outline {
+			drawer.Dot = baseline.Add(fixed.P(dx, dy))
+			drawer.DrawString(text)
+		}
+	}
+	drawer.Src = image.White
+	drawer.Dot = baseline
+	drawer.DrawString(text)
+	return img, nil
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+)
+
+// widgetTokenPrefix marks upload widget tokens, telling them apart from API keys
+const widgetTokenPrefix = "wt_"
+
+// WidgetToken is the scope of an upload widget token: what a static site embedding the widget
+// may upload, and how. Tokens are signed rather than stored, so they stay valid until they
+// expire or the signing secret changes.
+type WidgetToken struct {
+	Origins       []string   `json:"origins,omitempty"`       // Origins of the pages allowed to use the token, any when empty
+	Tags          []string   `json:"tags,omitempty"`          // Tags of every upload
+	Profile       string     `json:"profile,omitempty"`       // Processing profile of every upload, selected automatically when empty
+	Visibility    Visibility `json:"visibility,omitempty"`    // Visibility of every upload
+	ExpiryMinutes int        `json:"expiryMinutes,omitempty"` // Expiry of every upload (0 = never)
+	MaxFiles      int        `json:"maxFiles,omitempty"`      // Files per request, MAX_UPLOAD_COUNT when 0
+	MaxFileSize   int64      `json:"maxFileSize,omitempty"`   // Bytes per file, unlimited when 0
+	Tenant        string     `json:"tenant,omitempty"`        // Tenant the uploads go to
+	ExpiresAt     int64      `json:"exp"`                     // Unix time the token expires at
+}
+
+// AllowsOrigin reports whether the token may be used by a page of an origin. Requests without
+// an Origin header only pass tokens allowing any origin.
+func (t *WidgetToken) AllowsOrigin(origin string) bool {
+	return len(t.Origins) == 0 || slices.Contains(t.Origins, strings.ToLower(origin))
+}
+
+func widgetTokenSignature(cfg *config.Config, payload string) string {
+	mac := hmac.New(sha256.New, signingKey(cfg))
+	fmt.Fprintf(mac, "widget\n%s", payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignWidgetToken encodes a widget token signed with the signing secret
+func SignWidgetToken(cfg *config.Config, token *WidgetToken) (string, error) {
+	if len(signingKey(cfg)) == 0 {
+		return "", fmt.Errorf("no signing secret configured")
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode widget token: %v", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return widgetTokenPrefix + payload + "." + widgetTokenSignature(cfg, payload), nil
+}
+
+// VerifyWidgetToken decodes a widget token, checking its signature and expiry
+func VerifyWidgetToken(cfg *config.Config, value string) (*WidgetToken, error) {
+	if len(signingKey(cfg)) == 0 {
+		return nil, fmt.Errorf("no signing secret configured")
+	}
+	payload, signature, ok := strings.Cut(strings.TrimPrefix(value, widgetTokenPrefix), ".")
+	if !ok || !strings.HasPrefix(value, widgetTokenPrefix) {
+		return nil, fmt.Errorf("malformed widget token")
+	}
+	if !hmac.Equal([]byte(signature), []byte(widgetTokenSignature(cfg, payload))) {
+		return nil, fmt.Errorf("invalid widget token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed widget token")
+	}
+	var token WidgetToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("malformed widget token")
+	}
+	if time.Now().Unix() > token.ExpiresAt {
+		return nil, fmt.Errorf("widget token expired")
+	}
+	return &token, nil
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yuri-NagaSaki/ImageFlow/config"
+)
+
+func TestVerifyWidgetToken(t *testing.T) {
+	cfg := &config.Config{SigningSecret: "secret"}
+	sign := func(t *testing.T, cfg *config.Config, token *WidgetToken) string {
+		value, err := SignWidgetToken(cfg, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	valid := &WidgetToken{Origins: []string{"https://example.com"}, Tags: []string{"blog"}, MaxFiles: 3, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	expired := &WidgetToken{ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		value   func(t *testing.T) string
+		wantErr string
+	}{
+		{"valid", cfg, func(t *testing.T) string { return sign(t, cfg, valid) }, ""},
+		{"API key fallback", &config.Config{APIKey: "key"}, func(t *testing.T) string { return sign(t, &config.Config{APIKey: "key"}, valid) }, ""},
+		{"expired", cfg, func(t *testing.T) string { return sign(t, cfg, expired) }, "expired"},
+		{"other secret", cfg, func(t *testing.T) string { return sign(t, &config.Config{SigningSecret: "other"}, valid) }, "invalid widget token signature"},
+		{"tampered payload", cfg, func(t *testing.T) string {
+			value := sign(t, cfg, valid)
+			_, signature, _ := strings.Cut(value, ".")
+			payload := strings.TrimPrefix(sign(t, cfg, &WidgetToken{ExpiresAt: valid.ExpiresAt}), widgetTokenPrefix)
+			payload, _, _ = strings.Cut(payload, ".")
+			return widgetTokenPrefix + payload + "." + signature
+		}, "invalid widget token signature"},
+		{"missing prefix", cfg, func(t *testing.T) string { return strings.TrimPrefix(sign(t, cfg, valid), widgetTokenPrefix) }, "malformed"},
+		{"missing signature", cfg, func(t *testing.T) string { return widgetTokenPrefix + "payload" }, "malformed"},
+		{"invalid payload", cfg, func(t *testing.T) string { return widgetTokenPrefix + "!!." + widgetTokenSignature(cfg, "!!") }, "malformed"},
+		{"no secret", &config.Config{}, func(t *testing.T) string { return sign(t, cfg, valid) }, "no signing secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := VerifyWidgetToken(tt.cfg, tt.value(t))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("VerifyWidgetToken() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyWidgetToken() error = %v", err)
+			}
+			if !token.AllowsOrigin("https://example.com") || token.AllowsOrigin("https://evil.example") ||
+				token.MaxFiles != valid.MaxFiles || len(token.Tags) != 1 || token.Tags[0] != "blog" {
+				t.Errorf("VerifyWidgetToken() = %+v, want %+v", token, valid)
+			}
+		})
+	}
+}
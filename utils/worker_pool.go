@@ -1,10 +1,15 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Yuri-NagaSaki/ImageFlow/config"
 	"github.com/Yuri-NagaSaki/ImageFlow/utils/logger"
+	"github.com/Yuri-NagaSaki/ImageFlow/utils/tracing"
 	"go.uber.org/zap"
 )
 
@@ -26,6 +31,21 @@ type WorkerPool struct {
 	workerCount int
 	wg          sync.WaitGroup
 	once        sync.Once
+	queued      atomic.Int64 // Tasks submitted and not picked up by a worker yet
+	busy        atomic.Int64 // Workers running a task
+
+	mu     sync.RWMutex // Held by Submit while sending, so Shutdown never closes the queue under it
+	closed bool
+}
+
+// errWorkerPoolClosed fails tasks submitted after Shutdown
+var errWorkerPoolClosed = errors.New("worker pool is shut down")
+
+// WorkerPoolStats reports the load of the worker pool
+type WorkerPoolStats struct {
+	Workers int   `json:"workers"`
+	Busy    int64 `json:"busy"`   // Workers running a task
+	Queued  int64 `json:"queued"` // Tasks waiting for a worker, including callers blocked on a full queue
 }
 
 var (
@@ -89,16 +109,19 @@ func (p *WorkerPool) worker(id int) {
 		zap.Int("worker_id", id))
 
 	for task := range p.taskQueue {
-		logger.Debug("Processing task",
+		p.queued.Add(-1)
+		p.busy.Add(1)
+		conversionLog.Debug("Processing task",
 			zap.Int("worker_id", id))
 
 		data, err := task.Process()
+		p.busy.Add(-1)
 		if err != nil {
 			logger.Error("Task processing failed",
 				zap.Int("worker_id", id),
 				zap.Error(err))
 		} else {
-			logger.Debug("Task completed successfully",
+			conversionLog.Debug("Task completed successfully",
 				zap.Int("worker_id", id),
 				zap.Int("data_size", len(data)))
 		}
@@ -114,11 +137,19 @@ func (p *WorkerPool) worker(id int) {
 // Submit adds a task to the worker pool queue and returns a channel for the result
 func (p *WorkerPool) Submit(process func() ([]byte, error)) <-chan TaskResult {
 	resultChan := make(chan TaskResult, 1)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		resultChan <- TaskResult{Error: errWorkerPoolClosed}
+		close(resultChan)
+		return resultChan
+	}
+	p.queued.Add(1)
 	p.taskQueue <- Task{
 		Process: process,
 		Result:  resultChan,
 	}
-	logger.Debug("Task submitted to worker pool")
+	conversionLog.Debug("Task submitted to worker pool")
 	return resultChan
 }
 
@@ -132,10 +163,38 @@ func (p *WorkerPool) ProcessTask(process func() ([]byte, error)) ([]byte, error)
 	return result.Data, result.Error
 }
 
+// ProcessTaskContext is ProcessTask recording a span of the given name in the context's trace,
+// including the time the task waited for a free worker
+func (p *WorkerPool) ProcessTaskContext(ctx context.Context, name string, process func() ([]byte, error)) ([]byte, error) {
+	_, span := tracing.Start(ctx, name)
+	defer span.End()
+
+	queued := time.Now()
+	data, err := p.ProcessTask(func() ([]byte, error) {
+		span.SetAttributes(tracing.Int64("worker_pool.queue_wait_ms", time.Since(queued).Milliseconds()))
+		return process()
+	})
+	span.RecordError(err)
+	span.SetAttributes(tracing.Int64("worker_pool.output_size", int64(len(data))))
+	return data, err
+}
+
+// Stats returns the current load of the worker pool
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Workers: p.workerCount,
+		Busy:    p.busy.Load(),
+		Queued:  p.queued.Load(),
+	}
+}
+
 // Shutdown gracefully stops the worker pool after all tasks are processed
 func (p *WorkerPool) Shutdown() {
 	logger.Info("Initiating worker pool shutdown")
+	p.mu.Lock()
+	p.closed = true
 	close(p.taskQueue)
+	p.mu.Unlock()
 	p.wg.Wait()
 	logger.Info("Worker pool shutdown complete",
 		zap.Int("worker_count", p.workerCount))